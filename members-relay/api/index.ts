@@ -16,6 +16,11 @@ const pool = new Pool({
 
 const API_SECRET = process.env.API_SECRET;
 const RELAY_ADMIN_PUBKEY = process.env.RELAY_ADMIN_PUBKEY;
+// Community this API instance manages; the relay can host several on one
+// database, each with its own members (see relay/community.go). Every query
+// over relay data is confined to it; those kept in *_SQL constants are run
+// against two communities by the relay's TestAPIQueriesStayInCommunity.
+const COMMUNITY = process.env.COMMUNITY || 'default';
 
 if (!API_SECRET || !RELAY_ADMIN_PUBKEY) {
   console.error('Missing required environment variables');
@@ -208,8 +213,8 @@ app.post('/api/members', authenticate, async (req: Request, res: Response) => {
     }
 
     const existing = await pool.query(
-      'SELECT * FROM members WHERE pubkey = $1',
-      [pubkey]
+      'SELECT * FROM members WHERE pubkey = $1 AND community = $2',
+      [pubkey, COMMUNITY]
     );
 
     if (existing.rows.length > 0) {
@@ -227,9 +232,9 @@ app.post('/api/members', authenticate, async (req: Request, res: Response) => {
           payment_id = COALESCE($3, payment_id),
           payment_method = COALESCE($4, payment_method),
           updated_at = NOW()
-        WHERE pubkey = $5
+        WHERE pubkey = $5 AND community = $6
         RETURNING *`,
-        [tier, newEnd, payment_id, payment_method, pubkey]
+        [tier, newEnd, payment_id, payment_method, pubkey, COMMUNITY]
       );
 
       console.log(`[API] Extended membership for ${pubkey} until ${newEnd}`);
@@ -244,10 +249,10 @@ app.post('/api/members', authenticate, async (req: Request, res: Response) => {
     const subscriptionEnd = calculateEndDate(subscription_months);
 
     const result = await pool.query(
-      `INSERT INTO members (pubkey, status, tier, subscription_start, subscription_end, payment_id, payment_method)
-       VALUES ($1, 'active', $2, NOW(), $3, $4, $5)
+      `INSERT INTO members (pubkey, status, tier, subscription_start, subscription_end, payment_id, payment_method, community)
+       VALUES ($1, 'active', $2, NOW(), $3, $4, $5, $6)
        RETURNING *`,
-      [pubkey, tier, subscriptionEnd, payment_id, payment_method]
+      [pubkey, tier, subscriptionEnd, payment_id, payment_method, COMMUNITY]
     );
 
     console.log(`[API] Created new membership for ${pubkey} until ${subscriptionEnd}`);
@@ -263,6 +268,14 @@ app.post('/api/members', authenticate, async (req: Request, res: Response) => {
   }
 });
 
+// Relay-issued badges a member holds in COMMUNITY: badge_awards has no
+// community of its own, so it is that of the award event.
+const MEMBER_BADGES_SQL = `
+  SELECT b.badge, b.event_id, b.awarded_at FROM badge_awards b
+  JOIN events e ON e.id = b.event_id AND e.community = $1
+  WHERE b.recipient = $2 AND b.revoked_at IS NULL
+  ORDER BY b.awarded_at`;
+
 app.get('/api/members/:pubkey', authenticate, async (req: Request, res: Response) => {
   try {
     const { pubkey } = req.params;
@@ -280,8 +293,8 @@ app.get('/api/members/:pubkey', authenticate, async (req: Request, res: Response
         subscription_end,
         EXTRACT(DAY FROM subscription_end - NOW()) as days_remaining,
         created_at
-      FROM members WHERE pubkey = $1`,
-      [pubkey]
+      FROM members WHERE pubkey = $1 AND community = $2`,
+      [pubkey, COMMUNITY]
     );
 
     if (result.rows.length === 0) {
@@ -292,9 +305,13 @@ app.get('/api/members/:pubkey', authenticate, async (req: Request, res: Response
     const isActive = ['active', 'grace'].includes(member.status) &&
       new Date(member.subscription_end) > new Date();
 
+    // Relay-issued NIP-58 badges currently held (see relay/badges.go)
+    const badges = await pool.query(MEMBER_BADGES_SQL, [COMMUNITY, pubkey]);
+
     res.json({
       is_member: isActive,
       ...member,
+      badges: badges.rows,
     });
   } catch (error) {
     console.error('[API] Error getting member:', error);
@@ -313,11 +330,11 @@ app.get('/api/members/:pubkey/check', authenticate, async (req: Request, res: Re
     const result = await pool.query(
       `SELECT EXISTS (
         SELECT 1 FROM members
-        WHERE pubkey = $1
+        WHERE pubkey = $1 AND community = $2
         AND status IN ('active', 'grace')
         AND subscription_end > NOW()
       ) as is_member`,
-      [pubkey]
+      [pubkey, COMMUNITY]
     );
 
     res.json({ is_member: result.rows[0].is_member });
@@ -341,8 +358,8 @@ app.post('/api/members/:pubkey/renew', authenticate, async (req: Request, res: R
     }
 
     const existing = await pool.query(
-      'SELECT * FROM members WHERE pubkey = $1',
-      [pubkey]
+      'SELECT * FROM members WHERE pubkey = $1 AND community = $2',
+      [pubkey, COMMUNITY]
     );
 
     if (existing.rows.length === 0) {
@@ -361,9 +378,9 @@ app.post('/api/members/:pubkey/renew', authenticate, async (req: Request, res: R
         subscription_end = $1,
         payment_id = COALESCE($2, payment_id),
         updated_at = NOW()
-      WHERE pubkey = $3
+      WHERE pubkey = $3 AND community = $4
       RETURNING *`,
-      [newEnd, payment_id, pubkey]
+      [newEnd, payment_id, pubkey, COMMUNITY]
     );
 
     console.log(`[API] Renewed membership for ${pubkey} until ${newEnd}`);
@@ -389,9 +406,9 @@ app.delete('/api/members/:pubkey', authenticate, async (req: Request, res: Respo
 
     const result = await pool.query(
       `UPDATE members SET status = 'cancelled', updated_at = NOW()
-       WHERE pubkey = $1
+       WHERE pubkey = $1 AND community = $2
        RETURNING *`,
-      [pubkey]
+      [pubkey, COMMUNITY]
     );
 
     if (result.rows.length === 0) {
@@ -416,8 +433,8 @@ app.get('/api/members', authenticate, async (req: Request, res: Response) => {
     const { status, search, limit = 100, offset = 0 } = req.query;
 
     let query = 'SELECT * FROM members';
-    const params: any[] = [];
-    const conditions: string[] = [];
+    const params: any[] = [COMMUNITY];
+    const conditions: string[] = ['community = $1'];
 
     if (status) {
       conditions.push(`status = $${params.length + 1}`);
@@ -439,9 +456,9 @@ app.get('/api/members', authenticate, async (req: Request, res: Response) => {
     const result = await pool.query(query, params);
 
     let countQuery = 'SELECT COUNT(*) FROM members';
-    const countParams: any[] = [];
+    const countParams: any[] = [COMMUNITY];
     if (conditions.length > 0) {
-      const countConditions: string[] = [];
+      const countConditions: string[] = ['community = $1'];
       if (status) {
         countConditions.push(`status = $${countParams.length + 1}`);
         countParams.push(status);
@@ -499,10 +516,10 @@ app.get('/api/members/expiring', authenticate, async (req: Request, res: Respons
         subscription_end,
         EXTRACT(DAY FROM subscription_end - NOW()) as days_remaining
       FROM members
-      WHERE status = 'active'
+      WHERE status = 'active' AND community = $2
       AND subscription_end BETWEEN NOW() AND NOW() + INTERVAL '1 day' * $1
       ORDER BY subscription_end`,
-      [days]
+      [days, COMMUNITY]
     );
 
     res.json({
@@ -515,6 +532,13 @@ app.get('/api/members/expiring', authenticate, async (req: Request, res: Respons
   }
 });
 
+const EVENT_STATS_SQL = `
+  SELECT
+    COUNT(*) as total_events,
+    COUNT(*) FILTER (WHERE kind = 30023) as recipes,
+    COUNT(*) FILTER (WHERE kind = 9) as group_messages
+  FROM events WHERE community = $1`;
+
 app.get('/api/stats', authenticate, async (req: Request, res: Response) => {
   try {
     const stats = await pool.query(`
@@ -525,16 +549,10 @@ app.get('/api/stats', authenticate, async (req: Request, res: Response) => {
         COUNT(*) FILTER (WHERE status = 'grace') as grace_period,
         COUNT(*) FILTER (WHERE created_at > NOW() - INTERVAL '30 days') as new_last_30_days,
         COUNT(*) FILTER (WHERE subscription_end BETWEEN NOW() AND NOW() + INTERVAL '7 days') as expiring_7_days
-      FROM members
-    `);
+      FROM members WHERE community = $1
+    `, [COMMUNITY]);
 
-    const eventStats = await pool.query(`
-      SELECT
-        COUNT(*) as total_events,
-        COUNT(*) FILTER (WHERE kind = 30023) as recipes,
-        COUNT(*) FILTER (WHERE kind = 9) as group_messages
-      FROM events
-    `);
+    const eventStats = await pool.query(EVENT_STATS_SQL, [COMMUNITY]);
 
     res.json({
       members: stats.rows[0],
@@ -637,8 +655,8 @@ app.post('/api/nip05/claim', authenticate, async (req: Request, res: Response) =
       return res.status(400).json({ error: validation.error });
     }
     const memberResult = await pool.query(
-      `SELECT subscription_end FROM members WHERE pubkey = $1 AND status IN ('active', 'grace') AND subscription_end > NOW()`,
-      [pubkey]
+      `SELECT subscription_end FROM members WHERE pubkey = $1 AND community = $2 AND status IN ('active', 'grace') AND subscription_end > NOW()`,
+      [pubkey, COMMUNITY]
     );
     if (memberResult.rows.length === 0) {
       return res.status(403).json({ error: 'Active membership required' });
@@ -741,6 +759,13 @@ app.get('/.well-known/nostr.json', async (req: Request, res: Response) => {
 // Profiles Route
 // =============================================================================
 
+// The most recent kind 0 of each pubkey in COMMUNITY.
+const PROFILES_SQL = `
+  SELECT DISTINCT ON (pubkey) pubkey, content
+  FROM events
+  WHERE kind = 0 AND community = $1 AND pubkey = ANY($2::text[])
+  ORDER BY pubkey, created_at DESC`;
+
 app.get('/api/profiles', authenticate, async (req: Request, res: Response) => {
   try {
     const { pubkeys } = req.query;
@@ -755,15 +780,7 @@ app.get('/api/profiles', authenticate, async (req: Request, res: Response) => {
       return res.json({ profiles: {} });
     }
 
-    // Get the most recent kind 0 event for each pubkey
-    const placeholders = pubkeyList.map((_, i) => `$${i + 1}`).join(',');
-    const result = await pool.query(
-      `SELECT DISTINCT ON (pubkey) pubkey, content
-       FROM events
-       WHERE kind = 0 AND pubkey IN (${placeholders})
-       ORDER BY pubkey, created_at DESC`,
-      pubkeyList
-    );
+    const result = await pool.query(PROFILES_SQL, [COMMUNITY, pubkeyList]);
 
     const profiles: Record<string, any> = {};
     for (const row of result.rows) {
@@ -791,12 +808,15 @@ app.get('/api/profiles', authenticate, async (req: Request, res: Response) => {
 // Events Browse Route
 // =============================================================================
 
+// events.created_at holds Unix seconds; the admin UI expects a timestamp.
+const EVENTS_SQL = `SELECT id, pubkey, kind, to_timestamp(created_at) AS created_at, content, tags, raw FROM events WHERE community = $1`;
+
 app.get('/api/events', authenticate, async (req: Request, res: Response) => {
   try {
     const { kind, pubkey, limit = 50, offset = 0 } = req.query;
 
-    let query = 'SELECT id, pubkey, kind, created_at, content, tags, raw FROM events';
-    const params: any[] = [];
+    let query = EVENTS_SQL;
+    const params: any[] = [COMMUNITY];
     const conditions: string[] = [];
 
     if (kind) {
@@ -810,10 +830,10 @@ app.get('/api/events', authenticate, async (req: Request, res: Response) => {
     }
 
     if (conditions.length > 0) {
-      query += ' WHERE ' + conditions.join(' AND ');
+      query += ' AND ' + conditions.join(' AND ');
     }
 
-    query += ` ORDER BY created_at DESC LIMIT $${params.length + 1} OFFSET $${params.length + 2}`;
+    query += ` ORDER BY events.created_at DESC LIMIT $${params.length + 1} OFFSET $${params.length + 2}`;
     params.push(parseInt(limit as string), parseInt(offset as string));
 
     const result = await pool.query(query, params);
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// NIP-119 AND TAG FILTERS
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// A filter key "&t": ["vegan", "dessert"] matches events carrying every listed
+// t tag, unlike "#t" where any one suffices. go-nostr's filter decoder drops
+// unknown keys, so sniffConn hands us the raw REQ and we re-read the "&" keys
+// here; applyAndTags then re-attaches them to each filter as Tags["&t"],
+// which buildQuery renders with andTagFilterCondition. khatru's broadcast
+// cannot match them, so live events reach those filters through
+// deliverAndTagged, which matches with matchesLiveFilter, the same rule.
+
+// pendingAndTags holds the "&" keys of one REQ, one TagMap per filter (nil for
+// filters without any), until khatru has run each filter through
+// OverwriteFilter.
+type pendingAndTags struct {
+	filters []nostr.TagMap
+	reqCtx  context.Context
+	next    int
+}
+
+// parseAndTags extracts the single-letter "&" keys of every filter in a raw
+// REQ. ok is false if the message is not a REQ or has no such keys.
+func parseAndTags(msg []byte) (subID string, filters []nostr.TagMap, ok bool) {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(msg, &parts); err != nil || len(parts) < 3 {
+		return "", nil, false
+	}
+	var label string
+	if json.Unmarshal(parts[0], &label) != nil || label != "REQ" {
+		return "", nil, false
+	}
+	if json.Unmarshal(parts[1], &subID) != nil {
+		return "", nil, false
+	}
+
+	for _, raw := range parts[2:] {
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(raw, &fields) != nil {
+			return "", nil, false
+		}
+		var tags nostr.TagMap
+		for key, value := range fields {
+			if len(key) != 2 || key[0] != '&' {
+				continue
+			}
+			var values []string
+			if json.Unmarshal(value, &values) != nil || len(values) == 0 {
+				continue
+			}
+			if tags == nil {
+				tags = make(nostr.TagMap)
+			}
+			tags[key[1:]] = values
+			ok = true
+		}
+		filters = append(filters, tags)
+	}
+	return subID, filters, ok
+}
+
+func (t *connTracker) stashAndTags(ws *khatru.WebSocket, subID string, msg []byte) {
+	id, filters, ok := parseAndTags(msg)
+	if !ok || id != subID {
+		return
+	}
+	t.mu.Lock()
+	if c, found := t.conns[ws]; found {
+		c.andTags[subID] = &pendingAndTags{filters: filters}
+	}
+	t.mu.Unlock()
+}
+
+// applyAndTags is the OverwriteFilter hook that re-attaches a filter's "&"
+// keys. khatru runs every filter of a REQ through OverwriteFilter in order
+// with the same context, which is how the pending entry is matched up.
+//
+// khatru matches live events against its own copy of the filter, which shares
+// the Tags map with ours but knows nothing of "&" keys. An "&t" key with no
+// values is put there, which no event matches, so khatru never delivers to
+// the filter and deliverAndTagged does instead. When the filter has no "#t"
+// of its own, our copy also gets the "&t" values as "#t", which the exact
+// AND implies.
+func (t *connTracker) applyAndTags(ctx context.Context, filter *nostr.Filter) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return
+	}
+	subID := khatru.GetSubscriptionID(ctx)
+
+	t.mu.Lock()
+	var tags nostr.TagMap
+	if c, ok := t.conns[ws]; ok {
+		if p := c.andTags[subID]; p != nil {
+			if p.reqCtx != nil && p.reqCtx != ctx {
+				// Left over from a REQ that was rejected part-way through.
+				delete(c.andTags, subID)
+			} else {
+				p.reqCtx = ctx
+				if p.next < len(p.filters) {
+					tags = p.filters[p.next]
+				}
+				p.next++
+				if p.next >= len(p.filters) {
+					delete(c.andTags, subID)
+				}
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	if len(tags) == 0 {
+		return
+	}
+	if filter.Tags == nil {
+		filter.Tags = make(nostr.TagMap)
+	}
+	own := make(nostr.TagMap, len(filter.Tags)+2*len(tags))
+	for name, values := range filter.Tags {
+		own[name] = values
+	}
+	for name, values := range tags {
+		if _, ok := own[name]; !ok {
+			own[name] = values
+		}
+		own["&"+name] = values
+		filter.Tags["&"+name] = []string{}
+	}
+	filter.Tags = own
+}
+
+// hasAndTags reports whether applyAndTags attached "&" keys to filter.
+func hasAndTags(filter nostr.Filter) bool {
+	for name := range filter.Tags {
+		if isAndTagKey(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesLiveFilter is filter.Matches with "&" keys requiring every value,
+// compared as andTagFilterCondition compares them in SQL.
+func matchesLiveFilter(filter nostr.Filter, event *nostr.Event) bool {
+	if !hasAndTags(filter) {
+		return filter.Matches(event)
+	}
+	plain := filter
+	plain.Tags = make(nostr.TagMap, len(filter.Tags))
+	for name, values := range filter.Tags {
+		if !isAndTagKey(name) {
+			plain.Tags[name] = values
+			continue
+		}
+		for _, value := range values {
+			if !hasTagValue(event, name[1:], value) {
+				return false
+			}
+		}
+	}
+	return plain.Matches(event)
+}
+
+// hasTagValue reports whether event has the tag name = value, with indexable
+// values compared as stored in event_tags.
+func hasTagValue(event *nostr.Event, name, value string) bool {
+	indexed := isIndexableTag(name, tagIndexValue(name, value))
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != name {
+			continue
+		}
+		if tag[1] == value || (indexed && tagIndexValue(name, tag[1]) == tagIndexValue(name, value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// reachedByBroadcast reports whether khatru's broadcast of event, unless
+// hideRestricted holds it back, reaches a subscription through filter.
+func reachedByBroadcast(filter nostr.Filter, event *nostr.Event) bool {
+	return !hasAndTags(filter) && filter.Matches(event)
+}
+
+// deliverAndTagged is the live delivery of a new event to the subscriptions
+// whose "&" filters match it. Subscriptions khatru's broadcast reaches
+// through another filter are skipped, and restricted events are left to
+// deliverRestricted, which matches "&" filters the same way.
+func (t *connTracker) deliverAndTagged(ctx context.Context, event *nostr.Event) {
+	if isRestrictedEvent(event) {
+		return
+	}
+	t.deliver(communityOf(ctx).id(), event, func(string) bool { return true }, func(filters []nostr.Filter) bool {
+		matched := false
+		for _, filter := range filters {
+			if reachedByBroadcast(filter, event) {
+				return false
+			}
+			if matchesLiveFilter(filter, event) {
+				matched = true
+			}
+		}
+		return matched
+	})
+}
+
+// andTagFilterCondition renders an "&" tag (every value required) as SQL.
+// Indexable values are probed in event_tags in one grouped subquery; anything
+// else becomes a single JSONB containment of all the pairs.
+func andTagFilterCondition(tagName string, values []string, argIndex int) (string, []interface{}) {
+	distinct := make([]string, 0, len(values))
+	seen := make(map[string]bool, len(values))
+	indexable := true
+	for _, v := range tagIndexValues(tagName, values) {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		distinct = append(distinct, v)
+		if !isIndexableTag(tagName, v) {
+			indexable = false
+		}
+	}
+
+	// A single required value is just a "#" filter.
+	if len(distinct) == 1 {
+		return tagFilterCondition(tagName, distinct, argIndex)
+	}
+
+	if indexable {
+		cond := fmt.Sprintf(
+			"id IN (SELECT event_id FROM event_tags WHERE tag_name = $%d AND tag_value = ANY($%d::text[]) "+
+				"GROUP BY event_id HAVING COUNT(DISTINCT tag_value) = $%d)",
+			argIndex, argIndex+1, argIndex+2)
+		return cond, []interface{}{tagName, pq.Array(distinct), len(distinct)}
+	}
+
+	pairs := make([][]string, len(distinct))
+	for i, v := range distinct {
+		pairs[i] = []string{tagName, v}
+	}
+	tagsJSON, _ := json.Marshal(pairs)
+	return fmt.Sprintf("tags @> $%d::jsonb", argIndex), []interface{}{string(tagsJSON)}
+}
+
+// isAndTagKey reports whether a filter Tags key was attached by applyAndTags.
+func isAndTagKey(key string) bool {
+	return strings.HasPrefix(key, "&")
+}
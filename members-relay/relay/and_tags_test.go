@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseAndTags(t *testing.T) {
+	subID, filters, ok := parseAndTags([]byte(
+		`["REQ","s1",{"kinds":[30023]},{"&t":["vegan","dessert"],"#t":["quick"],"&long":["x"],"&p":[]}]`))
+	if !ok || subID != "s1" {
+		t.Fatalf("parse failed: %q %v", subID, ok)
+	}
+	want := []nostr.TagMap{nil, {"t": {"vegan", "dessert"}}}
+	if !reflect.DeepEqual(filters, want) {
+		t.Fatalf("got %v, want %v", filters, want)
+	}
+
+	if _, _, ok := parseAndTags([]byte(`["REQ","s2",{"#t":["a&b"]}]`)); ok {
+		t.Fatal("REQ without & keys reported as having them")
+	}
+}
+
+func TestBuildQueryMixesAndWithOrTags(t *testing.T) {
+	authors := pubkeys(2)
+	filter := nostr.Filter{
+		Kinds:   []int{KindRecipe},
+		Authors: authors,
+		Tags:    nostr.TagMap{"t": {"quick", "easy"}, "&t": {"vegan", "dessert"}},
+	}
+	query, args := buildQuery(filter)
+
+	if n := strings.Count(query, "event_tags"); n != 2 {
+		t.Fatalf("expected an OR probe and an AND probe, got %d in %s", n, query)
+	}
+	if !strings.Contains(query, "HAVING COUNT(DISTINCT tag_value) = ") {
+		t.Fatalf("AND tags not rendered as a grouped probe: %s", query)
+	}
+	// authors + kinds + (name, values, count) + (name, values) + group
+	// recipes' viewer + community
+	if len(args) != 9 {
+		t.Fatalf("expected 9 args, got %d: %v", len(args), args)
+	}
+}
+
+func TestSingleAndTagMatchesHashTag(t *testing.T) {
+	and, andArgs := buildQuery(nostr.Filter{Kinds: []int{KindRecipe}, Tags: nostr.TagMap{"&t": {"vegan"}}})
+	or, orArgs := buildQuery(nostr.Filter{Kinds: []int{KindRecipe}, Tags: nostr.TagMap{"t": {"vegan"}}})
+	if and != or || !reflect.DeepEqual(andArgs, orArgs) {
+		t.Fatalf("single &t differs from #t:\n%s %v\n%s %v", and, andArgs, or, orArgs)
+	}
+}
+
+// TestAndTagsReachQuery sends a raw REQ through the sniffing listener and
+// checks the filters handed to QueryEvents.
+func TestAndTagsReachQuery(t *testing.T) {
+	tracker := &connTracker{conns: make(map[*khatru.WebSocket]*trackedConn)}
+	seen := make(chan nostr.Filter, 4)
+	rl := khatru.NewRelay()
+	rl.OnConnect = append(rl.OnConnect, tracker.onConnect)
+	rl.OnDisconnect = append(rl.OnDisconnect, tracker.onDisconnect)
+	rl.OverwriteFilter = append(rl.OverwriteFilter, tracker.applyAndTags)
+	rl.QueryEvents = append(rl.QueryEvents, func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		seen <- filter
+		ch := make(chan *nostr.Event)
+		close(ch)
+		return ch, nil
+	})
+	url := startTestRelay(t, rl, testServerConfig(false))
+	c := dialTestRelay(t, url)
+
+	author := pubkeys(1)[0]
+	got := c.req("mixed", `{"kinds":[30023],"authors":["`+author+`"],"#t":["quick"],"&t":["vegan","dessert"]},{"kinds":[30023]}`)
+	if got != "EOSE" {
+		t.Fatalf("REQ: %s", got)
+	}
+	first, second := <-seen, <-seen
+	if len(first.Tags) == 0 {
+		first, second = second, first
+	}
+	if !reflect.DeepEqual(first.Tags["&t"], []string{"vegan", "dessert"}) || !reflect.DeepEqual(first.Tags["t"], []string{"quick"}) {
+		t.Fatalf("first filter tags: %v", first.Tags)
+	}
+	if len(second.Tags) != 0 {
+		t.Fatalf("& tags leaked into the second filter: %v", second.Tags)
+	}
+
+	// A later REQ without & keys must not inherit anything.
+	if got := c.req("mixed", `{"kinds":[30023]}`); got != "EOSE" {
+		t.Fatalf("REQ: %s", got)
+	}
+	if f := <-seen; len(f.Tags) != 0 {
+		t.Fatalf("stale & tags applied: %v", f.Tags)
+	}
+}
+
+// TestAndTagsLiveDelivery publishes recipes to open subscriptions with "&"
+// keys, which must hold live events to every value as the query does.
+func TestAndTagsLiveDelivery(t *testing.T) {
+	tracker := &connTracker{conns: make(map[*khatru.WebSocket]*trackedConn)}
+	rl := khatru.NewRelay()
+	rl.OnConnect = append(rl.OnConnect, tracker.onConnect)
+	rl.OnDisconnect = append(rl.OnDisconnect, tracker.onDisconnect)
+	rl.OverwriteFilter = append(rl.OverwriteFilter, tracker.applyAndTags, tracker.limitLiveFilter)
+	rl.RejectFilter = append(rl.RejectFilter, tracker.limitFilter)
+	rl.StoreEvent = append(rl.StoreEvent, func(ctx context.Context, event *nostr.Event) error {
+		tracker.deliverAndTagged(ctx, event)
+		return nil
+	})
+	url := startTestRelay(t, rl, testServerConfig(false))
+
+	and, live, mixed := dialTestRelay(t, url), dialTestRelay(t, url), dialTestRelay(t, url)
+	for _, sub := range []struct {
+		c      *wsTestClient
+		filter string
+	}{
+		{and, `{"kinds":[30023],"&t":["vegan","dessert"]}`},
+		{live, `{"kinds":[30023],"&t":["vegan","dessert"],"limit":0}`},
+		{mixed, `{"kinds":[30023],"&t":["vegan","dessert"]},{"kinds":[30023],"#t":["soup"]}`},
+	} {
+		if got := sub.c.req("s", sub.filter); got != "EOSE" {
+			t.Fatalf("REQ %s: %s", sub.filter, got)
+		}
+	}
+
+	publisher := dialTestRelay(t, url)
+	sk := nostr.GeneratePrivateKey()
+	publish := func(d string, tags ...string) *nostr.Event {
+		t.Helper()
+		recipeTags := nostr.Tags{{"d", d}}
+		for _, tag := range tags {
+			recipeTags = append(recipeTags, nostr.Tag{"t", tag})
+		}
+		evt := signedEvent(t, sk, KindRecipe, nostr.Now(), recipeTags, d)
+		raw, _ := nostr.EventEnvelope{Event: *evt}.MarshalJSON()
+		publisher.send(string(raw))
+		env := publisher.next(func(env nostr.Envelope) bool {
+			ok, isOK := env.(*nostr.OKEnvelope)
+			return isOK && ok.EventID == evt.ID
+		}).(*nostr.OKEnvelope)
+		if !env.OK {
+			t.Fatalf("publish %s: %s", d, env.Reason)
+		}
+		return evt
+	}
+	nextEvent := func(c *wsTestClient) string {
+		t.Helper()
+		env := c.next(func(env nostr.Envelope) bool { _, ok := env.(*nostr.EventEnvelope); return ok })
+		return env.(*nostr.EventEnvelope).ID
+	}
+
+	publish("vegan", "vegan")
+	both := publish("both", "Vegan", "dessert", "soup")
+	soup := publish("soup", "soup")
+	for name, c := range map[string]*wsTestClient{"and": and, "live": live} {
+		if got := nextEvent(c); got != both.ID {
+			t.Errorf("%s subscription got %s first, want the recipe with both tags", name, got)
+		}
+	}
+	// khatru's broadcast reaches the subscription through its "#t" filter,
+	// so the "&t" filter must not deliver the recipe a second time.
+	for _, want := range []string{both.ID, soup.ID} {
+		if got := nextEvent(mixed); got != want {
+			t.Fatalf("mixed subscription got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestAndTagQuerySemantics(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+
+	recipes := map[string]nostr.Tags{
+		"both":    {{"d", "both"}, {"t", "vegan"}, {"t", "dessert"}},
+		"vegan":   {{"d", "vegan"}, {"t", "vegan"}},
+		"dessert": {{"d", "dessert"}, {"t", "dessert"}, {"t", "quick"}},
+		"all":     {{"d", "all"}, {"t", "vegan"}, {"t", "dessert"}, {"t", "quick"}},
+	}
+	ids := make(map[string]string)
+	for name, tags := range recipes {
+		evt := signedEvent(t, sk, KindRecipe, now, tags, name)
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+		ids[evt.ID] = name
+	}
+
+	run := func(tags nostr.TagMap) []string {
+		ch, _ := queryEvents(ctx, nostr.Filter{Kinds: []int{KindRecipe}, Tags: tags})
+		var names []string
+		for evt := range ch {
+			names = append(names, ids[evt.ID])
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if got := run(nostr.TagMap{"&t": {"vegan", "dessert"}}); !reflect.DeepEqual(got, []string{"all", "both"}) {
+		t.Fatalf("&t vegan+dessert: %v", got)
+	}
+	if got := run(nostr.TagMap{"&t": {"vegan", "dessert"}, "t": {"quick"}}); !reflect.DeepEqual(got, []string{"all"}) {
+		t.Fatalf("&t vegan+dessert with #t quick: %v", got)
+	}
+	if and, or := run(nostr.TagMap{"&t": {"vegan"}}), run(nostr.TagMap{"t": {"vegan"}}); !reflect.DeepEqual(and, or) {
+		t.Fatalf("single &t %v differs from #t %v", and, or)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// GROUP ANNOUNCEMENTS
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// An announcement is group chat (kind 9) carrying an ["announcement"] tag,
+// so clients that do not know the tag still show it in the conversation
+// and the web client can render it apart. Only roles with the announce
+// capability (see GROUP ROLES) and the relay admin may post one; anyone
+// else is told "restricted: admin only". A mute does not hold them back,
+// and the chat retention purge keeps announcements however old they get.
+//
+// The relay publishes the group's latest RELAY_GROUP_ANNOUNCEMENTS
+// (default 3) announcements, newest first, as e tags of a relay-signed
+// kind 39005 with d = group id, regenerated by the group sync worker with
+// the rest of the group's metadata, so someone who just joined sees them
+// without scrolling back through the chat. Storing or deleting an
+// announcement marks its group dirty.
+
+// KindGroupAnnouncements lists a group's latest announcements.
+const KindGroupAnnouncements = 39005
+
+// maxGroupAnnouncements is how many announcements a group's 39005 lists.
+var maxGroupAnnouncements int
+
+func loadAnnouncementConfig() {
+	maxGroupAnnouncements = envInt("RELAY_GROUP_ANNOUNCEMENTS", 3)
+}
+
+// notAnnouncementCondition leaves out announcements e.
+const notAnnouncementCondition = `NOT EXISTS (
+	SELECT 1 FROM jsonb_array_elements(e.tags) t WHERE t->>0 = 'announcement')`
+
+// isAnnouncement reports group chat marked as an announcement.
+func isAnnouncement(event *nostr.Event) bool {
+	return event.Kind == KindGroupChat && event.Tags.GetFirst([]string{"announcement"}) != nil
+}
+
+// rejectAnnouncement refuses an announcement from pubkey, a member of
+// groupId, unless their role may announce.
+func rejectAnnouncement(ctx context.Context, groupId, pubkey string) (bool, string) {
+	if !hasGroupCapability(ctx, groupId, pubkey, capAnnounce) {
+		return true, say(ctx, msgAnnouncementAdminOnly)
+	}
+	return false, ""
+}
+
+// noteAnnouncement marks the group of an announcement stored or deleted as
+// part of tx dirty, so its 39005 follows.
+func noteAnnouncement(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	if !isAnnouncement(event) || getHTag(event) == "" {
+		return nil
+	}
+	return markGroupDirty(ctx, tx, getHTag(event))
+}
+
+// generateGroupAnnouncements publishes groupId's latest announcements
+// (kind 39005).
+func generateGroupAnnouncements(ctx context.Context, tx *sql.Tx, groupId string) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT e.id FROM events e
+		JOIN event_tags h ON h.event_id = e.id AND h.tag_name = 'h' AND h.tag_value = $1
+		WHERE e.kind = $2 AND e.community = $3 AND NOT (`+notAnnouncementCondition+`)
+		ORDER BY e.created_at DESC, e.id
+		LIMIT $4
+	`, groupId, KindGroupChat, communityOf(ctx).id(), maxGroupAnnouncements)
+	if err != nil {
+		return fmt.Errorf("fetch group announcements: %w", err)
+	}
+	defer rows.Close()
+
+	tags := nostr.Tags{
+		{"d", groupId},
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		tags = append(tags, nostr.Tag{"e", id})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	event := nostr.Event{
+		Kind:    KindGroupAnnouncements,
+		Content: "",
+		Tags:    tags,
+	}
+
+	if err := signRelayEvent(&event); err != nil {
+		return fmt.Errorf("sign group announcements: %w", err)
+	}
+	return persistEventTx(ctx, tx, &event)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestIsAnnouncement(t *testing.T) {
+	for _, tc := range []struct {
+		event *nostr.Event
+		want  bool
+	}{
+		{&nostr.Event{Kind: KindGroupChat, Tags: nostr.Tags{{"h", "g"}, {"announcement"}}}, true},
+		{&nostr.Event{Kind: KindGroupChat, Tags: nostr.Tags{{"h", "g"}, {"t", "announcement"}}}, false},
+		{&nostr.Event{Kind: KindGroupChatReply, Tags: nostr.Tags{{"h", "g"}, {"announcement"}}}, false},
+	} {
+		if got := isAnnouncement(tc.event); got != tc.want {
+			t.Errorf("%v: announcement %v, want %v", tc.event.Tags, got, tc.want)
+		}
+	}
+}
+
+// Members cannot announce; a muted moderator can, the purge keeps the
+// announcement and 39005 lists it until it is deleted.
+func TestGroupAnnouncements(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	prevRetention := limits.Retention
+	limits.Retention = []retentionRule{{Kinds: []int{KindGroupChat}, Time: 3600}}
+	t.Cleanup(func() { limits.Retention = prevRetention })
+	ownerSK, modSK, memberSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	mod, _ := nostr.GetPublicKey(modSK)
+	member, _ := nostr.GetPublicKey(memberSK)
+	for _, pk := range []string{mod, member} {
+		addTestMember(t, pk)
+	}
+	now := nostr.Now()
+	h := nostr.Tags{{"h", "kitchen"}}
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindCreateGroup, now, h, ""))
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindPutUser, now, nostr.Tags{{"h", "kitchen"}, {"p", mod, "moderator"}, {"p", member}}, ""))
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindMuteUser, now, nostr.Tags{{"h", "kitchen"}, {"p", mod}, {"duration", "60"}}, ""))
+	as := func(pubkey string) context.Context { return context.WithValue(ctx, nip98ViewerKey{}, pubkey) }
+	announce := func(sk string, createdAt nostr.Timestamp) *nostr.Event {
+		return signedEvent(t, sk, KindGroupChat, createdAt, nostr.Tags{{"h", "kitchen"}, {"announcement"}}, "Bake-off on Saturday")
+	}
+
+	if reject, msg := rejectEventPolicy(as(member), announce(memberSK, now)); !reject || msg != "restricted: admin only" {
+		t.Fatalf("member's announcement: %v %q", reject, msg)
+	}
+	chat := signedEvent(t, modSK, KindGroupChat, now, h, "hello")
+	if reject, _ := rejectEventPolicy(as(mod), chat); !reject {
+		t.Fatal("muted moderator's chat accepted")
+	}
+	old := announce(modSK, now-2*3600)
+	if reject, msg := rejectEventPolicy(as(mod), old); reject {
+		t.Fatalf("muted moderator's announcement: %s", msg)
+	}
+	if err := storeEvent(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	if dirty := groupDirty(t, "kitchen"); !dirty {
+		t.Fatal("announcement left the group clean")
+	}
+
+	if n, err := purgeAllExpiredChat(ctx); err != nil || n != 0 {
+		t.Fatalf("purged %d (%v)", n, err)
+	}
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	listed, err := currentRelayEvent(ctx, KindGroupAnnouncements, "kitchen")
+	if err != nil || listed == nil || listed.Tags.GetFirst([]string{"e", old.ID}) == nil {
+		t.Fatalf("39005: %v %v", listed, err)
+	}
+
+	if err := deleteEvent(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if listed, _ := currentRelayEvent(ctx, KindGroupAnnouncements, "kitchen"); listed == nil || listed.Tags.GetFirst([]string{"e", old.ID}) != nil {
+		t.Fatalf("39005 after deletion: %v", listed)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// APP DATA (NIP-78)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Kind 30078 carries per-user app settings (saved filters, unit preferences,
+// pantry lists), one addressable event per author and d tag. They are private:
+// reads only ever return a member's own app data, enforced in SQL and in live
+// delivery (see deliverRestricted). The exception is the Nourish service,
+// whose analyses are public (isPublicNourishFilter).
+
+// appDataForAnyAuthed lets authenticated non-members store app data too
+// (RELAY_APP_DATA_ANY_AUTHED).
+var appDataForAnyAuthed bool
+
+// rejectAppData is the write policy for kind 30078.
+func rejectAppData(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	if !appDataForAnyAuthed && !isActiveMember(ctx, pubkey) {
+		return true, say(ctx, msgMembershipRequired)
+	}
+	if addressableDTag(event) == nil {
+		return true, say(ctx, msgAppDataDTag)
+	}
+	return false, ""
+}
+
+// isPrivateAppData reports whether event is app data only its author may read.
+func isPrivateAppData(event *nostr.Event) bool {
+	return event.Kind == KindAppData && event.PubKey != NourishServicePubkey
+}
+
+// appDataPrivacyCondition limits app data to the viewer's own and the Nourish
+// service's. The admin gets no exception.
+func appDataPrivacyCondition(viewer string, argIndex int) (string, []interface{}) {
+	return fmt.Sprintf("(kind <> %d OR pubkey = $%d OR pubkey = $%d)", KindAppData, argIndex, argIndex+1),
+		[]interface{}{viewer, NourishServicePubkey}
+}
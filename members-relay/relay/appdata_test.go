@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestAppDataConditionOnlyForAppDataKinds(t *testing.T) {
+	viewer := pubkeys(1)[0]
+	if q, _ := buildViewerQuery(nostr.Filter{Kinds: []int{KindRecipe}}, nil, viewer, false); strings.Contains(q, "30078") {
+		t.Fatalf("app data privacy applied to recipes: %s", q)
+	}
+	for _, filter := range []nostr.Filter{{Kinds: []int{KindAppData}}, {Authors: pubkeys(2)}} {
+		if q, _ := buildViewerQuery(filter, nil, adminPubkey, false); !strings.Contains(q, "kind <> 30078") {
+			t.Fatalf("%v can return app data but is not checked: %s", filter, q)
+		}
+	}
+}
+
+func TestPrivateAppData(t *testing.T) {
+	for _, tc := range []struct {
+		event nostr.Event
+		want  bool
+	}{
+		{nostr.Event{Kind: KindAppData, PubKey: pubkeys(1)[0]}, true},
+		{nostr.Event{Kind: KindAppData, PubKey: NourishServicePubkey}, false},
+		{nostr.Event{Kind: KindRecipe, PubKey: pubkeys(1)[0]}, false},
+	} {
+		if got := isPrivateAppData(&tc.event); got != tc.want {
+			t.Errorf("kind %d by %s: got %v", tc.event.Kind, tc.event.PubKey, got)
+		}
+	}
+}
+
+func TestRejectAppData(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	member, outsider := pubkeys(2)[0], pubkeys(2)[1]
+	addTestMember(t, member)
+
+	settings := &nostr.Event{Kind: KindAppData, Tags: nostr.Tags{{"d", "zapcooking/settings"}}}
+	if reject, msg := rejectAppData(ctx, settings, member); reject {
+		t.Fatalf("member rejected: %s", msg)
+	}
+	if reject, _ := rejectAppData(ctx, &nostr.Event{Kind: KindAppData}, member); !reject {
+		t.Fatal("app data without a d tag accepted")
+	}
+	if reject, _ := rejectAppData(ctx, settings, outsider); !reject {
+		t.Fatal("non-member accepted")
+	}
+	appDataForAnyAuthed = true
+	defer func() { appDataForAnyAuthed = false }()
+	if reject, msg := rejectAppData(ctx, settings, outsider); reject {
+		t.Fatalf("authed non-member rejected with RELAY_APP_DATA_ANY_AUTHED: %s", msg)
+	}
+}
+
+func TestAppDataVisibility(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	authorSK := nostr.GeneratePrivateKey()
+	author, _ := nostr.GetPublicKey(authorSK)
+	other := pubkeys(1)[0]
+	addTestMember(t, author)
+	addTestMember(t, other)
+
+	now := nostr.Now()
+	settings := signedEvent(t, authorSK, KindAppData, now, nostr.Tags{{"d", "zapcooking/settings"}}, `{"units":"metric"}`)
+	analysis := &nostr.Event{Kind: KindAppData, PubKey: NourishServicePubkey, CreatedAt: now,
+		Tags: nostr.Tags{{"d", "nourish/analysis"}}, Content: "{}"}
+	analysis.ID = analysis.GetID()
+	for _, evt := range []*nostr.Event{settings, analysis} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names := map[string]string{settings.ID: "settings", analysis.ID: "analysis"}
+
+	visible := func(filter nostr.Filter, viewer string) string {
+		query, args := buildViewerQuery(filter, nil, viewer, false)
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var got []string
+		for rows.Next() {
+			var raw []byte
+			rows.Scan(&raw)
+			var evt nostr.Event
+			evt.UnmarshalJSON(raw)
+			got = append(got, names[evt.ID])
+		}
+		sort.Strings(got)
+		return strings.Join(got, ",")
+	}
+
+	byD := nostr.Filter{Kinds: []int{KindAppData}, Tags: nostr.TagMap{"d": {"zapcooking/settings"}}}
+	if got := visible(byD, author); got != "settings" {
+		t.Fatalf("author sees %q", got)
+	}
+	if got := visible(byD, other); got != "" {
+		t.Fatalf("another member querying by d tag sees %q", got)
+	}
+	if got := visible(nostr.Filter{Authors: []string{author}}, adminPubkey); got != "" {
+		t.Fatalf("admin sees %q", got)
+	}
+	if got := visible(nostr.Filter{Kinds: []int{KindAppData}}, other); got != "analysis" {
+		t.Fatalf("another member sees %q", got)
+	}
+	if got := visible(nostr.Filter{Kinds: []int{KindAppData}, Authors: []string{NourishServicePubkey}}, ""); got != "analysis" {
+		t.Fatalf("anonymous Nourish read sees %q", got)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// AUTHENTICATION (NIP-42)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// khatru accepts any AUTH event that carries the connection's challenge, a
+// relay tag naming the host the request came in on and a created_at within
+// ten minutes. That let clients reconnecting through a proxy replay an AUTH
+// event signed for an earlier connection. The members relay checks AUTH
+// events itself before khatru sees them (the sniffer hands them over, see
+// HTTP SERVER): the relay tag must name RELAY_URL (a community's url), the
+// challenge must have been issued less than RELAY_AUTH_CHALLENGE_TTL ago and
+// the event must be signed after it was issued, give or take
+// RELAY_AUTH_CLOCK_SKEW. A refused AUTH rotates the connection's challenge,
+// so khatru answers it with "failed to authenticate", and the client gets
+// the new challenge to sign. Without RELAY_URL the relay tag is left to
+// khatru.
+//
+// A connection stays authenticated until it closes, so a member removed
+// mid-session would keep their open subscriptions. Every
+// RELAY_AUTH_SWEEP_INTERVAL the relay looks up the connections that
+// authenticated as a member and closes those whose membership has ended;
+// the client reconnects and authenticates afresh, as whoever it now is.
+// Connections that were never a member's are left alone: the policy already
+// treats them as non-members.
+
+type authConfig struct {
+	URL           string        // the relay tag AUTH must carry; "" leaves it to khatru
+	ChallengeTTL  time.Duration // how long a challenge can be answered
+	ClockSkew     time.Duration // how far created_at may precede the challenge
+	SweepInterval time.Duration // 0 disables the revocation sweep
+}
+
+var authCfg authConfig
+
+func loadAuthConfig() {
+	authCfg = authConfig{
+		URL:           envOr("RELAY_URL", ""),
+		ChallengeTTL:  envDuration("RELAY_AUTH_CHALLENGE_TTL", 10*time.Minute),
+		ClockSkew:     envDuration("RELAY_AUTH_CLOCK_SKEW", time.Minute),
+		SweepInterval: envDuration("RELAY_AUTH_SWEEP_INTERVAL", time.Minute),
+	}
+}
+
+// authURL is the relay URL AUTH events for community id must name.
+func authURL(id string) string {
+	if c := communities[id]; c != nil {
+		return c.URL
+	}
+	return authCfg.URL
+}
+
+// validateAuth checks an AUTH event against the challenge issued at issued
+// and, unless relayURL is "", the relay URL.
+func validateAuth(event *nostr.Event, challenge string, issued time.Time, relayURL string, cfg authConfig, now time.Time) error {
+	if event.Kind != nostr.KindClientAuthentication {
+		return fmt.Errorf("kind %d is not an AUTH event", event.Kind)
+	}
+	if tag := event.Tags.GetFirst([]string{"challenge", ""}); tag == nil || (*tag)[1] != challenge {
+		return errors.New("wrong challenge")
+	}
+	if cfg.ChallengeTTL > 0 && now.Sub(issued) > cfg.ChallengeTTL {
+		return fmt.Errorf("challenge issued %s ago", now.Sub(issued).Round(time.Second))
+	}
+	signed := event.CreatedAt.Time()
+	if signed.Before(issued.Add(-cfg.ClockSkew).Truncate(time.Second)) {
+		return errors.New("signed before the challenge was issued")
+	}
+	if signed.After(now.Add(cfg.ClockSkew)) {
+		return errors.New("created_at is in the future")
+	}
+	if relayURL != "" {
+		tag := event.Tags.GetFirst([]string{"relay", ""})
+		if tag == nil || !sameRelayURL((*tag)[1], relayURL) {
+			return fmt.Errorf("relay tag is not %s", relayURL)
+		}
+	}
+	if ok, err := event.CheckSignature(); err != nil || !ok {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// sameRelayURL compares relay URLs by scheme, host and path, ignoring case
+// in the first two and a trailing slash.
+func sameRelayURL(a, b string) bool {
+	ua, errA := url.Parse(strings.TrimSpace(a))
+	ub, errB := url.Parse(strings.TrimSpace(b))
+	if errA != nil || errB != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host) &&
+		strings.TrimSuffix(ua.Path, "/") == strings.TrimSuffix(ub.Path, "/")
+}
+
+func newChallenge() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// checkAuth validates an AUTH event sniffed off ws before khatru handles it.
+// It returns "" if the event is good, else the connection's new challenge,
+// which the caller sends.
+func (t *connTracker) checkAuth(ws *khatru.WebSocket, event *nostr.Event, now time.Time) string {
+	t.mu.Lock()
+	c, ok := t.conns[ws]
+	if !ok {
+		t.mu.Unlock()
+		return ""
+	}
+	err := validateAuth(event, ws.Challenge, c.challengedAt, authURL(c.community), authCfg, now)
+	if err == nil {
+		c.authed, c.member = event.PubKey, false
+		community := c.community
+		t.mu.Unlock()
+		go t.noteMembership(ws, community, event.PubKey)
+		return ""
+	}
+	// The handler goroutine khatru starts for this message reads the
+	// challenge after us, so it refuses the event.
+	challenge := newChallenge()
+	ws.Challenge, c.challengedAt = challenge, now
+	t.mu.Unlock()
+	log.Printf("[auth] Refused AUTH from %s: %v", event.PubKey, err)
+	return challenge
+}
+
+// noteMembership records whether the pubkey ws authenticated as is a member,
+// which makes the connection subject to the revocation sweep.
+func (t *connTracker) noteMembership(ws *khatru.WebSocket, community, pubkey string) {
+	member := isActiveMember(withCommunity(context.Background(), communities[community]), pubkey)
+	t.mu.Lock()
+	if c, ok := t.conns[ws]; ok && c.authed == pubkey {
+		c.member = member
+	}
+	t.mu.Unlock()
+}
+
+// activeMembers returns which of pubkeys are active members of community.
+func activeMembers(ctx context.Context, community string, pubkeys []string) (map[string]bool, error) {
+	active := make(map[string]bool, len(pubkeys))
+	admin := communities[community].admin()
+	rows, err := db.QueryContext(ctx, `
+		SELECT pubkey FROM members
+		WHERE community = $1 AND pubkey = ANY($2)
+		AND status IN ('active', 'grace')
+		AND subscription_end > NOW()
+	`, community, pq.Array(pubkeys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pk string
+		if err := rows.Scan(&pk); err != nil {
+			return nil, err
+		}
+		active[pk] = true
+	}
+	for _, pk := range pubkeys {
+		if pk == admin {
+			active[pk] = true
+		}
+	}
+	return active, rows.Err()
+}
+
+// sweepRevoked closes the connections authenticated as a member who no
+// longer is one and returns how many.
+func (t *connTracker) sweepRevoked(ctx context.Context) (int, error) {
+	byCommunity := map[string][]string{}
+	t.mu.Lock()
+	for ws, c := range t.conns {
+		if c.member && c.authed != "" && c.authed == ws.AuthedPublicKey {
+			byCommunity[c.community] = append(byCommunity[c.community], c.authed)
+		}
+	}
+	t.mu.Unlock()
+
+	revoked := map[string]map[string]bool{}
+	for community, pubkeys := range byCommunity {
+		active, err := activeMembers(ctx, community, pubkeys)
+		if err != nil {
+			return 0, err
+		}
+		for _, pk := range pubkeys {
+			if !active[pk] {
+				if revoked[community] == nil {
+					revoked[community] = map[string]bool{}
+				}
+				revoked[community][pk] = true
+			}
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	closed := 0
+	for ws, c := range t.conns {
+		if !c.member || !revoked[c.community][c.authed] || c.authed != ws.AuthedPublicKey {
+			continue
+		}
+		log.Printf("[auth] Closing connection of %s: no longer a member of %s", c.authed, c.community)
+		if c.netConn != nil {
+			// As in reapIdle, khatru's read loop fails and cleans up.
+			c.netConn.Close()
+		}
+		delete(t.conns, ws)
+		closed++
+	}
+	return closed, nil
+}
+
+func (t *connTracker) runRevocationSweep(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := t.sweepRevoked(ctx)
+			if err != nil {
+				log.Printf("[auth] Error checking authenticated members: %v", err)
+			} else if n > 0 {
+				log.Printf("[auth] Closed %d connection(s) of former members", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestValidateAuth(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	cfg := authConfig{URL: "wss://members.zap.cooking", ChallengeTTL: 10 * time.Minute, ClockSkew: time.Minute}
+	now := time.Now()
+	issued := now.Add(-2 * time.Minute)
+	auth := func(kind int, at time.Time, relayURL, challenge string) *nostr.Event {
+		return signedEvent(t, sk, kind, nostr.Timestamp(at.Unix()), nostr.Tags{{"relay", relayURL}, {"challenge", challenge}}, "")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		event  *nostr.Event
+		issued time.Time
+		ok     bool
+	}{
+		{"fresh", auth(nostr.KindClientAuthentication, now, cfg.URL, "c1"), issued, true},
+		{"trailing slash", auth(nostr.KindClientAuthentication, now, "wss://Members.zap.cooking/", "c1"), issued, true},
+		{"wrong relay tag", auth(nostr.KindClientAuthentication, now, "wss://other.example", "c1"), issued, false},
+		{"proxy's relay tag", auth(nostr.KindClientAuthentication, now, "ws://relay:3334", "c1"), issued, false},
+		{"wrong challenge", auth(nostr.KindClientAuthentication, now, cfg.URL, "c0"), issued, false},
+		{"signed before the challenge", auth(nostr.KindClientAuthentication, issued.Add(-5*time.Minute), cfg.URL, "c1"), issued, false},
+		{"expired challenge", auth(nostr.KindClientAuthentication, now, cfg.URL, "c1"), now.Add(-time.Hour), false},
+		{"future", auth(nostr.KindClientAuthentication, now.Add(5*time.Minute), cfg.URL, "c1"), issued, false},
+		{"not an AUTH event", auth(1, now, cfg.URL, "c1"), issued, false},
+	} {
+		if err := validateAuth(tc.event, "c1", tc.issued, cfg.URL, cfg, now); (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v", tc.name, err)
+		}
+	}
+
+	forged := auth(nostr.KindClientAuthentication, now, cfg.URL, "c1")
+	forged.Sig = strings.Repeat("0", 128)
+	if err := validateAuth(forged, "c1", issued, cfg.URL, cfg, now); err == nil {
+		t.Error("bad signature accepted")
+	}
+	if err := validateAuth(auth(nostr.KindClientAuthentication, now, "ws://anything", "c1"), "c1", issued, "", cfg, now); err != nil {
+		t.Errorf("relay tag checked without a URL: %v", err)
+	}
+}
+
+// A refused AUTH rotates the challenge, so neither the bad event nor the old
+// challenge works afterwards.
+func TestAuthWrongRelayTag(t *testing.T) {
+	savedCfg, savedAdmin := authCfg, adminPubkey
+	defer func() { authCfg, adminPubkey = savedCfg, savedAdmin }()
+	authCfg = authConfig{URL: "wss://members.zap.cooking", ChallengeTTL: time.Minute, ClockSkew: time.Minute}
+	// The admin is a member without a database lookup.
+	sk := nostr.GeneratePrivateKey()
+	adminPubkey, _ = nostr.GetPublicKey(sk)
+
+	tracker := &connTracker{conns: make(map[*khatru.WebSocket]*trackedConn), checksAuth: true}
+	rl := khatru.NewRelay()
+	rl.ServiceURL = authCfg.URL
+	rl.OnConnect = append(rl.OnConnect, tracker.onConnect)
+	rl.OnDisconnect = append(rl.OnDisconnect, tracker.onDisconnect)
+	url := startTestRelay(t, rl, testServerConfig(true))
+	c := dialTestRelay(t, url)
+	first := c.challenge()
+
+	if c.auth(url, first, sk) {
+		t.Fatal("AUTH naming the address dialed instead of RELAY_URL was accepted")
+	}
+	if len(c.challenges) != 1 || c.challenges[0] == first {
+		t.Fatalf("expected a new challenge after the refusal, got %v", c.challenges)
+	}
+	if c.auth(authCfg.URL, first, sk) {
+		t.Fatal("the replaced challenge was accepted")
+	}
+	latest := c.challenges[len(c.challenges)-1]
+	if !c.auth(authCfg.URL, latest, sk) {
+		t.Fatal("AUTH with RELAY_URL and the new challenge was refused")
+	}
+}
+
+func TestRevokedMemberDisconnected(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	pks := pubkeys(2)
+	member, outsider := pks[0], pks[1]
+	addTestMember(t, member)
+
+	tracker := &connTracker{conns: make(map[*khatru.WebSocket]*trackedConn), checksAuth: true}
+	connect := func(pubkey string) (*khatru.WebSocket, net.Conn) {
+		server, client := net.Pipe()
+		t.Cleanup(func() { server.Close(); client.Close() })
+		ws := &khatru.WebSocket{AuthedPublicKey: pubkey}
+		tracker.conns[ws] = &trackedConn{netConn: server, community: defaultCommunityID, authed: pubkey}
+		tracker.noteMembership(ws, defaultCommunityID, pubkey)
+		return ws, client
+	}
+	memberWS, memberConn := connect(member)
+	outsiderWS, _ := connect(outsider)
+	if !tracker.conns[memberWS].member || tracker.conns[outsiderWS].member {
+		t.Fatal("membership not recorded at AUTH")
+	}
+
+	if n, err := tracker.sweepRevoked(ctx); err != nil || n != 0 {
+		t.Fatalf("sweep with nothing revoked closed %d (%v)", n, err)
+	}
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM members WHERE pubkey = $1`, member); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := tracker.sweepRevoked(ctx); err != nil || n != 1 {
+		t.Fatalf("sweep after revocation closed %d (%v), want 1", n, err)
+	}
+	if _, ok := tracker.conns[memberWS]; ok {
+		t.Fatal("revoked member's connection still tracked")
+	}
+	if _, ok := tracker.conns[outsiderWS]; !ok {
+		t.Fatal("a connection that never was a member's was closed")
+	}
+	memberConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := memberConn.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "deadline") {
+		t.Fatalf("socket not closed: %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// BADGES (NIP-58)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Badge definitions (30009) and awards (8) are signed by the relay key, so
+// members can show them in any client and anyone can verify where they came
+// from. The admin defines badges; awards are made by hand through the admin
+// API or automatically for milestones (tier, tenure, founding members) when
+// a definition with the milestone's d tag exists. badge_awards keeps one row
+// per badge and recipient, which makes awarding idempotent and remembers
+// revocations so the automatic awarder does not hand a revoked badge back.
+// Members publish their own 30008 profile-badges list like any other event.
+
+const (
+	KindBadgeAward      = 8
+	KindProfileBadges   = 30008
+	KindBadgeDefinition = 30009
+)
+
+// foundingCutoff is the join date before which members earn the
+// "founding-member" badge (RELAY_FOUNDING_CUTOFF, YYYY-MM-DD; unset disables).
+var foundingCutoff time.Time
+
+func loadBadgeConfig() {
+	if v := envOr("RELAY_FOUNDING_CUTOFF", ""); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			log.Fatalf("Invalid RELAY_FOUNDING_CUTOFF %q: %v", v, err)
+		}
+		foundingCutoff = t
+	}
+}
+
+var errBadgeNotDefined = errors.New("badge is not defined")
+
+// milestoneBadges lists the badges, by definition d tag, a member with this
+// tier who joined at joined has earned by now.
+func milestoneBadges(tier string, joined, now time.Time) []string {
+	badges := []string{"tier-" + tier}
+	if !foundingCutoff.IsZero() && joined.Before(foundingCutoff) {
+		badges = append(badges, "founding-member")
+	}
+	for years := 1; !joined.AddDate(years, 0, 0).After(now); years++ {
+		badges = append(badges, fmt.Sprintf("%d-year-subscriber", years))
+	}
+	return badges
+}
+
+func badgeAddress(d string) string {
+	return fmt.Sprintf("%d:%s:%s", KindBadgeDefinition, relaySigningPubkey, d)
+}
+
+// defineBadge publishes (or replaces) a relay-signed badge definition.
+func defineBadge(ctx context.Context, d, name, description, image string) (*nostr.Event, error) {
+	tags := nostr.Tags{{"d", d}, {"name", name}}
+	if description != "" {
+		tags = append(tags, nostr.Tag{"description", description})
+	}
+	if image != "" {
+		tags = append(tags, nostr.Tag{"image", image})
+	}
+	event := nostr.Event{Kind: KindBadgeDefinition, Tags: tags}
+	if err := signRelayEvent(&event); err != nil {
+		return nil, err
+	}
+	return &event, persistEvent(ctx, &event)
+}
+
+// definedBadges returns the d tags of the relay's badge definitions.
+func definedBadges(ctx context.Context) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT d_tag FROM events WHERE kind = $1 AND pubkey = $2 AND d_tag IS NOT NULL",
+		KindBadgeDefinition, relaySigningPubkey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	defined := make(map[string]bool)
+	for rows.Next() {
+		var d string
+		if err := rows.Scan(&d); err != nil {
+			return nil, err
+		}
+		defined[d] = true
+	}
+	return defined, rows.Err()
+}
+
+// awardBadge issues a kind 8 award unless recipient already holds badge. A
+// revoked badge is only re-issued by a manual award. It reports whether a
+// new award was made.
+func awardBadge(ctx context.Context, badge, recipient string, manual bool) (bool, error) {
+	var defined bool
+	if err := db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM events WHERE kind = $1 AND pubkey = $2 AND d_tag = $3)",
+		KindBadgeDefinition, relaySigningPubkey, badge).Scan(&defined); err != nil {
+		return false, err
+	}
+	if !defined {
+		return false, errBadgeNotDefined
+	}
+
+	// Claim the (badge, recipient) row first so concurrent awarders cannot
+	// both sign an award.
+	var claimed bool
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO badge_awards (badge, recipient, awarded_at) VALUES ($1, $2, NOW())
+		ON CONFLICT (badge, recipient) DO UPDATE SET revoked_at = NULL, awarded_at = NOW()
+			WHERE badge_awards.revoked_at IS NOT NULL AND $3
+		RETURNING true
+	`, badge, recipient, manual).Scan(&claimed)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	event := nostr.Event{
+		Kind: KindBadgeAward,
+		Tags: nostr.Tags{{"a", badgeAddress(badge)}, {"p", recipient}},
+	}
+	if err := signRelayEvent(&event); err == nil {
+		err = persistEvent(ctx, &event)
+	}
+	if err != nil {
+		db.ExecContext(ctx, "DELETE FROM badge_awards WHERE badge = $1 AND recipient = $2 AND event_id IS NULL", badge, recipient)
+		return false, err
+	}
+	_, err = db.ExecContext(ctx,
+		"UPDATE badge_awards SET event_id = $3 WHERE badge = $1 AND recipient = $2",
+		badge, recipient, event.ID)
+	return true, err
+}
+
+// revokeBadge deletes a held award. It reports whether there was one.
+func revokeBadge(ctx context.Context, badge, recipient string) (bool, error) {
+	var eventID sql.NullString
+	err := db.QueryRowContext(ctx, `
+		WITH held AS (
+			SELECT event_id FROM badge_awards
+			WHERE badge = $1 AND recipient = $2 AND revoked_at IS NULL
+			FOR UPDATE
+		)
+		UPDATE badge_awards b SET revoked_at = NOW(), event_id = NULL
+		FROM held WHERE b.badge = $1 AND b.recipient = $2
+		RETURNING held.event_id
+	`, badge, recipient).Scan(&eventID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if eventID.Valid {
+		if _, err := db.ExecContext(ctx, "DELETE FROM events WHERE id = $1", eventID.String); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// awardMilestones gives every active member the defined milestone badges
+// they have earned.
+func awardMilestones(ctx context.Context) (int, error) {
+	defined, err := definedBadges(ctx)
+	if err != nil || len(defined) == 0 {
+		return 0, err
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT pubkey, tier, created_at FROM members
+		WHERE status IN ('active', 'grace') AND subscription_end > NOW()
+		AND community = $1
+	`, defaultCommunityID)
+	if err != nil {
+		return 0, err
+	}
+	type member struct {
+		pubkey, tier string
+		joined       time.Time
+	}
+	var members []member
+	for rows.Next() {
+		var m member
+		if err := rows.Scan(&m.pubkey, &m.tier, &m.joined); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		members = append(members, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	awarded := 0
+	now := time.Now()
+	for _, m := range members {
+		for _, badge := range milestoneBadges(m.tier, m.joined, now) {
+			if !defined[badge] {
+				continue
+			}
+			ok, err := awardBadge(ctx, badge, m.pubkey, false)
+			if err != nil {
+				return awarded, err
+			}
+			if ok {
+				awarded++
+			}
+		}
+	}
+	return awarded, nil
+}
+
+// runBadgeAwarder checks milestones hourly. It needs a relay signer.
+func runBadgeAwarder(ctx context.Context) {
+	if !canSignRelayEvents() {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if n, err := awardMilestones(ctx); err != nil {
+			log.Printf("[badges] Error awarding milestone badges: %v", err)
+		} else if n > 0 {
+			log.Printf("[badges] Awarded %d milestone badges", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ─── HTTP ──────────────────────────────────────────────────────────────────────
+
+type badgeRequest struct {
+	Badge       string `json:"badge"`
+	Pubkey      string `json:"pubkey"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Image       string `json:"image"`
+}
+
+// registerBadgeAPI mounts the admin badge endpoints (POST, JSON body) on the
+// admin mux.
+func registerBadgeAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/badges", badgeAdminAPI(func(w http.ResponseWriter, r *http.Request, req badgeRequest) {
+		if req.Badge == "" || req.Name == "" {
+			httpError(w, r, adminPubkey, http.StatusBadRequest, msgBadgeNameRequired)
+			return
+		}
+		event, err := defineBadge(r.Context(), req.Badge, req.Name, req.Description, req.Image)
+		writeAPIResult(w, event, err)
+	}))
+	mux.HandleFunc("/admin/badges/award", badgeAdminAPI(func(w http.ResponseWriter, r *http.Request, req badgeRequest) {
+		if !nostr.IsValid32ByteHex(req.Pubkey) {
+			httpError(w, r, adminPubkey, http.StatusBadRequest, msgPubkeyNotHex)
+			return
+		}
+		awarded, err := awardBadge(r.Context(), req.Badge, req.Pubkey, true)
+		if errors.Is(err, errBadgeNotDefined) {
+			httpError(w, r, adminPubkey, http.StatusNotFound, msgBadgeNotDefined)
+			return
+		}
+		writeAPIResult(w, map[string]interface{}{"badge": req.Badge, "pubkey": req.Pubkey, "awarded": awarded}, err)
+	}))
+	mux.HandleFunc("/admin/badges/revoke", badgeAdminAPI(func(w http.ResponseWriter, r *http.Request, req badgeRequest) {
+		revoked, err := revokeBadge(r.Context(), req.Badge, req.Pubkey)
+		writeAPIResult(w, map[string]interface{}{"badge": req.Badge, "pubkey": req.Pubkey, "revoked": revoked}, err)
+	}))
+}
+
+// badgeAdminAPI restricts a POST to the main relay's admin and decodes its
+// JSON body for h.
+func badgeAdminAPI(h func(w http.ResponseWriter, r *http.Request, req badgeRequest)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pubkey := nip98Admin(r)
+		if pubkey != adminPubkey {
+			httpError(w, r, pubkey, http.StatusForbidden, msgRelayAdminOnly)
+			return
+		}
+		if !canSignRelayEvents() {
+			httpError(w, r, pubkey, http.StatusServiceUnavailable, msgSigningKeyMissing)
+			return
+		}
+		var req badgeRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			httpError(w, r, pubkey, http.StatusBadRequest, msgMalformedJSON)
+			return
+		}
+		h(w, r, req)
+	}
+}
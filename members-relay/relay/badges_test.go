@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMilestoneBadges(t *testing.T) {
+	prev := foundingCutoff
+	defer func() { foundingCutoff = prev }()
+	foundingCutoff = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)
+
+	got := milestoneBadges("standard", time.Date(2024, 10, 15, 0, 0, 0, 0, time.UTC), now)
+	want := []string{"tier-standard", "founding-member", "1-year-subscriber", "2-year-subscriber"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got := milestoneBadges("pro", now.AddDate(0, -6, 0), now); !reflect.DeepEqual(got, []string{"tier-pro"}) {
+		t.Fatalf("new member earned %v", got)
+	}
+}
+
+// withRelayKey configures a throwaway relay signing key for the test.
+func withRelayKey(t testing.TB) {
+	t.Helper()
+	prevSK, prevPK := relayPrivateKey, relaySigningPubkey
+	relayPrivateKey = nostr.GeneratePrivateKey()
+	relaySigningPubkey, _ = nostr.GetPublicKey(relayPrivateKey)
+	t.Cleanup(func() { relayPrivateKey, relaySigningPubkey = prevSK, prevPK })
+}
+
+func TestBadgeAwardsIdempotentAndRevocable(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	recipient := pubkeys(1)[0]
+
+	if _, err := awardBadge(ctx, "course-graduate", recipient, true); err != errBadgeNotDefined {
+		t.Fatalf("award of undefined badge: %v", err)
+	}
+	if _, err := defineBadge(ctx, "course-graduate", "Course Graduate", "Finished the bread course", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	awards := func() int {
+		var n int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM events WHERE kind = $1 AND pubkey = $2",
+			KindBadgeAward, relaySigningPubkey).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	for i, want := range []bool{true, false} {
+		awarded, err := awardBadge(ctx, "course-graduate", recipient, true)
+		if err != nil || awarded != want {
+			t.Fatalf("award %d: %v (%v)", i, awarded, err)
+		}
+	}
+	if n := awards(); n != 1 {
+		t.Fatalf("expected one kind 8, got %d", n)
+	}
+
+	if revoked, err := revokeBadge(ctx, "course-graduate", recipient); err != nil || !revoked {
+		t.Fatalf("revoke: %v (%v)", revoked, err)
+	}
+	if n := awards(); n != 0 {
+		t.Fatalf("revoked award still stored (%d)", n)
+	}
+	// The automatic awarder does not hand a revoked badge back; an admin can.
+	if awarded, _ := awardBadge(ctx, "course-graduate", recipient, false); awarded {
+		t.Fatal("automatic award reinstated a revoked badge")
+	}
+	if awarded, err := awardBadge(ctx, "course-graduate", recipient, true); err != nil || !awarded {
+		t.Fatalf("manual re-award: %v (%v)", awarded, err)
+	}
+}
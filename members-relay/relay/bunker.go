@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// REMOTE SIGNER (NIP-46)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// RELAY_PRIVATE_KEY puts the relay's key in the container's environment,
+// where anything that can read it can take it; it remains for development.
+// In production RELAY_BUNKER_URL (bunker://<signer pubkey>?relay=wss://...
+// &secret=...) hands every relay signature to a NIP-46 remote signer
+// instead. The relay keeps one connection to the bunker's relay, opening it
+// again when it drops, and asks for each signature with sign_event: an
+// attempt times out after RELAY_BUNKER_TIMEOUT and a signature is tried
+// bunkerAttempts times. Requests are NIP-04 encrypted. The relay talks to
+// the bunker as RELAY_BUNKER_CLIENT_KEY, so an approval given once survives
+// restarts; without it each start uses a fresh key and relies on the URL's
+// secret.
+//
+// A signature that still fails is an error like any other: group metadata
+// and join and leave confirmations stay queued for the group sync, which
+// retries them (see GROUP SYNC), while on-demand events (labels, badges)
+// fail their request. Startup connects and asks the bunker for its public
+// key, which becomes relaySigningPubkey; a signature by any other key is
+// refused.
+
+// bunkerAttempts is how many times a request to the bunker is tried.
+const bunkerAttempts = 3
+
+type bunkerConfig struct {
+	URL       string
+	ClientKey string
+	Timeout   time.Duration
+}
+
+var bunkerCfg bunkerConfig
+
+// relayBunker signs relay events when RELAY_BUNKER_URL is set, else nil.
+var relayBunker *bunkerSigner
+
+func loadBunkerConfig() {
+	bunkerCfg = bunkerConfig{
+		URL:       envOr("RELAY_BUNKER_URL", ""),
+		ClientKey: envOr("RELAY_BUNKER_CLIENT_KEY", ""),
+		Timeout:   envDuration("RELAY_BUNKER_TIMEOUT", 10*time.Second),
+	}
+}
+
+// canSignRelayEvents reports whether the relay has a key or a bunker to
+// sign its own events with.
+func canSignRelayEvents() bool {
+	return relayPrivateKey != "" || relayBunker != nil
+}
+
+type bunkerSigner struct {
+	target   string // the bunker's pubkey
+	relays   []string
+	secret   string
+	clientSK string
+	clientPK string
+	shared   []byte // NIP-04 key between clientSK and target
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	conn    *nostr.Relay
+	serial  int64
+	pending map[string]chan bunkerResponse
+}
+
+type bunkerRequest struct {
+	ID     string   `json:"id"`
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+}
+
+type bunkerResponse struct {
+	ID     string `json:"id"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// newBunkerSigner parses a bunker:// URL. clientSK is the key the relay
+// talks to the bunker as, "" for a fresh one.
+func newBunkerSigner(bunkerURL, clientSK string, timeout time.Duration) (*bunkerSigner, error) {
+	u, err := url.Parse(bunkerURL)
+	if err != nil || u.Scheme != "bunker" {
+		return nil, fmt.Errorf("not a bunker:// URL")
+	}
+	if !nostr.IsValidPublicKey(u.Host) {
+		return nil, fmt.Errorf("bad signer pubkey %q", u.Host)
+	}
+	b := &bunkerSigner{
+		target:  u.Host,
+		relays:  u.Query()["relay"],
+		secret:  u.Query().Get("secret"),
+		timeout: timeout,
+		pending: make(map[string]chan bunkerResponse),
+	}
+	if len(b.relays) == 0 {
+		return nil, fmt.Errorf("the URL names no relay")
+	}
+	if clientSK == "" {
+		clientSK = nostr.GeneratePrivateKey()
+	}
+	if b.clientPK, err = nostr.GetPublicKey(clientSK); err != nil {
+		return nil, fmt.Errorf("bad client key: %w", err)
+	}
+	b.clientSK = clientSK
+	if b.shared, err = nip04.ComputeSharedSecret(b.target, clientSK); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// startBunker connects to the configured bunker and adopts its public key
+// as the relay's signing pubkey.
+func startBunker(ctx context.Context) error {
+	b, err := newBunkerSigner(bunkerCfg.URL, bunkerCfg.ClientKey, bunkerCfg.Timeout)
+	if err != nil {
+		return err
+	}
+	if _, err := b.rpc(ctx, "connect", b.target, b.secret); err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	pubkey, err := b.rpc(ctx, "get_public_key")
+	if err != nil {
+		return fmt.Errorf("get_public_key: %w", err)
+	}
+	if !nostr.IsValidPublicKey(pubkey) {
+		return fmt.Errorf("get_public_key returned %q", pubkey)
+	}
+	relayBunker, relaySigningPubkey = b, pubkey
+	return nil
+}
+
+// sign has the bunker sign event, which already carries relaySigningPubkey
+// and its created_at.
+func (b *bunkerSigner) sign(ctx context.Context, event *nostr.Event) error {
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	result, err := b.rpc(ctx, "sign_event", string(raw))
+	if err != nil {
+		return err
+	}
+	var signed nostr.Event
+	if err := json.Unmarshal([]byte(result), &signed); err != nil {
+		return fmt.Errorf("unreadable signed event: %w", err)
+	}
+	if signed.PubKey != event.PubKey || signed.Kind != event.Kind || signed.CreatedAt != event.CreatedAt || signed.Content != event.Content {
+		return errors.New("the signer returned a different event")
+	}
+	if ok, err := signed.CheckSignature(); err != nil || !ok || !signed.CheckID() {
+		return errors.New("the signer returned a bad signature")
+	}
+	event.ID, event.Sig = signed.ID, signed.Sig
+	return nil
+}
+
+// rpc sends a request, trying bunkerAttempts times, each attempt on a
+// fresh connection if the last one failed.
+func (b *bunkerSigner) rpc(ctx context.Context, method string, params ...string) (string, error) {
+	var err error
+	for attempt := 1; attempt <= bunkerAttempts; attempt++ {
+		var result string
+		if result, err = b.call(ctx, method, params); err == nil {
+			return result, nil
+		}
+		var refused bunkerError
+		if errors.As(err, &refused) || ctx.Err() != nil {
+			return "", err
+		}
+		log.Printf("[NIP-46] %s attempt %d failed: %v", method, attempt, err)
+		b.disconnect()
+	}
+	return "", err
+}
+
+// bunkerError is an error the bunker answered with, which a retry would
+// only repeat.
+type bunkerError string
+
+func (e bunkerError) Error() string { return "signer refused: " + string(e) }
+
+// call makes one attempt at a request.
+func (b *bunkerSigner) call(ctx context.Context, method string, params []string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	conn, err := b.connection(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	b.mu.Lock()
+	b.serial++
+	id := strconv.FormatInt(b.serial, 10)
+	responses := make(chan bunkerResponse, 1)
+	b.pending[id] = responses
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.pending, id)
+		b.mu.Unlock()
+	}()
+
+	raw, _ := json.Marshal(bunkerRequest{ID: id, Method: method, Params: params})
+	content, err := nip04.Encrypt(string(raw), b.shared)
+	if err != nil {
+		return "", err
+	}
+	request := nostr.Event{
+		Kind:      nostr.KindNostrConnect,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", b.target}},
+		Content:   content,
+	}
+	if err := request.Sign(b.clientSK); err != nil {
+		return "", err
+	}
+	if err := conn.Publish(ctx, request); err != nil {
+		return "", err
+	}
+	for {
+		select {
+		case resp := <-responses:
+			if resp.Result == "auth_url" {
+				// The bunker wants the operator's approval first; its
+				// answer follows under the same id.
+				log.Printf("[NIP-46] Signer asks for approval of %s at %s", method, resp.Error)
+				continue
+			}
+			if resp.Error != "" {
+				return "", bunkerError(resp.Error)
+			}
+			return resp.Result, nil
+		case <-ctx.Done():
+			return "", fmt.Errorf("no answer from the signer: %w", ctx.Err())
+		}
+	}
+}
+
+// connection returns the open connection to the bunker's relay, opening
+// one to the first of its relays that answers if there is none.
+func (b *bunkerSigner) connection(ctx context.Context) (*nostr.Relay, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil && b.conn.IsConnected() {
+		return b.conn, nil
+	}
+	var errs []error
+	for _, relayURL := range b.relays {
+		conn, err := nostr.RelayConnect(ctx, relayURL)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		since := nostr.Now() - 60
+		sub, err := conn.Subscribe(conn.Context(), nostr.Filters{{
+			Kinds: []int{nostr.KindNostrConnect},
+			Tags:  nostr.TagMap{"p": {b.clientPK}},
+			Since: &since,
+		}})
+		if err != nil {
+			conn.Close()
+			errs = append(errs, err)
+			continue
+		}
+		go b.listen(sub)
+		b.conn = conn
+		return conn, nil
+	}
+	return nil, fmt.Errorf("no bunker relay reachable: %w", errors.Join(errs...))
+}
+
+// disconnect drops the connection so the next attempt opens a new one.
+func (b *bunkerSigner) disconnect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn = nil
+	}
+}
+
+// listen hands the bunker's responses to the requests waiting for them.
+func (b *bunkerSigner) listen(sub *nostr.Subscription) {
+	for event := range sub.Events {
+		if event.PubKey != b.target || !event.CheckID() {
+			continue
+		}
+		if ok, err := event.CheckSignature(); err != nil || !ok {
+			continue
+		}
+		plain, err := nip04.Decrypt(event.Content, b.shared)
+		if err != nil {
+			continue
+		}
+		var resp bunkerResponse
+		if json.Unmarshal([]byte(plain), &resp) != nil {
+			continue
+		}
+		b.mu.Lock()
+		waiting := b.pending[resp.ID]
+		b.mu.Unlock()
+		if waiting != nil {
+			select {
+			case waiting <- resp:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+func TestNewBunkerSigner(t *testing.T) {
+	signer := pubkeys(1)[0]
+	for _, bad := range []string{
+		"nostrconnect://" + signer + "?relay=wss://bunker.example",
+		"bunker://npub1signer?relay=wss://bunker.example",
+		"bunker://" + signer + "?secret=s3cret",
+	} {
+		if _, err := newBunkerSigner(bad, "", time.Second); err == nil {
+			t.Errorf("%s: accepted", bad)
+		}
+	}
+	b, err := newBunkerSigner("bunker://"+signer+"?relay=wss://one.example&relay=wss://two.example&secret=s3cret", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.target != signer || len(b.relays) != 2 || b.secret != "s3cret" || b.clientPK == "" {
+		t.Fatalf("parsed %+v", b)
+	}
+}
+
+// fakeBunker answers NIP-46 requests on relayURL as bunkerSK, signing with
+// userSK and refusing kind 9999.
+func fakeBunker(t *testing.T, relayURL, bunkerSK, userSK, secret string) {
+	t.Helper()
+	bunkerPK, _ := nostr.GetPublicKey(bunkerSK)
+	userPK, _ := nostr.GetPublicKey(userSK)
+	conn, err := nostr.RelayConnect(context.Background(), relayURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	sub, err := conn.Subscribe(conn.Context(), nostr.Filters{{Kinds: []int{nostr.KindNostrConnect}, Tags: nostr.TagMap{"p": {bunkerPK}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for req := range sub.Events {
+			shared, _ := nip04.ComputeSharedSecret(req.PubKey, bunkerSK)
+			plain, err := nip04.Decrypt(req.Content, shared)
+			if err != nil {
+				continue
+			}
+			var r bunkerRequest
+			json.Unmarshal([]byte(plain), &r)
+			resp := bunkerResponse{ID: r.ID}
+			switch r.Method {
+			case "connect":
+				resp.Result = "ack"
+				if len(r.Params) < 2 || r.Params[1] != secret {
+					resp.Error = "bad secret"
+				}
+			case "get_public_key":
+				resp.Result = userPK
+			case "sign_event":
+				var evt nostr.Event
+				json.Unmarshal([]byte(r.Params[0]), &evt)
+				if evt.Kind == 9999 {
+					resp.Error = "kind 9999 not allowed"
+					break
+				}
+				evt.Sign(userSK)
+				raw, _ := json.Marshal(evt)
+				resp.Result = string(raw)
+			}
+			raw, _ := json.Marshal(resp)
+			content, _ := nip04.Encrypt(string(raw), shared)
+			answer := nostr.Event{Kind: nostr.KindNostrConnect, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"p", req.PubKey}}, Content: content}
+			answer.Sign(bunkerSK)
+			conn.Publish(context.Background(), answer)
+		}
+	}()
+}
+
+func TestBunkerSigning(t *testing.T) {
+	srv := httptest.NewServer(khatru.NewRelay())
+	defer srv.Close()
+	relayURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	bunkerSK, userSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	bunkerPK, _ := nostr.GetPublicKey(bunkerSK)
+	userPK, _ := nostr.GetPublicKey(userSK)
+	fakeBunker(t, relayURL, bunkerSK, userSK, "s3cret")
+
+	prevCfg, prevBunker, prevPK, prevSK := bunkerCfg, relayBunker, relaySigningPubkey, relayPrivateKey
+	t.Cleanup(func() {
+		if relayBunker != nil && relayBunker != prevBunker {
+			relayBunker.disconnect()
+		}
+		bunkerCfg, relayBunker, relaySigningPubkey, relayPrivateKey = prevCfg, prevBunker, prevPK, prevSK
+	})
+	relayPrivateKey = ""
+	ctx := context.Background()
+
+	bunkerCfg = bunkerConfig{URL: "bunker://" + bunkerPK + "?relay=" + relayURL + "&secret=wrong", Timeout: 2 * time.Second}
+	if err := startBunker(ctx); err == nil || !strings.Contains(err.Error(), "bad secret") {
+		t.Fatalf("wrong secret: %v", err)
+	}
+	bunkerCfg.URL = "bunker://" + bunkerPK + "?relay=" + relayURL + "&secret=s3cret"
+	if err := startBunker(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if relaySigningPubkey != userPK || !canSignRelayEvents() {
+		t.Fatalf("signing pubkey %s, want %s", relaySigningPubkey, userPK)
+	}
+
+	event := nostr.Event{Kind: KindGroupAdmins, Tags: nostr.Tags{{"d", "bakers"}}}
+	if err := signRelayEvent(&event); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := event.CheckSignature(); !ok || event.PubKey != userPK {
+		t.Fatalf("bad signature on %+v", event)
+	}
+	refused := nostr.Event{Kind: 9999}
+	if err := signRelayEvent(&refused); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("refused kind: %v", err)
+	}
+
+	// A dropped connection is opened again.
+	relayBunker.disconnect()
+	again := nostr.Event{Kind: KindGroupAdmins, Tags: nostr.Tags{{"d", "bakers"}}}
+	if err := signRelayEvent(&again); err != nil {
+		t.Fatalf("after reconnect: %v", err)
+	}
+}
+
+func TestBunkerUnreachable(t *testing.T) {
+	srv := httptest.NewServer(khatru.NewRelay())
+	relayURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	srv.Close()
+	b, err := newBunkerSigner("bunker://"+pubkeys(1)[0]+"?relay="+relayURL, "", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := b.rpc(context.Background(), "get_public_key"); err == nil {
+		t.Fatal("no error from an unreachable signer")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("gave up after %s", elapsed)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// CALENDAR EVENTS (NIP-52)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Groups schedule cook-alongs as date-based (31922) or time-based (31923)
+// calendar events and members answer with RSVPs (31925). All three are
+// group-scoped when they carry an h tag. Each stored calendar event also
+// gets a calendar_events row with its start and end, so "upcoming events in
+// my groups" is one indexed query (/api/calendar/upcoming).
+
+const (
+	KindCalendarDate = 31922
+	KindCalendarTime = 31923
+	KindCalendarRSVP = 31925
+)
+
+const calendarDateLayout = "2006-01-02"
+
+// calendarSpan parses the start and end of a calendar event. Date-based
+// events run from the start date to the end date exclusive (one day when
+// absent); time-based events end at start when they have no end.
+func calendarSpan(event *nostr.Event) (start, end time.Time, reason string) {
+	startTag := event.Tags.GetFirst([]string{"start", ""})
+	if startTag == nil {
+		return start, end, "missing start tag"
+	}
+	endTag := event.Tags.GetFirst([]string{"end", ""})
+
+	parse := func(v string) (time.Time, bool) {
+		if event.Kind == KindCalendarDate {
+			t, err := time.Parse(calendarDateLayout, v)
+			return t, err == nil
+		}
+		ts, err := strconv.ParseInt(v, 10, 64)
+		return time.Unix(ts, 0).UTC(), err == nil && ts > 0
+	}
+
+	var ok bool
+	if start, ok = parse((*startTag)[1]); !ok {
+		return start, end, "malformed start tag"
+	}
+	switch {
+	case endTag != nil:
+		if end, ok = parse((*endTag)[1]); !ok {
+			return start, end, "malformed end tag"
+		}
+		if end.Before(start) {
+			return start, end, "end is before start"
+		}
+	case event.Kind == KindCalendarDate:
+		end = start.AddDate(0, 0, 1)
+	default:
+		end = start
+	}
+	return start, end, ""
+}
+
+// calendarSpanMessages gives the message for each calendarSpan reason.
+var calendarSpanMessages = map[string]msgCode{
+	"missing start tag":   msgCalendarMissingStart,
+	"malformed start tag": msgCalendarMalformedStart,
+	"malformed end tag":   msgCalendarMalformedEnd,
+	"end is before start": msgCalendarEndBeforeStart,
+}
+
+// rejectCalendarEvent is the write policy for kinds 31922, 31923 and 31925.
+func rejectCalendarEvent(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	if !isActiveMember(ctx, pubkey) {
+		return true, say(ctx, msgMembershipRequired)
+	}
+	if addressableDTag(event) == nil {
+		return true, say(ctx, msgCalendarDTag)
+	}
+	if reject, msg := rejectGroupScope(ctx, event, pubkey); reject {
+		return reject, msg
+	}
+	if event.Kind == KindCalendarRSVP {
+		return rejectRSVP(ctx, event, pubkey)
+	}
+	if _, _, reason := calendarSpan(event); reason != "" {
+		return true, say(ctx, calendarSpanMessages[reason])
+	}
+	return false, ""
+}
+
+// rejectRSVP requires the a tag to name a stored calendar event the author
+// can see. An RSVP to a group's event must carry the same h tag so it is
+// visible to exactly that group.
+func rejectRSVP(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	status := event.Tags.GetFirst([]string{"status", ""})
+	if status == nil || ((*status)[1] != "accepted" && (*status)[1] != "declined" && (*status)[1] != "tentative") {
+		return true, say(ctx, msgRSVPStatus)
+	}
+	tag := event.Tags.GetFirst([]string{"a", ""})
+	if tag == nil {
+		return true, say(ctx, msgRSVPATag)
+	}
+	parts := strings.SplitN((*tag)[1], ":", 3)
+	kind, err := strconv.Atoi(parts[0])
+	if len(parts) != 3 || err != nil || (kind != KindCalendarDate && kind != KindCalendarTime) {
+		return true, say(ctx, msgRSVPTarget)
+	}
+
+	var rawTags []byte
+	err = db.QueryRowContext(ctx,
+		"SELECT tags FROM events WHERE kind = $1 AND pubkey = $2 AND d_tag = $3 AND community = $4",
+		kind, parts[1], parts[2], communityOf(ctx).id()).Scan(&rawTags)
+	if err == sql.ErrNoRows {
+		return true, say(ctx, msgCalendarNotFound)
+	}
+	if err != nil {
+		return true, say(ctx, msgCalendarLookupFailed)
+	}
+	target := &nostr.Event{Kind: kind}
+	json.Unmarshal(rawTags, &target.Tags)
+	if groupId := getHTag(target); groupId != "" {
+		if pubkey != communityAdmin(ctx) && !isGroupMember(ctx, groupId, pubkey) {
+			return true, say(ctx, msgCalendarNotVisible)
+		}
+		if getHTag(event) != groupId {
+			return true, say(ctx, msgRSVPHTag)
+		}
+	}
+	return false, ""
+}
+
+// insertCalendarSpan records a calendar event's span for the upcoming query.
+// Replaced versions lose their row through the events foreign key.
+func insertCalendarSpan(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	if event.Kind != KindCalendarDate && event.Kind != KindCalendarTime {
+		return nil
+	}
+	start, end, reason := calendarSpan(event)
+	if reason != "" {
+		return nil
+	}
+	var groupId sql.NullString
+	if h := getHTag(event); h != "" {
+		groupId = sql.NullString{String: h, Valid: true}
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO calendar_events (event_id, group_id, starts_at, ends_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (event_id) DO NOTHING
+	`, event.ID, groupId, start, end)
+	return err
+}
+
+// upcomingGroupEvents returns calendar events of pubkey's groups that have
+// not ended yet, soonest first.
+func upcomingGroupEvents(ctx context.Context, pubkey string, limit int) ([]json.RawMessage, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT e.raw FROM calendar_events c
+		JOIN group_members gm ON gm.group_id = c.group_id AND gm.pubkey = $1
+		JOIN events e ON e.id = c.event_id
+		WHERE c.ends_at >= NOW() AND e.community = $3
+		ORDER BY c.starts_at
+		LIMIT $2
+	`, pubkey, limit, communityOf(ctx).id())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []json.RawMessage{}
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		events = append(events, raw)
+	}
+	return events, rows.Err()
+}
+
+func registerCalendarAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/api/calendar/upcoming", memberAPI(func(w http.ResponseWriter, r *http.Request, pubkey string) {
+		limit := 50
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 500 {
+				http.Error(w, "invalid: limit must be between 1 and 500", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		events, err := upcomingGroupEvents(r.Context(), pubkey, limit)
+		writeAPIResult(w, map[string]interface{}{"events": events}, err)
+	}))
+}
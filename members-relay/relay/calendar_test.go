@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCalendarSpan(t *testing.T) {
+	day := func(s string) time.Time { d, _ := time.Parse(calendarDateLayout, s); return d }
+	for _, tc := range []struct {
+		kind       int
+		tags       nostr.Tags
+		start, end time.Time
+		reason     string
+	}{
+		{KindCalendarDate, nostr.Tags{{"start", "2026-11-02"}}, day("2026-11-02"), day("2026-11-03"), ""},
+		{KindCalendarDate, nostr.Tags{{"start", "2026-11-02"}, {"end", "2026-11-05"}}, day("2026-11-02"), day("2026-11-05"), ""},
+		{KindCalendarTime, nostr.Tags{{"start", "1793000000"}, {"end", "1793003600"}}, time.Unix(1793000000, 0).UTC(), time.Unix(1793003600, 0).UTC(), ""},
+		{KindCalendarTime, nostr.Tags{{"start", "1793000000"}}, time.Unix(1793000000, 0).UTC(), time.Unix(1793000000, 0).UTC(), ""},
+		{KindCalendarTime, nil, time.Time{}, time.Time{}, "missing start tag"},
+		{KindCalendarDate, nostr.Tags{{"start", "1793000000"}}, time.Time{}, time.Time{}, "malformed start tag"},
+		{KindCalendarTime, nostr.Tags{{"start", "1793000000"}, {"end", "1792000000"}}, time.Time{}, time.Time{}, "end is before start"},
+	} {
+		start, end, reason := calendarSpan(&nostr.Event{Kind: tc.kind, Tags: tc.tags})
+		if reason != tc.reason || (reason == "" && (!start.Equal(tc.start) || !end.Equal(tc.end))) {
+			t.Errorf("%d %v: got %v %v %q", tc.kind, tc.tags, start, end, reason)
+		}
+	}
+}
+
+func TestGroupScopeConditionKinds(t *testing.T) {
+	viewer := pubkeys(1)[0]
+	if cond, _ := groupScopeCondition([]int{nostr.KindProfileMetadata}, viewer, adminPubkey, 1); cond != "" {
+		t.Fatalf("scope check applied to profiles: %s", cond)
+	}
+	cond, args := groupScopeCondition([]int{KindRecipe, KindCalendarTime}, viewer, adminPubkey, 4)
+	if !strings.Contains(cond, "kind NOT IN (31923,30023)") || !strings.Contains(cond, "$4") || len(args) != 1 {
+		t.Fatalf("unexpected scope condition %s %v", cond, args)
+	}
+	prev := adminPubkey
+	adminPubkey = viewer
+	defer func() { adminPubkey = prev }()
+	if cond, _ := groupScopeCondition(nil, viewer, adminPubkey, 1); cond != "" {
+		t.Fatalf("relay admin is scoped: %s", cond)
+	}
+}
+
+func TestCalendarRSVPAndUpcoming(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	hostSK, guestSK, outsiderSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	host, _ := nostr.GetPublicKey(hostSK)
+	guest, _ := nostr.GetPublicKey(guestSK)
+	outsider, _ := nostr.GetPublicKey(outsiderSK)
+	for _, pk := range []string{host, guest, outsider} {
+		addTestMember(t, pk)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO groups (id, name) VALUES ('bakers', 'Bakers')"); err != nil {
+		t.Fatal(err)
+	}
+	for _, pk := range []string{host, guest} {
+		if _, err := db.ExecContext(ctx,
+			"INSERT INTO group_members (group_id, pubkey, role) VALUES ('bakers', $1, 'member')", pk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	store := func(evt *nostr.Event, pubkey string) string {
+		if reject, msg := rejectCalendarEvent(ctx, evt, pubkey); reject {
+			return msg
+		}
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+		return ""
+	}
+	ts := func(at time.Time) string { return strconv.FormatInt(at.Unix(), 10) }
+	past := signedEvent(t, hostSK, KindCalendarTime, nostr.Now(), nostr.Tags{{"d", "past"}, {"h", "bakers"},
+		{"start", ts(now.Add(-3 * time.Hour))}, {"end", ts(now.Add(-2 * time.Hour))}}, "")
+	later := signedEvent(t, hostSK, KindCalendarTime, nostr.Now(), nostr.Tags{{"d", "later"}, {"h", "bakers"},
+		{"start", ts(now.Add(48 * time.Hour))}}, "")
+	soon := signedEvent(t, hostSK, KindCalendarTime, nostr.Now(), nostr.Tags{{"d", "soon"}, {"h", "bakers"},
+		{"start", ts(now.Add(time.Hour))}, {"end", ts(now.Add(2 * time.Hour))}}, "")
+	for _, evt := range []*nostr.Event{past, later, soon} {
+		if msg := store(evt, host); msg != "" {
+			t.Fatalf("calendar event rejected: %s", msg)
+		}
+	}
+
+	events, err := upcomingGroupEvents(ctx, guest, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, raw := range events {
+		var evt nostr.Event
+		json.Unmarshal(raw, &evt)
+		got = append(got, evt.ID)
+	}
+	if strings.Join(got, ",") != soon.ID+","+later.ID {
+		t.Fatalf("upcoming = %v", got)
+	}
+	if events, _ := upcomingGroupEvents(ctx, outsider, 10); len(events) != 0 {
+		t.Fatalf("non-member sees %d upcoming events", len(events))
+	}
+
+	address := "31923:" + host + ":soon"
+	rsvp := func(sk, pubkey string, tags nostr.Tags) string {
+		return store(signedEvent(t, sk, KindCalendarRSVP, nostr.Now(), append(nostr.Tags{{"d", "rsvp-soon"}, {"status", "accepted"}}, tags...), ""), pubkey)
+	}
+	if msg := rsvp(guestSK, guest, nostr.Tags{{"a", address}, {"h", "bakers"}}); msg != "" {
+		t.Fatalf("member RSVP rejected: %s", msg)
+	}
+	if msg := rsvp(guestSK, guest, nostr.Tags{{"a", address}}); msg == "" {
+		t.Fatal("RSVP without the event's h tag accepted")
+	}
+	if msg := rsvp(outsiderSK, outsider, nostr.Tags{{"a", address}}); msg == "" {
+		t.Fatal("RSVP to an invisible event accepted")
+	}
+	if msg := rsvp(guestSK, guest, nostr.Tags{{"a", "31923:" + host + ":missing"}, {"h", "bakers"}}); msg == "" {
+		t.Fatal("RSVP to a missing event accepted")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// COMMUNITIES
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// One binary and database can host several communities that must not see
+// each other. A request belongs to a community by its Host header or, for
+// the relay endpoint only, a path prefix; anything else is the default
+// community, configured by the RELAY_* variables as before.
+// RELAY_COMMUNITIES_FILE lists the others as JSON.
+//
+// Each community gets its own khatru relay, so NIP-11, NIP-42's relay URL
+// and live broadcasts stay per community, while every relay shares the hooks
+// below. The hooks find their community with communityOf(ctx): members,
+// groups and events carry a community column, and every membership, group
+// and event lookup is confined to it. The relay signing key, media storage
+// and the background workers are shared; relay-issued badges, the NIP-89
+// handler, profile hydration and the public mirror serve the default
+// community only.
+
+const defaultCommunityID = "default"
+
+type community struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Pubkey      string   `json:"pubkey"`       // NIP-11 pubkey, the admin's if empty
+	AdminPubkey string   `json:"admin_pubkey"` // plays the part of RELAY_PUBKEY
+	Contact     string   `json:"contact"`
+	Hosts       []string `json:"hosts"`
+	PathPrefix  string   `json:"path_prefix"`
+	URL         string   `json:"url"` // NIP-42 relay URL; needed with PathPrefix
+
+	relay *khatru.Relay
+}
+
+// communities holds the configured communities other than the default.
+var communities = map[string]*community{}
+
+func loadCommunityConfig() {
+	path := envOr("RELAY_COMMUNITIES_FILE", "")
+	if path == "" {
+		return
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Reading RELAY_COMMUNITIES_FILE: %v", err)
+	}
+	list, err := parseCommunities(raw)
+	if err != nil {
+		log.Fatalf("Invalid RELAY_COMMUNITIES_FILE: %v", err)
+	}
+	for _, c := range list {
+		communities[c.ID] = c
+	}
+}
+
+// parseCommunities decodes and checks a communities file.
+func parseCommunities(raw []byte) ([]*community, error) {
+	var list []*community
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{defaultCommunityID: true}
+	routes := map[string]string{}
+	for _, c := range list {
+		switch {
+		case c.ID == "":
+			return nil, fmt.Errorf("community without an id")
+		case seen[c.ID]:
+			return nil, fmt.Errorf("community %q is defined twice or reserved", c.ID)
+		case !nostr.IsValid32ByteHex(c.AdminPubkey):
+			return nil, fmt.Errorf("community %q: admin_pubkey must be a hex pubkey", c.ID)
+		case len(c.Hosts) == 0 && c.PathPrefix == "":
+			return nil, fmt.Errorf("community %q: needs hosts or a path_prefix", c.ID)
+		case c.PathPrefix != "" && (!strings.HasPrefix(c.PathPrefix, "/") || c.PathPrefix == "/"):
+			return nil, fmt.Errorf("community %q: path_prefix must start with / and not be /", c.ID)
+		}
+		seen[c.ID] = true
+		c.PathPrefix = strings.TrimSuffix(c.PathPrefix, "/")
+		keys := append([]string{}, c.Hosts...)
+		if c.PathPrefix != "" {
+			keys = append(keys, c.PathPrefix)
+		}
+		for _, k := range keys {
+			k = strings.ToLower(k)
+			if other, ok := routes[k]; ok {
+				return nil, fmt.Errorf("communities %q and %q share %s", other, c.ID, k)
+			}
+			routes[k] = c.ID
+		}
+		if c.Name == "" {
+			c.Name = c.ID
+		}
+		if c.Pubkey == "" {
+			c.Pubkey = c.AdminPubkey
+		}
+	}
+	return list, nil
+}
+
+// id and admin treat a nil community as the default one.
+func (c *community) id() string {
+	if c == nil {
+		return defaultCommunityID
+	}
+	return c.ID
+}
+
+func (c *community) admin() string {
+	if c == nil {
+		return adminPubkey
+	}
+	return c.AdminPubkey
+}
+
+// communityForRequest picks the community a request addresses by host, then
+// by path prefix. It returns nil for the default community.
+func communityForRequest(r *http.Request) *community {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, c := range communities {
+		for _, h := range c.Hosts {
+			if strings.EqualFold(h, host) {
+				return c
+			}
+		}
+	}
+	for _, c := range communities {
+		if c.PathPrefix != "" && (r.URL.Path == c.PathPrefix || strings.HasPrefix(r.URL.Path, c.PathPrefix+"/")) {
+			return c
+		}
+	}
+	return nil
+}
+
+type communityKey struct{}
+
+func withCommunity(ctx context.Context, c *community) context.Context {
+	return context.WithValue(ctx, communityKey{}, c.id())
+}
+
+// communityOf returns the community ctx works for: the one set with
+// withCommunity or, in khatru hooks, the one of the websocket's request.
+// It returns nil for the default community.
+func communityOf(ctx context.Context) *community {
+	id, _ := ctx.Value(communityKey{}).(string)
+	if id == "" {
+		if ws := khatru.GetConnection(ctx); ws != nil && ws.Request != nil {
+			id, _ = ws.Request.Context().Value(communityKey{}).(string)
+		}
+	}
+	return communities[id]
+}
+
+// communityAdmin is the pubkey with relay admin rights in ctx's community.
+func communityAdmin(ctx context.Context) string {
+	return communityOf(ctx).admin()
+}
+
+// relayFor returns the khatru relay serving ctx's community.
+func relayFor(ctx context.Context) *khatru.Relay {
+	if c := communityOf(ctx); c != nil && c.relay != nil {
+		return c.relay
+	}
+	return relay
+}
+
+// routeCommunity tags each request with its community before next sees it.
+func routeCommunity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c := communityForRequest(r); c != nil {
+			r = r.WithContext(withCommunity(r.Context(), c))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startCommunityRelays builds the relay of every configured community.
+func startCommunityRelays() {
+	for _, c := range communities {
+		c.relay = newMembersRelay(c)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// withCommunities installs list as the configured communities for one test.
+func withCommunities(t *testing.T, list ...*community) {
+	t.Helper()
+	prev := communities
+	communities = map[string]*community{}
+	for _, c := range list {
+		communities[c.ID] = c
+	}
+	t.Cleanup(func() { communities = prev })
+}
+
+func TestParseCommunities(t *testing.T) {
+	admin := pubkeys(1)[0]
+	list, err := parseCommunities([]byte(`[{"id":"fr","admin_pubkey":"` + admin + `","hosts":["club.example"],"path_prefix":"/fr/"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := list[0]; c.Name != "fr" || c.Pubkey != admin || c.PathPrefix != "/fr" {
+		t.Fatalf("defaults not applied: %+v", c)
+	}
+
+	for name, raw := range map[string]string{
+		"reserved id":   `[{"id":"default","admin_pubkey":"` + admin + `","hosts":["a"]}]`,
+		"duplicate id":  `[{"id":"a","admin_pubkey":"` + admin + `","hosts":["a"]},{"id":"a","admin_pubkey":"` + admin + `","hosts":["b"]}]`,
+		"shared host":   `[{"id":"a","admin_pubkey":"` + admin + `","hosts":["x"]},{"id":"b","admin_pubkey":"` + admin + `","hosts":["X"]}]`,
+		"no route":      `[{"id":"a","admin_pubkey":"` + admin + `"}]`,
+		"bad admin":     `[{"id":"a","admin_pubkey":"npub1","hosts":["a"]}]`,
+		"root prefix":   `[{"id":"a","admin_pubkey":"` + admin + `","path_prefix":"/"}]`,
+		"relative path": `[{"id":"a","admin_pubkey":"` + admin + `","path_prefix":"fr"}]`,
+	} {
+		if _, err := parseCommunities([]byte(raw)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestCommunityForRequest(t *testing.T) {
+	fr := &community{ID: "fr", Hosts: []string{"club.example"}}
+	es := &community{ID: "es", PathPrefix: "/es"}
+	withCommunities(t, fr, es)
+
+	for _, tc := range []struct {
+		host, path string
+		want       *community
+	}{
+		{"club.example", "/", fr},
+		{"Club.Example:443", "/api/calendar/upcoming", fr},
+		{"members.zap.cooking", "/es", es},
+		{"members.zap.cooking", "/es/", es},
+		{"members.zap.cooking", "/escape", nil},
+		{"members.zap.cooking", "/", nil},
+		{"club.example.evil", "/", nil},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://"+tc.host+tc.path, nil)
+		if got := communityForRequest(r); got != tc.want {
+			t.Errorf("%s%s: got %v, want %v", tc.host, tc.path, got.id(), tc.want.id())
+		}
+	}
+}
+
+func TestCommunityOfContext(t *testing.T) {
+	fr := &community{ID: "fr", AdminPubkey: pubkeys(2)[1]}
+	withCommunities(t, fr)
+
+	ctx := context.Background()
+	if communityOf(ctx) != nil || communityAdmin(ctx) != adminPubkey {
+		t.Fatal("a bare context is not the default community")
+	}
+	if communityOf(withCommunity(ctx, fr)) != fr || communityAdmin(withCommunity(ctx, fr)) != fr.AdminPubkey {
+		t.Fatal("community not carried by the context")
+	}
+	if communityOf(withCommunity(ctx, &community{ID: "gone"})) != nil {
+		t.Fatal("an unconfigured community must fall back to the default")
+	}
+}
+
+// The relay admin of one community has no admin rights in another.
+func TestGroupScopeAdminIsPerCommunity(t *testing.T) {
+	saved := adminPubkey
+	defer func() { adminPubkey = saved }()
+	keys := pubkeys(2)
+	adminPubkey = keys[0]
+	fr := &community{ID: "fr", AdminPubkey: keys[1]}
+
+	scoped := nostr.Filter{Kinds: []int{KindCalendarTime}}
+	for _, tc := range []struct {
+		c      *community
+		viewer string
+		bypass bool
+	}{
+		{nil, keys[0], true},
+		{nil, keys[1], false},
+		{fr, keys[1], true},
+		{fr, keys[0], false},
+	} {
+		q, args := buildViewerQuery(scoped, tc.c, tc.viewer, false)
+		if bypass := !strings.Contains(q, "group_members"); bypass != tc.bypass {
+			t.Errorf("community %s, viewer %s: bypass = %v, want %v", tc.c.id(), tc.viewer[:8], bypass, tc.bypass)
+		}
+		if !strings.Contains(q, "community = $") || args[len(args)-1] != tc.c.id() {
+			t.Errorf("community %s: query not confined: %s %v", tc.c.id(), q, args)
+		}
+	}
+}
+
+// Restricted deliveries only consider connections to the event's community.
+func TestDeliverMatchingStaysInCommunity(t *testing.T) {
+	tracker := &connTracker{conns: make(map[*khatru.WebSocket]*trackedConn)}
+	live := func() map[string]*openSub {
+		return map[string]*openSub{"s": {live: []nostr.Filter{{Kinds: []int{KindCalendarTime}}}}}
+	}
+	tracker.conns[&khatru.WebSocket{AuthedPublicKey: "home"}] = &trackedConn{subs: live(), community: defaultCommunityID}
+	tracker.conns[&khatru.WebSocket{AuthedPublicKey: "away"}] = &trackedConn{subs: live(), community: "fr"}
+
+	event := &nostr.Event{Kind: KindCalendarTime}
+	var asked []string
+	tracker.deliverMatching(defaultCommunityID, event, event, func(pk string) bool {
+		asked = append(asked, pk)
+		return false
+	})
+	if len(asked) != 1 || asked[0] != "home" {
+		t.Fatalf("expected only the default community's connection, got %v", asked)
+	}
+}
+
+func TestRelayInfoPerCommunity(t *testing.T) {
+	savedRelay, savedLimits := relay, limits
+	defer func() { relay, limits = savedRelay, savedLimits }()
+	limits = relayLimits{MaxMessageLength: 1 << 16, MaxSubscriptions: 4, MaxFilters: 4}
+	relay = newMembersRelay(nil)
+	fr := &community{ID: "fr", Name: "Club", Description: "Cuisine", Pubkey: pubkeys(1)[0], Hosts: []string{"club.example"}}
+	withCommunities(t, fr)
+	startCommunityRelays()
+
+	handler := routeCommunity(http.HandlerFunc(handleRelayInfo))
+	info := func(host string) nip11.RelayInformationDocument {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		req.Header.Set("Accept", "application/nostr+json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var doc nip11.RelayInformationDocument
+		if err := json.NewDecoder(rec.Body).Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+		return doc
+	}
+	if doc := info("club.example"); doc.Name != "Club" || doc.Description != "Cuisine" || doc.PubKey != fr.Pubkey {
+		t.Fatalf("community document: %+v", doc)
+	}
+	if doc := info("members.zap.cooking"); doc.Name != relayName || doc.PubKey == fr.Pubkey {
+		t.Fatalf("default document: %+v", doc)
+	}
+}
+
+func TestCommunityHelpersDoNotLeak(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	keys := pubkeys(3)
+	alice, bob, frAdmin := keys[0], keys[1], keys[2]
+	fr := &community{ID: "fr", AdminPubkey: frAdmin, Hosts: []string{"club.example"}}
+	withCommunities(t, fr)
+	frCtx := withCommunity(ctx, fr)
+
+	for _, m := range []struct{ pubkey, community string }{{alice, defaultCommunityID}, {bob, "fr"}} {
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO members (pubkey, status, subscription_start, subscription_end, community)
+			VALUES ($1, 'active', NOW(), NOW() + INTERVAL '30 days', $2)
+		`, m.pubkey, m.community); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO groups (id, name, community) VALUES ('bakers', 'Bakers', 'default'), ('boulangers', 'Boulangers', 'fr')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO group_members (group_id, pubkey, role) VALUES ('bakers', $1, 'admin'), ('boulangers', $2, 'admin')",
+		alice, bob); err != nil {
+		t.Fatal(err)
+	}
+
+	// Members and admins
+	if !isActiveMember(ctx, alice) || isActiveMember(frCtx, alice) {
+		t.Error("alice's membership must hold in the default community only")
+	}
+	if !isActiveMember(frCtx, bob) || isActiveMember(ctx, bob) {
+		t.Error("bob's membership must hold in fr only")
+	}
+	if !isActiveMember(frCtx, frAdmin) || isActiveMember(ctx, frAdmin) {
+		t.Error("fr's admin must be an admin in fr only")
+	}
+
+	// Groups
+	if !groupExists(ctx, "bakers") || groupExists(frCtx, "bakers") || groupExists(ctx, "boulangers") {
+		t.Error("groups must exist in their own community only")
+	}
+	if !groupIdTaken(frCtx, "bakers") {
+		t.Error("group ids are global")
+	}
+	if isGroupMember(frCtx, "bakers", alice) || isGroupAdmin(frCtx, "bakers", alice) || isGroupModerator(frCtx, "bakers", alice) {
+		t.Error("group roles leak across communities")
+	}
+	if isGroupMember(ctx, "boulangers", frAdmin) {
+		t.Error("fr's admin has rights in another community's group")
+	}
+
+	// Events, including replaceable versions
+	aliceSK := nostr.GeneratePrivateKey()
+	author, _ := nostr.GetPublicKey(aliceSK)
+	now := nostr.Now()
+	home := signedEvent(t, aliceSK, 0, now-10, nil, `{"name":"alice"}`)
+	away := signedEvent(t, aliceSK, 0, now, nil, `{"name":"alice (fr)"}`)
+	if err := persistEvent(ctx, home); err != nil {
+		t.Fatal(err)
+	}
+	if err := persistEvent(frCtx, away); err != nil {
+		t.Fatal(err)
+	}
+	visible := func(ctx context.Context) []string {
+		var ids []string
+		ch, _ := queryEvents(ctx, nostr.Filter{Authors: []string{author}})
+		for evt := range ch {
+			ids = append(ids, evt.ID)
+		}
+		return ids
+	}
+	if got := visible(ctx); len(got) != 1 || got[0] != home.ID {
+		t.Errorf("default community sees %v, want only %s", got, home.ID)
+	}
+	if got := visible(frCtx); len(got) != 1 || got[0] != away.ID {
+		t.Errorf("fr sees %v, want only %s", got, away.ID)
+	}
+	if stored, _ := storedEvent(frCtx, home.ID); stored != nil {
+		t.Error("storedEvent found another community's event")
+	}
+}
+
+func TestCommunityRelaysDoNotLeak(t *testing.T) {
+	openTestDB(t)
+	savedRelay, savedLimits, savedCfg := relay, limits, serverCfg
+	defer func() { relay, limits, serverCfg = savedRelay, savedLimits, savedCfg }()
+	serverCfg = testServerConfig(true)
+	limits = relayLimits{MaxMessageLength: 1 << 16, MaxSubscriptions: 8, MaxFilters: 4, MaxFilterConditions: 100}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		relayFor(r.Context()).ServeHTTP(w, r)
+	})
+	url := startTestServer(t, routeCommunity(mux), serverCfg)
+
+	fr := &community{ID: "fr", Name: "Club", AdminPubkey: pubkeys(1)[0], PathPrefix: "/fr", URL: url + "/fr"}
+	withCommunities(t, fr)
+	relay = newMembersRelay(nil)
+	startCommunityRelays()
+
+	aliceSK, bobSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	alice, _ := nostr.GetPublicKey(aliceSK)
+	bob, _ := nostr.GetPublicKey(bobSK)
+	for _, m := range []struct{ pubkey, community string }{{alice, defaultCommunityID}, {bob, "fr"}} {
+		if _, err := db.ExecContext(context.Background(), `
+			INSERT INTO members (pubkey, status, subscription_start, subscription_end, community)
+			VALUES ($1, 'active', NOW(), NOW() + INTERVAL '30 days', $2)
+		`, m.pubkey, m.community); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dial := func(endpoint, sk string) *wsTestClient {
+		c := dialTestRelay(t, endpoint)
+		if !c.auth(endpoint, c.challenge(), sk) {
+			t.Fatalf("AUTH at %s refused", endpoint)
+		}
+		return c
+	}
+	publish := func(c *wsTestClient, evt *nostr.Event) (bool, string) {
+		raw, _ := nostr.EventEnvelope{Event: *evt}.MarshalJSON()
+		c.send(string(raw))
+		ok := c.next(func(env nostr.Envelope) bool {
+			ok, isOK := env.(*nostr.OKEnvelope)
+			return isOK && ok.EventID == evt.ID
+		}).(*nostr.OKEnvelope)
+		return ok.OK, ok.Reason
+	}
+	history := func(c *wsTestClient, subID string) []string {
+		c.send(`["REQ","` + subID + `",{"kinds":[1]}]`)
+		var ids []string
+		for {
+			env := c.next(func(env nostr.Envelope) bool {
+				switch env := env.(type) {
+				case *nostr.EventEnvelope:
+					return *env.SubscriptionID == subID
+				case *nostr.EOSEEnvelope:
+					return string(*env) == subID
+				}
+				return false
+			})
+			evt, ok := env.(*nostr.EventEnvelope)
+			if !ok {
+				return ids
+			}
+			ids = append(ids, evt.Event.ID)
+		}
+	}
+
+	home := dial(url, aliceSK)
+	away := dial(url+"/fr", bobSK)
+	if got := away.req("live", `{"kinds":[1]}`); got != "EOSE" {
+		t.Fatalf("live subscription in fr: %s", got)
+	}
+
+	homeNote := signedEvent(t, aliceSK, 1, nostr.Now(), nil, "hello")
+	if ok, msg := publish(home, homeNote); !ok {
+		t.Fatalf("alice's note in the default community: %s", msg)
+	}
+	awayNote := signedEvent(t, bobSK, 1, nostr.Now(), nil, "bonjour")
+	if ok, msg := publish(away, awayNote); !ok {
+		t.Fatalf("bob's note in fr: %s", msg)
+	}
+
+	// The first live event fr sees is its own: alice's was never broadcast there.
+	live := away.next(func(env nostr.Envelope) bool {
+		evt, ok := env.(*nostr.EventEnvelope)
+		return ok && *evt.SubscriptionID == "live"
+	}).(*nostr.EventEnvelope)
+	if live.Event.ID != awayNote.ID {
+		t.Fatalf("fr received %s live, want only its own note", live.Event.ID)
+	}
+
+	if got := history(home, "h1"); len(got) != 1 || got[0] != homeNote.ID {
+		t.Errorf("default community history: %v", got)
+	}
+	if got := history(away, "h2"); len(got) != 1 || got[0] != awayNote.ID {
+		t.Errorf("fr history: %v", got)
+	}
+
+	// Membership does not carry over.
+	intruder := dial(url+"/fr", aliceSK)
+	if ok, msg := publish(intruder, signedEvent(t, aliceSK, 1, nostr.Now(), nil, "salut")); ok || !strings.HasPrefix(msg, "restricted:") {
+		t.Errorf("alice published in fr: ok=%v %q", ok, msg)
+	}
+}
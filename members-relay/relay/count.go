@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// COUNT (NIP-45)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// COUNT takes the same filters, access policy and visibility rules as REQ,
+// so a reader only ever counts what they could have fetched. Limit is
+// ignored. An addressable event counts once per (kind, pubkey, d tag), so
+// superseded versions of a recipe do not inflate the total.
+
+// countKey identifies what COUNT counts: the address of an addressable
+// event, the id of any other.
+const countKey = `CASE WHEN kind >= 30000 AND kind < 40000
+	THEN kind::text || ':' || pubkey || ':' || COALESCE(d_tag, '')
+	ELSE id END`
+
+func countEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	viewer := getAuthenticatedPubkey(ctx)
+	query, args := buildCountQuery(filter, communityOf(ctx), viewer, hidesLabeled(ctx, viewer))
+	var n int64
+	if err := db.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+		log.Printf("Count error: %v", err)
+		return 0, errors.New(say(ctx, msgCountFailed))
+	}
+	return n, nil
+}
+
+// buildCountQuery renders filter as buildViewerQuery does, counting the
+// matching events instead of returning them.
+func buildCountQuery(filter nostr.Filter, c *community, viewer string, hideLabeled bool) (string, []interface{}) {
+	where, args, _ := viewerConditions(filter, c, viewer, hideLabeled)
+	return "SELECT COUNT(DISTINCT " + countKey + ") FROM events" + where, args
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestBuildCountQuery(t *testing.T) {
+	filter := nostr.Filter{Kinds: []int{KindRecipe}, Authors: pubkeys(2), Tags: nostr.TagMap{"t": {"bread"}}, Limit: 5}
+	query, args := buildCountQuery(filter, nil, "", false)
+	list, listArgs := buildQuery(filter)
+	if !strings.HasPrefix(query, "SELECT COUNT(DISTINCT CASE WHEN kind >= 30000") {
+		t.Fatalf("not a distinct count: %s", query)
+	}
+	where := list[strings.Index(list, " WHERE "):strings.Index(list, " ORDER BY ")]
+	if !strings.HasSuffix(query, where) {
+		t.Fatalf("count conditions differ from the query's:\n%s\n%s", query, list)
+	}
+	if strings.Contains(query, "LIMIT") || len(args) != len(listArgs) {
+		t.Fatalf("count query %s with %d args", query, len(args))
+	}
+}
+
+func TestCountEvents(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	chefSK, memberSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	member, _ := nostr.GetPublicKey(memberSK)
+	addTestMember(t, member)
+	if _, err := db.ExecContext(ctx, "INSERT INTO groups (id, name) VALUES ('bakers', 'Bakers')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO group_members (group_id, pubkey, role) VALUES ('bakers', $1, 'member')", member); err != nil {
+		t.Fatal(err)
+	}
+
+	now := nostr.Now()
+	for _, evt := range []*nostr.Event{
+		signedEvent(t, chefSK, KindRecipe, now-20, nostr.Tags{{"d", "loaf"}}, "v1"),
+		signedEvent(t, chefSK, KindRecipe, now-10, nostr.Tags{{"d", "loaf"}}, "v2"),
+		signedEvent(t, chefSK, KindRecipe, now, nostr.Tags{{"d", "soup"}}, ""),
+		signedEvent(t, chefSK, KindGroupChat, now, nostr.Tags{{"h", "bakers"}}, "one"),
+		signedEvent(t, memberSK, KindGroupChat, now, nostr.Tags{{"h", "bakers"}}, "two"),
+		signedEvent(t, memberSK, KindRecipe, now, nostr.Tags{{"d", "rye"}, {"h", "bakers"}}, "work in progress"),
+	} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A superseded version left behind, as bulk ingest can.
+	old := signedEvent(t, chefSK, KindRecipe, now-30, nostr.Tags{{"d", "loaf"}}, "v0")
+	raw, _ := old.MarshalJSON()
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO events (id, pubkey, created_at, kind, tags, content, sig, raw, d_tag) VALUES ($1, $2, $3, $4, '[]', '', $5, $6, 'loaf')",
+		old.ID, old.PubKey, old.CreatedAt, old.Kind, old.Sig, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(filter nostr.Filter, viewer string) int64 {
+		t.Helper()
+		query, args := buildCountQuery(filter, nil, viewer, false)
+		var n int64
+		if err := db.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count(nostr.Filter{Kinds: []int{KindRecipe}, Limit: 1}, ""); n != 2 {
+		t.Fatalf("%d recipes, want 2 addresses whatever the limit", n)
+	}
+	if n := count(nostr.Filter{Kinds: []int{KindGroupChat}, Tags: nostr.TagMap{"h": {"bakers"}}}, member); n != 2 {
+		t.Fatalf("%d messages for a member, want 2", n)
+	}
+	if n := count(nostr.Filter{Kinds: []int{KindGroupChat}}, ""); n != 0 {
+		t.Fatalf("%d messages counted anonymously", n)
+	}
+	if n := count(nostr.Filter{Kinds: []int{KindRecipe}}, member); n != 3 {
+		t.Fatalf("%d recipes for a member, want 3 with the group's", n)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// REQ DEDUPLICATION
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// khatru queries each filter of a REQ separately, so an event matching two
+// filters (a recipe by author and by #d, say) would reach the client twice.
+// dedupQuery remembers the ids each REQ has been sent, keyed by the context
+// khatru shares between the REQ's filters (see trackREQ).
+//
+// The set holds at most dedupCap ids. Past that, further events are still
+// sent but no longer remembered, so a REQ returning that many events may
+// repeat some; none is ever dropped. Live events are matched by khatru per
+// filter and are not deduplicated here.
+
+const dedupCap = 5000
+
+type sentIDs struct {
+	mu  sync.Mutex
+	ids map[string]struct{}
+}
+
+// first reports whether id has not been sent before, remembering it.
+func (s *sentIDs) first(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, sent := s.ids[id]; sent {
+		return false
+	}
+	if len(s.ids) < dedupCap {
+		s.ids[id] = struct{}{}
+	}
+	return true
+}
+
+var sentByREQ = struct {
+	sync.Mutex
+	m map[context.Context]*sentIDs
+}{m: make(map[context.Context]*sentIDs)}
+
+// trackREQ is the OverwriteFilter hook that marks ctx as a REQ's, which
+// khatru only runs filters of a REQ through. The set is dropped when khatru
+// cancels ctx after EOSE.
+func trackREQ(ctx context.Context, _ *nostr.Filter) {
+	sentByREQ.Lock()
+	defer sentByREQ.Unlock()
+	if _, ok := sentByREQ.m[ctx]; ok {
+		return
+	}
+	sentByREQ.m[ctx] = &sentIDs{ids: make(map[string]struct{})}
+	context.AfterFunc(ctx, func() {
+		sentByREQ.Lock()
+		delete(sentByREQ.m, ctx)
+		sentByREQ.Unlock()
+	})
+}
+
+// dedupQuery wraps a QueryEvents hook so each event id is emitted at most
+// once per REQ. Queries outside a REQ (khatru's deletion lookups) pass
+// through untouched.
+func dedupQuery(query func(context.Context, nostr.Filter) (chan *nostr.Event, error)) func(context.Context, nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch, err := query(ctx, filter)
+		sentByREQ.Lock()
+		sent := sentByREQ.m[ctx]
+		sentByREQ.Unlock()
+		if err != nil || ch == nil || sent == nil {
+			return ch, err
+		}
+		out := make(chan *nostr.Event)
+		go func() {
+			defer close(out)
+			for event := range ch {
+				if !sent.first(event.ID) {
+					continue
+				}
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					// Let the query goroutine finish.
+					for range ch {
+					}
+					return
+				}
+			}
+		}()
+		return out, nil
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestOverlappingFiltersEmitOnce(t *testing.T) {
+	recipe := &nostr.Event{ID: strings.Repeat("a", 64), Kind: KindRecipe}
+	other := &nostr.Event{ID: strings.Repeat("b", 64), Kind: KindRecipe}
+	rl := khatru.NewRelay()
+	rl.OverwriteFilter = append(rl.OverwriteFilter, trackREQ)
+	rl.QueryEvents = append(rl.QueryEvents, dedupQuery(func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		// Every filter matches the recipe; the second also matches other.
+		ch := make(chan *nostr.Event, 2)
+		ch <- recipe
+		if len(filter.Tags) > 0 {
+			ch <- other
+		}
+		close(ch)
+		return ch, nil
+	}))
+	url := startTestRelay(t, rl, testServerConfig(false))
+	c := dialTestRelay(t, url)
+
+	feed := func(subID string) map[string]int {
+		t.Helper()
+		c.send(`["REQ","` + subID + `",{"authors":["` + pubkeys(1)[0] + `"]},{"#d":["loaf"]}]`)
+		got := make(map[string]int)
+		for {
+			env := c.next(func(env nostr.Envelope) bool {
+				switch env := env.(type) {
+				case *nostr.EventEnvelope:
+					return *env.SubscriptionID == subID
+				case *nostr.EOSEEnvelope:
+					return string(*env) == subID
+				}
+				return false
+			})
+			evt, ok := env.(*nostr.EventEnvelope)
+			if !ok {
+				return got
+			}
+			got[evt.ID]++
+		}
+	}
+	for _, subID := range []string{"feed", "again"} {
+		if got := feed(subID); got[recipe.ID] != 1 || got[other.ID] != 1 || len(got) != 2 {
+			t.Fatalf("%s: emissions %v, want each event once", subID, got)
+		}
+	}
+
+	// Each REQ's set is forgotten after EOSE.
+	time.Sleep(50 * time.Millisecond)
+	sentByREQ.Lock()
+	open := len(sentByREQ.m)
+	sentByREQ.Unlock()
+	if open != 0 {
+		t.Fatalf("%d sets left after EOSE", open)
+	}
+}
+
+func TestSentIDsCap(t *testing.T) {
+	s := &sentIDs{ids: make(map[string]struct{})}
+	for i := 0; i < dedupCap; i++ {
+		if !s.first(fmt.Sprint(i)) {
+			t.Fatalf("%d reported as sent", i)
+		}
+	}
+	if s.first("0") {
+		t.Fatal("remembered id sent twice")
+	}
+	if !s.first("overflow") || !s.first("overflow") {
+		t.Fatal("ids past the cap must still be sent")
+	}
+	if len(s.ids) != dedupCap {
+		t.Fatalf("set grew to %d", len(s.ids))
+	}
+}
+
+func TestDedupQueryOutsideREQ(t *testing.T) {
+	recipe := &nostr.Event{ID: strings.Repeat("a", 64)}
+	query := dedupQuery(func(context.Context, nostr.Filter) (chan *nostr.Event, error) {
+		ch := make(chan *nostr.Event, 1)
+		ch <- recipe
+		close(ch)
+		return ch, nil
+	})
+	// khatru's deletion lookups share the connection's context.
+	for i := 0; i < 2; i++ {
+		ch, _ := query(context.Background(), nostr.Filter{IDs: []string{recipe.ID}})
+		if evt := <-ch; evt == nil {
+			t.Fatalf("lookup %d found nothing", i)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// DEFAULT GROUPS
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// RELAY_DEFAULT_GROUPS lists groups the relay creates on startup, as
+// comma-separated id:name pairs ("general:General,kitchen:Kitchen Talk"), so
+// a new deployment does not have to hand-craft a create-group (kind 9007)
+// with the admin key. A missing group is created in the default community
+// the way handleCreateGroup does it, with the relay admin (RELAY_PUBKEY) as
+// its admin, and its 39000, 39001 and 39002 are generated right away. A
+// group that already exists is skipped untouched, whatever its metadata, so
+// provisioning is safe to run at every start.
+
+type defaultGroup struct {
+	ID   string
+	Name string
+}
+
+// defaultGroups are the groups provisioned on startup.
+var defaultGroups []defaultGroup
+
+func loadDefaultGroupsConfig() {
+	groups, err := parseDefaultGroups(envOr("RELAY_DEFAULT_GROUPS", ""))
+	if err != nil {
+		log.Fatalf("Invalid RELAY_DEFAULT_GROUPS: %v", err)
+	}
+	defaultGroups = groups
+}
+
+// parseDefaultGroups parses RELAY_DEFAULT_GROUPS.
+func parseDefaultGroups(v string) ([]defaultGroup, error) {
+	var groups []defaultGroup
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, name, ok := strings.Cut(entry, ":")
+		id, name = strings.TrimSpace(id), strings.TrimSpace(name)
+		if !ok || id == "" || name == "" {
+			return nil, fmt.Errorf("%q is not an id:name pair", entry)
+		}
+		if !validGroupID(id) {
+			return nil, fmt.Errorf("group id %q must be 3-64 chars of a-z, 0-9, - and _", id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("group %s is listed twice", id)
+		}
+		seen[id] = true
+		groups = append(groups, defaultGroup{ID: id, Name: name})
+	}
+	return groups, nil
+}
+
+// provisionDefaultGroups creates the default groups that do not exist yet.
+// It returns the ids it created and those it skipped.
+func provisionDefaultGroups(ctx context.Context) (created, skipped []string, err error) {
+	for _, g := range defaultGroups {
+		ok, err := provisionGroup(ctx, g)
+		if err != nil {
+			return created, skipped, fmt.Errorf("group %s: %w", g.ID, err)
+		}
+		if !ok {
+			log.Printf("[NIP-29] Default group %s already exists, skipped", g.ID)
+			skipped = append(skipped, g.ID)
+			continue
+		}
+		log.Printf("[NIP-29] Created default group %s (%q), admin %s", g.ID, g.Name, adminPubkey)
+		created = append(created, g.ID)
+		if !canSignRelayEvents() {
+			log.Printf("[NIP-29] No relay signing key: metadata for group %s waits until one is configured", g.ID)
+			continue
+		}
+		if err := regenerateGroup(ctx, g.ID); err != nil {
+			// Still dirty: the group sync worker retries
+			log.Printf("[NIP-29] Error generating metadata for default group %s: %v", g.ID, err)
+		}
+	}
+	return created, skipped, nil
+}
+
+// provisionGroup creates g unless a group with its id exists, reporting
+// whether it did.
+func provisionGroup(ctx context.Context, g defaultGroup) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if err := lockGroup(ctx, tx, g.ID); err != nil {
+		return false, err
+	}
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO groups (id, name, description, is_public, is_open, created_by, community)
+		VALUES ($1, $2, '', false, false, $3, $4)
+		ON CONFLICT (id) DO NOTHING
+	`, g.ID, g.Name, adminPubkey, defaultCommunityID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO group_members (group_id, pubkey, role)
+		VALUES ($1, $2, 'admin')
+		ON CONFLICT (group_id, pubkey) DO UPDATE SET role = 'admin'
+	`, g.ID, adminPubkey); err != nil {
+		return false, err
+	}
+	if err := markGroupDirty(ctx, tx, g.ID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
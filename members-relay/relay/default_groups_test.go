@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseDefaultGroups(t *testing.T) {
+	got, err := parseDefaultGroups(" general:General , kitchen:Kitchen Talk,")
+	if want := []defaultGroup{{"general", "General"}, {"kitchen", "Kitchen Talk"}}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("parsed %v, %v", got, err)
+	}
+	if got, err := parseDefaultGroups(""); err != nil || got != nil {
+		t.Fatalf("unset: %v, %v", got, err)
+	}
+	for _, v := range []string{"general", "general:", ":General", "pie:A,pie:B", "Bread Club:Bread"} {
+		if _, err := parseDefaultGroups(v); err == nil {
+			t.Errorf("%q accepted", v)
+		}
+	}
+}
+
+// Missing groups are created with metadata, existing ones left as they
+// are, and a restart changes nothing.
+func TestProvisionDefaultGroups(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	ownerSK := nostr.GeneratePrivateKey()
+	prevAdmin, prevGroups := adminPubkey, defaultGroups
+	adminPubkey = pubkeys(1)[0]
+	defaultGroups = []defaultGroup{{"general", "General"}, {"kitchen", "Kitchen Talk"}}
+	t.Cleanup(func() { adminPubkey, defaultGroups = prevAdmin, prevGroups })
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindCreateGroup, nostr.Now(), nostr.Tags{{"h", "kitchen"}}, ""))
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindEditMetadata, nostr.Now(), nostr.Tags{{"h", "kitchen"}, {"name", "The Kitchen"}}, ""))
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	created, skipped, err := provisionDefaultGroups(ctx)
+	if err != nil || !reflect.DeepEqual(created, []string{"general"}) || !reflect.DeepEqual(skipped, []string{"kitchen"}) {
+		t.Fatalf("created %v, skipped %v, %v", created, skipped, err)
+	}
+	metadata, err := currentRelayEvent(ctx, KindGroupMetadata, "general")
+	if err != nil || metadata == nil {
+		t.Fatalf("no 39000 for general: %v", err)
+	}
+	if name := metadata.Tags.GetFirst([]string{"name", ""}); name == nil || (*name)[1] != "General" {
+		t.Fatalf("39000 for general: %v", metadata.Tags)
+	}
+	admins, _ := currentRelayEvent(ctx, KindGroupAdmins, "general")
+	if admins == nil || taggedMembers(admins.Tags)[adminPubkey] != "admin" {
+		t.Fatalf("39001 for general: %v", admins)
+	}
+	if members := storedGroupMembers(t, "general"); !members[adminPubkey] {
+		t.Fatalf("39002 for general lists %v", members)
+	}
+	if !isGroupAdmin(ctx, "general", adminPubkey) || isGroupMember(ctx, "kitchen", adminPubkey) {
+		t.Fatal("relay admin's memberships")
+	}
+	if metadata, _ := currentRelayEvent(ctx, KindGroupMetadata, "kitchen"); metadata == nil ||
+		metadata.Tags.GetFirst([]string{"name", "The Kitchen"}) == nil {
+		t.Fatal("existing group's metadata clobbered")
+	}
+
+	if created, skipped, err = provisionDefaultGroups(ctx); err != nil || created != nil || len(skipped) != 2 {
+		t.Fatalf("restart: created %v, skipped %v, %v", created, skipped, err)
+	}
+}
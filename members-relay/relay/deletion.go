@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// DELETIONS (NIP-09)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// A kind 5 may delete an event when its author wrote the event (by e tag, or
+// by a tag whose coordinate names the same author) or is the relay admin.
+// Who sent the kind 5 over the connection does not matter, so the admin can
+// relay a member's own deletion. Group moderators delete group events only
+// with kind 9005. Each deletion leaves a tombstone, so the event cannot be
+// published again, and a deletion_audit row.
+//
+// khatru (v0.12) finds each target with QueryEvents and asks
+// OverwriteDeletionOutcome whether to delete it; authorizeDeletion is that
+// hook and deletes the target itself, together with its tombstone and audit
+// row, so the deleteEvent call khatru makes afterwards finds nothing left.
+// khatru answers every refusal of that hook with "blocked: " and the text,
+// so a kind 5 sent without NIP-42 auth is let through it and refused by
+// requireDeletionAuth, the DeleteEvent hook ahead of deleteEvent, whose
+// error khatru sends as is: "auth-required: ...", with an AUTH challenge.
+//
+// Open subscriptions that could have shown a deleted event are sent the
+// deletion (notifyDeletion): the kind 5, or for moderator deletions a
+// relay-signed 9005, so clients can drop the event in place.
+
+const (
+	deletedByAuthor    = "author"
+	deletedByAdmin     = "admin"
+	deletedByModerator = "moderator"
+)
+
+func eventAddress(event *nostr.Event) string {
+	d := addressableDTag(event)
+	if d == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey, *d)
+}
+
+// deletionTarget reports how deletion names target: by coordinate (the
+// returned address) or by id ("").
+func deletionTarget(target, deletion *nostr.Event) (address string) {
+	for _, tag := range deletion.Tags {
+		if len(tag) >= 2 && tag[0] == "e" && tag[1] == target.ID {
+			return ""
+		}
+	}
+	return eventAddress(target)
+}
+
+// deletionAuthority decides whether deletion may delete target, returning
+// the authority it acts on or the code of its refusal.
+func deletionAuthority(ctx context.Context, target, deletion *nostr.Event) (authority string, refusal msgCode) {
+	switch {
+	case deletion.PubKey == target.PubKey:
+		return deletedByAuthor, ""
+	case deletion.PubKey == communityAdmin(ctx):
+		return deletedByAdmin, ""
+	case deletionTarget(target, deletion) != "":
+		return "", msgDeletionCoordinate
+	}
+	if groupId := getHTag(target); groupId != "" && hasGroupCapability(ctx, groupId, deletion.PubKey, capDeleteEvent) {
+		return "", msgDeletionByModerator
+	}
+	return "", msgDeletionNotAuthor
+}
+
+// refuseDeletion is authorizeDeletion's answer for code, without the prefix
+// khatru puts in front of it.
+func refuseDeletion(ctx context.Context, code msgCode) (bool, string) {
+	_, text, _ := strings.Cut(say(ctx, code), ": ")
+	return false, text
+}
+
+// requireDeletionAuth is the DeleteEvent hook that refuses a kind 5 sent
+// without NIP-42 auth. It runs ahead of deleteEvent: khatru stops at its
+// error for a kind 5, and ignores it when it replaces older versions of a
+// replaceable event, which deleteEvent still removes.
+func requireDeletionAuth(ctx context.Context, _ *nostr.Event) error {
+	if getAuthenticatedPubkey(ctx) == "" {
+		return errors.New(say(ctx, msgAuthNIP42))
+	}
+	return nil
+}
+
+// authorizeDeletion is the OverwriteDeletionOutcome hook. It lets a kind 5
+// sent without auth through to requireDeletionAuth.
+func authorizeDeletion(ctx context.Context, target, deletion *nostr.Event) (bool, string) {
+	relayedBy := getAuthenticatedPubkey(ctx)
+	if relayedBy == "" {
+		return true, ""
+	}
+	authority, refusal := deletionAuthority(ctx, target, deletion)
+	if authority == "" {
+		return refuseDeletion(ctx, refusal)
+	}
+	address := deletionTarget(target, deletion)
+	tx, err := db.BeginTx(ctx, nil)
+	if err == nil {
+		defer tx.Rollback()
+		if err = recordDeletion(ctx, tx, target, deletion, address, relayedBy, authority); err == nil {
+			if err = removeEventTx(ctx, tx, target); err == nil {
+				err = tx.Commit()
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("[NIP-09] Error deleting %s: %v", target.ID, err)
+		return refuseDeletion(ctx, msgDeleteFailed)
+	}
+	connections.notifyDeletion(ctx, target, deletion)
+	return true, ""
+}
+
+// notifyDeletion sends signal to the open subscriptions that could have
+// shown target. Subscriptions matching signal itself get it from khatru's
+// broadcast instead.
+func (t *connTracker) notifyDeletion(ctx context.Context, target, signal *nostr.Event) {
+	t.deliverMatching(communityOf(ctx).id(), target, signal, readableBy(ctx, target))
+}
+
+// announceGroupDeletion signs, stores and broadcasts a 9005 for events a
+// moderator's 9005 request deleted, and notifies the subscriptions that
+// could have shown them.
+func announceGroupDeletion(ctx context.Context, request *nostr.Event, deleted []*nostr.Event) {
+	signal := nostr.Event{Kind: KindDeleteEvent, Tags: nostr.Tags{{"h", getHTag(request)}}}
+	for _, target := range deleted {
+		signal.Tags = append(signal.Tags, nostr.Tag{"e", target.ID})
+	}
+	if err := signRelayEvent(&signal); err != nil {
+		log.Printf("[NIP-29] Error signing deletion notice: %v", err)
+		return
+	}
+	if err := persistEvent(ctx, &signal); err != nil {
+		log.Printf("[NIP-29] Error storing deletion notice: %v", err)
+	}
+	for _, target := range deleted {
+		connections.notifyDeletion(ctx, target, &signal)
+	}
+	if relay != nil {
+		relayFor(ctx).BroadcastEvent(&signal)
+	}
+}
+
+// recordDeletion writes, as part of tx, the tombstones and audit row for
+// deleting target on the strength of request. address is set when request
+// named target by coordinate, which also tombstones the address up to
+// request's created_at.
+func recordDeletion(ctx context.Context, tx *sql.Tx, target, request *nostr.Event, address, relayedBy, authority string) error {
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO tombstones (target) VALUES ($1) ON CONFLICT (target) DO NOTHING",
+		target.ID); err != nil {
+		return err
+	}
+	var addressArg sql.NullString
+	if address != "" {
+		addressArg = sql.NullString{String: address, Valid: true}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO tombstones (target, deleted_until) VALUES ($1, $2)
+			ON CONFLICT (target) DO UPDATE
+				SET deleted_until = GREATEST(tombstones.deleted_until, EXCLUDED.deleted_until)
+		`, address, request.CreatedAt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO deletion_audit (event_id, address, kind, author, deleted_by, relayed_by, authority, request_id)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8)
+	`, target.ID, addressArg, target.Kind, target.PubKey, request.PubKey, relayedBy, authority, request.ID); err != nil {
+		return err
+	}
+	log.Printf("[NIP-09] %s %s deleted %s (kind %d by %s)", authority, request.PubKey, target.ID, target.Kind, target.PubKey)
+	return nil
+}
+
+// rejectDeleted is a RejectEvent hook refusing tombstoned events.
+func rejectDeleted(ctx context.Context, event *nostr.Event) (bool, string) {
+	var deleted bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM tombstones
+			WHERE target = $1 OR (target = $2 AND deleted_until >= $3)
+		)
+	`, event.ID, eventAddress(event), event.CreatedAt).Scan(&deleted)
+	if err != nil {
+		log.Printf("[NIP-09] Error checking tombstones for %s: %v", event.ID, err)
+		return true, say(ctx, msgDeletionCheckFailed)
+	}
+	if deleted {
+		return true, say(ctx, msgEventDeleted)
+	}
+	return false, ""
+}
+
+// inGroup reports whether target is a group event (a group-scoped kind)
+// of groupId, which a kind 9005 sent to groupId may delete. A recipe or
+// note that merely carries the group's h tag is not.
+func inGroup(target *nostr.Event, groupId string) bool {
+	return groupId != "" && isGroupScopedKind(target.Kind) && getHTag(target) == groupId
+}
+
+// rejectGroupEventDeletion checks that every event a kind 9005 names belongs
+// to the group it is sent to.
+func rejectGroupEventDeletion(ctx context.Context, event *nostr.Event, groupId string) (bool, string) {
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "e" {
+			continue
+		}
+		target, err := storedEvent(ctx, tag[1])
+		if err != nil {
+			return true, say(ctx, msgEventLookupFailed)
+		}
+		if target != nil && !inGroup(target, groupId) {
+			return true, say(ctx, msgEventNotInGroup, tag[1])
+		}
+	}
+	return false, ""
+}
+
+// storedEvent loads an event of ctx's community by id, or nil if it is not
+// stored there.
+func storedEvent(ctx context.Context, id string) (*nostr.Event, error) {
+	var raw []byte
+	err := db.QueryRowContext(ctx, "SELECT raw FROM events WHERE id = $1 AND community = $2",
+		id, communityOf(ctx).id()).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var event nostr.Event
+	return &event, json.Unmarshal(raw, &event)
+}
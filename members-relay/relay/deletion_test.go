@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestDeletionTarget(t *testing.T) {
+	recipe := &nostr.Event{ID: "r1", Kind: KindRecipe, PubKey: "alice", Tags: nostr.Tags{{"d", "bread"}}}
+	byID := &nostr.Event{Kind: 5, Tags: nostr.Tags{{"e", "r1"}}}
+	if got := deletionTarget(recipe, byID); got != "" {
+		t.Fatalf("deletion by id reported as coordinate %q", got)
+	}
+	byAddress := &nostr.Event{Kind: 5, Tags: nostr.Tags{{"a", "30023:alice:bread"}}}
+	if got := deletionTarget(recipe, byAddress); got != "30023:alice:bread" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestDeletionAuthority(t *testing.T) {
+	ctx := context.Background()
+	alice, mallory := pubkeys(2)[0], pubkeys(2)[1]
+	recipe := &nostr.Event{ID: "r1", Kind: KindRecipe, PubKey: alice, Tags: nostr.Tags{{"d", "bread"}}}
+	coordinate := nostr.Tags{{"a", "30023:" + alice + ":bread"}}
+
+	for _, tc := range []struct {
+		name      string
+		deletion  *nostr.Event
+		authority string
+		refusal   msgCode
+	}{
+		{"own by id", &nostr.Event{PubKey: alice, Tags: nostr.Tags{{"e", "r1"}}}, deletedByAuthor, ""},
+		{"own by coordinate", &nostr.Event{PubKey: alice, Tags: coordinate}, deletedByAuthor, ""},
+		{"admin", &nostr.Event{PubKey: adminPubkey, Tags: coordinate}, deletedByAdmin, ""},
+		{"someone else's by coordinate", &nostr.Event{PubKey: mallory, Tags: coordinate}, "", msgDeletionCoordinate},
+	} {
+		authority, refusal := deletionAuthority(ctx, recipe, tc.deletion)
+		if authority != tc.authority || refusal != tc.refusal {
+			t.Errorf("%s: got %q, %q", tc.name, authority, refusal)
+		}
+	}
+	if _, msg := refuseDeletion(ctx, msgDeletionNotAuthor); msg != "you are not the author of this event" {
+		t.Errorf("refusal %q: khatru adds the prefix", msg)
+	}
+	if err := requireDeletionAuth(ctx, recipe); err == nil || !strings.HasPrefix(err.Error(), "auth-required: ") {
+		t.Errorf("unauthenticated deletion: %v", err)
+	}
+}
+
+func TestDeleteRecipeByCoordinate(t *testing.T) {
+	openTestDB(t)
+	aliceSK, mallorySK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	alice, _ := nostr.GetPublicKey(aliceSK)
+	mallory, _ := nostr.GetPublicKey(mallorySK)
+	ctx := context.Background()
+	now := nostr.Now()
+
+	recipe := signedEvent(t, aliceSK, KindRecipe, now-10, nostr.Tags{{"d", "bread"}}, "flour, water, salt")
+	if err := persistEvent(ctx, recipe); err != nil {
+		t.Fatal(err)
+	}
+	coordinate := nostr.Tags{{"a", "30023:" + alice + ":bread"}}
+
+	theft := signedEvent(t, mallorySK, 5, now, coordinate, "")
+	if authority, refusal := deletionAuthority(ctx, recipe, theft); authority != "" || refusal != msgDeletionCoordinate {
+		t.Fatalf("someone else's recipe deletable by coordinate: %q %q", authority, refusal)
+	}
+	if stored, _ := storedEvent(ctx, recipe.ID); stored == nil {
+		t.Fatal("recipe gone after rejected deletion")
+	}
+
+	// alice's deletion, relayed by the admin's connection.
+	own := signedEvent(t, aliceSK, 5, now, coordinate, "")
+	if authority, _ := deletionAuthority(ctx, recipe, own); authority != deletedByAuthor {
+		t.Fatalf("own deletion refused")
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recordDeletion(ctx, tx, recipe, own, deletionTarget(recipe, own), adminPubkey, deletedByAuthor); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteEvent(ctx, recipe); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := storedEvent(ctx, recipe.ID); stored != nil {
+		t.Fatal("recipe still stored")
+	}
+
+	var deletedBy, relayedBy, authority string
+	if err := db.QueryRowContext(ctx,
+		"SELECT deleted_by, relayed_by, authority FROM deletion_audit WHERE event_id = $1",
+		recipe.ID).Scan(&deletedBy, &relayedBy, &authority); err != nil {
+		t.Fatal(err)
+	}
+	if deletedBy != alice || relayedBy != adminPubkey || authority != deletedByAuthor {
+		t.Fatalf("audit row: %s %s %s", deletedBy, relayedBy, authority)
+	}
+
+	older := signedEvent(t, aliceSK, KindRecipe, now-5, nostr.Tags{{"d", "bread"}}, "older copy")
+	newer := signedEvent(t, aliceSK, KindRecipe, now+5, nostr.Tags{{"d", "bread"}}, "new recipe")
+	for _, tc := range []struct {
+		event  *nostr.Event
+		reject bool
+	}{{recipe, true}, {older, true}, {newer, false}} {
+		if reject, msg := rejectDeleted(ctx, tc.event); reject != tc.reject || (reject && msg != "invalid: this event was deleted") {
+			t.Errorf("%q: reject = %v (%s)", tc.event.Content, reject, msg)
+		}
+	}
+
+	// A moderator is pointed at kind 9005 rather than allowed a kind 5.
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO group_members (group_id, pubkey, role) VALUES ('sourdough', $1, 'moderator')", mallory); err != nil {
+		t.Fatal(err)
+	}
+	status := signedEvent(t, aliceSK, KindUserStatus, now, nostr.Tags{{"d", "general"}, {"h", "sourdough"}}, "proofing")
+	byModerator := signedEvent(t, mallorySK, 5, now, nostr.Tags{{"e", status.ID}}, "")
+	if authority, refusal := deletionAuthority(ctx, status, byModerator); authority != "" || refusal != msgDeletionByModerator {
+		t.Fatalf("moderator kind 5: %q %q", authority, refusal)
+	}
+}
+
+func TestDeletionReachesLiveSubscribers(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	authorSK := nostr.GeneratePrivateKey()
+	author, _ := nostr.GetPublicKey(authorSK)
+	recipe := signedEvent(t, authorSK, KindRecipe, nostr.Now()-10, nostr.Tags{{"d", "focaccia"}}, "olive oil")
+	if err := persistEvent(ctx, recipe); err != nil {
+		t.Fatal(err)
+	}
+
+	rl := khatru.NewRelay()
+	rl.QueryEvents = append(rl.QueryEvents, queryEvents)
+	rl.DeleteEvent = append(rl.DeleteEvent, requireDeletionAuth, deleteEvent)
+	rl.OverwriteDeletionOutcome = append(rl.OverwriteDeletionOutcome, authorizeDeletion)
+	rl.RejectFilter = append(rl.RejectFilter, rejectFilterPolicy, connections.limitFilter)
+	rl.OnConnect = append(rl.OnConnect, connections.onConnect)
+	rl.OnDisconnect = append(rl.OnDisconnect, connections.onDisconnect)
+	url := startTestRelay(t, rl, testServerConfig(true))
+
+	// A second, anonymous client is showing the recipe.
+	viewer := dialTestRelay(t, url)
+	if got := viewer.req("recipes", `{"kinds":[30023]}`); got != "EOSE" {
+		t.Fatalf("recipe REQ: %s", got)
+	}
+
+	deletion := signedEvent(t, authorSK, 5, nostr.Now(), nostr.Tags{{"a", "30023:" + author + ":focaccia"}}, "")
+	raw, _ := nostr.EventEnvelope{Event: *deletion}.MarshalJSON()
+	answer := func(c *wsTestClient) *nostr.OKEnvelope {
+		c.send(string(raw))
+		return c.next(func(env nostr.Envelope) bool {
+			ok, isOK := env.(*nostr.OKEnvelope)
+			return isOK && ok.EventID == deletion.ID
+		}).(*nostr.OKEnvelope)
+	}
+
+	// Sent without AUTH, it is refused and the recipe stays.
+	anonymous := dialTestRelay(t, url)
+	if ok := answer(anonymous); ok.OK || !strings.HasPrefix(ok.Reason, "auth-required: ") {
+		t.Fatalf("anonymous deletion: %v %q", ok.OK, ok.Reason)
+	}
+	if stored, _ := storedEvent(ctx, recipe.ID); stored == nil {
+		t.Fatal("recipe deleted without AUTH")
+	}
+
+	owner := dialTestRelay(t, url)
+	if !owner.auth(url, owner.challenge(), authorSK) {
+		t.Fatal("AUTH refused")
+	}
+	if ok := answer(owner); !ok.OK {
+		t.Fatalf("deletion refused: %s", ok.Reason)
+	}
+
+	env := viewer.next(func(env nostr.Envelope) bool {
+		evt, isEvent := env.(*nostr.EventEnvelope)
+		return isEvent && evt.Event.Kind == 5
+	}).(*nostr.EventEnvelope)
+	if *env.SubscriptionID != "recipes" || env.Event.ID != deletion.ID {
+		t.Fatalf("viewer got %s on %s", env.Event.ID, *env.SubscriptionID)
+	}
+	if stored, _ := storedEvent(ctx, recipe.ID); stored != nil {
+		t.Fatal("recipe still stored")
+	}
+}
+
+// A 9005 deletes its own group's events only: not another group's chat, nor
+// a recipe carrying the group's h tag.
+func TestGroupEventDeletionScope(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK, memberSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	for _, g := range []string{"club", "other"} {
+		applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, nostr.Tags{{"h", g}}, ""))
+	}
+	own := signedEvent(t, memberSK, KindGroupChat, now, nostr.Tags{{"h", "club"}}, "spam")
+	foreign := signedEvent(t, memberSK, KindGroupChat, now, nostr.Tags{{"h", "other"}}, "hello")
+	recipe := signedEvent(t, memberSK, KindRecipe, now, nostr.Tags{{"d", "focaccia"}, {"h", "club"}}, "olive oil")
+	for _, evt := range []*nostr.Event{own, foreign, recipe} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleteEvents := func(targets ...*nostr.Event) *nostr.Event {
+		tags := nostr.Tags{{"h", "club"}}
+		for _, target := range targets {
+			tags = append(tags, nostr.Tag{"e", target.ID})
+		}
+		return signedEvent(t, adminSK, KindDeleteEvent, now+1, tags, "")
+	}
+	for _, target := range []*nostr.Event{foreign, recipe} {
+		if reject, msg := rejectGroupEventDeletion(ctx, deleteEvents(target), "club"); !reject || !strings.Contains(msg, target.ID) {
+			t.Fatalf("deletion of kind %d in group %q: %v %q", target.Kind, getHTag(target), reject, msg)
+		}
+	}
+	if reject, msg := rejectGroupEventDeletion(ctx, deleteEvents(own), "club"); reject {
+		t.Fatalf("deletion of the group's own chat refused: %s", msg)
+	}
+
+	// Past the policy, the handler still skips what is not the group's.
+	applyGroupEvent(t, deleteEvents(own, foreign, recipe))
+	for _, tc := range []struct {
+		event *nostr.Event
+		kept  bool
+	}{{own, false}, {foreign, true}, {recipe, true}} {
+		if stored, _ := storedEvent(ctx, tc.event.ID); (stored != nil) != tc.kept {
+			t.Errorf("kind %d in group %q: stored %v, want %v", tc.event.Kind, getHTag(tc.event), stored != nil, tc.kept)
+		}
+	}
+	var audited []string
+	rows, err := db.QueryContext(ctx, "SELECT event_id FROM deletion_audit WHERE authority = $1", deletedByModerator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		audited = append(audited, id)
+	}
+	if len(audited) != 1 || audited[0] != own.ID {
+		t.Fatalf("audit trail %v, want only %s", audited, own.ID)
+	}
+}
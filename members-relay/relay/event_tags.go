@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// TAG INDEX (event_tags)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Single-letter tags (the ones NIP-01 filters can address) are copied into
+// event_tags so tag filters become btree probes instead of JSONB containment
+// scans. Very long values are skipped to stay well under the btree row limit;
+// filters asking for such values fall back to the JSONB column.
+const maxIndexedTagValue = 512
+
+const eventTagsBackfillKey = "event_tags_backfilled"
+
+// indexedTags returns the (name, value) pairs of event that belong in event_tags.
+func indexedTags(event *nostr.Event) (names, values []string) {
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || !isIndexableTag(tag[0], tag[1]) {
+			continue
+		}
+		names = append(names, tag[0])
+		values = append(values, tagIndexValue(tag[0], tag[1]))
+	}
+	return names, values
+}
+
+func isIndexableTag(name, value string) bool {
+	return len(name) == 1 && len(value) <= maxIndexedTagValue
+}
+
+// Hashtags are stored and matched lowercase, so "#t": ["Dessert"] finds
+// recipes tagged "dessert" and vice versa. Events keep their tags as sent.
+// tagIndexSQL is the same rule for SQL that reads tag pairs from JSONB as t.
+const tagIndexSQL = `CASE WHEN t->>0 = 't' THEN lower(t->>1) ELSE t->>1 END`
+
+// tagIndexValue returns value as it is stored in, and looked up from,
+// event_tags.
+func tagIndexValue(name, value string) string {
+	if name == "t" {
+		return strings.ToLower(value)
+	}
+	return value
+}
+
+// tagIndexValues applies tagIndexValue to each of a filter's values.
+func tagIndexValues(name string, values []string) []string {
+	if name != "t" {
+		return values
+	}
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = tagIndexValue(name, v)
+	}
+	return out
+}
+
+func insertEventTags(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	names, values := indexedTags(event)
+	if len(names) == 0 {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO event_tags (event_id, tag_name, tag_value)
+		SELECT $1, n, v FROM unnest($2::text[], $3::text[]) AS t(n, v)
+		ON CONFLICT DO NOTHING
+	`, event.ID, pq.Array(names), pq.Array(values))
+	return err
+}
+
+// tagFilterCondition renders one filter tag (OR across its values) as SQL.
+// Indexable tags become a single = ANY probe of event_tags regardless of how
+// many values are listed; anything else is one JSONB containment test
+// against an array of the values.
+func tagFilterCondition(tagName string, values []string, argIndex int) (string, []interface{}) {
+	indexable := true
+	for _, v := range values {
+		if !isIndexableTag(tagName, v) {
+			indexable = false
+			break
+		}
+	}
+
+	if indexable {
+		cond := fmt.Sprintf(
+			"id IN (SELECT event_id FROM event_tags WHERE tag_name = $%d AND tag_value = ANY($%d::text[]))",
+			argIndex, argIndex+1)
+		return cond, []interface{}{tagName, pq.Array(tagIndexValues(tagName, values))}
+	}
+
+	tagsJSON := make([]string, len(values))
+	for i, val := range values {
+		tagJSON, _ := json.Marshal([][]string{{tagName, val}})
+		tagsJSON[i] = string(tagJSON)
+	}
+	return fmt.Sprintf("tags @> ANY($%d::jsonb[])", argIndex), []interface{}{pq.Array(tagsJSON)}
+}
+
+// dTagFilterCondition renders a "#d" filter over addressable kinds against
+// the d_tag column, which persistEvent fills for exactly those kinds, so an
+// naddr lookup (kind, author, d) is a single probe of
+// idx_events_kind_pubkey_d_tag.
+func dTagFilterCondition(values []string, argIndex int) (string, []interface{}) {
+	return fmt.Sprintf("d_tag = ANY($%d::text[])", argIndex), []interface{}{pq.Array(values)}
+}
+
+// onlyAddressableKinds reports whether kinds is non-empty and all 30000-39999.
+func onlyAddressableKinds(kinds []int) bool {
+	for _, k := range kinds {
+		if k < 30000 || k >= 40000 {
+			return false
+		}
+	}
+	return len(kinds) > 0
+}
+
+// mayMatchAddressable reports whether a filter with these kinds can return
+// an addressable event.
+func mayMatchAddressable(kinds []int) bool {
+	for _, k := range kinds {
+		if k >= 30000 && k < 40000 {
+			return true
+		}
+	}
+	return len(kinds) == 0
+}
+
+// latestVersionCondition hides addressable events superseded by a newer row
+// for the same (kind, pubkey, d_tag), which the DELETE in persistEventTx or
+// a bulk import can leave behind. Ties keep the lowest id, as persistEventTx
+// does. Being a WHERE condition, it applies before LIMIT.
+func latestVersionCondition() string {
+	return `(kind < 30000 OR kind >= 40000 OR NOT EXISTS (SELECT 1 FROM events newer
+		WHERE newer.kind = events.kind AND newer.pubkey = events.pubkey
+		AND newer.d_tag = events.d_tag AND newer.community = events.community
+		AND (newer.created_at > events.created_at
+			OR (newer.created_at = events.created_at AND newer.id < events.id))))`
+}
+
+// backfillEventTags populates event_tags for rows stored before the table
+// existed. It runs once per database, in id-ordered batches.
+func backfillEventTags(ctx context.Context) error {
+	var done bool
+	if err := db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM relay_state WHERE key = $1)", eventTagsBackfillKey,
+	).Scan(&done); err != nil {
+		return err
+	}
+	if done {
+		return nil
+	}
+
+	log.Println("[tags] Backfilling event_tags from existing events")
+	last := ""
+	total := 0
+	for {
+		var maxID sql.NullString
+		var n int
+		err := db.QueryRowContext(ctx, `
+			WITH batch AS (
+				SELECT id, tags FROM events WHERE id > $1 ORDER BY id LIMIT 5000
+			), ins AS (
+				INSERT INTO event_tags (event_id, tag_name, tag_value)
+				SELECT b.id, t->>0, `+tagIndexSQL+`
+				FROM batch b, jsonb_array_elements(b.tags) t
+				WHERE jsonb_typeof(t) = 'array'
+				AND octet_length(t->>0) = 1
+				AND t->>1 IS NOT NULL
+				AND octet_length(t->>1) <= $2
+				ON CONFLICT DO NOTHING
+			)
+			SELECT MAX(id), COUNT(*) FROM batch
+		`, last, maxIndexedTagValue).Scan(&maxID, &n)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+		last = maxID.String
+	}
+
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO relay_state (key, value) VALUES ($1, NOW()::text)
+		ON CONFLICT (key) DO NOTHING
+	`, eventTagsBackfillKey); err != nil {
+		return err
+	}
+	log.Printf("[tags] Backfill complete (%d events scanned)", total)
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func pubkeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%064x", i+1)
+	}
+	return keys
+}
+
+func TestBuildQueryMultiValueTagUsesSingleProbe(t *testing.T) {
+	filter := nostr.Filter{Kinds: []int{KindGroupChat}, Tags: nostr.TagMap{"p": pubkeys(100)}}
+	query, args := buildQuery(filter)
+
+	if strings.Contains(query, "@>") {
+		t.Fatalf("expected no JSONB containment, got %s", query)
+	}
+	if n := strings.Count(query, "event_tags"); n != 1 {
+		t.Fatalf("expected one event_tags probe, got %d in %s", n, query)
+	}
+	// kind + tag name + value array + viewer (group scope) + community
+	if len(args) != 5 {
+		t.Fatalf("expected 5 args for 100 tag values, got %d", len(args))
+	}
+}
+
+func TestBuildQueryTagOrderIsStable(t *testing.T) {
+	filter := nostr.Filter{Tags: nostr.TagMap{"p": {"a"}, "e": {"b"}, "h": {"c"}, "t": {"d"}}}
+	first, _ := buildQuery(filter)
+	for i := 0; i < 20; i++ {
+		if q, _ := buildQuery(filter); q != first {
+			t.Fatalf("query text changed between runs:\n%s\n%s", first, q)
+		}
+	}
+}
+
+func TestBuildQueryOversizedTagFallsBackToJSONB(t *testing.T) {
+	long := strings.Repeat("x", maxIndexedTagValue+1)
+	query, _ := buildQuery(nostr.Filter{Tags: nostr.TagMap{"r": {long}}})
+	if !strings.Contains(query, "tags @>") || strings.Contains(query, "event_tags") {
+		t.Fatalf("expected JSONB fallback for oversized value, got %s", query)
+	}
+
+	query, args := buildQuery(nostr.Filter{Kinds: []int{KindRecipe}, Tags: nostr.TagMap{"title": {"Bread", "Rye", "Spelt"}}})
+	if !strings.Contains(query, "tags @> ANY($2::jsonb[])") || len(args) != 4 {
+		t.Fatalf("expected one JSONB fallback array for multi-letter tag, got %s %v", query, args)
+	}
+}
+
+func TestBuildQueryDTagUsesColumn(t *testing.T) {
+	naddr := nostr.Filter{Kinds: []int{KindRecipe}, Authors: pubkeys(1), Tags: nostr.TagMap{"d": {"sourdough"}}}
+	query, _ := buildQuery(naddr)
+	if !strings.Contains(query, "d_tag = ANY($3::text[])") || strings.Contains(query, "event_tags") {
+		t.Fatalf("naddr lookup not served by d_tag: %s", query)
+	}
+	for _, kinds := range [][]int{nil, {KindRecipe, KindGroupChat}} {
+		query, _ := buildQuery(nostr.Filter{Kinds: kinds, Tags: nostr.TagMap{"d": {"sourdough"}}})
+		if strings.Contains(query, "d_tag = ANY") || !strings.Contains(query, "event_tags") {
+			t.Fatalf("kinds %v: d tags of non-addressable events need the tag index: %s", kinds, query)
+		}
+	}
+}
+
+func TestLatestVersionConditionOnlyForAddressableKinds(t *testing.T) {
+	if q, _ := buildQuery(nostr.Filter{Kinds: []int{KindGroupChat}}); strings.Contains(q, "newer") {
+		t.Fatalf("version check applied to chat: %s", q)
+	}
+	for _, kinds := range [][]int{nil, {KindRecipe}, {KindGroupChat, KindRecipe}} {
+		if q, _ := buildQuery(nostr.Filter{Kinds: kinds}); !strings.Contains(q, "newer") {
+			t.Fatalf("kinds %v: superseded versions not hidden: %s", kinds, q)
+		}
+	}
+}
+
+func TestQueryReturnsLatestVersion(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	current := signedEvent(t, sk, KindRecipe, now, nostr.Tags{{"d", "loaf"}}, "v2")
+	other := signedEvent(t, sk, KindRecipe, now-5, nostr.Tags{{"d", "soup"}}, "")
+	for _, evt := range []*nostr.Event{current, other} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A superseded version slipped in by an import, newer than other so a
+	// limit applied before deduplication would cut other off.
+	old := signedEvent(t, sk, KindRecipe, now-1, nostr.Tags{{"d", "loaf"}}, "v1")
+	raw, _ := old.MarshalJSON()
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO events (id, pubkey, created_at, kind, tags, content, sig, raw, d_tag) VALUES ($1, $2, $3, $4, '[]', '', $5, $6, 'loaf')",
+		old.ID, old.PubKey, old.CreatedAt, old.Kind, old.Sig, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		filter nostr.Filter
+		want   []string
+	}{
+		{nostr.Filter{Kinds: []int{KindRecipe}, Tags: nostr.TagMap{"d": {"loaf"}}}, []string{current.ID}},
+		{nostr.Filter{Authors: []string{current.PubKey}}, []string{current.ID, other.ID}},
+		{nostr.Filter{Authors: []string{current.PubKey}, Limit: 2}, []string{current.ID, other.ID}},
+	} {
+		query, args := buildQuery(tc.filter)
+		got, err := fetchEvents(ctx, query, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, evt := range got {
+			ids = append(ids, evt.ID)
+		}
+		if !slices.Equal(ids, tc.want) {
+			t.Errorf("%v: got %v, want %v", tc.filter, ids, tc.want)
+		}
+	}
+}
+
+// BenchmarkNaddrLookup resolves naddrs the way the frontend does, through
+// the d_tag column and, for comparison, through the event_tags probe every
+// "#d" filter used before. The comparison filter adds kind 1 to force that
+// path without changing the results.
+func BenchmarkNaddrLookup(b *testing.B) {
+	openTestDB(b)
+	ctx := context.Background()
+	corpus := generateRecipeCorpus(b, benchCorpusSize)
+	if _, err := bulkIngest(ctx, corpus); err != nil {
+		b.Fatal(err)
+	}
+	for _, bench := range []struct {
+		name  string
+		kinds []int
+	}{{"d_tag", []int{KindRecipe}}, {"event_tags", []int{KindRecipe, 1}}} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				evt := corpus[i%len(corpus)]
+				query, args := buildQuery(nostr.Filter{Kinds: bench.kinds, Authors: []string{evt.PubKey},
+					Tags: nostr.TagMap{"d": {evt.Tags.GetD()}}})
+				rows, err := db.QueryContext(ctx, query, args...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n := 0
+				for rows.Next() {
+					n++
+				}
+				rows.Close()
+				if n != 1 {
+					b.Fatalf("%d events for one naddr", n)
+				}
+			}
+		})
+	}
+}
+
+func TestIndexedTags(t *testing.T) {
+	event := &nostr.Event{Tags: nostr.Tags{
+		{"h", "dessert-club"},
+		{"p", "abc", "wss://relay"},
+		{"title", "not indexed"},
+		{"e"},
+		{"r", strings.Repeat("x", maxIndexedTagValue+1)},
+		{"t", "Dessert"},
+	}}
+	names, values := indexedTags(event)
+	if strings.Join(names, ",") != "h,p,t" || strings.Join(values, ",") != "dessert-club,abc,dessert" {
+		t.Fatalf("unexpected indexed tags %v %v", names, values)
+	}
+}
+
+// TestTagFilterPlanUsesIndex checks the planner can answer multi-value tag
+// filters from idx_event_tags_name_value at 1, 10 and 100 values, and the
+// categories page's hashtag filter.
+func TestTagFilterPlanUsesIndex(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Tiny test tables make sequential scans cheapest; rule them out so the
+	// plan shows whether the index is usable for this shape at all.
+	if _, err := conn.ExecContext(ctx, "SET enable_seqscan = off"); err != nil {
+		t.Fatal(err)
+	}
+
+	filters := []nostr.Filter{{Kinds: []int{KindRecipe}, Tags: nostr.TagMap{"t": {"dessert"}}, Limit: 20}}
+	for _, n := range []int{1, 10, 100} {
+		filters = append(filters, nostr.Filter{Kinds: []int{KindGroupChat}, Tags: nostr.TagMap{"p": pubkeys(n)}})
+	}
+	for _, filter := range filters {
+		query, args := buildQuery(filter)
+		rows, err := conn.QueryContext(ctx, "EXPLAIN "+query, args...)
+		if err != nil {
+			t.Fatalf("explain %v: %v", filter, err)
+		}
+		var plan strings.Builder
+		for rows.Next() {
+			var line string
+			rows.Scan(&line)
+			plan.WriteString(line + "\n")
+		}
+		rows.Close()
+		if !strings.Contains(plan.String(), "idx_event_tags_name_value") {
+			t.Fatalf("plan for %v does not use the tag index:\n%s", filter, plan.String())
+		}
+	}
+}
+
+func TestHashtagsMatchAnyCase(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	cake := signedEvent(t, sk, KindRecipe, nostr.Now(), nostr.Tags{{"d", "cake"}, {"t", "Dessert"}}, "")
+	tags := nostr.Tags{{"d", "sorbet"}, {"t", "dessert"}, {"t", "Vegan"}}
+	for i := 0; i < 10; i++ {
+		tags = append(tags, nostr.Tag{"t", fmt.Sprintf("tag%d", i)})
+	}
+	sorbet := signedEvent(t, sk, KindRecipe, nostr.Now()-1, tags, "")
+	for _, evt := range []*nostr.Event{cake, sorbet} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		tags nostr.TagMap
+		want []string
+	}{
+		{nostr.TagMap{"t": {"dessert"}}, []string{cake.ID, sorbet.ID}},
+		{nostr.TagMap{"t": {"DESSERT", "vegan", "tag3"}}, []string{cake.ID, sorbet.ID}},
+		{nostr.TagMap{"&t": {"Dessert", "VEGAN"}}, []string{sorbet.ID}},
+	} {
+		query, args := buildQuery(nostr.Filter{Kinds: []int{KindRecipe}, Tags: tc.tags, Limit: 20})
+		got, err := fetchEvents(ctx, query, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, evt := range got {
+			ids = append(ids, evt.ID)
+		}
+		if !slices.Equal(ids, tc.want) {
+			t.Errorf("%v: got %v, want %v", tc.tags, ids, tc.want)
+		}
+	}
+}
+
+func TestDeleteGroupRemovesChatByTagIndex(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	if _, err := db.ExecContext(ctx, "INSERT INTO groups (id, name) VALUES ('sourdough', 'Sourdough'), ('pasta', 'Pasta')"); err != nil {
+		t.Fatal(err)
+	}
+	gone := signedEvent(t, sk, KindGroupChat, nostr.Now(), nostr.Tags{{"h", "sourdough"}}, "")
+	kept := signedEvent(t, sk, KindGroupChat, nostr.Now(), nostr.Tags{{"h", "pasta"}}, "")
+	for _, evt := range []*nostr.Event{gone, kept} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := handleDeleteGroup(ctx, tx, &nostr.Event{Kind: KindDeleteGroup, Tags: nostr.Tags{{"h", "sourdough"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	rows, err := db.QueryContext(ctx, "SELECT event_id FROM event_tags WHERE tag_name = 'h'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	if len(ids) != 1 || ids[0] != kept.ID {
+		t.Fatalf("h tags left %v, want only the other group's message", ids)
+	}
+}
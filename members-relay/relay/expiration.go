@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// EXPIRING EVENTS (NIP-40)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// An event's expiration tag is copied into events.expires_at when it is
+// stored. Queries leave out events past it, so they disappear the moment
+// they expire, and the purger deletes them hourly. Events that arrive
+// already expired are refused. A malformed expiration tag is ignored,
+// except on user statuses (see USER STATUSES).
+
+// expiredPurgeBatch bounds one purge statement.
+const expiredPurgeBatch = 1000
+
+// rejectExpired refuses events whose expiration has passed.
+func rejectExpired(ctx context.Context, event *nostr.Event) (bool, string) {
+	if expiration, err := eventExpiration(event); err == nil && expiration != 0 && expiration <= nostr.Now() {
+		return true, say(ctx, msgEventExpired)
+	}
+	return false, ""
+}
+
+// insertExpiration records the expiration of event, stored as part of tx.
+func insertExpiration(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	expiration, err := eventExpiration(event)
+	if err != nil || expiration == 0 {
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE events SET expires_at = $1 WHERE id = $2", int64(expiration), event.ID)
+	return err
+}
+
+// unexpiredCondition hides events whose expiration has passed.
+func unexpiredCondition() string {
+	return "(expires_at IS NULL OR expires_at > EXTRACT(EPOCH FROM NOW())::bigint)"
+}
+
+// purgeExpiredEvents deletes one batch of expired events.
+func purgeExpiredEvents(ctx context.Context) (int64, error) {
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM events WHERE id IN (
+			SELECT id FROM events WHERE expires_at <= EXTRACT(EPOCH FROM NOW())::bigint LIMIT $1)
+	`, expiredPurgeBatch)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// runExpiredEventPurger deletes expired events hourly.
+func runExpiredEventPurger(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		var total int64
+		for {
+			n, err := purgeExpiredEvents(ctx)
+			total += n
+			if err != nil {
+				log.Printf("[expiration] Error purging expired events: %v", err)
+				break
+			}
+			if n < expiredPurgeBatch {
+				break
+			}
+		}
+		if total > 0 {
+			log.Printf("[expiration] Purged %d expired events", total)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
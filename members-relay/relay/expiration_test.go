@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRejectExpired(t *testing.T) {
+	ctx := context.Background()
+	now := nostr.Now()
+	for _, tc := range []struct {
+		tags   nostr.Tags
+		reject bool
+	}{
+		{nil, false},
+		{nostr.Tags{{"expiration", fmt.Sprint(now + 60)}}, false},
+		{nostr.Tags{{"expiration", fmt.Sprint(now - 60)}}, true},
+		{nostr.Tags{{"expiration", "soon"}}, false},
+	} {
+		reject, msg := rejectExpired(ctx, &nostr.Event{Kind: 1, Tags: tc.tags})
+		if reject != tc.reject || (reject && msg != "invalid: event is expired") {
+			t.Errorf("%v: got %v %q", tc.tags, reject, msg)
+		}
+	}
+}
+
+func TestQueriesHideExpired(t *testing.T) {
+	for _, kinds := range [][]int{nil, {KindRecipe}, {KindGroupChat}} {
+		if q, _ := buildQuery(nostr.Filter{Kinds: kinds}); !strings.Contains(q, unexpiredCondition()) {
+			t.Fatalf("kinds %v: expired events not hidden: %s", kinds, q)
+		}
+	}
+}
+
+func TestEventExpiresBetweenStoreAndQuery(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	soon := signedEvent(t, sk, 1, now, nostr.Tags{{"expiration", fmt.Sprint(now + 1)}}, "bake sale in the lobby")
+	later := signedEvent(t, sk, 1, now, nostr.Tags{{"expiration", fmt.Sprint(now + 3600)}}, "")
+	forever := signedEvent(t, sk, 1, now, nil, "")
+	for _, evt := range []*nostr.Event{soon, later, forever} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func() int {
+		t.Helper()
+		query, args := buildQuery(nostr.Filter{Authors: []string{soon.PubKey}})
+		got, err := fetchEvents(ctx, query, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(got)
+	}
+	if n := count(); n != 3 {
+		t.Fatalf("%d events before expiry, want 3", n)
+	}
+
+	time.Sleep(time.Until(time.Unix(int64(now)+2, 0)))
+	if n := count(); n != 2 {
+		t.Fatalf("%d events after expiry, want 2", n)
+	}
+	if n, err := purgeExpiredEvents(ctx); err != nil || n != 1 {
+		t.Fatalf("purged %d, %v; want 1", n, err)
+	}
+	if stored, _ := storedEvent(ctx, soon.ID); stored != nil {
+		t.Fatal("expired event still stored")
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// FEATURED RECIPES
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Every ISO week the relay publishes "featured this week" as a relay-signed
+// NIP-51 curation set (kind 30004, d = the week, e.g. "2026-W42") of recipe
+// a tags, so the list is verifiable and past weeks stay queryable by d tag.
+//
+// At the start of the week the curator seeds candidates from trending
+// recipes: those the most distinct people referenced (reactions, zaps,
+// comments) over the previous seven days. Until the review window closes,
+// the admin can approve, remove or add recipes through /admin/featured;
+// then the curator publishes the approved recipes followed by the best
+// remaining candidates, up to RELAY_FEATURED_SIZE, and pushes the list to
+// RELAY_FEATURED_PUBLISH_RELAYS if set. A published week is final.
+// GET /api/featured serves the latest list with its recipes in one fetch.
+
+const (
+	KindCurationSet = 30004
+
+	featuredPublishedKey = "featured_published"
+)
+
+type featuredConfig struct {
+	Size   int           // recipes per list; 0 disables the curator
+	Review time.Duration // from the start of the week until publication
+	Title  string
+	Relays []string // public relays to push to
+}
+
+var featuredCfg featuredConfig
+
+func loadFeaturedConfig() {
+	featuredCfg = featuredConfig{
+		Size:   envInt("RELAY_FEATURED_SIZE", 10),
+		Review: envDuration("RELAY_FEATURED_REVIEW", 48*time.Hour),
+		Title:  envOr("RELAY_FEATURED_TITLE", "Featured on zap.cooking"),
+		Relays: splitList(envOr("RELAY_FEATURED_PUBLISH_RELAYS", "")),
+	}
+}
+
+var isoWeekPattern = regexp.MustCompile(`^\d{4}-W\d{2}$`)
+
+// isoWeek names the ISO week of t, as in "2026-W42".
+func isoWeek(t time.Time) string {
+	year, week := t.UTC().ISOWeek()
+	return fmt.Sprintf("%d-W%02d", year, week)
+}
+
+// weekStart is the Monday 00:00 UTC starting t's ISO week.
+func weekStart(t time.Time) time.Time {
+	day := t.UTC().Truncate(24 * time.Hour)
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// featuredPick is one recipe considered for a week.
+type featuredPick struct {
+	Address string `json:"address"`
+	Score   int    `json:"score"`
+	Status  string `json:"status"` // candidate, approved or removed
+	AddedBy string `json:"added_by"`
+}
+
+// trendingRecipes returns the addresses of the recipes referenced by the
+// most distinct other people since since, best first.
+func trendingRecipes(ctx context.Context, since time.Time, limit int) ([]featuredPick, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.tag_value, COUNT(DISTINCT x.pubkey) AS score
+		FROM events r
+		JOIN event_tags t ON t.tag_name = 'a' AND t.tag_value = r.kind || ':' || r.pubkey || ':' || r.d_tag
+		JOIN events x ON x.id = t.event_id AND x.created_at >= $1 AND x.pubkey <> r.pubkey AND x.community = r.community
+		WHERE r.kind = $2 AND r.community = $3 AND `+ungroupedCondition("r")+`
+		GROUP BY t.tag_value
+		ORDER BY score DESC, t.tag_value
+		LIMIT $4
+	`, since.Unix(), KindRecipe, defaultCommunityID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var picks []featuredPick
+	for rows.Next() {
+		p := featuredPick{Status: "candidate", AddedBy: "trending"}
+		if err := rows.Scan(&p.Address, &p.Score); err != nil {
+			return nil, err
+		}
+		picks = append(picks, p)
+	}
+	return picks, rows.Err()
+}
+
+// seedFeatured adds week's trending candidates, leaving admin decisions alone.
+func seedFeatured(ctx context.Context, week string, start time.Time) error {
+	picks, err := trendingRecipes(ctx, start.AddDate(0, 0, -7), 2*featuredCfg.Size)
+	if err != nil {
+		return err
+	}
+	for _, p := range picks {
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO featured_picks (week, address, score, status, added_by)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (week, address) DO UPDATE SET score = EXCLUDED.score
+		`, week, p.Address, p.Score, p.Status, p.AddedBy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// featuredPicks lists week's picks in list order: approved first, then by
+// score; removed ones last.
+func featuredPicks(ctx context.Context, week string) ([]featuredPick, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT address, score, status, added_by FROM featured_picks
+		WHERE week = $1
+		ORDER BY status = 'removed', status = 'approved' DESC, score DESC, address
+	`, week)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	picks := []featuredPick{}
+	for rows.Next() {
+		var p featuredPick
+		if err := rows.Scan(&p.Address, &p.Score, &p.Status, &p.AddedBy); err != nil {
+			return nil, err
+		}
+		picks = append(picks, p)
+	}
+	return picks, rows.Err()
+}
+
+// setFeaturedPick records the admin's decision on address for week.
+func setFeaturedPick(ctx context.Context, week, address, status, admin string) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO featured_picks (week, address, status, added_by)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (week, address) DO UPDATE SET status = EXCLUDED.status
+	`, week, address, status, admin)
+	return err
+}
+
+// featuredRecipes loads the stored recipes at addresses, keyed by address.
+func featuredRecipes(ctx context.Context, addresses []string) (map[string]*nostr.Event, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT raw FROM events
+		WHERE kind = $1 AND community = $2 AND kind || ':' || pubkey || ':' || d_tag = ANY($3)
+		AND `+ungroupedCondition("events")+`
+	`, KindRecipe, defaultCommunityID, pq.Array(addresses))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	recipes := make(map[string]*nostr.Event)
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		var event nostr.Event
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, err
+		}
+		recipes[eventAddress(&event)] = &event
+	}
+	return recipes, rows.Err()
+}
+
+// featuredList builds week's unsigned curation set, or nil when no pick is
+// left standing.
+func featuredList(ctx context.Context, week string) (*nostr.Event, error) {
+	picks, err := featuredPicks(ctx, week)
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for _, p := range picks {
+		if p.Status != "removed" && len(addresses) < featuredCfg.Size {
+			addresses = append(addresses, p.Address)
+		}
+	}
+	recipes, err := featuredRecipes(ctx, addresses)
+	if err != nil {
+		return nil, err
+	}
+	tags := nostr.Tags{{"d", week}, {"title", featuredCfg.Title + ", " + week}}
+	var refs nostr.Tags
+	for _, address := range addresses {
+		recipe := recipes[address]
+		if recipe == nil {
+			continue // deleted since it was picked
+		}
+		if image := recipe.Tags.GetFirst([]string{"image", ""}); image != nil && len(tags) == 2 {
+			tags = append(tags, nostr.Tag{"image", (*image)[1]})
+		}
+		refs = append(refs, nostr.Tag{"a", address})
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	return &nostr.Event{Kind: KindCurationSet, Tags: append(tags, refs...)}, nil
+}
+
+// publishFeatured signs and stores week's list, then pushes it to
+// featuredCfg.Relays once.
+func publishFeatured(ctx context.Context, week string, publish func(context.Context, []string, nostr.Event) error) error {
+	event, err := currentRelayEvent(ctx, KindCurationSet, week)
+	if err != nil {
+		return err
+	}
+	if event == nil {
+		want, err := featuredList(ctx, week)
+		if err != nil || want == nil {
+			return err
+		}
+		if event, err = ensureRelayEvent(ctx, *want); err != nil {
+			return err
+		}
+		log.Printf("[featured] Published %s with %d recipes", week, len(event.Tags.GetAll([]string{"a", ""})))
+	}
+
+	var published string
+	err = db.QueryRowContext(ctx, "SELECT value FROM relay_state WHERE key = $1", featuredPublishedKey).Scan(&published)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if published == event.ID || len(featuredCfg.Relays) == 0 {
+		return nil
+	}
+	if err := publish(ctx, featuredCfg.Relays, *event); err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO relay_state (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value
+	`, featuredPublishedKey, event.ID)
+	return err
+}
+
+// isFeaturedPublished reports whether week's list is final.
+func isFeaturedPublished(ctx context.Context, week string) (bool, error) {
+	event, err := currentRelayEvent(ctx, KindCurationSet, week)
+	return event != nil, err
+}
+
+// curateFeatured seeds the current week and publishes it once the review
+// window has closed.
+func curateFeatured(ctx context.Context, now time.Time, publish func(context.Context, []string, nostr.Event) error) error {
+	week, start := isoWeek(now), weekStart(now)
+	published, err := isFeaturedPublished(ctx, week)
+	if err != nil {
+		return err
+	}
+	if !published {
+		if err := seedFeatured(ctx, week, start); err != nil {
+			return fmt.Errorf("seed %s: %w", week, err)
+		}
+		if now.Before(start.Add(featuredCfg.Review)) {
+			return nil
+		}
+	}
+	return publishFeatured(ctx, week, publish)
+}
+
+// runFeaturedCurator curates hourly.
+func runFeaturedCurator(ctx context.Context) {
+	if featuredCfg.Size <= 0 || !canSignRelayEvents() {
+		return
+	}
+	publish := poolPublisher()
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := curateFeatured(ctx, time.Now(), publish); err != nil {
+			log.Printf("[featured] Error curating: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ─── HTTP ──────────────────────────────────────────────────────────────────────
+
+// isPublicFeaturedFilter reports a REQ for the relay's curation sets only,
+// which anyone may read.
+func isPublicFeaturedFilter(filter nostr.Filter) bool {
+	return containsOnlyKind(filter.Kinds, KindCurationSet) && relaySigningPubkey != "" &&
+		len(filter.Authors) == 1 && filter.Authors[0] == relaySigningPubkey
+}
+
+type featuredRequest struct {
+	Week   string `json:"week"`   // default: the current week
+	Action string `json:"action"` // approve, remove or add
+	Naddr  string `json:"naddr"`
+}
+
+// recipeAddress decodes a recipe naddr into its address.
+func recipeAddress(naddr string) (string, bool) {
+	data, ok := decodeBech32("naddr", naddr)
+	if !ok {
+		return "", false
+	}
+	// TLV: 0 identifier, 2 author, 3 kind (big-endian uint32)
+	var d, pubkey string
+	kind := -1
+	for len(data) >= 2 {
+		typ, size := data[0], int(data[1])
+		if len(data) < 2+size {
+			return "", false
+		}
+		value := data[2 : 2+size]
+		switch {
+		case typ == 0:
+			d = string(value)
+		case typ == 2 && size == 32:
+			pubkey = hex.EncodeToString(value)
+		case typ == 3 && size == 4:
+			kind = int(binary.BigEndian.Uint32(value))
+		}
+		data = data[2+size:]
+	}
+	if kind != KindRecipe || pubkey == "" {
+		return "", false
+	}
+	return fmt.Sprintf("%d:%s:%s", kind, pubkey, d), true
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// decodeBech32 decodes a BIP-173 string with the given prefix into bytes,
+// checking its checksum. NIP-19 entities may exceed the 90-character limit.
+func decodeBech32(hrp, s string) ([]byte, bool) {
+	s = strings.ToLower(s)
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || s[:sep] != hrp || len(s)-sep-1 < 6 {
+		return nil, false
+	}
+	values := make([]byte, 0, len(s)-sep-1)
+	for _, c := range s[sep+1:] {
+		v := strings.IndexRune(bech32Charset, c)
+		if v < 0 {
+			return nil, false
+		}
+		values = append(values, byte(v))
+	}
+
+	polymod := uint32(1)
+	expanded := make([]byte, 0, 2*len(hrp)+1+len(values))
+	for _, c := range hrp {
+		expanded = append(expanded, byte(c>>5))
+	}
+	expanded = append(expanded, 0)
+	for _, c := range hrp {
+		expanded = append(expanded, byte(c&31))
+	}
+	for _, v := range append(expanded, values...) {
+		top := polymod >> 25
+		polymod = (polymod&0x1ffffff)<<5 ^ uint32(v)
+		for i, g := range []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3} {
+			if top>>i&1 == 1 {
+				polymod ^= g
+			}
+		}
+	}
+	if polymod != 1 {
+		return nil, false
+	}
+
+	// Regroup the 5-bit values, minus the checksum, into bytes.
+	var out []byte
+	acc, bits := 0, 0
+	for _, v := range values[:len(values)-6] {
+		acc = (acc<<5 | int(v)) & 0xfff
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			out = append(out, byte(acc>>bits))
+		}
+	}
+	return out, true
+}
+
+// registerFeaturedAPI mounts GET /api/featured (public, ?week= optional)
+// and, on the admin mux, /admin/featured (main relay admin): GET ?week=
+// lists the picks, POST a featuredRequest changes one.
+func registerFeaturedAPI(mux, admin *http.ServeMux) {
+	mux.HandleFunc("/api/featured", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		week := r.URL.Query().Get("week")
+		if week != "" && !isoWeekPattern.MatchString(week) {
+			httpError(w, r, "", http.StatusBadRequest, msgFeaturedWeek)
+			return
+		}
+		var raw []byte
+		err := db.QueryRowContext(r.Context(), `
+			SELECT raw FROM events
+			WHERE kind = $1 AND pubkey = $2 AND ($3 = '' OR d_tag = $3)
+			ORDER BY d_tag DESC LIMIT 1
+		`, KindCurationSet, relaySigningPubkey, week).Scan(&raw)
+		if err == sql.ErrNoRows {
+			httpError(w, r, "", http.StatusNotFound, msgFeaturedNotFound)
+			return
+		}
+		if err != nil {
+			writeAPIResult(w, nil, err)
+			return
+		}
+		var list nostr.Event
+		if err := json.Unmarshal(raw, &list); err != nil {
+			writeAPIResult(w, nil, err)
+			return
+		}
+		var addresses []string
+		for _, tag := range list.Tags.GetAll([]string{"a", ""}) {
+			addresses = append(addresses, tag[1])
+		}
+		byAddress, err := featuredRecipes(r.Context(), addresses)
+		recipes := []*nostr.Event{}
+		for _, address := range addresses {
+			if recipe := byAddress[address]; recipe != nil {
+				recipes = append(recipes, recipe)
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		writeAPIResult(w, map[string]interface{}{"week": list.Tags.GetD(), "list": list, "recipes": recipes}, err)
+	})
+
+	admin.HandleFunc("/admin/featured", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		pubkey := nip98Admin(r)
+		if pubkey != adminPubkey {
+			httpError(w, r, pubkey, http.StatusForbidden, msgRelayAdminOnly)
+			return
+		}
+		req := featuredRequest{Week: r.URL.Query().Get("week")}
+		if r.Method == http.MethodPost {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+				httpError(w, r, pubkey, http.StatusBadRequest, msgMalformedJSON)
+				return
+			}
+		}
+		if req.Week == "" {
+			req.Week = isoWeek(time.Now())
+		}
+		if !isoWeekPattern.MatchString(req.Week) {
+			httpError(w, r, pubkey, http.StatusBadRequest, msgFeaturedWeek)
+			return
+		}
+		published, err := isFeaturedPublished(ctx, req.Week)
+		if err != nil {
+			writeAPIResult(w, nil, err)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			status := map[string]string{"approve": "approved", "add": "approved", "remove": "removed"}[req.Action]
+			if status == "" {
+				httpError(w, r, pubkey, http.StatusBadRequest, msgFeaturedAction)
+				return
+			}
+			if published {
+				httpError(w, r, pubkey, http.StatusConflict, msgFeaturedPublished, req.Week)
+				return
+			}
+			address, ok := recipeAddress(req.Naddr)
+			if !ok {
+				httpError(w, r, pubkey, http.StatusBadRequest, msgFeaturedNaddr)
+				return
+			}
+			if status == "approved" {
+				recipes, err := featuredRecipes(ctx, []string{address})
+				if err != nil {
+					writeAPIResult(w, nil, err)
+					return
+				}
+				if recipes[address] == nil {
+					httpError(w, r, pubkey, http.StatusNotFound, msgEventNotFound)
+					return
+				}
+			}
+			if err := setFeaturedPick(ctx, req.Week, address, status, pubkey); err != nil {
+				writeAPIResult(w, nil, err)
+				return
+			}
+		}
+		picks, err := featuredPicks(ctx, req.Week)
+		writeAPIResult(w, map[string]interface{}{"week": req.Week, "published": published, "picks": picks}, err)
+	})
+}
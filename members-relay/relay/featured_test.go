@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestISOWeek(t *testing.T) {
+	for _, tc := range []struct {
+		at    string
+		week  string
+		start string
+	}{
+		{"2026-10-15T18:30:00Z", "2026-W42", "2026-10-12"},
+		{"2026-10-12T00:00:00Z", "2026-W42", "2026-10-12"},
+		{"2026-10-18T23:59:59Z", "2026-W42", "2026-10-12"},
+		{"2027-01-01T12:00:00Z", "2026-W53", "2026-12-28"},
+	} {
+		at, _ := time.Parse(time.RFC3339, tc.at)
+		if got := isoWeek(at); got != tc.week {
+			t.Errorf("%s: week %s, want %s", tc.at, got, tc.week)
+		}
+		if got := weekStart(at).Format("2006-01-02"); got != tc.start {
+			t.Errorf("%s: starts %s, want %s", tc.at, got, tc.start)
+		}
+	}
+}
+
+func TestRecipeAddress(t *testing.T) {
+	author := strings.Repeat("a", 64)
+	address, ok := recipeAddress("naddr1qq88xmm4wfjx7at8dqkkcmmpvcq3yamnwvaz7tm6v9czucm0da4kjmn89upzp242424242424242424242424242424242424242424242424242qvzqqqr4guck6n08")
+	if !ok || address != "30023:"+author+":sourdough-loaf" {
+		t.Fatalf("got %q %v", address, ok)
+	}
+	for _, bad := range []string{
+		"naddr1qq88xmm4wfjx7at8dqkkcmmpvcpzp242424242424242424242424242424242424242424242424242qvzqqqqqqyuxg7hm",                                 // kind 1
+		"naddr1qq88xmm4wfjx7at8dqkkcmmpvcq3yamnwvaz7tm6v9czucm0da4kjmn89upzp242424242424242424242424242424242424242424242424242qvzqqqr4guck6n09", // checksum
+		"npub1qq88xmm4wfjx7at8dqkkcmmpvc",
+		"30023:" + author + ":sourdough-loaf",
+	} {
+		if address, ok := recipeAddress(bad); ok {
+			t.Errorf("%s decoded to %s", bad, address)
+		}
+	}
+}
+
+func TestIsPublicFeaturedFilter(t *testing.T) {
+	withRelayKey(t)
+	if !isPublicFeaturedFilter(nostr.Filter{Kinds: []int{KindCurationSet}, Authors: []string{relaySigningPubkey}, Tags: nostr.TagMap{"d": {"2026-W42"}}}) {
+		t.Fatal("relay curation sets not public")
+	}
+	if isPublicFeaturedFilter(nostr.Filter{Kinds: []int{KindCurationSet}}) || isPublicFeaturedFilter(nostr.Filter{Kinds: []int{KindCurationSet}, Authors: pubkeys(1)}) {
+		t.Fatal("members' curation sets public")
+	}
+}
+
+func TestCurateFeatured(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	prev := featuredCfg
+	featuredCfg = featuredConfig{Size: 2, Review: 48 * time.Hour, Title: "Featured", Relays: []string{"wss://public.example"}}
+	t.Cleanup(func() { featuredCfg = prev })
+
+	now, _ := time.Parse(time.RFC3339, "2026-10-12T10:00:00Z")
+	chefSK := nostr.GeneratePrivateKey()
+	recipe := func(d, image string) *nostr.Event {
+		tags := nostr.Tags{{"d", d}, {"title", d}}
+		if image != "" {
+			tags = append(tags, nostr.Tag{"image", image})
+		}
+		evt := signedEvent(t, chefSK, KindRecipe, nostr.Timestamp(now.Unix()-30*86400), tags, "")
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+		return evt
+	}
+	brisket, bread, soup := recipe("brisket", ""), recipe("bread", "https://media.zap.cooking/bread.jpg"), recipe("soup", "")
+	react := func(target *nostr.Event, fans int) {
+		for i := 0; i < fans; i++ {
+			evt := signedEvent(t, nostr.GeneratePrivateKey(), KindReaction, nostr.Timestamp(now.Unix()-86400), nostr.Tags{{"a", eventAddress(target)}}, "+")
+			if err := persistEvent(ctx, evt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	react(brisket, 3)
+	react(bread, 2)
+	react(soup, 1)
+
+	var pushed []nostr.Event
+	publish := func(_ context.Context, _ []string, event nostr.Event) error {
+		pushed = append(pushed, event)
+		return nil
+	}
+	if err := curateFeatured(ctx, now, publish); err != nil {
+		t.Fatal(err)
+	}
+	picks, err := featuredPicks(ctx, "2026-W42")
+	if err != nil || len(picks) != 3 || picks[0].Address != eventAddress(brisket) {
+		t.Fatalf("seeded picks %+v (%v)", picks, err)
+	}
+	if published, _ := isFeaturedPublished(ctx, "2026-W42"); published {
+		t.Fatal("published during the review window")
+	}
+
+	if err := setFeaturedPick(ctx, "2026-W42", eventAddress(brisket), "removed", adminPubkey); err != nil {
+		t.Fatal(err)
+	}
+	if err := setFeaturedPick(ctx, "2026-W42", eventAddress(soup), "approved", adminPubkey); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := curateFeatured(ctx, now.Add(48*time.Hour), publish); err != nil {
+		t.Fatal(err)
+	}
+	list, err := currentRelayEvent(ctx, KindCurationSet, "2026-W42")
+	if err != nil || list == nil {
+		t.Fatalf("list not published (%v)", err)
+	}
+	var refs []string
+	for _, tag := range list.Tags.GetAll([]string{"a", ""}) {
+		refs = append(refs, tag[1])
+	}
+	if strings.Join(refs, ",") != eventAddress(soup)+","+eventAddress(bread) {
+		t.Fatalf("list %v, want the approved soup then bread", refs)
+	}
+	if image := list.Tags.GetFirst([]string{"image", ""}); image == nil || (*image)[1] != "https://media.zap.cooking/bread.jpg" {
+		t.Fatalf("image %v", image)
+	}
+	if len(pushed) != 1 || pushed[0].ID != list.ID {
+		t.Fatalf("pushed %d events", len(pushed))
+	}
+
+	// Published weeks are final, and pushed once.
+	if err := curateFeatured(ctx, now.Add(72*time.Hour), func(context.Context, []string, nostr.Event) error {
+		return errors.New("pushed twice")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := currentRelayEvent(ctx, KindCurationSet, "2026-W42"); again.ID != list.ID {
+		t.Fatal("published list replaced")
+	}
+}
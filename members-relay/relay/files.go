@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// FILE METADATA (NIP-94)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Clients describe each upload with a kind 1063 event (x = sha256, url, m,
+// dim, blurhash, alt). The x tag and any e/a reference to a recipe land in
+// event_tags, so lookups by hash and by recipe are index probes. Members may
+// publish metadata for any file; a recipe's author needs no membership for
+// metadata whose a or e tag names their own recipe stored here. Since
+// recipes are public, so is their images' metadata: reads of kind 1063 need
+// no auth when a tag filter ties them to recipes, or asks for hashes only
+// recipe images have (isPublicFileMetadataFilter). When
+// RELAY_MEDIA_SERVER points at our Blossom-style media storage, metadata is
+// only accepted for blobs it holds (HEAD /<sha256>), unless
+// RELAY_ALLOW_FOREIGN_FILES is set, and a periodic sweep drops metadata
+// whose blob has since been deleted.
+
+const KindFileMetadata = 1063
+
+var (
+	mediaServer       string
+	allowForeignFiles bool
+	mediaClient       = &http.Client{Timeout: 10 * time.Second}
+)
+
+func loadFileConfig() {
+	mediaServer = strings.TrimSuffix(envOr("RELAY_MEDIA_SERVER", ""), "/")
+	allowForeignFiles = envBool("RELAY_ALLOW_FOREIGN_FILES", false)
+}
+
+// blobExists asks the media server whether it holds the blob with this hash.
+func blobExists(ctx context.Context, sha256 string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, mediaServer+"/"+sha256, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := mediaClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("media server returned %s", resp.Status)
+}
+
+// rejectFileMetadata is the write policy for kind 1063.
+func rejectFileMetadata(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	if !isActiveMember(ctx, pubkey) && !describesOwnRecipe(ctx, event, pubkey) {
+		return true, say(ctx, msgMembershipRequired)
+	}
+	x := event.Tags.GetFirst([]string{"x", ""})
+	if x == nil || !nostr.IsValid32ByteHex((*x)[1]) {
+		return true, say(ctx, msgFileXTag)
+	}
+	u := event.Tags.GetFirst([]string{"url", ""})
+	if u == nil {
+		return true, say(ctx, msgFileURLTag)
+	}
+	if parsed, err := url.Parse((*u)[1]); err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return true, say(ctx, msgFileMalformedURL)
+	}
+	if mediaServer == "" || allowForeignFiles {
+		return false, ""
+	}
+	held, err := blobExists(ctx, (*x)[1])
+	if err != nil {
+		log.Printf("[files] Error checking blob %s: %v", (*x)[1], err)
+		return true, say(ctx, msgFileVerifyFailed)
+	}
+	if !held {
+		return true, say(ctx, msgFileNotHeld)
+	}
+	return false, ""
+}
+
+// describesOwnRecipe reports whether event's a or e tag names a recipe by
+// pubkey stored in ctx's community.
+func describesOwnRecipe(ctx context.Context, event *nostr.Event, pubkey string) bool {
+	if tag := event.Tags.GetFirst([]string{"a", ""}); tag != nil {
+		parts := strings.SplitN((*tag)[1], ":", 3)
+		return len(parts) == 3 && parts[1] == pubkey && recipesStored(ctx, []string{(*tag)[1]}, nil)
+	}
+	tag := event.Tags.GetFirst([]string{"e", ""})
+	if tag == nil {
+		return false
+	}
+	var own bool
+	if err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM events WHERE id = $1 AND kind = $2 AND pubkey = $3 AND community = $4)
+	`, (*tag)[1], KindRecipe, pubkey, communityOf(ctx).id()).Scan(&own); err != nil {
+		log.Printf("[files] Error looking up recipe %s: %v", (*tag)[1], err)
+		return false
+	}
+	return own
+}
+
+// isPublicFileMetadataFilter reports a filter for kind 1063 only that can
+// only match recipe images: one of its a tag filters names only recipe
+// addresses, one of its e tag filters only recipes stored here, or one of
+// its x tag filters only hashes whose every metadata event names a recipe.
+func isPublicFileMetadataFilter(ctx context.Context, filter nostr.Filter) bool {
+	if !containsOnlyKind(filter.Kinds, KindFileMetadata) {
+		return false
+	}
+	recipePrefix := fmt.Sprintf("%d:", KindRecipe)
+	for name, values := range filter.Tags {
+		if len(values) == 0 {
+			continue
+		}
+		switch strings.TrimPrefix(name, "&") {
+		case "a":
+			recipes := true
+			for _, v := range values {
+				recipes = recipes && strings.HasPrefix(v, recipePrefix)
+			}
+			if recipes {
+				return true
+			}
+		case "e":
+			if recipesStored(ctx, nil, values) {
+				return true
+			}
+		case "x":
+			if onlyRecipeImages(ctx, values) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// onlyRecipeImages reports whether every file metadata event in ctx's
+// community with one of hashes names a recipe stored there.
+func onlyRecipeImages(ctx context.Context, hashes []string) bool {
+	var other bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM events f
+			WHERE f.kind = $1 AND f.community = $3
+			AND f.id IN (SELECT event_id FROM event_tags WHERE tag_name = 'x' AND tag_value = ANY($2))
+			AND NOT EXISTS (
+				SELECT 1 FROM event_tags r
+				JOIN events recipe ON recipe.kind = $4 AND recipe.community = f.community
+				WHERE r.event_id = f.id AND (
+					(r.tag_name = 'e' AND r.tag_value = recipe.id)
+					OR (r.tag_name = 'a' AND r.tag_value = recipe.kind || ':' || recipe.pubkey || ':' || recipe.d_tag)
+				)
+			)
+		)
+	`, KindFileMetadata, pq.Array(hashes), communityOf(ctx).id(), KindRecipe).Scan(&other)
+	if err != nil {
+		log.Printf("[files] Error checking file metadata: %v", err)
+		return false
+	}
+	return !other
+}
+
+// fileMetadataBatch bounds one sweep's media server checks.
+const fileMetadataBatch = 500
+
+// collectOrphanedFileMetadata deletes kind 1063 events whose blob is gone
+// from the media server. Hashes the server cannot answer for are kept.
+func collectOrphanedFileMetadata(ctx context.Context) (int64, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT DISTINCT et.tag_value FROM event_tags et
+		JOIN events e ON e.id = et.event_id
+		WHERE e.kind = $1 AND et.tag_name = 'x'
+		LIMIT $2
+	`, KindFileMetadata, fileMetadataBatch)
+	if err != nil {
+		return 0, err
+	}
+	var hashes []string
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		hashes = append(hashes, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var gone []string
+	for _, h := range hashes {
+		held, err := blobExists(ctx, h)
+		if err != nil {
+			log.Printf("[files] Error checking blob %s: %v", h, err)
+			continue
+		}
+		if !held {
+			gone = append(gone, h)
+		}
+	}
+	if len(gone) == 0 {
+		return 0, nil
+	}
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM events WHERE kind = $1 AND id IN (
+			SELECT event_id FROM event_tags WHERE tag_name = 'x' AND tag_value = ANY($2::text[])
+		)
+	`, KindFileMetadata, pq.Array(gone))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// runFileMetadataGC sweeps for orphaned metadata every six hours.
+func runFileMetadataGC(ctx context.Context) {
+	if mediaServer == "" {
+		return
+	}
+	ticker := time.NewTicker(6 * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if n, err := collectOrphanedFileMetadata(ctx); err != nil {
+			log.Printf("[files] Error collecting orphaned file metadata: %v", err)
+		} else if n > 0 {
+			log.Printf("[files] Removed %d file metadata events for deleted blobs", n)
+		}
+	}
+}
+
+// recipeMedia is the layout-relevant part of a recipe's file metadata.
+type recipeMedia struct {
+	SHA256   string `json:"sha256"`
+	URL      string `json:"url"`
+	MimeType string `json:"m,omitempty"`
+	Dim      string `json:"dim,omitempty"`
+	Blurhash string `json:"blurhash,omitempty"`
+	Alt      string `json:"alt,omitempty"`
+}
+
+// mediaForRecipe returns the file metadata referencing a recipe by address
+// (a tag) or event id (e tag).
+func mediaForRecipe(ctx context.Context, address, eventID string) ([]recipeMedia, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT e.tags FROM events e
+		WHERE e.kind = $1 AND e.community = $4 AND e.id IN (
+			SELECT event_id FROM event_tags
+			WHERE (tag_name = 'a' AND tag_value = $2) OR (tag_name = 'e' AND tag_value = $3)
+		)
+		ORDER BY e.created_at
+	`, KindFileMetadata, address, eventID, communityOf(ctx).id())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	media := []recipeMedia{}
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		var tags nostr.Tags
+		json.Unmarshal(raw, &tags)
+		value := func(name string) string {
+			if tag := tags.GetFirst([]string{name, ""}); tag != nil {
+				return (*tag)[1]
+			}
+			return ""
+		}
+		media = append(media, recipeMedia{
+			SHA256: value("x"), URL: value("url"), MimeType: value("m"),
+			Dim: value("dim"), Blurhash: value("blurhash"), Alt: value("alt"),
+		})
+	}
+	return media, rows.Err()
+}
+
+// registerFileAPI mounts GET /api/recipes/media?a=<30023 address>&e=<id>,
+// which gives the frontend image dimensions and blurhash for layout, and the
+// recipe's content labels so it knows to blur. Recipes are public, so this is
+// too.
+func registerFileAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/api/recipes/media", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		address, eventID := r.URL.Query().Get("a"), r.URL.Query().Get("e")
+		if !strings.HasPrefix(address, fmt.Sprintf("%d:", KindRecipe)) && !nostr.IsValid32ByteHex(eventID) {
+			http.Error(w, "invalid: a recipe address (a) or event id (e) is required", http.StatusBadRequest)
+			return
+		}
+		media, err := mediaForRecipe(r.Context(), address, eventID)
+		labels := []contentLabel{}
+		if err == nil {
+			var byTarget map[string][]contentLabel
+			byTarget, err = labelsFor(r.Context(), []string{address, eventID})
+			labels = append(append(labels, byTarget[address]...), byTarget[eventID]...)
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		writeAPIResult(w, map[string]interface{}{"media": media, "labels": labels}, err)
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// fakeMediaServer answers HEAD /<sha256> from a mutable set of blobs.
+type fakeMediaServer struct {
+	mu    sync.Mutex
+	blobs map[string]bool
+}
+
+func startMediaServer(t *testing.T, blobs ...string) *fakeMediaServer {
+	t.Helper()
+	m := &fakeMediaServer{blobs: make(map[string]bool)}
+	for _, b := range blobs {
+		m.blobs[b] = true
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if strings.Contains(r.URL.Path, "broken") {
+			w.WriteHeader(http.StatusBadGateway)
+		} else if !m.blobs[strings.TrimPrefix(r.URL.Path, "/")] {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	prev := mediaServer
+	mediaServer = srv.URL
+	t.Cleanup(func() {
+		srv.Close()
+		mediaServer = prev
+	})
+	return m
+}
+
+func TestBlobExists(t *testing.T) {
+	held := pubkeys(1)[0]
+	startMediaServer(t, held)
+	ctx := context.Background()
+
+	if ok, err := blobExists(ctx, held); !ok || err != nil {
+		t.Fatalf("held blob: %v %v", ok, err)
+	}
+	if ok, err := blobExists(ctx, pubkeys(2)[1]); ok || err != nil {
+		t.Fatalf("missing blob: %v %v", ok, err)
+	}
+	if _, err := blobExists(ctx, "broken"); err == nil {
+		t.Fatal("server error reported as an answer")
+	}
+}
+
+func TestFileMetadataLifecycle(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	addTestMember(t, pk)
+	hashes := pubkeys(2)
+	media := startMediaServer(t, hashes[0])
+
+	recipe := "30023:" + pk + ":focaccia"
+	file := func(x string) *nostr.Event {
+		return signedEvent(t, sk, KindFileMetadata, nostr.Now(), nostr.Tags{
+			{"x", x}, {"url", "https://media.zap.cooking/" + x + ".jpg"}, {"m", "image/jpeg"},
+			{"dim", "1200x800"}, {"blurhash", "LEHV6nWB2yk8"}, {"a", recipe},
+		}, "")
+	}
+
+	if reject, msg := rejectFileMetadata(ctx, file(hashes[1]), pk); !reject {
+		t.Fatal("metadata for a foreign file accepted")
+	} else if !strings.HasPrefix(msg, "invalid:") {
+		t.Fatalf("unexpected reason %q", msg)
+	}
+	bad := signedEvent(t, sk, KindFileMetadata, nostr.Now(), nostr.Tags{{"x", hashes[0]}, {"url", "ftp://x"}}, "")
+	if reject, _ := rejectFileMetadata(ctx, bad, pk); !reject {
+		t.Fatal("malformed url accepted")
+	}
+
+	evt := file(hashes[0])
+	if reject, msg := rejectFileMetadata(ctx, evt, pk); reject {
+		t.Fatalf("held file rejected: %s", msg)
+	}
+	if err := persistEvent(ctx, evt); err != nil {
+		t.Fatal(err)
+	}
+	got, err := mediaForRecipe(ctx, recipe, "")
+	if err != nil || len(got) != 1 || got[0].Dim != "1200x800" || got[0].Blurhash != "LEHV6nWB2yk8" {
+		t.Fatalf("recipe media %+v (%v)", got, err)
+	}
+
+	// Deleting the blob orphans the metadata.
+	media.mu.Lock()
+	delete(media.blobs, hashes[0])
+	media.mu.Unlock()
+	if n, err := collectOrphanedFileMetadata(ctx); err != nil || n != 1 {
+		t.Fatalf("collected %d (%v)", n, err)
+	}
+	if got, _ := mediaForRecipe(ctx, recipe, ""); len(got) != 0 {
+		t.Fatalf("orphaned metadata still served: %+v", got)
+	}
+}
+
+// A recipe's author publishes metadata for its photo without membership,
+// and anyone can look the photo up by hash.
+func TestRecipeImageMetadata(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	authorSK := nostr.GeneratePrivateKey()
+	author, _ := nostr.GetPublicKey(authorSK)
+	member := pubkeys(1)[0]
+	addTestMember(t, member)
+	hashes := pubkeys(3)
+
+	recipe := signedEvent(t, authorSK, KindRecipe, nostr.Now(), nostr.Tags{{"d", "focaccia"}}, "")
+	if err := persistEvent(ctx, recipe); err != nil {
+		t.Fatal(err)
+	}
+	address := "30023:" + author + ":focaccia"
+	file := func(x string, ref nostr.Tag) *nostr.Event {
+		return signedEvent(t, authorSK, KindFileMetadata, nostr.Now(), nostr.Tags{
+			{"x", x}, {"url", "https://media.zap.cooking/" + x + ".jpg"}, {"m", "image/jpeg"}, {"dim", "1200x800"}, ref,
+		}, "")
+	}
+
+	byAddress, byID := file(hashes[0], nostr.Tag{"a", address}), file(hashes[1], nostr.Tag{"e", recipe.ID})
+	for _, evt := range []*nostr.Event{byAddress, byID} {
+		if reject, msg := rejectFileMetadata(ctx, evt, author); reject {
+			t.Fatalf("recipe author rejected: %s", msg)
+		}
+	}
+	if reject, _ := rejectFileMetadata(ctx, file(hashes[2], nostr.Tag{"a", "30023:" + member + ":bagels"}), author); !reject {
+		t.Fatal("non-member accepted for someone else's recipe")
+	}
+	if reject, _ := rejectFileMetadata(ctx, file(hashes[2], nostr.Tag{"t", "kitchen"}), author); !reject {
+		t.Fatal("non-member accepted without a recipe")
+	}
+	noX := signedEvent(t, authorSK, KindFileMetadata, nostr.Now(), nostr.Tags{{"url", "https://media.zap.cooking/a.jpg"}, {"a", address}}, "")
+	if reject, msg := rejectFileMetadata(ctx, noX, author); !reject || !strings.HasPrefix(msg, "invalid:") {
+		t.Fatalf("metadata without x: %v %q", reject, msg)
+	}
+
+	// Metadata of a file outside any recipe keeps its hash private.
+	memberFile := &nostr.Event{Kind: KindFileMetadata, PubKey: member, CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{{"x", hashes[2]}, {"url", "https://media.zap.cooking/c.jpg"}}}
+	memberFile.ID = memberFile.GetID()
+	for _, evt := range []*nostr.Event{byAddress, byID, memberFile} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rl := khatru.NewRelay()
+	rl.QueryEvents = append(rl.QueryEvents, queryEvents)
+	rl.RejectFilter = append(rl.RejectFilter, rejectFilterPolicy)
+	url := startTestRelay(t, rl, testServerConfig(false))
+	c := dialTestRelay(t, url)
+	fetch := func(subID, filter string) []string {
+		t.Helper()
+		c.send(`["REQ","` + subID + `",` + filter + `]`)
+		var ids []string
+		for {
+			env := c.next(func(env nostr.Envelope) bool {
+				switch env := env.(type) {
+				case *nostr.EventEnvelope:
+					return *env.SubscriptionID == subID
+				case *nostr.EOSEEnvelope:
+					return string(*env) == subID
+				case *nostr.ClosedEnvelope:
+					return env.SubscriptionID == subID
+				}
+				return false
+			})
+			evt, ok := env.(*nostr.EventEnvelope)
+			if !ok {
+				return ids
+			}
+			ids = append(ids, evt.Event.ID)
+		}
+	}
+
+	if got := fetch("x", `{"kinds":[1063],"#x":["`+hashes[0]+`","`+hashes[1]+`"]}`); len(got) != 2 ||
+		!slices.Contains(got, byAddress.ID) || !slices.Contains(got, byID.ID) {
+		t.Errorf("recipe images by hash: %v", got)
+	}
+	if got := fetch("a", `{"kinds":[1063],"#a":["`+address+`"]}`); !slices.Equal(got, []string{byAddress.ID}) {
+		t.Errorf("recipe images by address: %v", got)
+	}
+	if reason := c.req("other", `{"kinds":[1063],"#x":["`+hashes[2]+`"]}`); reason == "EOSE" {
+		t.Error("metadata outside recipes served without auth")
+	}
+}
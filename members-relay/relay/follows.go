@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// FOLLOW GRAPH (kind 3)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Kind 3 contact lists are stored like any replaceable event; their p tags are
+// also mirrored into follows so community features can query the graph.
+// follows always equals the p tags of each author's current list: it is
+// diffed inside the same transaction that stores a newer list, and cleared
+// when the list is deleted.
+
+const followsBackfillKey = "follows_backfilled"
+
+// maxFollowHops bounds followDistance; each hop is one indexed join.
+const maxFollowHops = 3
+
+// followees returns the distinct valid pubkeys a contact list follows.
+func followees(event *nostr.Event) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "p" || !nostr.IsValid32ByteHex(tag[1]) || seen[tag[1]] {
+			continue
+		}
+		seen[tag[1]] = true
+		out = append(out, tag[1])
+	}
+	return out
+}
+
+// syncFollows makes follows match event, the author's new current list.
+func syncFollows(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	list := followees(event)
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM follows WHERE follower = $1 AND followee <> ALL($2::text[])",
+		event.PubKey, pq.Array(list)); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO follows (follower, followee)
+		SELECT $1, f FROM unnest($2::text[]) AS f
+		ON CONFLICT DO NOTHING
+	`, event.PubKey, pq.Array(list))
+	return err
+}
+
+// deleteFollowsForEvent clears the graph edges of a contact list that is
+// about to be deleted.
+func deleteFollowsForEvent(ctx context.Context, tx *sql.Tx, eventID string) error {
+	_, err := tx.ExecContext(ctx, `
+		DELETE FROM follows WHERE follower = (
+			SELECT pubkey FROM events WHERE id = $1 AND kind = $2
+		)
+	`, eventID, nostr.KindFollowList)
+	return err
+}
+
+// backfillFollows derives follows from contact lists stored before the
+// table existed. It runs once per database.
+func backfillFollows(ctx context.Context) error {
+	var done bool
+	if err := db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM relay_state WHERE key = $1)", followsBackfillKey,
+	).Scan(&done); err != nil || done {
+		return err
+	}
+
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO follows (follower, followee)
+		SELECT DISTINCT e.pubkey, t->>1
+		FROM events e, jsonb_array_elements(e.tags) t
+		WHERE e.kind = $1
+		AND jsonb_typeof(t) = 'array'
+		AND t->>0 = 'p'
+		AND t->>1 ~ '^[0-9a-f]{64}$'
+		ON CONFLICT DO NOTHING
+	`, nostr.KindFollowList)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO relay_state (key, value) VALUES ($1, NOW()::text)
+		ON CONFLICT (key) DO NOTHING
+	`, followsBackfillKey); err != nil {
+		return err
+	}
+	log.Printf("[follows] Backfilled %d follow edges from stored contact lists", n)
+	return nil
+}
+
+// memberFollowers lists active relay members who follow pubkey.
+func memberFollowers(ctx context.Context, pubkey string) ([]string, error) {
+	return queryPubkeys(ctx, `
+		SELECT f.follower FROM follows f
+		JOIN members m ON m.pubkey = f.follower
+		WHERE f.followee = $1
+		AND m.status IN ('active', 'grace') AND m.subscription_end > NOW()
+		ORDER BY f.follower
+	`, pubkey)
+}
+
+// groupMutuals lists members of groupID who follow pubkey and are followed
+// back by it.
+func groupMutuals(ctx context.Context, groupID, pubkey string) ([]string, error) {
+	return queryPubkeys(ctx, `
+		SELECT gm.pubkey FROM group_members gm
+		JOIN follows out ON out.follower = $2 AND out.followee = gm.pubkey
+		JOIN follows back ON back.follower = gm.pubkey AND back.followee = $2
+		WHERE gm.group_id = $1 AND gm.pubkey <> $2
+		ORDER BY gm.pubkey
+	`, groupID, pubkey)
+}
+
+// followDistance returns the number of follow hops from one pubkey to
+// another, or -1 if to is not reachable within maxHops (capped at
+// maxFollowHops). Paths are found by meeting in the middle: from's follow
+// list on one side, the lists that contain to on the other.
+func followDistance(ctx context.Context, from, to string, maxHops int) (int, error) {
+	if from == to {
+		return 0, nil
+	}
+	if maxHops > maxFollowHops {
+		maxHops = maxFollowHops
+	}
+	queries := []string{
+		`SELECT EXISTS (SELECT 1 FROM follows WHERE follower = $1 AND followee = $2)`,
+		`SELECT EXISTS (
+			SELECT 1 FROM follows a JOIN follows b ON b.follower = a.followee
+			WHERE a.follower = $1 AND b.followee = $2
+		)`,
+		`SELECT EXISTS (
+			SELECT 1 FROM follows a
+			JOIN follows b ON b.follower = a.followee
+			JOIN follows c ON c.follower = b.followee
+			WHERE a.follower = $1 AND c.followee = $2
+		)`,
+	}
+	for hops := 1; hops <= maxHops; hops++ {
+		var found bool
+		if err := db.QueryRowContext(ctx, queries[hops-1], from, to).Scan(&found); err != nil {
+			return -1, err
+		}
+		if found {
+			return hops, nil
+		}
+	}
+	return -1, nil
+}
+
+func queryPubkeys(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var pk string
+		if err := rows.Scan(&pk); err != nil {
+			return nil, err
+		}
+		out = append(out, pk)
+	}
+	return out, rows.Err()
+}
+
+// ─── HTTP ──────────────────────────────────────────────────────────────────────
+
+// registerFollowAPI mounts the follow-graph endpoints. They answer for the
+// NIP-98 authenticated caller only and require an active membership, the
+// same bar as reading someone else's raw contact list.
+func registerFollowAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/api/follows/followers", memberAPI(func(w http.ResponseWriter, r *http.Request, pubkey string) {
+		followers, err := memberFollowers(r.Context(), pubkey)
+		writeAPIResult(w, map[string]interface{}{"followers": followers}, err)
+	}))
+	mux.HandleFunc("/api/follows/mutuals", memberAPI(func(w http.ResponseWriter, r *http.Request, pubkey string) {
+		groupID := r.URL.Query().Get("group")
+		if groupID == "" {
+			http.Error(w, "invalid: group parameter required", http.StatusBadRequest)
+			return
+		}
+		if !isGroupMember(r.Context(), groupID, pubkey) {
+			http.Error(w, "restricted: not a member of this group", http.StatusForbidden)
+			return
+		}
+		mutuals, err := groupMutuals(r.Context(), groupID, pubkey)
+		writeAPIResult(w, map[string]interface{}{"group": groupID, "mutuals": mutuals}, err)
+	}))
+	mux.HandleFunc("/api/follows/distance", memberAPI(func(w http.ResponseWriter, r *http.Request, pubkey string) {
+		target := r.URL.Query().Get("target")
+		if !nostr.IsValid32ByteHex(target) {
+			http.Error(w, "invalid: target must be a hex pubkey", http.StatusBadRequest)
+			return
+		}
+		maxHops := maxFollowHops
+		if v := r.URL.Query().Get("max"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "invalid: max must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			maxHops = n
+		}
+		hops, err := followDistance(r.Context(), pubkey, target, maxHops)
+		writeAPIResult(w, map[string]interface{}{"target": target, "hops": hops, "within": hops >= 0}, err)
+	}))
+}
+
+// memberAPI authenticates a request with NIP-98 and requires an active
+// membership before calling h with the caller's pubkey.
+func memberAPI(h func(w http.ResponseWriter, r *http.Request, pubkey string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pubkey, err := nip98Pubkey(r)
+		if err != nil {
+			http.Error(w, "auth-required: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !isActiveMember(r.Context(), pubkey) {
+			http.Error(w, "restricted: membership required", http.StatusForbidden)
+			return
+		}
+		h(w, r, pubkey)
+	}
+}
+
+func writeAPIResult(w http.ResponseWriter, body interface{}, err error) {
+	if err != nil {
+		log.Printf("[api] Query error: %v", err)
+		http.Error(w, "error: query failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
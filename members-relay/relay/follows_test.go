@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestFolloweesDedupAndValidate(t *testing.T) {
+	keys := pubkeys(2)
+	event := &nostr.Event{Kind: nostr.KindFollowList, Tags: nostr.Tags{
+		{"p", keys[0]}, {"p", keys[0], "wss://relay"}, {"p", "npub1nope"}, {"e", keys[1]}, {"p", keys[1]},
+	}}
+	if got := followees(event); !reflect.DeepEqual(got, keys) {
+		t.Fatalf("got %v, want %v", got, keys)
+	}
+}
+
+func storedFollows(t *testing.T, follower string) []string {
+	t.Helper()
+	got, err := queryPubkeys(context.Background(),
+		"SELECT followee FROM follows WHERE follower = $1 ORDER BY followee", follower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func contactList(keys ...string) nostr.Tags {
+	tags := nostr.Tags{}
+	for _, k := range keys {
+		tags = append(tags, nostr.Tag{"p", k})
+	}
+	return tags
+}
+
+func TestFollowsTrackCurrentContactList(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	keys := pubkeys(3)
+	sort.Strings(keys)
+	now := nostr.Now()
+
+	if err := persistEvent(ctx, signedEvent(t, sk, nostr.KindFollowList, now, contactList(keys[0], keys[1]), "")); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedFollows(t, pk); !reflect.DeepEqual(got, keys[:2]) {
+		t.Fatalf("initial follows %v", got)
+	}
+
+	// A newer list replaces the edges; an older one is refused.
+	latest := signedEvent(t, sk, nostr.KindFollowList, now+10, contactList(keys[1], keys[2]), "")
+	if err := persistEvent(ctx, latest); err != nil {
+		t.Fatal(err)
+	}
+	if err := persistEvent(ctx, signedEvent(t, sk, nostr.KindFollowList, now+5, contactList(keys[0]), "")); !errors.Is(err, errReplaced) {
+		t.Fatalf("older list: %v", err)
+	}
+	if got := storedFollows(t, pk); !reflect.DeepEqual(got, keys[1:]) {
+		t.Fatalf("follows after replacement %v", got)
+	}
+
+	if err := deleteEvent(ctx, latest); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedFollows(t, pk); len(got) != 0 {
+		t.Fatalf("follows left after deleting the list: %v", got)
+	}
+}
+
+func TestFollowDistance(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	keys := pubkeys(5)
+	// 0 -> 1 -> 2 -> 3, and 4 is unreachable.
+	for i := 0; i < 3; i++ {
+		if _, err := db.ExecContext(ctx,
+			"INSERT INTO follows (follower, followee) VALUES ($1, $2)", keys[i], keys[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		to, max, want int
+	}{
+		{0, 3, 0}, {1, 3, 1}, {2, 3, 2}, {3, 3, 3}, {3, 2, -1}, {3, 10, 3}, {4, 3, -1},
+	} {
+		got, err := followDistance(ctx, keys[0], keys[tc.to], tc.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("distance to %d (max %d) = %d, want %d", tc.to, tc.max, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// GIFT WRAPS (NIP-17, NIP-59)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Members message each other with NIP-17 direct messages, which travel as
+// kind 1059 gift wraps. A wrap is signed by a throwaway key, so the sender
+// is the authenticated connection rather than the event's pubkey; it names
+// its one recipient in a p tag. Only the recipient can read a wrap, in SQL
+// and in live delivery. The admin gets no exception.
+
+// giftWrapRecipient returns the pubkey of a wrap's single p tag, or "".
+func giftWrapRecipient(event *nostr.Event) string {
+	recipient := ""
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "p" {
+			continue
+		}
+		if recipient != "" {
+			return ""
+		}
+		recipient = tag[1]
+	}
+	if !nostr.IsValid32ByteHex(recipient) {
+		return ""
+	}
+	return recipient
+}
+
+// rejectGiftWrap is the write policy for kind 1059: an active member
+// sending to an active member.
+func rejectGiftWrap(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	if !isActiveMember(ctx, pubkey) {
+		return true, say(ctx, msgMembershipRequired)
+	}
+	recipient := giftWrapRecipient(event)
+	if recipient == "" {
+		return true, say(ctx, msgGiftWrapRecipient)
+	}
+	if !isActiveMember(ctx, recipient) {
+		return true, say(ctx, msgRecipientNotMember)
+	}
+	return false, ""
+}
+
+// giftWrapPrivacyCondition limits gift wraps to those addressed to viewer.
+func giftWrapPrivacyCondition(viewer string, argIndex int) (string, []interface{}) {
+	return fmt.Sprintf("(kind <> %d OR tags @> jsonb_build_array(jsonb_build_array('p', $%d::text)))",
+		nostr.KindGiftWrap, argIndex), []interface{}{viewer}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestGiftWrapRecipient(t *testing.T) {
+	a, b := pubkeys(2)[0], pubkeys(2)[1]
+	for _, tc := range []struct {
+		tags nostr.Tags
+		want string
+	}{
+		{nostr.Tags{{"p", a}}, a},
+		{nostr.Tags{{"p", a}, {"p", b}}, ""},
+		{nostr.Tags{{"p", "npub1xyz"}}, ""},
+		{nil, ""},
+	} {
+		if got := giftWrapRecipient(&nostr.Event{Kind: nostr.KindGiftWrap, Tags: tc.tags}); got != tc.want {
+			t.Errorf("%v: got %q", tc.tags, got)
+		}
+	}
+}
+
+func TestGiftWrapsReachOnlyTheirRecipient(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	keys := pubkeys(3)
+	alice, bob, outsider := keys[0], keys[1], keys[2]
+	addTestMember(t, alice)
+	addTestMember(t, bob)
+
+	// Each wrap is signed by its own throwaway key.
+	wrap := func(recipient string) *nostr.Event {
+		return signedEvent(t, nostr.GeneratePrivateKey(), nostr.KindGiftWrap, nostr.Now(), nostr.Tags{{"p", recipient}}, "sealed")
+	}
+	toAlice, toBob := wrap(alice), wrap(bob)
+	if reject, msg := rejectGiftWrap(ctx, toBob, alice); reject {
+		t.Fatalf("member to member refused: %s", msg)
+	}
+	if reject, _ := rejectGiftWrap(ctx, wrap(outsider), alice); !reject {
+		t.Fatal("wrap to a non-member accepted")
+	}
+	if reject, _ := rejectGiftWrap(ctx, toBob, outsider); !reject {
+		t.Fatal("wrap from a non-member accepted")
+	}
+	for _, evt := range []*nostr.Event{toAlice, toBob} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, filter := range []nostr.Filter{
+		{Kinds: []int{nostr.KindGiftWrap}},
+		{Kinds: []int{nostr.KindGiftWrap}, Tags: nostr.TagMap{"p": {bob}}},
+		{Kinds: []int{nostr.KindGiftWrap}, Tags: nostr.TagMap{"p": {alice, bob}}},
+		{IDs: []string{toAlice.ID, toBob.ID}},
+		{Authors: []string{toBob.PubKey}},
+	} {
+		query, args := buildViewerQuery(filter, nil, alice, false)
+		got, err := fetchEvents(ctx, query, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, evt := range got {
+			if evt.ID == toBob.ID {
+				t.Errorf("%v: alice read bob's gift wrap", filter)
+			}
+		}
+	}
+	query, args := buildViewerQuery(nostr.Filter{Kinds: []int{nostr.KindGiftWrap}}, nil, alice, false)
+	if got, _ := fetchEvents(ctx, query, args); len(got) != 1 || got[0].ID != toAlice.ID {
+		t.Fatalf("alice's own wraps: %v", got)
+	}
+
+	allow := readableBy(ctx, toBob)
+	if allow(alice) || !allow(bob) || allow("") {
+		t.Fatal("live delivery of bob's wrap not limited to bob")
+	}
+	if !isRestrictedEvent(toBob) {
+		t.Fatal("gift wrap broadcast to every subscription")
+	}
+}
@@ -3,6 +3,7 @@ module members-relay
 go 1.23.1
 
 require (
+	github.com/fasthttp/websocket v1.5.7
 	github.com/fiatjaf/khatru v0.12.0
 	github.com/lib/pq v1.10.9
 	github.com/nbd-wtf/go-nostr v0.42.0
@@ -16,7 +17,6 @@ require (
 	github.com/cespare/xxhash v1.1.0 // indirect
 	github.com/decred/dcrd/crypto/blake256 v1.1.0 // indirect
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.3.0 // indirect
-	github.com/fasthttp/websocket v1.5.7 // indirect
 	github.com/fiatjaf/eventstore v0.13.0 // indirect
 	github.com/gobwas/httphead v0.1.0 // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
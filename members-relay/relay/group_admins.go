@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// LAST GROUP ADMIN (NIP-29)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// A group without an admin cannot be managed, so nothing may take away its
+// last admin: not a leave request (kind 9022), a remove-user (kind 9001) or
+// a put-user (kind 9000) demoting them. Such events are refused with
+// "invalid: cannot remove the last group admin — transfer ownership
+// first". To hand a group over, an admin promotes someone with a put-user
+// giving them the admin role (["p", <pubkey>, "admin"]) and may then
+// leave; one put-user can also promote the successor and demote the admin
+// at once. The community admin is exempt and can remove anyone.
+
+// errLastAdmin is the side effects' answer for a change the policy let
+// through that would leave the group without an admin; nothing is stored.
+var errLastAdmin = errors.New("would remove the last group admin")
+
+// adminChanges returns the pubkeys a membership event takes the admin role
+// from (dropped) and gives it to (promoted).
+func adminChanges(event *nostr.Event) (dropped, promoted []string) {
+	switch event.Kind {
+	case KindLeaveRequest:
+		return []string{event.PubKey}, nil
+	case KindRemoveUser:
+		if hasUnbanMarker(event) {
+			return nil, nil
+		}
+	case KindPutUser:
+	default:
+		return nil, nil
+	}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "p" {
+			continue
+		}
+		if event.Kind == KindPutUser && len(tag) >= 3 && tag[2] == "admin" {
+			promoted = append(promoted, tag[1])
+		} else {
+			dropped = append(dropped, tag[1])
+		}
+	}
+	return dropped, promoted
+}
+
+// leavesNoAdmin reports whether event would take away groupId's last
+// admin. Events from the community admin never do.
+func leavesNoAdmin(ctx context.Context, q rowQueryer, groupId string, event *nostr.Event) (bool, error) {
+	if event.PubKey == communityOf(ctx).admin() {
+		return false, nil
+	}
+	dropped, promoted := adminChanges(event)
+	if len(dropped) == 0 || len(promoted) > 0 {
+		return false, nil
+	}
+	var orphaned bool
+	err := q.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM group_members WHERE group_id = $1 AND role = 'admin' AND pubkey = ANY($2))
+			AND NOT EXISTS (SELECT 1 FROM group_members WHERE group_id = $1 AND role = 'admin' AND NOT pubkey = ANY($2))
+	`, groupId, pq.Array(dropped)).Scan(&orphaned)
+	return orphaned, err
+}
+
+// rejectLastAdmin refuses a membership event that would leave its group
+// without an admin.
+func rejectLastAdmin(ctx context.Context, event *nostr.Event) (bool, string) {
+	groupId := getHTag(event)
+	orphaned, err := leavesNoAdmin(ctx, db, groupId, event)
+	if err != nil {
+		log.Printf("[NIP-29] Error checking admins of group %s: %v", groupId, err)
+		return true, say(ctx, msgEventLookupFailed)
+	}
+	if orphaned {
+		return true, say(ctx, msgLastGroupAdmin)
+	}
+	return false, ""
+}
+
+// checkLastAdmin is rejectLastAdmin for the side effects, under the group
+// lock: a change racing past the policy is refused here.
+func checkLastAdmin(ctx context.Context, tx *sql.Tx, groupId string, event *nostr.Event) error {
+	orphaned, err := leavesNoAdmin(ctx, tx, groupId, event)
+	if err != nil {
+		return err
+	}
+	if orphaned {
+		return errLastAdmin
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestAdminChanges(t *testing.T) {
+	keys := pubkeys(2)
+	a, b := keys[0], keys[1]
+	for _, tc := range []struct {
+		event             *nostr.Event
+		dropped, promoted []string
+	}{
+		{&nostr.Event{Kind: KindLeaveRequest, PubKey: a, Tags: nostr.Tags{{"h", "g"}}}, []string{a}, nil},
+		{&nostr.Event{Kind: KindRemoveUser, Tags: nostr.Tags{{"h", "g"}, {"p", a}}}, []string{a}, nil},
+		{&nostr.Event{Kind: KindRemoveUser, Tags: nostr.Tags{{"h", "g"}, {"p", a}, {"unban"}}}, nil, nil},
+		{&nostr.Event{Kind: KindPutUser, Tags: nostr.Tags{{"h", "g"}, {"p", a, "member"}, {"p", b, "admin"}}}, []string{a}, []string{b}},
+		{&nostr.Event{Kind: KindGroupChat, Tags: nostr.Tags{{"h", "g"}, {"p", a}}}, nil, nil},
+	} {
+		dropped, promoted := adminChanges(tc.event)
+		if !reflect.DeepEqual(dropped, tc.dropped) || !reflect.DeepEqual(promoted, tc.promoted) {
+			t.Errorf("kind %d %v: dropped %v, promoted %v", tc.event.Kind, tc.event.Tags, dropped, promoted)
+		}
+	}
+}
+
+// The sole admin can neither leave, be removed nor be demoted until they
+// hand the group over; the community admin can.
+func TestLastGroupAdmin(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	ownerSK, heirSK, relayAdminSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSK)
+	heir, _ := nostr.GetPublicKey(heirSK)
+	relayAdmin, _ := nostr.GetPublicKey(relayAdminSK)
+	addTestMember(t, owner)
+	prev := adminPubkey
+	adminPubkey = relayAdmin
+	t.Cleanup(func() { adminPubkey = prev })
+	now := nostr.Now()
+	h := nostr.Tags{{"h", "club"}}
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindCreateGroup, now, h, ""))
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindPutGroupStatus, now, nostr.Tags{{"h", "club"}, {"open"}}, ""))
+	applyGroupEvent(t, signedEvent(t, heirSK, KindJoinRequest, now, h, ""))
+
+	for _, evt := range []*nostr.Event{
+		signedEvent(t, ownerSK, KindLeaveRequest, now+1, h, ""),
+		signedEvent(t, ownerSK, KindRemoveUser, now+1, nostr.Tags{{"h", "club"}, {"p", owner}}, ""),
+		signedEvent(t, ownerSK, KindPutUser, now+1, nostr.Tags{{"h", "club"}, {"p", owner, "member"}}, ""),
+	} {
+		if reject, msg := rejectLastAdmin(ctx, evt); !reject || msg != "invalid: cannot remove the last group admin — transfer ownership first" {
+			t.Fatalf("kind %d by the last admin: %v %q", evt.Kind, reject, msg)
+		}
+		if err := storeGroupEvent(ctx, evt); !errors.Is(err, errLastAdmin) {
+			t.Fatalf("kind %d applied: %v", evt.Kind, err)
+		}
+	}
+	if !isGroupAdmin(ctx, "club", owner) {
+		t.Fatal("last admin lost the role")
+	}
+
+	// Transfer ownership, then leave
+	addTestMember(t, heir)
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindPutUser, now+2, nostr.Tags{{"h", "club"}, {"p", heir, "admin"}}, ""))
+	leave := signedEvent(t, ownerSK, KindLeaveRequest, now+3, h, "")
+	if reject, msg := rejectLastAdmin(ctx, leave); reject {
+		t.Fatalf("leaving after the handover: %s", msg)
+	}
+	applyGroupEvent(t, leave)
+	if isGroupMember(ctx, "club", owner) || !isGroupAdmin(ctx, "club", heir) {
+		t.Fatal("handover not applied")
+	}
+
+	// The community admin overrides
+	remove := signedEvent(t, relayAdminSK, KindRemoveUser, now+4, nostr.Tags{{"h", "club"}, {"p", heir}}, "")
+	if reject, msg := rejectLastAdmin(ctx, remove); reject {
+		t.Fatalf("community admin refused: %s", msg)
+	}
+	applyGroupEvent(t, remove)
+	if isGroupMember(ctx, "club", heir) {
+		t.Fatal("community admin could not remove the last admin")
+	}
+}
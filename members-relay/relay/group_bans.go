@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// GROUP BANS (NIP-29)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// A group admin bans someone with a remove-user (kind 9001) carrying a
+// ["ban", <optional reason>] tag: every pubkey it names is removed and
+// recorded in group_bans. A banned pubkey can send nothing with the group's
+// h tag, join requests included, and is told "restricted: you are banned
+// from this group". A remove-user with an ["unban"] tag lifts the ban of
+// the pubkeys it names without adding them, so they may ask to join again;
+// a put-user (kind 9000) lifts it and adds them. The community admin
+// cannot be banned.
+
+// errGroupBanned is handleJoinRequest's answer for a banned requester;
+// nothing is stored.
+var errGroupBanned = errors.New("banned from the group")
+
+// isBannedFromGroup reports whether pubkey is banned from groupId.
+func isBannedFromGroup(ctx context.Context, q rowQueryer, groupId, pubkey string) (bool, error) {
+	var banned bool
+	err := q.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM group_bans WHERE group_id = $1 AND pubkey = $2)",
+		groupId, pubkey).Scan(&banned)
+	return banned, err
+}
+
+// rejectGroupBanned refuses any event for a group its author is banned
+// from.
+func rejectGroupBanned(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	groupId := getHTag(event)
+	if groupId == "" || pubkey == communityAdmin(ctx) {
+		return false, ""
+	}
+	banned, err := isBannedFromGroup(ctx, db, groupId, pubkey)
+	if err != nil {
+		log.Printf("[NIP-29] Error checking bans of group %s for %s: %v", groupId, pubkey, err)
+		return true, say(ctx, msgBanCheckFailed)
+	}
+	if banned {
+		return true, say(ctx, msgGroupBanned)
+	}
+	return false, ""
+}
+
+// banMarker returns the reason of a remove-user's ban tag, and whether it
+// has one.
+func banMarker(event *nostr.Event) (reason string, ok bool) {
+	for _, tag := range event.Tags {
+		if len(tag) >= 1 && tag[0] == "ban" {
+			if len(tag) >= 2 {
+				reason = tag[1]
+			}
+			return reason, true
+		}
+	}
+	return "", false
+}
+
+// hasUnbanMarker reports a remove-user that lifts bans.
+func hasUnbanMarker(event *nostr.Event) bool {
+	for _, tag := range event.Tags {
+		if len(tag) >= 1 && tag[0] == "unban" {
+			return true
+		}
+	}
+	return false
+}
+
+func banFromGroup(ctx context.Context, tx *sql.Tx, groupId, pubkey, reason, by string) error {
+	if pubkey == communityOf(ctx).admin() {
+		return nil
+	}
+	log.Printf("[NIP-29] Banning %s from group %s (by %s)", pubkey, groupId, by)
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO group_bans (group_id, pubkey, reason, banned_by)
+		VALUES ($1, $2, NULLIF($3, ''), $4)
+		ON CONFLICT (group_id, pubkey) DO UPDATE SET reason = EXCLUDED.reason, banned_by = $4, banned_at = NOW()
+	`, groupId, pubkey, reason, by)
+	return err
+}
+
+func unbanFromGroup(ctx context.Context, tx *sql.Tx, groupId, pubkey string) error {
+	res, err := tx.ExecContext(ctx, "DELETE FROM group_bans WHERE group_id = $1 AND pubkey = $2", groupId, pubkey)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("[NIP-29] Lifted ban of %s from group %s", pubkey, groupId)
+	}
+	return nil
+}
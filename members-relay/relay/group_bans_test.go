@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestBanMarkers(t *testing.T) {
+	if reason, ok := banMarker(&nostr.Event{Tags: nostr.Tags{{"h", "g"}, {"p", "x"}, {"ban", "spam"}}}); !ok || reason != "spam" {
+		t.Errorf("ban with a reason: %q %v", reason, ok)
+	}
+	if reason, ok := banMarker(&nostr.Event{Tags: nostr.Tags{{"h", "g"}, {"ban"}}}); !ok || reason != "" {
+		t.Errorf("bare ban: %q %v", reason, ok)
+	}
+	if _, ok := banMarker(&nostr.Event{Tags: nostr.Tags{{"h", "g"}, {"p", "x"}}}); ok {
+		t.Error("plain removal read as a ban")
+	}
+	if !hasUnbanMarker(&nostr.Event{Tags: nostr.Tags{{"h", "g"}, {"unban"}}}) {
+		t.Error("unban not recognized")
+	}
+}
+
+// Ban, attempt to rejoin, unban, rejoin.
+func TestGroupBanAndUnban(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK, trollSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	troll, _ := nostr.GetPublicKey(trollSK)
+	now := nostr.Now()
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, nostr.Tags{{"h", "club"}}, ""))
+	applyGroupEvent(t, signedEvent(t, adminSK, KindPutGroupStatus, now, nostr.Tags{{"h", "club"}, {"open"}}, ""))
+	join := func(at nostr.Timestamp) *nostr.Event {
+		return signedEvent(t, trollSK, KindJoinRequest, at, nostr.Tags{{"h", "club"}}, "")
+	}
+	member := func() bool { return isGroupMember(ctx, "club", troll) }
+
+	applyGroupEvent(t, join(now))
+	applyGroupEvent(t, signedEvent(t, adminSK, KindRemoveUser, now+1, nostr.Tags{{"h", "club"}, {"p", troll}, {"ban", "spam"}}, ""))
+	if member() {
+		t.Fatal("banned user still a member")
+	}
+
+	chat := signedEvent(t, trollSK, KindGroupChat, now+2, nostr.Tags{{"h", "club"}}, "back again")
+	for _, evt := range []*nostr.Event{join(now + 2), chat} {
+		if reject, msg := rejectGroupBanned(ctx, evt, troll); !reject || msg != "restricted: you are banned from this group" {
+			t.Fatalf("kind %d from a banned user: %v %q", evt.Kind, reject, msg)
+		}
+	}
+	if reject, _ := rejectGroupBanned(ctx, signedEvent(t, trollSK, KindGroupChat, now+2, nostr.Tags{{"h", "other"}}, ""), troll); reject {
+		t.Fatal("ban applied to another group")
+	}
+	if err := storeGroupEvent(ctx, join(now+2)); !errors.Is(err, errGroupBanned) || member() {
+		t.Fatalf("banned user's join request: %v", err)
+	}
+
+	applyGroupEvent(t, signedEvent(t, adminSK, KindRemoveUser, now+3, nostr.Tags{{"h", "club"}, {"p", troll}, {"unban"}}, ""))
+	if reject, msg := rejectGroupBanned(ctx, join(now+4), troll); reject {
+		t.Fatalf("unbanned user refused: %s", msg)
+	}
+	if member() {
+		t.Fatal("unban added the user")
+	}
+	applyGroupEvent(t, join(now+4))
+	if !member() {
+		t.Fatal("unbanned user could not rejoin")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// GROUP CAPACITY
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// A group can cap its size, for cohort classes with a fixed number of
+// seats. Its max_members (0 for no cap) is set with a ["max_members", "<n>"]
+// tag on a kind 9002 or through POST /admin/groups/max-members. A join
+// request or put-user that would take the group past it is refused with
+// "restricted: group is full" and nothing of it is applied. The check runs
+// in the side effects, under the group lock, so two joins racing for the
+// last seat cannot both get it. Events from the community's relay admin
+// may go past the cap. A capped group's 39000 carries max_members and the
+// seats left (["remaining_capacity", "<n>"]).
+
+// errGroupFull is the side effects' answer for members a group has no room
+// for; nothing is stored.
+var errGroupFull = errors.New("group is full")
+
+// maxMembersTag parses the max_members tag of a kind 9002. ok is false when
+// there is none.
+func maxMembersTag(tags nostr.Tags) (n int, ok bool, err error) {
+	for _, tag := range tags {
+		if len(tag) < 2 || tag[0] != "max_members" {
+			continue
+		}
+		n, err := strconv.Atoi(tag[1])
+		if err != nil || n < 0 {
+			return 0, true, fmt.Errorf("malformed max_members %q", tag[1])
+		}
+		return n, true, nil
+	}
+	return 0, false, nil
+}
+
+// rejectMaxMembers checks the max_members tag of a kind 9002, if any.
+func rejectMaxMembers(ctx context.Context, event *nostr.Event) (bool, string) {
+	if _, ok, err := maxMembersTag(event.Tags); ok && err != nil {
+		return true, say(ctx, msgMaxMembersMalformed)
+	}
+	return false, ""
+}
+
+// checkGroupCapacity refuses adding pubkeys to groupId, as part of tx
+// holding the group's lock, when the group has fewer seats left than
+// pubkeys who are not members yet. Changes by the relay admin are exempt.
+func checkGroupCapacity(ctx context.Context, tx *sql.Tx, groupId, by string, pubkeys []string) error {
+	if len(pubkeys) == 0 || by == communityOf(ctx).admin() {
+		return nil
+	}
+	var limit, members, joining int
+	err := tx.QueryRowContext(ctx, `
+		SELECT g.max_members,
+			(SELECT COUNT(*) FROM group_members WHERE group_id = g.id),
+			(SELECT COUNT(DISTINCT p) FROM unnest($2::text[]) AS p
+				WHERE NOT EXISTS (SELECT 1 FROM group_members WHERE group_id = g.id AND pubkey = p))
+		FROM groups g WHERE g.id = $1
+	`, groupId, pq.Array(pubkeys)).Scan(&limit, &members, &joining)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("check group capacity: %w", err)
+	}
+	if limit > 0 && joining > 0 && members+joining > limit {
+		log.Printf("[NIP-29] Group %s is full (%d/%d), not adding %d", groupId, members, limit, joining)
+		return errGroupFull
+	}
+	return nil
+}
+
+// setMaxMembers stores groupId's cap as part of tx, which must hold the
+// group's lock.
+func setMaxMembers(ctx context.Context, tx *sql.Tx, groupId string, limit int) error {
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE groups SET max_members = $1, updated_at = NOW() WHERE id = $2", limit, groupId); err != nil {
+		return err
+	}
+	log.Printf("[NIP-29] Group %s capped at %d members", groupId, limit)
+	return markGroupDirty(ctx, tx, groupId)
+}
+
+// ─── HTTP ──────────────────────────────────────────────────────────────────────
+
+type maxMembersRequest struct {
+	Group      string `json:"group"`
+	MaxMembers int    `json:"max_members"`
+}
+
+// registerCapacityAPI mounts POST /admin/groups/max-members (the
+// community's relay admin, JSON body) on the admin mux.
+func registerCapacityAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/groups/max-members", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		pubkey := nip98Admin(r)
+		var req maxMembersRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil || req.MaxMembers < 0 {
+			httpError(w, r, pubkey, http.StatusBadRequest, msgMalformedJSON)
+			return
+		}
+		if !groupExists(ctx, req.Group) {
+			httpError(w, r, pubkey, http.StatusNotFound, msgGroupNotFound)
+			return
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			writeAPIResult(w, nil, err)
+			return
+		}
+		defer tx.Rollback()
+		if err = lockGroup(ctx, tx, req.Group); err == nil {
+			if err = setMaxMembers(ctx, tx, req.Group, req.MaxMembers); err == nil {
+				err = tx.Commit()
+			}
+		}
+		if err == nil {
+			groupSync.kick()
+		}
+		writeAPIResult(w, map[string]interface{}{"group": req.Group, "max_members": req.MaxMembers}, err)
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMaxMembersTag(t *testing.T) {
+	for _, tc := range []struct {
+		tags    nostr.Tags
+		max     int
+		ok, bad bool
+	}{
+		{nostr.Tags{{"h", "g"}, {"max_members", "25"}}, 25, true, false},
+		{nostr.Tags{{"max_members", "0"}}, 0, true, false},
+		{nostr.Tags{{"max_members", "-1"}}, 0, true, true},
+		{nostr.Tags{{"max_members", "many"}}, 0, true, true},
+		{nostr.Tags{{"h", "g"}}, 0, false, false},
+	} {
+		n, ok, err := maxMembersTag(tc.tags)
+		if n != tc.max || ok != tc.ok || (err != nil) != tc.bad {
+			t.Errorf("%v: %d %v %v", tc.tags, n, ok, err)
+		}
+	}
+}
+
+// Two joins racing for the last seat: one gets it, the other is told the
+// group is full. Put-user is held to the cap too, except from the relay
+// admin, and 39000 shows the seats left.
+func TestGroupCapacity(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	ownerSK, relayAdminSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	relayAdmin, _ := nostr.GetPublicKey(relayAdminSK)
+	prev := adminPubkey
+	adminPubkey = relayAdmin
+	t.Cleanup(func() { adminPubkey = prev })
+	keys := pubkeys(2)
+	for _, pk := range keys {
+		addTestMember(t, pk)
+	}
+	now := nostr.Now()
+	h := nostr.Tags{{"h", "class"}}
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindCreateGroup, now, h, ""))
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindPutGroupStatus, now, nostr.Tags{{"h", "class"}, {"open"}}, ""))
+	capped := signedEvent(t, ownerSK, KindEditMetadata, now, nostr.Tags{{"h", "class"}, {"max_members", "2"}}, "")
+	if reject, msg := rejectMaxMembers(ctx, capped); reject {
+		t.Fatalf("cap refused: %s", msg)
+	}
+	applyGroupEvent(t, capped)
+
+	// The owner holds one of the two seats
+	joins := []*nostr.Event{
+		signedEvent(t, nostr.GeneratePrivateKey(), KindJoinRequest, now, h, ""),
+		signedEvent(t, nostr.GeneratePrivateKey(), KindJoinRequest, now, h, ""),
+	}
+	errs := make([]error, len(joins))
+	var wg sync.WaitGroup
+	for i, join := range joins {
+		wg.Add(1)
+		go func(i int, join *nostr.Event) {
+			defer wg.Done()
+			errs[i] = storeEvent(ctx, join)
+		}(i, join)
+	}
+	wg.Wait()
+	var joined int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			joined++
+		case err.Error() != "restricted: group is full":
+			t.Fatalf("losing join: %v", err)
+		}
+	}
+	if joined != 1 {
+		t.Fatalf("%d joins took the last seat: %v", joined, errs)
+	}
+
+	put := signedEvent(t, ownerSK, KindPutUser, now+1, nostr.Tags{{"h", "class"}, {"p", keys[0]}}, "")
+	if err := storeGroupEvent(ctx, put); !errors.Is(err, errGroupFull) {
+		t.Fatalf("put-user into a full group: %v", err)
+	}
+	applyGroupEvent(t, signedEvent(t, relayAdminSK, KindPutUser, now+1, nostr.Tags{{"h", "class"}, {"p", keys[1]}}, ""))
+	if !isGroupMember(ctx, "class", keys[1]) || isGroupMember(ctx, "class", keys[0]) {
+		t.Fatal("the relay admin's put-user was held to the cap")
+	}
+
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := currentRelayEvent(ctx, KindGroupMetadata, "class")
+	if err != nil || metadata == nil ||
+		metadata.Tags.GetFirst([]string{"max_members", "2"}) == nil ||
+		metadata.Tags.GetFirst([]string{"remaining_capacity", "0"}) == nil {
+		t.Fatalf("39000 of a full group: %v %v", metadata, err)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// GROUP IDS
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// A group id ends up in URLs, d tags, log lines and admin tooling, so a new
+// group's id must be 3 to 64 characters of a-z, 0-9, - and _. The policy
+// refuses a create-group (kind 9007) with any other id, and so does
+// RELAY_DEFAULT_GROUPS at startup. Groups created before the check keep
+// their ids and work as before; a management event naming an id that fails
+// the check and belongs to no group has no side effects.
+
+var groupIDPattern = regexp.MustCompile(`^[a-z0-9_-]{3,64}$`)
+
+// errGroupIDInvalid is the side effects' answer for an event naming a
+// malformed id that is no existing group's; nothing is stored.
+var errGroupIDInvalid = errors.New("invalid group id")
+
+// validGroupID reports whether id may name a new group.
+func validGroupID(id string) bool {
+	return groupIDPattern.MatchString(id)
+}
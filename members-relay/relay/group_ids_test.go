@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestValidGroupID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"kitchen":                true,
+		"bread-club_2024":        true,
+		strings.Repeat("a", 64):  true,
+		"":                       false,
+		"ab":                     false,
+		"🍞🍞🍞":                    false,
+		strings.Repeat("a", 200): false,
+		"bread/club":             false,
+		`bread"club`:             false,
+		"bread club":             false,
+		"Kitchen":                false,
+	} {
+		if got := validGroupID(id); got != want {
+			t.Errorf("%q: valid %v, want %v", id, got, want)
+		}
+	}
+}
+
+// The relay admin cannot create a group with an emoji, empty or 200-char
+// id, and a create-group that skips the policy creates nothing either.
+func TestCreateGroupIDValidation(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK := nostr.GeneratePrivateKey()
+	prev := adminPubkey
+	adminPubkey, _ = nostr.GetPublicKey(adminSK)
+	t.Cleanup(func() { adminPubkey = prev })
+	as := context.WithValue(ctx, nip98ViewerKey{}, adminPubkey)
+	create := func(id string) *nostr.Event {
+		return signedEvent(t, adminSK, KindCreateGroup, nostr.Now(), nostr.Tags{{"h", id}}, "")
+	}
+
+	for _, id := range []string{"🍞🍞🍞", "", strings.Repeat("a", 200)} {
+		if reject, msg := rejectEventPolicy(as, create(id)); !reject || !strings.HasPrefix(msg, "invalid:") {
+			t.Errorf("%q: %v %q", id, reject, msg)
+		}
+	}
+	if _, msg := rejectEventPolicy(as, create("🍞🍞🍞")); msg != "invalid: group id must be 3-64 chars of a-z, 0-9, - and _" {
+		t.Errorf("emoji id: %q", msg)
+	}
+	if reject, msg := rejectEventPolicy(as, create("bread-club")); reject {
+		t.Fatalf("valid id: %s", msg)
+	}
+
+	if err := storeGroupEvent(ctx, create("bread club")); !errors.Is(err, errGroupIDInvalid) {
+		t.Fatalf("create-group past the policy: %v", err)
+	}
+	if groupIdTaken(ctx, "bread club") {
+		t.Fatal("group created with a malformed id")
+	}
+}
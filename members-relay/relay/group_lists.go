@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// GROUP LISTS (NIP-51 kind 10009)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Clients such as Chachi and 0xchat keep the groups a user is in as a kind
+// 10009 list of ["group", "<id>", "<relay url>"] tags, and bootstrap their
+// group list from it. The relay does not write these lists: they are the
+// member's own replaceable events, which it cannot sign for them. Members
+// store and update theirs like any replaceable event, and a client asking
+// for the lists of known pubkeys is served by the isLatestLookup fast path.
+//
+// A member who leaves every group of the community, by leaving, being
+// removed, lapsing (see LAPSED MEMBERS) or through the group's deletion,
+// would keep handing clients a list of groups they are no longer in. When
+// that list names nothing but this relay's groups it is deleted along with
+// the last membership; a list that also names groups elsewhere is the
+// member's to edit and is left alone.
+
+// KindSimpleGroups is the NIP-51 list of groups a user is in.
+const KindSimpleGroups = 10009
+
+// localGroupList reports whether list names only groups of this relay:
+// group tags with no relay URL or community's own.
+func localGroupList(list *nostr.Event, community string) bool {
+	url := authURL(community)
+	for _, tag := range list.Tags {
+		if len(tag) < 2 || tag[0] != "group" {
+			continue
+		}
+		if len(tag) >= 3 && tag[2] != "" && (url == "" || !sameRelayURL(tag[2], url)) {
+			return false
+		}
+	}
+	return true
+}
+
+// dropGroupLists deletes, as part of tx, the stored group lists of those
+// of pubkeys who are in none of the community's groups any more and whose
+// lists name only this relay's groups.
+func dropGroupLists(ctx context.Context, tx *sql.Tx, pubkeys []string) error {
+	if len(pubkeys) == 0 {
+		return nil
+	}
+	community := communityOf(ctx).id()
+	rows, err := tx.QueryContext(ctx, `
+		SELECT e.raw FROM events e
+		WHERE e.kind = $1 AND e.pubkey = ANY($2::text[]) AND e.community = $3
+		AND NOT EXISTS (
+			SELECT 1 FROM group_members gm JOIN groups g ON g.id = gm.group_id
+			WHERE gm.pubkey = e.pubkey AND g.community = $3)
+	`, KindSimpleGroups, pq.Array(pubkeys), community)
+	if err != nil {
+		return fmt.Errorf("find group lists: %w", err)
+	}
+	var stale []*nostr.Event
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			rows.Close()
+			return err
+		}
+		var list nostr.Event
+		if err := json.Unmarshal(raw, &list); err != nil {
+			rows.Close()
+			return err
+		}
+		if localGroupList(&list, community) {
+			stale = append(stale, &list)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, list := range stale {
+		log.Printf("[NIP-29] Deleting group list of %s, who is in no group any more", list.PubKey)
+		if err := removeEventTx(ctx, tx, list); err != nil {
+			return fmt.Errorf("delete group list: %w", err)
+		}
+	}
+	return nil
+}
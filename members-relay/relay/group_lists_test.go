@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestLocalGroupList(t *testing.T) {
+	prev := authCfg
+	authCfg.URL = "wss://members.zap.cooking"
+	t.Cleanup(func() { authCfg = prev })
+	for _, tc := range []struct {
+		tags nostr.Tags
+		want bool
+	}{
+		{nostr.Tags{{"group", "kitchen", "wss://members.zap.cooking/"}, {"group", "bakers"}}, true},
+		{nostr.Tags{{"group", "kitchen", "wss://members.zap.cooking"}, {"group", "chat", "wss://groups.0xchat.com"}}, false},
+		{nostr.Tags{{"r", "wss://groups.0xchat.com"}}, true},
+	} {
+		if got := localGroupList(&nostr.Event{Kind: KindSimpleGroups, Tags: tc.tags}, defaultCommunityID); got != tc.want {
+			t.Errorf("%v: local %v, want %v", tc.tags, got, tc.want)
+		}
+	}
+}
+
+// A member's own 10009 is served as they stored it and goes when they
+// leave their last group here; one naming another relay's group stays.
+func TestDropGroupLists(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	prev := authCfg
+	authCfg.URL = "wss://members.zap.cooking"
+	t.Cleanup(func() { authCfg = prev })
+	ownerSK, cookSK, travellerSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	cook, _ := nostr.GetPublicKey(cookSK)
+	traveller, _ := nostr.GetPublicKey(travellerSK)
+	for _, sk := range []string{ownerSK, cookSK, travellerSK} {
+		pk, _ := nostr.GetPublicKey(sk)
+		addTestMember(t, pk)
+	}
+	now := nostr.Now()
+	for _, id := range []string{"kitchen", "bakers"} {
+		h := nostr.Tags{{"h", id}}
+		applyGroupEvent(t, signedEvent(t, ownerSK, KindCreateGroup, now, h, ""))
+		applyGroupEvent(t, signedEvent(t, ownerSK, KindPutGroupStatus, now, nostr.Tags{{"h", id}, {"open"}}, ""))
+		applyGroupEvent(t, signedEvent(t, cookSK, KindJoinRequest, now, h, ""))
+	}
+	applyGroupEvent(t, signedEvent(t, travellerSK, KindJoinRequest, now, nostr.Tags{{"h", "kitchen"}}, ""))
+	cookList := signedEvent(t, cookSK, KindSimpleGroups, now, nostr.Tags{
+		{"group", "kitchen", "wss://members.zap.cooking"}, {"group", "bakers", "wss://members.zap.cooking"}}, "")
+	travellerList := signedEvent(t, travellerSK, KindSimpleGroups, now, nostr.Tags{
+		{"group", "kitchen", "wss://members.zap.cooking"}, {"group", "chat", "wss://groups.0xchat.com"}}, "")
+	for _, list := range []*nostr.Event{cookList, travellerList} {
+		if err := persistEvent(ctx, list); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := func(list *nostr.Event) bool {
+		t.Helper()
+		found, err := storedEvent(ctx, list.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found != nil
+	}
+
+	applyGroupEvent(t, signedEvent(t, cookSK, KindLeaveRequest, now+1, nostr.Tags{{"h", "kitchen"}}, ""))
+	if !stored(cookList) {
+		t.Fatal("list dropped while still in bakers")
+	}
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindRemoveUser, now+1, nostr.Tags{{"h", "bakers"}, {"p", cook}}, ""))
+	if stored(cookList) {
+		t.Fatal("list kept after leaving every group")
+	}
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindDeleteGroup, now+2, nostr.Tags{{"h", "kitchen"}}, ""))
+	if !stored(travellerList) || isGroupMember(ctx, "kitchen", traveller) {
+		t.Fatal("list naming another relay's group dropped")
+	}
+}
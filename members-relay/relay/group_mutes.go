@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// GROUP MUTES
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// A group moderator mutes members for a while with a mute-user (kind 9004)
+// carrying p tags and a ["duration", <minutes>] tag. Until the mute runs out
+// (the event's created_at plus the duration) the members stay in the group
+// and can read it, but their chat messages there are refused with
+// "restricted: muted until <time>". Mutes are checked against the clock when
+// a message arrives, so nothing has to sweep them; a later mute-user with
+// duration 0 lifts them early. The community admin cannot be muted.
+//
+// GET /api/groups/mutes?group=<id> lists a group's current mutes for its
+// moderators (NIP-98).
+
+// muteDuration returns a mute-user's duration tag.
+func muteDuration(event *nostr.Event) (time.Duration, error) {
+	tag := event.Tags.GetFirst([]string{"duration", ""})
+	if tag == nil {
+		return 0, fmt.Errorf("no duration tag")
+	}
+	minutes, err := strconv.Atoi((*tag)[1])
+	if err != nil || minutes < 0 {
+		return 0, fmt.Errorf("duration %q is not a number of minutes", (*tag)[1])
+	}
+	return time.Duration(minutes) * time.Minute, nil
+}
+
+// rejectMute checks a mute-user from a group moderator.
+func rejectMute(ctx context.Context, event *nostr.Event) (bool, string) {
+	if _, err := muteDuration(event); err != nil || event.Tags.GetFirst([]string{"p", ""}) == nil {
+		return true, say(ctx, msgMuteTags)
+	}
+	return false, ""
+}
+
+// mutedUntil returns when pubkey's mute in groupId runs out, or the zero
+// time if they are not muted.
+func mutedUntil(ctx context.Context, groupId, pubkey string) (time.Time, error) {
+	var until int64
+	err := db.QueryRowContext(ctx, `
+		SELECT muted_until FROM group_mutes
+		WHERE group_id = $1 AND pubkey = $2 AND muted_until > EXTRACT(EPOCH FROM NOW())::bigint
+	`, groupId, pubkey).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(until, 0).UTC(), nil
+}
+
+// rejectGroupMuted refuses chat from a member muted in the event's group.
+func rejectGroupMuted(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	groupId := getHTag(event)
+	until, err := mutedUntil(ctx, groupId, pubkey)
+	if err != nil {
+		log.Printf("[NIP-29] Error checking mutes of group %s for %s: %v", groupId, pubkey, err)
+		return true, say(ctx, msgMuteCheckFailed)
+	}
+	if !until.IsZero() {
+		return true, say(ctx, msgMuted, until.Format(time.RFC3339))
+	}
+	return false, ""
+}
+
+func handleMuteUser(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	groupId := getHTag(event)
+	duration, err := muteDuration(event)
+	if groupId == "" || err != nil {
+		return nil
+	}
+	until := event.CreatedAt.Time().Add(duration).Unix()
+	admin := communityOf(ctx).admin()
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "p" || tag[1] == admin {
+			continue
+		}
+		pubkey := tag[1]
+		if duration == 0 {
+			log.Printf("[NIP-29] Unmuting %s in group %s (by %s)", pubkey, groupId, event.PubKey)
+			if _, err := tx.ExecContext(ctx,
+				"DELETE FROM group_mutes WHERE group_id = $1 AND pubkey = $2", groupId, pubkey); err != nil {
+				return fmt.Errorf("unmute: %w", err)
+			}
+			continue
+		}
+		log.Printf("[NIP-29] Muting %s in group %s for %s (by %s)", pubkey, groupId, duration, event.PubKey)
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO group_mutes (group_id, pubkey, muted_until, muted_by)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (group_id, pubkey) DO UPDATE SET muted_until = $3, muted_by = $4
+		`, groupId, pubkey, until, event.PubKey); err != nil {
+			return fmt.Errorf("mute: %w", err)
+		}
+	}
+	return nil
+}
+
+type groupMute struct {
+	Pubkey     string    `json:"pubkey"`
+	MutedUntil time.Time `json:"muted_until"`
+	MutedBy    string    `json:"muted_by"`
+}
+
+// groupMutes returns groupId's current mutes, soonest to end first.
+func groupMutes(ctx context.Context, groupId string) ([]groupMute, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT pubkey, muted_until, muted_by FROM group_mutes
+		WHERE group_id = $1 AND muted_until > EXTRACT(EPOCH FROM NOW())::bigint
+		ORDER BY muted_until
+	`, groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	mutes := []groupMute{}
+	for rows.Next() {
+		var m groupMute
+		var until int64
+		if err := rows.Scan(&m.Pubkey, &until, &m.MutedBy); err != nil {
+			return nil, err
+		}
+		m.MutedUntil = time.Unix(until, 0).UTC()
+		mutes = append(mutes, m)
+	}
+	return mutes, rows.Err()
+}
+
+// registerMuteAPI mounts GET /api/groups/mutes?group=<id> (NIP-98,
+// roles of the group that may mute).
+func registerMuteAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/api/groups/mutes", memberAPI(func(w http.ResponseWriter, r *http.Request, pubkey string) {
+		groupId := r.URL.Query().Get("group")
+		if !hasGroupCapability(r.Context(), groupId, pubkey, capMuteUser) {
+			httpError(w, r, pubkey, http.StatusForbidden, msgModeratorRequired)
+			return
+		}
+		mutes, err := groupMutes(r.Context(), groupId)
+		writeAPIResult(w, map[string]interface{}{"mutes": mutes}, err)
+	}))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMuteDuration(t *testing.T) {
+	for _, tc := range []struct {
+		tags nostr.Tags
+		want time.Duration
+		ok   bool
+	}{
+		{nostr.Tags{{"duration", "30"}}, 30 * time.Minute, true},
+		{nostr.Tags{{"duration", "0"}}, 0, true},
+		{nostr.Tags{{"duration", "-5"}}, 0, false},
+		{nostr.Tags{{"duration", "1h"}}, 0, false},
+		{nil, 0, false},
+	} {
+		got, err := muteDuration(&nostr.Event{Tags: tc.tags})
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("%v: %s, %v", tc.tags, got, err)
+		}
+	}
+}
+
+// Mute, chat refused, mute listed, lifted early, chat again; a mute whose
+// time is up is not enforced.
+func TestGroupMutes(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK, chattySK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	chatty, _ := nostr.GetPublicKey(chattySK)
+	admin, _ := nostr.GetPublicKey(adminSK)
+	addTestMember(t, admin)
+	now := nostr.Now()
+	for _, g := range []string{"club", "other"} {
+		applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, nostr.Tags{{"h", g}}, ""))
+	}
+	mute := func(at nostr.Timestamp, minutes string) {
+		applyGroupEvent(t, signedEvent(t, adminSK, KindMuteUser, at, nostr.Tags{{"h", "club"}, {"p", chatty}, {"duration", minutes}}, ""))
+	}
+	chat := func(groupId string) (bool, string) {
+		return rejectGroupMuted(ctx, signedEvent(t, chattySK, KindGroupChat, nostr.Now(), nostr.Tags{{"h", groupId}}, "one more thing"), chatty)
+	}
+
+	mute(now, "30")
+	want := "restricted: muted until " + now.Time().Add(30*time.Minute).UTC().Format(time.RFC3339)
+	if reject, msg := chat("club"); !reject || msg != want {
+		t.Fatalf("muted member's chat: %v %q, want %q", reject, msg, want)
+	}
+	if reject, msg := chat("other"); reject {
+		t.Fatalf("mute applied to another group: %s", msg)
+	}
+
+	mux := http.NewServeMux()
+	registerMuteAPI(mux)
+	r := httptest.NewRequest("GET", "/api/groups/mutes?group=club", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "members.zap.cooking")
+	r.Header.Set("Authorization", nip98Header(t, adminSK, "https://members.zap.cooking/api/groups/mutes?group=club", "GET", nostr.Now()))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	var body struct{ Mutes []groupMute }
+	if err := json.Unmarshal(w.Body.Bytes(), &body); w.Code != http.StatusOK || err != nil ||
+		len(body.Mutes) != 1 || body.Mutes[0].Pubkey != chatty {
+		t.Fatalf("mute list: %d %s", w.Code, w.Body)
+	}
+
+	mute(now+1, "0")
+	if reject, msg := chat("club"); reject {
+		t.Fatalf("lifted mute still enforced: %s", msg)
+	}
+
+	mute(now-3600, "10")
+	if reject, msg := chat("club"); reject {
+		t.Fatalf("expired mute enforced: %s", msg)
+	}
+}
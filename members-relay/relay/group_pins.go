@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// PINNED MESSAGES
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Group admins pin events, such as the weekly challenge, with a pin-event
+// (kind 9003) naming them in e tags, and unpin them with a pin-event that
+// also carries an ["unpin"] tag. Only events of the group can be pinned
+// (see inGroup), and at most RELAY_MAX_GROUP_PINS at once. The relay
+// publishes the group's pins, oldest first, as a relay-signed kind 39004
+// with d = group id, regenerated by the group sync worker like the rest of
+// the group's metadata. A pinned event that is deleted drops out of the
+// list at the next regeneration.
+
+// maxGroupPins is how many events a group can have pinned.
+var maxGroupPins int
+
+func loadPinConfig() {
+	maxGroupPins = envInt("RELAY_MAX_GROUP_PINS", 5)
+}
+
+// pinTargets returns the distinct event ids a pin-event names.
+func pinTargets(event *nostr.Event) []string {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "e" && tag[1] != "" && !seen[tag[1]] {
+			seen[tag[1]] = true
+			ids = append(ids, tag[1])
+		}
+	}
+	return ids
+}
+
+// hasUnpinMarker reports a pin-event that unpins.
+func hasUnpinMarker(event *nostr.Event) bool {
+	return event.Tags.GetFirst([]string{"unpin"}) != nil
+}
+
+// rejectPin checks a pin-event from a group admin of groupId.
+func rejectPin(ctx context.Context, event *nostr.Event, groupId string) (bool, string) {
+	ids := pinTargets(event)
+	if len(ids) == 0 {
+		return true, say(ctx, msgPinTags)
+	}
+	if hasUnpinMarker(event) {
+		return false, ""
+	}
+	for _, id := range ids {
+		target, err := storedEvent(ctx, id)
+		if err != nil {
+			log.Printf("[NIP-29] Error looking up pin target %s: %v", id, err)
+			return true, say(ctx, msgEventLookupFailed)
+		}
+		if target == nil {
+			return true, say(ctx, msgEventNotFound)
+		}
+		if !inGroup(target, groupId) {
+			return true, say(ctx, msgEventNotInGroup, id)
+		}
+	}
+	var others int
+	if err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM group_pins WHERE group_id = $1 AND NOT event_id = ANY($2)",
+		groupId, pq.Array(ids)).Scan(&others); err != nil {
+		log.Printf("[NIP-29] Error counting pins of group %s: %v", groupId, err)
+		return true, say(ctx, msgEventLookupFailed)
+	}
+	if others+len(ids) > maxGroupPins {
+		return true, say(ctx, msgPinLimit, maxGroupPins)
+	}
+	return false, ""
+}
+
+func handlePinEvents(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	groupId := getHTag(event)
+	ids := pinTargets(event)
+	if groupId == "" || len(ids) == 0 {
+		return nil
+	}
+	if hasUnpinMarker(event) {
+		log.Printf("[NIP-29] Unpinning %d event(s) in group %s (by %s)", len(ids), groupId, event.PubKey)
+		if _, err := tx.ExecContext(ctx,
+			"DELETE FROM group_pins WHERE group_id = $1 AND event_id = ANY($2)",
+			groupId, pq.Array(ids)); err != nil {
+			return fmt.Errorf("unpin: %w", err)
+		}
+		return markGroupDirty(ctx, tx, groupId)
+	}
+
+	log.Printf("[NIP-29] Pinning %d event(s) in group %s (by %s)", len(ids), groupId, event.PubKey)
+	// The policy checked the limit; under the group lock, pins that raced
+	// past it are dropped here
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO group_pins (group_id, event_id, pinned_by)
+		SELECT $1, t.id, $3 FROM unnest($2::text[]) AS t(id)
+		WHERE EXISTS (SELECT 1 FROM events e WHERE e.id = t.id)
+		ON CONFLICT (group_id, event_id) DO NOTHING
+	`, groupId, pq.Array(ids), event.PubKey); err != nil {
+		return fmt.Errorf("pin: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM group_pins WHERE group_id = $1 AND event_id IN (
+			SELECT event_id FROM group_pins WHERE group_id = $1
+			ORDER BY pinned_at, event_id OFFSET $2)
+	`, groupId, maxGroupPins); err != nil {
+		return fmt.Errorf("trim pins: %w", err)
+	}
+	return markGroupDirty(ctx, tx, groupId)
+}
+
+// generateGroupPins publishes groupId's pinned events (kind 39004).
+func generateGroupPins(ctx context.Context, tx *sql.Tx, groupId string) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT event_id FROM group_pins
+		WHERE group_id = $1
+		ORDER BY pinned_at, event_id
+	`, groupId)
+	if err != nil {
+		return fmt.Errorf("fetch group pins: %w", err)
+	}
+	defer rows.Close()
+
+	tags := nostr.Tags{
+		{"d", groupId},
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		tags = append(tags, nostr.Tag{"e", id})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	event := nostr.Event{
+		Kind:    KindGroupPins,
+		Content: "",
+		Tags:    tags,
+	}
+
+	if err := signRelayEvent(&event); err != nil {
+		return fmt.Errorf("sign group pins: %w", err)
+	}
+	return persistEventTx(ctx, tx, &event)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPinTargets(t *testing.T) {
+	a, b := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	event := &nostr.Event{Tags: nostr.Tags{{"h", "club"}, {"e", a}, {"e", b}, {"e", a}, {"unpin"}}}
+	if got := pinTargets(event); !reflect.DeepEqual(got, []string{a, b}) {
+		t.Errorf("targets %v", got)
+	}
+	if !hasUnpinMarker(event) || hasUnpinMarker(&nostr.Event{Tags: nostr.Tags{{"e", a}}}) {
+		t.Error("unpin marker misread")
+	}
+}
+
+// Pin up to the limit, refuse foreign and unknown events, unpin to make
+// room; 39004 follows.
+func TestGroupPins(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	prev := maxGroupPins
+	maxGroupPins = 2
+	t.Cleanup(func() { maxGroupPins = prev })
+	ctx := context.Background()
+	adminSK, memberSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	for _, g := range []string{"club", "other"} {
+		applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, nostr.Tags{{"h", g}}, ""))
+	}
+	var challenges []*nostr.Event
+	for _, week := range []string{"brioche", "bagels", "babka"} {
+		challenges = append(challenges, signedEvent(t, adminSK, KindGroupChat, now, nostr.Tags{{"h", "club"}}, "This week: "+week))
+	}
+	foreign := signedEvent(t, memberSK, KindGroupChat, now, nostr.Tags{{"h", "other"}}, "hello")
+	for _, evt := range append(challenges, foreign) {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pin := func(at nostr.Timestamp, extra nostr.Tags, targets ...*nostr.Event) *nostr.Event {
+		tags := append(nostr.Tags{{"h", "club"}}, extra...)
+		for _, target := range targets {
+			tags = append(tags, nostr.Tag{"e", target.ID})
+		}
+		return signedEvent(t, adminSK, KindPinEvents, at, tags, "")
+	}
+	pinned := func() []string {
+		t.Helper()
+		if err := syncGroups(ctx); err != nil {
+			t.Fatal(err)
+		}
+		event, err := currentRelayEvent(ctx, KindGroupPins, "club")
+		if err != nil || event == nil {
+			t.Fatalf("39004: %v %v", event, err)
+		}
+		var ids []string
+		for _, tag := range event.Tags {
+			if tag[0] == "e" {
+				ids = append(ids, tag[1])
+			}
+		}
+		return ids
+	}
+
+	if reject, msg := rejectPin(ctx, pin(now, nil, foreign), "club"); !reject || !strings.Contains(msg, foreign.ID) {
+		t.Fatalf("pin of another group's message: %v %q", reject, msg)
+	}
+	unknown := &nostr.Event{ID: strings.Repeat("0", 64)}
+	if reject, msg := rejectPin(ctx, pin(now, nil, unknown), "club"); !reject || msg != "invalid: event not found" {
+		t.Fatalf("pin of an unknown event: %v %q", reject, msg)
+	}
+
+	first := pin(now, nil, challenges[0], challenges[1])
+	if reject, msg := rejectPin(ctx, first, "club"); reject {
+		t.Fatalf("pin refused: %s", msg)
+	}
+	applyGroupEvent(t, first)
+	if got := pinned(); len(got) != 2 {
+		t.Fatalf("pinned %v", got)
+	}
+	if reject, msg := rejectPin(ctx, pin(now+1, nil, challenges[2]), "club"); !reject || msg != "restricted: a group can pin at most 2 events" {
+		t.Fatalf("pin past the limit: %v %q", reject, msg)
+	}
+	if reject, msg := rejectPin(ctx, pin(now+1, nil, challenges[1]), "club"); reject {
+		t.Fatalf("pinning a pinned event again: %s", msg)
+	}
+
+	applyGroupEvent(t, pin(now+1, nostr.Tags{{"unpin"}}, challenges[0]))
+	if got := pinned(); len(got) != 1 || got[0] != challenges[1].ID {
+		t.Fatalf("after unpinning: %v", got)
+	}
+	third := pin(now+2, nil, challenges[2])
+	if reject, msg := rejectPin(ctx, third, "club"); reject {
+		t.Fatalf("pin after unpinning refused: %s", msg)
+	}
+	applyGroupEvent(t, third)
+	if got := pinned(); len(got) != 2 || got[1] != challenges[2].ID {
+		t.Fatalf("after pinning again: %v", got)
+	}
+
+	applyGroupEvent(t, signedEvent(t, adminSK, KindDeleteGroup, now+3, nostr.Tags{{"h", "club"}}, ""))
+	if event, _ := currentRelayEvent(ctx, KindGroupPins, "club"); event != nil {
+		t.Fatal("39004 left behind by the group's deletion")
+	}
+}
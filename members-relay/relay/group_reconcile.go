@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// GROUP RECONCILIATION
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// The group tables are the truth and 39000 through 39002 are published from
+// them (see GROUP SYNC), but a crash mid-side-effect or a fix made by hand
+// in SQL can leave the two apart without marking the group dirty, and
+// clients trust the events. Every RELAY_GROUP_RECONCILE_INTERVAL (default
+// 15m, 0 turns it off) the reconciler compares each clean group's current
+// 39000, 39001 and 39002 with group_members and marks the groups that
+// drifted, including those with no 39000 at all, dirty for the sync worker,
+// logging each one. After database surgery the community's relay admin can
+// run a pass at once with POST /admin/groups/reconcile, which answers with
+// the groups it regenerated.
+
+// groupReconcileInterval is how often the reconciler runs; 0 turns it off.
+var groupReconcileInterval time.Duration
+
+func loadGroupReconcileConfig() {
+	groupReconcileInterval = envDuration("RELAY_GROUP_RECONCILE_INTERVAL", 15*time.Minute)
+}
+
+// taggedMembers maps the p tags of a 39001 or 39002 to their role ("" when
+// none is given).
+func taggedMembers(tags nostr.Tags) map[string]string {
+	members := make(map[string]string)
+	for _, tag := range tags {
+		if len(tag) < 2 || tag[0] != "p" {
+			continue
+		}
+		role := ""
+		if len(tag) >= 3 {
+			role = tag[2]
+		}
+		members[tag[1]] = role
+	}
+	return members
+}
+
+// groupDrift lists how groupId's published metadata differs from its
+// group_members rows; nil when they agree.
+func groupDrift(ctx context.Context, tx *sql.Tx, groupId string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT pubkey, role FROM group_members WHERE group_id = $1", groupId)
+	if err != nil {
+		return nil, err
+	}
+	members, admins := make(map[string]string), make(map[string]string)
+	for rows.Next() {
+		var pubkey, role string
+		if err := rows.Scan(&pubkey, &role); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		members[pubkey] = role
+		if role == "admin" || role == "moderator" {
+			admins[pubkey] = role
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var drift []string
+	metadata, err := currentRelayEvent(ctx, KindGroupMetadata, groupId)
+	if err != nil {
+		return nil, err
+	}
+	if metadata == nil {
+		drift = append(drift, "no 39000")
+	} else if tag := metadata.Tags.GetFirst([]string{"members_count", ""}); tag == nil || (*tag)[1] != strconv.Itoa(len(members)) {
+		drift = append(drift, "39000 member count")
+	}
+
+	published, err := currentRelayEvent(ctx, KindGroupAdmins, groupId)
+	if err != nil {
+		return nil, err
+	}
+	if published == nil {
+		drift = append(drift, "no 39001")
+	} else if tagged := taggedMembers(published.Tags); len(tagged) != len(admins) || !hasRoles(tagged, admins) {
+		drift = append(drift, "39001 admins")
+	}
+
+	if published, err = currentRelayEvent(ctx, KindGroupMembers, groupId); err != nil {
+		return nil, err
+	}
+	if published == nil {
+		drift = append(drift, "no 39002")
+	} else if tagged := taggedMembers(published.Tags); len(tagged) != len(members) || !hasMembers(tagged, members) {
+		drift = append(drift, "39002 members")
+	}
+	return drift, nil
+}
+
+// hasRoles reports whether tagged gives every pubkey of want its role.
+func hasRoles(tagged, want map[string]string) bool {
+	for pubkey, role := range want {
+		if tagged[pubkey] != role {
+			return false
+		}
+	}
+	return true
+}
+
+// hasMembers reports whether tagged lists every pubkey of want.
+func hasMembers(tagged, want map[string]string) bool {
+	for pubkey := range want {
+		if _, ok := tagged[pubkey]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// reconcileGroups marks the clean groups of community (every community when
+// "") whose metadata drifted from their tables dirty, and returns them.
+func reconcileGroups(ctx context.Context, community string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id FROM groups
+		WHERE metadata_dirty_since IS NULL AND ($1 = '' OR community = $1)
+		ORDER BY id
+	`, community)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var drifted []string
+	for _, id := range ids {
+		ok, err := reconcileGroup(ctx, id)
+		if err != nil {
+			log.Printf("[NIP-29] Error reconciling group %s: %v", id, err)
+			continue
+		}
+		if ok {
+			drifted = append(drifted, id)
+		}
+	}
+	return drifted, nil
+}
+
+// reconcileGroup compares groupId's metadata with its tables under the
+// group lock, so no change or regeneration is halfway, and marks it dirty
+// if they differ. It reports whether it did.
+func reconcileGroup(ctx context.Context, groupId string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if err := lockGroup(ctx, tx, groupId); err != nil {
+		return false, err
+	}
+	var dirty bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT metadata_dirty_since IS NOT NULL FROM groups WHERE id = $1", groupId).Scan(&dirty)
+	if err == sql.ErrNoRows || (err == nil && dirty) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	drift, err := groupDrift(ctx, tx, groupId)
+	if err != nil || len(drift) == 0 {
+		return false, err
+	}
+	log.Printf("[NIP-29] Group %s drifted from its tables (%s), regenerating", groupId, strings.Join(drift, ", "))
+	if err := markGroupDirty(ctx, tx, groupId); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// runGroupReconciler reconciles every group each groupReconcileInterval.
+func runGroupReconciler(ctx context.Context) {
+	if groupReconcileInterval <= 0 || !canSignRelayEvents() {
+		return
+	}
+	ticker := time.NewTicker(groupReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		drifted, err := reconcileGroups(ctx, "")
+		if err != nil {
+			log.Printf("[NIP-29] Error reconciling groups: %v", err)
+		} else if len(drifted) > 0 {
+			log.Printf("[NIP-29] Reconciliation found %d drifted groups", len(drifted))
+			groupSync.kick()
+		}
+	}
+}
+
+// ─── HTTP ──────────────────────────────────────────────────────────────────────
+
+// registerReconcileAPI mounts POST /admin/groups/reconcile (the community's
+// relay admin) on the admin mux. It reconciles the community's groups and
+// regenerates the drifted ones before answering.
+func registerReconcileAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/groups/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		drifted, err := reconcileGroups(ctx, communityOf(ctx).id())
+		if err == nil && len(drifted) > 0 {
+			err = syncGroups(ctx)
+		}
+		if drifted == nil {
+			drifted = []string{}
+		}
+		writeAPIResult(w, map[string]interface{}{"drifted": drifted}, err)
+	})
+}
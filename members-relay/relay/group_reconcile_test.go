@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestTaggedMembers(t *testing.T) {
+	keys := pubkeys(2)
+	got := taggedMembers(nostr.Tags{{"d", "club"}, {"p", keys[0], "admin"}, {"p", keys[1]}, {"p"}})
+	if want := map[string]string{keys[0]: "admin", keys[1]: ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("members %v", got)
+	}
+}
+
+// Rows changed behind the relay's back, and a group with no metadata at
+// all, are found and regenerated; groups in step are left alone.
+func TestGroupReconciliation(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK := nostr.GeneratePrivateKey()
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, nostr.Now(), nostr.Tags{{"h", "club"}}, ""))
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if drifted, err := reconcileGroups(ctx, ""); err != nil || len(drifted) != 0 {
+		t.Fatalf("groups in step reported drifted: %v %v", drifted, err)
+	}
+
+	// Database surgery: a member added by hand, a group created by hand
+	added := pubkeys(1)[0]
+	if _, err := db.ExecContext(ctx, "INSERT INTO group_members (group_id, pubkey, role) VALUES ('club', $1, 'moderator')", added); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO groups (id, name) VALUES ('imported', 'Imported')"); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	registerReconcileAPI(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/admin/groups/reconcile", nil))
+	var body struct{ Drifted []string }
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || !reflect.DeepEqual(body.Drifted, []string{"club", "imported"}) {
+		t.Fatalf("reconcile: %d %s", w.Code, w.Body)
+	}
+	if members := storedGroupMembers(t, "club"); !members[added] {
+		t.Fatalf("39002 after reconciling lists %v", members)
+	}
+	if admins, _ := currentRelayEvent(ctx, KindGroupAdmins, "club"); admins == nil || taggedMembers(admins.Tags)[added] != "moderator" {
+		t.Fatalf("39001 after reconciling: %v", admins)
+	}
+	if metadata, _ := currentRelayEvent(ctx, KindGroupMetadata, "imported"); metadata == nil {
+		t.Fatal("no 39000 for the group created by hand")
+	}
+	if drifted, err := reconcileGroups(ctx, ""); err != nil || len(drifted) != 0 {
+		t.Fatalf("groups still drifted after regenerating: %v %v", drifted, err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"slices"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// GROUP ROLES
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// What a group role may do is a matrix of capabilities, one per moderation
+// action, and the policy asks hasGroupCapability for the capability of each
+// moderation kind rather than for a role. Admins hold every capability;
+// moderators delete events (9005), mute members (9004) and post
+// announcements, but do not add or remove members, edit the group or its
+// status, pin, or issue invites. Deleting a group (9008) stays with the
+// community's relay admin, who holds every capability in every group. The
+// group's 39003 lists each role's capabilities after its description.
+
+type groupCapability string
+
+const (
+	capPutUser         groupCapability = "put-user"
+	capRemoveUser      groupCapability = "remove-user"
+	capEditMetadata    groupCapability = "edit-metadata"
+	capPinEvents       groupCapability = "pin-events"
+	capMuteUser        groupCapability = "mute-user"
+	capDeleteEvent     groupCapability = "delete-event"
+	capEditGroupStatus groupCapability = "edit-group-status"
+	capCreateInvite    groupCapability = "create-invite"
+	capAnnounce        groupCapability = "announce"
+)
+
+// groupRoles are the roles group_members.role can hold and the capability
+// matrix the policy enforces.
+var groupRoles = []struct {
+	name, description string
+	capabilities      []groupCapability
+}{
+	{"admin", "Edits the group, adds and removes members and sets their roles", []groupCapability{
+		capPutUser, capRemoveUser, capEditMetadata, capPinEvents, capMuteUser,
+		capDeleteEvent, capEditGroupStatus, capCreateInvite, capAnnounce,
+	}},
+	{"moderator", "Deletes messages and mutes members in the group", []groupCapability{
+		capMuteUser, capDeleteEvent, capAnnounce,
+	}},
+	{"member", "Reads and posts in the group", nil},
+}
+
+// kindCapabilities maps the moderation kinds a group role may send to the
+// capability each needs.
+var kindCapabilities = map[int]groupCapability{
+	KindPutUser:        capPutUser,
+	KindRemoveUser:     capRemoveUser,
+	KindEditMetadata:   capEditMetadata,
+	KindPinEvents:      capPinEvents,
+	KindMuteUser:       capMuteUser,
+	KindDeleteEvent:    capDeleteEvent,
+	KindPutGroupStatus: capEditGroupStatus,
+	KindCreateInvite:   capCreateInvite,
+}
+
+// roleHas reports whether role holds capability.
+func roleHas(role string, capability groupCapability) bool {
+	for _, r := range groupRoles {
+		if r.name == role {
+			return slices.Contains(r.capabilities, capability)
+		}
+	}
+	return false
+}
+
+// hasGroupCapability reports whether pubkey's role in groupId holds
+// capability. The community's relay admin holds them all.
+func hasGroupCapability(ctx context.Context, groupId, pubkey string, capability groupCapability) bool {
+	c := communityOf(ctx)
+	if pubkey == c.admin() {
+		return true
+	}
+	var role string
+	err := db.QueryRowContext(ctx, `
+		SELECT gm.role FROM group_members gm JOIN groups g ON g.id = gm.group_id
+		WHERE gm.group_id = $1 AND gm.pubkey = $2 AND g.community = $3
+	`, groupId, pubkey, c.id()).Scan(&role)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Printf("Error checking group capability %s for %s in %s: %v", capability, pubkey, groupId, err)
+		return false
+	}
+	return roleHas(role, capability)
+}
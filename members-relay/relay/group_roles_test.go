@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRoleCapabilities(t *testing.T) {
+	for kind, capability := range kindCapabilities {
+		if !roleHas("admin", capability) {
+			t.Errorf("admins cannot send kind %d", kind)
+		}
+		if roleHas("member", capability) {
+			t.Errorf("members can send kind %d", kind)
+		}
+	}
+	for _, capability := range []groupCapability{capDeleteEvent, capMuteUser, capAnnounce} {
+		if !roleHas("moderator", capability) {
+			t.Errorf("moderators lack %s", capability)
+		}
+	}
+	for _, capability := range []groupCapability{capPutUser, capRemoveUser, capEditMetadata, capEditGroupStatus, capCreateInvite, capPinEvents} {
+		if roleHas("moderator", capability) {
+			t.Errorf("moderators hold %s", capability)
+		}
+	}
+	if roleHas("owner", capPutUser) {
+		t.Error("unknown role holds a capability")
+	}
+}
+
+// A moderator deletes events and mutes, and is refused every action class
+// that belongs to admins; 39003 spells out the matrix.
+func TestModeratorCapabilities(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	ownerSK, modSK, memberSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	mod, _ := nostr.GetPublicKey(modSK)
+	member, _ := nostr.GetPublicKey(memberSK)
+	for _, pk := range []string{mod, member} {
+		addTestMember(t, pk)
+	}
+	now := nostr.Now()
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindCreateGroup, now, nostr.Tags{{"h", "kitchen"}}, ""))
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindPutUser, now, nostr.Tags{{"h", "kitchen"}, {"p", mod, "moderator"}, {"p", member}}, ""))
+	chat := signedEvent(t, memberSK, KindGroupChat, now, nostr.Tags{{"h", "kitchen"}}, "spam")
+	if err := persistEvent(ctx, chat); err != nil {
+		t.Fatal(err)
+	}
+	as := context.WithValue(ctx, nip98ViewerKey{}, mod)
+	send := func(kind int, tags ...nostr.Tag) (bool, string) {
+		return rejectEventPolicy(as, signedEvent(t, modSK, kind, now+1, append(nostr.Tags{{"h", "kitchen"}}, tags...), ""))
+	}
+
+	for _, tc := range []struct {
+		kind int
+		tags nostr.Tags
+	}{
+		{KindPutUser, nostr.Tags{{"p", pubkeys(1)[0]}}},
+		{KindRemoveUser, nostr.Tags{{"p", member}}},
+		{KindEditMetadata, nostr.Tags{{"name", "Moderated"}}},
+		{KindPinEvents, nostr.Tags{{"e", chat.ID}}},
+		{KindPutGroupStatus, nostr.Tags{{"open"}}},
+		{KindCreateInvite, nostr.Tags{{"code", "levain"}}},
+	} {
+		if reject, msg := send(tc.kind, tc.tags...); !reject || msg != "restricted: group admin access required" {
+			t.Errorf("moderator's kind %d: %v %q", tc.kind, reject, msg)
+		}
+	}
+	if reject, _ := send(KindDeleteGroup); !reject {
+		t.Error("moderator deleted the group")
+	}
+	if reject, msg := send(KindDeleteEvent, nostr.Tag{"e", chat.ID}); reject {
+		t.Errorf("moderator's delete-event: %s", msg)
+	}
+	if reject, msg := send(KindMuteUser, nostr.Tag{"p", member}, nostr.Tag{"duration", "60"}); reject {
+		t.Errorf("moderator's mute: %s", msg)
+	}
+	if hasGroupCapability(ctx, "kitchen", member, capDeleteEvent) {
+		t.Error("plain member may delete events")
+	}
+
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	roles, err := currentRelayEvent(ctx, KindGroupRoles, "kitchen")
+	if err != nil || roles == nil {
+		t.Fatalf("no 39003: %v", err)
+	}
+	tag := roles.Tags.GetFirst([]string{"role", "moderator"})
+	if tag == nil || !slices.Contains(*tag, "delete-event") || slices.Contains(*tag, "put-user") {
+		t.Fatalf("39003 moderator role: %v", tag)
+	}
+}
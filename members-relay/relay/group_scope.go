@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// GROUP-SCOPED EVENTS
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Some kinds that are not NIP-29 group kinds can still be scoped to a group
+// with an h tag: only members of that group may publish them, and only
+// members (and the relay admin) may read them. Reads are filtered in SQL;
+// live delivery goes through deliverRestricted, since khatru's broadcast has
+// no per-reader check.
+//
+// A group's own chat and moderation events are read the same way. The
+// relay-generated metadata (39000-39009) is not scoped, so every member can
+// still browse groups they have not joined, and neither is a deleted
+// group's tombstone (9008), which no one is left a member of.
+//
+// Recipes (kind 30023) are public, but one with an h tag is a group's
+// work in progress: only the group's members may publish or read it. The
+// scope condition covers them like the kinds below, so REQ and COUNT leave
+// out the same recipes and a page is never short of the filter's limit.
+// The public listings built straight from the events table (featured and
+// trending recipes, recipe engagement) leave them out (ungroupedCondition).
+
+var groupScopedKinds = []int{
+	KindUserStatus,
+	KindCalendarDate, KindCalendarTime, KindCalendarRSVP,
+	KindReaction,
+	KindGroupChat, KindGroupChatReply, KindGroupChatDelete,
+	KindPutUser, KindRemoveUser, KindEditMetadata, KindPinEvents, KindMuteUser, KindDeleteEvent, KindPutGroupStatus,
+	KindCreateGroup, KindCreateInvite,
+}
+
+func isGroupScopedKind(kind int) bool {
+	for _, k := range groupScopedKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// mayMatchGroupScoped reports whether a filter with these kinds can return
+// a group-scoped kind.
+func mayMatchGroupScoped(kinds []int) bool {
+	for _, k := range groupScopedKinds {
+		if mayMatchKind(kinds, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGroupScoped reports an event that only its group may see.
+func isGroupScoped(event *nostr.Event) bool {
+	return (isGroupScopedKind(event.Kind) || event.Kind == KindRecipe) && getHTag(event) != ""
+}
+
+// rejectGroupScope checks write access to the group named by the h tag, if any.
+func rejectGroupScope(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	groupId := getHTag(event)
+	if groupId == "" {
+		return false, ""
+	}
+	if !groupExists(ctx, groupId) {
+		return true, say(ctx, msgGroupNotFound)
+	}
+	if pubkey != communityAdmin(ctx) && !isGroupMember(ctx, groupId, pubkey) {
+		return true, say(ctx, msgNotGroupMember)
+	}
+	return false, ""
+}
+
+// ungroupedCondition matches rows of the events table aliased alias that
+// carry no h tag.
+func ungroupedCondition(alias string) string {
+	return fmt.Sprintf("NOT EXISTS (SELECT 1 FROM event_tags g WHERE g.event_id = %s.id AND g.tag_name = 'h')", alias)
+}
+
+// groupScopeCondition hides group-scoped events and group recipes of groups
+// viewer is not in. It returns "" when the filter cannot match a scoped kind
+// or viewer is admin, the community's relay admin.
+func groupScopeCondition(kinds []int, viewer, admin string, argIndex int) (string, []interface{}) {
+	if viewer != "" && viewer == admin {
+		return "", nil
+	}
+	var scoped []string
+	for _, k := range groupScopedKinds {
+		if mayMatchKind(kinds, k) {
+			scoped = append(scoped, fmt.Sprint(k))
+		}
+	}
+	if mayMatchKind(kinds, KindRecipe) {
+		scoped = append(scoped, fmt.Sprint(KindRecipe))
+	}
+	if len(scoped) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf(`(kind NOT IN (%s) OR NOT EXISTS (SELECT 1 FROM jsonb_array_elements(tags) x
+		WHERE x->>0 = 'h' AND NOT EXISTS (
+			SELECT 1 FROM group_members gm WHERE gm.group_id = x->>1 AND gm.pubkey = $%d)))`,
+		strings.Join(scoped, ","), argIndex), []interface{}{viewer}
+}
+
+// ─── Group directory ───────────────────────────────────────────────────────────
+
+// Public groups' metadata (39000), admin lists (39001) and roles (39003)
+// can be browsed without membership, so logged-out visitors see which
+// groups exist. Private groups' stay with the community's members.
+
+// isGroupDirectoryFilter reports a REQ for group metadata, admin lists and
+// roles only, which anyone may send; the query leaves out private groups for
+// readers who are not members (see groupDirectoryCondition).
+func isGroupDirectoryFilter(filter nostr.Filter) bool {
+	if len(filter.Kinds) == 0 {
+		return false
+	}
+	for _, k := range filter.Kinds {
+		if k != KindGroupMetadata && k != KindGroupAdmins && k != KindGroupRoles {
+			return false
+		}
+	}
+	return true
+}
+
+// groupDirectoryCondition hides private groups' metadata, admin lists and
+// roles from viewers who are not active members of community c. It returns
+// "" when the filter cannot match any of these kinds or viewer is c's admin.
+func groupDirectoryCondition(kinds []int, c *community, viewer string, argIndex int) (string, []interface{}) {
+	if viewer != "" && viewer == c.admin() {
+		return "", nil
+	}
+	if !mayMatchKind(kinds, KindGroupMetadata) && !mayMatchKind(kinds, KindGroupAdmins) &&
+		!mayMatchKind(kinds, KindGroupRoles) {
+		return "", nil
+	}
+	cond := fmt.Sprintf("kind NOT IN (%d, %d, %d) OR d_tag IN (SELECT id FROM groups WHERE is_public)",
+		KindGroupMetadata, KindGroupAdmins, KindGroupRoles)
+	if viewer == "" {
+		return "(" + cond + ")", nil
+	}
+	return fmt.Sprintf(`(%s OR EXISTS (SELECT 1 FROM members WHERE pubkey = $%d AND community = $%d
+		AND status IN ('active', 'grace') AND subscription_end > NOW()))`, cond, argIndex, argIndex+1),
+		[]interface{}{viewer, c.id()}
+}
+
+// ─── Restricted delivery ───────────────────────────────────────────────────────
+
+// Group-scoped events, private app data (see APP DATA) and lists (see
+// LISTS), read markers (see READ MARKERS), gift wraps (see GIFT WRAPS) and
+// reports (see REPORTS) must not reach every matching subscription. hideRestricted keeps them out
+// of khatru's fan-out; khatru stops notifying at the first true, which is
+// what we want here. storeEvent then hands them to deliverRestricted.
+
+func isRestrictedEvent(event *nostr.Event) bool {
+	return isGroupScoped(event) || isPrivateAppData(event) || isPrivateList(event) ||
+		event.Kind == KindReadMarker || event.Kind == nostr.KindGiftWrap || event.Kind == nostr.KindReporting
+}
+
+// hideRestricted is the PreventBroadcast hook.
+func hideRestricted(ws *khatru.WebSocket, event *nostr.Event) bool {
+	return isRestrictedEvent(event)
+}
+
+// deliverRestricted sends a newly stored restricted event to the open
+// subscriptions that match it and whose connection may read it.
+func (t *connTracker) deliverRestricted(ctx context.Context, event *nostr.Event) {
+	t.deliverMatching(communityOf(ctx).id(), event, event, readableBy(ctx, event))
+}
+
+// readableBy returns the check for which authenticated pubkeys ("" for
+// anonymous connections) may read event once they hold a subscription
+// matching it: anyone, except for restricted events.
+func readableBy(ctx context.Context, event *nostr.Event) func(pubkey string) bool {
+	switch {
+	case isPrivateAppData(event), isPrivateList(event), event.Kind == KindReadMarker:
+		return func(pk string) bool { return pk != "" && pk == event.PubKey }
+	case event.Kind == nostr.KindGiftWrap:
+		recipient := giftWrapRecipient(event)
+		return func(pk string) bool { return pk != "" && pk == recipient }
+	case event.Kind == nostr.KindReporting:
+		return func(pk string) bool { return pk != "" && (pk == event.PubKey || pk == communityAdmin(ctx)) }
+	case isGroupScoped(event):
+		groupId := getHTag(event)
+		return func(pk string) bool {
+			return pk != "" && (pk == communityAdmin(ctx) || isGroupMember(ctx, groupId, pk))
+		}
+	}
+	return func(string) bool { return true }
+}
+
+// deliverMatching sends send to every open subscription with a live filter
+// matching match, on a connection to community whose pubkey allow accepts.
+// When send is a different event, subscriptions that also match send are
+// skipped: khatru's broadcast of send reaches them.
+func (t *connTracker) deliverMatching(community string, match, send *nostr.Event, allow func(pubkey string) bool) {
+	t.deliver(community, send, allow, func(filters []nostr.Filter) bool {
+		matched := false
+		for _, filter := range filters {
+			if send != match && reachedByBroadcast(filter, send) {
+				return false
+			}
+			if matchesLiveFilter(filter, match) {
+				matched = true
+			}
+		}
+		return matched
+	})
+}
+
+// deliver sends send to every open subscription on a connection to
+// community whose live filters match accepts and whose pubkey allow accepts.
+func (t *connTracker) deliver(community string, send *nostr.Event, allow func(pubkey string) bool, match func(filters []nostr.Filter) bool) {
+	type target struct {
+		ws    *khatru.WebSocket
+		subID string
+	}
+	var targets []target
+	t.mu.Lock()
+	for ws, c := range t.conns {
+		if c.community != community {
+			continue
+		}
+		for subID, sub := range c.subs {
+			if match(sub.live) {
+				targets = append(targets, target{ws, subID})
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	allowed := make(map[string]bool)
+	for _, tg := range targets {
+		pk := tg.ws.AuthedPublicKey
+		ok, checked := allowed[pk]
+		if !checked {
+			ok = allow(pk)
+			allowed[pk] = ok
+		}
+		if ok {
+			subID := tg.subID
+			tg.ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &subID, Event: *send})
+		}
+	}
+}
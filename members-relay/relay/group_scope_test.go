@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestGroupContentScopedButNotMetadata(t *testing.T) {
+	viewer := pubkeys(1)[0]
+	for _, kinds := range [][]int{{KindGroupChat}, {KindPutUser}, nil} {
+		if q, _ := buildViewerQuery(nostr.Filter{Kinds: kinds}, nil, viewer, false); !strings.Contains(q, "group_members") {
+			t.Fatalf("kinds %v: other groups' content not hidden: %s", kinds, q)
+		}
+	}
+	if q, _ := buildViewerQuery(nostr.Filter{Kinds: []int{KindGroupMetadata}}, nil, viewer, false); strings.Contains(q, "group_members") {
+		t.Fatalf("group metadata scoped: %s", q)
+	}
+	if mayMatchGroupScoped([]int{KindGroupMetadata, KindJoinRequest}) || !mayMatchGroupScoped([]int{KindGroupMetadata, KindGroupChat}) {
+		t.Fatal("mayMatchGroupScoped disagrees with groupScopedKinds")
+	}
+}
+
+func TestGroupContentNeedsGroupMembership(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	memberSK, authorSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	member, _ := nostr.GetPublicKey(memberSK)
+	addTestMember(t, member)
+	if _, err := db.ExecContext(ctx, "INSERT INTO groups (id, name, is_public) VALUES ('bakers', 'Bakers', true), ('secret', 'Secret', false)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO group_members (group_id, pubkey, role) VALUES ('bakers', $1, 'member')", member); err != nil {
+		t.Fatal(err)
+	}
+	now := nostr.Now()
+	open := signedEvent(t, authorSK, KindGroupChat, now, nostr.Tags{{"h", "bakers"}}, "crumb shot")
+	hidden := signedEvent(t, authorSK, KindGroupChat, now, nostr.Tags{{"h", "secret"}}, "the plan")
+	metadata := signedEvent(t, authorSK, KindGroupMetadata, now, nostr.Tags{{"d", "secret"}, {"name", "Secret"}}, "")
+	kick := signedEvent(t, authorSK, KindRemoveUser, now-1, nostr.Tags{{"h", "secret"}, {"p", member}}, "")
+	recipe := signedEvent(t, authorSK, KindRecipe, now-2, nostr.Tags{{"d", "focaccia"}}, "")
+	for _, evt := range []*nostr.Event{open, hidden, metadata, kick, recipe} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rl := khatru.NewRelay()
+	rl.QueryEvents = append(rl.QueryEvents, queryEvents)
+	rl.RejectFilter = append(rl.RejectFilter, rejectFilterPolicy)
+	rl.OnConnect = append(rl.OnConnect, connections.onConnect)
+	rl.OnDisconnect = append(rl.OnDisconnect, connections.onDisconnect)
+	url := startTestRelay(t, rl, testServerConfig(true))
+	c := dialTestRelay(t, url)
+	if !c.auth(url, c.challenge(), memberSK) {
+		t.Fatal("AUTH refused")
+	}
+	fetch := func(subID, filter string) []string {
+		t.Helper()
+		c.send(`["REQ","` + subID + `",` + filter + `]`)
+		var ids []string
+		for {
+			env := c.next(func(env nostr.Envelope) bool {
+				switch env := env.(type) {
+				case *nostr.EventEnvelope:
+					return *env.SubscriptionID == subID
+				case *nostr.EOSEEnvelope:
+					return string(*env) == subID
+				case *nostr.ClosedEnvelope:
+					return env.SubscriptionID == subID
+				}
+				return false
+			})
+			evt, ok := env.(*nostr.EventEnvelope)
+			if !ok {
+				return ids
+			}
+			ids = append(ids, evt.Event.ID)
+		}
+	}
+
+	if got := fetch("own", `{"kinds":[9],"#h":["bakers"]}`); !slices.Equal(got, []string{open.ID}) {
+		t.Errorf("own group: %v", got)
+	}
+	if reason := c.req("other", `{"kinds":[9],"#h":["bakers","secret"]}`); !strings.HasPrefix(reason, "restricted:") {
+		t.Errorf("another group's chat: %q", reason)
+	}
+	if got := fetch("all", `{"kinds":[9]}`); !slices.Equal(got, []string{open.ID}) {
+		t.Errorf("chat without #h: %v", got)
+	}
+	if got := fetch("byid", `{"ids":["`+hidden.ID+`"]}`); len(got) != 0 {
+		t.Errorf("another group's message by id: %v", got)
+	}
+	if got := fetch("meta", `{"kinds":[39000],"#d":["secret"]}`); !slices.Equal(got, []string{metadata.ID}) {
+		t.Errorf("group metadata: %v", got)
+	}
+	author := open.PubKey
+	if got := fetch("anykind", `{"authors":["`+author+`"]}`); slices.Contains(got, hidden.ID) || slices.Contains(got, kick.ID) || !slices.Contains(got, recipe.ID) {
+		t.Errorf("filter without kinds: %v", got)
+	}
+	if reason := c.req("anykindh", `{"authors":["`+author+`"],"#h":["secret"]}`); !strings.HasPrefix(reason, "restricted:") {
+		t.Errorf("another group's events without kinds: %q", reason)
+	}
+	if got := fetch("mixed", `{"kinds":[30023,9,9001]}`); !slices.Equal(got, []string{open.ID, recipe.ID}) {
+		t.Errorf("recipes mixed with group kinds: %v", got)
+	}
+}
+
+func TestGroupDirectoryFilter(t *testing.T) {
+	for _, tc := range []struct {
+		kinds []int
+		want  bool
+	}{
+		{nil, false},
+		{[]int{KindGroupMetadata}, true},
+		{[]int{KindGroupMetadata, KindGroupAdmins}, true},
+		{[]int{KindGroupRoles}, true},
+		{[]int{KindGroupMetadata, KindGroupMembers}, false},
+		{[]int{KindGroupMetadata, KindRecipe}, false},
+	} {
+		if got := isGroupDirectoryFilter(nostr.Filter{Kinds: tc.kinds}); got != tc.want {
+			t.Errorf("kinds %v: got %v", tc.kinds, got)
+		}
+	}
+	if q, _ := buildViewerQuery(nostr.Filter{Kinds: []int{KindGroupMembers}}, nil, "", false); strings.Contains(q, "is_public") {
+		t.Fatalf("member lists filtered by the directory: %s", q)
+	}
+	if reject, msg := rejectFilterPolicy(context.Background(), nostr.Filter{Kinds: []int{KindGroupMetadata}}); reject {
+		t.Fatalf("anonymous group browsing refused: %s", msg)
+	}
+}
+
+func TestAnonymousReadersSeeOnlyPublicGroups(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	member := pubkeys(1)[0]
+	addTestMember(t, member)
+	if _, err := db.ExecContext(ctx, "INSERT INTO groups (id, name, is_public) VALUES ('bakers', 'Bakers', true), ('secret', 'Secret', false)"); err != nil {
+		t.Fatal(err)
+	}
+	sk := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	open := signedEvent(t, sk, KindGroupMetadata, now, nostr.Tags{{"d", "bakers"}, {"name", "Bakers"}}, "")
+	hidden := signedEvent(t, sk, KindGroupMetadata, now, nostr.Tags{{"d", "secret"}, {"name", "Secret"}, {"private"}}, "")
+	hiddenAdmins := signedEvent(t, sk, KindGroupAdmins, now, nostr.Tags{{"d", "secret"}}, "")
+	hiddenRoles := signedEvent(t, sk, KindGroupRoles, now, nostr.Tags{{"d", "secret"}, {"role", "admin"}}, "")
+	for _, evt := range []*nostr.Event{open, hidden, hiddenAdmins, hiddenRoles} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filter := nostr.Filter{Kinds: []int{KindGroupMetadata, KindGroupAdmins, KindGroupRoles}}
+	for _, tc := range []struct {
+		viewer string
+		want   int
+	}{
+		{"", 1},
+		{pubkeys(2)[1], 1},
+		{member, 4},
+	} {
+		query, args := buildViewerQuery(filter, nil, tc.viewer, false)
+		got, err := fetchEvents(ctx, query, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != tc.want || (tc.want == 1 && got[0].ID != open.ID) {
+			t.Errorf("viewer %q: %d events, want %d", tc.viewer, len(got), tc.want)
+		}
+	}
+}
+
+// A recipe with an h tag is the group's: members publish and read it,
+// everyone else sees only public recipes.
+func TestGroupRecipes(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	memberSK, outsiderSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	member, _ := nostr.GetPublicKey(memberSK)
+	outsider, _ := nostr.GetPublicKey(outsiderSK)
+	addTestMember(t, member)
+	addTestMember(t, outsider)
+	if _, err := db.ExecContext(ctx, "INSERT INTO groups (id, name, is_public) VALUES ('test-kitchen', 'Test kitchen', true)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO group_members (group_id, pubkey, role) VALUES ('test-kitchen', $1, 'member')", member); err != nil {
+		t.Fatal(err)
+	}
+	now := nostr.Now()
+	draft := func(sk string) *nostr.Event {
+		return signedEvent(t, sk, KindRecipe, now, nostr.Tags{{"d", "laminated-dough"}, {"h", "test-kitchen"}}, "work in progress")
+	}
+	as := func(pubkey string) context.Context { return context.WithValue(ctx, nip98ViewerKey{}, pubkey) }
+
+	if reject, msg := rejectEventPolicy(ctx, draft(memberSK)); !reject || !strings.HasPrefix(msg, "auth-required:") {
+		t.Fatalf("anonymous group recipe: %v %q", reject, msg)
+	}
+	if reject, msg := rejectEventPolicy(as(outsider), draft(outsiderSK)); !reject || msg != "restricted: not a member of this group" {
+		t.Fatalf("group recipe from outside the group: %v %q", reject, msg)
+	}
+	wip := draft(memberSK)
+	if reject, msg := rejectEventPolicy(as(member), wip); reject {
+		t.Fatalf("group recipe from a member refused: %s", msg)
+	}
+	public := signedEvent(t, outsiderSK, KindRecipe, now-1, nostr.Tags{{"d", "focaccia"}}, "olive oil")
+	for _, evt := range []*nostr.Event{wip, public} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	feed := func(ctx context.Context) []string {
+		t.Helper()
+		if reject, msg := rejectFilterPolicy(ctx, nostr.Filter{Kinds: []int{KindRecipe}}); reject {
+			t.Fatalf("recipe feed refused: %s", msg)
+		}
+		ch, _ := queryEvents(ctx, nostr.Filter{Kinds: []int{KindRecipe}})
+		var ids []string
+		for evt := range ch {
+			ids = append(ids, evt.ID)
+		}
+		return ids
+	}
+	if got := feed(ctx); !slices.Equal(got, []string{public.ID}) {
+		t.Errorf("anonymous feed: %v", got)
+	}
+	if got := feed(as(outsider)); !slices.Equal(got, []string{public.ID}) {
+		t.Errorf("outsider's feed: %v", got)
+	}
+	if got := feed(as(member)); !slices.Equal(got, []string{wip.ID, public.ID}) {
+		t.Errorf("member's feed: %v", got)
+	}
+	if isMirrored(wip) || !isMirrored(public) {
+		t.Error("mirror shows group recipes or hides public ones")
+	}
+}
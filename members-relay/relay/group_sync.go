@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// GROUP SYNC
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Group management events change the group tables in the same transaction
+// that stores them (handleNIP29SideEffects). The relay-signed events that
+// follow are produced afterwards by runGroupSync, which retries until they
+// go through, so a failed signature or write cannot leave the tables and the
+// published metadata out of step:
+//
+//   - A change marks the group dirty (groups.metadata_dirty_since) and bumps
+//     metadata_version. The worker regenerates 39000 through 39004 from the
+//     tables and clears the flag. Changes and regenerations of a group are
+//     serialized by its advisory lock (lockGroup), and any number of changes
+//     queued up behind a regeneration are covered by the next one.
+//   - The worker leaves a dirty group for RELAY_GROUP_REGEN_DELAY (default
+//     1s) before regenerating it, so a burst of changes, such as onboarding
+//     a cohort with one put-user each, is published as one up-to-date set
+//     rather than one per change: a group is regenerated at most once per
+//     delay. The dirty flag lives in the database, so a burst cut short by a
+//     restart is caught up by the worker's first pass, which does not wait.
+//   - Join and leave confirmations (9000, 9001) and deleted groups'
+//     tombstones (9008) are queued in group_outbox and signed and stored by
+//     the worker, each in one transaction with the removal of its row.
+//
+// `relay reconcile-groups` lists dirty groups or forces a resync.
+
+// groupSyncInterval is how often the worker retries without being kicked.
+const groupSyncInterval = 30 * time.Second
+
+// groupRegenDelay is how long the worker lets a dirty group settle before
+// regenerating it.
+var groupRegenDelay time.Duration
+
+func loadGroupSyncConfig() {
+	groupRegenDelay = envDuration("RELAY_GROUP_REGEN_DELAY", time.Second)
+}
+
+type groupSyncer struct {
+	wake chan struct{}
+}
+
+var groupSync = &groupSyncer{wake: make(chan struct{}, 1)}
+
+// kick asks the worker to sync now.
+func (g *groupSyncer) kick() {
+	select {
+	case g.wake <- struct{}{}:
+	default:
+	}
+}
+
+// markGroupDirty flags groupId's metadata for regeneration as part of tx.
+func markGroupDirty(ctx context.Context, tx *sql.Tx, groupId string) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE groups SET metadata_dirty_since = COALESCE(metadata_dirty_since, NOW()),
+			metadata_version = metadata_version + 1
+		WHERE id = $1
+	`, groupId)
+	return err
+}
+
+// queueGroupEvent queues an unsigned relay event for groupId as part of tx.
+func queueGroupEvent(ctx context.Context, tx *sql.Tx, groupId string, event nostr.Event) error {
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO group_outbox (group_id, event, community) VALUES ($1, $2, $3)",
+		groupId, raw, communityOf(ctx).id())
+	return err
+}
+
+// sendGroupEvent signs and stores the oldest due outbox event. It reports
+// whether there was one; a failed attempt is rescheduled with backoff.
+func sendGroupEvent(ctx context.Context) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var raw []byte
+	var community string
+	err = tx.QueryRowContext(ctx, `
+		SELECT o.id, o.event, COALESCE(o.community, g.community, $1) FROM group_outbox o
+		LEFT JOIN groups g ON g.id = o.group_id
+		WHERE o.next_attempt <= NOW()
+		ORDER BY o.id LIMIT 1 FOR UPDATE OF o SKIP LOCKED
+	`, defaultCommunityID).Scan(&id, &raw, &community)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var event nostr.Event
+	if err = json.Unmarshal(raw, &event); err == nil {
+		if err = signRelayEvent(&event); err == nil {
+			err = persistEventTx(withCommunity(ctx, communities[community]), tx, &event)
+		}
+	}
+	if err == nil {
+		if _, err = tx.ExecContext(ctx, "DELETE FROM group_outbox WHERE id = $1", id); err == nil {
+			err = tx.Commit()
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Printf("[NIP-29] Error sending queued group event %d: %v", id, err)
+		_, err = db.ExecContext(ctx, `
+			UPDATE group_outbox SET attempts = attempts + 1, last_error = $2,
+				next_attempt = NOW() + LEAST(attempts + 1, 60) * INTERVAL '1 minute'
+			WHERE id = $1
+		`, id, err.Error())
+		return err == nil, err
+	}
+	return true, nil
+}
+
+// groupLockClass namespaces the per-group advisory locks.
+const groupLockClass = 29
+
+// lockGroup takes groupId's lock for the rest of tx. Side effects and
+// regenerations of one group hold it, so they run one at a time across
+// connections and relay instances; different groups never wait on each
+// other.
+func lockGroup(ctx context.Context, tx *sql.Tx, groupId string) error {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1, hashtext($2))", groupLockClass, groupId)
+	return err
+}
+
+// regenerateGroup rebuilds a dirty group's 39000, 39001, 39002 and 39003
+// and clears the flag, all under the group lock. However many changes made the
+// group dirty, they are covered by one regeneration; a group found clean
+// (another run got there first) or deleted is left alone.
+func regenerateGroup(ctx context.Context, groupId string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := lockGroup(ctx, tx, groupId); err != nil {
+		return err
+	}
+
+	var version int64
+	var dirty bool
+	var community string
+	err = tx.QueryRowContext(ctx,
+		"SELECT metadata_version, metadata_dirty_since IS NOT NULL, community FROM groups WHERE id = $1",
+		groupId).Scan(&version, &dirty, &community)
+	if err == sql.ErrNoRows || (err == nil && !dirty) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// The regenerated events belong to the group's community
+	ctx = withCommunity(ctx, communities[community])
+	if err := generateGroupMetadata(ctx, tx, groupId); err != nil {
+		return err
+	}
+	if err := generateGroupAdmins(ctx, tx, groupId); err != nil {
+		return err
+	}
+	if err := generateGroupMembers(ctx, tx, groupId); err != nil {
+		return err
+	}
+	if err := generateGroupRoles(ctx, tx, groupId); err != nil {
+		return err
+	}
+	if err := generateGroupPins(ctx, tx, groupId); err != nil {
+		return err
+	}
+	if err := generateGroupAnnouncements(ctx, tx, groupId); err != nil {
+		return err
+	}
+	// A change that came in meanwhile starts a new settling period
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE groups SET metadata_sync_error = NULL,
+			metadata_dirty_since = CASE WHEN metadata_version = $2 THEN NULL ELSE NOW() END
+		WHERE id = $1
+	`, groupId, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// syncDirtyGroups regenerates the metadata of every group that has been
+// dirty for at least settle. It returns how many groups were brought up to
+// date and how long until the next one is due (0 if none is waiting).
+func syncDirtyGroups(ctx context.Context, settle time.Duration) (int, time.Duration, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, EXTRACT(EPOCH FROM metadata_dirty_since + make_interval(secs => $1) - NOW()) FROM groups
+		WHERE metadata_dirty_since IS NOT NULL
+		ORDER BY metadata_dirty_since
+	`, settle.Seconds())
+	if err != nil {
+		return 0, 0, err
+	}
+	var dirty []string
+	var next time.Duration
+	for rows.Next() {
+		var id string
+		var wait float64
+		if err := rows.Scan(&id, &wait); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		if wait > 0 {
+			if d := time.Duration(wait * float64(time.Second)); next == 0 || d < next {
+				next = d
+			}
+			continue
+		}
+		dirty = append(dirty, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	synced := 0
+	for _, id := range dirty {
+		if err := regenerateGroup(ctx, id); err != nil {
+			log.Printf("[NIP-29] Error regenerating metadata for group %s: %v", id, err)
+			db.ExecContext(ctx, "UPDATE groups SET metadata_sync_error = $2 WHERE id = $1", id, err.Error())
+			continue
+		}
+		synced++
+	}
+	return synced, next, nil
+}
+
+// syncGroups sends due outbox events, then regenerates every dirty group.
+func syncGroups(ctx context.Context) error {
+	_, err := syncGroupsSettled(ctx, 0)
+	return err
+}
+
+// syncGroupsSettled is syncGroups for groups dirty for at least settle; it
+// returns how long until the next group is due (0 if none is waiting).
+func syncGroupsSettled(ctx context.Context, settle time.Duration) (time.Duration, error) {
+	for {
+		more, err := sendGroupEvent(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if !more {
+			break
+		}
+	}
+	_, next, err := syncDirtyGroups(ctx, settle)
+	return next, err
+}
+
+// runGroupSync syncs whenever kicked, when a dirty group has settled, and
+// every groupSyncInterval to retry. Its first pass regenerates whatever is
+// dirty at once, catching up on changes made before a restart.
+func runGroupSync(ctx context.Context) {
+	if !canSignRelayEvents() {
+		return
+	}
+	ticker := time.NewTicker(groupSyncInterval)
+	defer ticker.Stop()
+	settle := time.Duration(0)
+	for {
+		next, err := syncGroupsSettled(ctx, settle)
+		if err != nil {
+			log.Printf("[NIP-29] Error syncing groups: %v", err)
+		}
+		settle = groupRegenDelay
+		var settled <-chan time.Time
+		if next > 0 {
+			settled = time.After(next)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-groupSync.wake:
+		case <-settled:
+		case <-ticker.C:
+		}
+	}
+}
+
+// runReconcileGroups implements `relay reconcile-groups [-list] [group ...]`:
+// it marks the named groups (default: all) dirty and syncs them once, or with
+// -list only reports what is out of step.
+func runReconcileGroups(args []string) {
+	fs := flag.NewFlagSet("reconcile-groups", flag.ExitOnError)
+	list := fs.Bool("list", false, "list dirty groups and queued events without changing anything")
+	fs.Parse(args)
+
+	loadConfig()
+	initDB()
+	defer db.Close()
+	ctx := context.Background()
+	if err := migrateSchema(ctx); err != nil {
+		log.Fatal("Failed to migrate schema:", err)
+	}
+
+	if *list {
+		rows, err := db.QueryContext(ctx, `
+			SELECT id, metadata_dirty_since, COALESCE(metadata_sync_error, '') FROM groups
+			WHERE metadata_dirty_since IS NOT NULL ORDER BY metadata_dirty_since
+		`)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id, syncErr string
+			var since time.Time
+			if err := rows.Scan(&id, &since, &syncErr); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("%s\tdirty since %s\t%s\n", id, since.Format(time.RFC3339), syncErr)
+		}
+		var queued int
+		db.QueryRowContext(ctx, "SELECT COUNT(*) FROM group_outbox").Scan(&queued)
+		fmt.Printf("%d queued group events\n", queued)
+		return
+	}
+
+	if !canSignRelayEvents() {
+		log.Fatal("RELAY_PRIVATE_KEY or RELAY_BUNKER_URL is required to sign group metadata")
+	}
+	query, queryArgs := "UPDATE groups SET metadata_dirty_since = COALESCE(metadata_dirty_since, NOW()), metadata_version = metadata_version + 1", []interface{}{}
+	if fs.NArg() > 0 {
+		query += " WHERE id = ANY($1::text[])"
+		queryArgs = append(queryArgs, pq.Array(fs.Args()))
+	}
+	res, err := db.ExecContext(ctx, query, queryArgs...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	marked, _ := res.RowsAffected()
+	if err := syncGroups(ctx); err != nil {
+		log.Fatalf("[NIP-29] Reconcile failed: %v", err)
+	}
+	var remaining int
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM groups WHERE metadata_dirty_since IS NOT NULL").Scan(&remaining)
+	log.Printf("[NIP-29] Reconciled %d groups, %d still dirty", marked, remaining)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// applyGroupEvent stores event and applies its NIP-29 side effects the way
+// storeEvent does.
+func applyGroupEvent(t *testing.T, event *nostr.Event) {
+	t.Helper()
+	if err := storeGroupEvent(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func storeGroupEvent(ctx context.Context, event *nostr.Event) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := persistEventTx(ctx, tx, event); err != nil {
+		return err
+	}
+	if _, err := handleNIP29SideEffects(ctx, tx, event); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func groupDirty(t *testing.T, groupId string) bool {
+	t.Helper()
+	var dirty bool
+	if err := db.QueryRowContext(context.Background(),
+		"SELECT metadata_dirty_since IS NOT NULL FROM groups WHERE id = $1", groupId).Scan(&dirty); err != nil {
+		t.Fatal(err)
+	}
+	return dirty
+}
+
+func storedGroupMembers(t *testing.T, groupId string) map[string]bool {
+	t.Helper()
+	event, err := currentRelayEvent(context.Background(), KindGroupMembers, groupId)
+	if err != nil || event == nil {
+		t.Fatalf("no 39002 for %s: %v", groupId, err)
+	}
+	members := make(map[string]bool)
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "p" {
+			members[tag[1]] = true
+		}
+	}
+	return members
+}
+
+func TestGroupSyncRegeneratesAndConfirms(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminSK)
+	joinerSK := nostr.GeneratePrivateKey()
+	joiner, _ := nostr.GetPublicKey(joinerSK)
+	now := nostr.Now()
+
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, nostr.Tags{{"h", "sourdough"}}, ""))
+	applyGroupEvent(t, signedEvent(t, joinerSK, KindJoinRequest, now, nostr.Tags{{"h", "sourdough"}}, ""))
+	if !groupDirty(t, "sourdough") {
+		t.Fatal("group changes did not mark the group dirty")
+	}
+
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if groupDirty(t, "sourdough") {
+		t.Fatal("group still dirty after sync")
+	}
+	for _, kind := range []int{KindGroupMetadata, KindGroupAdmins, KindGroupRoles, KindGroupPins} {
+		if event, _ := currentRelayEvent(ctx, kind, "sourdough"); event == nil {
+			t.Errorf("kind %d not generated", kind)
+		}
+	}
+	if roles, _ := currentRelayEvent(ctx, KindGroupRoles, "sourdough"); roles != nil {
+		var names []string
+		for _, tag := range roles.Tags {
+			if len(tag) >= 3 && tag[0] == "role" && tag[2] != "" {
+				names = append(names, tag[1])
+			}
+		}
+		if strings.Join(names, ",") != "admin,moderator,member" {
+			t.Errorf("39003 describes roles %v", names)
+		}
+	}
+	if members := storedGroupMembers(t, "sourdough"); !members[admin] || !members[joiner] {
+		t.Fatalf("39002 lists %v", members)
+	}
+	var confirmations, queued int
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM events WHERE kind = $1 AND pubkey = $2",
+		KindPutUser, relaySigningPubkey).Scan(&confirmations)
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM group_outbox").Scan(&queued)
+	if confirmations != 1 || queued != 0 {
+		t.Fatalf("%d put-user confirmations, %d still queued", confirmations, queued)
+	}
+
+	applyGroupEvent(t, signedEvent(t, adminSK, KindDeleteGroup, now, nostr.Tags{{"h", "sourdough"}}, ""))
+	for _, kind := range []int{KindGroupMetadata, KindGroupAdmins, KindGroupMembers, KindGroupRoles, KindGroupPins} {
+		if event, _ := currentRelayEvent(ctx, kind, "sourdough"); event != nil {
+			t.Errorf("kind %d left behind by the group's deletion", kind)
+		}
+	}
+}
+
+func TestGroupSyncRetriesFailures(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK := nostr.GeneratePrivateKey()
+	joinerSK := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, nostr.Tags{{"h", "pasta"}}, ""))
+	applyGroupEvent(t, signedEvent(t, joinerSK, KindJoinRequest, now, nostr.Tags{{"h", "pasta"}}, ""))
+
+	// Signing fails while the key is missing: nothing is lost.
+	key := relayPrivateKey
+	relayPrivateKey = ""
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	relayPrivateKey = key
+	if !groupDirty(t, "pasta") {
+		t.Fatal("failed regeneration cleared the dirty flag")
+	}
+	var attempts int
+	var syncErr string
+	db.QueryRowContext(ctx, "SELECT attempts FROM group_outbox").Scan(&attempts)
+	db.QueryRowContext(ctx, "SELECT COALESCE(metadata_sync_error, '') FROM groups WHERE id = 'pasta'").Scan(&syncErr)
+	if attempts != 1 || syncErr == "" {
+		t.Fatalf("failure not recorded: attempts %d, error %q", attempts, syncErr)
+	}
+
+	db.ExecContext(ctx, "UPDATE group_outbox SET next_attempt = NOW()")
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var queued int
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM group_outbox").Scan(&queued)
+	if groupDirty(t, "pasta") || queued != 0 {
+		t.Fatalf("retry did not catch up: dirty %v, %d queued", groupDirty(t, "pasta"), queued)
+	}
+}
+
+func TestConcurrentJoinsEndInExactMemberList(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminSK)
+	now := nostr.Now()
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, nostr.Tags{{"h", "announcement"}}, ""))
+
+	const joiners = 50
+	want := map[string]bool{admin: true}
+	joins := make([]*nostr.Event, joiners)
+	for i := range joins {
+		sk := nostr.GeneratePrivateKey()
+		joins[i] = signedEvent(t, sk, KindJoinRequest, now, nostr.Tags{{"h", "announcement"}}, "")
+		want[joins[i].PubKey] = true
+	}
+
+	// Joins land while workers (say, two relay instances) keep syncing.
+	var wg sync.WaitGroup
+	errs := make(chan error, joiners+joiners/5)
+	for i, join := range joins {
+		wg.Add(1)
+		go func(join *nostr.Event) {
+			defer wg.Done()
+			errs <- storeGroupEvent(ctx, join)
+		}(join)
+		if i%5 == 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- syncGroups(ctx)
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	got := storedGroupMembers(t, "announcement")
+	if len(got) != len(want) {
+		t.Fatalf("39002 lists %d members, want %d", len(got), len(want))
+	}
+	for pubkey := range want {
+		if !got[pubkey] {
+			t.Fatalf("39002 is missing %s", pubkey)
+		}
+	}
+	if groupDirty(t, "announcement") {
+		t.Fatal("group still dirty after the final sync")
+	}
+}
+
+// A dirty group waits out the settling delay unless the pass is a
+// catch-up one.
+func TestGroupSyncSettles(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK := nostr.GeneratePrivateKey()
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, nostr.Now(), nostr.Tags{{"h", "cohort"}}, ""))
+
+	next, err := syncGroupsSettled(ctx, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !groupDirty(t, "cohort") || next <= 0 || next > time.Hour {
+		t.Fatalf("unsettled group: dirty %v, next in %s", groupDirty(t, "cohort"), next)
+	}
+	if next, err = syncGroupsSettled(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if groupDirty(t, "cohort") || next != 0 {
+		t.Fatalf("catch-up pass: dirty %v, next in %s", groupDirty(t, "cohort"), next)
+	}
+}
+
+// Onboarding a cohort with one put-user each: the worker syncing after every
+// change signs a member list per change, the settled one a single set.
+func BenchmarkMembershipBurst(b *testing.B) {
+	openTestDB(b)
+	withRelayKey(b)
+	prev := groupGuestsAllowed
+	groupGuestsAllowed = true
+	b.Cleanup(func() { groupGuestsAllowed = prev })
+	ctx := context.Background()
+	adminSK := nostr.GeneratePrivateKey()
+	const cohort = 80
+
+	for _, bc := range []struct {
+		name   string
+		settle time.Duration
+	}{{"each", 0}, {"settled", time.Hour}} {
+		b.Run(bc.name, func(b *testing.B) {
+			signed := relayEventsSigned.Value()
+			for i := 0; i < b.N; i++ {
+				groupId := fmt.Sprintf("%s-%d", bc.name, i)
+				now := nostr.Now()
+				if err := storeGroupEvent(ctx, signedEvent(b, adminSK, KindCreateGroup, now, nostr.Tags{{"h", groupId}}, "")); err != nil {
+					b.Fatal(err)
+				}
+				for _, pk := range pubkeys(cohort) {
+					put := signedEvent(b, adminSK, KindPutUser, now, nostr.Tags{{"h", groupId}, {"p", pk}}, "")
+					if err := storeGroupEvent(ctx, put); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := syncGroupsSettled(ctx, bc.settle); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := syncGroups(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(relayEventsSigned.Value()-signed)/float64(b.N), "signatures/op")
+		})
+	}
+}
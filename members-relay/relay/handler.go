@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// APP HANDLER (NIP-89)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// So generic clients know to open recipe naddrs in zap.cooking, the relay
+// maintains a kind 31990 handler information event for kind 30023 and a kind
+// 31989 recommendation pointing at it, both signed by the relay key, and
+// pushes them to public relays. Both are derived from configuration at
+// startup: unchanged config reuses the stored events, changed config signs
+// replacements, and relay_state remembers which versions reached which
+// relays so nothing is re-pushed needlessly. Because they are rebuilt from
+// config, the events come back on their own after a database loss.
+
+const (
+	KindHandlerRecommendation = 31989
+	KindHandlerInformation    = 31990
+
+	handlerPublishedKey = "nip89_published"
+)
+
+type handlerConfig struct {
+	Identifier  string // d tag of the 31990
+	WebTemplate string // URL with <bech32> where the naddr goes
+	Name        string
+	About       string
+	Picture     string
+	Relays      []string // public relays to push to
+}
+
+// appHandler is disabled when WebTemplate is empty.
+var appHandler handlerConfig
+
+func loadHandlerConfig() {
+	appHandler = handlerConfig{
+		Identifier:  envOr("RELAY_HANDLER_ID", "zap.cooking"),
+		WebTemplate: envOr("RELAY_HANDLER_WEB_TEMPLATE", "https://zap.cooking/recipe/<bech32>"),
+		Name:        envOr("RELAY_HANDLER_NAME", "zap.cooking"),
+		About:       envOr("RELAY_HANDLER_ABOUT", "Recipes on Nostr"),
+		Picture:     envOr("RELAY_HANDLER_PICTURE", "https://zap.cooking/logo.png"),
+		Relays:      splitList(envOr("RELAY_HANDLER_PUBLISH_RELAYS", "wss://relay.damus.io,wss://nos.lol,wss://relay.nostr.band")),
+	}
+}
+
+// handlerEvents returns the unsigned 31990 and 31989 described by cfg.
+func handlerEvents(cfg handlerConfig) (info, recommendation nostr.Event) {
+	metadata, _ := json.Marshal(map[string]string{"name": cfg.Name, "about": cfg.About, "picture": cfg.Picture})
+	kind := fmt.Sprint(KindRecipe)
+	info = nostr.Event{
+		Kind:    KindHandlerInformation,
+		Content: string(metadata),
+		Tags: nostr.Tags{
+			{"d", cfg.Identifier},
+			{"k", kind},
+			{"web", cfg.WebTemplate, "naddr"},
+		},
+	}
+	address := fmt.Sprintf("%d:%s:%s", KindHandlerInformation, relaySigningPubkey, cfg.Identifier)
+	aTag := nostr.Tag{"a", address}
+	if len(cfg.Relays) > 0 {
+		aTag = append(aTag, cfg.Relays[0], "web")
+	}
+	recommendation = nostr.Event{
+		Kind: KindHandlerRecommendation,
+		Tags: nostr.Tags{{"d", kind}, aTag},
+	}
+	return info, recommendation
+}
+
+// currentRelayEvent loads the relay's stored version of an addressable event.
+func currentRelayEvent(ctx context.Context, kind int, d string) (*nostr.Event, error) {
+	var raw []byte
+	err := db.QueryRowContext(ctx,
+		"SELECT raw FROM events WHERE kind = $1 AND pubkey = $2 AND d_tag = $3",
+		kind, relaySigningPubkey, d).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var event nostr.Event
+	return &event, json.Unmarshal(raw, &event)
+}
+
+// ensureRelayEvent returns the stored version of want if its content and
+// tags already match, and otherwise signs and stores want.
+func ensureRelayEvent(ctx context.Context, want nostr.Event) (*nostr.Event, error) {
+	stored, err := currentRelayEvent(ctx, want.Kind, want.Tags.GetD())
+	if err != nil {
+		return nil, err
+	}
+	if stored != nil && stored.Content == want.Content && reflect.DeepEqual(stored.Tags, want.Tags) {
+		return stored, nil
+	}
+	if err := signRelayEvent(&want); err != nil {
+		return nil, err
+	}
+	return &want, persistEvent(ctx, &want)
+}
+
+// publishHandler makes sure the configured handler events are stored and
+// pushed to cfg.Relays. publish sends one event and returns an error unless
+// at least one relay accepted it.
+func publishHandler(ctx context.Context, cfg handlerConfig,
+	publish func(context.Context, []string, nostr.Event) error) error {
+	info, recommendation := handlerEvents(cfg)
+	var events []*nostr.Event
+	for _, want := range []nostr.Event{info, recommendation} {
+		event, err := ensureRelayEvent(ctx, want)
+		if err != nil {
+			return err
+		}
+		events = append(events, event)
+	}
+
+	fingerprint := events[0].ID + " " + events[1].ID + " " + strings.Join(cfg.Relays, ",")
+	var published string
+	err := db.QueryRowContext(ctx, "SELECT value FROM relay_state WHERE key = $1", handlerPublishedKey).Scan(&published)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if published == fingerprint || len(cfg.Relays) == 0 {
+		return nil
+	}
+
+	for _, event := range events {
+		if err := publish(ctx, cfg.Relays, *event); err != nil {
+			return fmt.Errorf("kind %d: %w", event.Kind, err)
+		}
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO relay_state (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value
+	`, handlerPublishedKey, fingerprint)
+	if err == nil {
+		log.Printf("[NIP-89] Published handler %q to %d relays", cfg.Identifier, len(cfg.Relays))
+	}
+	return err
+}
+
+// poolPublisher pushes an event to every relay and succeeds if at least one
+// of them accepted it.
+func poolPublisher() func(context.Context, []string, nostr.Event) error {
+	pool := nostr.NewSimplePool(context.Background())
+	return func(ctx context.Context, urls []string, event nostr.Event) error {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		var errs []error
+		accepted := false
+		for res := range pool.PublishMany(ctx, urls, event) {
+			if res.Error != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", res.RelayURL, res.Error))
+				continue
+			}
+			accepted = true
+		}
+		if accepted {
+			return nil
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// runHandlerPublisher publishes the handler at startup, retrying hourly
+// until it goes through.
+func runHandlerPublisher(ctx context.Context) {
+	if appHandler.WebTemplate == "" || !canSignRelayEvents() {
+		return
+	}
+	publish := poolPublisher()
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		err := publishHandler(ctx, appHandler, publish)
+		if err == nil {
+			return
+		}
+		log.Printf("[NIP-89] Error publishing handler: %v", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPublishHandlerIsIdempotent(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "DELETE FROM relay_state WHERE key = $1", handlerPublishedKey); err != nil {
+		t.Fatal(err)
+	}
+
+	var pushed []nostr.Event
+	publish := func(_ context.Context, _ []string, event nostr.Event) error {
+		pushed = append(pushed, event)
+		return nil
+	}
+	cfg := handlerConfig{Identifier: "zap.cooking", WebTemplate: "https://zap.cooking/recipe/<bech32>",
+		Name: "zap.cooking", Relays: []string{"wss://relay.example"}}
+
+	if err := publishHandler(ctx, cfg, publish); err != nil {
+		t.Fatal(err)
+	}
+	if len(pushed) != 2 || pushed[0].Kind != KindHandlerInformation || pushed[1].Kind != KindHandlerRecommendation {
+		t.Fatalf("pushed %v", pushed)
+	}
+	first := pushed[0].ID
+
+	// Same config: nothing re-signed, nothing re-pushed.
+	if err := publishHandler(ctx, cfg, publish); err != nil || len(pushed) != 2 {
+		t.Fatalf("republished unchanged handler (%d pushes, %v)", len(pushed), err)
+	}
+
+	// A new template replaces the stored 31990 and pushes again.
+	cfg.WebTemplate = "https://zap.cooking/r/<bech32>"
+	if err := publishHandler(ctx, cfg, publish); err != nil || len(pushed) != 4 {
+		t.Fatalf("changed handler not pushed (%d pushes, %v)", len(pushed), err)
+	}
+	if pushed[2].ID == first {
+		t.Fatal("changed template reused the old event")
+	}
+	stored, err := currentRelayEvent(ctx, KindHandlerInformation, "zap.cooking")
+	if err != nil || stored == nil || stored.ID != pushed[2].ID {
+		t.Fatalf("stored handler %v (%v)", stored, err)
+	}
+
+	// A failed push is retried on the next run.
+	cfg.Relays = []string{"wss://other.example"}
+	failing := func(context.Context, []string, nostr.Event) error { return errors.New("offline") }
+	if err := publishHandler(ctx, cfg, failing); err == nil {
+		t.Fatal("expected push failure")
+	}
+	if err := publishHandler(ctx, cfg, publish); err != nil || len(pushed) != 6 {
+		t.Fatalf("failed push not retried (%d pushes, %v)", len(pushed), err)
+	}
+}
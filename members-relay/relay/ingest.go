@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// BULK INGESTION
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Bulk ingestion bypasses the websocket policy stack and NIP-29 side effects:
+// it is meant for backfills and imports of already-trusted data, where the
+// per-statement cost of persistEvent dominates. Signatures are still verified.
+
+const defaultIngestBatchSize = 5000
+
+type ingestStats struct {
+	Read     int
+	Invalid  int
+	Inserted int64
+}
+
+// verifyEvents checks ids and signatures across a pool of workers and returns
+// only the events that pass.
+func verifyEvents(events []*nostr.Event, workers int) []*nostr.Event {
+	if workers < 1 {
+		workers = 1
+	}
+	ok := make([]bool, len(events))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				evt := events[i]
+				if !evt.CheckID() {
+					continue
+				}
+				if valid, err := evt.CheckSignature(); err == nil && valid {
+					ok[i] = true
+				}
+			}
+		}()
+	}
+	for i := range events {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	verified := events[:0:0]
+	for i, evt := range events {
+		if ok[i] {
+			verified = append(verified, evt)
+		}
+	}
+	return verified
+}
+
+// bulkIngest COPYs events into a transaction-scoped staging table and merges
+// them into events, in ctx's community, with a single INSERT ... SELECT.
+// Addressable and replaceable events keep persistEvent's semantics: only the
+// newest version per (kind, pubkey, d_tag), or per (kind, pubkey), in the
+// community survives, whether the competing version is staged or already
+// stored.
+func bulkIngest(ctx context.Context, events []*nostr.Event) (int64, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+	community := communityOf(ctx).id()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		CREATE TEMP TABLE events_staging (LIKE events INCLUDING DEFAULTS) ON COMMIT DROP
+	`); err != nil {
+		return 0, fmt.Errorf("create staging table: %w", err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("events_staging",
+		"id", "pubkey", "kind", "created_at", "content", "tags", "sig", "d_tag", "expires_at", "raw", "community"))
+	if err != nil {
+		return 0, fmt.Errorf("prepare copy: %w", err)
+	}
+	for _, event := range events {
+		if isEphemeralKind(event.Kind) {
+			continue
+		}
+		rawJSON, err := json.Marshal(event)
+		if err != nil {
+			stmt.Close()
+			return 0, err
+		}
+		tagsJSON, _ := json.Marshal(event.Tags)
+
+		// COPY encodes []byte as bytea, so JSON columns go in as strings.
+		var dTag, expiresAt interface{}
+		if d := addressableDTag(event); d != nil {
+			dTag = *d
+		}
+		if exp, err := eventExpiration(event); err == nil && exp != 0 {
+			expiresAt = int64(exp)
+		}
+		if _, err := stmt.ExecContext(ctx, event.ID, event.PubKey, event.Kind,
+			int64(event.CreatedAt), event.Content, string(tagsJSON),
+			event.Sig, dTag, expiresAt, string(rawJSON), community); err != nil {
+			stmt.Close()
+			return 0, fmt.Errorf("copy row: %w", err)
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return 0, fmt.Errorf("flush copy: %w", err)
+	}
+	if err := stmt.Close(); err != nil {
+		return 0, err
+	}
+
+	// Drop stored versions superseded by a staged one. On equal created_at
+	// the lowest id wins (NIP-01). Replaceable kinds have no d_tag.
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM events e
+		USING events_staging s
+		WHERE (s.d_tag IS NOT NULL OR `+replaceableKindSQL("s")+`)
+		AND e.kind = s.kind AND e.pubkey = s.pubkey AND e.d_tag IS NOT DISTINCT FROM s.d_tag
+		AND e.community = s.community
+		AND (e.created_at < s.created_at OR (e.created_at = s.created_at AND e.id > s.id))
+	`); err != nil {
+		return 0, fmt.Errorf("replace superseded versions: %w", err)
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO events (id, pubkey, kind, created_at, content, tags, sig, d_tag, expires_at, raw, community)
+		SELECT id, pubkey, kind, created_at, content, tags, sig, d_tag, expires_at, raw, community FROM (
+			(SELECT DISTINCT ON (id) * FROM events_staging s
+			WHERE d_tag IS NULL AND NOT `+replaceableKindSQL("s")+`)
+			UNION ALL
+			(SELECT DISTINCT ON (kind, pubkey, d_tag) * FROM events_staging
+			WHERE d_tag IS NOT NULL
+			ORDER BY kind, pubkey, d_tag, created_at DESC, id)
+			UNION ALL
+			(SELECT DISTINCT ON (kind, pubkey) * FROM events_staging s
+			WHERE `+replaceableKindSQL("s")+`
+			ORDER BY kind, pubkey, created_at DESC, id)
+		) s
+		WHERE (s.d_tag IS NULL AND NOT `+replaceableKindSQL("s")+`) OR NOT EXISTS (
+			SELECT 1 FROM events e
+			WHERE e.kind = s.kind AND e.pubkey = s.pubkey AND e.d_tag IS NOT DISTINCT FROM s.d_tag
+			AND e.community = s.community
+			AND (e.created_at > s.created_at OR (e.created_at = s.created_at AND e.id <= s.id))
+		)
+		ON CONFLICT DO NOTHING
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("merge staging: %w", err)
+	}
+	inserted, _ := res.RowsAffected()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO event_tags (event_id, tag_name, tag_value)
+		SELECT s.id, t->>0, `+tagIndexSQL+`
+		FROM events_staging s, jsonb_array_elements(s.tags) t
+		WHERE EXISTS (SELECT 1 FROM events e WHERE e.id = s.id)
+		AND jsonb_typeof(t) = 'array'
+		AND octet_length(t->>0) = 1
+		AND t->>1 IS NOT NULL
+		AND octet_length(t->>1) <= $1
+		ON CONFLICT DO NOTHING
+	`, maxIndexedTagValue); err != nil {
+		return 0, fmt.Errorf("index tags: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return inserted, nil
+}
+
+// addressableDTag returns the d tag value for kinds 30000-39999, or nil.
+func addressableDTag(event *nostr.Event) *string {
+	if event.Kind < 30000 || event.Kind >= 40000 {
+		return nil
+	}
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "d" {
+			return &tag[1]
+		}
+	}
+	return nil
+}
+
+// ingestJSONL streams newline-delimited events from r in batches.
+func ingestJSONL(ctx context.Context, r io.Reader, batchSize, workers int) (ingestStats, error) {
+	var stats ingestStats
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 8*1024*1024)
+
+	batch := make([]*nostr.Event, 0, batchSize)
+	flush := func() error {
+		verified := verifyEvents(batch, workers)
+		stats.Invalid += len(batch) - len(verified)
+		n, err := bulkIngest(ctx, verified)
+		stats.Inserted += n
+		batch = batch[:0]
+		return err
+	}
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		stats.Read++
+		var event nostr.Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			stats.Invalid++
+			continue
+		}
+		batch = append(batch, &event)
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// runImport implements `relay import [-batch N] [-workers N] <file.jsonl|->`.
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	batchSize := fs.Int("batch", defaultIngestBatchSize, "events per COPY batch")
+	workers := fs.Int("workers", runtime.NumCPU(), "signature verification workers")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: relay import [-batch N] [-workers N] <file.jsonl|->")
+	}
+
+	in := os.Stdin
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", path, err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	initDB()
+	defer db.Close()
+
+	start := time.Now()
+	stats, err := ingestJSONL(context.Background(), in, *batchSize, *workers)
+	elapsed := time.Since(start)
+	log.Printf("[import] read %d, invalid %d, inserted %d in %s (%.0f events/s)",
+		stats.Read, stats.Invalid, stats.Inserted, elapsed.Round(time.Millisecond),
+		float64(stats.Read)/elapsed.Seconds())
+	if err != nil {
+		log.Fatalf("[import] failed: %v", err)
+	}
+}
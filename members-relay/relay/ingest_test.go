@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// generateRecipeCorpus produces n distinct signed kind 30023 events.
+func generateRecipeCorpus(tb testing.TB, n int) []*nostr.Event {
+	sk := nostr.GeneratePrivateKey()
+	base := nostr.Now()
+	events := make([]*nostr.Event, n)
+	for i := range events {
+		events[i] = signedEvent(tb, sk, KindRecipe, base+nostr.Timestamp(i),
+			nostr.Tags{{"d", fmt.Sprintf("bench-recipe-%d-%d", base, i)}, {"title", "Bench"}},
+			"# Sourdough\n\nFlour, water, salt.")
+	}
+	return events
+}
+
+func TestVerifyEventsDropsTampered(t *testing.T) {
+	events := generateRecipeCorpus(t, 20)
+	events[3].Content = "tampered"
+	events[11].Sig = events[12].Sig
+
+	verified := verifyEvents(events, 4)
+	if len(verified) != 18 {
+		t.Fatalf("expected 18 verified events, got %d", len(verified))
+	}
+	for _, evt := range verified {
+		if evt == events[3] || evt == events[11] {
+			t.Fatalf("tampered event %s passed verification", evt.ID)
+		}
+	}
+}
+
+const benchCorpusSize = 2000
+
+func BenchmarkIngestSerial(b *testing.B) {
+	openTestDB(b)
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		corpus := generateRecipeCorpus(b, benchCorpusSize)
+		b.StartTimer()
+		for _, evt := range corpus {
+			if ok, _ := evt.CheckSignature(); !ok {
+				b.Fatal("bad signature in corpus")
+			}
+			if err := persistEvent(ctx, evt); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(benchCorpusSize*b.N)/b.Elapsed().Seconds(), "events/s")
+}
+
+func BenchmarkIngestBulk(b *testing.B) {
+	openTestDB(b)
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		corpus := generateRecipeCorpus(b, benchCorpusSize)
+		b.StartTimer()
+		verified := verifyEvents(corpus, runtime.NumCPU())
+		if _, err := bulkIngest(ctx, verified); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(benchCorpusSize*b.N)/b.Elapsed().Seconds(), "events/s")
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// JOIN REQUESTS AND INVITES (NIP-29)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// A join request (kind 9021) to an open group admits the member at once. A
+// closed group (is_open = false) admits them only with an invite code in a
+// ["code", ...] tag. Without one the request is stored and waits in
+// pending_joins, and the client's OK says "pending: join request awaiting
+// approval". A group admin's put-user (kind 9000) is what admits them and
+// clears the request; a remove-user (kind 9001) naming them turns it down.
+// A second request from a member, or from someone whose request is still
+// waiting, is refused with a "duplicate:" message and not stored, unless it
+// brings an invite code; the same holds under the group lock, so a
+// double-click or a request replayed from a backup changes nothing.
+//
+// Group admins issue codes with a create-invite (kind 9009). Its code tag
+// names the code, or the code is the first inviteCodeLength characters of
+// the event id. A max_uses tag sets how many joins it admits (one by
+// default) and a NIP-40 expiration tag when it stops working. Each join
+// redeems one use in the transaction that admits the member, so a one-use
+// code admits one member however many requests race for it. An expired,
+// exhausted or unknown code is refused with "invalid: invite code not
+// valid". Deleting the 9009 revokes the code.
+//
+// GET /api/groups/pending?group=<id> lists a group's waiting requests for
+// its admins (NIP-98).
+
+const (
+	// inviteCodeLength is the length of codes taken from the event id.
+	inviteCodeLength = 12
+	// maxInviteCodeLength bounds codes admins choose.
+	maxInviteCodeLength = 64
+)
+
+var (
+	// errJoinPending is handleJoinRequest's answer for a request now
+	// waiting for approval. The request is stored all the same.
+	errJoinPending = errors.New("join request awaiting approval")
+	// errInviteInvalid is its answer for a code that cannot be redeemed
+	// (any more); nothing is stored.
+	errInviteInvalid = errors.New("invite code not valid")
+	// errAlreadyMember and errJoinDuplicate are its answers for a request
+	// from a member and a second request still waiting; nothing is stored.
+	errAlreadyMember = errors.New("already a group member")
+	errJoinDuplicate = errors.New("join request already waiting")
+)
+
+// inviteCode is the code a create-invite issues.
+func inviteCode(event *nostr.Event) string {
+	if tag := event.Tags.GetFirst([]string{"code", ""}); tag != nil {
+		return (*tag)[1]
+	}
+	if len(event.ID) < inviteCodeLength {
+		return event.ID
+	}
+	return event.ID[:inviteCodeLength]
+}
+
+// inviteMaxUses is the number of joins a create-invite admits.
+func inviteMaxUses(event *nostr.Event) (int, error) {
+	tag := event.Tags.GetFirst([]string{"max_uses", ""})
+	if tag == nil {
+		return 1, nil
+	}
+	n, err := strconv.Atoi((*tag)[1])
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("max_uses %q is not a positive number", (*tag)[1])
+	}
+	return n, nil
+}
+
+// rejectInvite checks a create-invite from a group admin of groupId.
+func rejectInvite(ctx context.Context, event *nostr.Event, groupId string) (bool, string) {
+	code := inviteCode(event)
+	if _, err := inviteMaxUses(event); err != nil || code == "" || len(code) > maxInviteCodeLength {
+		return true, say(ctx, msgInviteTags, maxInviteCodeLength)
+	}
+	var taken bool
+	if err := db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM invites WHERE group_id = $1 AND code = $2)",
+		groupId, code).Scan(&taken); err != nil {
+		log.Printf("[NIP-29] Error checking invite code for %s: %v", groupId, err)
+		return true, say(ctx, msgEventLookupFailed)
+	}
+	if taken {
+		return true, say(ctx, msgInviteCodeTaken)
+	}
+	return false, ""
+}
+
+// rejectInviteCode refuses a join request naming a code that cannot be
+// redeemed now. Redemption itself is handleJoinRequest's.
+func rejectInviteCode(ctx context.Context, event *nostr.Event, groupId string) (bool, string) {
+	tag := event.Tags.GetFirst([]string{"code", ""})
+	if tag == nil {
+		return false, ""
+	}
+	var usable bool
+	if err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM invites WHERE group_id = $1 AND code = $2 AND `+inviteUsableCondition+`)
+	`, groupId, (*tag)[1]).Scan(&usable); err != nil {
+		log.Printf("[NIP-29] Error checking invite code for %s: %v", groupId, err)
+		return true, say(ctx, msgEventLookupFailed)
+	}
+	if !usable {
+		return true, say(ctx, msgInviteInvalid)
+	}
+	return false, ""
+}
+
+// joinState reports whether pubkey is in groupId and whether a request of
+// theirs is waiting there, read through q.
+func joinState(ctx context.Context, q rowQueryer, groupId, pubkey string) (member, waiting bool, err error) {
+	err = q.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM group_members WHERE group_id = $1 AND pubkey = $2),
+			EXISTS (SELECT 1 FROM pending_joins WHERE group_id = $1 AND pubkey = $2)
+	`, groupId, pubkey).Scan(&member, &waiting)
+	return member, waiting, err
+}
+
+// rejectDuplicateJoin refuses a join request without a code from someone
+// whose earlier request to groupId is still waiting.
+func rejectDuplicateJoin(ctx context.Context, event *nostr.Event, groupId string) (bool, string) {
+	if event.Tags.GetFirst([]string{"code", ""}) != nil {
+		return false, ""
+	}
+	_, waiting, err := joinState(ctx, db, groupId, event.PubKey)
+	if err != nil {
+		log.Printf("[NIP-29] Error checking join requests of %s for %s: %v", event.PubKey, groupId, err)
+		return true, say(ctx, msgEventLookupFailed)
+	}
+	if waiting {
+		return true, say(ctx, msgJoinDuplicate)
+	}
+	return false, ""
+}
+
+// inviteUsableCondition matches invites with uses left that have not
+// expired.
+const inviteUsableCondition = "uses_left > 0 AND (expires_at IS NULL OR expires_at > EXTRACT(EPOCH FROM NOW())::bigint)"
+
+func handleCreateInvite(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	groupId := getHTag(event)
+	maxUses, err := inviteMaxUses(event)
+	if groupId == "" || err != nil {
+		return nil
+	}
+	var expiresAt *int64
+	if expiration, err := eventExpiration(event); err == nil && expiration != 0 {
+		at := int64(expiration)
+		expiresAt = &at
+	}
+
+	log.Printf("[NIP-29] Invite to group %s for %d join(s) (by %s)", groupId, maxUses, event.PubKey)
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO invites (group_id, code, event_id, creator, max_uses, uses_left, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $5, $6)
+	`, groupId, inviteCode(event), event.ID, event.PubKey, maxUses, expiresAt)
+	if err != nil {
+		return fmt.Errorf("create invite: %w", err)
+	}
+	return nil
+}
+
+// redeemInvite uses up one join of code, or returns errInviteInvalid.
+func redeemInvite(ctx context.Context, tx *sql.Tx, groupId, code string) error {
+	res, err := tx.ExecContext(ctx, `
+		UPDATE invites SET uses_left = uses_left - 1
+		WHERE group_id = $1 AND code = $2 AND `+inviteUsableCondition,
+		groupId, code)
+	if err != nil {
+		return fmt.Errorf("redeem invite: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errInviteInvalid
+	}
+	return nil
+}
+
+// needsApproval reports whether event, a join request, must wait for a
+// group admin. A code it carries is redeemed.
+func needsApproval(ctx context.Context, tx *sql.Tx, groupId string, event *nostr.Event) (bool, error) {
+	var open bool
+	if err := tx.QueryRowContext(ctx, "SELECT is_open FROM groups WHERE id = $1", groupId).Scan(&open); err != nil {
+		return false, fmt.Errorf("fetch group: %w", err)
+	}
+	if open {
+		return false, nil
+	}
+	tag := event.Tags.GetFirst([]string{"code", ""})
+	if tag == nil {
+		return true, nil
+	}
+	return false, redeemInvite(ctx, tx, groupId, (*tag)[1])
+}
+
+func queuePendingJoin(ctx context.Context, tx *sql.Tx, groupId string, event *nostr.Event) error {
+	log.Printf("[NIP-29] Join request from %s for closed group %s awaits approval", event.PubKey, groupId)
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO pending_joins (group_id, pubkey, event_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (group_id, pubkey) DO UPDATE SET event_id = $3, requested_at = NOW()
+	`, groupId, event.PubKey, event.ID)
+	if err != nil {
+		return fmt.Errorf("queue join request: %w", err)
+	}
+	return errJoinPending
+}
+
+// clearPendingJoin drops pubkey's waiting request to groupId, admitted or
+// turned down.
+func clearPendingJoin(ctx context.Context, tx *sql.Tx, groupId, pubkey string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM pending_joins WHERE group_id = $1 AND pubkey = $2", groupId, pubkey)
+	return err
+}
+
+type pendingJoin struct {
+	Pubkey      string       `json:"pubkey"`
+	RequestedAt time.Time    `json:"requested_at"`
+	Event       *nostr.Event `json:"event,omitempty"`
+}
+
+// pendingJoins returns groupId's waiting requests, oldest first.
+func pendingJoins(ctx context.Context, groupId string) ([]pendingJoin, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.pubkey, p.requested_at, e.raw
+		FROM pending_joins p LEFT JOIN events e ON e.id = p.event_id
+		WHERE p.group_id = $1
+		ORDER BY p.requested_at
+	`, groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	joins := []pendingJoin{}
+	for rows.Next() {
+		var j pendingJoin
+		var raw []byte
+		if err := rows.Scan(&j.Pubkey, &j.RequestedAt, &raw); err != nil {
+			return nil, err
+		}
+		if raw != nil {
+			j.Event = &nostr.Event{}
+			if err := j.Event.UnmarshalJSON(raw); err != nil {
+				return nil, err
+			}
+		}
+		joins = append(joins, j)
+	}
+	return joins, rows.Err()
+}
+
+// registerJoinAPI mounts GET /api/groups/pending?group=<id> (NIP-98, admins
+// of the group).
+func registerJoinAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/api/groups/pending", memberAPI(func(w http.ResponseWriter, r *http.Request, pubkey string) {
+		groupId := r.URL.Query().Get("group")
+		if !isGroupAdmin(r.Context(), groupId, pubkey) {
+			httpError(w, r, pubkey, http.StatusForbidden, msgGroupAdminRequired)
+			return
+		}
+		joins, err := pendingJoins(r.Context(), groupId)
+		writeAPIResult(w, map[string]interface{}{"pending": joins}, err)
+	}))
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestClosedGroupJoinRequests(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	keys := map[string]string{}
+	pk := map[string]string{}
+	for _, name := range []string{"admin", "waiting", "invited", "guesser", "other"} {
+		keys[name] = nostr.GeneratePrivateKey()
+		pk[name], _ = nostr.GetPublicKey(keys[name])
+		addTestMember(t, pk[name])
+	}
+	now := nostr.Now()
+	applyGroupEvent(t, signedEvent(t, keys["admin"], KindCreateGroup, now, nostr.Tags{{"h", "club"}}, ""))
+	applyGroupEvent(t, signedEvent(t, keys["admin"], KindCreateInvite, now, nostr.Tags{{"h", "club"}, {"code", "levain"}}, ""))
+
+	inGroup := func(name string) bool {
+		t.Helper()
+		var n int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM group_members WHERE group_id = 'club' AND pubkey = $1", pk[name]).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n == 1
+	}
+	waiting := func() []string {
+		t.Helper()
+		joins, err := pendingJoins(ctx, "club")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, j := range joins {
+			got = append(got, j.Pubkey)
+		}
+		return got
+	}
+	askToJoin := func(name string, tags nostr.Tags) error {
+		t.Helper()
+		return storeEvent(ctx, signedEvent(t, keys[name], KindJoinRequest, now, append(nostr.Tags{{"h", "club"}}, tags...), ""))
+	}
+
+	if err := askToJoin("waiting", nil); err == nil || err.Error() != "pending: join request awaiting approval" {
+		t.Fatalf("join request without an invite: %v", err)
+	}
+	if err := askToJoin("guesser", nostr.Tags{{"code", "sourdough"}}); err == nil || !strings.HasPrefix(err.Error(), "pending:") {
+		t.Fatalf("join request with a wrong code: %v", err)
+	}
+	if inGroup("waiting") || inGroup("guesser") {
+		t.Fatal("closed group admitted a request without a valid invite")
+	}
+	if got := waiting(); len(got) != 2 || got[0] != pk["waiting"] || got[1] != pk["guesser"] {
+		t.Fatalf("pending %v", got)
+	}
+	applyGroupEvent(t, signedEvent(t, keys["invited"], KindJoinRequest, now, nostr.Tags{{"h", "club"}, {"code", "levain"}}, ""))
+	if !inGroup("invited") {
+		t.Fatal("valid invite code not honored")
+	}
+
+	mux := http.NewServeMux()
+	registerJoinAPI(mux)
+	list := func(name string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/api/groups/pending?group=club", nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "members.zap.cooking")
+		r.Header.Set("Authorization", nip98Header(t, keys[name], "https://members.zap.cooking/api/groups/pending?group=club", "GET", nostr.Now()))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	if w := list("invited"); w.Code != http.StatusForbidden {
+		t.Fatalf("pending list for a plain member: %d", w.Code)
+	}
+	w := list("admin")
+	var body struct{ Pending []pendingJoin }
+	if err := json.Unmarshal(w.Body.Bytes(), &body); w.Code != http.StatusOK || err != nil ||
+		len(body.Pending) != 2 || body.Pending[0].Event == nil || body.Pending[0].Event.Kind != KindJoinRequest {
+		t.Fatalf("pending list for the admin: %d %s", w.Code, w.Body)
+	}
+
+	applyGroupEvent(t, signedEvent(t, keys["admin"], KindPutUser, now+1, nostr.Tags{{"h", "club"}, {"p", pk["waiting"]}}, ""))
+	applyGroupEvent(t, signedEvent(t, keys["admin"], KindRemoveUser, now+1, nostr.Tags{{"h", "club"}, {"p", pk["guesser"]}}, ""))
+	if !inGroup("waiting") || inGroup("guesser") {
+		t.Fatal("admin's decisions not applied")
+	}
+	if got := waiting(); len(got) != 0 {
+		t.Fatalf("requests still pending after the admin decided: %v", got)
+	}
+
+	applyGroupEvent(t, signedEvent(t, keys["admin"], KindPutGroupStatus, now+2, nostr.Tags{{"h", "club"}, {"open"}}, ""))
+	applyGroupEvent(t, signedEvent(t, keys["other"], KindJoinRequest, now+2, nostr.Tags{{"h", "club"}}, ""))
+	if !inGroup("other") {
+		t.Fatal("open group did not auto-approve")
+	}
+}
+
+func TestInviteTags(t *testing.T) {
+	id := strings.Repeat("ab", 32)
+	if got := inviteCode(&nostr.Event{ID: id, Tags: nostr.Tags{{"h", "club"}, {"code", "levain"}}}); got != "levain" {
+		t.Errorf("code tag: %q", got)
+	}
+	if got := inviteCode(&nostr.Event{ID: id, Tags: nostr.Tags{{"h", "club"}}}); got != id[:inviteCodeLength] {
+		t.Errorf("code from the id: %q", got)
+	}
+	for _, tc := range []struct {
+		tags nostr.Tags
+		want int
+		ok   bool
+	}{
+		{nil, 1, true},
+		{nostr.Tags{{"max_uses", "12"}}, 12, true},
+		{nostr.Tags{{"max_uses", "0"}}, 0, false},
+		{nostr.Tags{{"max_uses", "-3"}}, 0, false},
+		{nostr.Tags{{"max_uses", "lots"}}, 0, false},
+	} {
+		got, err := inviteMaxUses(&nostr.Event{Tags: tc.tags})
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("%v: %d, %v", tc.tags, got, err)
+		}
+	}
+}
+
+// Five members race to redeem a one-use code; one joins.
+func TestConcurrentInviteRedemption(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, nostr.Tags{{"h", "club"}}, ""))
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateInvite, now, nostr.Tags{{"h", "club"}, {"code", "one-loaf"}}, ""))
+
+	const racers = 5
+	errs := make(chan error, racers)
+	for i := 0; i < racers; i++ {
+		join := signedEvent(t, nostr.GeneratePrivateKey(), KindJoinRequest, now, nostr.Tags{{"h", "club"}, {"code", "one-loaf"}}, "")
+		go func() { errs <- storeGroupEvent(ctx, join) }()
+	}
+	joined := 0
+	for i := 0; i < racers; i++ {
+		switch err := <-errs; {
+		case err == nil:
+			joined++
+		case !errors.Is(err, errInviteInvalid):
+			t.Errorf("redemption failed: %v", err)
+		}
+	}
+	var members int
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM group_members WHERE group_id = 'club' AND role = 'member'").Scan(&members)
+	if joined != 1 || members != 1 {
+		t.Fatalf("%d redemptions succeeded and %d members joined, want 1", joined, members)
+	}
+
+	late := signedEvent(t, nostr.GeneratePrivateKey(), KindJoinRequest, now, nostr.Tags{{"h", "club"}, {"code", "one-loaf"}}, "")
+	if reject, msg := rejectInviteCode(ctx, late, "club"); !reject || msg != "invalid: invite code not valid" {
+		t.Fatalf("exhausted code: %v %q", reject, msg)
+	}
+
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateInvite, now, nostr.Tags{{"h", "club"}, {"code", "expired"}, {"max_uses", "10"}}, ""))
+	if _, err := db.ExecContext(ctx, "UPDATE invites SET expires_at = EXTRACT(EPOCH FROM NOW())::bigint - 60 WHERE code = 'expired'"); err != nil {
+		t.Fatal(err)
+	}
+	stale := signedEvent(t, nostr.GeneratePrivateKey(), KindJoinRequest, now, nostr.Tags{{"h", "club"}, {"code", "expired"}}, "")
+	if reject, msg := rejectInviteCode(ctx, stale, "club"); !reject || msg != "invalid: invite code not valid" {
+		t.Fatalf("expired code: %v %q", reject, msg)
+	}
+	if reject, _ := rejectInvite(ctx, signedEvent(t, adminSK, KindCreateInvite, now, nostr.Tags{{"h", "club"}, {"code", "expired"}}, ""), "club"); !reject {
+		t.Fatal("code issued twice for the group")
+	}
+}
+
+// The same signed join request sent twice, to an open and to a closed
+// group, leaves one membership or one waiting request and one stored
+// event; the policy turns away a second request while one waits.
+func TestDuplicateJoinRequests(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK, joinerSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	joiner, _ := nostr.GetPublicKey(joinerSK)
+	addTestMember(t, joiner)
+	now := nostr.Now()
+	for _, id := range []string{"open-club", "closed-club"} {
+		applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, nostr.Tags{{"h", id}}, ""))
+	}
+	applyGroupEvent(t, signedEvent(t, adminSK, KindPutGroupStatus, now, nostr.Tags{{"h", "open-club"}, {"open"}}, ""))
+	count := func(query, groupId string) int {
+		t.Helper()
+		var n int
+		if err := db.QueryRowContext(ctx, query, groupId, joiner).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	const storedJoins = `SELECT COUNT(*) FROM events e JOIN event_tags h ON h.event_id = e.id AND h.tag_name = 'h'
+		WHERE h.tag_value = $1 AND e.pubkey = $2 AND e.kind = 9021`
+
+	open := signedEvent(t, joinerSK, KindJoinRequest, now, nostr.Tags{{"h", "open-club"}}, "")
+	if err := storeEvent(ctx, open); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeEvent(ctx, open); err == nil || !strings.HasPrefix(err.Error(), "duplicate:") {
+		t.Fatalf("replayed join to an open group: %v", err)
+	}
+	if n := count("SELECT COUNT(*) FROM group_members WHERE group_id = $1 AND pubkey = $2", "open-club"); n != 1 {
+		t.Fatalf("%d memberships", n)
+	}
+	if n := count(storedJoins, "open-club"); n != 1 {
+		t.Fatalf("%d join requests stored for the open group", n)
+	}
+
+	closed := signedEvent(t, joinerSK, KindJoinRequest, now, nostr.Tags{{"h", "closed-club"}}, "")
+	for i, want := range []string{"pending: join request awaiting approval", "duplicate: join request already awaiting approval"} {
+		if err := storeEvent(ctx, closed); err == nil || err.Error() != want {
+			t.Fatalf("request %d to a closed group: %v", i+1, err)
+		}
+	}
+	as := context.WithValue(ctx, nip98ViewerKey{}, joiner)
+	again := signedEvent(t, joinerSK, KindJoinRequest, now+1, nostr.Tags{{"h", "closed-club"}}, "")
+	if reject, msg := rejectEventPolicy(as, again); !reject || msg != "duplicate: join request already awaiting approval" {
+		t.Fatalf("second request while waiting: %v %q", reject, msg)
+	}
+	if n := count("SELECT COUNT(*) FROM pending_joins WHERE group_id = $1 AND pubkey = $2", "closed-club"); n != 1 {
+		t.Fatalf("%d waiting requests", n)
+	}
+	if n := count(storedJoins, "closed-club"); n != 1 {
+		t.Fatalf("%d join requests stored for the closed group", n)
+	}
+}
+
+// Join requests repeated before duplicates were refused collapse to the
+// newest once the schema migrates, even with event_tags not yet backfilled.
+func TestJoinRequestsAreDeduplicated(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	joinerSK := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	first := signedEvent(t, joinerSK, KindJoinRequest, now-60, nostr.Tags{{"h", "club"}}, "")
+	repeat := signedEvent(t, joinerSK, KindJoinRequest, now, nostr.Tags{{"h", "club"}}, "")
+	other := signedEvent(t, joinerSK, KindJoinRequest, now-60, nostr.Tags{{"h", "other-club"}}, "")
+	for _, evt := range []*nostr.Event{first, repeat, other} {
+		raw, _ := evt.MarshalJSON()
+		tags, _ := json.Marshal(evt.Tags)
+		if _, err := db.ExecContext(ctx,
+			"INSERT INTO events (id, pubkey, created_at, kind, tags, content, sig, raw) VALUES ($1, $2, $3, $4, $5, '', $6, $7)",
+			evt.ID, evt.PubKey, evt.CreatedAt, evt.Kind, string(tags), evt.Sig, raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM relay_state WHERE key = 'join_requests_deduplicated'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	if err := db.QueryRowContext(ctx,
+		"SELECT array_agg(id ORDER BY id) FROM events WHERE kind = $1 AND pubkey = $2",
+		KindJoinRequest, first.PubKey).Scan(pq.Array(&ids)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{repeat.ID, other.ID}
+	sort.Strings(want)
+	if !slices.Equal(ids, want) {
+		t.Fatalf("stored join requests %v, want %v", ids, want)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// CONTENT LABELS (NIP-32, NIP-36)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Some content (graphic butchery photos, the odd chat message) needs a
+// warning rather than removal. An event is labeled when its author gave it a
+// content-warning tag or a self-label in the content-warning namespace, or
+// when a moderator attached a relay-signed kind 1985 label to it through
+// POST /api/labels. content_labels indexes those three sources by target
+// (event id or address); other kind 1985 events are stored like any other
+// event and change nothing. Clients blur labeled content themselves, using
+// GET /api/labels or the relay's 1985s, which anyone may read. A member who
+// sets the content-labels preference gets labeled events left out of their
+// query results instead.
+//
+// A group may also require labels: with require-media-labels set in its
+// metadata, chat posts carrying RELAY_MEDIA_HEAVY_MIN or more images or
+// videos are rejected unless labeled.
+
+const (
+	KindLabel = 1985
+
+	// labelNamespace is the NIP-32 namespace of content warnings.
+	labelNamespace = "content-warning"
+
+	// labelPrefsDTag addresses the kind 30078 app data holding a member's
+	// label preference; a ["content-labels", "hide"] tag on it filters
+	// labeled events out of their reads. The tag is read by the relay, so it
+	// must not be encrypted.
+	labelPrefsDTag = "zap.cooking/content-labels"
+)
+
+// mediaHeavyMin is how many images or videos make a post media-heavy.
+var mediaHeavyMin int
+
+func loadLabelConfig() {
+	mediaHeavyMin = envInt("RELAY_MEDIA_HEAVY_MIN", 2)
+}
+
+// contentLabel is one label on one target.
+type contentLabel struct {
+	Target  string `json:"-"`
+	Label   string `json:"label"`
+	Reason  string `json:"reason,omitempty"`
+	By      string `json:"by"` // "author" or "moderator"
+	EventID string `json:"event_id"`
+}
+
+// contentLabels returns the labels event carries or, for a relay-signed
+// 1985, attaches to its targets. Labels without a value are "nsfw".
+func contentLabels(event *nostr.Event) []contentLabel {
+	var labels []contentLabel
+	if event.Kind == KindLabel {
+		if event.PubKey != relaySigningPubkey || relaySigningPubkey == "" {
+			return nil
+		}
+		var targets []string
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && (tag[0] == "e" || tag[0] == "a") && tag[1] != "" {
+				targets = append(targets, tag[1])
+			}
+		}
+		for _, label := range namespaceLabels(event) {
+			for _, target := range targets {
+				labels = append(labels, contentLabel{Target: target, Label: label, Reason: event.Content, By: "moderator", EventID: event.ID})
+			}
+		}
+		return labels
+	}
+
+	for _, tag := range event.Tags {
+		if len(tag) >= 1 && tag[0] == "content-warning" {
+			reason := ""
+			if len(tag) >= 2 {
+				reason = tag[1]
+			}
+			labels = append(labels, contentLabel{Target: event.ID, Label: "nsfw", Reason: reason, By: "author", EventID: event.ID})
+		}
+	}
+	for _, label := range namespaceLabels(event) {
+		labels = append(labels, contentLabel{Target: event.ID, Label: label, By: "author", EventID: event.ID})
+	}
+	return labels
+}
+
+// namespaceLabels returns event's l tags in the content-warning namespace.
+func namespaceLabels(event *nostr.Event) []string {
+	var labels []string
+	for _, tag := range event.Tags {
+		if len(tag) >= 3 && tag[0] == "l" && tag[2] == labelNamespace {
+			label := tag[1]
+			if label == "" {
+				label = "nsfw"
+			}
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// isLabeled reports a post its author labeled.
+func isLabeled(event *nostr.Event) bool {
+	return len(contentLabels(event)) > 0
+}
+
+func insertContentLabels(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	labels := contentLabels(event)
+	if len(labels) == 0 {
+		return nil
+	}
+	targets := make([]string, len(labels))
+	values := make([]string, len(labels))
+	reasons := make([]string, len(labels))
+	for i, l := range labels {
+		targets[i], values[i], reasons[i] = l.Target, l.Label, l.Reason
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO content_labels (event_id, target, label, reason, labeler, community)
+		SELECT $1, t, l, r, $5, $6 FROM unnest($2::text[], $3::text[], $4::text[]) AS x(t, l, r)
+		ON CONFLICT DO NOTHING
+	`, event.ID, pq.Array(targets), pq.Array(values), pq.Array(reasons), event.PubKey, communityOf(ctx).id())
+	return err
+}
+
+// ─── Write policy ──────────────────────────────────────────────────────────────
+
+// rejectLabel is the write policy for kind 1985.
+func rejectLabel(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	if !isActiveMember(ctx, pubkey) {
+		return true, say(ctx, msgMembershipRequired)
+	}
+	if event.Tags.GetFirst([]string{"l", ""}) == nil {
+		return true, say(ctx, msgLabelLTag)
+	}
+	return false, ""
+}
+
+// mediaURLPattern matches image and video links in note content.
+var mediaURLPattern = regexp.MustCompile(`(?i)https?://[^\s]+\.(?:jpe?g|png|gif|webp|avif|heic|mp4|webm|mov)(?:\?[^\s]*)?`)
+
+// mediaCount counts the distinct images and videos event links, in imeta
+// tags or its content.
+func mediaCount(event *nostr.Event) int {
+	urls := make(map[string]bool)
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "imeta" {
+			continue
+		}
+		for _, field := range tag[1:] {
+			if u, ok := strings.CutPrefix(field, "url "); ok {
+				urls[u] = true
+			}
+		}
+	}
+	for _, u := range mediaURLPattern.FindAllString(event.Content, -1) {
+		urls[u] = true
+	}
+	return len(urls)
+}
+
+// rejectUnlabeledMedia rejects a media-heavy, unlabeled post to a group that
+// requires media labels.
+func rejectUnlabeledMedia(ctx context.Context, event *nostr.Event) (bool, string) {
+	groupId := getHTag(event)
+	if groupId == "" || mediaHeavyMin <= 0 || mediaCount(event) < mediaHeavyMin || isLabeled(event) {
+		return false, ""
+	}
+	var required bool
+	err := db.QueryRowContext(ctx,
+		"SELECT require_media_labels FROM groups WHERE id = $1 AND community = $2",
+		groupId, communityOf(ctx).id()).Scan(&required)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("[labels] Error loading media rule of group %s: %v", groupId, err)
+		return true, say(ctx, msgMediaRuleFailed)
+	}
+	if required {
+		return true, say(ctx, msgMediaLabelRequired)
+	}
+	return false, ""
+}
+
+// ─── Reads ─────────────────────────────────────────────────────────────────────
+
+// isPublicLabelFilter reports a REQ for the relay's labels only, which
+// anyone may read so anonymous recipe readers can blur too.
+func isPublicLabelFilter(filter nostr.Filter) bool {
+	return containsOnlyKind(filter.Kinds, KindLabel) && relaySigningPubkey != "" &&
+		len(filter.Authors) == 1 && filter.Authors[0] == relaySigningPubkey
+}
+
+// hidesLabeled reports whether viewer asked for labeled events to be left
+// out of their reads.
+func hidesLabeled(ctx context.Context, viewer string) bool {
+	if viewer == "" {
+		return false
+	}
+	var hide bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM events WHERE kind = $1 AND pubkey = $2 AND d_tag = $3
+			AND community = $4 AND tags @> '[["content-labels","hide"]]')
+	`, KindAppData, viewer, labelPrefsDTag, communityOf(ctx).id()).Scan(&hide)
+	if err != nil {
+		log.Printf("[labels] Error loading label preference of %s: %v", viewer, err)
+	}
+	return hide
+}
+
+// unlabeledCondition leaves labeled events out, except viewer's own.
+func unlabeledCondition(viewer string, argIndex int) (string, []interface{}) {
+	return fmt.Sprintf(`(pubkey = $%d OR NOT EXISTS (SELECT 1 FROM content_labels cl
+		WHERE cl.community = events.community AND (cl.target = events.id
+			OR (events.d_tag IS NOT NULL AND cl.target = events.kind || ':' || events.pubkey || ':' || events.d_tag))))`,
+		argIndex), []interface{}{viewer}
+}
+
+// labelsFor returns the labels on each of targets (event ids or addresses)
+// in ctx's community.
+func labelsFor(ctx context.Context, targets []string) (map[string][]contentLabel, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT target, label, COALESCE(reason, ''), labeler, event_id FROM content_labels
+		WHERE target = ANY($1::text[]) AND community = $2
+		ORDER BY target, label
+	`, pq.Array(targets), communityOf(ctx).id())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	labels := make(map[string][]contentLabel)
+	for rows.Next() {
+		var l contentLabel
+		var labeler string
+		if err := rows.Scan(&l.Target, &l.Label, &l.Reason, &labeler, &l.EventID); err != nil {
+			return nil, err
+		}
+		l.By = "author"
+		if labeler == relaySigningPubkey {
+			l.By = "moderator"
+		}
+		labels[l.Target] = append(labels[l.Target], l)
+	}
+	return labels, rows.Err()
+}
+
+// ─── Moderator labels ──────────────────────────────────────────────────────────
+
+// mayLabel reports whether pubkey may label target: the community's relay
+// admin always, a group's moderators for events of their group.
+func mayLabel(ctx context.Context, target *nostr.Event, pubkey string) bool {
+	if pubkey == communityAdmin(ctx) {
+		return true
+	}
+	groupId := getHTag(target)
+	return groupId != "" && isGroupModerator(ctx, groupId, pubkey)
+}
+
+// attachLabel signs and stores a kind 1985 putting label on target and
+// pushes it to open subscriptions.
+func attachLabel(ctx context.Context, target *nostr.Event, label, reason, moderator string) (*nostr.Event, error) {
+	tags := nostr.Tags{
+		{"L", labelNamespace},
+		{"l", label, labelNamespace},
+		{"e", target.ID},
+		{"p", target.PubKey},
+	}
+	if address := eventAddress(target); address != "" {
+		tags = append(tags, nostr.Tag{"a", address})
+	}
+	event := nostr.Event{Kind: KindLabel, Content: reason, Tags: tags}
+	if err := signRelayEvent(&event); err != nil {
+		return nil, err
+	}
+	if err := persistEvent(ctx, &event); err != nil {
+		return nil, err
+	}
+	log.Printf("[labels] %s labeled %s as %q", moderator, target.ID, label)
+	relayFor(ctx).BroadcastEvent(&event)
+	connections.deliverAndTagged(ctx, &event)
+	return &event, nil
+}
+
+// detachLabel deletes the relay's labels putting label on target. It
+// returns how many it deleted.
+func detachLabel(ctx context.Context, target *nostr.Event, label string) (int64, error) {
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM events WHERE kind = $1 AND pubkey = $2 AND community = $5 AND id IN (
+			SELECT event_id FROM content_labels WHERE target = $3 AND label = $4
+		)
+	`, KindLabel, relaySigningPubkey, target.ID, label, communityOf(ctx).id())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ─── HTTP ──────────────────────────────────────────────────────────────────────
+
+type labelRequest struct {
+	Event  string `json:"event"`
+	Label  string `json:"label"`
+	Reason string `json:"reason"`
+}
+
+// maxLabelTargets bounds one GET /api/labels.
+const maxLabelTargets = 100
+
+// registerLabelAPI mounts GET /api/labels?e=<id>&a=<address> (repeatable),
+// public like the content it describes, and the moderator endpoints
+// POST /api/labels and POST /api/labels/remove (NIP-98, JSON body).
+func registerLabelAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/api/labels", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			moderatorLabelAPI(w, r, func(target *nostr.Event, req labelRequest, moderator string) {
+				event, err := attachLabel(r.Context(), target, req.Label, req.Reason, moderator)
+				writeAPIResult(w, event, err)
+			})
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		targets := append(q["e"], q["a"]...)
+		if len(targets) == 0 || len(targets) > maxLabelTargets {
+			httpError(w, r, "", http.StatusBadRequest, msgLabelTargets, maxLabelTargets)
+			return
+		}
+		labels, err := labelsFor(r.Context(), targets)
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		writeAPIResult(w, map[string]interface{}{"labels": labels}, err)
+	})
+	mux.HandleFunc("/api/labels/remove", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		moderatorLabelAPI(w, r, func(target *nostr.Event, req labelRequest, moderator string) {
+			removed, err := detachLabel(r.Context(), target, req.Label)
+			writeAPIResult(w, map[string]interface{}{"event": target.ID, "label": req.Label, "removed": removed}, err)
+		})
+	})
+}
+
+// moderatorLabelAPI authenticates a POST with NIP-98, decodes its JSON body
+// and loads the event it names, then hands them to h if the caller may
+// label that event.
+func moderatorLabelAPI(w http.ResponseWriter, r *http.Request, h func(target *nostr.Event, req labelRequest, moderator string)) {
+	pubkey, err := nip98Pubkey(r)
+	if err != nil {
+		httpError(w, r, "", http.StatusUnauthorized, msgAuthFailed, err)
+		return
+	}
+	if !canSignRelayEvents() {
+		httpError(w, r, pubkey, http.StatusServiceUnavailable, msgSigningKeyMissing)
+		return
+	}
+	var req labelRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		httpError(w, r, pubkey, http.StatusBadRequest, msgMalformedJSON)
+		return
+	}
+	if !nostr.IsValid32ByteHex(req.Event) || req.Label == "" {
+		httpError(w, r, pubkey, http.StatusBadRequest, msgLabelFieldsRequired)
+		return
+	}
+	target, err := storedEvent(r.Context(), req.Event)
+	if err != nil {
+		writeAPIResult(w, nil, err)
+		return
+	}
+	if target == nil {
+		httpError(w, r, pubkey, http.StatusNotFound, msgEventNotFound)
+		return
+	}
+	if !mayLabel(r.Context(), target, pubkey) {
+		httpError(w, r, pubkey, http.StatusForbidden, msgLabelModeratorOnly)
+		return
+	}
+	h(target, req, pubkey)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestContentLabels(t *testing.T) {
+	withRelayKey(t)
+	author := pubkeys(1)[0]
+	recipe := "30023:" + author + ":brisket"
+
+	cases := []struct {
+		name  string
+		event nostr.Event
+		want  []string // target/label
+	}{
+		{"content warning", nostr.Event{ID: "a1", Kind: KindRecipe, Tags: nostr.Tags{{"content-warning", "butchery"}}}, []string{"a1/nsfw"}},
+		{"bare content warning", nostr.Event{ID: "a2", Kind: 9, Tags: nostr.Tags{{"content-warning"}}}, []string{"a2/nsfw"}},
+		{"self label", nostr.Event{ID: "a3", Kind: 9, Tags: nostr.Tags{{"L", labelNamespace}, {"l", "graphic", labelNamespace}}}, []string{"a3/graphic"}},
+		{"other namespace", nostr.Event{ID: "a4", Kind: 9, Tags: nostr.Tags{{"L", "ISO-639-1"}, {"l", "en", "ISO-639-1"}}}, nil},
+		{"member label", nostr.Event{ID: "a5", Kind: KindLabel, PubKey: author, Tags: nostr.Tags{{"l", "graphic", labelNamespace}, {"e", "a1"}}}, nil},
+		{"relay label", nostr.Event{ID: "a6", Kind: KindLabel, PubKey: relaySigningPubkey, Tags: nostr.Tags{
+			{"L", labelNamespace}, {"l", "graphic", labelNamespace}, {"e", "a1"}, {"a", recipe}, {"p", author},
+		}}, []string{"a1/graphic", recipe + "/graphic"}},
+	}
+	for _, tc := range cases {
+		var got []string
+		for _, l := range contentLabels(&tc.event) {
+			got = append(got, l.Target+"/"+l.Label)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s: labels %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMediaCount(t *testing.T) {
+	event := &nostr.Event{
+		Content: "Before https://media.zap.cooking/a.jpg and after https://media.zap.cooking/b.PNG?w=800, recipe at https://zap.cooking/r",
+		Tags:    nostr.Tags{{"imeta", "url https://media.zap.cooking/a.jpg", "m image/jpeg"}, {"imeta", "url https://media.zap.cooking/c.mp4"}},
+	}
+	if n := mediaCount(event); n != 3 {
+		t.Fatalf("counted %d media, want 3", n)
+	}
+	if n := mediaCount(&nostr.Event{Content: "no pictures today"}); n != 0 {
+		t.Fatalf("counted %d media in plain text", n)
+	}
+}
+
+func TestIsPublicLabelFilter(t *testing.T) {
+	withRelayKey(t)
+	cases := []struct {
+		filter nostr.Filter
+		want   bool
+	}{
+		{nostr.Filter{Kinds: []int{KindLabel}, Authors: []string{relaySigningPubkey}}, true},
+		{nostr.Filter{Kinds: []int{KindLabel}, Authors: []string{relaySigningPubkey}, Tags: nostr.TagMap{"e": {"x"}}}, true},
+		{nostr.Filter{Kinds: []int{KindLabel}}, false},
+		{nostr.Filter{Kinds: []int{KindLabel, 9}, Authors: []string{relaySigningPubkey}}, false},
+		{nostr.Filter{Kinds: []int{KindLabel}, Authors: pubkeys(1)}, false},
+	}
+	for i, tc := range cases {
+		if got := isPublicLabelFilter(tc.filter); got != tc.want {
+			t.Errorf("case %d: got %v, want %v", i, got, tc.want)
+		}
+	}
+}
+
+func TestUnlabeledConditionOnlyWhenHidden(t *testing.T) {
+	viewer := pubkeys(1)[0]
+	filter := nostr.Filter{Kinds: []int{KindRecipe}}
+	if q, _ := buildViewerQuery(filter, nil, viewer, false); strings.Contains(q, "content_labels") {
+		t.Fatalf("labels filtered without the preference: %s", q)
+	}
+	q, args := buildViewerQuery(filter, nil, viewer, true)
+	if !strings.Contains(q, "content_labels") || !strings.Contains(q, "pubkey = $3") {
+		t.Fatalf("expected label filter sparing the viewer's own events: %s", q)
+	}
+	if len(args) != 4 || args[2] != viewer {
+		t.Fatalf("unexpected args %v", args)
+	}
+}
+
+func TestLabelLifecycle(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	prevRelay := relay
+	relay = khatru.NewRelay()
+	t.Cleanup(func() { relay = prevRelay })
+	ctx := context.Background()
+	authorSK, viewerSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	author, _ := nostr.GetPublicKey(authorSK)
+	viewer, _ := nostr.GetPublicKey(viewerSK)
+	addTestMember(t, author)
+	addTestMember(t, viewer)
+
+	warned := signedEvent(t, authorSK, KindRecipe, nostr.Now(), nostr.Tags{{"d", "head-cheese"}, {"content-warning", "butchery"}}, "")
+	plain := signedEvent(t, authorSK, KindRecipe, nostr.Now(), nostr.Tags{{"d", "brisket"}}, "")
+	for _, e := range []*nostr.Event{warned, plain} {
+		if err := persistEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	label, err := attachLabel(ctx, plain, "graphic", "raw meat close-ups", adminPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reject, _ := rejectFilterPolicy(ctx, nostr.Filter{Kinds: []int{KindLabel}, Authors: []string{relaySigningPubkey}}); reject {
+		t.Fatal("relay labels not publicly readable")
+	}
+
+	address := eventAddress(plain)
+	labels, err := labelsFor(ctx, []string{warned.ID, plain.ID, address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := labels[warned.ID]; len(l) != 1 || l[0].By != "author" || l[0].Reason != "butchery" {
+		t.Fatalf("author label: %+v", l)
+	}
+	if l := labels[address]; len(l) != 1 || l[0].Label != "graphic" || l[0].By != "moderator" || l[0].EventID != label.ID {
+		t.Fatalf("moderator label on the address: %+v", l)
+	}
+
+	visible := func(viewer string) int {
+		t.Helper()
+		q, args := buildViewerQuery(nostr.Filter{Kinds: []int{KindRecipe}}, nil, viewer, hidesLabeled(ctx, viewer))
+		rows, err := db.QueryContext(ctx, q, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		n := 0
+		for rows.Next() {
+			n++
+		}
+		return n
+	}
+	if n := visible(viewer); n != 2 {
+		t.Fatalf("viewer without the preference sees %d recipes, want 2", n)
+	}
+	prefs := signedEvent(t, viewerSK, KindAppData, nostr.Now(), nostr.Tags{{"d", labelPrefsDTag}, {"content-labels", "hide"}}, "")
+	if err := persistEvent(ctx, prefs); err != nil {
+		t.Fatal(err)
+	}
+	if n := visible(viewer); n != 0 {
+		t.Fatalf("viewer hiding labels sees %d recipes, want 0", n)
+	}
+	if n := visible(author); n != 2 {
+		t.Fatalf("author sees %d of their own recipes, want 2", n)
+	}
+
+	if removed, err := detachLabel(ctx, plain, "graphic"); err != nil || removed != 1 {
+		t.Fatalf("detach: %d %v", removed, err)
+	}
+	if n := visible(viewer); n != 1 {
+		t.Fatalf("after removing the label, viewer sees %d recipes, want 1", n)
+	}
+}
+
+func TestGroupMediaLabelRule(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	prev := mediaHeavyMin
+	mediaHeavyMin = 2
+	t.Cleanup(func() { mediaHeavyMin = prev })
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO groups (id, name, require_media_labels) VALUES ('butchers', 'Butchers', true), ('bakers', 'Bakers', false)"); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(group string, tags ...nostr.Tag) *nostr.Event {
+		return &nostr.Event{
+			Kind:    KindGroupChat,
+			Content: "https://media.zap.cooking/1.jpg https://media.zap.cooking/2.jpg",
+			Tags:    append(nostr.Tags{{"h", group}}, tags...),
+		}
+	}
+	if reject, msg := rejectUnlabeledMedia(ctx, post("butchers")); !reject || !strings.HasPrefix(msg, "restricted:") {
+		t.Fatalf("unlabeled media post accepted: %v %q", reject, msg)
+	}
+	if reject, _ := rejectUnlabeledMedia(ctx, post("butchers", nostr.Tag{"content-warning", "carcass"})); reject {
+		t.Fatal("labeled media post rejected")
+	}
+	if reject, _ := rejectUnlabeledMedia(ctx, post("bakers")); reject {
+		t.Fatal("media post rejected by a group without the rule")
+	}
+	single := &nostr.Event{Kind: KindGroupChat, Content: "https://media.zap.cooking/1.jpg", Tags: nostr.Tags{{"h", "butchers"}}}
+	if reject, _ := rejectUnlabeledMedia(ctx, single); reject {
+		t.Fatal("post below the media-heavy threshold rejected")
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// LAPSED MEMBERS
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// A member whose subscription lapses is refused by every membership check,
+// but their group_members rows would keep them in the groups' 39001 and
+// 39002. Every RELAY_LAPSED_SWEEP_INTERVAL (default 1h) the sweep takes
+// them out of the groups of the community they lapsed in: the rows are
+// deleted, the removal is recorded in group_member_lapses with the role
+// and join date they had, the relay publishes a remove-user (kind 9001)
+// for each, and the groups' member lists are regenerated. Members in their
+// grace period, like the community admin, are still members and are left
+// alone. So is a group's last admin (see LAST GROUP ADMIN): while none of
+// its admins has a current subscription, its lapsed admins stay and the
+// sweep logs the group for the community admin to hand over.
+//
+// RELAY_LAPSED_MEMBERS chooses what becomes of them:
+//
+//   - "remove" (default): they are out of the group for good.
+//   - "inactive": they are out of the group's lists until they come back,
+//     and a join request of theirs approved after re-subscribing gives them
+//     back the role and join date they had.
+//   - "off": no sweep.
+//
+// Re-subscribing alone never puts anyone back in a group; that takes a
+// join request (kind 9021) or a put-user again.
+
+const (
+	lapsedRemove   = "remove"
+	lapsedInactive = "inactive"
+	lapsedOff      = "off"
+)
+
+// lapsedMembers is RELAY_LAPSED_MEMBERS.
+var lapsedMembers string
+
+// lapsedSweepInterval is how often the sweep runs.
+var lapsedSweepInterval time.Duration
+
+func loadLapsedMembersConfig() {
+	lapsedMembers = envOr("RELAY_LAPSED_MEMBERS", lapsedRemove)
+	switch lapsedMembers {
+	case lapsedRemove, lapsedInactive, lapsedOff:
+	default:
+		log.Fatalf("Invalid RELAY_LAPSED_MEMBERS %q: want remove, inactive or off", lapsedMembers)
+	}
+	lapsedSweepInterval = envDuration("RELAY_LAPSED_SWEEP_INTERVAL", time.Hour)
+}
+
+// lapsedCondition matches group_members gm of group g whose member has no
+// current subscription in g's community.
+const lapsedCondition = `NOT EXISTS (
+	SELECT 1 FROM members m
+	WHERE m.pubkey = gm.pubkey AND m.community = g.community
+	AND m.status IN ('active', 'grace')
+	AND m.subscription_end > NOW())`
+
+// lastAdminCondition matches group_members gm of group g who are admins of
+// a group with no admin left but the lapsed ones, where $2 is the
+// community admin, who never lapses.
+const lastAdminCondition = `gm.role = 'admin' AND NOT EXISTS (
+	SELECT 1 FROM group_members a
+	WHERE a.group_id = gm.group_id AND a.role = 'admin'
+	AND (a.pubkey = $2 OR EXISTS (
+		SELECT 1 FROM members m
+		WHERE m.pubkey = a.pubkey AND m.community = g.community
+		AND m.status IN ('active', 'grace')
+		AND m.subscription_end > NOW())))`
+
+// sweepLapsedMembers removes lapsed members from their groups and returns
+// how many memberships it ended.
+func sweepLapsedMembers(ctx context.Context) (int, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT DISTINCT gm.group_id, g.community FROM group_members gm
+		JOIN groups g ON g.id = gm.group_id
+		WHERE `+lapsedCondition+`
+		ORDER BY gm.group_id
+	`)
+	if err != nil {
+		return 0, err
+	}
+	type affected struct{ id, community string }
+	var groups []affected
+	for rows.Next() {
+		var g affected
+		if err := rows.Scan(&g.id, &g.community); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		groups = append(groups, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, g := range groups {
+		n, err := removeLapsedMembers(withCommunity(ctx, communities[g.community]), g.id)
+		if err != nil {
+			log.Printf("[NIP-29] Error removing lapsed members from group %s: %v", g.id, err)
+			continue
+		}
+		removed += n
+	}
+	return removed, nil
+}
+
+// removeLapsedMembers takes groupId's lapsed members out of it under the
+// group lock, so a member renewing meanwhile is not removed. Its last
+// admins are kept.
+func removeLapsedMembers(ctx context.Context, groupId string) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if err := lockGroup(ctx, tx, groupId); err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		WITH lapsed AS (
+			DELETE FROM group_members gm USING groups g
+			WHERE gm.group_id = $1 AND g.id = gm.group_id AND gm.pubkey <> $2
+			AND `+lapsedCondition+`
+			AND NOT (`+lastAdminCondition+`)
+			RETURNING gm.group_id, gm.pubkey, gm.role, gm.joined_at
+		)
+		INSERT INTO group_member_lapses (group_id, pubkey, role, joined_at)
+		SELECT group_id, pubkey, role, joined_at FROM lapsed
+		RETURNING pubkey, role
+	`, groupId, communityOf(ctx).admin())
+	if err != nil {
+		return 0, fmt.Errorf("remove lapsed members: %w", err)
+	}
+	type lapse struct{ pubkey, role string }
+	var lapses []lapse
+	for rows.Next() {
+		var l lapse
+		if err := rows.Scan(&l.pubkey, &l.role); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		lapses = append(lapses, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var kept []string
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(array_agg(gm.pubkey), '{}') FROM group_members gm
+		JOIN groups g ON g.id = gm.group_id
+		WHERE gm.group_id = $1 AND gm.pubkey <> $2
+		AND `+lapsedCondition+`
+	`, groupId, communityOf(ctx).admin()).Scan(pq.Array(&kept)); err != nil {
+		return 0, fmt.Errorf("find kept admins: %w", err)
+	}
+	for _, pubkey := range kept {
+		log.Printf("[NIP-29] Keeping lapsed admin %s of group %s: it has no other admin", pubkey, groupId)
+	}
+	if len(lapses) == 0 {
+		return 0, nil
+	}
+
+	var pubkeys []string
+	for _, l := range lapses {
+		log.Printf("[NIP-29] Removing lapsed member %s (%s) from group %s", l.pubkey, l.role, groupId)
+		pubkeys = append(pubkeys, l.pubkey)
+		// A relay-signed remove-user tells clients, as for a leave
+		if err := queueGroupEvent(ctx, tx, groupId, nostr.Event{
+			Kind: KindRemoveUser,
+			Tags: nostr.Tags{{"h", groupId}, {"p", l.pubkey}},
+		}); err != nil {
+			return 0, err
+		}
+	}
+	if err := dropGroupLists(ctx, tx, pubkeys); err != nil {
+		return 0, err
+	}
+	if err := markGroupDirty(ctx, tx, groupId); err != nil {
+		return 0, err
+	}
+	return len(lapses), tx.Commit()
+}
+
+// restoreLapsedMembership gives pubkey, just approved into groupId as part
+// of tx, the role and join date of their last lapsed membership there, when
+// lapsed members are kept inactive.
+func restoreLapsedMembership(ctx context.Context, tx *sql.Tx, groupId, pubkey string) error {
+	if lapsedMembers != lapsedInactive {
+		return nil
+	}
+	res, err := tx.ExecContext(ctx, `
+		UPDATE group_members gm SET role = l.role, joined_at = l.joined_at
+		FROM (
+			SELECT role, joined_at FROM group_member_lapses
+			WHERE group_id = $1 AND pubkey = $2
+			ORDER BY lapsed_at DESC LIMIT 1
+		) l
+		WHERE gm.group_id = $1 AND gm.pubkey = $2
+	`, groupId, pubkey)
+	if err != nil {
+		return fmt.Errorf("restore lapsed membership: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("[NIP-29] Restored lapsed membership of %s in group %s", pubkey, groupId)
+	}
+	return nil
+}
+
+// runLapsedMemberSweep sweeps lapsed members every lapsedSweepInterval.
+func runLapsedMemberSweep(ctx context.Context) {
+	if lapsedMembers == lapsedOff || lapsedSweepInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(lapsedSweepInterval)
+	defer ticker.Stop()
+	for {
+		if n, err := sweepLapsedMembers(ctx); err != nil {
+			log.Printf("[NIP-29] Error sweeping lapsed members: %v", err)
+		} else if n > 0 {
+			log.Printf("[NIP-29] Removed %d lapsed group memberships", n)
+			groupSync.kick()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
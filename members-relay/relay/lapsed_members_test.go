@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Lapsed members leave their groups with a trace; grace-period members
+// stay. Re-subscribing alone does not bring anyone back, and a join
+// afterwards restores the old role only when lapses are kept inactive.
+func TestLapsedMembers(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	prev := lapsedMembers
+	lapsedMembers = lapsedRemove
+	t.Cleanup(func() { lapsedMembers = prev })
+	ownerSK := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSK)
+	addTestMember(t, owner)
+	sks := map[string]string{}
+	pk := map[string]string{}
+	for _, name := range []string{"renewing", "grace", "lapsedMod", "lapsed"} {
+		sks[name] = nostr.GeneratePrivateKey()
+		pk[name], _ = nostr.GetPublicKey(sks[name])
+	}
+	subscribe := func(pubkey, status, end string) {
+		t.Helper()
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO members (pubkey, status, subscription_start, subscription_end)
+			VALUES ($1, $2, NOW() - INTERVAL '60 days', NOW() + $3::interval)
+			ON CONFLICT (community, pubkey) DO UPDATE SET status = $2, subscription_end = NOW() + $3::interval
+		`, pubkey, status, end); err != nil {
+			t.Fatal(err)
+		}
+	}
+	subscribe(pk["renewing"], "active", "30 days")
+	subscribe(pk["grace"], "grace", "3 days")
+	subscribe(pk["lapsedMod"], "active", "-1 day")
+	subscribe(pk["lapsed"], "expired", "-1 day")
+
+	now := nostr.Now()
+	h := nostr.Tags{{"h", "club"}}
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindCreateGroup, now, h, ""))
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindPutGroupStatus, now, nostr.Tags{{"h", "club"}, {"open"}}, ""))
+	for _, name := range []string{"renewing", "grace", "lapsed"} {
+		applyGroupEvent(t, signedEvent(t, sks[name], KindJoinRequest, now, h, ""))
+	}
+	applyGroupEvent(t, signedEvent(t, sks["lapsedMod"], KindJoinRequest, now, h, ""))
+	if _, err := db.ExecContext(ctx, "UPDATE group_members SET role = 'moderator' WHERE pubkey = $1", pk["lapsedMod"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := sweepLapsedMembers(ctx); err != nil || n != 2 {
+		t.Fatalf("sweep removed %d: %v", n, err)
+	}
+	for name, want := range map[string]bool{"renewing": true, "grace": true, "lapsedMod": false, "lapsed": false} {
+		if isGroupMember(ctx, "club", pk[name]) != want {
+			t.Errorf("%s member: %v", name, !want)
+		}
+	}
+	if !isGroupAdmin(ctx, "club", owner) {
+		t.Fatal("owner removed")
+	}
+	var lapses, confirmations int
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM group_member_lapses WHERE group_id = 'club' AND pubkey = $1 AND role = 'moderator'", pk["lapsedMod"]).Scan(&lapses)
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM group_outbox").Scan(&confirmations)
+	if lapses != 1 || confirmations != 2 {
+		t.Fatalf("%d lapse records for the moderator, %d remove-users queued", lapses, confirmations)
+	}
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if members := storedGroupMembers(t, "club"); members[pk["lapsed"]] || members[pk["lapsedMod"]] || !members[pk["grace"]] {
+		t.Fatalf("39002 after the sweep lists %v", members)
+	}
+
+	// Renewing changes nothing until they ask to join again
+	subscribe(pk["lapsedMod"], "active", "30 days")
+	subscribe(pk["lapsed"], "active", "30 days")
+	if n, err := sweepLapsedMembers(ctx); err != nil || n != 0 || isGroupMember(ctx, "club", pk["lapsedMod"]) {
+		t.Fatalf("after renewing: swept %d, %v", n, err)
+	}
+	role := func(name string) string {
+		t.Helper()
+		var r string
+		if err := db.QueryRowContext(ctx, "SELECT role FROM group_members WHERE group_id = 'club' AND pubkey = $1", pk[name]).Scan(&r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	applyGroupEvent(t, signedEvent(t, sks["lapsed"], KindJoinRequest, now+1, h, ""))
+	lapsedMembers = lapsedInactive
+	applyGroupEvent(t, signedEvent(t, sks["lapsedMod"], KindJoinRequest, now+1, h, ""))
+	if got := role("lapsed"); got != "member" {
+		t.Errorf("rejoined after removal as %s", got)
+	}
+	if got := role("lapsedMod"); got != "moderator" {
+		t.Errorf("rejoined after an inactive lapse as %s", got)
+	}
+}
+
+// A group's only admin is kept when they lapse, until another admin with a
+// current subscription can take over.
+func TestLapsedLastAdminIsKept(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	prev := lapsedMembers
+	lapsedMembers = lapsedRemove
+	t.Cleanup(func() { lapsedMembers = prev })
+	ownerSK, successorSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSK)
+	successor, _ := nostr.GetPublicKey(successorSK)
+	addTestMember(t, owner)
+	addTestMember(t, successor)
+
+	now := nostr.Now()
+	h := nostr.Tags{{"h", "club"}}
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindCreateGroup, now, h, ""))
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindPutGroupStatus, now, nostr.Tags{{"h", "club"}, {"open"}}, ""))
+	applyGroupEvent(t, signedEvent(t, successorSK, KindJoinRequest, now, h, ""))
+	if _, err := db.ExecContext(ctx, "UPDATE members SET status = 'expired', subscription_end = NOW() - INTERVAL '1 day' WHERE pubkey = $1", owner); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := sweepLapsedMembers(ctx); err != nil || n != 0 {
+		t.Fatalf("sweep removed %d: %v", n, err)
+	}
+	if !isGroupAdmin(ctx, "club", owner) {
+		t.Fatal("the group's only admin was removed")
+	}
+
+	applyGroupEvent(t, signedEvent(t, ownerSK, KindPutUser, now+1, nostr.Tags{{"h", "club"}, {"p", successor, "admin"}}, ""))
+	if n, err := sweepLapsedMembers(ctx); err != nil || n != 1 {
+		t.Fatalf("sweep after the handover removed %d: %v", n, err)
+	}
+	if isGroupMember(ctx, "club", owner) || !isGroupAdmin(ctx, "club", successor) {
+		t.Fatal("handover not completed by the sweep")
+	}
+}
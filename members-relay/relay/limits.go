@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// RELAY LIMITS
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// relayLimits is the single source for every limit the relay enforces and
+// for the NIP-11 document that advertises them. Each field names the NIP-11
+// path it is published under in its nip11 tag, or "-" if NIP-11 has no field
+// for it; TestRelayInfoAdvertisesEveryLimit fails for untagged fields.
+type relayLimits struct {
+	// Enforced by khatru's websocket read limit.
+	MaxMessageLength int `nip11:"limitation.max_message_length"`
+
+	// Every filter becomes its own SQL query, so a single client with many
+	// REQs of many filters multiplies database load. The zap.cooking frontend
+	// keeps up to ~8 subscriptions open, so the defaults leave plenty of
+	// headroom. See admitFilter.
+	MaxSubscriptions    int  `nip11:"limitation.max_subscriptions"`
+	MaxFilters          int  `nip11:"limitation.max_filters"`
+	MaxFilterConditions int  `nip11:"-"` // ids + authors + kinds + tag values per filter
+	EnforceSubscription bool `nip11:"-"` // false only logs what would have been rejected
+
+	// REQs per minute per connection, metered by a token bucket holding a
+	// minute's allowance. See meterREQ.
+	MaxREQsPerMinute int `nip11:"-"`
+	// Ceilings for connections the community admin has authenticated on.
+	AdminMaxSubscriptions int `nip11:"-"`
+	AdminMaxREQsPerMinute int `nip11:"-"`
+
+	// Caps the events one filter returns, whatever limit it asks for, and is
+	// the limit of filters that ask for none. See queryLimit.
+	MaxLimit int `nip11:"limitation.max_limit"`
+
+	// AuthRequired extends NIP-42 auth to public recipe reads and writes,
+	// which are otherwise anonymous. Everything else always needs auth.
+	AuthRequired bool `nip11:"limitation.auth_required"`
+	// Writes other than recipes require an active membership, which is paid.
+	RestrictedWrites bool `nip11:"limitation.restricted_writes"`
+	PaymentRequired  bool `nip11:"limitation.payment_required"`
+
+	// Recipes, which anyone may publish, need this much committed NIP-13
+	// work (0 for none) unless an authenticated member sends them. See
+	// rejectRecipePow.
+	MinPowDifficulty int `nip11:"limitation.min_pow_difficulty"`
+
+	// Events are refused with a created_at further than these from now (0
+	// for no lower bound). See rejectEventLimits.
+	CreatedAtLowerLimit time.Duration `nip11:"limitation.created_at_lower_limit"`
+	CreatedAtUpperLimit time.Duration `nip11:"limitation.created_at_upper_limit"`
+
+	// The community rules every event is published under.
+	PostingPolicy string `nip11:"posting_policy"`
+
+	// Membership payment settings. A zero fee advertises no fee schedule.
+	PaymentsURL      string        `nip11:"payments_url"`
+	MembershipFee    int           `nip11:"fees.subscription.0.amount"` // msats
+	MembershipPeriod time.Duration `nip11:"fees.subscription.0.period"`
+
+	// Retention rules published in NIP-11: ephemeral kinds are never
+	// stored, and time rules covering chat are enforced by the chat
+	// retention purger (see CHAT RETENTION). Per-group TTLs have no place
+	// in NIP-11 and show in each group's 39000 instead.
+	Retention []retentionRule `nip11:"retention"`
+}
+
+// retentionRule is one entry of the NIP-11 retention array.
+type retentionRule struct {
+	Kinds      []int
+	KindRanges [][2]int // inclusive
+	Time       int64    // seconds
+	NotStored  bool     // published as "time": 0
+	Count      int
+}
+
+func (r retentionRule) MarshalJSON() ([]byte, error) {
+	doc := map[string]any{}
+	var kinds []any
+	for _, kind := range r.Kinds {
+		kinds = append(kinds, kind)
+	}
+	for _, kr := range r.KindRanges {
+		kinds = append(kinds, kr)
+	}
+	if len(kinds) > 0 {
+		doc["kinds"] = kinds
+	}
+	if r.Time > 0 || r.NotStored {
+		doc["time"] = r.Time
+	}
+	if r.Count > 0 {
+		doc["count"] = r.Count
+	}
+	return json.Marshal(doc)
+}
+
+var limits relayLimits
+
+// defaultMaxLimit is RELAY_MAX_LIMIT's default, and the cap when limits
+// were never loaded.
+const defaultMaxLimit = 500
+
+// Clients reaching this fraction of a limit are logged so the defaults can be
+// tuned before anyone gets rejected.
+const nearLimitRatio = 0.75
+
+func loadLimits() {
+	paymentsURL := os.Getenv("RELAY_PAYMENTS_URL")
+	if paymentsURL == "" {
+		paymentsURL = "https://zap.cooking/membership"
+	}
+	limits = relayLimits{
+		MaxMessageLength:      envInt("RELAY_MAX_MESSAGE_LENGTH", 512000),
+		MaxSubscriptions:      envInt("RELAY_MAX_SUBSCRIPTIONS", 32),
+		MaxFilters:            envInt("RELAY_MAX_FILTERS", 10),
+		MaxFilterConditions:   envInt("RELAY_MAX_FILTER_CONDITIONS", 1000),
+		EnforceSubscription:   envBool("RELAY_ENFORCE_SUBSCRIPTION_LIMITS", true),
+		MaxREQsPerMinute:      envInt("RELAY_MAX_REQS_PER_MINUTE", 120),
+		AdminMaxSubscriptions: envInt("RELAY_ADMIN_MAX_SUBSCRIPTIONS", 256),
+		AdminMaxREQsPerMinute: envInt("RELAY_ADMIN_MAX_REQS_PER_MINUTE", 1200),
+		MaxLimit:              envInt("RELAY_MAX_LIMIT", defaultMaxLimit),
+		AuthRequired:          envBool("RELAY_AUTH_REQUIRED", false),
+		RestrictedWrites:      true,
+		PaymentRequired:       true,
+		MinPowDifficulty:      envInt("RELAY_MIN_POW", 0),
+		CreatedAtLowerLimit:   envDuration("RELAY_CREATED_AT_LOWER_LIMIT", 0),
+		CreatedAtUpperLimit:   envDuration("RELAY_CREATED_AT_UPPER_LIMIT", 15*time.Minute),
+		PostingPolicy:         envOr("RELAY_POSTING_POLICY_URL", "https://zap.cooking/terms"),
+		PaymentsURL:           paymentsURL,
+		MembershipFee:         envInt("RELAY_MEMBERSHIP_FEE_SATS", 0) * 1000,
+		MembershipPeriod:      envDuration("RELAY_MEMBERSHIP_PERIOD", 365*24*time.Hour),
+		// khatru broadcasts ephemeral events without storing them.
+		Retention: []retentionRule{{KindRanges: [][2]int{{20000, 29999}}, NotStored: true}},
+	}
+	if d := envDuration("RELAY_CHAT_RETENTION", 0); d > 0 {
+		limits.Retention = append(limits.Retention, retentionRule{
+			Kinds: []int{KindGroupChat, KindGroupChatReply},
+			Time:  int64(d.Seconds()),
+		})
+	}
+}
+
+// applyLimits installs lim as the active limits: the policy hooks read the
+// global, khatru gets its own knobs, and relay.Info is rebuilt from the same
+// values. Anything that changes limits at runtime must go through here.
+func applyLimits(rl *khatru.Relay, lim relayLimits) {
+	limits = lim
+	rl.MaxMessageSize = int64(lim.MaxMessageLength)
+	buildRelayInfo(rl.Info, lim)
+}
+
+// buildRelayInfo writes the limit-derived parts of the NIP-11 document.
+func buildRelayInfo(info *nip11.RelayInformationDocument, lim relayLimits) {
+	info.Limitation = &nip11.RelayLimitationDocument{
+		MaxMessageLength: lim.MaxMessageLength,
+		MaxSubscriptions: lim.MaxSubscriptions,
+		MaxFilters:       lim.MaxFilters,
+		MaxLimit:         lim.MaxLimit,
+		MinPowDifficulty: lim.MinPowDifficulty,
+		AuthRequired:     lim.AuthRequired,
+		PaymentRequired:  lim.PaymentRequired,
+		RestrictedWrites: lim.RestrictedWrites,
+	}
+	info.PostingPolicy = lim.PostingPolicy
+	info.PaymentsURL = lim.PaymentsURL
+	info.Fees = nil
+	if lim.MembershipFee > 0 {
+		info.Fees = &nip11.RelayFeesDocument{}
+		info.Fees.Subscription = append(info.Fees.Subscription, struct {
+			Amount int    `json:"amount"`
+			Unit   string `json:"unit"`
+			Period int    `json:"period"`
+		}{Amount: lim.MembershipFee, Unit: "msats", Period: int(lim.MembershipPeriod.Seconds())})
+	}
+}
+
+// relayInfoDocument adds the fields go-nostr's NIP-11 type lacks.
+type relayInfoDocument struct {
+	nip11.RelayInformationDocument
+	Limitation *relayLimitationDocument `json:"limitation,omitempty"`
+	Retention  []retentionRule          `json:"retention,omitempty"`
+}
+
+// relayLimitationDocument adds the created_at bounds to go-nostr's.
+type relayLimitationDocument struct {
+	nip11.RelayLimitationDocument
+	CreatedAtLowerLimit int64 `json:"created_at_lower_limit,omitempty"`
+	CreatedAtUpperLimit int64 `json:"created_at_upper_limit,omitempty"`
+}
+
+// newRelayInfoDocument extends info with lim's fields go-nostr lacks.
+func newRelayInfoDocument(info nip11.RelayInformationDocument, lim relayLimits) relayInfoDocument {
+	doc := relayInfoDocument{RelayInformationDocument: info, Retention: lim.Retention}
+	if info.Limitation != nil {
+		doc.Limitation = &relayLimitationDocument{
+			RelayLimitationDocument: *info.Limitation,
+			CreatedAtLowerLimit:     int64(lim.CreatedAtLowerLimit.Seconds()),
+			CreatedAtUpperLimit:     int64(lim.CreatedAtUpperLimit.Seconds()),
+		}
+	}
+	return doc
+}
+
+// rejectEventLimits is a RejectEvent hook enforcing the advertised
+// created_at bounds.
+func rejectEventLimits(ctx context.Context, event *nostr.Event) (bool, string) {
+	now := nostr.Now()
+	if limits.CreatedAtUpperLimit > 0 && event.CreatedAt > now+nostr.Timestamp(limits.CreatedAtUpperLimit.Seconds()) {
+		return true, say(ctx, msgCreatedAtTooNew)
+	}
+	if limits.CreatedAtLowerLimit > 0 && event.CreatedAt < now-nostr.Timestamp(limits.CreatedAtLowerLimit.Seconds()) {
+		return true, say(ctx, msgCreatedAtTooOld)
+	}
+	return false, ""
+}
+
+// rejectRecipePow holds a recipe, or a reaction or comment on one, sent by
+// anyone but an authenticated active member (pubkey, the connection's key)
+// to limits.MinPowDifficulty. The work counts only up to the target its
+// nonce tag commits to, and not at all if the id falls short of that target.
+func rejectRecipePow(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	if limits.MinPowDifficulty <= 0 || (pubkey != "" && isActiveMember(ctx, pubkey)) {
+		return false, ""
+	}
+	if nip13.CommittedDifficulty(event) < limits.MinPowDifficulty {
+		return true, say(ctx, msgPowRequired, limits.MinPowDifficulty)
+	}
+	return false, ""
+}
+
+// handleRelayInfo serves the NIP-11 document of the request's community in
+// place of khatru's HandleNIP11 (which it mirrors) so the document can carry
+// retention.
+func handleRelayInfo(w http.ResponseWriter, r *http.Request) {
+	rl := relayFor(r.Context())
+	relayInfoMu.RLock()
+	info := *rl.Info
+	relayInfoMu.RUnlock()
+	info.SupportedNIPs = append([]int(nil), info.SupportedNIPs...)
+	if len(rl.DeleteEvent) > 0 {
+		info.AddSupportedNIP(9)
+	}
+	if len(rl.CountEvents) > 0 {
+		info.AddSupportedNIP(45)
+	}
+	for _, ovw := range rl.OverwriteRelayInformation {
+		info = ovw(r.Context(), r, info)
+	}
+
+	w.Header().Set("Content-Type", "application/nostr+json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(newRelayInfoDocument(info, limits))
+}
+
+// isRelayInfoRequest matches the requests khatru would answer with NIP-11.
+func isRelayInfoRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "websocket" && r.Header.Get("Accept") == "application/nostr+json"
+}
+
+type openSub struct {
+	reqCtx  context.Context // identifies the REQ the filters below belong to
+	filters int
+	live    []nostr.Filter // as admitted, for deliveries khatru does not make
+}
+
+// filterConditions counts the values a filter asks the database to match.
+func filterConditions(filter nostr.Filter) int {
+	n := len(filter.IDs) + len(filter.Authors) + len(filter.Kinds)
+	for _, values := range filter.Tags {
+		n += len(values)
+	}
+	return n
+}
+
+func nearLimit(n, limit int) bool {
+	return limit > 0 && n == int(float64(limit)*nearLimitRatio+0.5)
+}
+
+// admitFilter applies the limits to one filter of a REQ and records it when
+// admitted. It returns the rejection as a message code and its arguments,
+// or "" to accept; the caller renders it once the tracker is unlocked.
+// Limits of 0 are disabled.
+func (c *trackedConn) admitFilter(reqCtx context.Context, subID string, filter nostr.Filter, lim relayLimits) (reason msgCode, args []interface{}, warning string) {
+	if n := filterConditions(filter); lim.MaxFilterConditions > 0 && n > lim.MaxFilterConditions {
+		return msgFilterTooComplex, []interface{}{n, lim.MaxFilterConditions}, ""
+	}
+
+	sub, open := c.subs[subID]
+	if !open {
+		if lim.MaxSubscriptions > 0 && len(c.subs) >= lim.MaxSubscriptions {
+			return msgTooManySubscriptions, []interface{}{lim.MaxSubscriptions}, ""
+		}
+		sub = &openSub{}
+	}
+	// A REQ reusing an open id replaces that subscription, so its filter
+	// count starts over.
+	filters := sub.filters + 1
+	if sub.reqCtx != reqCtx {
+		filters = 1
+		sub.live = nil
+	}
+	if lim.MaxFilters > 0 && filters > lim.MaxFilters {
+		return msgTooManyFilters, []interface{}{lim.MaxFilters}, ""
+	}
+
+	sub.reqCtx = reqCtx
+	sub.filters = filters
+	sub.live = append(sub.live, filter)
+	c.subs[subID] = sub
+
+	if !open && nearLimit(len(c.subs), lim.MaxSubscriptions) {
+		warning = fmt.Sprintf("%d/%d subscriptions open", len(c.subs), lim.MaxSubscriptions)
+	} else if nearLimit(filters, lim.MaxFilters) {
+		warning = fmt.Sprintf("%d/%d filters in REQ %q", filters, lim.MaxFilters, subID)
+	}
+	return "", nil, warning
+}
+
+func (t *connTracker) admit(ctx context.Context, filter nostr.Filter) string {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return ""
+	}
+	lim := limits.forConn(ctx, ws)
+
+	t.mu.Lock()
+	c, ok := t.conns[ws]
+	if !ok {
+		t.mu.Unlock()
+		return ""
+	}
+	subID := khatru.GetSubscriptionID(ctx)
+	code, args, warning := c.admitFilter(ctx, subID, filter, lim)
+	if code != "" && !lim.EnforceSubscription {
+		// Dry run: record the filter as if the limits were disabled.
+		c.admitFilter(ctx, subID, filter, relayLimits{})
+	}
+	t.mu.Unlock()
+
+	who := clientLabel(ws)
+	if warning != "" {
+		log.Printf("[limits] %s near limit: %s", who, warning)
+	}
+	if code == "" {
+		return ""
+	}
+	reason := say(ctx, code, args...)
+	if !lim.EnforceSubscription {
+		log.Printf("[limits] %s would be rejected: %s", who, reason)
+		return ""
+	}
+	log.Printf("[limits] Rejected %s: %s", who, reason)
+	return reason
+}
+
+// limitFilter is the RejectFilter hook. It runs after the access policy so
+// subscriptions that policy refuses are never counted as open.
+func (t *connTracker) limitFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	reason := t.admit(ctx, filter)
+	return reason != "", reason
+}
+
+// rejectLiveFilter returns the OverwriteFilter hook that holds limit:0
+// filters, which khatru subscribes without consulting RejectFilter, to the
+// access policy. Refused ones have LimitZero cleared so they take the
+// RejectFilter path, where policy refuses them again and they are CLOSED.
+func rejectLiveFilter(policy func(context.Context, nostr.Filter) (bool, string)) func(context.Context, *nostr.Filter) {
+	return func(ctx context.Context, filter *nostr.Filter) {
+		if !filter.LimitZero {
+			return
+		}
+		if reject, _ := policy(ctx, *filter); reject {
+			filter.LimitZero = false
+		}
+	}
+}
+
+// limitLiveFilter is the OverwriteFilter hook for limit:0 filters, which
+// khatru subscribes without consulting RejectFilter. Over-limit ones have
+// LimitZero cleared so they take the RejectFilter path and are CLOSED there.
+// It runs after rejectLiveFilter so filters the policy refuses are never
+// counted as open.
+func (t *connTracker) limitLiveFilter(ctx context.Context, filter *nostr.Filter) {
+	if !filter.LimitZero {
+		return
+	}
+	if reason := t.admit(ctx, *filter); reason != "" {
+		filter.LimitZero = false
+	}
+}
+
+// forConn returns the limits that apply on ws: lim with the admin ceilings
+// once the community admin has authenticated on it.
+func (lim relayLimits) forConn(ctx context.Context, ws *khatru.WebSocket) relayLimits {
+	if ws.AuthedPublicKey == "" || ws.AuthedPublicKey != communityOf(ctx).admin() {
+		return lim
+	}
+	lim.MaxSubscriptions = lim.AdminMaxSubscriptions
+	lim.MaxREQsPerMinute = lim.AdminMaxREQsPerMinute
+	return lim
+}
+
+// reqBucket is a connection's token bucket of REQs. It holds a minute's
+// allowance and refills continuously.
+type reqBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token at now, refilling at perMinute, and reports whether
+// one was available.
+func (b *reqBucket) take(now time.Time, perMinute int) bool {
+	capacity := float64(perMinute)
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens = min(capacity, b.tokens+now.Sub(b.last).Minutes()*capacity)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// meterREQ is the OverwriteFilter hook that spends a token of the
+// connection's bucket for each REQ, at its first filter, so a client over
+// the rate costs no policy lookups or queries. khatru runs it before
+// RejectFilter and for limit:0 filters too; those of a REQ over the rate
+// lose LimitZero so limitREQRate can CLOSE them.
+func (t *connTracker) meterREQ(ctx context.Context, filter *nostr.Filter) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return
+	}
+	lim := limits.forConn(ctx, ws)
+
+	t.mu.Lock()
+	c, ok := t.conns[ws]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	over, metered := c.metered[ctx]
+	if !metered {
+		over = lim.MaxREQsPerMinute > 0 && !c.reqs.take(time.Now(), lim.MaxREQsPerMinute)
+		if over && !lim.EnforceSubscription {
+			log.Printf("[limits] %s would be rejected: over %d REQs per minute", clientLabel(ws), lim.MaxREQsPerMinute)
+			over = false
+		} else if over {
+			log.Printf("[limits] Rejected %s: over %d REQs per minute", clientLabel(ws), lim.MaxREQsPerMinute)
+		}
+		if c.metered == nil {
+			c.metered = make(map[context.Context]bool)
+		}
+		c.metered[ctx] = over
+		context.AfterFunc(ctx, func() {
+			t.mu.Lock()
+			delete(c.metered, ctx)
+			t.mu.Unlock()
+		})
+	}
+	t.mu.Unlock()
+
+	if over {
+		filter.LimitZero = false
+	}
+}
+
+// limitREQRate is the RejectFilter hook that CLOSEs a REQ meterREQ found
+// over the rate. It runs before the access policy.
+func (t *connTracker) limitREQRate(ctx context.Context, _ nostr.Filter) (bool, string) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return false, ""
+	}
+	lim := limits.forConn(ctx, ws)
+	t.mu.Lock()
+	c, ok := t.conns[ws]
+	over := ok && c.metered[ctx]
+	t.mu.Unlock()
+	if over {
+		return true, fmt.Sprintf("rate-limited: too many REQs (max %d per minute)", lim.MaxREQsPerMinute)
+	}
+	return false, ""
+}
+
+// queryLimit is the LIMIT of a filter's query: the limit it asks for,
+// capped at MaxLimit.
+func queryLimit(requested int) int {
+	max := limits.MaxLimit
+	if max <= 0 {
+		max = defaultMaxLimit
+	}
+	if requested <= 0 || requested > max {
+		return max
+	}
+	return requested
+}
+
+// isBroadFilter reports whether filter constrains nothing an index can use,
+// so its query would scan every event. Since and until alone do not count.
+func isBroadFilter(filter nostr.Filter) bool {
+	if len(filter.IDs) > 0 || len(filter.Authors) > 0 || len(filter.Kinds) > 0 || searchTerms(filter.Search) != "" {
+		return false
+	}
+	for _, values := range filter.Tags {
+		if len(values) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *connTracker) closeSubscription(ws *khatru.WebSocket, subID string) {
+	t.mu.Lock()
+	if c, ok := t.conns[ws]; ok {
+		delete(c.subs, subID)
+		delete(c.andTags, subID)
+	}
+	t.mu.Unlock()
+}
+
+// clientLabel identifies a connection in logs.
+func clientLabel(ws *khatru.WebSocket) string {
+	addr := ws.Request.Header.Get("X-Forwarded-For")
+	if addr == "" {
+		addr = ws.Request.RemoteAddr
+	}
+	if ws.AuthedPublicKey != "" {
+		return fmt.Sprintf("%s (%s)", addr, ws.AuthedPublicKey[:16])
+	}
+	return addr
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+func TestAdmitFilterLimits(t *testing.T) {
+	lim := relayLimits{MaxSubscriptions: 2, MaxFilters: 2, MaxFilterConditions: 3, EnforceSubscription: true}
+	c := &trackedConn{subs: make(map[string]*openSub)}
+	req1, req2, req3 := context.Background(), context.TODO(), context.WithValue(context.Background(), netConnKey{}, 1)
+	admit := func(reqCtx context.Context, subID string, filter nostr.Filter) string {
+		code, args, _ := c.admitFilter(reqCtx, subID, filter, lim)
+		if code == "" {
+			return ""
+		}
+		return render(defaultLanguage, code, args...)
+	}
+
+	if reason := admit(req1, "a", nostr.Filter{Kinds: []int{1, 2}}); reason != "" {
+		t.Fatalf("first filter rejected: %s", reason)
+	}
+	if reason := admit(req1, "a", nostr.Filter{}); reason != "" {
+		t.Fatalf("second filter rejected: %s", reason)
+	}
+	if reason := admit(req1, "a", nostr.Filter{}); reason != "error: too many filters (max 2)" {
+		t.Fatalf("third filter in one REQ: got %q", reason)
+	}
+	// Re-using the id in a new REQ replaces the subscription.
+	if reason := admit(req2, "a", nostr.Filter{}); reason != "" {
+		t.Fatalf("replacement REQ rejected: %s", reason)
+	}
+	if reason := admit(req2, "b", nostr.Filter{Authors: []string{"x"}, Tags: nostr.TagMap{"p": {"y", "z"}}}); reason != "" {
+		t.Fatalf("second subscription rejected: %s", reason)
+	}
+	if reason := admit(req3, "c", nostr.Filter{}); reason != "error: too many subscriptions (max 2)" {
+		t.Fatalf("third subscription: got %q", reason)
+	}
+	if reason := admit(req3, "b", nostr.Filter{Kinds: []int{1, 2, 3, 4}}); !strings.HasPrefix(reason, "error: filter too complex") {
+		t.Fatalf("complex filter: got %q", reason)
+	}
+	if len(c.subs) != 2 {
+		t.Fatalf("rejected filters must not be recorded, have %d subs", len(c.subs))
+	}
+}
+
+func TestSniffConnCapturesCommands(t *testing.T) {
+	var got []string
+	c := &sniffConn{}
+	c.watch(func(msg []byte) { got = append(got, string(msg)) })
+
+	req := `["REQ","x",{"kinds":[30023],"&t":["vegan","dessert"]}]`
+	var stream []byte
+	stream = append(stream, maskedFrame(0x2, make([]byte, 300))...) // binary, skipped
+	stream = append(stream, maskedFrame(0x1, []byte(req))...)
+	stream = append(stream, maskedFrame(0x9, nil)...) // ping
+	stream = append(stream, maskedFrame(0x1, []byte(`["CLOSE","feed"]`))...)
+	stream = append(stream, maskedFrame(0x1, []byte(`["EVENT",{"content":"[\"CLOSE\"]"}]`))...)
+	stream = append(stream, maskedFrame(0x1, []byte(`[ "CLOSE" , "second" ]`))...)
+	stream = append(stream, maskedFrame(0x1, []byte(`["REQ","big",{"authors":["`+strings.Repeat("a", 70000)+`"]}]`))...)
+
+	// Deliver in awkward chunk sizes so headers and payloads straddle reads.
+	for len(stream) > 0 {
+		n := 3
+		if n > len(stream) {
+			n = len(stream)
+		}
+		c.feed(stream[:n])
+		stream = stream[n:]
+	}
+	want := []string{req, `["CLOSE","feed"]`, `[ "CLOSE" , "second" ]`}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func maskedFrame(opcode byte, payload []byte) []byte {
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestSubscriptionCapFreedByClose(t *testing.T) {
+	saved := limits
+	limits = relayLimits{MaxSubscriptions: 2, MaxFilters: 10, MaxFilterConditions: 100, EnforceSubscription: true}
+	defer func() { limits = saved }()
+
+	tracker := &connTracker{conns: make(map[*khatru.WebSocket]*trackedConn)}
+	rl := khatru.NewRelay()
+	rl.OnConnect = append(rl.OnConnect, tracker.onConnect)
+	rl.OnDisconnect = append(rl.OnDisconnect, tracker.onDisconnect)
+	rl.RejectFilter = append(rl.RejectFilter, tracker.limitFilter)
+	rl.OverwriteFilter = append(rl.OverwriteFilter, tracker.limitLiveFilter)
+	url := startTestRelay(t, rl, testServerConfig(false))
+	c := dialTestRelay(t, url)
+
+	if got := c.req("a", `{"kinds":[1]}`); got != "EOSE" {
+		t.Fatalf("a: %s", got)
+	}
+	if got := c.req("b", `{"kinds":[1],"limit":0}`); got != "EOSE" {
+		t.Fatalf("b: %s", got)
+	}
+	if got := c.req("c", `{"kinds":[1],"limit":0}`); !strings.HasPrefix(got, "error: too many subscriptions") {
+		t.Fatalf("c over the cap: %s", got)
+	}
+
+	// The CLOSE is sniffed as it is read, before the REQ behind it.
+	c.send(`["CLOSE","a"]`)
+	if got := c.req("c", `{"kinds":[1]}`); got != "EOSE" {
+		t.Fatalf("c after CLOSE: %s", got)
+	}
+}
+
+// A limit:0 REQ skips khatru's RejectFilter, so an anonymous one for
+// reports would be left open for every live report without the policy
+// hook.
+func TestLiveOnlyFilterMeetsThePolicy(t *testing.T) {
+	rl := khatru.NewRelay()
+	rl.RejectFilter = append(rl.RejectFilter, rejectFilterPolicy)
+	rl.OverwriteFilter = append(rl.OverwriteFilter, rejectLiveFilter(rejectFilterPolicy))
+	url := startTestRelay(t, rl, testServerConfig(false))
+	c := dialTestRelay(t, url)
+
+	if got := c.req("reports", `{"kinds":[1984],"limit":0}`); !strings.HasPrefix(got, "auth-required:") {
+		t.Fatalf("anonymous live reports: %s", got)
+	}
+	if got := c.req("recipes", `{"kinds":[30023],"limit":0}`); got != "EOSE" {
+		t.Fatalf("anonymous live recipes: %s", got)
+	}
+
+	sk := nostr.GeneratePrivateKey()
+	report := signedEvent(t, sk, nostr.KindReporting, nostr.Now(), nostr.Tags{{"p", pubkeys(1)[0], "spam"}}, "")
+	recipe := signedEvent(t, sk, KindRecipe, nostr.Now(), nostr.Tags{{"d", "soup"}}, "")
+	rl.BroadcastEvent(report)
+	rl.BroadcastEvent(recipe)
+	env := c.next(func(env nostr.Envelope) bool { _, ok := env.(*nostr.EventEnvelope); return ok })
+	if got := env.(*nostr.EventEnvelope); got.ID != recipe.ID {
+		t.Fatalf("live delivery after the CLOSED: %s on %s", got.ID, *got.SubscriptionID)
+	}
+}
+
+func TestREQBucket(t *testing.T) {
+	var b reqBucket
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !b.take(now, 3) {
+			t.Fatalf("REQ %d of a full bucket refused", i)
+		}
+	}
+	if b.take(now, 3) {
+		t.Fatal("empty bucket gave a token")
+	}
+	if !b.take(now.Add(20*time.Second), 3) || b.take(now.Add(20*time.Second), 3) {
+		t.Fatal("a third of a minute should refill one token")
+	}
+	for i := 0; i < 3; i++ {
+		if !b.take(now.Add(time.Hour), 3) {
+			t.Fatalf("REQ %d after an idle hour refused", i)
+		}
+	}
+	if b.take(now.Add(time.Hour), 3) {
+		t.Fatal("bucket refilled past a minute's allowance")
+	}
+}
+
+func TestAdminCeilings(t *testing.T) {
+	lim := relayLimits{MaxSubscriptions: 8, MaxREQsPerMinute: 60, AdminMaxSubscriptions: 80, AdminMaxREQsPerMinute: 600}
+	ctx := context.Background()
+	savedAdmin := adminPubkey
+	adminPubkey = pubkeys(1)[0]
+	defer func() { adminPubkey = savedAdmin }()
+	if got := lim.forConn(ctx, &khatru.WebSocket{AuthedPublicKey: adminPubkey}); got.MaxSubscriptions != 80 || got.MaxREQsPerMinute != 600 {
+		t.Fatalf("admin limits %+v", got)
+	}
+	for _, pk := range []string{"", pubkeys(2)[1]} {
+		if got := lim.forConn(ctx, &khatru.WebSocket{AuthedPublicKey: pk}); got.MaxSubscriptions != 8 || got.MaxREQsPerMinute != 60 {
+			t.Fatalf("%q got the admin's limits", pk)
+		}
+	}
+}
+
+func TestREQRateLimit(t *testing.T) {
+	saved := limits
+	limits = relayLimits{MaxSubscriptions: 10, MaxFilters: 10, MaxFilterConditions: 100, EnforceSubscription: true, MaxREQsPerMinute: 2}
+	defer func() { limits = saved }()
+
+	tracker := &connTracker{conns: make(map[*khatru.WebSocket]*trackedConn)}
+	var policyRan atomic.Int32
+	rl := khatru.NewRelay()
+	rl.OnConnect = append(rl.OnConnect, tracker.onConnect)
+	rl.OnDisconnect = append(rl.OnDisconnect, tracker.onDisconnect)
+	rl.RejectFilter = append(rl.RejectFilter, tracker.limitREQRate, func(context.Context, nostr.Filter) (bool, string) {
+		policyRan.Add(1)
+		return false, ""
+	}, tracker.limitFilter)
+	rl.OverwriteFilter = append(rl.OverwriteFilter, tracker.meterREQ, tracker.limitLiveFilter)
+	url := startTestRelay(t, rl, testServerConfig(false))
+	c := dialTestRelay(t, url)
+
+	// Two filters in one REQ cost one token.
+	if got := c.req("a", `{"kinds":[1]},{"kinds":[2]}`); got != "EOSE" {
+		t.Fatalf("a: %s", got)
+	}
+	if got := c.req("b", `{"kinds":[1]}`); got != "EOSE" {
+		t.Fatalf("b: %s", got)
+	}
+	for _, filter := range []string{`{"kinds":[1]}`, `{"kinds":[1],"limit":0}`} {
+		if got := c.req("c", filter); !strings.HasPrefix(got, "rate-limited: too many REQs") {
+			t.Fatalf("REQ %s over the rate: %s", filter, got)
+		}
+	}
+	if n := policyRan.Load(); n != 3 {
+		t.Fatalf("policy ran for %d filters, want only the 3 admitted", n)
+	}
+}
+
+func TestRelayInfoAdvertisesEveryLimit(t *testing.T) {
+	// Every field must be non-zero here so a missing NIP-11 mapping shows up.
+	lim := relayLimits{
+		MaxMessageLength:      1234,
+		MaxSubscriptions:      7,
+		MaxFilters:            3,
+		MaxFilterConditions:   99,
+		EnforceSubscription:   true,
+		MaxREQsPerMinute:      60,
+		AdminMaxSubscriptions: 70,
+		AdminMaxREQsPerMinute: 600,
+		MaxLimit:              250,
+		AuthRequired:          true,
+		RestrictedWrites:      true,
+		PaymentRequired:       true,
+		MinPowDifficulty:      8,
+		CreatedAtLowerLimit:   365 * 24 * time.Hour,
+		CreatedAtUpperLimit:   10 * time.Minute,
+		PostingPolicy:         "https://example.com/terms",
+		PaymentsURL:           "https://example.com/pay",
+		MembershipFee:         21000,
+		MembershipPeriod:      30 * 24 * time.Hour,
+		Retention:             []retentionRule{{Kinds: []int{9}, Time: 3600}},
+	}
+
+	savedRelay, savedLimits := relay, limits
+	defer func() { relay, limits = savedRelay, savedLimits }()
+	relay = khatru.NewRelay()
+	applyLimits(relay, lim)
+
+	if relay.MaxMessageSize != int64(lim.MaxMessageLength) {
+		t.Errorf("khatru MaxMessageSize = %d, want %d", relay.MaxMessageSize, lim.MaxMessageLength)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/nostr+json")
+	if !isRelayInfoRequest(req) {
+		t.Fatal("NIP-11 request not recognized")
+	}
+	handleRelayInfo(rec, req)
+	var doc interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("decode NIP-11: %v", err)
+	}
+
+	v := reflect.ValueOf(lim)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		path, ok := field.Tag.Lookup("nip11")
+		if !ok {
+			t.Errorf("%s has no nip11 tag; advertise it or tag it \"-\"", field.Name)
+			continue
+		}
+		if v.Field(i).IsZero() {
+			t.Errorf("%s is zero in this test; give it a value", field.Name)
+			continue
+		}
+		if path == "-" {
+			continue
+		}
+
+		want := v.Field(i).Interface()
+		if d, ok := want.(time.Duration); ok {
+			want = int64(d.Seconds())
+		}
+		raw, _ := json.Marshal(want)
+		var wantJSON interface{}
+		json.Unmarshal(raw, &wantJSON)
+
+		got, found := lookupJSONPath(doc, path)
+		if !found || !reflect.DeepEqual(got, wantJSON) {
+			t.Errorf("%s: NIP-11 %s = %v, want %v", field.Name, path, got, wantJSON)
+		}
+	}
+}
+
+func lookupJSONPath(doc interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			doc = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+func TestRelayInfoAdvertisesRetention(t *testing.T) {
+	savedRelay, savedLimits := relay, limits
+	defer func() { relay, limits = savedRelay, savedLimits }()
+	relay = khatru.NewRelay()
+	nip11Retention := func() string {
+		applyLimits(relay, limits)
+		rec := httptest.NewRecorder()
+		handleRelayInfo(rec, httptest.NewRequest("GET", "/", nil))
+		var doc struct {
+			Retention json.RawMessage `json:"retention"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+			t.Fatalf("decode NIP-11: %v", err)
+		}
+		return string(doc.Retention)
+	}
+
+	t.Setenv("RELAY_CHAT_RETENTION", "")
+	loadLimits()
+	if got, want := nip11Retention(), `[{"kinds":[[20000,29999]],"time":0}]`; got != want {
+		t.Errorf("retention without chat retention = %s, want %s", got, want)
+	}
+
+	t.Setenv("RELAY_CHAT_RETENTION", "720h")
+	loadLimits()
+	if got, want := nip11Retention(), `[{"kinds":[[20000,29999]],"time":0},{"kinds":[9,10],"time":2592000}]`; got != want {
+		t.Errorf("retention with chat retention = %s, want %s", got, want)
+	}
+	if got := chatRetention(KindGroupChat); got != 720*time.Hour {
+		t.Errorf("advertised chat retention is not enforced: %s", got)
+	}
+}
+
+func TestAuthRequiredGatesPublicReads(t *testing.T) {
+	saved := limits
+	defer func() { limits = saved }()
+
+	recipes := nostr.Filter{Kinds: []int{KindRecipe}}
+	limits = relayLimits{}
+	if reject, msg := rejectFilterPolicy(context.Background(), recipes); reject {
+		t.Fatalf("anonymous recipe read rejected by default: %s", msg)
+	}
+	limits.AuthRequired = true
+	if reject, msg := rejectFilterPolicy(context.Background(), recipes); !reject || !strings.HasPrefix(msg, "auth-required:") {
+		t.Fatalf("anonymous recipe read with auth required: %v %q", reject, msg)
+	}
+	evt := &nostr.Event{Kind: KindRecipe}
+	if reject, msg := rejectEventPolicy(context.Background(), evt); !reject || !strings.HasPrefix(msg, "auth-required:") {
+		t.Fatalf("anonymous recipe write with auth required: %v %q", reject, msg)
+	}
+}
+
+func TestQueryLimit(t *testing.T) {
+	saved := limits
+	defer func() { limits = saved }()
+	limits = relayLimits{MaxLimit: 200}
+	for requested, want := range map[int]int{0: 200, 50: 50, 200: 200, 100000: 200} {
+		if got := queryLimit(requested); got != want {
+			t.Errorf("limit %d: got %d, want %d", requested, got, want)
+		}
+	}
+	if query, _ := buildQuery(nostr.Filter{Kinds: []int{KindRecipe}, Limit: 100000}); !strings.HasSuffix(query, " LIMIT 200") {
+		t.Fatalf("limit not capped: %s", query)
+	}
+	limits = relayLimits{}
+	if got := queryLimit(0); got != defaultMaxLimit {
+		t.Fatalf("unset MaxLimit caps at %d", got)
+	}
+}
+
+func TestBroadFiltersNeedTheAdmin(t *testing.T) {
+	for filter, broad := range map[string]bool{
+		`{}`:                    true,
+		`{"since":1,"limit":5}`: true,
+		`{"#t":[]}`:             true,
+		`{"kinds":[30023]}`:     false,
+		`{"#t":["bread"]}`:      false,
+		`{"search":"bread"}`:    false,
+	} {
+		var f nostr.Filter
+		json.Unmarshal([]byte(filter), &f)
+		if isBroadFilter(f) != broad {
+			t.Errorf("%s: broad = %v", filter, !broad)
+		}
+	}
+
+	adminSK := nostr.GeneratePrivateKey()
+	prev := adminPubkey
+	adminPubkey, _ = nostr.GetPublicKey(adminSK)
+	defer func() { adminPubkey = prev }()
+
+	rl := khatru.NewRelay()
+	rl.RejectFilter = append(rl.RejectFilter, rejectFilterPolicy)
+	url := startTestRelay(t, rl, testServerConfig(true))
+
+	broad := func(sk string) string {
+		t.Helper()
+		c := dialTestRelay(t, url)
+		challenge := c.challenge()
+		if sk != "" && !c.auth(url, challenge, sk) {
+			t.Fatal("AUTH refused")
+		}
+		return c.req("backup", `{"since":0}`)
+	}
+	if got := broad(""); got != "blocked: filter too broad" {
+		t.Fatalf("anonymous broad filter: %s", got)
+	}
+	if got := broad(adminSK); got != "EOSE" {
+		t.Fatalf("admin backup filter: %s", got)
+	}
+}
+
+func TestRejectEventLimits(t *testing.T) {
+	saved := limits
+	defer func() { limits = saved }()
+	limits = relayLimits{CreatedAtLowerLimit: 24 * time.Hour, CreatedAtUpperLimit: 15 * time.Minute}
+	ctx := context.Background()
+	now := nostr.Now()
+	for _, tc := range []struct {
+		createdAt nostr.Timestamp
+		reject    bool
+	}{
+		{now, false},
+		{now + 60, false},
+		{now + 3600, true},
+		{now - 3600, false},
+		{now - 2*24*3600, true},
+	} {
+		if reject, msg := rejectEventLimits(ctx, &nostr.Event{CreatedAt: tc.createdAt, ID: strings.Repeat("f", 64)}); reject != tc.reject {
+			t.Errorf("created_at %+d: reject = %v (%s)", tc.createdAt-now, reject, msg)
+		}
+	}
+
+}
+
+// powRecipe signs a recipe whose nonce tag commits to target and whose id
+// has at least work leading zero bits.
+func powRecipe(t *testing.T, target, work int) *nostr.Event {
+	t.Helper()
+	sk := nostr.GeneratePrivateKey()
+	evt := &nostr.Event{Kind: KindRecipe, CreatedAt: nostr.Now(), Content: "focaccia"}
+	evt.PubKey, _ = nostr.GetPublicKey(sk)
+	for n := 0; ; n++ {
+		evt.Tags = nostr.Tags{{"d", "focaccia"}, {"nonce", strconv.Itoa(n), strconv.Itoa(target)}}
+		if nip13.Difficulty(evt.GetID()) >= work {
+			break
+		}
+	}
+	if err := evt.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	return evt
+}
+
+func TestRejectRecipePow(t *testing.T) {
+	saved := limits
+	defer func() { limits = saved }()
+	limits = relayLimits{MinPowDifficulty: 8}
+	savedAdmin := adminPubkey
+	adminPubkey = pubkeys(1)[0]
+	defer func() { adminPubkey = savedAdmin }()
+	ctx := context.Background()
+
+	low, high := powRecipe(t, 4, 4), powRecipe(t, 10, 10)
+	liar := powRecipe(t, 24, 8)
+	if nip13.Difficulty(liar.ID) >= 24 {
+		t.Skip("the lying nonce happened to meet its target")
+	}
+	for _, tc := range []struct {
+		name   string
+		event  *nostr.Event
+		pubkey string
+		reject bool
+	}{
+		{"low difficulty", low, "", true},
+		{"high difficulty", high, "", false},
+		{"target above the id's work", liar, "", true},
+		{"no nonce", signedEvent(t, nostr.GeneratePrivateKey(), KindRecipe, nostr.Now(), nostr.Tags{{"d", "x"}}, ""), "", true},
+		{"member", low, adminPubkey, false},
+	} {
+		reject, msg := rejectRecipePow(ctx, tc.event, tc.pubkey)
+		if reject != tc.reject || (reject && msg != "pow: difficulty 8 required") {
+			t.Errorf("%s: %v %q", tc.name, reject, msg)
+		}
+	}
+
+	limits.MinPowDifficulty = 0
+	if reject, _ := rejectRecipePow(ctx, low, ""); reject {
+		t.Error("proof of work required while RELAY_MIN_POW is unset")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// LISTS (NIP-51)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Members keep cookbooks on the relay: NIP-51 sets of recipe a tags, kind
+// 30003 (and the older 30001), plus kind 30000 people sets. Each is
+// addressable by its d tag, so persistEvent keeps the latest version only.
+// Lists are private to their author, like app data (see APP DATA), unless
+// they carry a ["public"] tag: the query leaves out other authors' private
+// lists, live delivery skips them, and a REQ for lists only by other authors
+// is refused unless one of them has a public list of those kinds.
+
+var listKinds = []int{nostr.KindCategorizedPeopleList, nostr.KindCategorizedBookmarksList, nostr.KindBookmarkSets}
+
+func isListKind(kind int) bool {
+	for _, k := range listKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectList is the write policy for kinds 30000, 30001 and 30003.
+func rejectList(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	if !isActiveMember(ctx, pubkey) {
+		return true, say(ctx, msgMembershipRequired)
+	}
+	if addressableDTag(event) == nil {
+		return true, say(ctx, msgListDTag)
+	}
+	return false, ""
+}
+
+// isPrivateList reports whether event is a list only its author may read.
+func isPrivateList(event *nostr.Event) bool {
+	return isListKind(event.Kind) && event.Tags.GetFirst([]string{"public"}) == nil
+}
+
+// listPrivacyCondition limits lists to the viewer's own and public ones.
+// The admin gets no exception.
+func listPrivacyCondition(viewer string, argIndex int) (string, []interface{}) {
+	return fmt.Sprintf(`(kind NOT IN (%d, %d, %d) OR pubkey = $%d
+		OR EXISTS (SELECT 1 FROM jsonb_array_elements(tags) t WHERE t->>0 = 'public'))`,
+		listKinds[0], listKinds[1], listKinds[2], argIndex), []interface{}{viewer}
+}
+
+// rejectListFilter refuses a filter for lists only, by authors other than
+// viewer, none of whom has a public list of those kinds: all it could
+// return is private.
+func rejectListFilter(ctx context.Context, filter nostr.Filter, viewer string) (bool, string) {
+	if len(filter.Kinds) == 0 || len(filter.Authors) == 0 {
+		return false, ""
+	}
+	for _, k := range filter.Kinds {
+		if !isListKind(k) {
+			return false, ""
+		}
+	}
+	var others []string
+	for _, author := range filter.Authors {
+		if author == viewer {
+			return false, ""
+		}
+		others = append(others, author)
+	}
+	var public bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM events
+			WHERE pubkey = ANY($1) AND kind = ANY($2::int[]) AND community = $3
+			AND EXISTS (SELECT 1 FROM jsonb_array_elements(tags) t WHERE t->>0 = 'public')
+		)
+	`, pq.Array(others), pq.Array(filter.Kinds), communityOf(ctx).id()).Scan(&public)
+	if err != nil {
+		log.Printf("Error checking public lists: %v", err)
+		return true, say(ctx, msgListPrivate)
+	}
+	if !public {
+		return true, say(ctx, msgListPrivate)
+	}
+	return false, ""
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPrivateList(t *testing.T) {
+	for _, tc := range []struct {
+		event nostr.Event
+		want  bool
+	}{
+		{nostr.Event{Kind: nostr.KindBookmarkSets, Tags: nostr.Tags{{"d", "weeknight"}}}, true},
+		{nostr.Event{Kind: nostr.KindCategorizedBookmarksList, Tags: nostr.Tags{{"d", "saved"}}}, true},
+		{nostr.Event{Kind: nostr.KindCategorizedPeopleList, Tags: nostr.Tags{{"d", "bakers"}}}, true},
+		{nostr.Event{Kind: nostr.KindBookmarkSets, Tags: nostr.Tags{{"d", "holiday"}, {"public"}}}, false},
+		{nostr.Event{Kind: nostr.KindCuratedSets, Tags: nostr.Tags{{"d", "2026-W42"}}}, false},
+	} {
+		if got := isPrivateList(&tc.event); got != tc.want {
+			t.Errorf("kind %d %v: got %v", tc.event.Kind, tc.event.Tags, got)
+		}
+	}
+}
+
+func TestListConditionOnlyForListKinds(t *testing.T) {
+	viewer := pubkeys(1)[0]
+	if q, _ := buildViewerQuery(nostr.Filter{Kinds: []int{KindRecipe}}, nil, viewer, false); strings.Contains(q, "'public'") {
+		t.Fatalf("list privacy applied to recipes: %s", q)
+	}
+	for _, filter := range []nostr.Filter{{Kinds: []int{nostr.KindBookmarkSets}}, {Authors: pubkeys(2)}} {
+		if q, _ := buildViewerQuery(filter, nil, adminPubkey, false); !strings.Contains(q, "kind NOT IN (30000, 30001, 30003)") {
+			t.Fatalf("%v can return lists but is not checked: %s", filter, q)
+		}
+	}
+}
+
+func TestRejectList(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	member, outsider := pubkeys(2)[0], pubkeys(2)[1]
+	addTestMember(t, member)
+
+	cookbook := &nostr.Event{Kind: nostr.KindBookmarkSets, Tags: nostr.Tags{{"d", "weeknight"}, {"a", "30023:" + outsider + ":focaccia"}}}
+	if reject, msg := rejectList(ctx, cookbook, member); reject {
+		t.Fatalf("member rejected: %s", msg)
+	}
+	if reject, _ := rejectList(ctx, &nostr.Event{Kind: nostr.KindBookmarkSets}, member); !reject {
+		t.Fatal("list without a d tag accepted")
+	}
+	if reject, _ := rejectList(ctx, cookbook, outsider); !reject {
+		t.Fatal("non-member accepted")
+	}
+}
+
+// Member A reads their own lists and other members' public ones; a REQ for
+// member B's private cookbook is refused.
+func TestListReads(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	keys := map[string]string{}
+	for _, name := range []string{"a", "b", "c"} {
+		keys[name] = nostr.GeneratePrivateKey()
+		pk, _ := nostr.GetPublicKey(keys[name])
+		addTestMember(t, pk)
+	}
+	pk := func(name string) string { p, _ := nostr.GetPublicKey(keys[name]); return p }
+
+	now := nostr.Now()
+	own := signedEvent(t, keys["a"], nostr.KindBookmarkSets, now, nostr.Tags{{"d", "soups"}}, "")
+	private := signedEvent(t, keys["b"], nostr.KindBookmarkSets, now, nostr.Tags{{"d", "weeknight"}}, "")
+	public := signedEvent(t, keys["c"], nostr.KindBookmarkSets, now, nostr.Tags{{"d", "holiday"}, {"public"}}, "")
+	for _, evt := range []*nostr.Event{own, private, public} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rl := khatru.NewRelay()
+	rl.QueryEvents = append(rl.QueryEvents, queryEvents)
+	rl.RejectFilter = append(rl.RejectFilter, rejectFilterPolicy)
+	url := startTestRelay(t, rl, testServerConfig(true))
+	c := dialTestRelay(t, url)
+	if !c.auth(url, c.challenge(), keys["a"]) {
+		t.Fatal("AUTH refused")
+	}
+	fetch := func(subID, filter string) []string {
+		t.Helper()
+		c.send(`["REQ","` + subID + `",` + filter + `]`)
+		var ids []string
+		for {
+			env := c.next(func(env nostr.Envelope) bool {
+				switch env := env.(type) {
+				case *nostr.EventEnvelope:
+					return *env.SubscriptionID == subID
+				case *nostr.EOSEEnvelope:
+					return string(*env) == subID
+				case *nostr.ClosedEnvelope:
+					return env.SubscriptionID == subID
+				}
+				return false
+			})
+			evt, ok := env.(*nostr.EventEnvelope)
+			if !ok {
+				return ids
+			}
+			ids = append(ids, evt.Event.ID)
+		}
+	}
+
+	if reason := c.req("b", `{"kinds":[30003],"authors":["`+pk("b")+`"]}`); !strings.HasPrefix(reason, "restricted:") {
+		t.Errorf("member B's private cookbook: %q", reason)
+	}
+	if got := fetch("c", `{"kinds":[30003],"authors":["`+pk("c")+`"]}`); !slices.Equal(got, []string{public.ID}) {
+		t.Errorf("member C's public cookbook: %v", got)
+	}
+	if got := fetch("own", `{"kinds":[30003],"authors":["`+pk("a")+`"]}`); !slices.Equal(got, []string{own.ID}) {
+		t.Errorf("own cookbook: %v", got)
+	}
+	got := fetch("all", `{"kinds":[30003]}`)
+	slices.Sort(got)
+	want := []string{own.ID, public.ID}
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("every cookbook: %v, want own and public", got)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// LIVE ACTIVITIES (NIP-53)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Cook-along streams are announced as kind 30311 (addressable, one per host
+// and d tag) and chatted about with kind 1311, which points at the activity
+// through an a tag ("30311:<host>:<d>"). The a tag lands in event_tags, so
+// the per-stream chat query is an index probe. An activity only moves
+// forward through planned → live → ended. When RELAY_LIVE_CHAT_RETENTION is
+// set, chat of a stream that ended longer ago than that is purged.
+
+const (
+	KindLiveActivity = 30311
+	KindLiveChat     = 1311
+)
+
+var (
+	liveActivitiesAdminOnly bool
+	liveChatRetention       time.Duration
+)
+
+func loadLiveConfig() {
+	liveActivitiesAdminOnly = envBool("RELAY_LIVE_ACTIVITIES_ADMIN_ONLY", false)
+	liveChatRetention = envDuration("RELAY_LIVE_CHAT_RETENTION", 0)
+}
+
+// liveStatusRank orders the NIP-53 statuses; -1 for anything else.
+func liveStatusRank(status string) int {
+	switch status {
+	case "planned":
+		return 0
+	case "live":
+		return 1
+	case "ended":
+		return 2
+	}
+	return -1
+}
+
+func liveStatus(tags nostr.Tags) string {
+	if tag := tags.GetFirst([]string{"status", ""}); tag != nil {
+		return (*tag)[1]
+	}
+	return ""
+}
+
+// rejectLiveActivity is the write policy for kind 30311.
+func rejectLiveActivity(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	if liveActivitiesAdminOnly && pubkey != communityAdmin(ctx) {
+		return true, say(ctx, msgLiveAdminOnly)
+	}
+	if !isActiveMember(ctx, pubkey) {
+		return true, say(ctx, msgMembershipRequired)
+	}
+	dTag := addressableDTag(event)
+	if dTag == nil {
+		return true, say(ctx, msgLiveDTag)
+	}
+	status := liveStatus(event.Tags)
+	if liveStatusRank(status) < 0 {
+		return true, say(ctx, msgLiveStatus)
+	}
+
+	var rawTags []byte
+	err := db.QueryRowContext(ctx, `
+		SELECT tags FROM events WHERE kind = $1 AND pubkey = $2 AND d_tag = $3 AND created_at <= $4
+		AND community = $5
+		ORDER BY created_at DESC LIMIT 1
+	`, KindLiveActivity, pubkey, *dTag, int64(event.CreatedAt), communityOf(ctx).id()).Scan(&rawTags)
+	if err != nil {
+		// No earlier version (or a newer one exists and will win anyway).
+		return false, ""
+	}
+	var previous nostr.Tags
+	json.Unmarshal(rawTags, &previous)
+	if prev := liveStatus(previous); liveStatusRank(status) < liveStatusRank(prev) {
+		return true, say(ctx, msgLiveStatusBackwards, prev, status)
+	}
+	return false, ""
+}
+
+// rejectLiveChat is the write policy for kind 1311: the same membership bar
+// as group chat, and the a tag must name a stored activity.
+func rejectLiveChat(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	if !isActiveMember(ctx, pubkey) {
+		return true, say(ctx, msgMembershipForLiveChat)
+	}
+	tag := event.Tags.GetFirst([]string{"a", fmt.Sprintf("%d:", KindLiveActivity)})
+	if tag == nil {
+		return true, say(ctx, msgLiveChatATag)
+	}
+	parts := strings.SplitN((*tag)[1], ":", 3)
+	if len(parts) != 3 || !nostr.IsValid32ByteHex(parts[1]) {
+		return true, say(ctx, msgLiveMalformedAddress)
+	}
+	var exists bool
+	db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM events WHERE kind = $1 AND pubkey = $2 AND d_tag = $3 AND community = $4)
+	`, KindLiveActivity, parts[1], parts[2], communityOf(ctx).id()).Scan(&exists)
+	if !exists {
+		return true, say(ctx, msgLiveNotFound)
+	}
+	return false, ""
+}
+
+// purgeEndedLiveChat deletes chat of activities whose current version says
+// ended and was published more than liveChatRetention ago.
+func purgeEndedLiveChat(ctx context.Context) (int64, error) {
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM events WHERE kind = $1 AND id IN (
+			SELECT et.event_id FROM event_tags et
+			JOIN events act ON act.kind = $2
+				AND et.tag_value = act.kind || ':' || act.pubkey || ':' || act.d_tag
+			WHERE et.tag_name = 'a'
+			AND act.tags @> '[["status", "ended"]]'::jsonb
+			AND act.created_at < EXTRACT(EPOCH FROM NOW())::bigint - $3
+		)
+	`, KindLiveChat, KindLiveActivity, int64(liveChatRetention.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// runLiveChatPurger applies the ended-stream chat retention hourly.
+func runLiveChatPurger(ctx context.Context) {
+	if liveChatRetention <= 0 {
+		return
+	}
+	log.Printf("[live] Purging chat of streams ended more than %s ago", liveChatRetention)
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if n, err := purgeEndedLiveChat(ctx); err != nil {
+			log.Printf("[live] Error purging ended stream chat: %v", err)
+		} else if n > 0 {
+			log.Printf("[live] Purged %d chat messages of ended streams", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
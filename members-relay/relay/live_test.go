@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func addTestMember(t *testing.T, pubkey string) {
+	t.Helper()
+	if _, err := db.ExecContext(context.Background(), `
+		INSERT INTO members (pubkey, status, subscription_start, subscription_end)
+		VALUES ($1, 'active', NOW(), NOW() + INTERVAL '30 days')
+	`, pubkey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLiveActivityTransitions(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	host, _ := nostr.GetPublicKey(sk)
+	addTestMember(t, host)
+	now := nostr.Now()
+
+	publish := func(status string, at nostr.Timestamp) string {
+		evt := signedEvent(t, sk, KindLiveActivity, at, nostr.Tags{{"d", "sourdough-week-3"}, {"status", status}}, "")
+		if reject, msg := rejectLiveActivity(ctx, evt, host); reject {
+			return msg
+		}
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+		return ""
+	}
+
+	if msg := publish("planned", now-30); msg != "" {
+		t.Fatalf("planned rejected: %s", msg)
+	}
+	if msg := publish("live", now-20); msg != "" {
+		t.Fatalf("live rejected: %s", msg)
+	}
+	if msg := publish("planned", now-10); msg == "" {
+		t.Fatal("live -> planned accepted")
+	}
+	if msg := publish("ended", now); msg != "" {
+		t.Fatalf("ended rejected: %s", msg)
+	}
+	if msg := publish("streaming", now+1); msg == "" {
+		t.Fatal("unknown status accepted")
+	}
+}
+
+func TestPurgeEndedLiveChat(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	hostSK, chatSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	host, _ := nostr.GetPublicKey(hostSK)
+	chatter, _ := nostr.GetPublicKey(chatSK)
+	addTestMember(t, chatter)
+
+	prev := liveChatRetention
+	liveChatRetention = time.Hour
+	defer func() { liveChatRetention = prev }()
+
+	old := nostr.Now() - 2*3600
+	ended := signedEvent(t, hostSK, KindLiveActivity, old, nostr.Tags{{"d", "ended"}, {"status", "ended"}}, "")
+	live := signedEvent(t, hostSK, KindLiveActivity, old, nostr.Tags{{"d", "still-live"}, {"status", "live"}}, "")
+	for _, evt := range []*nostr.Event{ended, live} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chat := func(d string) *nostr.Event {
+		evt := signedEvent(t, chatSK, KindLiveChat, old, nostr.Tags{{"a", "30311:" + host + ":" + d}}, "hi")
+		if reject, msg := rejectLiveChat(ctx, evt, chatter); reject {
+			t.Fatalf("chat rejected: %s", msg)
+		}
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+		return evt
+	}
+	chat("ended")
+	kept := chat("still-live")
+
+	if reject, _ := rejectLiveChat(ctx, signedEvent(t, chatSK, KindLiveChat, old, nostr.Tags{{"a", "30311:" + host + ":nope"}}, ""), chatter); !reject {
+		t.Fatal("chat for an unknown activity accepted")
+	}
+
+	n, err := purgeEndedLiveChat(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("purged %d (%v), want 1", n, err)
+	}
+	var left string
+	if err := db.QueryRowContext(ctx, "SELECT id FROM events WHERE kind = $1", KindLiveChat).Scan(&left); err != nil || left != kept.ID {
+		t.Fatalf("remaining chat %s (%v)", left, err)
+	}
+}
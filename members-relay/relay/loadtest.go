@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// LOAD TEST
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Synthetic data is marked so it can always be told apart from real members:
+// members rows carry payment_method = loadtestMarker and payment_id = run id,
+// and groups are named "loadtest-<run id>-<n>".
+const loadtestMarker = "loadtest"
+
+type loadtestConfig struct {
+	url      string
+	clients  int
+	groups   int
+	rate     float64 // chat messages per second, per client
+	subs     int     // open REQ subscriptions per client
+	duration time.Duration
+}
+
+type latencyRecorder struct {
+	mu      sync.Mutex
+	samples []time.Duration
+}
+
+func (r *latencyRecorder) add(d time.Duration) {
+	r.mu.Lock()
+	r.samples = append(r.samples, d)
+	r.mu.Unlock()
+}
+
+func (r *latencyRecorder) summary() string {
+	r.mu.Lock()
+	samples := append([]time.Duration(nil), r.samples...)
+	r.mu.Unlock()
+	if len(samples) == 0 {
+		return "no samples"
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return fmt.Sprintf("n=%d p50=%s p90=%s p99=%s max=%s", len(samples),
+		percentile(samples, 50), percentile(samples, 90), percentile(samples, 99),
+		samples[len(samples)-1])
+}
+
+// percentile uses the nearest-rank method on an ascending slice.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank].Round(time.Microsecond)
+}
+
+type loadtestRun struct {
+	id     string
+	cfg    loadtestConfig
+	keys   []string
+	groups []string
+
+	published sync.Map // event id -> time.Time of publish
+	ack       latencyRecorder
+	fanout    latencyRecorder
+
+	connected  atomic.Int64
+	connectErr atomic.Int64
+	authErr    atomic.Int64
+	sent       atomic.Int64
+	rejected   atomic.Int64
+}
+
+func (run *loadtestRun) groupPrefix() string {
+	return loadtestMarker + "-" + run.id + "-"
+}
+
+// seed inserts the synthetic members and open groups for this run.
+func (run *loadtestRun) seed(ctx context.Context) error {
+	run.keys = make([]string, run.cfg.clients)
+	pubkeys := make([]string, run.cfg.clients)
+	for i := range run.keys {
+		run.keys[i] = nostr.GeneratePrivateKey()
+		pubkeys[i], _ = nostr.GetPublicKey(run.keys[i])
+	}
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO members (pubkey, status, tier, subscription_start, subscription_end, payment_id, payment_method)
+		SELECT unnest($1::text[]), 'active', 'standard', NOW(), NOW() + INTERVAL '1 day', $2, $3
+	`, pq.Array(pubkeys), run.id, loadtestMarker); err != nil {
+		return fmt.Errorf("seed members: %w", err)
+	}
+
+	run.groups = make([]string, run.cfg.groups)
+	for i := range run.groups {
+		run.groups[i] = fmt.Sprintf("%s%d", run.groupPrefix(), i)
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO groups (id, name, description, is_public, is_open, created_by)
+			VALUES ($1, $1, 'synthetic load test group', false, true, $2)
+		`, run.groups[i], adminPubkey); err != nil {
+			return fmt.Errorf("seed group: %w", err)
+		}
+	}
+	log.Printf("[loadtest] Seeded %d members and %d groups (run %s)", len(pubkeys), len(run.groups), run.id)
+	return nil
+}
+
+// teardownLoadtest removes everything written by the given run, or by every
+// run when runID is empty.
+func teardownLoadtest(ctx context.Context, runID string) error {
+	memberFilter := "payment_method = $1"
+	groupPattern := loadtestMarker + "-%"
+	args := []interface{}{loadtestMarker}
+	if runID != "" {
+		memberFilter += " AND payment_id = $2"
+		groupPattern = loadtestMarker + "-" + runID + "-%"
+		args = append(args, runID)
+	}
+
+	var pubkeys []string
+	if err := db.QueryRowContext(ctx,
+		"SELECT COALESCE(array_agg(pubkey), '{}') FROM members WHERE "+memberFilter, args...,
+	).Scan(pq.Array(&pubkeys)); err != nil {
+		return err
+	}
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"DELETE FROM events WHERE pubkey = ANY($1)", []interface{}{pq.Array(pubkeys)}},
+		{"DELETE FROM events WHERE d_tag LIKE $1", []interface{}{groupPattern}},
+		{`DELETE FROM events WHERE EXISTS (
+			SELECT 1 FROM jsonb_array_elements(tags) t
+			WHERE t->>0 = 'h' AND t->>1 LIKE $1
+		)`, []interface{}{groupPattern}},
+		{"DELETE FROM group_members WHERE group_id LIKE $1", []interface{}{groupPattern}},
+		{"DELETE FROM groups WHERE id LIKE $1", []interface{}{groupPattern}},
+		{"DELETE FROM members WHERE " + memberFilter, args},
+	}
+	for _, stmt := range statements {
+		if _, err := db.ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+			return fmt.Errorf("teardown: %w", err)
+		}
+	}
+	log.Printf("[loadtest] Removed %d synthetic members and their groups/events", len(pubkeys))
+	return nil
+}
+
+// authenticate triggers the relay's AUTH challenge with a group-content REQ
+// and answers it, the same dance a real client does.
+func authenticate(ctx context.Context, r *nostr.Relay, sk, group string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	sub, err := r.Subscribe(ctx, nostr.Filters{{Kinds: []int{KindGroupChat}, Tags: nostr.TagMap{"h": {group}}, Limit: 1}})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsub()
+	select {
+	case reason := <-sub.ClosedReason:
+		if !strings.HasPrefix(reason, "auth-required") {
+			return fmt.Errorf("unexpected CLOSED: %s", reason)
+		}
+	case <-sub.EndOfStoredEvents:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return r.Auth(ctx, func(evt *nostr.Event) error { return evt.Sign(sk) })
+}
+
+func (run *loadtestRun) client(ctx context.Context, i int) {
+	sk := run.keys[i]
+	group := run.groups[i%len(run.groups)]
+
+	r, err := nostr.RelayConnect(ctx, run.cfg.url)
+	if err != nil {
+		run.connectErr.Add(1)
+		return
+	}
+	defer r.Close()
+	run.connected.Add(1)
+
+	if err := authenticate(ctx, r, sk, group); err != nil {
+		run.authErr.Add(1)
+		return
+	}
+
+	join := nostr.Event{Kind: KindJoinRequest, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"h", group}}}
+	join.Sign(sk)
+	if err := r.Publish(ctx, join); err != nil && !strings.Contains(err.Error(), "duplicate:") {
+		run.rejected.Add(1)
+	}
+
+	since := nostr.Now()
+	filters := []nostr.Filter{
+		{Kinds: []int{KindGroupChat}, Tags: nostr.TagMap{"h": {group}}, Since: &since},
+		{Kinds: []int{KindGroupMembers}, Tags: nostr.TagMap{"d": {group}}},
+		{Kinds: []int{KindRecipe}, Limit: 20},
+	}
+	for s := 0; s < run.cfg.subs; s++ {
+		sub, err := r.Subscribe(ctx, nostr.Filters{filters[s%len(filters)]})
+		if err != nil {
+			run.rejected.Add(1)
+			continue
+		}
+		go func() {
+			for evt := range sub.Events {
+				if at, ok := run.published.Load(evt.ID); ok {
+					run.fanout.add(time.Since(at.(time.Time)))
+				}
+			}
+		}()
+	}
+
+	if run.cfg.rate <= 0 {
+		<-ctx.Done()
+		return
+	}
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / run.cfg.rate))
+	defer ticker.Stop()
+	for n := 0; ; n++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		evt := nostr.Event{
+			Kind:      KindGroupChat,
+			CreatedAt: nostr.Now(),
+			Tags:      nostr.Tags{{"h", group}},
+			Content:   fmt.Sprintf("loadtest %s client %d message %d", run.id, i, n),
+		}
+		evt.Sign(sk)
+		start := time.Now()
+		run.published.Store(evt.ID, start)
+		run.sent.Add(1)
+		err := r.Publish(ctx, evt)
+		if ctx.Err() != nil {
+			return
+		}
+		run.ack.add(time.Since(start))
+		if err != nil {
+			run.rejected.Add(1)
+		}
+	}
+}
+
+func (run *loadtestRun) report() {
+	sent := run.sent.Load()
+	errRate := 0.0
+	if sent > 0 {
+		errRate = float64(run.rejected.Load()) / float64(sent) * 100
+	}
+	fmt.Printf("\nLoad test %s against %s\n", run.id, run.cfg.url)
+	fmt.Printf("  clients:   %d requested, %d connected, %d connect errors, %d auth errors\n",
+		run.cfg.clients, run.connected.Load(), run.connectErr.Load(), run.authErr.Load())
+	fmt.Printf("  events:    %d sent, %d rejected/failed (%.2f%%)\n", sent, run.rejected.Load(), errRate)
+	fmt.Printf("  ack:       %s\n", run.ack.summary())
+	fmt.Printf("  fan-out:   %s\n", run.fanout.summary())
+}
+
+// runLoadtest implements `relay loadtest -url wss://... [flags]`. It writes
+// synthetic members and groups into DATABASE_URL, which must be the database
+// behind the target relay, and removes them again when the run ends.
+// `relay loadtest -cleanup` removes leftovers from interrupted runs.
+func runLoadtest(args []string) {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	var cfg loadtestConfig
+	fs.StringVar(&cfg.url, "url", "ws://localhost:3334", "target relay websocket URL")
+	fs.IntVar(&cfg.clients, "clients", 50, "number of simulated clients")
+	fs.IntVar(&cfg.groups, "groups", 5, "number of synthetic groups")
+	fs.Float64Var(&cfg.rate, "rate", 0.2, "chat messages per second per client")
+	fs.IntVar(&cfg.subs, "subs", 3, "open subscriptions per client")
+	fs.DurationVar(&cfg.duration, "duration", time.Minute, "how long to publish")
+	cleanup := fs.Bool("cleanup", false, "only remove synthetic data left by earlier runs")
+	keep := fs.Bool("keep", false, "skip teardown (inspect synthetic data afterwards)")
+	fs.Parse(args)
+
+	adminPubkey = os.Getenv("RELAY_PUBKEY")
+	initDB()
+	defer db.Close()
+
+	if *cleanup {
+		if err := teardownLoadtest(context.Background(), ""); err != nil {
+			log.Fatalf("[loadtest] %v", err)
+		}
+		return
+	}
+	if cfg.clients < 1 || cfg.groups < 1 {
+		log.Fatal("[loadtest] -clients and -groups must be at least 1")
+	}
+
+	idBytes := make([]byte, 4)
+	rand.Read(idBytes)
+	run := &loadtestRun{id: hex.EncodeToString(idBytes), cfg: cfg}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := run.seed(ctx); err != nil {
+		teardownLoadtest(context.Background(), run.id)
+		log.Fatalf("[loadtest] %v", err)
+	}
+	if !*keep {
+		defer teardownLoadtest(context.Background(), run.id)
+	}
+
+	log.Printf("[loadtest] Starting %d clients for %s", cfg.clients, cfg.duration)
+	runCtx, cancel := context.WithTimeout(ctx, cfg.duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			run.client(runCtx, i)
+		}(i)
+	}
+	wg.Wait()
+	run.report()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	samples := make([]time.Duration, 100)
+	for i := range samples {
+		samples[i] = time.Duration(i+1) * time.Millisecond
+	}
+	cases := map[float64]time.Duration{
+		50: 50 * time.Millisecond,
+		90: 90 * time.Millisecond,
+		99: 99 * time.Millisecond,
+		0:  1 * time.Millisecond,
+	}
+	for p, want := range cases {
+		if got := percentile(samples, p); got != want {
+			t.Errorf("p%.0f = %s, want %s", p, got, want)
+		}
+	}
+	if got := percentile([]time.Duration{7 * time.Millisecond}, 99); got != 7*time.Millisecond {
+		t.Errorf("single-sample p99 = %s", got)
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("empty percentile = %s", got)
+	}
+}
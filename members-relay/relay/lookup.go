@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// EVENT LOOKUP (NIP-19)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Server-side rendering needs one event per page, and opening a websocket
+// for it is slow. GET /e/<note|nevent|naddr> decodes the identifier, turns
+// it into a filter and answers with the event's JSON, found by queryEvents.
+// Access is rejectFilterPolicy's: an optional NIP-98 header stands in for
+// NIP-42, so public recipes are 200 for anyone while group content is 401
+// without the header and 403 for a non-member. An identifier by id alone
+// does not tell its kind, so it is first looked up as a public recipe.
+//
+// Answers to anonymous requests are publicly cacheable, an event by id for
+// longer than an address, whose event can be replaced; anything read with
+// NIP-98 is private.
+
+// lookupFilter decodes a NIP-19 identifier into the filter for its event.
+// byID reports a note or nevent, which names one immutable event. The
+// decoding is decodeBech32's (see FEATURED RECIPES): go-nostr's nip19 would
+// pull btcutil into the build for it.
+func lookupFilter(code string) (filter nostr.Filter, byID bool, err error) {
+	hrp := code
+	if sep := strings.LastIndexByte(code, '1'); sep > 0 {
+		hrp = strings.ToLower(code[:sep])
+	}
+	data, ok := decodeBech32(hrp, code)
+	if !ok {
+		return filter, false, errors.New("not bech32")
+	}
+	if hrp == "note" {
+		if len(data) != 32 {
+			return filter, false, errors.New("a note is 32 bytes")
+		}
+		return nostr.Filter{IDs: []string{hex.EncodeToString(data)}}, true, nil
+	}
+
+	// TLV: 0 id or identifier, 1 relay, 2 author, 3 kind (big-endian uint32)
+	var special, author string
+	kind := -1
+	for len(data) >= 2 {
+		typ, size := data[0], int(data[1])
+		if len(data) < 2+size {
+			return filter, false, errors.New("truncated TLV")
+		}
+		value := data[2 : 2+size]
+		switch {
+		case typ == 0:
+			special = string(value)
+			if hrp == "nevent" {
+				special = hex.EncodeToString(value)
+			}
+		case typ == 2 && size == 32:
+			author = hex.EncodeToString(value)
+		case typ == 3 && size == 4:
+			kind = int(binary.BigEndian.Uint32(value))
+		}
+		data = data[2+size:]
+	}
+	switch hrp {
+	case "nevent":
+		if !nostr.IsValid32ByteHex(special) {
+			return filter, false, errors.New("nevent without an id")
+		}
+		filter = nostr.Filter{IDs: []string{special}}
+		if kind >= 0 {
+			filter.Kinds = []int{kind}
+		}
+		if author != "" {
+			filter.Authors = []string{author}
+		}
+		return filter, true, nil
+	case "naddr":
+		if kind < 0 || author == "" {
+			return filter, false, errors.New("incomplete naddr")
+		}
+		return nostr.Filter{
+			Kinds:   []int{kind},
+			Authors: []string{author},
+			Tags:    nostr.TagMap{"d": {special}},
+			Limit:   1,
+		}, false, nil
+	}
+	return filter, false, errors.New("not a note, nevent or naddr")
+}
+
+// lookupEvent returns the event filter finds for ctx's viewer, or the
+// policy's rejection.
+func lookupEvent(ctx context.Context, filter nostr.Filter) (*nostr.Event, string) {
+	candidates := []nostr.Filter{filter}
+	if len(filter.Kinds) == 0 {
+		recipe := filter
+		recipe.Kinds = []int{KindRecipe}
+		candidates = append([]nostr.Filter{recipe}, candidates...)
+	}
+	for i, f := range candidates {
+		if reject, msg := rejectFilterPolicy(ctx, f); reject {
+			if i < len(candidates)-1 {
+				continue
+			}
+			return nil, msg
+		}
+		ch, err := queryEvents(ctx, f)
+		if err != nil {
+			return nil, ""
+		}
+		var found *nostr.Event
+		for event := range ch {
+			if found == nil {
+				found = event
+			}
+		}
+		if found != nil {
+			return found, ""
+		}
+	}
+	return nil, ""
+}
+
+func registerLookupAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/e/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		filter, byID, err := lookupFilter(strings.TrimPrefix(r.URL.Path, "/e/"))
+		if err != nil {
+			httpError(w, r, "", http.StatusBadRequest, msgIdentifierInvalid)
+			return
+		}
+		ctx, viewer := r.Context(), ""
+		if r.Header.Get("Authorization") != "" {
+			if viewer, err = nip98Pubkey(r); err != nil {
+				httpError(w, r, "", http.StatusUnauthorized, msgAuthFailed, err)
+				return
+			}
+			ctx = context.WithValue(ctx, nip98ViewerKey{}, viewer)
+		}
+
+		event, rejection := lookupEvent(ctx, filter)
+		w.Header().Set("Vary", "Authorization")
+		switch {
+		case rejection != "" && viewer == "":
+			http.Error(w, rejection, http.StatusUnauthorized)
+			return
+		case rejection != "":
+			http.Error(w, rejection, http.StatusForbidden)
+			return
+		case event == nil:
+			httpError(w, r, viewer, http.StatusNotFound, msgEventNotFound)
+			return
+		}
+
+		switch {
+		case viewer != "":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case byID:
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+		default:
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		}
+		etag := `"` + event.ID + `"`
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		raw, _ := json.Marshal(event)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(raw)
+	})
+}
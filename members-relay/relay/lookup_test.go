@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// encodeBech32 is decodeBech32's inverse, for building identifiers.
+func encodeBech32(hrp string, data []byte) string {
+	var values []byte
+	acc, bits := 0, 0
+	for _, b := range data {
+		acc = acc<<8 | int(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			values = append(values, byte(acc>>bits&31))
+		}
+	}
+	if bits > 0 {
+		values = append(values, byte(acc<<(5-bits)&31))
+	}
+	var expanded []byte
+	for _, c := range hrp {
+		expanded = append(expanded, byte(c>>5))
+	}
+	expanded = append(expanded, 0)
+	for _, c := range hrp {
+		expanded = append(expanded, byte(c&31))
+	}
+	polymod := uint32(1)
+	for _, v := range append(append(expanded, values...), 0, 0, 0, 0, 0, 0) {
+		top := polymod >> 25
+		polymod = (polymod&0x1ffffff)<<5 ^ uint32(v)
+		for i, g := range []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3} {
+			if top>>i&1 == 1 {
+				polymod ^= g
+			}
+		}
+	}
+	polymod ^= 1
+	for i := 0; i < 6; i++ {
+		values = append(values, byte(polymod>>(5*(5-i))&31))
+	}
+	out := hrp + "1"
+	for _, v := range values {
+		out += string(bech32Charset[v])
+	}
+	return out
+}
+
+func encodeNote(id string) string {
+	raw, _ := hex.DecodeString(id)
+	return encodeBech32("note", raw)
+}
+
+// encodeTLV builds an nevent or naddr; special is the id for nevent and the
+// d tag for naddr.
+func encodeTLV(hrp, special, author string, kind int) string {
+	value := []byte(special)
+	if hrp == "nevent" {
+		value, _ = hex.DecodeString(special)
+	}
+	data := append([]byte{0, byte(len(value))}, value...)
+	pk, _ := hex.DecodeString(author)
+	data = append(append(data, 2, 32), pk...)
+	data = append(data, 3, 4)
+	data = binary.BigEndian.AppendUint32(data, uint32(kind))
+	return encodeBech32(hrp, data)
+}
+
+func TestLookupFilter(t *testing.T) {
+	author := strings.Repeat("a", 64)
+	filter, byID, err := lookupFilter("naddr1qq88xmm4wfjx7at8dqkkcmmpvcq3yamnwvaz7tm6v9czucm0da4kjmn89upzp242424242424242424242424242424242424242424242424242qvzqqqr4guck6n08")
+	if err != nil || byID || filter.Kinds[0] != KindRecipe || filter.Authors[0] != author || filter.Tags["d"][0] != "sourdough-loaf" {
+		t.Fatalf("naddr: %+v %v %v", filter, byID, err)
+	}
+
+	id := strings.Repeat("b", 64)
+	if filter, byID, err := lookupFilter(encodeNote(id)); err != nil || !byID || filter.IDs[0] != id || len(filter.Kinds) != 0 {
+		t.Fatalf("note: %+v %v %v", filter, byID, err)
+	}
+	filter, byID, err = lookupFilter(encodeTLV("nevent", id, author, KindGroupChat))
+	if err != nil || !byID || filter.IDs[0] != id || filter.Kinds[0] != KindGroupChat || filter.Authors[0] != author {
+		t.Fatalf("nevent: %+v %v %v", filter, byID, err)
+	}
+
+	for _, bad := range []string{
+		"naddr1qq88xmm4wfjx7at8dqkkcmmpvcq3yamnwvaz7tm6v9czucm0da4kjmn89upzp242424242424242424242424242424242424242424242424242qvzqqqr4guck6n09",
+		encodeBech32("npub", make([]byte, 32)),
+		encodeBech32("note", make([]byte, 31)),
+		"30023:" + author + ":sourdough-loaf",
+		"",
+	} {
+		if filter, _, err := lookupFilter(bad); err == nil {
+			t.Errorf("%q decoded to %+v", bad, filter)
+		}
+	}
+}
+
+func TestLookupAPI(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	authorSK, memberSK, outsiderSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	author, _ := nostr.GetPublicKey(authorSK)
+	member, _ := nostr.GetPublicKey(memberSK)
+	addTestMember(t, author)
+	addTestMember(t, member)
+	if _, err := db.ExecContext(ctx, "INSERT INTO groups (id, name) VALUES ('bakers', 'Bakers')"); err != nil {
+		t.Fatal(err)
+	}
+	for _, pk := range []string{author, member} {
+		if _, err := db.ExecContext(ctx, "INSERT INTO group_members (group_id, pubkey, role) VALUES ('bakers', $1, 'member')", pk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recipe := signedEvent(t, authorSK, KindRecipe, nostr.Now(), nostr.Tags{{"d", "focaccia"}}, "# Focaccia")
+	chat := signedEvent(t, authorSK, KindGroupChat, nostr.Now(), nostr.Tags{{"h", "bakers"}}, "proofing now")
+	for _, evt := range []*nostr.Event{recipe, chat} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	registerLookupAPI(mux)
+	get := func(code, sk string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/e/"+code, nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "members.zap.cooking")
+		if sk != "" {
+			r.Header.Set("Authorization", nip98Header(t, sk, "https://members.zap.cooking/e/"+code, "GET", nostr.Now()))
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	servedEvent := func(w *httptest.ResponseRecorder) string {
+		var evt nostr.Event
+		json.Unmarshal(w.Body.Bytes(), &evt)
+		return evt.ID
+	}
+
+	naddr := encodeTLV("naddr", "focaccia", author, KindRecipe)
+	if w := get(naddr, ""); w.Code != http.StatusOK || servedEvent(w) != recipe.ID ||
+		!strings.HasPrefix(w.Header().Get("Cache-Control"), "public") {
+		t.Fatalf("recipe by naddr: %d %s %v", w.Code, w.Body, w.Header())
+	}
+	if w := get(encodeNote(recipe.ID), ""); w.Code != http.StatusOK || servedEvent(w) != recipe.ID {
+		t.Fatalf("recipe by note: %d %s", w.Code, w.Body)
+	}
+
+	chatNote := encodeNote(chat.ID)
+	if w := get(chatNote, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("group chat without auth: %d %s", w.Code, w.Body)
+	}
+	if w := get(chatNote, outsiderSK); w.Code != http.StatusForbidden {
+		t.Fatalf("group chat for a non-member: %d %s", w.Code, w.Body)
+	}
+	if w := get(chatNote, memberSK); w.Code != http.StatusOK || servedEvent(w) != chat.ID ||
+		!strings.HasPrefix(w.Header().Get("Cache-Control"), "private") {
+		t.Fatalf("group chat for a group member: %d %s %v", w.Code, w.Body, w.Header())
+	}
+
+	if w := get(encodeNote(strings.Repeat("c", 64)), memberSK); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown note: %d", w.Code)
+	}
+	if w := get(encodeTLV("naddr", "missing", author, KindRecipe), ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown naddr: %d", w.Code)
+	}
+	if w := get("nevent1garbage", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("undecodable: %d", w.Code)
+	}
+}
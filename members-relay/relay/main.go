@@ -4,16 +4,21 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fiatjaf/khatru"
 	"github.com/nbd-wtf/go-nostr"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 var (
@@ -25,6 +30,8 @@ var (
 	relayName          string
 	relayDesc          string
 	relayContact       string
+	autoCreateIndexes  bool
+	requireIndexes     bool
 )
 
 const (
@@ -36,8 +43,12 @@ const (
 	// Recipes
 	KindRecipe = 30023
 
+	// NIP-38 user statuses
+	KindUserStatus = 30315
+
 	// NIP-78 application data — Nourish analyses are public-readable when
-	// authored by the service key; other members' 30078 app-data stays gated.
+	// authored by the service key; all other 30078 app data is private to its
+	// author (see APP DATA).
 	KindAppData = 30078
 
 	// Zap Cooking Nourish service pubkey (frontend NOURISH_SERVICE_PUBKEY).
@@ -45,13 +56,16 @@ const (
 	NourishServicePubkey = "fdd263f69f9e95a2a0a58ec3e7e8053011214fa66007d93b26d2f4717d31917b"
 
 	// NIP-29 moderation events
-	KindPutUser      = 9000
-	KindRemoveUser   = 9001
-	KindEditMetadata = 9002
-	KindDeleteEvent  = 9005
-	KindCreateGroup  = 9007
-	KindDeleteGroup  = 9008
-	KindCreateInvite = 9009
+	KindPutUser        = 9000
+	KindRemoveUser     = 9001
+	KindEditMetadata   = 9002
+	KindPinEvents      = 9003
+	KindMuteUser       = 9004
+	KindDeleteEvent    = 9005
+	KindPutGroupStatus = 9006
+	KindCreateGroup    = 9007
+	KindDeleteGroup    = 9008
+	KindCreateInvite   = 9009
 
 	// NIP-29 user requests
 	KindJoinRequest  = 9021
@@ -61,32 +75,38 @@ const (
 	KindGroupMetadata = 39000
 	KindGroupAdmins   = 39001
 	KindGroupMembers  = 39002
+	KindGroupRoles    = 39003
+	KindGroupPins     = 39004
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		runSubcommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	loadConfig()
 	initDB()
 	defer db.Close()
-
-	relay = khatru.NewRelay()
-
-	relay.Info.Name = relayName
-	relay.Info.Description = relayDesc
-	if relaySigningPubkey != "" {
-		relay.Info.PubKey = relaySigningPubkey
-	} else {
-		relay.Info.PubKey = adminPubkey
+	if err := migrateSchema(context.Background()); err != nil {
+		log.Fatal("Failed to migrate schema:", err)
+	}
+	verifyIndexes(context.Background())
+	if err := backfillEventTags(context.Background()); err != nil {
+		log.Fatal("Failed to backfill event tags:", err)
+	}
+	if err := backfillFollows(context.Background()); err != nil {
+		log.Fatal("Failed to backfill follows:", err)
+	}
+	if _, _, err := provisionDefaultGroups(context.Background()); err != nil {
+		log.Fatal("Failed to create default groups:", err)
 	}
-	relay.Info.Contact = relayContact
-	relay.Info.SupportedNIPs = []int{1, 11, 29, 42}
-	relay.Info.Software = "khatru-members"
-	relay.Info.Version = "1.0.0"
 
-	relay.QueryEvents = append(relay.QueryEvents, queryEvents)
-	relay.StoreEvent = append(relay.StoreEvent, storeEvent)
-	relay.DeleteEvent = append(relay.DeleteEvent, deleteEvent)
-	relay.RejectEvent = append(relay.RejectEvent, rejectEventPolicy)
-	relay.RejectFilter = append(relay.RejectFilter, rejectFilterPolicy)
+	relay = newMembersRelay(nil)
+	startCommunityRelays()
+	if err := loadRelayInfo(context.Background()); err != nil {
+		log.Fatal("Failed to load relay info:", err)
+	}
 
 	port := os.Getenv("RELAY_PORT")
 	if port == "" {
@@ -94,22 +114,142 @@ func main() {
 	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", relay.ServeHTTP)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if mirror != nil && mirrorCfg.isMirrorHost(r.Host) {
+			mirror.ServeHTTP(w, r)
+			return
+		}
+		if isRelayInfoRequest(r) {
+			handleRelayInfo(w, r)
+			return
+		}
+		if isManagementRequest(r) {
+			handleManagementRPC(w, r)
+			return
+		}
+		relayFor(r.Context()).ServeHTTP(w, r)
+	})
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
+	mux.Handle("/debug/vars", expvar.Handler())
+	// Every /admin/ route requires a NIP-98 header from the relay admin.
+	admin := http.NewServeMux()
+	mux.Handle("/admin/", requireNIP98Admin(admin))
+	registerFollowAPI(mux)
+	registerCalendarAPI(mux)
+	registerBadgeAPI(admin)
+	registerFileAPI(mux)
+	registerLabelAPI(mux)
+	registerRetentionAPI(admin)
+	registerReconcileAPI(admin)
+	registerCapacityAPI(admin)
+	registerReadMarkerAPI(mux)
+	registerReactionAPI(mux)
+	registerJoinAPI(mux)
+	registerMuteAPI(mux)
+	registerFeaturedAPI(mux, admin)
+	registerLookupAPI(mux)
 
 	log.Printf("Starting members.zap.cooking relay on port %s", port)
 	log.Printf("Admin pubkey: %s", adminPubkey)
-	if relayPrivateKey != "" {
+	for _, c := range communities {
+		log.Printf("Community %s: hosts %v, path %q, admin %s", c.ID, c.Hosts, c.PathPrefix, c.AdminPubkey)
+	}
+	if relayBunker != nil {
+		log.Printf("NIP-29 group management: enabled (signing pubkey: %s, via NIP-46 signer %s)", relaySigningPubkey, relayBunker.target)
+	} else if relayPrivateKey != "" {
 		log.Printf("NIP-29 group management: enabled (signing pubkey: %s)", relaySigningPubkey)
 	} else {
-		log.Println("NIP-29 group management: disabled (RELAY_PRIVATE_KEY not set)")
+		log.Println("NIP-29 group management: disabled (neither RELAY_PRIVATE_KEY nor RELAY_BUNKER_URL set)")
+	}
+
+	go connections.runIdleReaper(context.Background(), serverCfg)
+	go connections.runRevocationSweep(context.Background(), authCfg.SweepInterval)
+	go profiles.run(context.Background())
+	go runLiveChatPurger(context.Background())
+	go runChatRetentionPurger(context.Background())
+	go runExpiredEventPurger(context.Background())
+	go runBadgeAwarder(context.Background())
+	go runFileMetadataGC(context.Background())
+	go runHandlerPublisher(context.Background())
+	go runFeaturedCurator(context.Background())
+	go runGroupSync(context.Background())
+	go runGroupReconciler(context.Background())
+	go runLapsedMemberSweep(context.Background())
+	go runMonitoring(context.Background())
+	startMirror(context.Background())
+
+	server := newHTTPServer(":"+port, routeCommunity(mux), serverCfg)
+	if err := listenAndServe(server); err != nil {
+		log.Fatal("Failed to start server:", err)
 	}
+}
 
-	if err := http.ListenAndServe(":"+port, mux); err != nil {
-		log.Fatal("Failed to start server:", err)
+// newMembersRelay builds the relay of community c (nil for the default
+// community). Every community's relay shares the hooks; they tell the
+// communities apart with communityOf.
+func newMembersRelay(c *community) *khatru.Relay {
+	rl := khatru.NewRelay()
+
+	rl.Info.Name = relayName
+	rl.Info.Description = relayDesc
+	if relaySigningPubkey != "" {
+		rl.Info.PubKey = relaySigningPubkey
+	} else {
+		rl.Info.PubKey = adminPubkey
+	}
+	rl.Info.Contact = relayContact
+	rl.Info.SupportedNIPs = []int{1, 9, 11, 17, 22, 25, 29, 32, 36, 40, 42, 45, 50, 51, 52, 53, 56, 57, 58, 59, 65, 70, 86, 89, 94, 119}
+	rl.Info.Software = "khatru-members"
+	rl.Info.Version = "1.0.0"
+	if c == nil {
+		rl.ServiceURL = authCfg.URL
+		applyLimits(rl, limits)
+	} else {
+		rl.Info.Name = c.Name
+		rl.Info.Description = c.Description
+		rl.Info.PubKey = c.Pubkey
+		if c.Contact != "" {
+			rl.Info.Contact = c.Contact
+		}
+		rl.ServiceURL = c.URL
+		rl.MaxMessageSize = int64(limits.MaxMessageLength)
+		buildRelayInfo(rl.Info, limits)
+	}
+
+	countConnect, countFilter, countEvent := countTraffic("members")
+	rl.QueryEvents = append(rl.QueryEvents, dedupQuery(queryEvents))
+	rl.StoreEvent = append(rl.StoreEvent, storeEvent)
+	rl.DeleteEvent = append(rl.DeleteEvent, requireDeletionAuth, deleteEvent)
+	rl.OverwriteDeletionOutcome = append(rl.OverwriteDeletionOutcome, authorizeDeletion)
+	rl.RejectEvent = append(rl.RejectEvent, countEvent, connections.touchEvent, rejectEventLimits, rejectDeleted, rejectEventPolicy)
+	rl.RejectFilter = append(rl.RejectFilter, countFilter, connections.touchFilter, connections.limitREQRate, rejectFilterPolicy, connections.limitFilter)
+	rl.CountEvents = append(rl.CountEvents, countEvents)
+	rl.RejectCountFilter = append(rl.RejectCountFilter, connections.touchFilter, rejectFilterPolicy)
+	rl.OverwriteFilter = append(rl.OverwriteFilter, trackREQ, connections.meterREQ, connections.applyAndTags, rejectLiveFilter(rejectFilterPolicy), connections.limitLiveFilter)
+	rl.PreventBroadcast = append(rl.PreventBroadcast, hideRestricted)
+	rl.OnEphemeralEvent = append(rl.OnEphemeralEvent, connections.deliverAndTagged)
+	rl.OnConnect = append(rl.OnConnect, countConnect, connections.onConnect)
+	rl.OnDisconnect = append(rl.OnDisconnect, connections.onDisconnect)
+	applyWebsocketConfig(rl, serverCfg)
+	return rl
+}
+
+// runSubcommand handles the non-server entry points of the binary.
+func runSubcommand(name string, args []string) {
+	switch name {
+	case "schema":
+		fmt.Print(schemaSQL())
+	case "import":
+		runImport(args)
+	case "loadtest":
+		runLoadtest(args)
+	case "reconcile-groups":
+		runReconcileGroups(args)
+	default:
+		log.Fatalf("Unknown subcommand %q (available: schema, import, loadtest, reconcile-groups)", name)
 	}
 }
 
@@ -126,6 +266,18 @@ func loadConfig() {
 		}
 		relaySigningPubkey = pk
 	}
+	loadBunkerConfig()
+	if bunkerCfg.URL != "" {
+		if relayPrivateKey != "" {
+			log.Fatal("Set RELAY_PRIVATE_KEY or RELAY_BUNKER_URL, not both")
+		}
+		if err := startBunker(context.Background()); err != nil {
+			log.Fatalf("NIP-46 signer at RELAY_BUNKER_URL did not respond: %v", err)
+		}
+	}
+	if relaySigningPubkey == adminPubkey {
+		log.Fatal("RELAY_PUBKEY must not be the relay's signing key: events signed with it are refused")
+	}
 	relayName = os.Getenv("RELAY_NAME")
 	if relayName == "" {
 		relayName = "Zap.Cooking Members"
@@ -138,6 +290,78 @@ func loadConfig() {
 	if relayContact == "" {
 		relayContact = "support@zap.cooking"
 	}
+	autoCreateIndexes = envBool("RELAY_CREATE_INDEXES", false)
+	requireIndexes = envBool("RELAY_REQUIRE_INDEXES", false)
+	loadServerConfig()
+	loadAuthConfig()
+	loadGroupSyncConfig()
+	loadGroupReconcileConfig()
+	loadDefaultGroupsConfig()
+	loadLapsedMembersConfig()
+	loadLimits()
+	loadProfileConfig()
+	loadLiveConfig()
+	loadBadgeConfig()
+	loadFileConfig()
+	loadHandlerConfig()
+	loadMirrorConfig()
+	loadCommunityConfig()
+	loadLabelConfig()
+	loadReadMarkerConfig()
+	loadReplyConfig()
+	loadPinConfig()
+	loadAnnouncementConfig()
+	loadFeaturedConfig()
+	loadQueryConfig()
+	loadReportConfig()
+	loadMonitoringConfig()
+	appDataForAnyAuthed = envBool("RELAY_APP_DATA_ANY_AUTHED", false)
+	groupGuestsAllowed = envBool("RELAY_GROUP_GUESTS", false)
+}
+
+// envOr is os.Getenv with a default that applies only when name is unset,
+// so an explicitly empty value can switch a feature off.
+func envOr(name, fallback string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return fallback
+}
+
+func envBool(name string, fallback bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return b
+}
+
+func envInt(name string, fallback int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return n
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return d
 }
 
 func initDB() {
@@ -160,19 +384,23 @@ func initDB() {
 // MEMBERSHIP & GROUP HELPERS
 // ═══════════════════════════════════════════════════════════════════════════════
 
+// The helpers below answer for the community ctx works for (see
+// COMMUNITIES): a member, group or admin of another community is none here.
+
 func isActiveMember(ctx context.Context, pubkey string) bool {
-	if pubkey == adminPubkey {
+	c := communityOf(ctx)
+	if pubkey == c.admin() {
 		return true
 	}
 	var exists bool
 	err := db.QueryRowContext(ctx, `
 		SELECT EXISTS (
 			SELECT 1 FROM members
-			WHERE pubkey = $1
+			WHERE pubkey = $1 AND community = $2
 			AND status IN ('active', 'grace')
 			AND subscription_end > NOW()
 		)
-	`, pubkey).Scan(&exists)
+	`, pubkey, c.id()).Scan(&exists)
 	if err != nil {
 		log.Printf("Error checking membership for %s: %v", pubkey, err)
 		return false
@@ -184,7 +412,8 @@ func getAuthenticatedPubkey(ctx context.Context) string {
 	if pubkey := khatru.GetAuthed(ctx); pubkey != "" {
 		return pubkey
 	}
-	return ""
+	pubkey, _ := ctx.Value(nip98ViewerKey{}).(string)
+	return pubkey
 }
 
 func getHTag(event *nostr.Event) string {
@@ -197,16 +426,17 @@ func getHTag(event *nostr.Event) string {
 }
 
 func isGroupAdmin(ctx context.Context, groupId string, pubkey string) bool {
-	if pubkey == adminPubkey {
+	c := communityOf(ctx)
+	if pubkey == c.admin() {
 		return true
 	}
 	var exists bool
 	err := db.QueryRowContext(ctx, `
 		SELECT EXISTS (
-			SELECT 1 FROM group_members
-			WHERE group_id = $1 AND pubkey = $2 AND role = 'admin'
+			SELECT 1 FROM group_members gm JOIN groups g ON g.id = gm.group_id
+			WHERE gm.group_id = $1 AND gm.pubkey = $2 AND gm.role = 'admin' AND g.community = $3
 		)
-	`, groupId, pubkey).Scan(&exists)
+	`, groupId, pubkey, c.id()).Scan(&exists)
 	if err != nil {
 		log.Printf("Error checking group admin for %s in %s: %v", pubkey, groupId, err)
 		return false
@@ -214,17 +444,37 @@ func isGroupAdmin(ctx context.Context, groupId string, pubkey string) bool {
 	return exists
 }
 
+func isGroupModerator(ctx context.Context, groupId string, pubkey string) bool {
+	c := communityOf(ctx)
+	if pubkey == c.admin() {
+		return true
+	}
+	var exists bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM group_members gm JOIN groups g ON g.id = gm.group_id
+			WHERE gm.group_id = $1 AND gm.pubkey = $2 AND gm.role IN ('admin', 'moderator') AND g.community = $3
+		)
+	`, groupId, pubkey, c.id()).Scan(&exists)
+	if err != nil {
+		log.Printf("Error checking group moderator for %s in %s: %v", pubkey, groupId, err)
+		return false
+	}
+	return exists
+}
+
 func isGroupMember(ctx context.Context, groupId string, pubkey string) bool {
-	if pubkey == adminPubkey {
+	c := communityOf(ctx)
+	if pubkey == c.admin() {
 		return true
 	}
 	var exists bool
 	err := db.QueryRowContext(ctx, `
 		SELECT EXISTS (
-			SELECT 1 FROM group_members
-			WHERE group_id = $1 AND pubkey = $2
+			SELECT 1 FROM group_members gm JOIN groups g ON g.id = gm.group_id
+			WHERE gm.group_id = $1 AND gm.pubkey = $2 AND g.community = $3
 		)
-	`, groupId, pubkey).Scan(&exists)
+	`, groupId, pubkey, c.id()).Scan(&exists)
 	if err != nil {
 		log.Printf("Error checking group membership for %s in %s: %v", pubkey, groupId, err)
 		return false
@@ -234,13 +484,22 @@ func isGroupMember(ctx context.Context, groupId string, pubkey string) bool {
 
 func groupExists(ctx context.Context, groupId string) bool {
 	var exists bool
-	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM groups WHERE id = $1)`, groupId).Scan(&exists)
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM groups WHERE id = $1 AND community = $2)`,
+		groupId, communityOf(ctx).id()).Scan(&exists)
 	if err != nil {
 		return false
 	}
 	return exists
 }
 
+// groupIdTaken reports whether any community has a group with this id.
+// Group ids are global, so a new group must not reuse one.
+func groupIdTaken(ctx context.Context, groupId string) bool {
+	var exists bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM groups WHERE id = $1)`, groupId).Scan(&exists)
+	return err != nil || exists
+}
+
 // ═══════════════════════════════════════════════════════════════════════════════
 // EVENT POLICIES
 // ═══════════════════════════════════════════════════════════════════════════════
@@ -248,63 +507,175 @@ func groupExists(ctx context.Context, groupId string) bool {
 func rejectEventPolicy(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
 	pubkey := getAuthenticatedPubkey(ctx)
 
-	// Recipes are public (no auth required)
-	if event.Kind == KindRecipe {
-		return false, ""
+	if limits.AuthRequired && pubkey == "" {
+		return true, say(ctx, msgAuthRequired)
+	}
+
+	// The relay's own events are generated internally (signRelayEvent,
+	// persistEvent) and never come in over the websocket. One that does was
+	// signed with a leaked key, and its side effects would go unchecked.
+	if relaySigningPubkey != "" && event.PubKey == relaySigningPubkey {
+		return true, say(ctx, msgRelayInternalPubkey)
+	}
+
+	// Protected events (NIP-70) are only taken from their author. Over the
+	// websocket khatru refuses a stranger's copy before the policy runs,
+	// with its own "blocked: must be published by event author". Bulk
+	// ingestion skips both, so backups holding protected events can still
+	// be restored.
+	if event.Tags.GetFirst([]string{"-"}) != nil && pubkey != event.PubKey {
+		return true, say(ctx, msgEventProtected)
+	}
+
+	if reject, msg := rejectExpired(ctx, event); reject {
+		return true, msg
+	}
+
+	// Bans set by the relay admin over NIP-86 (see RELAY MANAGEMENT)
+	if reject, msg := rejectBanned(ctx, event, pubkey); reject {
+		return true, msg
+	}
+
+	// Recipes are public (no auth required), though non-members may have
+	// to show proof of work. Group recipes are checked below.
+	if event.Kind == KindRecipe && getHTag(event) == "" {
+		return rejectRecipePow(ctx, event, pubkey)
+	}
+
+	// So are reactions and comments on stored recipes (see RECIPE
+	// ENGAGEMENT)
+	if isRecipeEngagement(ctx, event) {
+		return rejectRecipePow(ctx, event, pubkey)
+	}
+
+	// Zap receipts for stored recipes come from the author's lightning
+	// provider (see RECIPE ZAPS)
+	if event.Kind == nostr.KindZap {
+		if recipe := zappedRecipe(ctx, db, event); recipe != "" {
+			return rejectZapReceipt(ctx, event, recipe)
+		}
 	}
 
 	// Everything else requires NIP-42 auth
 	if pubkey == "" {
-		return true, "auth-required: please authenticate with NIP-42"
+		return true, say(ctx, msgAuthNIP42)
+	}
+
+	// Gift wraps are signed by a throwaway key (see GIFT WRAPS)
+	if event.Kind == nostr.KindGiftWrap {
+		return rejectGiftWrap(ctx, event, pubkey)
 	}
 
 	// Event pubkey must match authenticated pubkey
 	if event.PubKey != pubkey {
-		return true, "invalid: event pubkey doesn't match authenticated user"
+		return true, say(ctx, msgPubkeyMismatch)
+	}
+
+	// Nothing for a group one is banned from (see GROUP BANS)
+	if reject, msg := rejectGroupBanned(ctx, event, pubkey); reject {
+		return true, msg
 	}
 
 	// --- NIP-29 Management Events ---
 
 	// Create group (kind 9007): relay admin only
 	if event.Kind == KindCreateGroup {
-		if relayPrivateKey == "" {
-			return true, "error: NIP-29 group management not enabled on this relay"
+		if !canSignRelayEvents() {
+			return true, say(ctx, msgGroupsDisabled)
 		}
-		if pubkey != adminPubkey {
-			return true, "restricted: only relay admin can create groups"
+		if pubkey != communityAdmin(ctx) {
+			return true, say(ctx, msgAdminCreatesGroups)
 		}
 		groupId := getHTag(event)
 		if groupId == "" {
-			return true, "invalid: missing h tag for group creation"
+			return true, say(ctx, msgCreateGroupHTag)
+		}
+		if !validGroupID(groupId) {
+			return true, say(ctx, msgGroupIDInvalid)
 		}
-		if groupExists(ctx, groupId) {
-			return true, "duplicate: group already exists"
+		if groupIdTaken(ctx, groupId) {
+			return true, say(ctx, msgGroupExists)
 		}
 		return false, ""
 	}
 
 	// Delete group (kind 9008): relay admin only
 	if event.Kind == KindDeleteGroup {
-		if pubkey != adminPubkey {
-			return true, "restricted: only relay admin can delete groups"
+		if pubkey != communityAdmin(ctx) {
+			return true, say(ctx, msgAdminDeletesGroups)
+		}
+		if !groupExists(ctx, getHTag(event)) {
+			return true, say(ctx, msgGroupNotFound)
 		}
 		return false, ""
 	}
 
-	// Other moderation events (9000-9006, 9009): group admin required
+	// Delete event (kind 9005): group moderator, events of this group only.
+	// Moderation kinds need their capability (see GROUP ROLES).
+	if event.Kind == KindDeleteEvent {
+		if !isActiveMember(ctx, pubkey) {
+			return true, say(ctx, msgMembershipRequired)
+		}
+		groupId := getHTag(event)
+		if groupId == "" {
+			return true, say(ctx, msgManagementHTag)
+		}
+		if !groupExists(ctx, groupId) {
+			return true, say(ctx, msgGroupNotFound)
+		}
+		if !hasGroupCapability(ctx, groupId, pubkey, capDeleteEvent) {
+			return true, say(ctx, msgModeratorRequired)
+		}
+		return rejectGroupEventDeletion(ctx, event, groupId)
+	}
+
+	// Mute user (kind 9004): group moderator (see GROUP MUTES)
+	if event.Kind == KindMuteUser {
+		if !isActiveMember(ctx, pubkey) {
+			return true, say(ctx, msgMembershipRequired)
+		}
+		groupId := getHTag(event)
+		if groupId == "" {
+			return true, say(ctx, msgManagementHTag)
+		}
+		if !groupExists(ctx, groupId) {
+			return true, say(ctx, msgGroupNotFound)
+		}
+		if !hasGroupCapability(ctx, groupId, pubkey, capMuteUser) {
+			return true, say(ctx, msgModeratorRequired)
+		}
+		return rejectMute(ctx, event)
+	}
+
+	// Other moderation events (9000-9003, 9006, 9009): group admin required
 	if event.Kind >= 9000 && event.Kind <= 9009 {
 		if !isActiveMember(ctx, pubkey) {
-			return true, "restricted: membership required"
+			return true, say(ctx, msgMembershipRequired)
 		}
 		groupId := getHTag(event)
 		if groupId == "" {
-			return true, "invalid: missing h tag for group management event"
+			return true, say(ctx, msgManagementHTag)
 		}
 		if !groupExists(ctx, groupId) {
-			return true, "invalid: group does not exist"
+			return true, say(ctx, msgGroupNotFound)
+		}
+		if !hasGroupCapability(ctx, groupId, pubkey, kindCapabilities[event.Kind]) {
+			return true, say(ctx, msgGroupAdminRequired)
+		}
+		if event.Kind == KindEditMetadata {
+			if reject, msg := rejectMaxMembers(ctx, event); reject {
+				return reject, msg
+			}
+			return rejectMessageTTL(ctx, event)
+		}
+		if event.Kind == KindCreateInvite {
+			return rejectInvite(ctx, event, groupId)
+		}
+		if event.Kind == KindPinEvents {
+			return rejectPin(ctx, event, groupId)
 		}
-		if !isGroupAdmin(ctx, groupId, pubkey) {
-			return true, "restricted: group admin access required"
+		if event.Kind == KindPutUser || event.Kind == KindRemoveUser {
+			return rejectLastAdmin(ctx, event)
 		}
 		return false, ""
 	}
@@ -312,54 +683,178 @@ func rejectEventPolicy(ctx context.Context, event *nostr.Event) (reject bool, ms
 	// Join request (kind 9021): relay member, not already in group
 	if event.Kind == KindJoinRequest {
 		if !isActiveMember(ctx, pubkey) {
-			return true, "restricted: relay membership required to join groups"
+			return true, say(ctx, msgMembershipToJoin)
 		}
 		groupId := getHTag(event)
 		if groupId == "" {
-			return true, "invalid: missing h tag"
+			return true, say(ctx, msgMissingHTag)
 		}
 		if !groupExists(ctx, groupId) {
-			return true, "invalid: group does not exist"
+			return true, say(ctx, msgGroupNotFound)
 		}
 		if isGroupMember(ctx, groupId, pubkey) {
-			return true, "duplicate: already a member of this group"
+			return true, say(ctx, msgAlreadyGroupMember)
 		}
-		return false, ""
+		if reject, msg := rejectDuplicateJoin(ctx, event, groupId); reject {
+			return true, msg
+		}
+		return rejectInviteCode(ctx, event, groupId)
 	}
 
 	// Leave request (kind 9022): must be group member
 	if event.Kind == KindLeaveRequest {
 		groupId := getHTag(event)
 		if groupId == "" {
-			return true, "invalid: missing h tag"
+			return true, say(ctx, msgMissingHTag)
 		}
 		if !isGroupMember(ctx, groupId, pubkey) {
-			return true, "invalid: not a member of this group"
+			return true, say(ctx, msgLeaveNotMember)
 		}
-		return false, ""
+		return rejectLastAdmin(ctx, event)
+	}
+
+	// Badge definitions and awards are issued by the relay (see BADGES)
+	if event.Kind == KindBadgeDefinition || event.Kind == KindBadgeAward {
+		return true, say(ctx, msgBadgesRelayIssued)
+	}
+
+	// zap.cooking's NIP-89 handler events are maintained by the relay
+	if (event.Kind == KindHandlerInformation || event.Kind == KindHandlerRecommendation) && pubkey != communityAdmin(ctx) {
+		return true, say(ctx, msgHandlerManaged)
 	}
 
 	// Group metadata events (39000-39009): reject external submissions
 	if event.Kind >= 39000 && event.Kind <= 39009 {
-		return true, "invalid: group metadata events are relay-managed"
+		return true, say(ctx, msgGroupMetadataManaged)
+	}
+
+	// User status (kind 30315): member, optionally scoped to one of their groups
+	if event.Kind == KindUserStatus {
+		return rejectUserStatus(ctx, event, pubkey)
+	}
+
+	// Recipes shared in a group (kind 30023 with an h tag): members of
+	// the group only (see GROUP-SCOPED EVENTS)
+	if event.Kind == KindRecipe {
+		if !isActiveMember(ctx, pubkey) {
+			return true, say(ctx, msgMembershipForGroups)
+		}
+		return rejectGroupScope(ctx, event, pubkey)
+	}
+
+	// Calendar events and RSVPs (kinds 31922, 31923, 31925)
+	if event.Kind == KindCalendarDate || event.Kind == KindCalendarTime || event.Kind == KindCalendarRSVP {
+		return rejectCalendarEvent(ctx, event, pubkey)
+	}
+
+	// App data (kind 30078)
+	if event.Kind == KindAppData {
+		return rejectAppData(ctx, event, pubkey)
+	}
+
+	// Read markers (kind 30079)
+	if event.Kind == KindReadMarker {
+		return rejectReadMarker(ctx, event, pubkey)
+	}
+
+	// Lists (kinds 30000, 30001, 30003)
+	if isListKind(event.Kind) {
+		return rejectList(ctx, event, pubkey)
+	}
+
+	// File metadata (kind 1063)
+	if event.Kind == KindFileMetadata {
+		return rejectFileMetadata(ctx, event, pubkey)
 	}
 
-	// Chat events (kind 9, 10, 11): relay member required
+	// Labels (kind 1985)
+	if event.Kind == KindLabel {
+		return rejectLabel(ctx, event, pubkey)
+	}
+
+	// Reports (kind 1984)
+	if event.Kind == nostr.KindReporting {
+		return rejectReport(ctx, event, pubkey)
+	}
+
+	// Live activities (kind 30311) and their chat (kind 1311)
+	if event.Kind == KindLiveActivity {
+		return rejectLiveActivity(ctx, event, pubkey)
+	}
+	if event.Kind == KindLiveChat {
+		return rejectLiveChat(ctx, event, pubkey)
+	}
+
+	// Reactions to group chat (kind 7 with an h tag)
+	if isGroupReaction(event) {
+		return rejectGroupReaction(ctx, event, pubkey)
+	}
+
+	// Chat events (kind 9, 10, 11): members of the group they name only
+	// (the relay admin counts as one)
 	if isGroupChatEvent(event.Kind) {
 		if !isActiveMember(ctx, pubkey) {
-			return true, "restricted: membership required for group participation"
+			return true, say(ctx, msgMembershipForGroups)
 		}
-		return false, ""
+		groupId := getHTag(event)
+		if groupId == "" {
+			return true, say(ctx, msgMissingHTag)
+		}
+		if !groupExists(ctx, groupId) {
+			return true, say(ctx, msgGroupNotFound)
+		}
+		if !isGroupMember(ctx, groupId, pubkey) {
+			return true, say(ctx, msgNotGroupMember)
+		}
+		// Announcements come from moderators, muted or not (see GROUP
+		// ANNOUNCEMENTS)
+		if isAnnouncement(event) {
+			if reject, msg := rejectAnnouncement(ctx, groupId, pubkey); reject {
+				return true, msg
+			}
+		} else if reject, msg := rejectGroupMuted(ctx, event, pubkey); reject {
+			return true, msg
+		}
+		if reject, msg := rejectChatReply(ctx, event, groupId); reject {
+			return true, msg
+		}
+		return rejectUnlabeledMedia(ctx, event)
 	}
 
 	// Everything else: membership required
 	if !isActiveMember(ctx, pubkey) {
-		return true, "restricted: membership required"
+		return true, say(ctx, msgMembershipRequired)
 	}
 
 	return false, ""
 }
 
+// isReplaceableKind reports NIP-01 replaceable kinds: 0, 3 and 10000-19999.
+func isReplaceableKind(kind int) bool {
+	return kind == 0 || kind == 3 || (kind >= 10000 && kind < 20000)
+}
+
+// replaceableKindSQL is isReplaceableKind over the kind column of alias.
+func replaceableKindSQL(alias string) string {
+	return fmt.Sprintf("(%[1]s.kind IN (0, 3) OR %[1]s.kind BETWEEN 10000 AND 19999)", alias)
+}
+
+// isEphemeralKind reports NIP-01 ephemeral kinds, 20000-29999: relayed to
+// live subscribers, never stored.
+func isEphemeralKind(kind int) bool {
+	return kind >= 20000 && kind < 30000
+}
+
+// onlyEphemeralKinds reports whether kinds is non-empty and all ephemeral.
+func onlyEphemeralKinds(kinds []int) bool {
+	for _, k := range kinds {
+		if !isEphemeralKind(k) {
+			return false
+		}
+	}
+	return len(kinds) > 0
+}
+
 func isGroupChatEvent(kind int) bool {
 	return kind == KindGroupChat || kind == KindGroupChatReply || kind == KindGroupChatDelete
 }
@@ -387,11 +882,27 @@ func isGroupEvent(kind int) bool {
 func rejectFilterPolicy(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
 	pubkey := getAuthenticatedPubkey(ctx)
 
-	// Public recipe reads (kind 30023).
+	if limits.AuthRequired && pubkey == "" {
+		return true, say(ctx, msgAuthRequired)
+	}
+
+	// Only the admin may scan every event (for backups).
+	if isBroadFilter(filter) && pubkey != communityOf(ctx).admin() {
+		return true, say(ctx, msgFilterTooBroad)
+	}
+
+	// Public recipe reads (kind 30023). Group recipes are left out for
+	// readers outside the group (see GROUP-SCOPED EVENTS).
 	if containsOnlyKind(filter.Kinds, KindRecipe) {
 		return false, ""
 	}
 
+	// Public profile reads (kind 0), so recipe pages show their authors
+	// to logged-out visitors too.
+	if containsOnlyKind(filter.Kinds, nostr.KindProfileMetadata) {
+		return false, ""
+	}
+
 	// Public Nourish discovery reads: service-authored kind 30078 only.
 	// Writes remain auth-gated via rejectEventPolicy. Bare kind-30078
 	// filters (no author constraint) stay membership-gated so members'
@@ -400,29 +911,68 @@ func rejectFilterPolicy(ctx context.Context, filter nostr.Filter) (reject bool,
 		return false, ""
 	}
 
-	if containsGroupKinds(filter.Kinds) {
+	// The relay's content labels, so anonymous readers can blur too.
+	if isPublicLabelFilter(filter) {
+		return false, ""
+	}
+
+	// The relay's weekly featured lists (see FEATURED RECIPES).
+	if isPublicFeaturedFilter(filter) {
+		return false, ""
+	}
+
+	// Reactions and comments on recipes (see RECIPE ENGAGEMENT).
+	if isPublicEngagementFilter(ctx, filter) {
+		return false, ""
+	}
+
+	// Recipe images' file metadata (see FILE METADATA).
+	if isPublicFileMetadataFilter(ctx, filter) {
+		return false, ""
+	}
+
+	// Browsing groups; private ones are left out (see GROUP-SCOPED EVENTS).
+	if isGroupDirectoryFilter(filter) {
+		return false, ""
+	}
+
+	// A filter without kinds can match group events too. Reading one's own
+	// events needs no membership, whatever their kinds.
+	own := len(filter.Authors) == 1 && filter.Authors[0] == pubkey
+	if containsGroupKinds(filter.Kinds) && !(own && len(filter.Kinds) == 0) {
 		if pubkey == "" {
-			return true, "auth-required: please authenticate to access group content"
+			return true, say(ctx, msgAuthGroupContent)
 		}
 		if !isActiveMember(ctx, pubkey) {
-			return true, "restricted: membership required to access group content"
+			return true, say(ctx, msgMembershipForGroupContent)
+		}
+		// A group's conversation is for its members. Without an h tag the
+		// query leaves out other groups', so a filter mixing in recipes or
+		// other public kinds still gets those (see GROUP-SCOPED EVENTS).
+		if mayMatchGroupScoped(filter.Kinds) {
+			for _, groupId := range append(filter.Tags["h"], filter.Tags["&h"]...) {
+				if !isGroupMember(ctx, groupId, pubkey) {
+					return true, say(ctx, msgNotGroupMember)
+				}
+			}
 		}
 		return false, ""
 	}
 
-	if len(filter.Authors) == 1 && filter.Authors[0] == pubkey {
+	if own {
 		return false, ""
 	}
 
 	if pubkey == "" {
-		return true, "auth-required: please authenticate"
+		return true, say(ctx, msgAuthPlease)
 	}
 
 	if !isActiveMember(ctx, pubkey) {
-		return true, "restricted: membership required"
+		return true, say(ctx, msgMembershipRequired)
 	}
 
-	return false, ""
+	// Other members' lists are private unless marked public (see LISTS).
+	return rejectListFilter(ctx, filter, pubkey)
 }
 
 // isPublicNourishFilter reports whether a REQ may be served without auth:
@@ -449,7 +999,12 @@ func containsOnlyKind(kinds []int, targetKind int) bool {
 	return true
 }
 
+// containsGroupKinds reports whether a filter with these kinds can match a
+// group event. An empty list matches every kind, group kinds included.
 func containsGroupKinds(kinds []int) bool {
+	if len(kinds) == 0 {
+		return true
+	}
 	for _, k := range kinds {
 		if isGroupEvent(k) {
 			return true
@@ -462,273 +1017,856 @@ func containsGroupKinds(kinds []int) bool {
 // EVENT STORAGE
 // ═══════════════════════════════════════════════════════════════════════════════
 
+// errReplaced refuses a replaceable event older than the stored version.
+var errReplaced = errors.New("replaced: have newer event")
+
 func persistEvent(ctx context.Context, event *nostr.Event) error {
-	rawJSON, err := json.Marshal(event)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	var dTag *string
-	if event.Kind >= 30000 && event.Kind < 40000 {
-		for _, tag := range event.Tags {
-			if len(tag) >= 2 && tag[0] == "d" {
-				dTag = &tag[1]
-				break
-			}
-		}
+	if err := persistEventTx(ctx, tx, event); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addressLockClass namespaces the per-address advisory locks.
+const addressLockClass = 30
+
+// lockAddress takes the lock of the address (kind, pubkey, d) for the rest
+// of tx. Without it two transactions replacing the same address would each
+// delete the versions they see and both insert, as regenerated group
+// metadata did; idx_events_address now refuses the second.
+func lockAddress(ctx context.Context, tx *sql.Tx, kind int, pubkey, d string) error {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1, hashtext($2))",
+		addressLockClass, fmt.Sprintf("%d:%s:%s", kind, pubkey, d))
+	return err
+}
+
+// persistEventTx stores event as part of tx, in ctx's community. Replaced
+// versions are looked up there too: an event id is stored once, so the same
+// event sent to a second community is not stored again.
+func persistEventTx(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	// khatru only broadcasts ephemeral events; nothing else stores them either
+	if isEphemeralKind(event.Kind) {
+		return nil
+	}
+
+	rawJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
 	}
+	community := communityOf(ctx).id()
+
+	dTag := addressableDTag(event)
 
 	tagsJSON, _ := json.Marshal(event.Tags)
 
-	if event.Kind >= 30000 && event.Kind < 40000 && dTag != nil {
-		// Addressable events: delete previous version, then insert
-		_, _ = db.ExecContext(ctx,
-			"DELETE FROM events WHERE kind = $1 AND pubkey = $2 AND d_tag = $3",
-			event.Kind, event.PubKey, *dTag)
+	if dTag != nil {
+		// Addressable events: keep only the newest per (kind, pubkey, d),
+		// the lowest id winning a created_at tie (NIP-01). Writers of one
+		// address take turns, so each sees the version the last one stored.
+		if err := lockAddress(ctx, tx, event.Kind, event.PubKey, *dTag); err != nil {
+			return err
+		}
+		var superseded bool
+		if err := tx.QueryRowContext(ctx, `
+			SELECT EXISTS (SELECT 1 FROM events WHERE kind = $1 AND pubkey = $2 AND d_tag = $3
+				AND (created_at > $4 OR (created_at = $4 AND id < $5)) AND community = $6)
+		`, event.Kind, event.PubKey, *dTag, int64(event.CreatedAt), event.ID, community).Scan(&superseded); err != nil {
+			return err
+		}
+		if superseded {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx,
+			"DELETE FROM events WHERE kind = $1 AND pubkey = $2 AND d_tag = $3 AND community = $4",
+			event.Kind, event.PubKey, *dTag, community); err != nil {
+			return err
+		}
 
-		_, err = db.ExecContext(ctx, `
-			INSERT INTO events (id, pubkey, kind, created_at, content, tags, sig, d_tag, raw)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO events (id, pubkey, kind, created_at, content, tags, sig, d_tag, raw, community)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 			ON CONFLICT (id) DO UPDATE SET
 				content = EXCLUDED.content,
 				tags = EXCLUDED.tags,
 				sig = EXCLUDED.sig,
 				raw = EXCLUDED.raw
-		`, event.ID, event.PubKey, event.Kind, time.Unix(int64(event.CreatedAt), 0),
-			event.Content, tagsJSON, event.Sig, dTag, rawJSON)
+			WHERE events.community = EXCLUDED.community
+		`, event.ID, event.PubKey, event.Kind, int64(event.CreatedAt),
+			event.Content, tagsJSON, event.Sig, dTag, rawJSON, community)
+	} else if isReplaceableKind(event.Kind) {
+		// Replaceable events (profiles, follow and relay lists): keep only
+		// the newest per (kind, pubkey), with the same tie-break and lock.
+		// An older version is refused, so it is not broadcast either.
+		if err := lockAddress(ctx, tx, event.Kind, event.PubKey, ""); err != nil {
+			return err
+		}
+		var superseded bool
+		if err := tx.QueryRowContext(ctx, `
+			SELECT EXISTS (SELECT 1 FROM events WHERE kind = $1 AND pubkey = $2
+				AND (created_at > $3 OR (created_at = $3 AND id < $4)) AND community = $5)
+		`, event.Kind, event.PubKey, int64(event.CreatedAt), event.ID, community).Scan(&superseded); err != nil {
+			return err
+		}
+		if superseded {
+			return errReplaced
+		}
+		if _, err := tx.ExecContext(ctx,
+			"DELETE FROM events WHERE kind = $1 AND pubkey = $2 AND id <> $3 AND community = $4",
+			event.Kind, event.PubKey, event.ID, community); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO events (id, pubkey, kind, created_at, content, tags, sig, raw, community)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (id) DO NOTHING
+		`, event.ID, event.PubKey, event.Kind, int64(event.CreatedAt),
+			event.Content, tagsJSON, event.Sig, rawJSON, community)
+		if err == nil && event.Kind == nostr.KindFollowList {
+			err = syncFollows(ctx, tx, event)
+		}
 	} else {
-		_, err = db.ExecContext(ctx, `
-			INSERT INTO events (id, pubkey, kind, created_at, content, tags, sig, raw)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO events (id, pubkey, kind, created_at, content, tags, sig, raw, community)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 			ON CONFLICT (id) DO NOTHING
-		`, event.ID, event.PubKey, event.Kind, time.Unix(int64(event.CreatedAt), 0),
-			event.Content, tagsJSON, event.Sig, rawJSON)
+		`, event.ID, event.PubKey, event.Kind, int64(event.CreatedAt),
+			event.Content, tagsJSON, event.Sig, rawJSON, community)
 	}
-
-	return err
-}
-
-func storeEvent(ctx context.Context, event *nostr.Event) error {
-	err := persistEvent(ctx, event)
 	if err != nil {
 		return err
 	}
 
-	// Handle NIP-29 side effects (generate relay-signed metadata events)
-	handleNIP29SideEffects(ctx, event)
-
-	return nil
-}
-
-func deleteEvent(ctx context.Context, event *nostr.Event) error {
-	pubkey := getAuthenticatedPubkey(ctx)
-	if pubkey == "" || pubkey != event.PubKey {
-		if pubkey != adminPubkey {
-			return fmt.Errorf("unauthorized: can only delete own events")
-		}
+	if err := insertEventTags(ctx, tx, event); err != nil {
+		return err
 	}
-	_, err := db.ExecContext(ctx, "DELETE FROM events WHERE id = $1", event.ID)
-	return err
-}
-
-// ═══════════════════════════════════════════════════════════════════════════════
-// EVENT QUERIES
-// ═══════════════════════════════════════════════════════════════════════════════
+	if err := insertContentLabels(ctx, tx, event); err != nil {
+		return err
+	}
+	if err := insertReadMarker(ctx, tx, event); err != nil {
+		return err
+	}
+	if err := insertGroupReaction(ctx, tx, event); err != nil {
+		return err
+	}
+	if err := insertZapReceipt(ctx, tx, event); err != nil {
+		return err
+	}
+	if err := insertReport(ctx, tx, event); err != nil {
+		return err
+	}
+	if err := insertExpiration(ctx, tx, event); err != nil {
+		return err
+	}
+	if err := noteAnnouncement(ctx, tx, event); err != nil {
+		return err
+	}
+	return insertCalendarSpan(ctx, tx, event)
+}
+
+func storeEvent(ctx context.Context, event *nostr.Event) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := persistEventTx(ctx, tx, event); err != nil {
+		return err
+	}
+
+	// NIP-29 side effects commit with the event; the relay-signed events
+	// they call for are generated by the group sync worker (see GROUP SYNC)
+	deleted, err := handleNIP29SideEffects(ctx, tx, event)
+	pending := errors.Is(err, errJoinPending)
+	var skipped *skippedUsersError
+	partial := errors.As(err, &skipped)
+	if errors.Is(err, errInviteInvalid) {
+		// Another join took the last use since the policy looked
+		return errors.New(say(ctx, msgInviteInvalid))
+	}
+	if errors.Is(err, errGroupBanned) {
+		return errors.New(say(ctx, msgGroupBanned))
+	}
+	if errors.Is(err, errLastAdmin) {
+		return errors.New(say(ctx, msgLastGroupAdmin))
+	}
+	if errors.Is(err, errGroupFull) {
+		return errors.New(say(ctx, msgGroupFull))
+	}
+	if errors.Is(err, errGroupIDInvalid) {
+		return errors.New(say(ctx, msgGroupIDInvalid))
+	}
+	if errors.Is(err, errAlreadyMember) {
+		return errors.New(say(ctx, msgAlreadyGroupMember))
+	}
+	if errors.Is(err, errJoinDuplicate) {
+		return errors.New(say(ctx, msgJoinDuplicate))
+	}
+	if err != nil && !pending && !partial {
+		log.Printf("[NIP-29] Error applying kind %d from %s: %v", event.Kind, event.PubKey, err)
+		return fmt.Errorf("error: could not apply group change")
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if pending {
+		// Stored, but the client is told it is not a member yet
+		return errors.New(say(ctx, msgJoinPending))
+	}
+	if (isGroupEvent(event.Kind) && !isGroupChatEvent(event.Kind)) || isAnnouncement(event) {
+		groupSync.kick()
+	}
+	if len(deleted) > 0 {
+		announceGroupDeletion(ctx, event, deleted)
+	}
+	if event.Kind == KindReadMarker {
+		unread.forget(communityOf(ctx).id(), event.PubKey)
+	}
+
+	if communityOf(ctx) == nil {
+		profiles.noticeEvent(event)
+		mirrorEvent(event)
+	}
+
+	if isRestrictedEvent(event) {
+		connections.deliverRestricted(ctx, event)
+	}
+	connections.deliverAndTagged(ctx, event)
+
+	if partial {
+		// Applied and stored, but the admin learns who was left out
+		return errors.New(say(ctx, msgUsersNotAdded, strings.Join(skipped.pubkeys, ", ")))
+	}
+	return nil
+}
+
+// deleteEvent removes a stored event. Callers authorize: authorizeDeletion
+// for kind 5, rejectEventPolicy for 9005 and for the replaceable versions
+// khatru supersedes.
+func deleteEvent(ctx context.Context, event *nostr.Event) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := removeEventTx(ctx, tx, event); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// removeEventTx deletes a stored event and what is derived from it as part
+// of tx.
+func removeEventTx(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	if event.Kind == nostr.KindFollowList {
+		if err := deleteFollowsForEvent(ctx, tx, event.ID); err != nil {
+			return err
+		}
+	}
+	if err := deleteReactionsTo(ctx, tx, event); err != nil {
+		return err
+	}
+	if err := noteAnnouncement(ctx, tx, event); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "DELETE FROM events WHERE id = $1", event.ID)
+	return err
+}
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// EVENT QUERIES
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// queryEvents fetches a filter's results queryBatchSize at a time, each batch
+// its own query whose connection is released before the batch is sent, so a
+// slow or departed client never holds a connection or cursor. It stops at
+// the first batch the client does not take. An event stored or deleted
+// between batches can shift the next one by a row; dedupQuery drops the
+// repeat.
+const queryBatchSize = 100
+
+// queriesAbandoned counts queries whose client went away mid-stream.
+var queriesAbandoned = expvar.NewInt("queries_abandoned")
+
+// queryConfig bounds each batch query: past Timeout (0 for none) it is
+// cancelled and the subscription gets what was sent so far, then EOSE; past
+// Slow it is logged with its filter.
+type queryConfig struct {
+	Timeout time.Duration
+	Slow    time.Duration
+}
+
+var queryCfg = queryConfig{Timeout: 5 * time.Second, Slow: time.Second}
+
+// queriesTimedOut counts queries cancelled by queryCfg.Timeout.
+var queriesTimedOut = expvar.NewInt("queries_timed_out")
+
+func loadQueryConfig() {
+	queryCfg = queryConfig{
+		Timeout: envDuration("RELAY_QUERY_TIMEOUT", 5*time.Second),
+		Slow:    envDuration("RELAY_SLOW_QUERY", time.Second),
+	}
+}
 
 func queryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
 	ch := make(chan *nostr.Event)
 	go func() {
 		defer close(ch)
-		query, args := buildQuery(filter)
-		rows, err := db.QueryContext(ctx, query, args...)
-		if err != nil {
-			log.Printf("Query error: %v", err)
+		viewer := getAuthenticatedPubkey(ctx)
+		c, hideLabeled := communityOf(ctx), hidesLabeled(ctx, viewer)
+		stats := newQueryStats(filter)
+		defer stats.record()
+		sent := 0
+		var last *nostr.Event
+		send := func(batch []*nostr.Event) bool {
+			for _, event := range batch {
+				select {
+				case ch <- event:
+					sent++
+					last = event
+				case <-ctx.Done():
+					queriesAbandoned.Add(1)
+					log.Printf("[query] Abandoned after %d events: %v", sent, context.Cause(ctx))
+					return false
+				}
+			}
+			return true
+		}
+
+		// Nothing ephemeral is stored
+		if onlyEphemeralKinds(filter.Kinds) {
 			return
 		}
-		defer rows.Close()
-		for rows.Next() {
-			var rawJSON []byte
-			if err := rows.Scan(&rawJSON); err != nil {
-				log.Printf("Scan error: %v", err)
-				continue
-			}
-			var event nostr.Event
-			if err := json.Unmarshal(rawJSON, &event); err != nil {
-				log.Printf("Unmarshal error: %v", err)
-				continue
+
+		if isIDLookup(filter) || isLatestLookup(filter) {
+			query, args := buildIDQuery(filter, c, viewer, hideLabeled)
+			if found, err := fetchBatch(ctx, filter, stats, query, args); err == nil {
+				send(found)
 			}
-			select {
-			case ch <- &event:
-			case <-ctx.Done():
+			return
+		}
+
+		limit := queryLimit(filter.Limit)
+		for offset := 0; offset < limit; offset += queryBatchSize {
+			size := min(queryBatchSize, limit-offset)
+			query, args := buildBatchQuery(filter, c, viewer, hideLabeled, offset, size)
+			batch, err := fetchBatch(ctx, filter, stats, query, args)
+			if err != nil || !send(batch) || len(batch) < size {
 				return
 			}
 		}
+
+		// The page is full: finish its oldest second (see buildSecondQuery).
+		if last == nil || searchTerms(filter.Search) != "" {
+			return
+		}
+		query, args := buildSecondQuery(filter, c, viewer, hideLabeled, last)
+		if rest, err := fetchBatch(ctx, filter, stats, query, args); err == nil {
+			send(rest)
+		}
 	}()
 	return ch, nil
 }
 
+// fetchBatch runs one batch query of filter under queryCfg's deadline,
+// adding it to stats and logging it if slow and any error but the client's
+// departure.
+func fetchBatch(ctx context.Context, filter nostr.Filter, stats *queryStats, query string, args []interface{}) ([]*nostr.Event, error) {
+	qctx, cancel := context.WithCancel(ctx)
+	if queryCfg.Timeout > 0 {
+		qctx, cancel = context.WithTimeout(ctx, queryCfg.Timeout)
+	}
+	defer cancel()
+	start := time.Now()
+	batch, err := fetchEvents(qctx, query, args)
+	elapsed := time.Since(start)
+	stats.add(len(batch), elapsed)
+	switch {
+	case err != nil && ctx.Err() == nil && qctx.Err() == context.DeadlineExceeded:
+		queriesTimedOut.Add(1)
+		log.Printf("[query] Timed out after %s: %s", elapsed.Round(time.Millisecond), filter)
+	case err != nil && ctx.Err() == nil:
+		log.Printf("Query error: %v", err)
+	case elapsed >= queryCfg.Slow:
+		log.Printf("[query] Slow query (%s): %s", elapsed.Round(time.Millisecond), filter)
+	}
+	return batch, err
+}
+
+// fetchEvents runs one batch query and returns its events, releasing the
+// connection before anything is sent.
+func fetchEvents(ctx context.Context, query string, args []interface{}) ([]*nostr.Event, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []*nostr.Event
+	for rows.Next() {
+		var rawJSON []byte
+		if err := rows.Scan(&rawJSON); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		var event nostr.Event
+		if err := json.Unmarshal(rawJSON, &event); err != nil {
+			log.Printf("Unmarshal error: %v", err)
+			continue
+		}
+		events = append(events, &event)
+	}
+	return events, rows.Err()
+}
+
+// buildQuery renders filter as an anonymous reader of the default community
+// would see it.
 func buildQuery(filter nostr.Filter) (string, []interface{}) {
+	return buildViewerQuery(filter, nil, "", false)
+}
+
+// buildViewerQuery renders filter for viewer, the authenticated pubkey (or
+// ""), which decides the visibility of reader-dependent rows, in community c
+// (nil for the default one). hideLabeled leaves out labeled events (see
+// CONTENT LABELS).
+func buildViewerQuery(filter nostr.Filter, c *community, viewer string, hideLabeled bool) (string, []interface{}) {
+	return buildBatchQuery(filter, c, viewer, hideLabeled, 0, queryLimit(filter.Limit))
+}
+
+// isIDLookup reports a filter that names its events by full id and nothing
+// else, as clients resolve e tags. It can return at most len(IDs) events, so
+// it needs neither ordering nor the default limit, which would otherwise cut
+// a lookup of more ids than MaxLimit short.
+func isIDLookup(filter nostr.Filter) bool {
+	if len(filter.IDs) == 0 || len(filter.Authors) > 0 || len(filter.Kinds) > 0 || len(filter.Tags) > 0 ||
+		filter.Since != nil || filter.Until != nil || filter.Search != "" {
+		return false
+	}
+	if filter.Limit > 0 && filter.Limit < len(filter.IDs) {
+		return false
+	}
+	for _, id := range filter.IDs {
+		if !nostr.IsValid32ByteHex(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// isLatestLookup reports a filter for the current replaceable events
+// (profiles, follow lists, a member's groups list) of authors named by full
+// pubkey, as clients fetch on startup. It returns the newest of each kind and
+// author, at most len(Kinds) * len(Authors) events, so like an id lookup it
+// needs no page order or batching.
+func isLatestLookup(filter nostr.Filter) bool {
+	if len(filter.Authors) == 0 || len(filter.Kinds) == 0 || len(filter.IDs) > 0 || len(filter.Tags) > 0 ||
+		filter.Since != nil || filter.Until != nil || filter.Search != "" {
+		return false
+	}
+	if filter.Limit > 0 && filter.Limit < len(filter.Kinds)*len(filter.Authors) {
+		return false
+	}
+	for _, kind := range filter.Kinds {
+		if !isReplaceableKind(kind) {
+			return false
+		}
+	}
+	for _, author := range filter.Authors {
+		if !nostr.IsValid32ByteHex(author) {
+			return false
+		}
+	}
+	return true
+}
+
+// buildIDQuery is the query for an isIDLookup or isLatestLookup filter: an
+// index probe under the same visibility conditions as any other query. A
+// latest lookup keeps the newest version of each kind and author, should an
+// older one still be stored, ties going to the lowest id as in persistEvent.
+func buildIDQuery(filter nostr.Filter, c *community, viewer string, hideLabeled bool) (string, []interface{}) {
+	where, args, _ := viewerConditions(filter, c, viewer, hideLabeled)
+	if len(filter.IDs) > 0 {
+		return "SELECT raw FROM events" + where, args
+	}
+	return "SELECT DISTINCT ON (kind, pubkey) raw FROM events" + where + " ORDER BY kind, pubkey, created_at DESC, id", args
+}
+
+// buildBatchQuery renders size events of filter's results from offset, in
+// page order: newest first, ties by ascending id, so the order is total and
+// the same on every run whatever kinds the filter mixes. LIMIT applies to
+// that order in the same SELECT, so a limit of N is the newest N whatever
+// plan Postgres picks.
+func buildBatchQuery(filter nostr.Filter, c *community, viewer string, hideLabeled bool, offset, size int) (string, []interface{}) {
+	where, args, searchArg := viewerConditions(filter, c, viewer, hideLabeled)
+	query := "SELECT raw FROM events" + where
+	if searchArg > 0 {
+		query += " ORDER BY " + searchRank(searchArg) + ", created_at DESC, id"
+	} else {
+		query += " ORDER BY created_at DESC, id"
+	}
+
+	query += fmt.Sprintf(" LIMIT %d", size)
+	if offset > 0 {
+		query += fmt.Sprintf(" OFFSET %d", offset)
+	}
+
+	return query, args
+}
+
+// buildSecondQuery renders the events of filter's results in last's second
+// that follow last in page order, at most MaxLimit of them. A page that fills
+// its limit ends with them, so clients paging back with until set to one
+// second before the oldest event they hold neither miss events sharing that
+// second nor get any twice.
+func buildSecondQuery(filter nostr.Filter, c *community, viewer string, hideLabeled bool, last *nostr.Event) (string, []interface{}) {
+	where, args, _ := viewerConditions(filter, c, viewer, hideLabeled)
+	where += fmt.Sprintf(" AND created_at = $%d AND id > $%d", len(args)+1, len(args)+2)
+	args = append(args, int64(last.CreatedAt), last.ID)
+	return "SELECT raw FROM events" + where + fmt.Sprintf(" ORDER BY id LIMIT %d", queryLimit(0)), args
+}
+
+// viewerConditions renders the WHERE clause shared by buildViewerQuery and
+// buildCountQuery, with its arguments and the index of the search argument
+// (0 when the filter does not search).
+func viewerConditions(filter nostr.Filter, c *community, viewer string, hideLabeled bool) (string, []interface{}, int) {
 	conditions := []string{}
 	args := []interface{}{}
 	argIndex := 1
 
 	if len(filter.IDs) > 0 {
-		placeholders := make([]string, len(filter.IDs))
-		for i, id := range filter.IDs {
-			placeholders[i] = fmt.Sprintf("$%d", argIndex)
-			args = append(args, id)
-			argIndex++
-		}
-		conditions = append(conditions, fmt.Sprintf("id IN (%s)", strings.Join(placeholders, ",")))
+		cond, idArgs := hexFilterCondition("id", filter.IDs, argIndex)
+		conditions = append(conditions, cond)
+		args = append(args, idArgs...)
+		argIndex += len(idArgs)
 	}
 
 	if len(filter.Authors) > 0 {
-		placeholders := make([]string, len(filter.Authors))
-		for i, author := range filter.Authors {
-			placeholders[i] = fmt.Sprintf("$%d", argIndex)
-			args = append(args, author)
-			argIndex++
-		}
-		conditions = append(conditions, fmt.Sprintf("pubkey IN (%s)", strings.Join(placeholders, ",")))
+		cond, authorArgs := hexFilterCondition("pubkey", filter.Authors, argIndex)
+		conditions = append(conditions, cond)
+		args = append(args, authorArgs...)
+		argIndex += len(authorArgs)
 	}
 
 	if len(filter.Kinds) > 0 {
-		placeholders := make([]string, len(filter.Kinds))
+		kinds := make([]int64, len(filter.Kinds))
 		for i, kind := range filter.Kinds {
-			placeholders[i] = fmt.Sprintf("$%d", argIndex)
-			args = append(args, kind)
-			argIndex++
+			kinds[i] = int64(kind)
 		}
-		conditions = append(conditions, fmt.Sprintf("kind IN (%s)", strings.Join(placeholders, ",")))
+		conditions = append(conditions, fmt.Sprintf("kind = ANY($%d::int[])", argIndex))
+		args = append(args, pq.Array(kinds))
+		argIndex++
 	}
 
-	// Tag filters (#h, #d, #p, #e, etc.)
-	if filter.Tags != nil {
-		for tagName, values := range filter.Tags {
-			if len(values) == 0 {
-				continue
-			}
-			tagConditions := make([]string, len(values))
-			for i, val := range values {
-				tagConditions[i] = fmt.Sprintf("tags @> $%d::jsonb", argIndex)
-				tagJSON, _ := json.Marshal([][]string{{tagName, val}})
-				args = append(args, string(tagJSON))
-				argIndex++
-			}
-			conditions = append(conditions, "("+strings.Join(tagConditions, " OR ")+")")
+	// Tag filters (#h, #d, #p, #e, etc., plus NIP-119 &-tags), in a stable
+	// order so identical filters produce identical statements.
+	tagNames := make([]string, 0, len(filter.Tags))
+	for tagName, values := range filter.Tags {
+		if len(values) > 0 {
+			tagNames = append(tagNames, tagName)
+		}
+	}
+	sort.Strings(tagNames)
+	for _, tagName := range tagNames {
+		var cond string
+		var tagArgs []interface{}
+		if isAndTagKey(tagName) {
+			cond, tagArgs = andTagFilterCondition(tagName[1:], filter.Tags[tagName], argIndex)
+		} else if tagName == "d" && onlyAddressableKinds(filter.Kinds) {
+			cond, tagArgs = dTagFilterCondition(filter.Tags[tagName], argIndex)
+		} else {
+			cond, tagArgs = tagFilterCondition(tagName, filter.Tags[tagName], argIndex)
 		}
+		conditions = append(conditions, cond)
+		args = append(args, tagArgs...)
+		argIndex += len(tagArgs)
 	}
 
 	if filter.Since != nil {
 		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", argIndex))
-		args = append(args, time.Unix(int64(*filter.Since), 0))
+		args = append(args, int64(*filter.Since))
 		argIndex++
 	}
 
 	if filter.Until != nil {
 		conditions = append(conditions, fmt.Sprintf("created_at <= $%d", argIndex))
-		args = append(args, time.Unix(int64(*filter.Until), 0))
+		args = append(args, int64(*filter.Until))
 		argIndex++
 	}
 
-	query := "SELECT raw FROM events"
-	if len(conditions) > 0 {
-		query += " WHERE " + strings.Join(conditions, " AND ")
+	// NIP-50 full-text search (see SEARCH)
+	searchArg := 0
+	if terms := searchTerms(filter.Search); terms != "" {
+		conditions = append(conditions, searchCondition(argIndex))
+		args = append(args, terms)
+		searchArg = argIndex
+		argIndex++
 	}
-	query += " ORDER BY created_at DESC"
 
-	if filter.Limit > 0 {
-		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
-	} else {
-		query += " LIMIT 500"
+	conditions = append(conditions, unexpiredCondition())
+	if mayMatchAddressable(filter.Kinds) {
+		conditions = append(conditions, latestVersionCondition())
+	}
+	if mayMatchKind(filter.Kinds, KindAppData) {
+		cond, appDataArgs := appDataPrivacyCondition(viewer, argIndex)
+		conditions = append(conditions, cond)
+		args = append(args, appDataArgs...)
+		argIndex += len(appDataArgs)
+	}
+	if mayMatchKind(filter.Kinds, listKinds[0]) || mayMatchKind(filter.Kinds, listKinds[1]) || mayMatchKind(filter.Kinds, listKinds[2]) {
+		cond, listArgs := listPrivacyCondition(viewer, argIndex)
+		conditions = append(conditions, cond)
+		args = append(args, listArgs...)
+		argIndex += len(listArgs)
+	}
+	if mayMatchKind(filter.Kinds, KindReadMarker) {
+		cond, markerArgs := readMarkerPrivacyCondition(viewer, argIndex)
+		conditions = append(conditions, cond)
+		args = append(args, markerArgs...)
+		argIndex += len(markerArgs)
+	}
+	if mayMatchKind(filter.Kinds, nostr.KindGiftWrap) {
+		cond, wrapArgs := giftWrapPrivacyCondition(viewer, argIndex)
+		conditions = append(conditions, cond)
+		args = append(args, wrapArgs...)
+		argIndex += len(wrapArgs)
+	}
+	if cond, scopeArgs := groupScopeCondition(filter.Kinds, viewer, c.admin(), argIndex); cond != "" {
+		conditions = append(conditions, cond)
+		args = append(args, scopeArgs...)
+		argIndex += len(scopeArgs)
+	}
+	if cond, dirArgs := groupDirectoryCondition(filter.Kinds, c, viewer, argIndex); cond != "" {
+		conditions = append(conditions, cond)
+		args = append(args, dirArgs...)
+		argIndex += len(dirArgs)
+	}
+	if viewer != c.admin() {
+		if mayMatchKind(filter.Kinds, nostr.KindReporting) {
+			cond, reportArgs := reportPrivacyCondition(viewer, argIndex)
+			conditions = append(conditions, cond)
+			args = append(args, reportArgs...)
+			argIndex += len(reportArgs)
+		}
+		conditions = append(conditions, unhiddenCondition())
 	}
+	if hideLabeled {
+		cond, labelArgs := unlabeledCondition(viewer, argIndex)
+		conditions = append(conditions, cond)
+		args = append(args, labelArgs...)
+		argIndex += len(labelArgs)
+	}
+	conditions = append(conditions, fmt.Sprintf("community = $%d", argIndex))
+	args = append(args, c.id())
+	argIndex++
 
-	return query, args
+	return " WHERE " + strings.Join(conditions, " AND "), args, searchArg
+}
+
+// hexFilterCondition renders the ids or authors of a filter (OR across
+// values) as SQL, one array parameter for full 64-char values and one for
+// NIP-01 prefixes, so the statement text does not grow with the list. A
+// value that is not lowercase hex can match nothing, and is dropped rather
+// than handed to LIKE.
+func hexFilterCondition(column string, values []string, argIndex int) (string, []interface{}) {
+	var exact, prefixes []string
+	for _, v := range values {
+		switch {
+		case nostr.IsValid32ByteHex(v):
+			exact = append(exact, v)
+		case isHexPrefix(v):
+			prefixes = append(prefixes, v+"%")
+		}
+	}
+	var conds []string
+	var args []interface{}
+	if len(exact) > 0 {
+		conds = append(conds, fmt.Sprintf("%s = ANY($%d::text[])", column, argIndex))
+		args = append(args, pq.Array(exact))
+		argIndex++
+	}
+	if len(prefixes) > 0 {
+		conds = append(conds, fmt.Sprintf("%s LIKE ANY($%d::text[])", column, argIndex))
+		args = append(args, pq.Array(prefixes))
+	}
+	switch len(conds) {
+	case 0:
+		return "FALSE", nil
+	case 1:
+		return conds[0], args
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args
+}
+
+// isHexPrefix reports whether v is a proper prefix of a 64-char lowercase
+// hex id or pubkey.
+func isHexPrefix(v string) bool {
+	if v == "" || len(v) >= 64 {
+		return false
+	}
+	for _, c := range v {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
 }
 
 // ═══════════════════════════════════════════════════════════════════════════════
 // NIP-29 GROUP MANAGEMENT
 // ═══════════════════════════════════════════════════════════════════════════════
 
+// relayTimestamps remembers the last created_at signed per replaceable
+// kind and d tag, so quick regenerations never share a timestamp (on a tie
+// the lowest id would win, not the newest version).
+var relayTimestamps = struct {
+	sync.Mutex
+	last map[string]nostr.Timestamp
+}{last: make(map[string]nostr.Timestamp)}
+
+// relayEventsSigned counts the events the relay has signed (or asked its
+// bunker to sign).
+var relayEventsSigned = expvar.NewInt("relay_events_signed")
+
+// signRelayEvent signs event as the relay, with the local key or through
+// the NIP-46 signer (see REMOTE SIGNER).
 func signRelayEvent(event *nostr.Event) error {
-	if relayPrivateKey == "" {
-		return fmt.Errorf("relay private key not configured")
+	if !canSignRelayEvents() {
+		return fmt.Errorf("relay signing key not configured")
 	}
 	event.PubKey = relaySigningPubkey
-	event.CreatedAt = nostr.Timestamp(time.Now().Unix())
+	event.CreatedAt = nextRelayTimestamp(event)
+	relayEventsSigned.Add(1)
+	if relayBunker != nil {
+		return relayBunker.sign(context.Background(), event)
+	}
 	return event.Sign(relayPrivateKey)
 }
 
-func handleNIP29SideEffects(ctx context.Context, event *nostr.Event) {
-	if relayPrivateKey == "" {
-		return
+// nextRelayTimestamp returns now, or one second past the previous version
+// of the same replaceable event if that is later.
+func nextRelayTimestamp(event *nostr.Event) nostr.Timestamp {
+	now := nostr.Timestamp(time.Now().Unix())
+	var key string
+	if d := addressableDTag(event); d != nil {
+		key = fmt.Sprintf("%d:%s", event.Kind, *d)
+	} else if isReplaceableKind(event.Kind) {
+		key = fmt.Sprint(event.Kind)
+	} else {
+		return now
+	}
+	relayTimestamps.Lock()
+	defer relayTimestamps.Unlock()
+	if last := relayTimestamps.last[key]; now <= last {
+		now = last + 1
+	}
+	relayTimestamps.last[key] = now
+	return now
+}
+
+// handleNIP29SideEffects applies a group management event to the group
+// tables as part of tx, which also stores the event. It holds the group's
+// lock (see GROUP SYNC) until tx ends. For a 9005 it returns the events
+// deleted, to be announced once tx commits.
+func handleNIP29SideEffects(ctx context.Context, tx *sql.Tx, event *nostr.Event) ([]*nostr.Event, error) {
+	if !canSignRelayEvents() {
+		return nil, nil
+	}
+	// The relay's own confirmations record changes already applied
+	if event.PubKey == relaySigningPubkey {
+		return nil, nil
+	}
+
+	switch event.Kind {
+	case KindCreateGroup, KindEditMetadata, KindPutGroupStatus, KindPutUser, KindRemoveUser,
+		KindCreateInvite, KindPinEvents, KindMuteUser, KindJoinRequest, KindLeaveRequest, KindDeleteEvent, KindDeleteGroup:
+		// Only groups that predate the id check may have other ids (see
+		// GROUP IDS)
+		if groupId := getHTag(event); !validGroupID(groupId) && (event.Kind == KindCreateGroup || !groupIdTaken(ctx, groupId)) {
+			log.Printf("[NIP-29] Ignoring kind %d for malformed group id %q", event.Kind, groupId)
+			return nil, errGroupIDInvalid
+		}
+		if err := lockGroup(ctx, tx, getHTag(event)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
 	}
 
 	switch event.Kind {
 	case KindCreateGroup:
-		handleCreateGroup(ctx, event)
+		return nil, handleCreateGroup(ctx, tx, event)
 	case KindEditMetadata:
-		handleEditMetadata(ctx, event)
+		return nil, handleEditMetadata(ctx, tx, event)
+	case KindPutGroupStatus:
+		return nil, handlePutGroupStatus(ctx, tx, event)
+	case KindCreateInvite:
+		return nil, handleCreateInvite(ctx, tx, event)
+	case KindPinEvents:
+		return nil, handlePinEvents(ctx, tx, event)
+	case KindMuteUser:
+		return nil, handleMuteUser(ctx, tx, event)
 	case KindPutUser:
-		handlePutUser(ctx, event)
+		return nil, handlePutUser(ctx, tx, event)
 	case KindRemoveUser:
-		handleRemoveUser(ctx, event)
+		return nil, handleRemoveUser(ctx, tx, event)
 	case KindJoinRequest:
-		handleJoinRequest(ctx, event)
+		return nil, handleJoinRequest(ctx, tx, event)
 	case KindLeaveRequest:
-		handleLeaveRequest(ctx, event)
+		return nil, handleLeaveRequest(ctx, tx, event)
 	case KindDeleteEvent:
-		handleDeleteGroupEvent(ctx, event)
+		return handleDeleteGroupEvent(ctx, tx, event)
 	case KindDeleteGroup:
-		handleDeleteGroup(ctx, event)
+		return nil, handleDeleteGroup(ctx, tx, event)
 	}
+	return nil, nil
 }
 
-func handleCreateGroup(ctx context.Context, event *nostr.Event) {
+func handleCreateGroup(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
 	groupId := getHTag(event)
 	if groupId == "" {
-		return
+		return nil
 	}
 
 	log.Printf("[NIP-29] Creating group: %s (by %s)", groupId, event.PubKey)
 
 	// Insert into groups table
-	_, err := db.ExecContext(ctx, `
-		INSERT INTO groups (id, name, description, is_public, is_open, created_by)
-		VALUES ($1, $2, $3, false, false, $4)
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO groups (id, name, description, is_public, is_open, created_by, community)
+		VALUES ($1, $2, $3, false, false, $4, $5)
 		ON CONFLICT (id) DO NOTHING
-	`, groupId, groupId, "", event.PubKey)
+	`, groupId, groupId, "", event.PubKey, communityOf(ctx).id())
 	if err != nil {
-		log.Printf("[NIP-29] Error creating group record: %v", err)
-		return
+		return fmt.Errorf("create group record: %w", err)
+	}
+	// Group ids are global; one taken meanwhile, maybe by another
+	// community, must not gain this creator as its admin
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("group id %s is taken", groupId)
 	}
 
 	// Add creator as group admin
-	_, err = db.ExecContext(ctx, `
+	_, err = tx.ExecContext(ctx, `
 		INSERT INTO group_members (group_id, pubkey, role)
 		VALUES ($1, $2, 'admin')
 		ON CONFLICT (group_id, pubkey) DO UPDATE SET role = 'admin'
 	`, groupId, event.PubKey)
 	if err != nil {
-		log.Printf("[NIP-29] Error adding creator as admin: %v", err)
+		return fmt.Errorf("add creator as admin: %w", err)
 	}
 
-	// Generate kind 39000 (group metadata)
-	generateGroupMetadata(ctx, groupId)
-
-	// Generate kind 39001 (group admins)
-	generateGroupAdmins(ctx, groupId)
-
-	// Generate kind 39002 (group members)
-	generateGroupMembers(ctx, groupId)
-
-	log.Printf("[NIP-29] Group %s created successfully", groupId)
+	// Kinds 39000, 39001 and 39002 follow from the group sync
+	return markGroupDirty(ctx, tx, groupId)
 }
 
-func handleEditMetadata(ctx context.Context, event *nostr.Event) {
+func handleEditMetadata(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
 	groupId := getHTag(event)
 	if groupId == "" {
-		return
+		return nil
 	}
 
 	log.Printf("[NIP-29] Editing metadata for group: %s", groupId)
@@ -749,45 +1887,166 @@ func handleEditMetadata(ctx context.Context, event *nostr.Event) {
 		}
 	}
 
-	// Update groups table
+	// Update groups table (stopping at the first error)
+	var err error
+	update := func(column string, value interface{}) {
+		if err == nil {
+			_, err = tx.ExecContext(ctx,
+				"UPDATE groups SET "+column+" = $1, updated_at = NOW() WHERE id = $2", value, groupId)
+		}
+	}
 	if name != "" {
-		db.ExecContext(ctx, "UPDATE groups SET name = $1, updated_at = NOW() WHERE id = $2", name, groupId)
+		update("name", name)
 	}
 	if description != "" {
-		db.ExecContext(ctx, "UPDATE groups SET description = $1, updated_at = NOW() WHERE id = $2", description, groupId)
+		update("description", description)
 	}
 	if pictureURL != "" {
-		db.ExecContext(ctx, "UPDATE groups SET picture_url = $1, updated_at = NOW() WHERE id = $2", pictureURL, groupId)
+		update("picture_url", pictureURL)
 	}
 
-	// Check for visibility/access tags
+	// Visibility/access tags, as kind 9006 sends them
+	isPublic, isOpen := groupStatus(event.Tags)
+	if isPublic != nil {
+		update("is_public", *isPublic)
+	}
+	if isOpen != nil {
+		update("is_open", *isOpen)
+	}
 	for _, tag := range event.Tags {
+		if len(tag) < 1 {
+			continue
+		}
+		switch tag[0] {
+		case "require-media-labels":
+			update("require_media_labels", true)
+		case "allow-unlabeled-media":
+			update("require_media_labels", false)
+		}
+	}
+	// Chat retention (see CHAT RETENTION), checked by the policy
+	if ttl, _, ok, ttlErr := messageTTLTag(event.Tags); ok && ttlErr == nil {
+		update("message_ttl", int64(ttl.Seconds()))
+	}
+	// Member cap (see GROUP CAPACITY), checked by the policy
+	if limit, ok, limitErr := maxMembersTag(event.Tags); ok && limitErr == nil {
+		update("max_members", limit)
+	}
+	if err != nil {
+		return fmt.Errorf("update group: %w", err)
+	}
+
+	// Regenerate kind 39000
+	return markGroupDirty(ctx, tx, groupId)
+}
+
+// groupStatus reads the public/private and open/closed tags of a 9006 (or
+// 9002); nil leaves that setting as it is, and of conflicting tags the last
+// one wins.
+func groupStatus(tags nostr.Tags) (isPublic, isOpen *bool) {
+	yes, no := true, false
+	for _, tag := range tags {
 		if len(tag) < 1 {
 			continue
 		}
 		switch tag[0] {
 		case "public":
-			db.ExecContext(ctx, "UPDATE groups SET is_public = true, updated_at = NOW() WHERE id = $1", groupId)
+			isPublic = &yes
 		case "private":
-			db.ExecContext(ctx, "UPDATE groups SET is_public = false, updated_at = NOW() WHERE id = $1", groupId)
+			isPublic = &no
 		case "open":
-			db.ExecContext(ctx, "UPDATE groups SET is_open = true, updated_at = NOW() WHERE id = $1", groupId)
+			isOpen = &yes
 		case "closed":
-			db.ExecContext(ctx, "UPDATE groups SET is_open = false, updated_at = NOW() WHERE id = $1", groupId)
+			isOpen = &no
 		}
 	}
+	return isPublic, isOpen
+}
+
+func handlePutGroupStatus(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	groupId := getHTag(event)
+	isPublic, isOpen := groupStatus(event.Tags)
+	if groupId == "" || (isPublic == nil && isOpen == nil) {
+		return nil
+	}
+
+	log.Printf("[NIP-29] Setting status of group %s (by %s)", groupId, event.PubKey)
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE groups SET
+			is_public = COALESCE($1, is_public),
+			is_open = COALESCE($2, is_open),
+			updated_at = NOW()
+		WHERE id = $3
+	`, isPublic, isOpen, groupId); err != nil {
+		return fmt.Errorf("update group status: %w", err)
+	}
 
 	// Regenerate kind 39000
-	generateGroupMetadata(ctx, groupId)
+	return markGroupDirty(ctx, tx, groupId)
+}
+
+// groupGuestsAllowed lets put-user add pubkeys that are not active members
+// of the community (RELAY_GROUP_GUESTS), for groups that take in outside
+// guests.
+var groupGuestsAllowed bool
+
+// skippedUsersError is handlePutUser's answer when it left out the
+// non-members among its targets. The rest is applied and stored.
+type skippedUsersError struct {
+	pubkeys []string
 }
 
-func handlePutUser(ctx context.Context, event *nostr.Event) {
+func (e *skippedUsersError) Error() string {
+	return "not relay members: " + strings.Join(e.pubkeys, ", ")
+}
+
+func handlePutUser(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
 	groupId := getHTag(event)
 	if groupId == "" {
-		return
+		return nil
 	}
 
-	for _, tag := range event.Tags {
+	// Only the community's members can be added, checked in one query
+	applied := *event
+	var skipped []string
+	if !groupGuestsAllowed {
+		var targets []string
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				targets = append(targets, tag[1])
+			}
+		}
+		active, err := activeMembers(ctx, communityOf(ctx).id(), targets)
+		if err != nil {
+			return fmt.Errorf("check members: %w", err)
+		}
+		applied.Tags = nil
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "p" && !active[tag[1]] {
+				log.Printf("[NIP-29] Not adding %s to group %s: not a relay member", tag[1], groupId)
+				skipped = append(skipped, tag[1])
+				continue
+			}
+			applied.Tags = append(applied.Tags, tag)
+		}
+	}
+	// A skipped target is not promoted either
+	if err := checkLastAdmin(ctx, tx, groupId, &applied); err != nil {
+		return err
+	}
+	var adding []string
+	for _, tag := range applied.Tags {
+		if len(tag) >= 2 && tag[0] == "p" {
+			adding = append(adding, tag[1])
+		}
+	}
+	if err := checkGroupCapacity(ctx, tx, groupId, event.PubKey, adding); err != nil {
+		return err
+	}
+
+	var confirmed nostr.Tags
+	for _, tag := range applied.Tags {
 		if len(tag) < 2 || tag[0] != "p" {
 			continue
 		}
@@ -799,67 +2058,166 @@ func handlePutUser(ctx context.Context, event *nostr.Event) {
 
 		log.Printf("[NIP-29] Adding user %s to group %s with role %s", userPubkey, groupId, role)
 
-		_, err := db.ExecContext(ctx, `
+		_, err := tx.ExecContext(ctx, `
 			INSERT INTO group_members (group_id, pubkey, role)
 			VALUES ($1, $2, $3)
 			ON CONFLICT (group_id, pubkey) DO UPDATE SET role = $3
 		`, groupId, userPubkey, role)
 		if err != nil {
-			log.Printf("[NIP-29] Error adding user: %v", err)
+			return fmt.Errorf("add user: %w", err)
+		}
+		if err := clearPendingJoin(ctx, tx, groupId, userPubkey); err != nil {
+			return fmt.Errorf("add user: %w", err)
 		}
+		if err := unbanFromGroup(ctx, tx, groupId, userPubkey); err != nil {
+			return fmt.Errorf("add user: %w", err)
+		}
+		confirmed = append(confirmed, nostr.Tag{"p", userPubkey, role})
+	}
+	if err := queueMembershipConfirmation(ctx, tx, groupId, KindPutUser, event, confirmed); err != nil {
+		return err
 	}
 
 	// Regenerate metadata events
-	generateGroupAdmins(ctx, groupId)
-	generateGroupMembers(ctx, groupId)
+	if err := markGroupDirty(ctx, tx, groupId); err != nil {
+		return err
+	}
+	if len(skipped) > 0 {
+		return &skippedUsersError{skipped}
+	}
+	return nil
 }
 
-func handleRemoveUser(ctx context.Context, event *nostr.Event) {
+func handleRemoveUser(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
 	groupId := getHTag(event)
 	if groupId == "" {
-		return
+		return nil
 	}
+	if err := checkLastAdmin(ctx, tx, groupId, event); err != nil {
+		return err
+	}
+	reason, ban := banMarker(event)
+	unban := hasUnbanMarker(event)
 
+	var confirmed nostr.Tags
+	var removed []string
 	for _, tag := range event.Tags {
 		if len(tag) < 2 || tag[0] != "p" {
 			continue
 		}
 		userPubkey := tag[1]
 
+		// Bans and unbans (see GROUP BANS)
+		if unban {
+			if err := unbanFromGroup(ctx, tx, groupId, userPubkey); err != nil {
+				return fmt.Errorf("unban user: %w", err)
+			}
+			continue
+		}
+		if ban {
+			if err := banFromGroup(ctx, tx, groupId, userPubkey, reason, event.PubKey); err != nil {
+				return fmt.Errorf("ban user: %w", err)
+			}
+		}
+
 		log.Printf("[NIP-29] Removing user %s from group %s", userPubkey, groupId)
 
-		_, err := db.ExecContext(ctx, `
+		_, err := tx.ExecContext(ctx, `
 			DELETE FROM group_members WHERE group_id = $1 AND pubkey = $2
 		`, groupId, userPubkey)
 		if err != nil {
-			log.Printf("[NIP-29] Error removing user: %v", err)
+			return fmt.Errorf("remove user: %w", err)
+		}
+		// Removing someone who asked to join turns the request down
+		if err := clearPendingJoin(ctx, tx, groupId, userPubkey); err != nil {
+			return fmt.Errorf("remove user: %w", err)
 		}
+		confirmed = append(confirmed, nostr.Tag{"p", userPubkey})
+		removed = append(removed, userPubkey)
+	}
+	if err := queueMembershipConfirmation(ctx, tx, groupId, KindRemoveUser, event, confirmed); err != nil {
+		return err
+	}
+	if err := dropGroupLists(ctx, tx, removed); err != nil {
+		return err
 	}
 
-	generateGroupAdmins(ctx, groupId)
-	generateGroupMembers(ctx, groupId)
+	return markGroupDirty(ctx, tx, groupId)
 }
 
-func handleJoinRequest(ctx context.Context, event *nostr.Event) {
+// queueMembershipConfirmation queues the relay-signed copy (kind 9000 or
+// 9001) of an admin's membership change, naming the users it applied to
+// and referring to the admin's event with an e tag, as the relay confirms
+// joins and leaves. The copy has no side effects of its own (see
+// handleNIP29SideEffects).
+func queueMembershipConfirmation(ctx context.Context, tx *sql.Tx, groupId string, kind int, cause *nostr.Event, users nostr.Tags) error {
+	if len(users) == 0 {
+		return nil
+	}
+	tags := append(nostr.Tags{{"h", groupId}}, users...)
+	tags = append(tags, nostr.Tag{"e", cause.ID})
+	return queueGroupEvent(ctx, tx, groupId, nostr.Event{Kind: kind, Content: "", Tags: tags})
+}
+
+func handleJoinRequest(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
 	groupId := getHTag(event)
 	if groupId == "" {
-		return
+		return nil
+	}
+
+	// The policy refused banned requesters; a ban since then still counts
+	if banned, err := isBannedFromGroup(ctx, tx, groupId, event.PubKey); err != nil {
+		return fmt.Errorf("check group bans: %w", err)
+	} else if banned {
+		return errGroupBanned
+	}
+
+	// The policy refused duplicates; a double-click or a replay that got
+	// past it changes nothing
+	member, waiting, err := joinState(ctx, tx, groupId, event.PubKey)
+	if err != nil {
+		return fmt.Errorf("check join state: %w", err)
+	}
+	if member {
+		return errAlreadyMember
+	}
+	if waiting && event.Tags.GetFirst([]string{"code", ""}) == nil {
+		return errJoinDuplicate
+	}
+
+	// Closed groups wait for an admin or take an invite code (see JOIN
+	// REQUESTS AND INVITES)
+	wait, err := needsApproval(ctx, tx, groupId, event)
+	if err != nil {
+		return err
+	}
+	if wait {
+		return queuePendingJoin(ctx, tx, groupId, event)
+	}
+
+	if err := checkGroupCapacity(ctx, tx, groupId, event.PubKey, []string{event.PubKey}); err != nil {
+		return err
 	}
 
 	log.Printf("[NIP-29] Join request from %s for group %s — auto-approving", event.PubKey, groupId)
 
 	// Auto-approve: add as member
-	_, err := db.ExecContext(ctx, `
+	_, err = tx.ExecContext(ctx, `
 		INSERT INTO group_members (group_id, pubkey, role)
 		VALUES ($1, $2, 'member')
 		ON CONFLICT (group_id, pubkey) DO NOTHING
 	`, groupId, event.PubKey)
 	if err != nil {
-		log.Printf("[NIP-29] Error auto-approving join: %v", err)
-		return
+		return fmt.Errorf("auto-approve join: %w", err)
+	}
+	if err := clearPendingJoin(ctx, tx, groupId, event.PubKey); err != nil {
+		return fmt.Errorf("auto-approve join: %w", err)
+	}
+	if err := restoreLapsedMembership(ctx, tx, groupId, event.PubKey); err != nil {
+		return err
 	}
 
-	// Generate a kind 9000 (put-user) event signed by relay to confirm
+	// Queue a kind 9000 (put-user) event signed by relay to confirm
 	putEvent := nostr.Event{
 		Kind:    KindPutUser,
 		Content: "",
@@ -868,35 +2226,37 @@ func handleJoinRequest(ctx context.Context, event *nostr.Event) {
 			{"p", event.PubKey, "member"},
 		},
 	}
-	if err := signRelayEvent(&putEvent); err != nil {
-		log.Printf("[NIP-29] Error signing put-user event: %v", err)
-		return
-	}
-	if err := persistEvent(ctx, &putEvent); err != nil {
-		log.Printf("[NIP-29] Error storing put-user event: %v", err)
+	if err := queueGroupEvent(ctx, tx, groupId, putEvent); err != nil {
+		return err
 	}
 
 	// Update members list
-	generateGroupMembers(ctx, groupId)
+	return markGroupDirty(ctx, tx, groupId)
 }
 
-func handleLeaveRequest(ctx context.Context, event *nostr.Event) {
+func handleLeaveRequest(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
 	groupId := getHTag(event)
 	if groupId == "" {
-		return
+		return nil
+	}
+
+	if err := checkLastAdmin(ctx, tx, groupId, event); err != nil {
+		return err
 	}
 
 	log.Printf("[NIP-29] Leave request from %s for group %s", event.PubKey, groupId)
 
-	_, err := db.ExecContext(ctx, `
+	_, err := tx.ExecContext(ctx, `
 		DELETE FROM group_members WHERE group_id = $1 AND pubkey = $2
 	`, groupId, event.PubKey)
 	if err != nil {
-		log.Printf("[NIP-29] Error processing leave: %v", err)
-		return
+		return fmt.Errorf("process leave: %w", err)
+	}
+	if err := dropGroupLists(ctx, tx, []string{event.PubKey}); err != nil {
+		return err
 	}
 
-	// Generate a kind 9001 (remove-user) event signed by relay to confirm
+	// Queue a kind 9001 (remove-user) event signed by relay to confirm
 	removeEvent := nostr.Event{
 		Kind:    KindRemoveUser,
 		Content: "",
@@ -905,71 +2265,146 @@ func handleLeaveRequest(ctx context.Context, event *nostr.Event) {
 			{"p", event.PubKey},
 		},
 	}
-	if err := signRelayEvent(&removeEvent); err != nil {
-		log.Printf("[NIP-29] Error signing remove-user event: %v", err)
-		return
-	}
-	if err := persistEvent(ctx, &removeEvent); err != nil {
-		log.Printf("[NIP-29] Error storing remove-user event: %v", err)
+	if err := queueGroupEvent(ctx, tx, groupId, removeEvent); err != nil {
+		return err
 	}
 
-	generateGroupAdmins(ctx, groupId)
-	generateGroupMembers(ctx, groupId)
+	return markGroupDirty(ctx, tx, groupId)
 }
 
-func handleDeleteGroupEvent(ctx context.Context, event *nostr.Event) {
+func handleDeleteGroupEvent(ctx context.Context, tx *sql.Tx, event *nostr.Event) ([]*nostr.Event, error) {
+	groupId := getHTag(event)
+	var deleted []*nostr.Event
 	for _, tag := range event.Tags {
 		if len(tag) >= 2 && tag[0] == "e" {
 			eventId := tag[1]
-			log.Printf("[NIP-29] Deleting event %s from group", eventId)
-			_, err := db.ExecContext(ctx, "DELETE FROM events WHERE id = $1", eventId)
+			target, err := storedEvent(ctx, eventId)
 			if err != nil {
-				log.Printf("[NIP-29] Error deleting event: %v", err)
+				return nil, fmt.Errorf("look up %s: %w", eventId, err)
+			}
+			if target == nil {
+				continue
+			}
+			if !inGroup(target, groupId) {
+				log.Printf("[NIP-29] Not deleting %s (kind %d, group %q) for group %q", eventId, target.Kind, getHTag(target), groupId)
+				continue
 			}
+			log.Printf("[NIP-29] Deleting event %s from group %s", eventId, groupId)
+			if err := recordDeletion(ctx, tx, target, event, "", event.PubKey, deletedByModerator); err != nil {
+				return nil, fmt.Errorf("record deletion: %w", err)
+			}
+			if err := removeEventTx(ctx, tx, target); err != nil {
+				return nil, fmt.Errorf("delete event: %w", err)
+			}
+			deleted = append(deleted, target)
 		}
 	}
+	return deleted, nil
 }
 
-func handleDeleteGroup(ctx context.Context, event *nostr.Event) {
+// handleDeleteGroup removes a group with everything stored for it: its
+// tables' rows, its metadata, and every event carrying its h tag whatever
+// the kind, the delete-group itself included. A relay-signed 9008 is
+// queued in its place so clients learn the group is gone.
+func handleDeleteGroup(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
 	groupId := getHTag(event)
 	if groupId == "" {
-		return
+		return nil
 	}
 
 	log.Printf("[NIP-29] Deleting group: %s", groupId)
 
-	// Delete group members
-	db.ExecContext(ctx, "DELETE FROM group_members WHERE group_id = $1", groupId)
-	// Delete group bans
-	db.ExecContext(ctx, "DELETE FROM group_bans WHERE group_id = $1", groupId)
-	// Delete group metadata events
-	db.ExecContext(ctx, "DELETE FROM events WHERE kind IN ($1, $2, $3) AND d_tag = $4",
-		KindGroupMetadata, KindGroupAdmins, KindGroupMembers, groupId)
-	// Delete group chat events (with h tag matching)
-	db.ExecContext(ctx, `DELETE FROM events WHERE tags @> $1::jsonb AND kind IN ($2, $3, $4)`,
-		fmt.Sprintf(`[["h","%s"]]`, groupId), KindGroupChat, KindGroupChatReply, KindGroupChatDelete)
-	// Delete group record
-	db.ExecContext(ctx, "DELETE FROM groups WHERE id = $1", groupId)
+	var members []string
+	rows, err := tx.QueryContext(ctx, "SELECT pubkey FROM group_members WHERE group_id = $1", groupId)
+	if err != nil {
+		return fmt.Errorf("delete group: %w", err)
+	}
+	for rows.Next() {
+		var pubkey string
+		if err := rows.Scan(&pubkey); err != nil {
+			rows.Close()
+			return fmt.Errorf("delete group: %w", err)
+		}
+		members = append(members, pubkey)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("delete group: %w", err)
+	}
+
+	for _, stmt := range []struct {
+		query string
+		args  []interface{}
+	}{
+		// Group members and bans
+		{"DELETE FROM group_members WHERE group_id = $1", []interface{}{groupId}},
+		{"DELETE FROM group_bans WHERE group_id = $1", []interface{}{groupId}},
+		{"DELETE FROM group_mutes WHERE group_id = $1", []interface{}{groupId}},
+		{"DELETE FROM pending_joins WHERE group_id = $1", []interface{}{groupId}},
+		{"DELETE FROM invites WHERE group_id = $1", []interface{}{groupId}},
+		{"DELETE FROM group_pins WHERE group_id = $1", []interface{}{groupId}},
+		{"DELETE FROM group_member_lapses WHERE group_id = $1", []interface{}{groupId}},
+		// Relay events not yet generated for the group
+		{"DELETE FROM group_outbox WHERE group_id = $1", []interface{}{groupId}},
+		// Moderators' deletions in the group
+		{`DELETE FROM deletion_audit WHERE request_id IN (
+			SELECT event_id FROM event_tags WHERE tag_name = 'h' AND tag_value = $1)`, []interface{}{groupId}},
+		// Group metadata events
+		{"DELETE FROM events WHERE kind IN ($1, $2, $3, $4, $5, $6) AND d_tag = $7",
+			[]interface{}{KindGroupMetadata, KindGroupAdmins, KindGroupMembers, KindGroupRoles, KindGroupPins, KindGroupAnnouncements, groupId}},
+		// Every event of the group, whatever its kind; rows kept alongside
+		// events (reactions, read markers, calendar spans) go with them
+		{`DELETE FROM events WHERE id IN (
+			SELECT event_id FROM event_tags WHERE tag_name = 'h' AND tag_value = $1)`, []interface{}{groupId}},
+		// Group record
+		{"DELETE FROM groups WHERE id = $1", []interface{}{groupId}},
+	} {
+		if _, err := tx.ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+			return fmt.Errorf("delete group: %w", err)
+		}
+	}
+	if err := dropGroupLists(ctx, tx, members); err != nil {
+		return err
+	}
+
+	tombstone := nostr.Event{
+		Kind:    KindDeleteGroup,
+		Content: "",
+		Tags:    nostr.Tags{{"h", groupId}},
+	}
+	if err := queueGroupEvent(ctx, tx, groupId, tombstone); err != nil {
+		return fmt.Errorf("queue group tombstone: %w", err)
+	}
 
 	log.Printf("[NIP-29] Group %s deleted", groupId)
+	return nil
 }
 
 // ═══════════════════════════════════════════════════════════════════════════════
 // RELAY-SIGNED METADATA EVENT GENERATION
 // ═══════════════════════════════════════════════════════════════════════════════
 
-func generateGroupMetadata(ctx context.Context, groupId string) {
+// generateGroupMetadata publishes groupId's metadata (kind 39000). Besides
+// the NIP-29 tags it carries the group's current member count
+// (["members_count", "42"]) and creation time (["created_at", <unix>]), so
+// clients can show both without fetching 39002; d is the group id. Every
+// membership change marks the group dirty, so the count follows the
+// group_members table.
+func generateGroupMetadata(ctx context.Context, tx *sql.Tx, groupId string) error {
 	// Fetch group info from DB
 	var name, description string
 	var pictureURL sql.NullString
-	var isPublic, isOpen bool
-	err := db.QueryRowContext(ctx, `
-		SELECT name, COALESCE(description, ''), picture_url, is_public, is_open
+	var isPublic, isOpen, requireMediaLabels bool
+	var messageTTL, membersCount, maxMembers int64
+	var createdAt time.Time
+	err := tx.QueryRowContext(ctx, `
+		SELECT name, COALESCE(description, ''), picture_url, is_public, is_open, require_media_labels, message_ttl,
+			created_at, (SELECT COUNT(*) FROM group_members WHERE group_id = groups.id), max_members
 		FROM groups WHERE id = $1
-	`, groupId).Scan(&name, &description, &pictureURL, &isPublic, &isOpen)
+	`, groupId).Scan(&name, &description, &pictureURL, &isPublic, &isOpen, &requireMediaLabels, &messageTTL,
+		&createdAt, &membersCount, &maxMembers)
 	if err != nil {
-		log.Printf("[NIP-29] Error fetching group for metadata: %v", err)
-		return
+		return fmt.Errorf("fetch group for metadata: %w", err)
 	}
 
 	tags := nostr.Tags{
@@ -988,6 +2423,24 @@ func generateGroupMetadata(ctx context.Context, groupId string) {
 	if !isOpen {
 		tags = append(tags, nostr.Tag{"closed"})
 	}
+	if requireMediaLabels {
+		tags = append(tags, nostr.Tag{"require-media-labels"})
+	}
+	if messageTTL > 0 {
+		tags = append(tags, nostr.Tag{"message_ttl", strconv.FormatInt(messageTTL, 10)})
+	}
+	tags = append(tags,
+		nostr.Tag{"members_count", strconv.FormatInt(membersCount, 10)},
+		nostr.Tag{"created_at", strconv.FormatInt(createdAt.Unix(), 10)},
+	)
+	if maxMembers > 0 {
+		// The relay admin can take a group past its cap
+		remaining := max(maxMembers-membersCount, 0)
+		tags = append(tags,
+			nostr.Tag{"max_members", strconv.FormatInt(maxMembers, 10)},
+			nostr.Tag{"remaining_capacity", strconv.FormatInt(remaining, 10)},
+		)
+	}
 
 	event := nostr.Event{
 		Kind:    KindGroupMetadata,
@@ -996,23 +2449,19 @@ func generateGroupMetadata(ctx context.Context, groupId string) {
 	}
 
 	if err := signRelayEvent(&event); err != nil {
-		log.Printf("[NIP-29] Error signing group metadata: %v", err)
-		return
-	}
-	if err := persistEvent(ctx, &event); err != nil {
-		log.Printf("[NIP-29] Error storing group metadata: %v", err)
+		return fmt.Errorf("sign group metadata: %w", err)
 	}
+	return persistEventTx(ctx, tx, &event)
 }
 
-func generateGroupAdmins(ctx context.Context, groupId string) {
-	rows, err := db.QueryContext(ctx, `
+func generateGroupAdmins(ctx context.Context, tx *sql.Tx, groupId string) error {
+	rows, err := tx.QueryContext(ctx, `
 		SELECT pubkey, role FROM group_members
 		WHERE group_id = $1 AND role IN ('admin', 'moderator')
 		ORDER BY joined_at
 	`, groupId)
 	if err != nil {
-		log.Printf("[NIP-29] Error fetching group admins: %v", err)
-		return
+		return fmt.Errorf("fetch group admins: %w", err)
 	}
 	defer rows.Close()
 
@@ -1022,10 +2471,13 @@ func generateGroupAdmins(ctx context.Context, groupId string) {
 	for rows.Next() {
 		var pubkey, role string
 		if err := rows.Scan(&pubkey, &role); err != nil {
-			continue
+			return err
 		}
 		tags = append(tags, nostr.Tag{"p", pubkey, role})
 	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
 
 	event := nostr.Event{
 		Kind:    KindGroupAdmins,
@@ -1034,23 +2486,19 @@ func generateGroupAdmins(ctx context.Context, groupId string) {
 	}
 
 	if err := signRelayEvent(&event); err != nil {
-		log.Printf("[NIP-29] Error signing group admins: %v", err)
-		return
-	}
-	if err := persistEvent(ctx, &event); err != nil {
-		log.Printf("[NIP-29] Error storing group admins: %v", err)
+		return fmt.Errorf("sign group admins: %w", err)
 	}
+	return persistEventTx(ctx, tx, &event)
 }
 
-func generateGroupMembers(ctx context.Context, groupId string) {
-	rows, err := db.QueryContext(ctx, `
+func generateGroupMembers(ctx context.Context, tx *sql.Tx, groupId string) error {
+	rows, err := tx.QueryContext(ctx, `
 		SELECT pubkey FROM group_members
 		WHERE group_id = $1
 		ORDER BY joined_at
 	`, groupId)
 	if err != nil {
-		log.Printf("[NIP-29] Error fetching group members: %v", err)
-		return
+		return fmt.Errorf("fetch group members: %w", err)
 	}
 	defer rows.Close()
 
@@ -1060,10 +2508,13 @@ func generateGroupMembers(ctx context.Context, groupId string) {
 	for rows.Next() {
 		var pubkey string
 		if err := rows.Scan(&pubkey); err != nil {
-			continue
+			return err
 		}
 		tags = append(tags, nostr.Tag{"p", pubkey})
 	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
 
 	event := nostr.Event{
 		Kind:    KindGroupMembers,
@@ -1072,10 +2523,33 @@ func generateGroupMembers(ctx context.Context, groupId string) {
 	}
 
 	if err := signRelayEvent(&event); err != nil {
-		log.Printf("[NIP-29] Error signing group members: %v", err)
-		return
+		return fmt.Errorf("sign group members: %w", err)
+	}
+	return persistEventTx(ctx, tx, &event)
+}
+
+// generateGroupRoles publishes the roles of groupId (39003) for clients'
+// role pickers, each followed by its capabilities (see GROUP ROLES).
+func generateGroupRoles(ctx context.Context, tx *sql.Tx, groupId string) error {
+	tags := nostr.Tags{
+		{"d", groupId},
+	}
+	for _, role := range groupRoles {
+		tag := nostr.Tag{"role", role.name, role.description}
+		for _, capability := range role.capabilities {
+			tag = append(tag, string(capability))
+		}
+		tags = append(tags, tag)
 	}
-	if err := persistEvent(ctx, &event); err != nil {
-		log.Printf("[NIP-29] Error storing group members: %v", err)
+
+	event := nostr.Event{
+		Kind:    KindGroupRoles,
+		Content: "",
+		Tags:    tags,
+	}
+
+	if err := signRelayEvent(&event); err != nil {
+		return fmt.Errorf("sign group roles: %w", err)
 	}
+	return persistEventTx(ctx, tx, &event)
 }
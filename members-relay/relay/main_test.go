@@ -0,0 +1,1279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// tiedVersions returns two versions of one recipe with equal created_at,
+// the lowest id first.
+func tiedVersions(t *testing.T) (low, high *nostr.Event) {
+	sk := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	a := signedEvent(t, sk, KindRecipe, now, nostr.Tags{{"d", "bread"}}, "first try")
+	b := signedEvent(t, sk, KindRecipe, now, nostr.Tags{{"d", "bread"}}, "retry")
+	if a.ID > b.ID {
+		a, b = b, a
+	}
+	return a, b
+}
+
+func storedRecipeID(t *testing.T, pubkey string) string {
+	var id string
+	if err := db.QueryRowContext(context.Background(),
+		"SELECT id FROM events WHERE kind = $1 AND pubkey = $2 AND d_tag = 'bread'",
+		KindRecipe, pubkey).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestEqualTimestampKeepsLowestID(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	for _, order := range []string{"low first", "high first"} {
+		low, high := tiedVersions(t)
+		first, second := low, high
+		if order == "high first" {
+			first, second = high, low
+		}
+		for _, evt := range []*nostr.Event{first, second} {
+			if err := persistEvent(ctx, evt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := storedRecipeID(t, low.PubKey); got != low.ID {
+			t.Errorf("%s: kept %s, want lowest id %s", order, got, low.ID)
+		}
+	}
+}
+
+func TestBulkIngestEqualTimestampKeepsLowestID(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	low, high := tiedVersions(t)
+	if err := persistEvent(ctx, high); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bulkIngest(ctx, []*nostr.Event{low}); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedRecipeID(t, low.PubKey); got != low.ID {
+		t.Fatalf("kept %s, want lowest id %s", got, low.ID)
+	}
+}
+
+// An import into one community leaves another community's version of the
+// same address alone.
+func TestBulkIngestStaysInCommunity(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	fr := &community{ID: "fr", AdminPubkey: pubkeys(1)[0]}
+	withCommunities(t, fr)
+	frCtx := withCommunity(ctx, fr)
+	sk := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	newer := signedEvent(t, sk, KindRecipe, now, nostr.Tags{{"d", "soup"}}, "fr")
+	older := signedEvent(t, sk, KindRecipe, now-60, nostr.Tags{{"d", "soup"}}, "default")
+	latest := signedEvent(t, sk, KindRecipe, now+60, nostr.Tags{{"d", "soup"}}, "default, later")
+	if err := persistEvent(frCtx, newer); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := func(ctx context.Context) []string {
+		ch, _ := queryEvents(ctx, nostr.Filter{Kinds: []int{KindRecipe}, Authors: []string{newer.PubKey}})
+		var ids []string
+		for evt := range ch {
+			ids = append(ids, evt.ID)
+		}
+		return ids
+	}
+
+	// fr's newer version neither blocks an older import here, nor does a
+	// later import here replace it.
+	for _, evt := range []*nostr.Event{older, latest} {
+		if _, err := bulkIngest(ctx, []*nostr.Event{evt}); err != nil {
+			t.Fatal(err)
+		}
+		if got := stored(ctx); len(got) != 1 || got[0] != evt.ID {
+			t.Errorf("default community stores %v, want only %s", got, evt.ID)
+		}
+	}
+	if got := stored(frCtx); len(got) != 1 || got[0] != newer.ID {
+		t.Errorf("fr stores %v, want only %s", got, newer.ID)
+	}
+}
+
+func TestBulkIngestKeepsLatestReplaceable(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	stored := signedEvent(t, sk, nostr.KindProfileMetadata, now, nil, `{"name":"stored"}`)
+	older := signedEvent(t, sk, nostr.KindProfileMetadata, now-60, nil, `{"name":"older"}`)
+	newer := signedEvent(t, sk, nostr.KindProfileMetadata, now+60, nil, `{"name":"newer"}`)
+	newest := signedEvent(t, sk, nostr.KindProfileMetadata, now+120, nil, `{"name":"newest"}`)
+	if err := persistEvent(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	profiles := func() []string {
+		ch, _ := queryEvents(ctx, nostr.Filter{Kinds: []int{nostr.KindProfileMetadata}, Authors: []string{stored.PubKey}})
+		var ids []string
+		for evt := range ch {
+			ids = append(ids, evt.ID)
+		}
+		return ids
+	}
+
+	// An older import leaves the stored profile alone.
+	if _, err := bulkIngest(ctx, []*nostr.Event{older}); err != nil {
+		t.Fatal(err)
+	}
+	if got := profiles(); len(got) != 1 || got[0] != stored.ID {
+		t.Errorf("after older import: %v, want only %s", got, stored.ID)
+	}
+	// A batch with two newer versions keeps only the newest of them.
+	if _, err := bulkIngest(ctx, []*nostr.Event{newer, newest}); err != nil {
+		t.Fatal(err)
+	}
+	if got := profiles(); len(got) != 1 || got[0] != newest.ID {
+		t.Errorf("after newer import: %v, want only %s", got, newest.ID)
+	}
+}
+
+func TestOlderProfileIsRefused(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	current := signedEvent(t, sk, nostr.KindProfileMetadata, now, nil, `{"name":"current"}`)
+	if err := persistEvent(ctx, current); err != nil {
+		t.Fatal(err)
+	}
+	stale := signedEvent(t, sk, nostr.KindProfileMetadata, now-60, nil, `{"name":"stale"}`)
+	if err := persistEvent(ctx, stale); !errors.Is(err, errReplaced) || err.Error() != "replaced: have newer event" {
+		t.Fatalf("stale profile: %v", err)
+	}
+	newer := signedEvent(t, sk, nostr.KindProfileMetadata, now+1, nil, `{"name":"newer"}`)
+	if err := persistEvent(ctx, newer); err != nil {
+		t.Fatal(err)
+	}
+	query, args := buildQuery(nostr.Filter{Kinds: []int{nostr.KindProfileMetadata}, Authors: []string{newer.PubKey}})
+	got, err := fetchEvents(ctx, query, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ID != newer.ID {
+		t.Fatalf("stored profiles %v, want only %s", got, newer.ID)
+	}
+}
+
+func TestAnonymousProfileReads(t *testing.T) {
+	ctx := context.Background()
+	author := pubkeys(1)
+	if reject, msg := rejectFilterPolicy(ctx, nostr.Filter{Kinds: []int{nostr.KindProfileMetadata}, Authors: author}); reject {
+		t.Fatalf("profiles refused to anonymous readers: %s", msg)
+	}
+	if reject, _ := rejectFilterPolicy(ctx, nostr.Filter{Kinds: []int{nostr.KindProfileMetadata, nostr.KindTextNote}, Authors: author}); !reject {
+		t.Fatal("notes served to anonymous readers alongside profiles")
+	}
+}
+
+func TestRelayTimestampsAreMonotonic(t *testing.T) {
+	metadata := &nostr.Event{Kind: KindGroupMetadata, Tags: nostr.Tags{{"d", "sourdough"}}}
+	other := &nostr.Event{Kind: KindGroupMetadata, Tags: nostr.Tags{{"d", "pasta"}}}
+	first := nextRelayTimestamp(metadata)
+	second := nextRelayTimestamp(metadata)
+	if second <= first {
+		t.Fatalf("regeneration reused timestamp %d after %d", second, first)
+	}
+	if got := nextRelayTimestamp(other); got > nostr.Now() {
+		t.Fatalf("unrelated group pushed into the future: %d", got)
+	}
+}
+
+func TestHexFilterCondition(t *testing.T) {
+	full := pubkeys(1)[0]
+	for _, tc := range []struct {
+		values []string
+		cond   string
+		args   int
+	}{
+		{[]string{full}, "pubkey = ANY($4::text[])", 1},
+		{[]string{"ab12"}, "pubkey LIKE ANY($4::text[])", 1},
+		{[]string{"ab12", full, "cd"}, "(pubkey = ANY($4::text[]) OR pubkey LIKE ANY($5::text[]))", 2},
+		{[]string{"AB12", "zz", "a%", full + "0"}, "FALSE", 0},
+		{[]string{"a_", "ab12"}, "pubkey LIKE ANY($4::text[])", 1},
+	} {
+		cond, args := hexFilterCondition("pubkey", tc.values, 4)
+		if cond != tc.cond || len(args) != tc.args {
+			t.Errorf("%v: got %s with %d args, want %s with %d", tc.values, cond, len(args), tc.cond, tc.args)
+		}
+	}
+}
+
+func TestPrefixFilters(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	evt := signedEvent(t, nostr.GeneratePrivateKey(), KindRecipe, nostr.Now(), nostr.Tags{{"d", "bread"}}, "")
+	if err := persistEvent(ctx, evt); err != nil {
+		t.Fatal(err)
+	}
+	matches := func(filter nostr.Filter) int {
+		t.Helper()
+		query, args := buildQuery(filter)
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		defer rows.Close()
+		n := 0
+		for rows.Next() {
+			n++
+		}
+		return n
+	}
+	for _, tc := range []struct {
+		filter nostr.Filter
+		want   int
+	}{
+		{nostr.Filter{Authors: []string{evt.PubKey[:4]}}, 1},
+		{nostr.Filter{Authors: []string{evt.PubKey}}, 1},
+		{nostr.Filter{IDs: []string{evt.ID[:4]}}, 1},
+		{nostr.Filter{IDs: []string{pubkeys(1)[0], evt.ID[:8]}}, 1},
+		{nostr.Filter{Authors: []string{"%"}}, 0},
+		{nostr.Filter{Authors: []string{strings.ToUpper(evt.PubKey[:4])}}, 0},
+	} {
+		tc.filter.Kinds = []int{KindRecipe}
+		if got := matches(tc.filter); got != tc.want {
+			t.Errorf("%v: %d matches, want %d", tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestLargeListsBindOneArray(t *testing.T) {
+	authors := pubkeys(1000)
+	kinds := make([]int, 300)
+	for i := range kinds {
+		kinds[i] = 40000 + i
+	}
+	query, args := buildQuery(nostr.Filter{Authors: authors, Kinds: kinds})
+	if !strings.Contains(query, "pubkey = ANY($1::text[]) AND kind = ANY($2::int[])") {
+		t.Fatalf("lists not bound as arrays: %s", query)
+	}
+	// authors + kinds + community
+	if len(args) != 3 {
+		t.Fatalf("%d args for two lists", len(args))
+	}
+}
+
+func TestThousandAuthors(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	evt := signedEvent(t, nostr.GeneratePrivateKey(), KindRecipe, nostr.Now(), nostr.Tags{{"d", "bread"}}, "")
+	if err := persistEvent(ctx, evt); err != nil {
+		t.Fatal(err)
+	}
+	authors := append(pubkeys(999), evt.PubKey)
+	query, args := buildQuery(nostr.Filter{Authors: authors, Kinds: []int{KindRecipe}})
+	got, err := fetchEvents(ctx, query, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ID != evt.ID {
+		t.Fatalf("got %d events, want the one recipe", len(got))
+	}
+}
+
+func TestSinceUntilAreUnixSeconds(t *testing.T) {
+	since, until := nostr.Timestamp(1793000000), nostr.Timestamp(1793000600)
+	query, args := buildQuery(nostr.Filter{Kinds: []int{KindRecipe}, Since: &since, Until: &until})
+	if !strings.Contains(query, "created_at >= $2 AND created_at <= $3") {
+		t.Fatalf("bounds not inclusive: %s", query)
+	}
+	if args[1] != int64(since) || args[2] != int64(until) {
+		t.Fatalf("bounds %v %v, want the Unix seconds", args[1], args[2])
+	}
+}
+
+func TestSinceUntilBoundaries(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	at := nostr.Timestamp(1793000000)
+	created := map[string]nostr.Timestamp{}
+	for _, ts := range []nostr.Timestamp{at - 1, at, at + 1} {
+		evt := signedEvent(t, sk, KindRecipe, ts, nostr.Tags{{"d", fmt.Sprint(ts)}}, "")
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+		created[evt.ID] = ts
+	}
+	stamps := func(filter nostr.Filter) []nostr.Timestamp {
+		t.Helper()
+		filter.Kinds = []int{KindRecipe}
+		query, args := buildQuery(filter)
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var got []nostr.Timestamp
+		for rows.Next() {
+			var raw []byte
+			rows.Scan(&raw)
+			var evt nostr.Event
+			evt.UnmarshalJSON(raw)
+			got = append(got, created[evt.ID])
+		}
+		return got
+	}
+	if got := stamps(nostr.Filter{Since: &at, Until: &at}); len(got) != 1 || got[0] != at {
+		t.Fatalf("since = until = %d: %v", at, got)
+	}
+	if got := stamps(nostr.Filter{Since: &at}); len(got) != 2 || got[0] != at+1 || got[1] != at {
+		t.Fatalf("since %d: %v", at, got)
+	}
+	if got := stamps(nostr.Filter{Until: &at}); len(got) != 2 || got[0] != at || got[1] != at-1 {
+		t.Fatalf("until %d: %v", at, got)
+	}
+
+	var stored int64
+	if err := db.QueryRowContext(ctx, "SELECT created_at FROM events WHERE d_tag = $1", fmt.Sprint(at)).Scan(&stored); err != nil || stored != int64(at) {
+		t.Fatalf("stored created_at %d (%v), want %d", stored, err, at)
+	}
+}
+
+func TestBuildBatchQuery(t *testing.T) {
+	filter := nostr.Filter{Kinds: []int{KindRecipe}, Limit: 250}
+	first, _ := buildBatchQuery(filter, nil, "", false, 0, 100)
+	third, _ := buildBatchQuery(filter, nil, "", false, 200, 50)
+	if !strings.HasSuffix(first, "ORDER BY created_at DESC, id LIMIT 100") {
+		t.Fatalf("first batch: %s", first)
+	}
+	if !strings.HasSuffix(third, "ORDER BY created_at DESC, id LIMIT 50 OFFSET 200") {
+		t.Fatalf("third batch: %s", third)
+	}
+}
+
+func TestIDLookup(t *testing.T) {
+	ids := pubkeys(3)
+	for _, tc := range []struct {
+		filter nostr.Filter
+		want   bool
+	}{
+		{nostr.Filter{IDs: ids}, true},
+		{nostr.Filter{IDs: ids, Limit: 3}, true},
+		{nostr.Filter{IDs: ids, Limit: 1}, false},
+		{nostr.Filter{IDs: []string{ids[0][:8]}}, false},
+		{nostr.Filter{IDs: ids, Kinds: []int{KindGroupChat}}, false},
+		{nostr.Filter{IDs: ids, Tags: nostr.TagMap{"h": {"bakers"}}}, false},
+		{nostr.Filter{Authors: ids}, false},
+	} {
+		if got := isIDLookup(tc.filter); got != tc.want {
+			t.Errorf("%v: id lookup %v, want %v", tc.filter, got, tc.want)
+		}
+	}
+	query, _ := buildIDQuery(nostr.Filter{IDs: ids}, nil, pubkeys(4)[3], false)
+	if !strings.Contains(query, "WHERE id = ANY($1::text[])") || strings.Contains(query, "ORDER BY") || strings.Contains(query, "LIMIT") {
+		t.Fatalf("id lookup: %s", query)
+	}
+	if !strings.Contains(query, "group_members") {
+		t.Fatalf("id lookup skips group scope: %s", query)
+	}
+}
+
+func TestLatestLookup(t *testing.T) {
+	authors := pubkeys(2)
+	for _, tc := range []struct {
+		filter nostr.Filter
+		want   bool
+	}{
+		{nostr.Filter{Kinds: []int{KindSimpleGroups}, Authors: authors}, true},
+		{nostr.Filter{Kinds: []int{0, KindSimpleGroups}, Authors: authors, Limit: 4}, true},
+		{nostr.Filter{Kinds: []int{KindSimpleGroups}, Authors: authors, Limit: 1}, false},
+		{nostr.Filter{Kinds: []int{KindSimpleGroups}, Authors: []string{authors[0][:8]}}, false},
+		{nostr.Filter{Kinds: []int{KindSimpleGroups, KindGroupChat}, Authors: authors}, false},
+		{nostr.Filter{Kinds: []int{KindSimpleGroups}, Authors: authors, Tags: nostr.TagMap{"d": {"x"}}}, false},
+		{nostr.Filter{Kinds: []int{KindSimpleGroups}}, false},
+	} {
+		if got := isLatestLookup(tc.filter); got != tc.want {
+			t.Errorf("%v: latest lookup %v, want %v", tc.filter, got, tc.want)
+		}
+	}
+	query, _ := buildIDQuery(nostr.Filter{Kinds: []int{KindSimpleGroups}, Authors: authors}, nil, "", false)
+	if !strings.HasPrefix(query, "SELECT DISTINCT ON (kind, pubkey) raw FROM events") ||
+		!strings.HasSuffix(query, "ORDER BY kind, pubkey, created_at DESC, id") {
+		t.Fatalf("latest lookup: %s", query)
+	}
+}
+
+func TestLookupMoreIDsThanMaxLimit(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	events := make([]*nostr.Event, 600)
+	ids := make([]string, len(events))
+	for i := range events {
+		events[i] = signedEvent(t, sk, 1, nostr.Now()-nostr.Timestamp(i), nil, fmt.Sprint(i))
+		ids[i] = events[i].ID
+	}
+	if _, err := bulkIngest(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := queryEvents(ctx, nostr.Filter{IDs: ids})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for evt := range ch {
+		found[evt.ID] = true
+	}
+	if len(found) != len(ids) {
+		t.Fatalf("found %d of %d ids", len(found), len(ids))
+	}
+}
+
+func TestQueryReleasesConnectionWhenAbandoned(t *testing.T) {
+	openTestDB(t)
+	sk := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	var ids []string
+	for i := 0; i < queryBatchSize+queryBatchSize/2; i++ {
+		evt := signedEvent(t, sk, KindRecipe, now-nostr.Timestamp(i), nostr.Tags{{"d", fmt.Sprint(i)}}, "")
+		if err := persistEvent(context.Background(), evt); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, evt.ID)
+	}
+
+	// A client that reads everything gets every event, in order.
+	ch, _ := queryEvents(context.Background(), nostr.Filter{Kinds: []int{KindRecipe}})
+	n := 0
+	for evt := range ch {
+		if evt.ID != ids[n] {
+			t.Fatalf("event %d out of order", n)
+		}
+		n++
+	}
+	if n != len(ids) {
+		t.Fatalf("%d events across batches, want %d", n, len(ids))
+	}
+
+	// One that leaves after the first event stops the query at once.
+	abandoned := queriesAbandoned.Value()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, _ = queryEvents(ctx, nostr.Filter{Kinds: []int{KindRecipe}})
+	<-ch
+	cancel()
+	for range ch {
+	}
+	if inUse := db.Stats().InUse; inUse != 0 {
+		t.Fatalf("%d connections still in use", inUse)
+	}
+	if queriesAbandoned.Value() != abandoned+1 {
+		t.Fatal("abandoned query not counted")
+	}
+}
+
+func TestQueryTimeoutAndSlowLog(t *testing.T) {
+	openTestDB(t)
+	evt := signedEvent(t, nostr.GeneratePrivateKey(), KindRecipe, nostr.Now(), nostr.Tags{{"d", "bread"}}, "")
+	if err := persistEvent(context.Background(), evt); err != nil {
+		t.Fatal(err)
+	}
+	prev := queryCfg
+	t.Cleanup(func() { queryCfg = prev })
+	var logged strings.Builder
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	drain := func() int {
+		ch, _ := queryEvents(context.Background(), nostr.Filter{Kinds: []int{KindRecipe}, Tags: nostr.TagMap{"d": {"bread"}}})
+		n := 0
+		for range ch {
+			n++
+		}
+		return n
+	}
+
+	queryCfg = queryConfig{Timeout: time.Nanosecond, Slow: time.Hour}
+	timedOut := queriesTimedOut.Value()
+	if n := drain(); n != 0 {
+		t.Fatalf("%d events past the deadline", n)
+	}
+	if queriesTimedOut.Value() != timedOut+1 || !strings.Contains(logged.String(), "[query] Timed out") {
+		t.Fatalf("timeout not reported: %q", logged.String())
+	}
+	if inUse := db.Stats().InUse; inUse != 0 {
+		t.Fatalf("%d connections still in use", inUse)
+	}
+
+	queryCfg = queryConfig{Timeout: time.Minute, Slow: 0}
+	if n := drain(); n != 1 {
+		t.Fatalf("%d events, want 1", n)
+	}
+	if !strings.Contains(logged.String(), `[query] Slow query`) || !strings.Contains(logged.String(), `"#d":["bread"]`) {
+		t.Fatalf("slow query not logged with its filter: %q", logged.String())
+	}
+}
+
+func TestBuildSecondQuery(t *testing.T) {
+	last := &nostr.Event{ID: strings.Repeat("c", 64), CreatedAt: 1793000000}
+	query, args := buildSecondQuery(nostr.Filter{Kinds: []int{KindJoinRequest}, Limit: 50}, nil, "", false, last)
+	if !strings.Contains(query, "AND created_at = $3 AND id > $4 ORDER BY id LIMIT 500") {
+		t.Fatalf("second query: %s", query)
+	}
+	if args[2] != int64(last.CreatedAt) || args[3] != last.ID {
+		t.Fatalf("args %v", args)
+	}
+}
+
+func TestPagingThroughOneSecond(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	at := nostr.Timestamp(1793000000)
+	all := map[string]bool{}
+	store := func(n int, ts nostr.Timestamp) {
+		for i := 0; i < n; i++ {
+			evt := signedEvent(t, sk, KindRecipe, ts, nostr.Tags{{"d", fmt.Sprint(ts, "-", i)}}, "")
+			if err := persistEvent(ctx, evt); err != nil {
+				t.Fatal(err)
+			}
+			all[evt.ID] = true
+		}
+	}
+	store(10, at+1)
+	store(200, at)
+	store(30, at-1)
+
+	seen := map[string]bool{}
+	var until *nostr.Timestamp
+	for page := 0; len(seen) < len(all); page++ {
+		if page > 10 {
+			t.Fatalf("no progress after %d pages (%d of %d events)", page, len(seen), len(all))
+		}
+		ch, _ := queryEvents(ctx, nostr.Filter{Kinds: []int{KindRecipe}, Until: until, Limit: 50})
+		var oldest *nostr.Event
+		for evt := range ch {
+			if seen[evt.ID] {
+				t.Fatalf("page %d repeats %s", page, evt.ID)
+			}
+			seen[evt.ID] = true
+			oldest = evt
+		}
+		if oldest == nil {
+			break
+		}
+		next := oldest.CreatedAt - 1
+		until = &next
+	}
+	if len(seen) != len(all) {
+		t.Fatalf("paged through %d of %d events", len(seen), len(all))
+	}
+}
+
+func TestBatchQueryOrderIsTotal(t *testing.T) {
+	query, _ := buildBatchQuery(nostr.Filter{Kinds: []int{1, KindRecipe}}, nil, "", false, 0, 10)
+	if !strings.HasSuffix(query, "ORDER BY created_at DESC, id LIMIT 10") {
+		t.Fatalf("ties not broken by id: %s", query)
+	}
+}
+
+func TestSameFilterSameOrder(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	at := nostr.Timestamp(1794000000)
+	var want []string
+	for i := 0; i < 20; i++ {
+		note := signedEvent(t, sk, 1, at, nostr.Tags{{"t", "sourdough"}}, fmt.Sprint("crumb ", i))
+		recipe := signedEvent(t, sk, KindRecipe, at, nostr.Tags{{"d", fmt.Sprint("loaf-", i)}, {"t", "sourdough"}}, "")
+		for _, evt := range []*nostr.Event{note, recipe} {
+			if err := persistEvent(ctx, evt); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, evt.ID)
+		}
+	}
+	// An older version of a recipe must not shift its successors.
+	stale := signedEvent(t, sk, KindRecipe, at-1, nostr.Tags{{"d", "loaf-0"}, {"t", "sourdough"}}, "")
+	if err := persistEvent(ctx, stale); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(want)
+
+	filter := nostr.Filter{Kinds: []int{1, KindRecipe}, Authors: []string{stale.PubKey}, Tags: nostr.TagMap{"t": {"sourdough"}}}
+	run := func() []string {
+		t.Helper()
+		ch, err := queryEvents(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for evt := range ch {
+			ids = append(ids, evt.ID)
+		}
+		return ids
+	}
+	first, second := run(), run()
+	if !slices.Equal(first, want) {
+		t.Fatalf("got %v, want ascending ids %v", first, want)
+	}
+	if !slices.Equal(first, second) {
+		t.Fatalf("order changed between runs:\n%v\n%v", first, second)
+	}
+}
+
+func TestContainsGroupKinds(t *testing.T) {
+	for _, tc := range []struct {
+		kinds []int
+		want  bool
+	}{
+		{nil, true},
+		{[]int{}, true},
+		{[]int{KindRecipe}, false},
+		{[]int{KindRecipe, KindGroupChat}, true},
+		{[]int{1, KindRemoveUser}, true},
+	} {
+		if got := containsGroupKinds(tc.kinds); got != tc.want {
+			t.Errorf("containsGroupKinds(%v) = %v", tc.kinds, got)
+		}
+	}
+}
+
+func TestConcurrentRegenerationsLeaveOneVersion(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK := nostr.GeneratePrivateKey()
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, nostr.Now(), nostr.Tags{{"h", "rye"}}, ""))
+
+	// Regenerations that skip the group lock, as two relay versions might.
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer tx.Rollback()
+			if err := generateGroupMembers(ctx, tx, "rye"); err != nil {
+				errs <- err
+				return
+			}
+			errs <- tx.Commit()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ch, _ := queryEvents(ctx, nostr.Filter{Kinds: []int{KindGroupMembers}, Tags: nostr.TagMap{"d": {"rye"}}})
+	var got []*nostr.Event
+	for evt := range ch {
+		got = append(got, evt)
+	}
+	if len(got) != 1 {
+		t.Fatalf("%d versions of the group's 39002, want 1", len(got))
+	}
+}
+
+func TestChatBackfillReturnsNewestWhateverThePlan(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	member := pubkeys(1)[0]
+	if _, err := db.ExecContext(ctx, "INSERT INTO group_members (group_id, pubkey, role) VALUES ('dessert-club', $1, 'member')", member); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1,000 messages stored in shuffled order, a few sharing a second, next
+	// to another group's newer chatter.
+	sk := nostr.GeneratePrivateKey()
+	at := nostr.Timestamp(1795000000)
+	var corpus []*nostr.Event
+	var ours []*nostr.Event
+	for i := 0; i < 1000; i++ {
+		kind := KindGroupChat
+		if i%3 == 0 {
+			kind = KindGroupChatReply
+		}
+		ts := at + nostr.Timestamp(i)
+		if i%7 == 6 {
+			ts--
+		}
+		evt := signedEvent(t, sk, kind, ts, nostr.Tags{{"h", "dessert-club"}}, fmt.Sprint("message ", i))
+		corpus = append(corpus, evt)
+		ours = append(ours, evt)
+		if i%10 == 0 {
+			corpus = append(corpus, signedEvent(t, sk, KindGroupChat, at+2000, nostr.Tags{{"h", "bread-club"}}, fmt.Sprint("elsewhere ", i)))
+		}
+	}
+	rand.New(rand.NewSource(1)).Shuffle(len(corpus), func(i, j int) { corpus[i], corpus[j] = corpus[j], corpus[i] })
+	if _, err := bulkIngest(ctx, corpus); err != nil {
+		t.Fatal(err)
+	}
+	db.ExecContext(ctx, "ANALYZE events")
+	db.ExecContext(ctx, "ANALYZE event_tags")
+
+	slices.SortFunc(ours, func(a, b *nostr.Event) int {
+		if a.CreatedAt != b.CreatedAt {
+			return int(b.CreatedAt - a.CreatedAt)
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	var want []string
+	for _, evt := range ours[:50] {
+		want = append(want, evt.ID)
+	}
+
+	filter := nostr.Filter{Kinds: []int{KindGroupChat, KindGroupChatReply}, Tags: nostr.TagMap{"h": {"dessert-club"}}, Limit: 50}
+	query, args := buildViewerQuery(filter, nil, member, false)
+	for _, plan := range []string{
+		"",
+		"SET LOCAL enable_indexscan = off; SET LOCAL enable_bitmapscan = off",
+		"SET LOCAL enable_seqscan = off; SET LOCAL enable_sort = off",
+		"SET LOCAL enable_hashjoin = off; SET LOCAL enable_mergejoin = off",
+	} {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan != "" {
+			if _, err := tx.ExecContext(ctx, plan); err != nil {
+				tx.Rollback()
+				t.Fatal(err)
+			}
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+		var got []string
+		for rows.Next() {
+			var raw []byte
+			var evt nostr.Event
+			if err := rows.Scan(&raw); err != nil || json.Unmarshal(raw, &evt) != nil {
+				t.Fatalf("bad row: %v", err)
+			}
+			got = append(got, evt.ID)
+		}
+		rows.Close()
+		tx.Rollback()
+		if !slices.Equal(got, want) {
+			t.Fatalf("plan %q: got %d events, not the newest 50 in order", plan, len(got))
+		}
+	}
+}
+
+func TestStrangerCannotRebroadcastProtected(t *testing.T) {
+	rl := khatru.NewRelay()
+	rl.RejectEvent = append(rl.RejectEvent, rejectEventPolicy)
+	url := startTestRelay(t, rl, testServerConfig(true))
+
+	publish := func(sk string, event *nostr.Event) *nostr.OKEnvelope {
+		t.Helper()
+		c := dialTestRelay(t, url)
+		challenge := c.challenge()
+		if sk != "" && !c.auth(url, challenge, sk) {
+			t.Fatal("AUTH refused")
+		}
+		raw, _ := nostr.EventEnvelope{Event: *event}.MarshalJSON()
+		c.send(string(raw))
+		return c.next(func(env nostr.Envelope) bool {
+			ok, isOK := env.(*nostr.OKEnvelope)
+			return isOK && ok.EventID == event.ID
+		}).(*nostr.OKEnvelope)
+	}
+
+	draft := signedEvent(t, nostr.GeneratePrivateKey(), KindRecipe, nostr.Now(), nostr.Tags{{"d", "draft"}, {"-"}}, "")
+	// khatru answers before the policy, in its own words.
+	if ok := publish(nostr.GeneratePrivateKey(), draft); ok.OK || ok.Reason != "blocked: must be published by event author" {
+		t.Errorf("stranger's rebroadcast: %v %q", ok.OK, ok.Reason)
+	}
+	if ok := publish("", draft); ok.OK || !strings.HasPrefix(ok.Reason, "auth-required:") {
+		t.Errorf("anonymous rebroadcast: %v %q", ok.OK, ok.Reason)
+	}
+
+	if reject, msg := rejectEventPolicy(context.Background(), draft); !reject || msg != "blocked: event marked as protected" {
+		t.Errorf("policy on a copy not from the author: %v %q", reject, msg)
+	}
+}
+
+func TestBulkIngestKeepsProtected(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	draft := signedEvent(t, nostr.GeneratePrivateKey(), KindRecipe, nostr.Now(), nostr.Tags{{"d", "draft"}, {"-"}}, "")
+	if _, err := bulkIngest(ctx, []*nostr.Event{draft}); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := storedEvent(ctx, draft.ID); stored == nil {
+		t.Fatal("protected event not restored from backup")
+	}
+}
+
+func TestEphemeralEventsAreOnlyBroadcast(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	rl := khatru.NewRelay()
+	rl.QueryEvents = append(rl.QueryEvents, queryEvents)
+	rl.StoreEvent = append(rl.StoreEvent, storeEvent)
+	rl.RejectEvent = append(rl.RejectEvent, rejectEventPolicy)
+	rl.RejectFilter = append(rl.RejectFilter, rejectFilterPolicy)
+	url := startTestRelay(t, rl, testServerConfig(true))
+
+	connect := func(sk string) *wsTestClient {
+		t.Helper()
+		pk, _ := nostr.GetPublicKey(sk)
+		addTestMember(t, pk)
+		c := dialTestRelay(t, url)
+		if !c.auth(url, c.challenge(), sk) {
+			t.Fatal("AUTH refused")
+		}
+		return c
+	}
+	storedRows := func() int {
+		t.Helper()
+		var n int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM events").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	typingSK := nostr.GeneratePrivateKey()
+	watcher, typist := connect(nostr.GeneratePrivateKey()), connect(typingSK)
+	if got := watcher.req("typing", `{"kinds":[20001]}`); got != "EOSE" {
+		t.Fatalf("REQ for ephemeral kinds: %s", got)
+	}
+	before := storedRows()
+
+	typing := signedEvent(t, typingSK, 20001, nostr.Now(), nil, "")
+	raw, _ := nostr.EventEnvelope{Event: *typing}.MarshalJSON()
+	typist.send(string(raw))
+	if ok := typist.next(func(env nostr.Envelope) bool {
+		ok, isOK := env.(*nostr.OKEnvelope)
+		return isOK && ok.EventID == typing.ID
+	}).(*nostr.OKEnvelope); !ok.OK {
+		t.Fatalf("ephemeral event refused: %s", ok.Reason)
+	}
+	watcher.next(func(env nostr.Envelope) bool {
+		evt, isEvent := env.(*nostr.EventEnvelope)
+		return isEvent && evt.Event.ID == typing.ID
+	})
+
+	if err := persistEvent(ctx, typing); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bulkIngest(ctx, []*nostr.Event{typing}); err != nil {
+		t.Fatal(err)
+	}
+	if after := storedRows(); after != before {
+		t.Fatalf("%d events stored before the ephemeral event, %d after", before, after)
+	}
+}
+
+func TestRelayPubkeyRefused(t *testing.T) {
+	withRelayKey(t)
+	ctx := context.Background()
+	putUser := signedEvent(t, relayPrivateKey, KindPutUser, nostr.Now(),
+		nostr.Tags{{"h", "bakers"}, {"p", pubkeys(1)[0], "admin"}}, "")
+	if reject, msg := rejectEventPolicy(ctx, putUser); !reject || msg != "restricted: relay-internal pubkey" {
+		t.Fatalf("relay-signed put-user from a client: %v %q", reject, msg)
+	}
+}
+
+func TestRelaySignedEventsHaveNoSideEffects(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "INSERT INTO groups (id, name) VALUES ('bakers', 'Bakers')"); err != nil {
+		t.Fatal(err)
+	}
+	intruder := pubkeys(1)[0]
+	putUser := signedEvent(t, relayPrivateKey, KindPutUser, nostr.Now(),
+		nostr.Tags{{"h", "bakers"}, {"p", intruder, "admin"}}, "")
+	if err := storeGroupEvent(ctx, putUser); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM group_members WHERE group_id = 'bakers'").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("relay-signed put-user added %d member(s)", n)
+	}
+}
+
+// An admin's put-user and remove-user are confirmed by relay-signed
+// copies pointing back at them, which change nothing again.
+func TestAdminMembershipConfirmations(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK := nostr.GeneratePrivateKey()
+	keys := pubkeys(2)
+	for _, pk := range keys {
+		addTestMember(t, pk)
+	}
+	now := nostr.Now()
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, nostr.Tags{{"h", "bakers"}}, ""))
+	put := signedEvent(t, adminSK, KindPutUser, now+1, nostr.Tags{{"h", "bakers"}, {"p", keys[0]}, {"p", keys[1], "moderator"}}, "")
+	applyGroupEvent(t, put)
+	remove := signedEvent(t, adminSK, KindRemoveUser, now+2, nostr.Tags{{"h", "bakers"}, {"p", keys[0]}}, "")
+	applyGroupEvent(t, remove)
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	confirmation := func(kind int, cause *nostr.Event) *nostr.Event {
+		t.Helper()
+		var raw []byte
+		err := db.QueryRowContext(ctx, `
+			SELECT e.raw FROM events e JOIN event_tags t ON t.event_id = e.id AND t.tag_name = 'e' AND t.tag_value = $3
+			WHERE e.kind = $1 AND e.pubkey = $2
+		`, kind, relaySigningPubkey, cause.ID).Scan(&raw)
+		if err != nil {
+			t.Fatalf("no relay-signed kind %d for %s: %v", kind, cause.ID, err)
+		}
+		var event nostr.Event
+		if err := json.Unmarshal(raw, &event); err != nil {
+			t.Fatal(err)
+		}
+		return &event
+	}
+	if got := taggedMembers(confirmation(KindPutUser, put).Tags); !reflect.DeepEqual(got, map[string]string{keys[0]: "member", keys[1]: "moderator"}) {
+		t.Fatalf("put-user confirmation names %v", got)
+	}
+	if got := taggedMembers(confirmation(KindRemoveUser, remove).Tags); !reflect.DeepEqual(got, map[string]string{keys[0]: ""}) {
+		t.Fatalf("remove-user confirmation names %v", got)
+	}
+	if isGroupMember(ctx, "bakers", keys[0]) || !isGroupMember(ctx, "bakers", keys[1]) {
+		t.Fatal("confirmations were applied as changes")
+	}
+	var queued int
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM group_outbox").Scan(&queued)
+	if queued != 0 {
+		t.Fatalf("%d events queued by the confirmations", queued)
+	}
+}
+
+// A put-user adds the relay members among its targets and reports the
+// others, unless the relay takes guests.
+func TestPutUserSkipsNonMembers(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK := nostr.GeneratePrivateKey()
+	keys := pubkeys(4)
+	members, outsiders := keys[:2], keys[2:]
+	for _, pk := range members {
+		addTestMember(t, pk)
+	}
+	now := nostr.Now()
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, nostr.Tags{{"h", "club"}}, ""))
+	putAll := func(groupId string) error {
+		tags := nostr.Tags{{"h", groupId}}
+		for _, pk := range keys {
+			tags = append(tags, nostr.Tag{"p", pk})
+		}
+		return storeEvent(ctx, signedEvent(t, adminSK, KindPutUser, now+1, tags, ""))
+	}
+
+	want := "restricted: not added, not relay members: " + strings.Join(outsiders, ", ")
+	if err := putAll("club"); err == nil || err.Error() != want {
+		t.Fatalf("mixed put-user: %v, want %q", err, want)
+	}
+	for _, pk := range members {
+		if !isGroupMember(ctx, "club", pk) {
+			t.Fatalf("member %s not added", pk)
+		}
+	}
+	for _, pk := range outsiders {
+		if isGroupMember(ctx, "club", pk) {
+			t.Fatalf("non-member %s added", pk)
+		}
+	}
+
+	prev := groupGuestsAllowed
+	groupGuestsAllowed = true
+	t.Cleanup(func() { groupGuestsAllowed = prev })
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, nostr.Tags{{"h", "open-house"}}, ""))
+	if err := putAll("open-house"); err != nil {
+		t.Fatalf("put-user with guests allowed: %v", err)
+	}
+	for _, pk := range keys {
+		if !isGroupMember(ctx, "open-house", pk) {
+			t.Fatalf("guest %s not added", pk)
+		}
+	}
+}
+
+// 39000 carries the member count and creation time, and follows every
+// membership change.
+func TestGroupMetadataMembersCount(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK, joinerSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	keys := pubkeys(2)
+	for _, pk := range keys {
+		addTestMember(t, pk)
+	}
+	now := nostr.Now()
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, nostr.Tags{{"h", "bakers"}}, ""))
+	applyGroupEvent(t, signedEvent(t, adminSK, KindPutGroupStatus, now, nostr.Tags{{"h", "bakers"}, {"open"}}, ""))
+	var created time.Time
+	if err := db.QueryRowContext(ctx, "SELECT created_at FROM groups WHERE id = 'bakers'").Scan(&created); err != nil {
+		t.Fatal(err)
+	}
+	metadata := func() (count, createdAt string) {
+		t.Helper()
+		if err := syncGroups(ctx); err != nil {
+			t.Fatal(err)
+		}
+		event, err := currentRelayEvent(ctx, KindGroupMetadata, "bakers")
+		if err != nil || event == nil {
+			t.Fatalf("39000: %v %v", event, err)
+		}
+		if d := event.Tags.GetD(); d != "bakers" {
+			t.Fatalf("39000 d tag %q", d)
+		}
+		if tag := event.Tags.GetFirst([]string{"members_count", ""}); tag != nil {
+			count = (*tag)[1]
+		}
+		if tag := event.Tags.GetFirst([]string{"created_at", ""}); tag != nil {
+			createdAt = (*tag)[1]
+		}
+		return count, createdAt
+	}
+
+	if count, createdAt := metadata(); count != "1" || createdAt != strconv.FormatInt(created.Unix(), 10) {
+		t.Fatalf("new group: members_count %q, created_at %q", count, createdAt)
+	}
+	applyGroupEvent(t, signedEvent(t, adminSK, KindPutUser, now+1, nostr.Tags{{"h", "bakers"}, {"p", keys[0]}, {"p", keys[1]}}, ""))
+	applyGroupEvent(t, signedEvent(t, joinerSK, KindJoinRequest, now+1, nostr.Tags{{"h", "bakers"}}, ""))
+	if count, _ := metadata(); count != "4" {
+		t.Fatalf("after put-user and join: members_count %q", count)
+	}
+	applyGroupEvent(t, signedEvent(t, adminSK, KindRemoveUser, now+2, nostr.Tags{{"h", "bakers"}, {"p", keys[0]}}, ""))
+	applyGroupEvent(t, signedEvent(t, joinerSK, KindLeaveRequest, now+2, nostr.Tags{{"h", "bakers"}}, ""))
+	if count, _ := metadata(); count != "2" {
+		t.Fatalf("after remove-user and leave: members_count %q", count)
+	}
+
+	applyGroupEvent(t, signedEvent(t, adminSK, KindDeleteGroup, now+3, nostr.Tags{{"h", "bakers"}}, ""))
+	if event, _ := currentRelayEvent(ctx, KindGroupMetadata, "bakers"); event != nil {
+		t.Fatal("39000 left behind by the group's deletion")
+	}
+}
+
+func TestGroupStatus(t *testing.T) {
+	yes, no := true, false
+	for _, tc := range []struct {
+		tags         nostr.Tags
+		public, open *bool
+	}{
+		{nostr.Tags{{"h", "g"}, {"public"}}, &yes, nil},
+		{nostr.Tags{{"h", "g"}, {"private"}}, &no, nil},
+		{nostr.Tags{{"h", "g"}, {"open"}}, nil, &yes},
+		{nostr.Tags{{"h", "g"}, {"closed"}}, nil, &no},
+		{nostr.Tags{{"h", "g"}, {"public"}, {"closed"}}, &yes, &no},
+		{nostr.Tags{{"h", "g"}, {"public"}, {"private"}}, &no, nil},
+		{nostr.Tags{{"h", "g"}, {"closed"}, {"open"}}, nil, &yes},
+		{nostr.Tags{{"h", "g"}}, nil, nil},
+	} {
+		public, open := groupStatus(tc.tags)
+		same := func(a, b *bool) bool { return (a == nil) == (b == nil) && (a == nil || *a == *b) }
+		if !same(public, tc.public) || !same(open, tc.open) {
+			t.Errorf("%v: public %v open %v", tc.tags, public, open)
+		}
+	}
+}
+
+func TestPutGroupStatus(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, nostr.Tags{{"h", "sourdough"}}, ""))
+	status := func() (public, open bool) {
+		t.Helper()
+		if err := db.QueryRowContext(ctx, "SELECT is_public, is_open FROM groups WHERE id = 'sourdough'").Scan(&public, &open); err != nil {
+			t.Fatal(err)
+		}
+		return public, open
+	}
+
+	for i, tc := range []struct {
+		tags         nostr.Tags
+		public, open bool
+	}{
+		{nostr.Tags{{"public"}}, true, false},
+		{nostr.Tags{{"open"}}, true, true},
+		{nostr.Tags{{"private"}}, false, true},
+		{nostr.Tags{{"closed"}}, false, false},
+		{nostr.Tags{{"public"}, {"open"}, {"closed"}}, true, false},
+	} {
+		tags := append(nostr.Tags{{"h", "sourdough"}}, tc.tags...)
+		applyGroupEvent(t, signedEvent(t, adminSK, KindPutGroupStatus, now+nostr.Timestamp(i+1), tags, ""))
+		if public, open := status(); public != tc.public || open != tc.open {
+			t.Errorf("after %v: public %v open %v", tc.tags, public, open)
+		}
+	}
+
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	metadata, _ := currentRelayEvent(ctx, KindGroupMetadata, "sourdough")
+	if metadata == nil || metadata.Tags.GetFirst([]string{"private"}) != nil || metadata.Tags.GetFirst([]string{"closed"}) == nil {
+		t.Fatalf("39000 not regenerated with the new status: %v", metadata)
+	}
+}
+
+func TestChatRequiresGroupMembership(t *testing.T) {
+	openTestDB(t)
+	savedAdmin := adminPubkey
+	defer func() { adminPubkey = savedAdmin }()
+	ctx := context.Background()
+	keys := map[string]string{}
+	for _, name := range []string{"insider", "removed", "stranger", "admin"} {
+		keys[name] = nostr.GeneratePrivateKey()
+	}
+	pk := func(name string) string { p, _ := nostr.GetPublicKey(keys[name]); return p }
+	adminPubkey = pk("admin")
+	for _, name := range []string{"insider", "removed", "stranger"} {
+		addTestMember(t, pk(name))
+	}
+	for _, stmt := range []string{
+		"INSERT INTO groups (id, name) VALUES ('bakers', 'Bakers')",
+		"INSERT INTO group_members (group_id, pubkey) VALUES ('bakers', '" + pk("insider") + "'), ('bakers', '" + pk("removed") + "')",
+		"DELETE FROM group_members WHERE pubkey = '" + pk("removed") + "'",
+	} {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name, group, want string
+	}{
+		{"insider", "bakers", ""},
+		{"admin", "bakers", ""},
+		{"removed", "bakers", "restricted: not a member of this group"},
+		{"stranger", "bakers", "restricted: not a member of this group"},
+		{"insider", "", "invalid: missing h tag"},
+		{"insider", "brewers", "invalid: group does not exist"},
+	} {
+		var tags nostr.Tags
+		if tc.group != "" {
+			tags = nostr.Tags{{"h", tc.group}}
+		}
+		for _, kind := range []int{KindGroupChat, KindGroupChatReply} {
+			authed := context.WithValue(ctx, nip98ViewerKey{}, pk(tc.name))
+			_, msg := rejectEventPolicy(authed, signedEvent(t, keys[tc.name], kind, nostr.Now(), tags, "proofing now"))
+			if msg != tc.want {
+				t.Errorf("%s posting kind %d to %q: %q, want %q", tc.name, kind, tc.group, msg, tc.want)
+			}
+		}
+	}
+}
+
+// Deleting a group leaves nothing of it but the relay's tombstone.
+func TestDeleteGroupRemovesAllItsEvents(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK, memberSK, trollSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	member, _ := nostr.GetPublicKey(memberSK)
+	now := nostr.Now()
+	h := nostr.Tags{{"h", "crumbs"}}
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, h, ""))
+	applyGroupEvent(t, signedEvent(t, adminSK, KindCreateInvite, now, append(nostr.Tags{{"code", "levain"}}, h...), ""))
+	applyGroupEvent(t, signedEvent(t, memberSK, KindJoinRequest, now, append(nostr.Tags{{"code", "levain"}}, h...), ""))
+	applyGroupEvent(t, signedEvent(t, trollSK, KindJoinRequest, now, h, ""))
+	chat := signedEvent(t, memberSK, KindGroupChat, now, h, "crumb shot")
+	spam := signedEvent(t, memberSK, KindGroupChat, now, h, "spam")
+	recipe := signedEvent(t, memberSK, KindRecipe, now, append(nostr.Tags{{"d", "rye"}}, h...), "draft")
+	for _, evt := range []*nostr.Event{chat, spam, recipe} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	applyGroupEvent(t, signedEvent(t, adminSK, KindPinEvents, now, append(nostr.Tags{{"e", chat.ID}}, h...), ""))
+	applyGroupEvent(t, signedEvent(t, adminSK, KindMuteUser, now, append(nostr.Tags{{"p", member}, {"duration", "10"}}, h...), ""))
+	applyGroupEvent(t, signedEvent(t, adminSK, KindDeleteEvent, now, append(nostr.Tags{{"e", spam.ID}}, h...), ""))
+	applyGroupEvent(t, signedEvent(t, memberSK, KindLeaveRequest, now+1, h, ""))
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	applyGroupEvent(t, signedEvent(t, adminSK, KindDeleteGroup, now+2, h, ""))
+	if err := syncGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT kind, pubkey FROM events
+		WHERE d_tag = 'crumbs' OR id IN (SELECT event_id FROM event_tags WHERE tag_name = 'h' AND tag_value = 'crumbs')
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var left []int
+	tombstones := 0
+	for rows.Next() {
+		var kind int
+		var pubkey string
+		rows.Scan(&kind, &pubkey)
+		if kind == KindDeleteGroup && pubkey == relaySigningPubkey {
+			tombstones++
+		} else {
+			left = append(left, kind)
+		}
+	}
+	if len(left) != 0 || tombstones != 1 {
+		t.Errorf("events of kinds %v left behind, %d relay-signed tombstones", left, tombstones)
+	}
+	for _, table := range []string{"group_members", "group_bans", "group_mutes", "pending_joins", "invites", "group_pins", "group_member_lapses", "group_outbox"} {
+		var n int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+" WHERE group_id = 'crumbs'").Scan(&n); err != nil || n != 0 {
+			t.Errorf("%s: %d rows left (%v)", table, n, err)
+		}
+	}
+	var audited int
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM deletion_audit WHERE event_id = $1", spam.ID).Scan(&audited)
+	if audited != 0 {
+		t.Error("the group's moderation audit left behind")
+	}
+}
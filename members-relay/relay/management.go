@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// RELAY MANAGEMENT (NIP-86)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// The relay admin manages the relay over NIP-86: JSON-RPC POSTed to the
+// relay URL as application/nostr+json+rpc, with a NIP-98 header whose
+// payload tag hashes the body. Like the /admin/ routes, each authorization
+// event is taken once. Bans and the relay name and description belong to the
+// community the request addresses. Membership already decides who may
+// write, so allowpubkey only lifts a ban. listeventsneedingmoderation lists
+// the events members' reports hid (see REPORTS), and allowevent clears such
+// a hide as well as a ban.
+
+const managementContentType = "application/nostr+json+rpc"
+
+var managementMethods = []string{
+	"supportedmethods",
+	"banpubkey", "allowpubkey", "listbannedpubkeys",
+	"banevent", "allowevent", "listbannedevents", "listeventsneedingmoderation",
+	"changerelayname", "changerelaydescription",
+}
+
+var errUnsupportedMethod = errors.New("unsupported method")
+
+// relayInfoMu guards the Info of every relay, which changerelayname and
+// changerelaydescription edit while NIP-11 requests read it.
+var relayInfoMu sync.RWMutex
+
+// isManagementRequest matches the requests khatru would answer with NIP-86.
+func isManagementRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == managementContentType
+}
+
+// handleManagementRPC answers one NIP-86 call.
+func handleManagementRPC(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lang := requestLanguage(ctx, "", r)
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err != nil {
+		writeManagementResult(w, http.StatusBadRequest, nip86.Response{Error: render(lang, msgMalformedJSON)})
+		return
+	}
+	event, err := nip98Event(r)
+	if err == nil && !nip98PayloadMatches(event, body) {
+		err = errors.New("authorization payload mismatch")
+	}
+	if err != nil {
+		writeManagementResult(w, http.StatusUnauthorized, nip86.Response{Error: render(lang, msgAuthFailed, err)})
+		return
+	}
+	if event.PubKey != communityAdmin(ctx) {
+		writeManagementResult(w, http.StatusUnauthorized, nip86.Response{Error: render(lang, msgRelayAdminOnly)})
+		return
+	}
+	if !spendNIP98Event(event) {
+		writeManagementResult(w, http.StatusUnauthorized, nip86.Response{Error: render(lang, msgAuthFailed, "authorization event already used")})
+		return
+	}
+
+	var req nip86.Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeManagementResult(w, http.StatusBadRequest, nip86.Response{Error: render(lang, msgMalformedJSON)})
+		return
+	}
+	params, err := nip86.DecodeRequest(req)
+	if err != nil {
+		writeManagementResult(w, http.StatusBadRequest, nip86.Response{Error: render(lang, msgRPCParams, err)})
+		return
+	}
+	result, err := manageRelay(ctx, params)
+	switch {
+	case errors.Is(err, errUnsupportedMethod):
+		writeManagementResult(w, http.StatusOK, nip86.Response{Error: render(lang, msgRPCMethod, params.MethodName())})
+	case err != nil:
+		log.Printf("[NIP-86] %s failed: %v", params.MethodName(), err)
+		writeManagementResult(w, http.StatusOK, nip86.Response{Error: "error: " + params.MethodName() + " failed"})
+	default:
+		log.Printf("[NIP-86] %s by %s in %s", params.MethodName(), event.PubKey, communityOf(ctx).id())
+		writeManagementResult(w, http.StatusOK, nip86.Response{Result: result})
+	}
+}
+
+// nip98PayloadMatches reports whether event's payload tag is body's SHA-256.
+func nip98PayloadMatches(event *nostr.Event, body []byte) bool {
+	sum := sha256.Sum256(body)
+	tag := event.Tags.GetFirst([]string{"payload", ""})
+	return tag != nil && (*tag)[1] == hex.EncodeToString(sum[:])
+}
+
+func writeManagementResult(w http.ResponseWriter, status int, resp nip86.Response) {
+	w.Header().Set("Content-Type", managementContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// manageRelay runs one decoded call in ctx's community.
+func manageRelay(ctx context.Context, params nip86.MethodParams) (interface{}, error) {
+	community := communityOf(ctx).id()
+	switch p := params.(type) {
+	case nip86.SupportedMethods:
+		return managementMethods, nil
+	case nip86.BanPubKey:
+		_, err := db.ExecContext(ctx, `
+			INSERT INTO banned_pubkeys (community, pubkey, reason) VALUES ($1, $2, $3)
+			ON CONFLICT (community, pubkey) DO UPDATE SET reason = EXCLUDED.reason
+		`, community, p.PubKey, p.Reason)
+		return true, err
+	case nip86.AllowPubKey:
+		_, err := db.ExecContext(ctx, "DELETE FROM banned_pubkeys WHERE community = $1 AND pubkey = $2", community, p.PubKey)
+		return true, err
+	case nip86.ListBannedPubKeys:
+		return listBanned(ctx, "SELECT pubkey, reason FROM banned_pubkeys WHERE community = $1 ORDER BY banned_at", community,
+			func(key, reason string) interface{} { return nip86.PubKeyReason{PubKey: key, Reason: reason} })
+	case nip86.BanEvent:
+		return true, banEvent(ctx, community, p.ID, p.Reason)
+	case nip86.AllowEvent:
+		if _, err := db.ExecContext(ctx, "DELETE FROM banned_events WHERE community = $1 AND id = $2", community, p.ID); err != nil {
+			return nil, err
+		}
+		return true, clearHidden(ctx, community, p.ID)
+	case nip86.ListBannedEvents:
+		return listBanned(ctx, "SELECT id, reason FROM banned_events WHERE community = $1 ORDER BY banned_at", community,
+			func(key, reason string) interface{} { return nip86.IDReason{ID: key, Reason: reason} })
+	case nip86.ListEventsNeedingModeration:
+		return listBanned(ctx, hiddenEventsQuery, community,
+			func(key, reason string) interface{} { return nip86.IDReason{ID: key, Reason: reason} })
+	case nip86.ChangeRelayName:
+		return true, changeRelayInfo(ctx, "relay_name:", p.Name)
+	case nip86.ChangeRelayDescription:
+		return true, changeRelayInfo(ctx, "relay_description:", p.Description)
+	}
+	return nil, errUnsupportedMethod
+}
+
+// banEvent records the ban and removes the event from the community.
+func banEvent(ctx context.Context, community, id, reason string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO banned_events (community, id, reason) VALUES ($1, $2, $3)
+		ON CONFLICT (community, id) DO UPDATE SET reason = EXCLUDED.reason
+	`, community, id, reason); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM events WHERE id = $1 AND community = $2", id, community); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// listBanned returns the rows of query, each made into a result by entry.
+func listBanned(ctx context.Context, query, community string, entry func(key, reason string) interface{}) (interface{}, error) {
+	rows, err := db.QueryContext(ctx, query, community)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []interface{}{}
+	for rows.Next() {
+		var key, reason string
+		if err := rows.Scan(&key, &reason); err != nil {
+			return nil, err
+		}
+		list = append(list, entry(key, reason))
+	}
+	return list, rows.Err()
+}
+
+// changeRelayInfo stores value under prefix+community in relay_state and
+// applies it to the community's relay.
+func changeRelayInfo(ctx context.Context, prefix, value string) error {
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO relay_state (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value
+	`, prefix+communityOf(ctx).id(), value); err != nil {
+		return err
+	}
+	setRelayInfo(relayFor(ctx), prefix, value)
+	return nil
+}
+
+func setRelayInfo(rl *khatru.Relay, prefix, value string) {
+	relayInfoMu.Lock()
+	defer relayInfoMu.Unlock()
+	switch prefix {
+	case "relay_name:":
+		rl.Info.Name = value
+	case "relay_description:":
+		rl.Info.Description = value
+	}
+}
+
+// loadRelayInfo applies the names and descriptions changed over NIP-86 to
+// the relays built from the environment.
+func loadRelayInfo(ctx context.Context) error {
+	relays := map[string]*khatru.Relay{defaultCommunityID: relay}
+	for _, c := range communities {
+		relays[c.id()] = c.relay
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT key, value FROM relay_state
+		WHERE key LIKE 'relay\_name:%' OR key LIKE 'relay\_description:%'
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		prefix, community, _ := strings.Cut(key, ":")
+		if rl := relays[community]; rl != nil {
+			setRelayInfo(rl, prefix+":", value)
+		}
+	}
+	return rows.Err()
+}
+
+// rejectBanned refuses banned events, and events from a banned pubkey
+// whether it signed them or sent them (gift wraps).
+func rejectBanned(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	var pubkeyBanned, eventBanned bool
+	err := db.QueryRowContext(ctx, `
+		SELECT
+			EXISTS (SELECT 1 FROM banned_pubkeys WHERE community = $1 AND pubkey IN ($2, $3)),
+			EXISTS (SELECT 1 FROM banned_events WHERE community = $1 AND id = $4)
+	`, communityOf(ctx).id(), event.PubKey, pubkey, event.ID).Scan(&pubkeyBanned, &eventBanned)
+	if err != nil {
+		log.Printf("[NIP-86] Error checking bans for %s: %v", event.ID, err)
+		return true, say(ctx, msgBanCheckFailed)
+	}
+	if pubkeyBanned {
+		return true, say(ctx, msgPubkeyBanned)
+	}
+	if eventBanned {
+		return true, say(ctx, msgEventBanned)
+	}
+	return false, ""
+}
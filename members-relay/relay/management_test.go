@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// managementCall POSTs a NIP-86 call signed by sk, with payload as the
+// payload tag's body ("" for the body itself).
+func managementCall(t *testing.T, sk, method string, params []any, payload string) (int, nip86.Response) {
+	t.Helper()
+	body, _ := json.Marshal(nip86.Request{Method: method, Params: params})
+	if payload == "" {
+		payload = string(body)
+	}
+	sum := sha256.Sum256([]byte(payload))
+	event := signedEvent(t, sk, kindHTTPAuth, nostr.Now(), nostr.Tags{
+		{"u", "https://members.zap.cooking/"}, {"method", "POST"}, {"payload", hex.EncodeToString(sum[:])},
+	}, "")
+	raw, _ := json.Marshal(event)
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", managementContentType)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "members.zap.cooking")
+	r.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(raw))
+	if !isManagementRequest(r) {
+		t.Fatal("not recognised as NIP-86")
+	}
+	w := httptest.NewRecorder()
+	handleManagementRPC(w, r)
+	var resp nip86.Response
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+	return w.Code, resp
+}
+
+func withTestAdmin(t *testing.T) string {
+	t.Helper()
+	sk := nostr.GeneratePrivateKey()
+	prev := adminPubkey
+	adminPubkey, _ = nostr.GetPublicKey(sk)
+	t.Cleanup(func() { adminPubkey = prev })
+	return sk
+}
+
+func TestManagementAuth(t *testing.T) {
+	sk := withTestAdmin(t)
+
+	if code, resp := managementCall(t, sk, "supportedmethods", nil, `{"method":"banpubkey"}`); code != http.StatusUnauthorized || resp.Error == "" {
+		t.Fatalf("payload mismatch: %d %+v", code, resp)
+	}
+	if code, resp := managementCall(t, nostr.GeneratePrivateKey(), "supportedmethods", nil, ""); code != http.StatusUnauthorized || resp.Error != "restricted: relay admin only" {
+		t.Fatalf("not the admin: %d %+v", code, resp)
+	}
+	code, resp := managementCall(t, sk, "supportedmethods", nil, "")
+	if code != http.StatusOK || resp.Error != "" {
+		t.Fatalf("supportedmethods: %d %+v", code, resp)
+	}
+	methods, _ := json.Marshal(resp.Result)
+	for _, m := range []string{"banpubkey", "allowpubkey", "listbannedpubkeys", "banevent", "changerelayname", "changerelaydescription"} {
+		if !strings.Contains(string(methods), `"`+m+`"`) {
+			t.Errorf("%s not listed in %s", m, methods)
+		}
+	}
+	if _, resp := managementCall(t, sk, "blockip", []any{"10.0.0.1"}, ""); resp.Error != `invalid: method "blockip" is not supported` {
+		t.Fatalf("blockip: %+v", resp)
+	}
+}
+
+func TestManagementMethods(t *testing.T) {
+	openTestDB(t)
+	sk := withTestAdmin(t)
+	prevRelay := relay
+	relay = khatru.NewRelay()
+	t.Cleanup(func() { relay = prevRelay })
+	ctx := context.Background()
+	t.Cleanup(func() {
+		db.ExecContext(ctx, "DELETE FROM relay_state WHERE key LIKE 'relay\\_name:%' OR key LIKE 'relay\\_description:%'")
+	})
+	memberSK := nostr.GeneratePrivateKey()
+	member, _ := nostr.GetPublicKey(memberSK)
+	addTestMember(t, member)
+
+	call := func(method string, params ...any) any {
+		t.Helper()
+		code, resp := managementCall(t, sk, method, params, "")
+		if code != http.StatusOK || resp.Error != "" {
+			t.Fatalf("%s: %d %+v", method, code, resp)
+		}
+		return resp.Result
+	}
+	listed := func(method, key string) bool {
+		t.Helper()
+		raw, _ := json.Marshal(call(method))
+		return strings.Contains(string(raw), key)
+	}
+
+	note := signedEvent(t, memberSK, 1, nostr.Now(), nil, "spam")
+	call("banpubkey", member, "spam")
+	if !listed("listbannedpubkeys", `"reason":"spam"`) {
+		t.Fatal("ban not listed")
+	}
+	if reject, msg := rejectBanned(ctx, note, member); !reject || msg != "blocked: this pubkey is banned from the relay" {
+		t.Fatalf("banned pubkey: %v %q", reject, msg)
+	}
+	call("allowpubkey", member)
+	if listed("listbannedpubkeys", member) {
+		t.Fatal("ban not lifted")
+	}
+	if reject, _ := rejectBanned(ctx, note, member); reject {
+		t.Fatal("allowed pubkey still rejected")
+	}
+
+	if err := persistEvent(ctx, note); err != nil {
+		t.Fatal(err)
+	}
+	call("banevent", note.ID, "off topic")
+	if stored, _ := storedEvent(ctx, note.ID); stored != nil {
+		t.Fatal("banned event still stored")
+	}
+	if !listed("listbannedevents", note.ID) {
+		t.Fatal("event ban not listed")
+	}
+	if reject, msg := rejectBanned(ctx, note, member); !reject || msg != "blocked: this event is banned from the relay" {
+		t.Fatalf("banned event: %v %q", reject, msg)
+	}
+	call("allowevent", note.ID)
+	if reject, _ := rejectBanned(ctx, note, member); reject {
+		t.Fatal("allowed event still rejected")
+	}
+
+	call("changerelayname", "Test Kitchen")
+	call("changerelaydescription", "where recipes get tested")
+	relay.Info.Name, relay.Info.Description = "", ""
+	if err := loadRelayInfo(ctx); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handleRelayInfo(w, httptest.NewRequest("GET", "/", nil))
+	var info relayInfoDocument
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "Test Kitchen" || info.Description != "where recipes get tested" {
+		t.Fatalf("relay info not changed: %q %q", info.Name, info.Description)
+	}
+}
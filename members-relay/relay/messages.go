@@ -0,0 +1,963 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// MESSAGES
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Rejections and notices reach users verbatim, and much of the community
+// reads French or Spanish. Every message the event and filter policies and
+// the admin APIs produce has a stable code and an entry per supported
+// language below. Only the text after the NIP-01 prefix is translated: the
+// prefix ("restricted", "auth-required", ...) is what client logic reads.
+//
+// The language is the user's stored preference (kind 30078 app data with d
+// tag zap.cooking/language and a ["lang", "fr"] tag), else the connection's
+// ?lang= parameter, else its Accept-Language header, else English.
+
+const (
+	defaultLanguage   = "en"
+	languagePrefsDTag = "zap.cooking/language"
+)
+
+var supportedLanguages = []string{"en", "fr", "es"}
+
+type msgCode string
+
+const (
+	msgAuthRequired              msgCode = "auth_required"
+	msgAuthNIP42                 msgCode = "auth_nip42"
+	msgAuthGroupContent          msgCode = "auth_group_content"
+	msgAuthPlease                msgCode = "auth_please"
+	msgAuthFailed                msgCode = "auth_failed"
+	msgPubkeyMismatch            msgCode = "pubkey_mismatch"
+	msgRelayInternalPubkey       msgCode = "relay_internal_pubkey"
+	msgEventProtected            msgCode = "event_protected"
+	msgMembershipRequired        msgCode = "membership_required"
+	msgMembershipForGroups       msgCode = "membership_for_groups"
+	msgMembershipForGroupContent msgCode = "membership_for_group_content"
+	msgMembershipToJoin          msgCode = "membership_to_join"
+	msgMembershipForLiveChat     msgCode = "membership_for_live_chat"
+
+	msgGroupsDisabled         msgCode = "groups_disabled"
+	msgAdminCreatesGroups     msgCode = "admin_creates_groups"
+	msgAdminDeletesGroups     msgCode = "admin_deletes_groups"
+	msgCreateGroupHTag        msgCode = "create_group_h_tag"
+	msgGroupExists            msgCode = "group_exists"
+	msgGroupNotFound          msgCode = "group_not_found"
+	msgManagementHTag         msgCode = "management_h_tag"
+	msgMissingHTag            msgCode = "missing_h_tag"
+	msgModeratorRequired      msgCode = "moderator_required"
+	msgGroupAdminRequired     msgCode = "group_admin_required"
+	msgAlreadyGroupMember     msgCode = "already_group_member"
+	msgJoinPending            msgCode = "join_pending"
+	msgJoinDuplicate          msgCode = "join_duplicate"
+	msgInviteInvalid          msgCode = "invite_invalid"
+	msgInviteTags             msgCode = "invite_tags"
+	msgInviteCodeTaken        msgCode = "invite_code_taken"
+	msgNotGroupMember         msgCode = "not_group_member"
+	msgGroupBanned            msgCode = "group_banned"
+	msgGroupFull              msgCode = "group_full"
+	msgGroupIDInvalid         msgCode = "group_id_invalid"
+	msgMaxMembersMalformed    msgCode = "max_members_malformed"
+	msgMuted                  msgCode = "muted"
+	msgMuteTags               msgCode = "mute_tags"
+	msgPinTags                msgCode = "pin_tags"
+	msgPinLimit               msgCode = "pin_limit"
+	msgAnnouncementAdminOnly  msgCode = "announcement_admin_only"
+	msgLeaveNotMember         msgCode = "leave_not_member"
+	msgLastGroupAdmin         msgCode = "last_group_admin"
+	msgUsersNotAdded          msgCode = "users_not_added"
+	msgEventNotInGroup        msgCode = "event_not_in_group"
+	msgReplyUnknown           msgCode = "reply_unknown"
+	msgGroupMetadataManaged   msgCode = "group_metadata_managed"
+	msgBadgesRelayIssued      msgCode = "badges_relay_issued"
+	msgHandlerManaged         msgCode = "handler_managed"
+	msgEventDeleted           msgCode = "event_deleted"
+	msgDeletionCheckFailed    msgCode = "deletion_check_failed"
+	msgDeleteFailed           msgCode = "delete_failed"
+	msgDeletionCoordinate     msgCode = "deletion_coordinate"
+	msgDeletionByModerator    msgCode = "deletion_by_moderator"
+	msgDeletionNotAuthor      msgCode = "deletion_not_author"
+	msgEventLookupFailed      msgCode = "event_lookup_failed"
+	msgAppDataDTag            msgCode = "app_data_d_tag"
+	msgStatusDTag             msgCode = "status_d_tag"
+	msgEventExpired           msgCode = "event_expired"
+	msgMalformedExpiration    msgCode = "malformed_expiration"
+	msgCreatedAtTooNew        msgCode = "created_at_too_new"
+	msgCreatedAtTooOld        msgCode = "created_at_too_old"
+	msgPowRequired            msgCode = "pow_required"
+	msgCalendarDTag           msgCode = "calendar_d_tag"
+	msgCalendarMissingStart   msgCode = "calendar_missing_start"
+	msgCalendarMalformedStart msgCode = "calendar_malformed_start"
+	msgCalendarMalformedEnd   msgCode = "calendar_malformed_end"
+	msgCalendarEndBeforeStart msgCode = "calendar_end_before_start"
+	msgCalendarNotFound       msgCode = "calendar_not_found"
+	msgCalendarLookupFailed   msgCode = "calendar_lookup_failed"
+	msgCalendarNotVisible     msgCode = "calendar_not_visible"
+	msgRSVPStatus             msgCode = "rsvp_status"
+	msgRSVPATag               msgCode = "rsvp_a_tag"
+	msgRSVPTarget             msgCode = "rsvp_target"
+	msgRSVPHTag               msgCode = "rsvp_h_tag"
+	msgFileXTag               msgCode = "file_x_tag"
+	msgFileURLTag             msgCode = "file_url_tag"
+	msgFileMalformedURL       msgCode = "file_malformed_url"
+	msgFileVerifyFailed       msgCode = "file_verify_failed"
+	msgFileNotHeld            msgCode = "file_not_held"
+	msgLiveAdminOnly          msgCode = "live_admin_only"
+	msgLiveDTag               msgCode = "live_d_tag"
+	msgLiveStatus             msgCode = "live_status"
+	msgLiveStatusBackwards    msgCode = "live_status_backwards"
+	msgLiveChatATag           msgCode = "live_chat_a_tag"
+	msgLiveMalformedAddress   msgCode = "live_malformed_address"
+	msgLiveNotFound           msgCode = "live_not_found"
+	msgLabelLTag              msgCode = "label_l_tag"
+	msgMediaLabelRequired     msgCode = "media_label_required"
+	msgMediaRuleFailed        msgCode = "media_rule_failed"
+	msgTTLMalformed           msgCode = "ttl_malformed"
+	msgTTLConfirm             msgCode = "ttl_confirm"
+	msgTTLCheckFailed         msgCode = "ttl_check_failed"
+	msgReadMarkerDTag         msgCode = "read_marker_d_tag"
+	msgReadMarkerUntil        msgCode = "read_marker_until"
+	msgGiftWrapRecipient      msgCode = "gift_wrap_recipient"
+	msgRecipientNotMember     msgCode = "recipient_not_member"
+	msgReactionTarget         msgCode = "reaction_target"
+	msgReactionDuplicate      msgCode = "reaction_duplicate"
+	msgCountFailed            msgCode = "count_failed"
+	msgFilterTooBroad         msgCode = "filter_too_broad"
+	msgFilterTooComplex       msgCode = "filter_too_complex"
+	msgTooManySubscriptions   msgCode = "too_many_subscriptions"
+	msgTooManyFilters         msgCode = "too_many_filters"
+	msgPubkeyBanned           msgCode = "pubkey_banned"
+	msgEventBanned            msgCode = "event_banned"
+	msgBanCheckFailed         msgCode = "ban_check_failed"
+	msgMuteCheckFailed        msgCode = "mute_check_failed"
+	msgZapRequestInvalid      msgCode = "zap_request_invalid"
+	msgZapBolt11              msgCode = "zap_bolt11"
+	msgZapAmountMismatch      msgCode = "zap_amount_mismatch"
+	msgZapProvider            msgCode = "zap_provider"
+	msgZapProviderUnreachable msgCode = "zap_provider_unreachable"
+	msgReportTarget           msgCode = "report_target"
+	msgReportType             msgCode = "report_type"
+	msgListDTag               msgCode = "list_d_tag"
+	msgListPrivate            msgCode = "list_private"
+
+	msgRelayAdminOnly      msgCode = "relay_admin_only"
+	msgLabelModeratorOnly  msgCode = "label_moderator_only"
+	msgSigningKeyMissing   msgCode = "signing_key_missing"
+	msgMalformedJSON       msgCode = "malformed_json"
+	msgBadgeNameRequired   msgCode = "badge_name_required"
+	msgBadgeNotDefined     msgCode = "badge_not_defined"
+	msgPubkeyNotHex        msgCode = "pubkey_not_hex"
+	msgLabelFieldsRequired msgCode = "label_fields_required"
+	msgLabelTargets        msgCode = "label_targets"
+	msgEventNotFound       msgCode = "event_not_found"
+	msgIdentifierInvalid   msgCode = "identifier_invalid"
+	msgReactionTargets     msgCode = "reaction_targets"
+	msgFeaturedWeek        msgCode = "featured_week"
+	msgFeaturedNotFound    msgCode = "featured_not_found"
+	msgFeaturedAction      msgCode = "featured_action"
+	msgFeaturedNaddr       msgCode = "featured_naddr"
+	msgFeaturedPublished   msgCode = "featured_published"
+	msgRPCMethod           msgCode = "rpc_method"
+	msgRPCParams           msgCode = "rpc_params"
+)
+
+// catalogEntry is one message: its untranslated NIP-01 prefix and its text
+// per language, as fmt formats.
+type catalogEntry struct {
+	prefix string
+	text   map[string]string
+}
+
+var messageCatalog = map[msgCode]catalogEntry{
+	msgAuthRequired: {"auth-required", map[string]string{
+		"en": "this relay requires authentication",
+		"fr": "ce relais exige une authentification",
+		"es": "este relé requiere autenticación",
+	}},
+	msgAuthNIP42: {"auth-required", map[string]string{
+		"en": "please authenticate with NIP-42",
+		"fr": "veuillez vous authentifier avec NIP-42",
+		"es": "autentícate con NIP-42",
+	}},
+	msgAuthGroupContent: {"auth-required", map[string]string{
+		"en": "please authenticate to access group content",
+		"fr": "veuillez vous authentifier pour accéder au contenu des groupes",
+		"es": "autentícate para acceder al contenido de los grupos",
+	}},
+	msgAuthPlease: {"auth-required", map[string]string{
+		"en": "please authenticate",
+		"fr": "veuillez vous authentifier",
+		"es": "autentícate",
+	}},
+	msgAuthFailed: {"auth-required", map[string]string{
+		"en": "%s",
+		"fr": "autorisation NIP-98 refusée (%s)",
+		"es": "autorización NIP-98 rechazada (%s)",
+	}},
+	msgPubkeyMismatch: {"invalid", map[string]string{
+		"en": "event pubkey doesn't match authenticated user",
+		"fr": "la clé publique de l'événement ne correspond pas à l'utilisateur authentifié",
+		"es": "la clave pública del evento no coincide con el usuario autenticado",
+	}},
+	msgRelayInternalPubkey: {"restricted", map[string]string{
+		"en": "relay-internal pubkey",
+		"fr": "clé publique interne au relais",
+		"es": "clave pública interna del relé",
+	}},
+	msgEventProtected: {"blocked", map[string]string{
+		"en": "event marked as protected",
+		"fr": "événement marqué comme protégé",
+		"es": "evento marcado como protegido",
+	}},
+	msgMembershipRequired: {"restricted", map[string]string{
+		"en": "membership required",
+		"fr": "adhésion requise",
+		"es": "se requiere membresía",
+	}},
+	msgMembershipForGroups: {"restricted", map[string]string{
+		"en": "membership required for group participation",
+		"fr": "adhésion requise pour participer aux groupes",
+		"es": "se requiere membresía para participar en los grupos",
+	}},
+	msgMembershipForGroupContent: {"restricted", map[string]string{
+		"en": "membership required to access group content",
+		"fr": "adhésion requise pour accéder au contenu des groupes",
+		"es": "se requiere membresía para acceder al contenido de los grupos",
+	}},
+	msgMembershipToJoin: {"restricted", map[string]string{
+		"en": "relay membership required to join groups",
+		"fr": "adhésion au relais requise pour rejoindre des groupes",
+		"es": "se requiere membresía del relé para unirse a grupos",
+	}},
+	msgMembershipForLiveChat: {"restricted", map[string]string{
+		"en": "membership required for live chat",
+		"fr": "adhésion requise pour le chat en direct",
+		"es": "se requiere membresía para el chat en vivo",
+	}},
+
+	msgGroupsDisabled: {"error", map[string]string{
+		"en": "NIP-29 group management not enabled on this relay",
+		"fr": "la gestion des groupes NIP-29 n'est pas activée sur ce relais",
+		"es": "la gestión de grupos NIP-29 no está activada en este relé",
+	}},
+	msgAdminCreatesGroups: {"restricted", map[string]string{
+		"en": "only relay admin can create groups",
+		"fr": "seul l'administrateur du relais peut créer des groupes",
+		"es": "solo el administrador del relé puede crear grupos",
+	}},
+	msgAdminDeletesGroups: {"restricted", map[string]string{
+		"en": "only relay admin can delete groups",
+		"fr": "seul l'administrateur du relais peut supprimer des groupes",
+		"es": "solo el administrador del relé puede eliminar grupos",
+	}},
+	msgCreateGroupHTag: {"invalid", map[string]string{
+		"en": "missing h tag for group creation",
+		"fr": "tag h manquant pour la création du groupe",
+		"es": "falta la etiqueta h para crear el grupo",
+	}},
+	msgGroupExists: {"duplicate", map[string]string{
+		"en": "group already exists",
+		"fr": "le groupe existe déjà",
+		"es": "el grupo ya existe",
+	}},
+	msgGroupNotFound: {"invalid", map[string]string{
+		"en": "group does not exist",
+		"fr": "le groupe n'existe pas",
+		"es": "el grupo no existe",
+	}},
+	msgManagementHTag: {"invalid", map[string]string{
+		"en": "missing h tag for group management event",
+		"fr": "tag h manquant pour l'événement de gestion du groupe",
+		"es": "falta la etiqueta h en el evento de gestión del grupo",
+	}},
+	msgMissingHTag: {"invalid", map[string]string{
+		"en": "missing h tag",
+		"fr": "tag h manquant",
+		"es": "falta la etiqueta h",
+	}},
+	msgModeratorRequired: {"restricted", map[string]string{
+		"en": "group moderator access required",
+		"fr": "accès modérateur du groupe requis",
+		"es": "se requiere acceso de moderador del grupo",
+	}},
+	msgGroupAdminRequired: {"restricted", map[string]string{
+		"en": "group admin access required",
+		"fr": "accès administrateur du groupe requis",
+		"es": "se requiere acceso de administrador del grupo",
+	}},
+	msgAlreadyGroupMember: {"duplicate", map[string]string{
+		"en": "already a member of this group",
+		"fr": "vous êtes déjà membre de ce groupe",
+		"es": "ya eres miembro de este grupo",
+	}},
+	msgJoinPending: {"pending", map[string]string{
+		"en": "join request awaiting approval",
+		"fr": "demande d'adhésion en attente d'approbation",
+		"es": "solicitud de ingreso pendiente de aprobación",
+	}},
+	msgJoinDuplicate: {"duplicate", map[string]string{
+		"en": "join request already awaiting approval",
+		"fr": "demande d'adhésion déjà en attente d'approbation",
+		"es": "la solicitud de ingreso ya está pendiente de aprobación",
+	}},
+	msgInviteInvalid: {"invalid", map[string]string{
+		"en": "invite code not valid",
+		"fr": "code d'invitation non valide",
+		"es": "código de invitación no válido",
+	}},
+	msgInviteTags: {"invalid", map[string]string{
+		"en": "max_uses must be a positive number and the code at most %d characters",
+		"fr": "max_uses doit être un nombre positif et le code compter au plus %d caractères",
+		"es": "max_uses debe ser un número positivo y el código tener como máximo %d caracteres",
+	}},
+	msgInviteCodeTaken: {"duplicate", map[string]string{
+		"en": "invite code already issued for this group",
+		"fr": "code d'invitation déjà émis pour ce groupe",
+		"es": "código de invitación ya emitido para este grupo",
+	}},
+	msgNotGroupMember: {"restricted", map[string]string{
+		"en": "not a member of this group",
+		"fr": "vous n'êtes pas membre de ce groupe",
+		"es": "no eres miembro de este grupo",
+	}},
+	msgGroupBanned: {"restricted", map[string]string{
+		"en": "you are banned from this group",
+		"fr": "vous êtes banni de ce groupe",
+		"es": "estás vetado en este grupo",
+	}},
+	msgMuted: {"restricted", map[string]string{
+		"en": "muted until %s",
+		"fr": "en sourdine jusqu'au %s",
+		"es": "silenciado hasta el %s",
+	}},
+	msgMuteTags: {"invalid", map[string]string{
+		"en": "mute needs p tags and a duration tag in minutes (0 lifts the mute)",
+		"fr": "la mise en sourdine exige des tags p et un tag duration en minutes (0 la lève)",
+		"es": "silenciar requiere etiquetas p y una etiqueta duration en minutos (0 lo levanta)",
+	}},
+	msgPinTags: {"invalid", map[string]string{
+		"en": "pin needs e tags naming the events",
+		"fr": "l'épinglage exige des tags e désignant les événements",
+		"es": "fijar requiere etiquetas e que nombren los eventos",
+	}},
+	msgPinLimit: {"restricted", map[string]string{
+		"en": "a group can pin at most %d events",
+		"fr": "un groupe peut épingler au plus %d événements",
+		"es": "un grupo puede fijar como máximo %d eventos",
+	}},
+	msgAnnouncementAdminOnly: {"restricted", map[string]string{
+		"en": "admin only",
+		"fr": "réservé aux administrateurs",
+		"es": "solo para administradores",
+	}},
+	msgGroupFull: {"restricted", map[string]string{
+		"en": "group is full",
+		"fr": "le groupe est complet",
+		"es": "el grupo está lleno",
+	}},
+	msgGroupIDInvalid: {"invalid", map[string]string{
+		"en": "group id must be 3-64 chars of a-z, 0-9, - and _",
+		"fr": "l'identifiant du groupe doit compter 3 à 64 caractères parmi a-z, 0-9, - et _",
+		"es": "el id del grupo debe tener de 3 a 64 caracteres entre a-z, 0-9, - y _",
+	}},
+	msgMaxMembersMalformed: {"invalid", map[string]string{
+		"en": "max_members must be a non-negative number",
+		"fr": "max_members doit être un nombre positif ou nul",
+		"es": "max_members debe ser un número no negativo",
+	}},
+	msgLastGroupAdmin: {"invalid", map[string]string{
+		"en": "cannot remove the last group admin — transfer ownership first",
+		"fr": "impossible de retirer le dernier administrateur du groupe — transférez d'abord la propriété",
+		"es": "no se puede quitar al último administrador del grupo — transfiere primero la propiedad",
+	}},
+	msgUsersNotAdded: {"restricted", map[string]string{
+		"en": "not added, not relay members: %s",
+		"fr": "non ajoutés, pas membres du relais : %s",
+		"es": "no añadidos, no son miembros del relé: %s",
+	}},
+	msgLeaveNotMember: {"invalid", map[string]string{
+		"en": "not a member of this group",
+		"fr": "vous n'êtes pas membre de ce groupe",
+		"es": "no eres miembro de este grupo",
+	}},
+	msgEventNotInGroup: {"restricted", map[string]string{
+		"en": "event %s is not part of this group",
+		"fr": "l'événement %s ne fait pas partie de ce groupe",
+		"es": "el evento %s no forma parte de este grupo",
+	}},
+	msgReplyUnknown: {"invalid", map[string]string{
+		"en": "reply references unknown event in this group",
+		"fr": "la réponse désigne un événement inconnu dans ce groupe",
+		"es": "la respuesta hace referencia a un evento desconocido en este grupo",
+	}},
+	msgGroupMetadataManaged: {"invalid", map[string]string{
+		"en": "group metadata events are relay-managed",
+		"fr": "les métadonnées de groupe sont gérées par le relais",
+		"es": "los metadatos de grupo los gestiona el relé",
+	}},
+	msgBadgesRelayIssued: {"invalid", map[string]string{
+		"en": "badges are issued by the relay",
+		"fr": "les badges sont délivrés par le relais",
+		"es": "las insignias las emite el relé",
+	}},
+	msgHandlerManaged: {"restricted", map[string]string{
+		"en": "handler events are managed by the relay",
+		"fr": "les événements de gestionnaire sont gérés par le relais",
+		"es": "los eventos de gestor los administra el relé",
+	}},
+	msgEventDeleted: {"invalid", map[string]string{
+		"en": "this event was deleted",
+		"fr": "cet événement a été supprimé",
+		"es": "este evento fue eliminado",
+	}},
+	msgDeletionCheckFailed: {"error", map[string]string{
+		"en": "could not check deletions",
+		"fr": "impossible de vérifier les suppressions",
+		"es": "no se pudieron comprobar las eliminaciones",
+	}},
+	msgDeleteFailed: {"error", map[string]string{
+		"en": "could not delete event",
+		"fr": "impossible de supprimer l'événement",
+		"es": "no se pudo eliminar el evento",
+	}},
+	msgDeletionCoordinate: {"blocked", map[string]string{
+		"en": "coordinate pubkey does not match the deletion's author",
+		"fr": "la clé publique de la coordonnée ne correspond pas à l'auteur de la suppression",
+		"es": "la clave pública de la coordenada no coincide con el autor de la eliminación",
+	}},
+	msgDeletionByModerator: {"blocked", map[string]string{
+		"en": "group moderators delete group events with kind 9005",
+		"fr": "les modérateurs suppriment les événements de groupe avec le kind 9005",
+		"es": "los moderadores eliminan los eventos de grupo con el kind 9005",
+	}},
+	msgDeletionNotAuthor: {"blocked", map[string]string{
+		"en": "you are not the author of this event",
+		"fr": "vous n'êtes pas l'auteur de cet événement",
+		"es": "no eres el autor de este evento",
+	}},
+	msgEventLookupFailed: {"error", map[string]string{
+		"en": "could not look up event",
+		"fr": "impossible de retrouver l'événement",
+		"es": "no se pudo consultar el evento",
+	}},
+	msgAppDataDTag: {"invalid", map[string]string{
+		"en": "app data requires a d tag",
+		"fr": "les données d'application exigent un tag d",
+		"es": "los datos de aplicación requieren una etiqueta d",
+	}},
+	msgStatusDTag: {"invalid", map[string]string{
+		"en": "user status requires a d tag",
+		"fr": "le statut exige un tag d",
+		"es": "el estado requiere una etiqueta d",
+	}},
+	msgEventExpired: {"invalid", map[string]string{
+		"en": "event is expired",
+		"fr": "l'événement a expiré",
+		"es": "el evento ha caducado",
+	}},
+	msgMalformedExpiration: {"invalid", map[string]string{
+		"en": "malformed expiration tag",
+		"fr": "tag expiration mal formé",
+		"es": "etiqueta expiration mal formada",
+	}},
+	msgCreatedAtTooNew: {"invalid", map[string]string{
+		"en": "created_at is too far in the future",
+		"fr": "created_at est trop loin dans le futur",
+		"es": "created_at está demasiado en el futuro",
+	}},
+	msgCreatedAtTooOld: {"invalid", map[string]string{
+		"en": "created_at is too far in the past",
+		"fr": "created_at est trop loin dans le passé",
+		"es": "created_at está demasiado en el pasado",
+	}},
+	msgPowRequired: {"pow", map[string]string{
+		"en": "difficulty %d required",
+		"fr": "difficulté %d requise",
+		"es": "se requiere dificultad %d",
+	}},
+	msgCalendarDTag: {"invalid", map[string]string{
+		"en": "calendar events require a d tag",
+		"fr": "les événements de calendrier exigent un tag d",
+		"es": "los eventos de calendario requieren una etiqueta d",
+	}},
+	msgCalendarMissingStart: {"invalid", map[string]string{
+		"en": "missing start tag",
+		"fr": "tag start manquant",
+		"es": "falta la etiqueta start",
+	}},
+	msgCalendarMalformedStart: {"invalid", map[string]string{
+		"en": "malformed start tag",
+		"fr": "tag start mal formé",
+		"es": "etiqueta start mal formada",
+	}},
+	msgCalendarMalformedEnd: {"invalid", map[string]string{
+		"en": "malformed end tag",
+		"fr": "tag end mal formé",
+		"es": "etiqueta end mal formada",
+	}},
+	msgCalendarEndBeforeStart: {"invalid", map[string]string{
+		"en": "end is before start",
+		"fr": "la fin précède le début",
+		"es": "el final es anterior al inicio",
+	}},
+	msgCalendarNotFound: {"invalid", map[string]string{
+		"en": "calendar event does not exist",
+		"fr": "l'événement de calendrier n'existe pas",
+		"es": "el evento de calendario no existe",
+	}},
+	msgCalendarLookupFailed: {"error", map[string]string{
+		"en": "could not look up calendar event",
+		"fr": "impossible de retrouver l'événement de calendrier",
+		"es": "no se pudo consultar el evento de calendario",
+	}},
+	msgCalendarNotVisible: {"restricted", map[string]string{
+		"en": "calendar event is not visible to you",
+		"fr": "cet événement de calendrier ne vous est pas visible",
+		"es": "este evento de calendario no es visible para ti",
+	}},
+	msgRSVPStatus: {"invalid", map[string]string{
+		"en": "RSVP status must be accepted, declined or tentative",
+		"fr": "le statut de la réponse doit être accepted, declined ou tentative",
+		"es": "el estado de la respuesta debe ser accepted, declined o tentative",
+	}},
+	msgRSVPATag: {"invalid", map[string]string{
+		"en": "RSVP requires an a tag referencing a calendar event",
+		"fr": "la réponse exige un tag a désignant un événement de calendrier",
+		"es": "la respuesta requiere una etiqueta a que indique un evento de calendario",
+	}},
+	msgRSVPTarget: {"invalid", map[string]string{
+		"en": "RSVP must reference a calendar event",
+		"fr": "la réponse doit désigner un événement de calendrier",
+		"es": "la respuesta debe indicar un evento de calendario",
+	}},
+	msgRSVPHTag: {"invalid", map[string]string{
+		"en": "RSVP must carry the calendar event's h tag",
+		"fr": "la réponse doit porter le tag h de l'événement de calendrier",
+		"es": "la respuesta debe llevar la etiqueta h del evento de calendario",
+	}},
+	msgFileXTag: {"invalid", map[string]string{
+		"en": "file metadata requires an x tag with the sha256 of the file",
+		"fr": "les métadonnées de fichier exigent un tag x avec le sha256 du fichier",
+		"es": "los metadatos de archivo requieren una etiqueta x con el sha256 del archivo",
+	}},
+	msgFileURLTag: {"invalid", map[string]string{
+		"en": "file metadata requires a url tag",
+		"fr": "les métadonnées de fichier exigent un tag url",
+		"es": "los metadatos de archivo requieren una etiqueta url",
+	}},
+	msgFileMalformedURL: {"invalid", map[string]string{
+		"en": "malformed url tag",
+		"fr": "tag url mal formé",
+		"es": "etiqueta url mal formada",
+	}},
+	msgFileVerifyFailed: {"error", map[string]string{
+		"en": "could not verify the file with media storage",
+		"fr": "impossible de vérifier le fichier auprès du stockage des médias",
+		"es": "no se pudo verificar el archivo con el almacenamiento de medios",
+	}},
+	msgFileNotHeld: {"invalid", map[string]string{
+		"en": "file is not held by this relay's media storage",
+		"fr": "le fichier n'est pas conservé par le stockage des médias de ce relais",
+		"es": "el archivo no está en el almacenamiento de medios de este relé",
+	}},
+	msgLiveAdminOnly: {"restricted", map[string]string{
+		"en": "only the relay admin can host live activities",
+		"fr": "seul l'administrateur du relais peut animer des directs",
+		"es": "solo el administrador del relé puede organizar directos",
+	}},
+	msgLiveDTag: {"invalid", map[string]string{
+		"en": "live activity requires a d tag",
+		"fr": "le direct exige un tag d",
+		"es": "el directo requiere una etiqueta d",
+	}},
+	msgLiveStatus: {"invalid", map[string]string{
+		"en": "live activity status must be planned, live or ended",
+		"fr": "le statut du direct doit être planned, live ou ended",
+		"es": "el estado del directo debe ser planned, live o ended",
+	}},
+	msgLiveStatusBackwards: {"invalid", map[string]string{
+		"en": "live activity cannot go from %s back to %s",
+		"fr": "le direct ne peut pas repasser de %s à %s",
+		"es": "el directo no puede volver de %s a %s",
+	}},
+	msgLiveChatATag: {"invalid", map[string]string{
+		"en": "live chat requires an a tag referencing a live activity",
+		"fr": "le chat en direct exige un tag a désignant un direct",
+		"es": "el chat en vivo requiere una etiqueta a que indique un directo",
+	}},
+	msgLiveMalformedAddress: {"invalid", map[string]string{
+		"en": "malformed live activity address",
+		"fr": "adresse de direct mal formée",
+		"es": "dirección de directo mal formada",
+	}},
+	msgLiveNotFound: {"invalid", map[string]string{
+		"en": "live activity does not exist",
+		"fr": "le direct n'existe pas",
+		"es": "el directo no existe",
+	}},
+	msgLabelLTag: {"invalid", map[string]string{
+		"en": "label event requires an l tag",
+		"fr": "l'événement d'étiquetage exige un tag l",
+		"es": "el evento de etiquetado requiere una etiqueta l",
+	}},
+	msgMediaLabelRequired: {"restricted", map[string]string{
+		"en": "this group requires a content-warning or label on posts with media",
+		"fr": "ce groupe exige un avertissement ou une étiquette sur les publications avec médias",
+		"es": "este grupo exige una advertencia o etiqueta en las publicaciones con medios",
+	}},
+	msgMediaRuleFailed: {"error", map[string]string{
+		"en": "could not check the group's media rule",
+		"fr": "impossible de vérifier la règle du groupe sur les médias",
+		"es": "no se pudo comprobar la regla de medios del grupo",
+	}},
+	msgTTLMalformed: {"invalid", map[string]string{
+		"en": "message_ttl must be a non-negative number of seconds",
+		"fr": "message_ttl doit être un nombre de secondes positif ou nul",
+		"es": "message_ttl debe ser un número de segundos no negativo",
+	}},
+	msgTTLConfirm: {"invalid", map[string]string{
+		"en": "this message TTL would delete %d existing messages; confirm to apply it",
+		"fr": "cette durée de conservation supprimerait %d messages existants ; confirmez pour l'appliquer",
+		"es": "esta caducidad eliminaría %d mensajes existentes; confirme para aplicarla",
+	}},
+	msgTTLCheckFailed: {"error", map[string]string{
+		"en": "could not check the message TTL change",
+		"fr": "impossible de vérifier le changement de durée de conservation",
+		"es": "no se pudo comprobar el cambio de caducidad de los mensajes",
+	}},
+	msgCountFailed: {"error", map[string]string{
+		"en": "could not count events",
+		"fr": "impossible de compter les événements",
+		"es": "no se pudieron contar los eventos",
+	}},
+	msgFilterTooBroad: {"blocked", map[string]string{
+		"en": "filter too broad",
+		"fr": "filtre trop large",
+		"es": "filtro demasiado amplio",
+	}},
+	msgFilterTooComplex: {"error", map[string]string{
+		"en": "filter too complex (%d conditions, max %d)",
+		"fr": "filtre trop complexe (%d conditions, max %d)",
+		"es": "filtro demasiado complejo (%d condiciones, máximo %d)",
+	}},
+	msgTooManySubscriptions: {"error", map[string]string{
+		"en": "too many subscriptions (max %d)",
+		"fr": "trop d'abonnements (max %d)",
+		"es": "demasiadas suscripciones (máximo %d)",
+	}},
+	msgTooManyFilters: {"error", map[string]string{
+		"en": "too many filters (max %d)",
+		"fr": "trop de filtres (max %d)",
+		"es": "demasiados filtros (máximo %d)",
+	}},
+	msgPubkeyBanned: {"blocked", map[string]string{
+		"en": "this pubkey is banned from the relay",
+		"fr": "cette clé publique est bannie du relais",
+		"es": "esta clave pública está vetada en el relé",
+	}},
+	msgEventBanned: {"blocked", map[string]string{
+		"en": "this event is banned from the relay",
+		"fr": "cet événement est banni du relais",
+		"es": "este evento está vetado en el relé",
+	}},
+	msgBanCheckFailed: {"error", map[string]string{
+		"en": "could not check bans",
+		"fr": "impossible de vérifier les bannissements",
+		"es": "no se pudieron comprobar los vetos",
+	}},
+	msgMuteCheckFailed: {"error", map[string]string{
+		"en": "could not check mutes",
+		"fr": "impossible de vérifier les mises en sourdine",
+		"es": "no se pudieron comprobar los silencios",
+	}},
+	msgZapRequestInvalid: {"invalid", map[string]string{
+		"en": "the zap request in the description is invalid (%s)",
+		"fr": "la demande de zap de la description est invalide (%s)",
+		"es": "la solicitud de zap de la descripción no es válida (%s)",
+	}},
+	msgZapBolt11: {"invalid", map[string]string{
+		"en": "the bolt11 tag must hold an invoice with an amount",
+		"fr": "le tag bolt11 doit contenir une facture avec un montant",
+		"es": "la etiqueta bolt11 debe contener una factura con un importe",
+	}},
+	msgZapAmountMismatch: {"invalid", map[string]string{
+		"en": "the invoice amount does not match the zap request",
+		"fr": "le montant de la facture ne correspond pas à la demande de zap",
+		"es": "el importe de la factura no coincide con la solicitud de zap",
+	}},
+	msgZapProvider: {"invalid", map[string]string{
+		"en": "the receipt is not signed by the recipe author's lightning provider",
+		"fr": "le reçu n'est pas signé par le fournisseur lightning de l'auteur de la recette",
+		"es": "el recibo no está firmado por el proveedor lightning del autor de la receta",
+	}},
+	msgZapProviderUnreachable: {"error", map[string]string{
+		"en": "could not reach the recipe author's lightning provider",
+		"fr": "impossible de joindre le fournisseur lightning de l'auteur de la recette",
+		"es": "no se pudo contactar con el proveedor lightning del autor de la receta",
+	}},
+	msgReportTarget: {"invalid", map[string]string{
+		"en": "a report must name the reported pubkey in a p tag",
+		"fr": "un signalement doit nommer la clé publique signalée dans un tag p",
+		"es": "un reporte debe nombrar la clave pública reportada en una etiqueta p",
+	}},
+	msgReportType: {"invalid", map[string]string{
+		"en": "unknown report type %q",
+		"fr": "type de signalement %q inconnu",
+		"es": "tipo de reporte %q desconocido",
+	}},
+	msgListDTag: {"invalid", map[string]string{
+		"en": "lists require a d tag",
+		"fr": "les listes exigent un tag d",
+		"es": "las listas requieren una etiqueta d",
+	}},
+	msgListPrivate: {"restricted", map[string]string{
+		"en": "these lists are private to their author",
+		"fr": "ces listes sont privées à leur auteur",
+		"es": "estas listas son privadas de su autor",
+	}},
+	msgReadMarkerDTag: {"invalid", map[string]string{
+		"en": "read marker requires a d tag naming the group",
+		"fr": "le marqueur de lecture exige un tag d nommant le groupe",
+		"es": "el marcador de lectura requiere una etiqueta d con el grupo",
+	}},
+	msgReadMarkerUntil: {"invalid", map[string]string{
+		"en": "read marker requires a read_until timestamp",
+		"fr": "le marqueur de lecture exige un horodatage read_until",
+		"es": "el marcador de lectura requiere una marca de tiempo read_until",
+	}},
+	msgGiftWrapRecipient: {"invalid", map[string]string{
+		"en": "gift wrap requires exactly one p tag naming the recipient",
+		"fr": "l'enveloppe exige un seul tag p désignant le destinataire",
+		"es": "el envoltorio requiere una sola etiqueta p con el destinatario",
+	}},
+	msgRecipientNotMember: {"restricted", map[string]string{
+		"en": "the recipient is not a member",
+		"fr": "le destinataire n'est pas membre",
+		"es": "el destinatario no es miembro",
+	}},
+	msgReactionTarget: {"invalid", map[string]string{
+		"en": "reaction must reference a chat message of this group with an e tag",
+		"fr": "la réaction doit désigner un message de ce groupe par un tag e",
+		"es": "la reacción debe referirse a un mensaje de este grupo con una etiqueta e",
+	}},
+	msgReactionDuplicate: {"duplicate", map[string]string{
+		"en": "you already reacted to this message with this emoji",
+		"fr": "vous avez déjà réagi à ce message avec cet emoji",
+		"es": "ya reaccionó a este mensaje con este emoji",
+	}},
+
+	msgRelayAdminOnly: {"restricted", map[string]string{
+		"en": "relay admin only",
+		"fr": "réservé à l'administrateur du relais",
+		"es": "solo para el administrador del relé",
+	}},
+	msgLabelModeratorOnly: {"restricted", map[string]string{
+		"en": "relay admin or group moderator only",
+		"fr": "réservé à l'administrateur du relais ou aux modérateurs du groupe",
+		"es": "solo para el administrador del relé o los moderadores del grupo",
+	}},
+	msgSigningKeyMissing: {"error", map[string]string{
+		"en": "relay signing key not configured",
+		"fr": "la clé de signature du relais n'est pas configurée",
+		"es": "la clave de firma del relé no está configurada",
+	}},
+	msgMalformedJSON: {"invalid", map[string]string{
+		"en": "malformed JSON body",
+		"fr": "corps JSON mal formé",
+		"es": "cuerpo JSON mal formado",
+	}},
+	msgBadgeNameRequired: {"invalid", map[string]string{
+		"en": "badge and name are required",
+		"fr": "badge et name sont obligatoires",
+		"es": "badge y name son obligatorios",
+	}},
+	msgBadgeNotDefined: {"invalid", map[string]string{
+		"en": "badge is not defined",
+		"fr": "ce badge n'est pas défini",
+		"es": "esta insignia no está definida",
+	}},
+	msgPubkeyNotHex: {"invalid", map[string]string{
+		"en": "pubkey must be hex",
+		"fr": "pubkey doit être en hexadécimal",
+		"es": "pubkey debe estar en hexadecimal",
+	}},
+	msgLabelFieldsRequired: {"invalid", map[string]string{
+		"en": "event (hex id) and label are required",
+		"fr": "event (identifiant hexadécimal) et label sont obligatoires",
+		"es": "event (identificador hexadecimal) y label son obligatorios",
+	}},
+	msgLabelTargets: {"invalid", map[string]string{
+		"en": "between 1 and %d event ids (e) or addresses (a) are required",
+		"fr": "entre 1 et %d identifiants d'événement (e) ou adresses (a) sont requis",
+		"es": "se requieren entre 1 y %d identificadores de evento (e) o direcciones (a)",
+	}},
+	msgEventNotFound: {"invalid", map[string]string{
+		"en": "event not found",
+		"fr": "événement introuvable",
+		"es": "evento no encontrado",
+	}},
+	msgIdentifierInvalid: {"invalid", map[string]string{
+		"en": "expected a note, nevent or naddr identifier",
+		"fr": "identifiant note, nevent ou naddr attendu",
+		"es": "se esperaba un identificador note, nevent o naddr",
+	}},
+	msgReactionTargets: {"invalid", map[string]string{
+		"en": "between 1 and %d message ids (e) are required",
+		"fr": "entre 1 et %d identifiants de message (e) sont requis",
+		"es": "se requieren entre 1 y %d identificadores de mensaje (e)",
+	}},
+	msgFeaturedWeek: {"invalid", map[string]string{
+		"en": "week must be an ISO week such as 2026-W07",
+		"fr": "week doit être une semaine ISO comme 2026-W07",
+		"es": "week debe ser una semana ISO como 2026-W07",
+	}},
+	msgFeaturedNotFound: {"invalid", map[string]string{
+		"en": "no featured list for this week",
+		"fr": "aucune sélection pour cette semaine",
+		"es": "no hay selección para esta semana",
+	}},
+	msgFeaturedAction: {"invalid", map[string]string{
+		"en": "action must be approve, remove or add",
+		"fr": "action doit être approve, remove ou add",
+		"es": "action debe ser approve, remove o add",
+	}},
+	msgFeaturedNaddr: {"invalid", map[string]string{
+		"en": "naddr must point at a recipe (kind 30023)",
+		"fr": "naddr doit désigner une recette (kind 30023)",
+		"es": "naddr debe apuntar a una receta (kind 30023)",
+	}},
+	msgFeaturedPublished: {"restricted", map[string]string{
+		"en": "the featured list for %s is already published",
+		"fr": "la sélection de %s est déjà publiée",
+		"es": "la selección de %s ya está publicada",
+	}},
+	msgRPCMethod: {"invalid", map[string]string{
+		"en": "method %q is not supported",
+		"fr": "la méthode %q n'est pas prise en charge",
+		"es": "el método %q no está soportado",
+	}},
+	msgRPCParams: {"invalid", map[string]string{
+		"en": "%s",
+		"fr": "paramètres invalides (%s)",
+		"es": "parámetros inválidos (%s)",
+	}},
+}
+
+// render formats code in lang, falling back to English, behind its
+// untranslated prefix.
+func render(lang string, code msgCode, args ...interface{}) string {
+	entry, ok := messageCatalog[code]
+	if !ok {
+		log.Printf("[messages] Unknown message code %q", code)
+		return "error: " + string(code)
+	}
+	text, ok := entry.text[lang]
+	if !ok {
+		text = entry.text[defaultLanguage]
+	}
+	return entry.prefix + ": " + fmt.Sprintf(text, args...)
+}
+
+// say renders code for the user of a relay connection.
+func say(ctx context.Context, code msgCode, args ...interface{}) string {
+	var r *http.Request
+	if ws := khatru.GetConnection(ctx); ws != nil {
+		r = ws.Request
+	}
+	return render(requestLanguage(ctx, getAuthenticatedPubkey(ctx), r), code, args...)
+}
+
+// httpError writes code as the error of an HTTP request made by pubkey
+// ("" when not known).
+func httpError(w http.ResponseWriter, r *http.Request, pubkey string, status int, code msgCode, args ...interface{}) {
+	http.Error(w, render(requestLanguage(r.Context(), pubkey, r), code, args...), status)
+}
+
+// requestLanguage picks the language for pubkey on request r (either may be
+// empty).
+func requestLanguage(ctx context.Context, pubkey string, r *http.Request) string {
+	if pubkey != "" {
+		if lang := storedLanguage(ctx, pubkey); lang != "" {
+			return lang
+		}
+	}
+	if r != nil {
+		if lang := supportedLanguage(r.URL.Query().Get("lang")); lang != "" {
+			return lang
+		}
+		if lang := acceptedLanguage(r.Header.Get("Accept-Language")); lang != "" {
+			return lang
+		}
+	}
+	return defaultLanguage
+}
+
+// storedLanguage returns pubkey's language preference, if it set one.
+func storedLanguage(ctx context.Context, pubkey string) string {
+	var lang string
+	err := db.QueryRowContext(ctx, `
+		SELECT x->>1 FROM events, jsonb_array_elements(tags) x
+		WHERE kind = $1 AND pubkey = $2 AND d_tag = $3 AND community = $4 AND x->>0 = 'lang'
+		LIMIT 1
+	`, KindAppData, pubkey, languagePrefsDTag, communityOf(ctx).id()).Scan(&lang)
+	if err != nil {
+		return ""
+	}
+	return supportedLanguage(lang)
+}
+
+// supportedLanguage maps a language tag ("fr", "es-MX") to a supported
+// language, or "".
+func supportedLanguage(tag string) string {
+	base, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+	for _, lang := range supportedLanguages {
+		if base == lang {
+			return lang
+		}
+	}
+	return ""
+}
+
+// acceptedLanguage picks the supported language an Accept-Language header
+// ranks highest, or "".
+func acceptedLanguage(header string) string {
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		lang := supportedLanguage(tag)
+		if lang == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			choices = append(choices, choice{lang, q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	if len(choices) == 0 {
+		return ""
+	}
+	return choices[0].lang
+}
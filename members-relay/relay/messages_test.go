@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// declaredMessageCodes reads the msgCode constants out of messages.go, so a
+// code added without a catalog entry fails the test below.
+func declaredMessageCodes(t *testing.T) []msgCode {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), "messages.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codes []msgCode
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			vs := spec.(*ast.ValueSpec)
+			if ident, ok := vs.Type.(*ast.Ident); !ok || ident.Name != "msgCode" {
+				continue
+			}
+			for _, v := range vs.Values {
+				code, _ := strconv.Unquote(v.(*ast.BasicLit).Value)
+				codes = append(codes, msgCode(code))
+			}
+		}
+	}
+	return codes
+}
+
+func TestCatalogCoversEveryCode(t *testing.T) {
+	codes := declaredMessageCodes(t)
+	if len(codes) != len(messageCatalog) {
+		t.Errorf("%d codes declared, %d in the catalog", len(codes), len(messageCatalog))
+	}
+	prefixes := map[string]bool{"auth-required": true, "restricted": true, "invalid": true, "duplicate": true, "error": true, "blocked": true, "rate-limited": true, "pow": true, "pending": true}
+	verbs := regexp.MustCompile(`%[a-z]`)
+	for _, code := range codes {
+		entry, ok := messageCatalog[code]
+		if !ok {
+			t.Errorf("%s: no catalog entry", code)
+			continue
+		}
+		if !prefixes[entry.prefix] {
+			t.Errorf("%s: %q is not a NIP-01 prefix", code, entry.prefix)
+		}
+		want := strings.Join(verbs.FindAllString(entry.text[defaultLanguage], -1), "")
+		for _, lang := range supportedLanguages {
+			text := entry.text[lang]
+			if text == "" {
+				t.Errorf("%s: no %s text", code, lang)
+			}
+			if got := strings.Join(verbs.FindAllString(text, -1), ""); got != want {
+				t.Errorf("%s: %s takes %q, English takes %q", code, lang, got, want)
+			}
+		}
+	}
+}
+
+func TestRenderKeepsPrefix(t *testing.T) {
+	if got := render("fr", msgMembershipRequired); got != "restricted: adhésion requise" {
+		t.Fatalf("French: %q", got)
+	}
+	if got := render("es", msgLiveStatusBackwards, "ended", "live"); got != "invalid: el directo no puede volver de ended a live" {
+		t.Fatalf("Spanish with arguments: %q", got)
+	}
+	if got := render("de", msgAuthPlease); got != "auth-required: please authenticate" {
+		t.Fatalf("unsupported language did not fall back to English: %q", got)
+	}
+}
+
+func TestAcceptedLanguage(t *testing.T) {
+	for header, want := range map[string]string{
+		"fr-FR,fr;q=0.9,en;q=0.8":  "fr",
+		"de-DE,es;q=0.5,en;q=0.7":  "en",
+		"es-MX":                    "es",
+		"de, it;q=0.5":             "",
+		"en;q=0.2, fr;q=0, es;q=1": "es",
+		"":                         "",
+	} {
+		if got := acceptedLanguage(header); got != want {
+			t.Errorf("%q: got %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestRequestLanguageHints(t *testing.T) {
+	ctx := context.Background()
+	r := httptest.NewRequest("GET", "/", nil)
+	if got := requestLanguage(ctx, "", r); got != "en" {
+		t.Fatalf("no hint: %q", got)
+	}
+	r.Header.Set("Accept-Language", "es-ES,es;q=0.9")
+	if got := requestLanguage(ctx, "", r); got != "es" {
+		t.Fatalf("Accept-Language: %q", got)
+	}
+	r = httptest.NewRequest("GET", "/?lang=fr", nil)
+	r.Header.Set("Accept-Language", "es-ES,es;q=0.9")
+	if got := requestLanguage(ctx, "", r); got != "fr" {
+		t.Fatalf("?lang= should win over the header: %q", got)
+	}
+}
+
+func TestStoredLanguageWins(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	r := httptest.NewRequest("GET", "/?lang=es", nil)
+	if got := requestLanguage(ctx, pk, r); got != "es" {
+		t.Fatalf("without a preference: %q", got)
+	}
+	prefs := signedEvent(t, sk, KindAppData, nostr.Now(), nostr.Tags{{"d", languagePrefsDTag}, {"lang", "fr"}}, "")
+	if err := persistEvent(ctx, prefs); err != nil {
+		t.Fatal(err)
+	}
+	if got := requestLanguage(ctx, pk, r); got != "fr" {
+		t.Fatalf("stored preference: %q", got)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// PUBLIC MIRROR
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// recipes.zap.cooking serves the public recipe corpus without any of the
+// members policy: a second khatru relay over the same storage that answers
+// only kind 30023 and public groups' 39000, rejects every EVENT with a
+// pointer to the members endpoint, never asks for NIP-42 and has its own
+// NIP-11 document. It listens on RELAY_MIRROR_PORT, and/or takes requests
+// whose Host is in RELAY_MIRROR_HOSTS on the main port. New recipes reach
+// its live subscriptions through storeEvent; group metadata, which the
+// group sync writes directly, is served on query only.
+
+type mirrorConfig struct {
+	Port        string
+	Hosts       []string
+	Name        string
+	Description string
+	MainURL     string // where writes should go instead
+}
+
+var (
+	mirrorCfg mirrorConfig
+	mirror    *khatru.Relay // nil unless configured
+
+	mirrorConnections = &connTracker{conns: make(map[*khatru.WebSocket]*trackedConn)}
+
+	// listenerTraffic counts connections, REQ filters and EVENTs per
+	// listener ("members", "mirror") under /debug/vars.
+	listenerTraffic = expvar.NewMap("listener_traffic")
+)
+
+func loadMirrorConfig() {
+	mirrorCfg = mirrorConfig{
+		Port:        envOr("RELAY_MIRROR_PORT", ""),
+		Hosts:       splitList(envOr("RELAY_MIRROR_HOSTS", "")),
+		Name:        envOr("RELAY_MIRROR_NAME", "Zap.Cooking Recipes"),
+		Description: envOr("RELAY_MIRROR_DESCRIPTION", "Read-only mirror of the public zap.cooking recipe corpus."),
+		MainURL:     envOr("RELAY_MIRROR_MAIN_URL", "wss://members.zap.cooking"),
+	}
+}
+
+func (c mirrorConfig) enabled() bool {
+	return c.Port != "" || len(c.Hosts) > 0
+}
+
+// isMirrorHost reports whether a request on the main port is for the mirror.
+func (c mirrorConfig) isMirrorHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, h := range c.Hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// countTraffic returns hooks counting one listener's traffic.
+func countTraffic(listener string) (onConnect func(context.Context), onFilter func(context.Context, nostr.Filter) (bool, string), onEvent func(context.Context, *nostr.Event) (bool, string)) {
+	onConnect = func(context.Context) { listenerTraffic.Add(listener+".connections", 1) }
+	onFilter = func(context.Context, nostr.Filter) (bool, string) {
+		listenerTraffic.Add(listener+".filters", 1)
+		return false, ""
+	}
+	onEvent = func(context.Context, *nostr.Event) (bool, string) {
+		listenerTraffic.Add(listener+".events", 1)
+		return false, ""
+	}
+	return onConnect, onFilter, onEvent
+}
+
+func newMirrorRelay(cfg mirrorConfig) *khatru.Relay {
+	rl := khatru.NewRelay()
+	rl.Info.Name = cfg.Name
+	rl.Info.Description = cfg.Description
+	rl.Info.PubKey = relaySigningPubkey
+	if rl.Info.PubKey == "" {
+		rl.Info.PubKey = adminPubkey
+	}
+	rl.Info.Contact = relayContact
+	rl.Info.SupportedNIPs = []int{1, 11}
+	rl.Info.Software = "khatru-members"
+	rl.Info.Version = "1.0.0"
+	rl.Info.Limitation = &nip11.RelayLimitationDocument{
+		MaxMessageLength: limits.MaxMessageLength,
+		MaxSubscriptions: limits.MaxSubscriptions,
+		MaxFilters:       limits.MaxFilters,
+		RestrictedWrites: true,
+	}
+	rl.MaxMessageSize = int64(limits.MaxMessageLength)
+
+	onConnect, onFilter, onEvent := countTraffic("mirror")
+	rl.QueryEvents = append(rl.QueryEvents, dedupQuery(queryMirror))
+	rl.RejectEvent = append(rl.RejectEvent, onEvent, mirrorConnections.touchEvent, rejectMirrorEvent(cfg))
+	rl.OverwriteDeletionOutcome = append(rl.OverwriteDeletionOutcome, refuseMirrorDeletion)
+	rl.RejectFilter = append(rl.RejectFilter, onFilter, mirrorConnections.touchFilter, mirrorConnections.limitREQRate, rejectMirrorFilter, mirrorConnections.limitFilter)
+	rl.OverwriteFilter = append(rl.OverwriteFilter, trackREQ, mirrorConnections.meterREQ, rejectLiveFilter(rejectMirrorFilter), mirrorConnections.limitLiveFilter)
+	rl.OnConnect = append(rl.OnConnect, onConnect, mirrorConnections.onConnect)
+	rl.OnDisconnect = append(rl.OnDisconnect, mirrorConnections.onDisconnect)
+
+	wsCfg := serverCfg
+	wsCfg.AuthOnConnect = false
+	applyWebsocketConfig(rl, wsCfg)
+	return rl
+}
+
+func rejectMirrorEvent(cfg mirrorConfig) func(context.Context, *nostr.Event) (bool, string) {
+	return func(context.Context, *nostr.Event) (bool, string) {
+		return true, "blocked: this is a read-only mirror; publish to " + cfg.MainURL
+	}
+}
+
+// refuseMirrorDeletion refuses kind 5 requests, which khatru handles
+// without consulting RejectEvent, for any event the mirror finds.
+func refuseMirrorDeletion(context.Context, *nostr.Event, *nostr.Event) (bool, string) {
+	return false, "read-only mirror"
+}
+
+// isMirrorKind reports the kinds the mirror serves.
+func isMirrorKind(kind int) bool {
+	return kind == KindRecipe || kind == KindGroupMetadata
+}
+
+// rejectMirrorFilter allows only filters confined to the mirror's kinds.
+func rejectMirrorFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	if len(filter.Kinds) == 0 {
+		return true, "restricted: this mirror only serves kinds 30023 and 39000"
+	}
+	for _, k := range filter.Kinds {
+		if !isMirrorKind(k) {
+			return true, "restricted: this mirror only serves kinds 30023 and 39000"
+		}
+	}
+	return false, ""
+}
+
+// isMirrored reports whether the mirror may show event: recipes not shared
+// in a group, and the metadata of public groups.
+func isMirrored(event *nostr.Event) bool {
+	switch event.Kind {
+	case KindRecipe:
+		return !isGroupScoped(event)
+	case KindGroupMetadata:
+		return event.PubKey == relaySigningPubkey && event.Tags.GetFirst([]string{"private"}) == nil
+	}
+	return false
+}
+
+// queryMirror reads from the shared storage as an anonymous viewer. Private
+// groups' metadata is dropped after the query, so such a page may come back
+// short of the filter's limit.
+func queryMirror(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	in, err := queryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan *nostr.Event)
+	go func() {
+		defer close(out)
+		for event := range in {
+			if !isMirrored(event) {
+				continue
+			}
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// mirrorEvent passes an event stored through the members relay on to the
+// mirror's subscriptions.
+func mirrorEvent(event *nostr.Event) {
+	if mirror != nil && isMirrored(event) {
+		mirror.BroadcastEvent(event)
+	}
+}
+
+// startMirror builds the mirror relay and, with RELAY_MIRROR_PORT, its own
+// listener.
+func startMirror(ctx context.Context) {
+	if !mirrorCfg.enabled() {
+		return
+	}
+	mirror = newMirrorRelay(mirrorCfg)
+	go mirrorConnections.runIdleReaper(ctx, serverCfg)
+	if len(mirrorCfg.Hosts) > 0 {
+		log.Printf("[mirror] Serving hosts %s on the main port", strings.Join(mirrorCfg.Hosts, ", "))
+	}
+	if mirrorCfg.Port == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", mirror)
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+	server := newHTTPServer(":"+mirrorCfg.Port, mux, serverCfg)
+	log.Printf("[mirror] Starting read-only mirror on port %s", mirrorCfg.Port)
+	go func() {
+		if err := listenAndServe(server); err != nil {
+			log.Fatal("Failed to start mirror:", err)
+		}
+	}()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+func TestMirrorHost(t *testing.T) {
+	cfg := mirrorConfig{Hosts: []string{"recipes.zap.cooking"}}
+	for host, want := range map[string]bool{
+		"recipes.zap.cooking":      true,
+		"Recipes.Zap.Cooking:443":  true,
+		"members.zap.cooking":      false,
+		"recipes.zap.cooking.evil": false,
+	} {
+		if got := cfg.isMirrorHost(host); got != want {
+			t.Errorf("isMirrorHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestRejectMirrorFilter(t *testing.T) {
+	for _, tc := range []struct {
+		filter nostr.Filter
+		reject bool
+	}{
+		{nostr.Filter{Kinds: []int{KindRecipe}}, false},
+		{nostr.Filter{Kinds: []int{KindRecipe, KindGroupMetadata}}, false},
+		{nostr.Filter{}, true},
+		{nostr.Filter{Authors: []string{strings.Repeat("a", 64)}}, true},
+		{nostr.Filter{Kinds: []int{KindRecipe, 1}}, true},
+		{nostr.Filter{Kinds: []int{KindGroupMembers}}, true},
+	} {
+		if reject, _ := rejectMirrorFilter(context.Background(), tc.filter); reject != tc.reject {
+			t.Errorf("filter %v: reject = %v, want %v", tc.filter, reject, tc.reject)
+		}
+	}
+}
+
+func TestIsMirrored(t *testing.T) {
+	savedSigning := relaySigningPubkey
+	defer func() { relaySigningPubkey = savedSigning }()
+	relaySigningPubkey = strings.Repeat("r", 64)
+	other := strings.Repeat("o", 64)
+
+	for _, tc := range []struct {
+		name  string
+		event nostr.Event
+		want  bool
+	}{
+		{"recipe", nostr.Event{Kind: KindRecipe, PubKey: other}, true},
+		{"public group", nostr.Event{Kind: KindGroupMetadata, PubKey: relaySigningPubkey, Tags: nostr.Tags{{"d", "g"}}}, true},
+		{"private group", nostr.Event{Kind: KindGroupMetadata, PubKey: relaySigningPubkey, Tags: nostr.Tags{{"d", "g"}, {"private"}}}, false},
+		{"group metadata not from the relay", nostr.Event{Kind: KindGroupMetadata, PubKey: other}, false},
+		{"note", nostr.Event{Kind: 1, PubKey: other}, false},
+	} {
+		if got := isMirrored(&tc.event); got != tc.want {
+			t.Errorf("%s: isMirrored = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMirrorRelay(t *testing.T) {
+	savedCfg, savedLimits := serverCfg, limits
+	defer func() { serverCfg, limits = savedCfg, savedLimits }()
+	serverCfg = testServerConfig(true)
+	limits = relayLimits{MaxMessageLength: 64 << 10, MaxSubscriptions: 4, MaxFilters: 4}
+
+	sk := nostr.GeneratePrivateKey()
+	recipe := signedEvent(t, sk, KindRecipe, nostr.Now(), nostr.Tags{{"d", "soup"}}, "soup")
+	rl := newMirrorRelay(mirrorConfig{Name: "Recipes", MainURL: "wss://members.example"})
+	rl.QueryEvents = []func(context.Context, nostr.Filter) (chan *nostr.Event, error){
+		func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+			ch := make(chan *nostr.Event, 1)
+			if filter.Matches(recipe) {
+				ch <- recipe
+			}
+			close(ch)
+			return ch, nil
+		},
+	}
+
+	url := startTestServer(t, rl, serverCfg)
+
+	t.Run("serves its own NIP-11 document", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, "http"+strings.TrimPrefix(url, "ws"), nil)
+		req.Header.Set("Accept", "application/nostr+json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var info nip11.RelayInformationDocument
+		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+		if info.Name != "Recipes" || info.Limitation == nil || info.Limitation.AuthRequired || !info.Limitation.RestrictedWrites {
+			t.Fatalf("unexpected mirror document: %+v", info)
+		}
+		for _, nip := range info.SupportedNIPs {
+			if nip == 42 || nip == 29 {
+				t.Fatalf("mirror advertises NIP-%d", nip)
+			}
+		}
+	})
+
+	c := dialTestRelay(t, url)
+
+	if got := c.req("recipes", `{"kinds":[30023]}`); got != "EOSE" {
+		t.Fatalf("recipe read: %s", got)
+	}
+	if got := c.req("notes", `{"kinds":[1]}`); !strings.HasPrefix(got, "restricted:") {
+		t.Fatalf("note read: %s", got)
+	}
+
+	note := signedEvent(t, sk, 1, nostr.Now(), nil, "hi")
+	raw, _ := nostr.EventEnvelope{Event: *note}.MarshalJSON()
+	c.send(string(raw))
+	env := c.next(func(env nostr.Envelope) bool {
+		ok, isOK := env.(*nostr.OKEnvelope)
+		return isOK && ok.EventID == note.ID
+	}).(*nostr.OKEnvelope)
+	if env.OK || !strings.Contains(env.Reason, "wss://members.example") {
+		t.Fatalf("EVENT on the mirror: ok=%v %q", env.OK, env.Reason)
+	}
+
+	deletion := signedEvent(t, sk, nostr.KindDeletion, nostr.Now(), nostr.Tags{{"e", recipe.ID}}, "")
+	raw, _ = nostr.EventEnvelope{Event: *deletion}.MarshalJSON()
+	c.send(string(raw))
+	env = c.next(func(env nostr.Envelope) bool {
+		ok, isOK := env.(*nostr.OKEnvelope)
+		return isOK && ok.EventID == deletion.ID
+	}).(*nostr.OKEnvelope)
+	if env.OK || env.Reason != "blocked: read-only mirror" {
+		t.Fatalf("deletion on the mirror: ok=%v %q", env.OK, env.Reason)
+	}
+
+	if len(c.challenges) != 0 {
+		t.Fatalf("mirror sent AUTH challenges: %v", c.challenges)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// RELAY MONITORING (NIP-66)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// zap.cooking runs several relays and watches them with NIP-66 monitoring
+// clients. With RELAY_MONITORING_INTERVAL set and a relay signer, the relay
+// reports on itself every interval: a kind 30166 discovery event for
+// RELAY_MONITORING_URL carrying its NIP-11 document (software and version
+// included), supported NIPs, the database round trip in rtt-db and its open
+// connections, and a kind 10166 announcement of itself as that event's
+// monitor. Both go to RELAY_MONITORING_RELAYS through the pool; a round no
+// relay accepted is logged and the next one tries again.
+
+const (
+	KindRelayMonitor   = 10166
+	KindRelayDiscovery = 30166
+)
+
+type monitoringConfig struct {
+	Interval time.Duration // 0 disables monitoring
+	URL      string        // the d tag of the discovery event
+	Relays   []string      // where reports are published
+}
+
+var monitoringCfg monitoringConfig
+
+func loadMonitoringConfig() {
+	monitoringCfg = monitoringConfig{
+		Interval: envDuration("RELAY_MONITORING_INTERVAL", 0),
+		URL:      envOr("RELAY_MONITORING_URL", "wss://members.zap.cooking"),
+		Relays:   splitList(envOr("RELAY_MONITORING_RELAYS", "wss://relay.nostr.watch,wss://nos.lol")),
+	}
+}
+
+// relayHealth is what one monitoring round measured.
+type relayHealth struct {
+	DBRoundTrip       time.Duration
+	Connections       int
+	MirrorConnections int
+}
+
+// relayDiscovery returns the unsigned 30166 describing the relay at cfg.URL.
+func relayDiscovery(cfg monitoringConfig, info nip11.RelayInformationDocument, health relayHealth) nostr.Event {
+	doc, _ := json.Marshal(newRelayInfoDocument(info, limits))
+	tags := nostr.Tags{
+		{"d", cfg.URL},
+		{"n", "clearnet"},
+		{"rtt-db", strconv.FormatInt(health.DBRoundTrip.Milliseconds(), 10)},
+		{"connections", strconv.Itoa(health.Connections)},
+	}
+	if mirror != nil {
+		tags = append(tags, nostr.Tag{"connections", strconv.Itoa(health.MirrorConnections), "mirror"})
+	}
+	for _, nip := range info.SupportedNIPs {
+		tags = append(tags, nostr.Tag{"N", fmt.Sprint(nip)})
+	}
+	if limits.AuthRequired {
+		tags = append(tags, nostr.Tag{"R", "auth"})
+	} else {
+		tags = append(tags, nostr.Tag{"R", "!auth"})
+	}
+	return nostr.Event{Kind: KindRelayDiscovery, Content: string(doc), Tags: tags}
+}
+
+// monitorAnnouncement returns the unsigned 10166 announcing the relay as
+// its own monitor.
+func monitorAnnouncement(cfg monitoringConfig) nostr.Event {
+	return nostr.Event{
+		Kind: KindRelayMonitor,
+		Tags: nostr.Tags{{"frequency", strconv.FormatInt(int64(cfg.Interval.Seconds()), 10)}},
+	}
+}
+
+// measureHealth times a database round trip and counts open connections.
+func measureHealth(ctx context.Context) (relayHealth, error) {
+	health := relayHealth{Connections: connections.count(), MirrorConnections: mirrorConnections.count()}
+	start := time.Now()
+	var one int
+	if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		return health, err
+	}
+	health.DBRoundTrip = time.Since(start)
+	return health, nil
+}
+
+// publishMonitoring signs and publishes one round of reports.
+func publishMonitoring(ctx context.Context, cfg monitoringConfig, publish func(context.Context, []string, nostr.Event) error) error {
+	health, err := measureHealth(ctx)
+	if err != nil {
+		return fmt.Errorf("database round trip: %w", err)
+	}
+	relayInfoMu.RLock()
+	info := *relay.Info
+	relayInfoMu.RUnlock()
+
+	discovery, announcement := relayDiscovery(cfg, info, health), monitorAnnouncement(cfg)
+	for _, event := range []*nostr.Event{&announcement, &discovery} {
+		if err := signRelayEvent(event); err != nil {
+			return err
+		}
+		if err := publish(ctx, cfg.Relays, *event); err != nil {
+			return fmt.Errorf("kind %d: %w", event.Kind, err)
+		}
+	}
+	return nil
+}
+
+// runMonitoring reports every monitoringCfg.Interval, starting now.
+func runMonitoring(ctx context.Context) {
+	if monitoringCfg.Interval <= 0 || len(monitoringCfg.Relays) == 0 || !canSignRelayEvents() {
+		return
+	}
+	publish := poolPublisher()
+	ticker := time.NewTicker(monitoringCfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := publishMonitoring(ctx, monitoringCfg, publish); err != nil {
+			log.Printf("[NIP-66] Error publishing monitoring report: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
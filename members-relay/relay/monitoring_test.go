@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+func TestRelayDiscovery(t *testing.T) {
+	cfg := monitoringConfig{Interval: 15 * time.Minute, URL: "wss://members.zap.cooking"}
+	info := nip11.RelayInformationDocument{Name: "The Pantry", Software: "khatru-members", Version: "1.0.0", SupportedNIPs: []int{1, 29, 42}}
+	event := relayDiscovery(cfg, info, relayHealth{DBRoundTrip: 3 * time.Millisecond, Connections: 12})
+
+	if event.Kind != KindRelayDiscovery || event.Tags.GetD() != cfg.URL {
+		t.Fatalf("not a discovery event for %s: %+v", cfg.URL, event)
+	}
+	for _, want := range []nostr.Tag{{"rtt-db", "3"}, {"connections", "12"}, {"N", "29"}, {"n", "clearnet"}} {
+		if tag := event.Tags.GetFirst(want); tag == nil {
+			t.Errorf("missing %v in %v", want, event.Tags)
+		}
+	}
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(event.Content), &doc); err != nil || doc["software"] != "khatru-members" || doc["version"] != "1.0.0" {
+		t.Fatalf("content is not the NIP-11 document: %s", event.Content)
+	}
+
+	announcement := monitorAnnouncement(cfg)
+	if announcement.Kind != KindRelayMonitor || announcement.Tags.GetFirst([]string{"frequency", "900"}) == nil {
+		t.Fatalf("announcement %+v", announcement)
+	}
+}
+
+func TestPublishMonitoring(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	prevRelay := relay
+	relay = khatru.NewRelay()
+	relay.Info.SupportedNIPs = []int{1, 66}
+	t.Cleanup(func() { relay = prevRelay })
+
+	cfg := monitoringConfig{Interval: time.Hour, URL: "wss://members.zap.cooking", Relays: []string{"wss://monitor.example"}}
+	var published []nostr.Event
+	publish := func(_ context.Context, urls []string, event nostr.Event) error {
+		if len(urls) != 1 || urls[0] != "wss://monitor.example" {
+			t.Errorf("published to %v", urls)
+		}
+		published = append(published, event)
+		return nil
+	}
+	if err := publishMonitoring(context.Background(), cfg, publish); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 2 || published[0].Kind != KindRelayMonitor || published[1].Kind != KindRelayDiscovery {
+		t.Fatalf("published %v", published)
+	}
+	for _, event := range published {
+		if ok, _ := event.CheckSignature(); !ok || event.PubKey != relaySigningPubkey {
+			t.Fatalf("kind %d not signed by the relay", event.Kind)
+		}
+	}
+	if published[1].Tags.GetFirst([]string{"rtt-db", ""}) == nil {
+		t.Fatal("no database round trip")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// NIP-98 HTTP AUTH
+// ═══════════════════════════════════════════════════════════════════════════════
+
+const (
+	kindHTTPAuth  = 27235
+	nip98MaxSkew  = 60 * time.Second
+	nip98MaxBytes = 16 << 10
+)
+
+// nip98Pubkey authenticates r from its "Authorization: Nostr <base64 event>"
+// header: a signed kind 27235 whose u and method tags match this request and
+// whose created_at is within a minute of now. The URL is rebuilt from the
+// forwarded scheme/host so it matches what the client saw behind Caddy.
+func nip98Pubkey(r *http.Request) (string, error) {
+	event, err := nip98Event(r)
+	if err != nil {
+		return "", err
+	}
+	return event.PubKey, nil
+}
+
+// nip98Event returns r's verified authorization event.
+func nip98Event(r *http.Request) (*nostr.Event, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Nostr ") {
+		return nil, errors.New("missing NIP-98 authorization")
+	}
+	encoded := strings.TrimSpace(strings.TrimPrefix(header, "Nostr "))
+	if len(encoded) > nip98MaxBytes {
+		return nil, errors.New("authorization event too large")
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("authorization is not base64")
+	}
+	var event nostr.Event
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return nil, errors.New("authorization is not a nostr event")
+	}
+
+	if event.Kind != kindHTTPAuth {
+		return nil, errors.New("authorization event must be kind 27235")
+	}
+	if skew := time.Since(event.CreatedAt.Time()); skew > nip98MaxSkew || skew < -nip98MaxSkew {
+		return nil, errors.New("authorization event expired")
+	}
+	if tag := event.Tags.GetFirst([]string{"u", ""}); tag == nil || !sameRequestURL((*tag)[1], requestURL(r)) {
+		return nil, errors.New("authorization url mismatch")
+	}
+	if tag := event.Tags.GetFirst([]string{"method", ""}); tag == nil || !strings.EqualFold((*tag)[1], r.Method) {
+		return nil, errors.New("authorization method mismatch")
+	}
+	if !event.CheckID() {
+		return nil, errors.New("authorization event id is invalid")
+	}
+	if ok, err := event.CheckSignature(); err != nil || !ok {
+		return nil, errors.New("authorization signature is invalid")
+	}
+	return &event, nil
+}
+
+// nip98ViewerKey carries the pubkey a request authenticated as with NIP-98
+// to code shared with relay connections, which reads it with
+// getAuthenticatedPubkey.
+type nip98ViewerKey struct{}
+
+// ─── Admin routes ────────────────────────────────────────────────────────────
+
+// Everything under /admin/ goes through requireNIP98Admin. On top of
+// nip98Pubkey it takes each authorization event once: a captured header
+// cannot repeat an admin action while it is still within the skew.
+
+type nip98AdminKey struct{}
+
+// nip98Spent holds the ids of the admin authorization events already used,
+// until their created_at falls out of the skew window.
+var nip98Spent = struct {
+	sync.Mutex
+	ids map[string]time.Time
+}{ids: make(map[string]time.Time)}
+
+// spendNIP98Event reports whether event is used for the first time and
+// marks it used.
+func spendNIP98Event(event *nostr.Event) bool {
+	nip98Spent.Lock()
+	defer nip98Spent.Unlock()
+	now := time.Now()
+	for id, until := range nip98Spent.ids {
+		if now.After(until) {
+			delete(nip98Spent.ids, id)
+		}
+	}
+	if _, ok := nip98Spent.ids[event.ID]; ok {
+		return false
+	}
+	nip98Spent.ids[event.ID] = event.CreatedAt.Time().Add(nip98MaxSkew)
+	return true
+}
+
+// requireNIP98Admin lets through requests authenticated with NIP-98 as the
+// relay admin of their community, which is adminPubkey on the main relay.
+// next reads the pubkey with nip98Admin.
+func requireNIP98Admin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event, err := nip98Event(r)
+		if err != nil {
+			httpError(w, r, "", http.StatusUnauthorized, msgAuthFailed, err)
+			return
+		}
+		if event.PubKey != communityAdmin(r.Context()) {
+			httpError(w, r, event.PubKey, http.StatusForbidden, msgRelayAdminOnly)
+			return
+		}
+		if !spendNIP98Event(event) {
+			httpError(w, r, "", http.StatusUnauthorized, msgAuthFailed, errors.New("authorization event already used"))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), nip98AdminKey{}, event.PubKey)))
+	})
+}
+
+// nip98Admin returns the admin pubkey requireNIP98Admin authenticated.
+func nip98Admin(r *http.Request) string {
+	pubkey, _ := r.Context().Value(nip98AdminKey{}).(string)
+	return pubkey
+}
+
+// requestURL reconstructs the absolute URL the client requested.
+func requestURL(r *http.Request) string {
+	scheme := r.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	return scheme + "://" + host + r.URL.RequestURI()
+}
+
+func sameRequestURL(a, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
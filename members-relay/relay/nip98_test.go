@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func nip98Header(t *testing.T, sk, url, method string, at nostr.Timestamp) string {
+	t.Helper()
+	event := signedEvent(t, sk, kindHTTPAuth, at, nostr.Tags{{"u", url}, {"method", method}}, "")
+	raw, _ := json.Marshal(event)
+	return "Nostr " + base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestNIP98Pubkey(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	const url = "https://members.zap.cooking/api/follows/followers"
+	now := nostr.Now()
+
+	cases := []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"valid", nip98Header(t, sk, url, "GET", now), true},
+		{"trailing slash", nip98Header(t, sk, url+"/", "GET", now), true},
+		{"wrong url", nip98Header(t, sk, "https://members.zap.cooking/api/follows/mutuals", "GET", now), false},
+		{"wrong method", nip98Header(t, sk, url, "POST", now), false},
+		{"expired", nip98Header(t, sk, url, "GET", now-120), false},
+		{"missing", "", false},
+		{"not base64", "Nostr !!!", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/follows/followers", nil)
+			r.Header.Set("X-Forwarded-Proto", "https")
+			r.Header.Set("X-Forwarded-Host", "members.zap.cooking")
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			got, err := nip98Pubkey(r)
+			if tc.ok && (err != nil || got != pk) {
+				t.Fatalf("expected %s, got %q (%v)", pk, got, err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatal("accepted")
+			}
+		})
+	}
+}
+
+func TestRequireNIP98Admin(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	defer func(old string) { adminPubkey = old }(adminPubkey)
+	adminPubkey = pk
+	const url = "https://members.zap.cooking/admin/featured"
+	now := nostr.Now()
+
+	var served string
+	handler := requireNIP98Admin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = nip98Admin(r)
+	}))
+	do := func(header string) int {
+		t.Helper()
+		served = ""
+		r := httptest.NewRequest("POST", "/admin/featured", nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "members.zap.cooking")
+		r.Header.Set("Authorization", header)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := do(nip98Header(t, sk, url, "POST", now-120)); code != http.StatusUnauthorized || served != "" {
+		t.Fatalf("expired: %d", code)
+	}
+	if code := do(nip98Header(t, sk, "https://members.zap.cooking/admin/badges", "POST", now)); code != http.StatusUnauthorized || served != "" {
+		t.Fatalf("wrong url: %d", code)
+	}
+	header := nip98Header(t, sk, url, "POST", now)
+	if code := do(header); code != http.StatusOK || served != pk {
+		t.Fatalf("valid: %d, served %q", code, served)
+	}
+	if code := do(header); code != http.StatusUnauthorized || served != "" {
+		t.Fatalf("replayed: %d", code)
+	}
+	if code := do(nip98Header(t, sk, url, "POST", now-1)); code != http.StatusOK || served != pk {
+		t.Fatalf("fresh event: %d", code)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// PROFILE HYDRATION
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Group chat shows raw npubs for participants whose kind 0 never reached this
+// relay. The hydrator fetches kind 0 and 10002 for them from public indexer
+// relays. Pubkeys are only ever queued because of something that happened
+// here (joining a group, chatting, being added), and the worker re-checks
+// that relationship in the database before any outbound request, so the
+// relay never crawls arbitrary keys. profile_fetches remembers when each
+// pubkey was last fetched, found or not.
+
+const profileFetchBatch = 50
+
+var (
+	profileQueueDropped = expvar.NewInt("profile_queue_dropped")
+	profileFetched      = expvar.NewInt("profile_events_fetched")
+)
+
+type profileHydrator struct {
+	maxAge   time.Duration // refetch profiles fetched longer ago than this
+	interval time.Duration // minimum gap between outbound fetches
+
+	queue chan string
+
+	mu      sync.Mutex
+	pending map[string]bool      // queued, not yet drained
+	checked map[string]time.Time // drained recently; skip until maxAge passes
+
+	// fetch asks the indexers for kinds 0 and 10002 by the given authors.
+	fetch func(ctx context.Context, pubkeys []string) []*nostr.Event
+}
+
+// profiles is nil when hydration is disabled (RELAY_PROFILE_INDEXERS="").
+var profiles *profileHydrator
+
+func loadProfileConfig() {
+	indexers := splitList(envOr("RELAY_PROFILE_INDEXERS", "wss://purplepag.es,wss://relay.nostr.band"))
+	if len(indexers) == 0 {
+		return
+	}
+	profiles = newProfileHydrator(
+		envInt("RELAY_PROFILE_QUEUE_SIZE", 1000),
+		envDuration("RELAY_PROFILE_MAX_AGE", 7*24*time.Hour),
+		envDuration("RELAY_PROFILE_FETCH_INTERVAL", 2*time.Second),
+		poolFetcher(indexers),
+	)
+}
+
+func newProfileHydrator(queueSize int, maxAge, interval time.Duration,
+	fetch func(context.Context, []string) []*nostr.Event) *profileHydrator {
+	return &profileHydrator{
+		maxAge:   maxAge,
+		interval: interval,
+		queue:    make(chan string, queueSize),
+		pending:  make(map[string]bool),
+		checked:  make(map[string]time.Time),
+		fetch:    fetch,
+	}
+}
+
+// poolFetcher queries the indexers in parallel and returns whatever arrives
+// before EOSE or the timeout.
+func poolFetcher(indexers []string) func(context.Context, []string) []*nostr.Event {
+	pool := nostr.NewSimplePool(context.Background())
+	return func(ctx context.Context, pubkeys []string) []*nostr.Event {
+		ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		defer cancel()
+		filter := nostr.Filter{Kinds: []int{nostr.KindProfileMetadata, nostr.KindRelayListMetadata}, Authors: pubkeys}
+		var events []*nostr.Event
+		for ie := range pool.SubManyEose(ctx, indexers, nostr.Filters{filter}) {
+			events = append(events, ie.Event)
+		}
+		return events
+	}
+}
+
+// notice queues pubkey unless it is already queued, was checked within
+// maxAge, or the queue is full. It never blocks.
+func (h *profileHydrator) notice(pubkey string) {
+	if h == nil || !nostr.IsValid32ByteHex(pubkey) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pending[pubkey] {
+		return
+	}
+	if at, ok := h.checked[pubkey]; ok && time.Since(at) < h.maxAge {
+		return
+	}
+	select {
+	case h.queue <- pubkey:
+		h.pending[pubkey] = true
+	default:
+		profileQueueDropped.Add(1)
+	}
+}
+
+// noticeEvent queues the participants a stored event introduces.
+func (h *profileHydrator) noticeEvent(event *nostr.Event) {
+	switch {
+	case isGroupChatEvent(event.Kind), event.Kind == KindJoinRequest, event.Kind == KindCreateGroup:
+		h.notice(event.PubKey)
+	case event.Kind == KindPutUser:
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				h.notice(tag[1])
+			}
+		}
+	}
+}
+
+// drain takes up to n queued pubkeys without blocking.
+func (h *profileHydrator) drain(n int) []string {
+	var batch []string
+collect:
+	for len(batch) < n {
+		select {
+		case pk := <-h.queue:
+			batch = append(batch, pk)
+		default:
+			break collect
+		}
+	}
+	now := time.Now()
+	h.mu.Lock()
+	for _, pk := range batch {
+		delete(h.pending, pk)
+		h.checked[pk] = now
+	}
+	h.mu.Unlock()
+	return batch
+}
+
+// prune forgets checks older than maxAge so the map tracks only live keys.
+func (h *profileHydrator) prune(now time.Time) {
+	h.mu.Lock()
+	for pk, at := range h.checked {
+		if now.Sub(at) >= h.maxAge {
+			delete(h.checked, pk)
+		}
+	}
+	h.mu.Unlock()
+}
+
+// acceptProfileEvent reports whether a fetched event may be stored: a valid
+// kind 0 or 10002 by one of the pubkeys we asked about.
+func acceptProfileEvent(event *nostr.Event, wanted map[string]bool) bool {
+	if event.Kind != nostr.KindProfileMetadata && event.Kind != nostr.KindRelayListMetadata {
+		return false
+	}
+	if !wanted[event.PubKey] || !event.CheckID() {
+		return false
+	}
+	ok, err := event.CheckSignature()
+	return err == nil && ok
+}
+
+// dueForFetch narrows pubkeys to those related to this relay that need a
+// fetch: we hold no kind 0 and have not tried recently, or our copy came from
+// a fetch older than maxAge. Profiles published here directly are left alone.
+func (h *profileHydrator) dueForFetch(ctx context.Context, pubkeys []string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT p FROM unnest($1::text[]) AS p
+		LEFT JOIN profile_fetches f ON f.pubkey = p
+		WHERE (
+			f.fetched_at < NOW() - make_interval(secs => $2)
+			OR (f.pubkey IS NULL AND NOT EXISTS (SELECT 1 FROM events e WHERE e.pubkey = p AND e.kind = 0))
+		)
+		AND (
+			EXISTS (SELECT 1 FROM group_members gm JOIN groups g ON g.id = gm.group_id
+				WHERE gm.pubkey = p AND g.community = $4)
+			OR EXISTS (SELECT 1 FROM members m WHERE m.pubkey = p AND m.community = $4)
+			OR EXISTS (SELECT 1 FROM events e WHERE e.pubkey = p AND e.kind = ANY($3::int[]) AND e.community = $4)
+		)
+	`, pq.Array(pubkeys), h.maxAge.Seconds(), pq.Array(groupChatKinds()), defaultCommunityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var due []string
+	for rows.Next() {
+		var pk string
+		if err := rows.Scan(&pk); err != nil {
+			return nil, err
+		}
+		due = append(due, pk)
+	}
+	return due, rows.Err()
+}
+
+// hydrate fetches and stores profiles for one batch of queued pubkeys.
+func (h *profileHydrator) hydrate(ctx context.Context, batch []string) error {
+	due, err := h.dueForFetch(ctx, batch)
+	if err != nil || len(due) == 0 {
+		return err
+	}
+
+	wanted := make(map[string]bool, len(due))
+	for _, pk := range due {
+		wanted[pk] = true
+	}
+	stored := 0
+	for _, event := range h.fetch(ctx, due) {
+		if !acceptProfileEvent(event, wanted) {
+			continue
+		}
+		if err := persistEvent(ctx, event); errors.Is(err, errReplaced) {
+			continue
+		} else if err != nil {
+			log.Printf("[profiles] Error storing kind %d for %s: %v", event.Kind, event.PubKey, err)
+			continue
+		}
+		stored++
+	}
+	profileFetched.Add(int64(stored))
+
+	// Record the attempt even when nothing was found so absent profiles are
+	// not re-requested on every chat message.
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO profile_fetches (pubkey, fetched_at)
+		SELECT p, NOW() FROM unnest($1::text[]) AS p
+		ON CONFLICT (pubkey) DO UPDATE SET fetched_at = EXCLUDED.fetched_at
+	`, pq.Array(due))
+	return err
+}
+
+// queueStale re-queues related pubkeys whose profile is missing or stale.
+func (h *profileHydrator) queueStale(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.pubkey FROM (
+			SELECT gm.pubkey FROM group_members gm JOIN groups g ON g.id = gm.group_id
+			WHERE g.community = $4
+			UNION
+			SELECT pubkey FROM events WHERE kind = ANY($2::int[]) AND community = $4
+		) p
+		LEFT JOIN profile_fetches f ON f.pubkey = p.pubkey
+		WHERE f.fetched_at < NOW() - make_interval(secs => $1)
+		OR (f.pubkey IS NULL AND NOT EXISTS (SELECT 1 FROM events e WHERE e.pubkey = p.pubkey AND e.kind = 0))
+		ORDER BY f.fetched_at NULLS FIRST
+		LIMIT $3
+	`, h.maxAge.Seconds(), pq.Array(groupChatKinds()), cap(h.queue)/2, defaultCommunityID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pk string
+		if err := rows.Scan(&pk); err != nil {
+			return err
+		}
+		h.notice(pk)
+	}
+	return rows.Err()
+}
+
+// run works the queue at most one batch per interval and sweeps for stale
+// profiles hourly.
+func (h *profileHydrator) run(ctx context.Context) {
+	if h == nil {
+		return
+	}
+	log.Printf("[profiles] Hydrating group participant profiles (refresh after %s)", h.maxAge)
+	fetchTick := time.NewTicker(h.interval)
+	defer fetchTick.Stop()
+	sweepTick := time.NewTicker(time.Hour)
+	defer sweepTick.Stop()
+
+	if err := h.queueStale(ctx); err != nil {
+		log.Printf("[profiles] Error scanning for stale profiles: %v", err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-sweepTick.C:
+			h.prune(now)
+			if err := h.queueStale(ctx); err != nil {
+				log.Printf("[profiles] Error scanning for stale profiles: %v", err)
+			}
+		case <-fetchTick.C:
+			batch := h.drain(profileFetchBatch)
+			if len(batch) == 0 {
+				continue
+			}
+			if err := h.hydrate(ctx, batch); err != nil {
+				log.Printf("[profiles] Error hydrating %d profiles: %v", len(batch), err)
+			}
+		}
+	}
+}
+
+func groupChatKinds() []int {
+	return []int{KindGroupChat, KindGroupChatReply, KindGroupChatDelete}
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
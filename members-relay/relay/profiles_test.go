@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestProfileQueueDedupAndCap(t *testing.T) {
+	h := newProfileHydrator(2, time.Hour, time.Second, nil)
+	a, b, c := pubkeys(3)[0], pubkeys(3)[1], pubkeys(3)[2]
+	dropped := profileQueueDropped.Value()
+
+	h.notice(a)
+	h.notice(a)
+	h.notice("not-a-pubkey")
+	h.notice(b)
+	h.notice(c) // queue full
+	if got := profileQueueDropped.Value() - dropped; got != 1 {
+		t.Fatalf("expected 1 dropped pubkey, got %d", got)
+	}
+	if batch := h.drain(10); !reflect.DeepEqual(batch, []string{a, b}) {
+		t.Fatalf("drained %v", batch)
+	}
+
+	// Recently checked keys are not queued again until maxAge passes.
+	h.notice(a)
+	if batch := h.drain(10); len(batch) != 0 {
+		t.Fatalf("recently checked pubkey re-queued: %v", batch)
+	}
+	h.prune(time.Now().Add(2 * time.Hour))
+	h.notice(a)
+	if batch := h.drain(10); !reflect.DeepEqual(batch, []string{a}) {
+		t.Fatalf("pubkey not re-queued after maxAge: %v", batch)
+	}
+}
+
+func TestNoticeEventParticipants(t *testing.T) {
+	h := newProfileHydrator(10, time.Hour, time.Second, nil)
+	keys := pubkeys(3)
+
+	h.noticeEvent(&nostr.Event{Kind: KindRecipe, PubKey: keys[0]})
+	h.noticeEvent(&nostr.Event{Kind: KindGroupChat, PubKey: keys[1]})
+	h.noticeEvent(&nostr.Event{Kind: KindPutUser, PubKey: keys[0], Tags: nostr.Tags{{"h", "g"}, {"p", keys[2], "member"}}})
+	if batch := h.drain(10); !reflect.DeepEqual(batch, []string{keys[1], keys[2]}) {
+		t.Fatalf("queued %v", batch)
+	}
+
+	var disabled *profileHydrator
+	disabled.noticeEvent(&nostr.Event{Kind: KindGroupChat, PubKey: keys[0]})
+}
+
+func TestAcceptProfileEvent(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	wanted := map[string]bool{pk: true}
+
+	profile := signedEvent(t, sk, nostr.KindProfileMetadata, nostr.Now(), nil, `{"name":"cook"}`)
+	if !acceptProfileEvent(profile, wanted) {
+		t.Fatal("valid profile rejected")
+	}
+	if acceptProfileEvent(signedEvent(t, sk, KindRecipe, nostr.Now(), nil, ""), wanted) {
+		t.Fatal("non-profile kind accepted")
+	}
+	if acceptProfileEvent(profile, map[string]bool{}) {
+		t.Fatal("profile for a pubkey we did not ask about accepted")
+	}
+	tampered := *profile
+	tampered.Content = `{"name":"impostor"}`
+	if acceptProfileEvent(&tampered, wanted) {
+		t.Fatal("tampered profile accepted")
+	}
+}
+
+func TestHydrateOnlyRelatedPubkeys(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+
+	memberSK, strangerSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	member, _ := nostr.GetPublicKey(memberSK)
+	stranger, _ := nostr.GetPublicKey(strangerSK)
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO group_members (group_id, pubkey, role) VALUES ('g', $1, 'member')", member); err != nil {
+		t.Fatal(err)
+	}
+
+	now := nostr.Now()
+	older := signedEvent(t, memberSK, nostr.KindProfileMetadata, now-100, nil, `{"name":"old"}`)
+	newer := signedEvent(t, memberSK, nostr.KindProfileMetadata, now, nil, `{"name":"new"}`)
+	var asked [][]string
+	h := newProfileHydrator(10, time.Hour, time.Second, func(_ context.Context, pks []string) []*nostr.Event {
+		asked = append(asked, pks)
+		return []*nostr.Event{
+			newer, older,
+			signedEvent(t, strangerSK, nostr.KindProfileMetadata, now, nil, `{"name":"stranger"}`),
+		}
+	})
+
+	if err := h.hydrate(ctx, []string{member, stranger}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(asked, [][]string{{member}}) {
+		t.Fatalf("fetched for %v, want only the group member", asked)
+	}
+	var content string
+	var n int
+	if err := db.QueryRowContext(ctx,
+		"SELECT MAX(content), COUNT(*) FROM events WHERE kind = 0 AND pubkey = $1", member).Scan(&content, &n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || content != `{"name":"new"}` {
+		t.Fatalf("expected only the newest profile stored, got %d rows (%s)", n, content)
+	}
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM events WHERE pubkey = $1", stranger).Scan(&n); err != nil || n != 0 {
+		t.Fatalf("stored %d events for an unrelated pubkey (%v)", n, err)
+	}
+
+	// A fresh fetch is not repeated.
+	if err := h.hydrate(ctx, []string{member}); err != nil {
+		t.Fatal(err)
+	}
+	if len(asked) != 1 {
+		t.Fatalf("profile re-fetched within maxAge: %v", asked)
+	}
+}
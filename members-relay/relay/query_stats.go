@@ -0,0 +1,90 @@
+package main
+
+import (
+	"expvar"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// QUERY STATS
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Every REQ filter is counted under its shape: the filter fields it sets,
+// never their values, so the number of shapes stays small. Under
+// /debug/vars, query_shapes holds per shape the filters queried, the rows
+// they returned and the microseconds spent in the database, e.g.
+// "kinds+#h.queries". Dividing gives the hot and slow shapes to index for.
+
+var queryShapes = expvar.NewMap("query_shapes")
+
+// filterShape names the fields filter sets, in a fixed order, or "broad"
+// when it sets none. Tags count by name; names longer than one letter,
+// which no index serves, share "#*".
+func filterShape(filter nostr.Filter) string {
+	var parts []string
+	if len(filter.IDs) > 0 {
+		parts = append(parts, "ids")
+	}
+	if len(filter.Authors) > 0 {
+		parts = append(parts, "authors")
+	}
+	if len(filter.Kinds) > 0 {
+		parts = append(parts, "kinds")
+	}
+	var tags []string
+	for name, values := range filter.Tags {
+		if len(values) == 0 {
+			continue
+		}
+		name = strings.TrimPrefix(name, "&")
+		if len(name) != 1 {
+			name = "*"
+		}
+		if tag := "#" + name; !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	slices.Sort(tags)
+	parts = append(parts, tags...)
+	if filter.Since != nil {
+		parts = append(parts, "since")
+	}
+	if filter.Until != nil {
+		parts = append(parts, "until")
+	}
+	if filter.Search != "" {
+		parts = append(parts, "search")
+	}
+	if len(parts) == 0 {
+		return "broad"
+	}
+	return strings.Join(parts, "+")
+}
+
+// queryStats accumulates one filter's queries.
+type queryStats struct {
+	shape string
+	rows  int
+	spent time.Duration
+}
+
+func newQueryStats(filter nostr.Filter) *queryStats {
+	return &queryStats{shape: filterShape(filter)}
+}
+
+// add records one batch query.
+func (s *queryStats) add(rows int, elapsed time.Duration) {
+	s.rows += rows
+	s.spent += elapsed
+}
+
+// record publishes the filter's totals under its shape.
+func (s *queryStats) record() {
+	queryShapes.Add(s.shape+".queries", 1)
+	queryShapes.Add(s.shape+".rows", int64(s.rows))
+	queryShapes.Add(s.shape+".us", s.spent.Microseconds())
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestFilterShape(t *testing.T) {
+	since := nostr.Timestamp(1)
+	for _, tc := range []struct {
+		filter nostr.Filter
+		want   string
+	}{
+		{nostr.Filter{}, "broad"},
+		{nostr.Filter{Limit: 10}, "broad"},
+		{nostr.Filter{IDs: []string{"ab"}}, "ids"},
+		{nostr.Filter{Kinds: []int{1}, Authors: []string{"a", "b"}}, "authors+kinds"},
+		{nostr.Filter{Kinds: []int{9}, Tags: nostr.TagMap{"h": {"bakers"}}}, "kinds+#h"},
+		{nostr.Filter{Tags: nostr.TagMap{"t": {"x"}, "&t": {"y"}, "e": {"z"}}}, "#e+#t"},
+		{nostr.Filter{Tags: nostr.TagMap{"title": {"x"}, "p": nil}}, "#*"},
+		{nostr.Filter{Kinds: []int{30023}, Since: &since, Search: "rye"}, "kinds+since+search"},
+	} {
+		if got := filterShape(tc.filter); got != tc.want {
+			t.Errorf("filterShape(%v) = %q, want %q", tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestQueryStatsRecord(t *testing.T) {
+	count := func(key string) int64 {
+		if v, ok := queryShapes.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	queries, rows := count("kinds+#a.queries"), count("kinds+#a.rows")
+	stats := newQueryStats(nostr.Filter{Kinds: []int{KindBadgeAward}, Tags: nostr.TagMap{"a": {"x"}}})
+	stats.add(3, time.Millisecond)
+	stats.add(2, time.Millisecond)
+	stats.record()
+	if got := count("kinds+#a.queries") - queries; got != 1 {
+		t.Errorf("%d queries recorded, want 1", got)
+	}
+	if got := count("kinds+#a.rows") - rows; got != 5 {
+		t.Errorf("%d rows recorded, want 5", got)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// GROUP CHAT REACTIONS (NIP-25)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// A kind 7 with an h tag reacts to a chat message (kind 9 or 10) of that
+// group, named by its last e tag. Only members of the group may react, and
+// the reaction is group-scoped like the message (see GROUP-SCOPED EVENTS).
+// A member has at most one reaction per message and emoji: a newer one
+// replaces the older, an older one is a duplicate.
+//
+// persistEventTx keeps group_reactions, one row per reaction, so
+// GET /api/groups/reactions can return the counts for a whole chat view in
+// one query instead of one REQ per message. Removing a message removes its
+// reactions with it.
+
+const (
+	KindReaction = 7
+
+	// maxReactionTargets bounds one GET /api/groups/reactions.
+	maxReactionTargets = 500
+)
+
+// isGroupReaction reports a reaction to a group chat message.
+func isGroupReaction(event *nostr.Event) bool {
+	return event.Kind == KindReaction && getHTag(event) != ""
+}
+
+// reactionTarget is the id of the reacted-to event: the last e tag.
+func reactionTarget(event *nostr.Event) string {
+	var target string
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "e" {
+			target = tag[1]
+		}
+	}
+	return target
+}
+
+// reactionEmoji is the reaction's content, "+" when empty.
+func reactionEmoji(event *nostr.Event) string {
+	if event.Content == "" {
+		return "+"
+	}
+	return event.Content
+}
+
+// rejectGroupReaction is the write policy for kind 7 with an h tag.
+func rejectGroupReaction(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	if !isActiveMember(ctx, pubkey) {
+		return true, say(ctx, msgMembershipForGroups)
+	}
+	groupId := getHTag(event)
+	if !groupExists(ctx, groupId) {
+		return true, say(ctx, msgGroupNotFound)
+	}
+	if !isGroupMember(ctx, groupId, pubkey) {
+		return true, say(ctx, msgNotGroupMember)
+	}
+	targetID := reactionTarget(event)
+	if targetID == "" {
+		return true, say(ctx, msgReactionTarget)
+	}
+	target, err := storedEvent(ctx, targetID)
+	if err != nil {
+		return true, say(ctx, msgEventLookupFailed)
+	}
+	if target == nil || (target.Kind != KindGroupChat && target.Kind != KindGroupChatReply) || getHTag(target) != groupId {
+		return true, say(ctx, msgReactionTarget)
+	}
+
+	var newer bool
+	err = db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM group_reactions r JOIN events e ON e.id = r.event_id
+			WHERE r.target = $1 AND r.pubkey = $2 AND r.emoji = $3 AND r.community = $4
+			AND e.created_at >= $5
+		)
+	`, targetID, pubkey, reactionEmoji(event), communityOf(ctx).id(), int64(event.CreatedAt)).Scan(&newer)
+	if err != nil {
+		return true, say(ctx, msgEventLookupFailed)
+	}
+	if newer {
+		return true, say(ctx, msgReactionDuplicate)
+	}
+	return false, ""
+}
+
+// insertGroupReaction records a group reaction, replacing the author's
+// earlier reaction with the same emoji to the same message.
+func insertGroupReaction(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	if !isGroupReaction(event) {
+		return nil
+	}
+	target, emoji, community := reactionTarget(event), reactionEmoji(event), communityOf(ctx).id()
+	if target == "" {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM events WHERE id IN (
+			SELECT event_id FROM group_reactions
+			WHERE target = $1 AND pubkey = $2 AND emoji = $3 AND community = $4 AND event_id <> $5
+		)
+	`, target, event.PubKey, emoji, community, event.ID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO group_reactions (event_id, target, group_id, pubkey, emoji, community)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (event_id) DO NOTHING
+	`, event.ID, target, getHTag(event), event.PubKey, emoji, community)
+	return err
+}
+
+// deleteReactionsTo removes the reactions to a removed chat message.
+func deleteReactionsTo(ctx context.Context, tx *sql.Tx, target *nostr.Event) error {
+	if target.Kind != KindGroupChat && target.Kind != KindGroupChatReply {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx,
+		"DELETE FROM events WHERE id IN (SELECT event_id FROM group_reactions WHERE target = $1)", target.ID)
+	return err
+}
+
+// reactionCount is one emoji's tally on a message.
+type reactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	Mine  bool   `json:"mine"` // the viewer is among the reactors
+}
+
+// reactionCounts tallies the reactions to targets in groupId, per target
+// and emoji, most used first.
+func reactionCounts(ctx context.Context, groupId string, targets []string, viewer string) (map[string][]reactionCount, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT target, emoji, COUNT(*), BOOL_OR(pubkey = $3)
+		FROM group_reactions
+		WHERE target = ANY($1) AND group_id = $2 AND community = $4
+		GROUP BY target, emoji
+		ORDER BY target, COUNT(*) DESC, emoji
+	`, pq.Array(targets), groupId, viewer, communityOf(ctx).id())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string][]reactionCount)
+	for rows.Next() {
+		var target string
+		var c reactionCount
+		if err := rows.Scan(&target, &c.Emoji, &c.Count, &c.Mine); err != nil {
+			return nil, err
+		}
+		counts[target] = append(counts[target], c)
+	}
+	return counts, rows.Err()
+}
+
+// ─── HTTP ──────────────────────────────────────────────────────────────────────
+
+// registerReactionAPI mounts GET /api/groups/reactions?group=<id>&e=<id>...
+// (NIP-98, members of the group).
+func registerReactionAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/api/groups/reactions", memberAPI(func(w http.ResponseWriter, r *http.Request, pubkey string) {
+		q := r.URL.Query()
+		groupId, targets := q.Get("group"), q["e"]
+		if len(targets) == 0 || len(targets) > maxReactionTargets {
+			httpError(w, r, pubkey, http.StatusBadRequest, msgReactionTargets, maxReactionTargets)
+			return
+		}
+		if pubkey != communityAdmin(r.Context()) && !isGroupMember(r.Context(), groupId, pubkey) {
+			httpError(w, r, pubkey, http.StatusForbidden, msgNotGroupMember)
+			return
+		}
+		counts, err := reactionCounts(r.Context(), groupId, targets, pubkey)
+		writeAPIResult(w, map[string]interface{}{"reactions": counts}, err)
+	}))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestReactionTargetAndEmoji(t *testing.T) {
+	event := &nostr.Event{Kind: KindReaction, Tags: nostr.Tags{{"e", "root"}, {"p", "author"}, {"e", "message"}, {"h", "bakers"}}}
+	if got := reactionTarget(event); got != "message" {
+		t.Fatalf("target %q, want the last e tag", got)
+	}
+	if got := reactionEmoji(event); got != "+" {
+		t.Fatalf("empty content is %q, want +", got)
+	}
+	event.Content = "🔥"
+	if got := reactionEmoji(event); got != "🔥" {
+		t.Fatalf("emoji %q", got)
+	}
+	if !isGroupReaction(event) || isGroupReaction(&nostr.Event{Kind: KindReaction, Tags: nostr.Tags{{"e", "x"}}}) {
+		t.Fatal("only reactions with an h tag are group reactions")
+	}
+	if !isGroupScoped(event) {
+		t.Fatal("group reactions are not group-scoped")
+	}
+}
+
+func TestGroupReactions(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	aliceSK, bobSK, outsiderSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	alice, _ := nostr.GetPublicKey(aliceSK)
+	bob, _ := nostr.GetPublicKey(bobSK)
+	outsider, _ := nostr.GetPublicKey(outsiderSK)
+	for _, pk := range []string{alice, bob, outsider} {
+		addTestMember(t, pk)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO groups (id, name) VALUES ('bakers', 'Bakers'), ('brewers', 'Brewers')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO group_members (group_id, pubkey, role) VALUES ('bakers', $1, 'member'), ('bakers', $2, 'member')", alice, bob); err != nil {
+		t.Fatal(err)
+	}
+
+	now := nostr.Now()
+	message := signedEvent(t, aliceSK, KindGroupChat, now-60, nostr.Tags{{"h", "bakers"}}, "fresh loaf")
+	elsewhere := signedEvent(t, aliceSK, KindGroupChat, now-60, nostr.Tags{{"h", "brewers"}}, "")
+	for _, evt := range []*nostr.Event{message, elsewhere} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policy := func(sk string, createdAt nostr.Timestamp, emoji string, target *nostr.Event) (*nostr.Event, bool, string) {
+		t.Helper()
+		pk, _ := nostr.GetPublicKey(sk)
+		evt := signedEvent(t, sk, KindReaction, createdAt, nostr.Tags{{"h", "bakers"}, {"e", target.ID}, {"p", target.PubKey}}, emoji)
+		reject, msg := rejectGroupReaction(ctx, evt, pk)
+		return evt, reject, msg
+	}
+	store := func(evt *nostr.Event) {
+		t.Helper()
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, reject, msg := policy(bobSK, now-30, "🔥", message)
+	if reject {
+		t.Fatalf("member reaction rejected: %s", msg)
+	}
+	store(first)
+	newer, reject, _ := policy(bobSK, now-10, "🔥", message)
+	if reject {
+		t.Fatal("newer reaction rejected")
+	}
+	store(newer)
+	if _, reject, msg := policy(bobSK, now-20, "🔥", message); !reject || !strings.HasPrefix(msg, "duplicate:") {
+		t.Fatalf("older duplicate: %v %q", reject, msg)
+	}
+	plus, _, _ := policy(aliceSK, now-5, "", message)
+	store(plus)
+	fire, _, _ := policy(aliceSK, now-5, "🔥", message)
+	store(fire)
+
+	if _, reject, _ := policy(outsiderSK, now, "🔥", message); !reject {
+		t.Fatal("reaction by a non-member of the group accepted")
+	}
+	if _, reject, _ := policy(bobSK, now, "🔥", elsewhere); !reject {
+		t.Fatal("reaction to another group's message accepted")
+	}
+
+	var stored int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM events WHERE kind = $1", KindReaction).Scan(&stored); err != nil || stored != 3 {
+		t.Fatalf("%d reactions stored (%v), want 3 after the replacement", stored, err)
+	}
+	counts, err := reactionCounts(ctx, "bakers", []string{message.ID}, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []reactionCount{{"🔥", 2, true}, {"+", 1, false}}
+	if got := counts[message.ID]; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("counts %+v, want %+v", got, want)
+	}
+	if other, _ := reactionCounts(ctx, "brewers", []string{message.ID}, bob); len(other) != 0 {
+		t.Fatalf("counts leaked through another group: %v", other)
+	}
+
+	if err := deleteEvent(ctx, message); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM events WHERE kind = $1", KindReaction).Scan(&stored); err != nil || stored != 0 {
+		t.Fatalf("%d reactions left after deleting the message (%v)", stored, err)
+	}
+}
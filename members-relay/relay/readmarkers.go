@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// READ MARKERS
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Members switching devices keep their place in group chat through read
+// markers: kind 30079, addressable, one per author and group (d tag = group
+// id), with ["read_until", "<unix>"] and optionally ["e", <last read id>].
+// Kind 30079 is zap.cooking's own, not a NIP. Markers are as private as app
+// data: only their author can read them, in SQL and in live delivery.
+//
+// GET /api/groups/unread answers "how many new messages per group" for all
+// of a member's groups in one query, reading the read_markers table kept by
+// persistEventTx. Counts stop at unreadCountCap and are cached per member for
+// RELAY_UNREAD_CACHE_TTL; writing a marker drops the member's entry.
+
+const (
+	KindReadMarker = 30079
+
+	// unreadCountCap bounds the rows counted per group; clients show "99+".
+	unreadCountCap = 100
+)
+
+// rejectReadMarker is the write policy for kind 30079.
+func rejectReadMarker(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	if !isActiveMember(ctx, pubkey) {
+		return true, say(ctx, msgMembershipRequired)
+	}
+	d := addressableDTag(event)
+	if d == nil || *d == "" {
+		return true, say(ctx, msgReadMarkerDTag)
+	}
+	if !groupExists(ctx, *d) {
+		return true, say(ctx, msgGroupNotFound)
+	}
+	if !isGroupMember(ctx, *d, pubkey) {
+		return true, say(ctx, msgNotGroupMember)
+	}
+	if _, ok := readUntil(event); !ok {
+		return true, say(ctx, msgReadMarkerUntil)
+	}
+	return false, ""
+}
+
+// readUntil parses a marker's read_until tag.
+func readUntil(event *nostr.Event) (time.Time, bool) {
+	tag := event.Tags.GetFirst([]string{"read_until", ""})
+	if tag == nil {
+		return time.Time{}, false
+	}
+	ts, err := strconv.ParseInt((*tag)[1], 10, 64)
+	if err != nil || ts < 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(ts, 0), true
+}
+
+// readMarkerPrivacyCondition limits read markers to the viewer's own. The
+// admin gets no exception.
+func readMarkerPrivacyCondition(viewer string, argIndex int) (string, []interface{}) {
+	return fmt.Sprintf("(kind <> %d OR pubkey = $%d)", KindReadMarker, argIndex), []interface{}{viewer}
+}
+
+// insertReadMarker records a marker for the unread query. Replaced versions
+// lose their row through the events foreign key.
+func insertReadMarker(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	if event.Kind != KindReadMarker {
+		return nil
+	}
+	d := addressableDTag(event)
+	until, ok := readUntil(event)
+	if d == nil || !ok {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO read_markers (event_id, pubkey, group_id, community, read_until)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (event_id) DO NOTHING
+	`, event.ID, event.PubKey, *d, communityOf(ctx).id(), until)
+	return err
+}
+
+// unreadCounts returns, for each of pubkey's groups, how many chat messages
+// by others are newer than their marker (all of them without one), up to
+// unreadCountCap.
+func unreadCounts(ctx context.Context, pubkey string) (map[string]int, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT gm.group_id, (
+			SELECT COUNT(*) FROM (
+				SELECT 1 FROM event_tags h
+				JOIN events e ON e.id = h.event_id
+				WHERE h.tag_name = 'h' AND h.tag_value = gm.group_id
+				AND e.kind IN ($3, $4) AND e.community = $2 AND e.pubkey <> $1
+				AND e.created_at > COALESCE((
+					SELECT EXTRACT(EPOCH FROM MAX(m.read_until))::bigint FROM read_markers m
+					WHERE m.pubkey = $1 AND m.group_id = gm.group_id AND m.community = $2
+				), -1)
+				LIMIT $5
+			) unread)
+		FROM group_members gm
+		JOIN groups g ON g.id = gm.group_id AND g.community = $2
+		WHERE gm.pubkey = $1
+	`, pubkey, communityOf(ctx).id(), KindGroupChat, KindGroupChatReply, unreadCountCap)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var group string
+		var n int
+		if err := rows.Scan(&group, &n); err != nil {
+			return nil, err
+		}
+		counts[group] = n
+	}
+	return counts, rows.Err()
+}
+
+// ─── Cache ─────────────────────────────────────────────────────────────────────
+
+type unreadEntry struct {
+	counts  map[string]int
+	expires time.Time
+}
+
+// unreadCache holds recent unreadCounts results per community and member.
+type unreadCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]unreadEntry
+}
+
+var unread = &unreadCache{ttl: 30 * time.Second, entries: make(map[string]unreadEntry)}
+
+func loadReadMarkerConfig() {
+	unread.ttl = envDuration("RELAY_UNREAD_CACHE_TTL", 30*time.Second)
+}
+
+// get returns pubkey's counts, computing them when missing or stale.
+func (c *unreadCache) get(ctx context.Context, pubkey string) (map[string]int, error) {
+	key := communityOf(ctx).id() + "/" + pubkey
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.counts, nil
+	}
+	counts, err := unreadCounts(ctx, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = unreadEntry{counts: counts, expires: now.Add(c.ttl)}
+	c.mu.Unlock()
+	return counts, nil
+}
+
+// forget drops pubkey's entry after they move a marker.
+func (c *unreadCache) forget(community, pubkey string) {
+	c.mu.Lock()
+	delete(c.entries, community+"/"+pubkey)
+	c.mu.Unlock()
+}
+
+// ─── HTTP ──────────────────────────────────────────────────────────────────────
+
+func registerReadMarkerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/api/groups/unread", memberAPI(func(w http.ResponseWriter, r *http.Request, pubkey string) {
+		counts, err := unread.get(r.Context(), pubkey)
+		writeAPIResult(w, map[string]interface{}{"unread": counts, "cap": unreadCountCap}, err)
+	}))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestReadUntil(t *testing.T) {
+	for _, tc := range []struct {
+		tags nostr.Tags
+		want int64
+		ok   bool
+	}{
+		{nostr.Tags{{"d", "bakers"}, {"read_until", "1700000000"}}, 1700000000, true},
+		{nostr.Tags{{"d", "bakers"}}, 0, false},
+		{nostr.Tags{{"read_until", "yesterday"}}, 0, false},
+		{nostr.Tags{{"read_until", "-1"}}, 0, false},
+	} {
+		got, ok := readUntil(&nostr.Event{Kind: KindReadMarker, Tags: tc.tags})
+		if ok != tc.ok || (ok && got.Unix() != tc.want) {
+			t.Errorf("%v: got %v %v", tc.tags, got, ok)
+		}
+	}
+}
+
+func TestReadMarkersArePrivate(t *testing.T) {
+	viewer := pubkeys(1)[0]
+	if q, _ := buildViewerQuery(nostr.Filter{Kinds: []int{KindRecipe}}, nil, viewer, false); strings.Contains(q, "30079") {
+		t.Fatalf("marker privacy applied to recipes: %s", q)
+	}
+	if q, _ := buildViewerQuery(nostr.Filter{Kinds: []int{KindReadMarker}}, nil, adminPubkey, false); !strings.Contains(q, "kind <> 30079") {
+		t.Fatalf("marker reads not limited to the author: %s", q)
+	}
+	marker := &nostr.Event{Kind: KindReadMarker, PubKey: viewer, Tags: nostr.Tags{{"d", "bakers"}}}
+	if !isRestrictedEvent(marker) {
+		t.Fatal("markers go through khatru's broadcast")
+	}
+	readable := readableBy(context.Background(), marker)
+	if !readable(viewer) || readable(adminPubkey) || readable("") {
+		t.Fatal("markers readable by someone other than their author")
+	}
+}
+
+func TestUnreadCounts(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	readerSK, chatSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	reader, _ := nostr.GetPublicKey(readerSK)
+	addTestMember(t, reader)
+	if _, err := db.ExecContext(ctx, "INSERT INTO groups (id, name) VALUES ('bakers', 'Bakers'), ('brewers', 'Brewers'), ('butchers', 'Butchers')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO group_members (group_id, pubkey, role) VALUES ('bakers', $1, 'member'), ('brewers', $1, 'member')", reader); err != nil {
+		t.Fatal(err)
+	}
+
+	now := nostr.Now()
+	for i, group := range []string{"bakers", "bakers", "bakers", "brewers", "butchers"} {
+		if err := persistEvent(ctx, signedEvent(t, chatSK, KindGroupChat, now-nostr.Timestamp(100-i), nostr.Tags{{"h", group}}, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := persistEvent(ctx, signedEvent(t, readerSK, KindGroupChat, now, nostr.Tags{{"h", "bakers"}}, "mine")); err != nil {
+		t.Fatal(err)
+	}
+
+	marker := signedEvent(t, readerSK, KindReadMarker, now, nostr.Tags{
+		{"d", "bakers"}, {"read_until", strconv.FormatInt(int64(now-99), 10)},
+	}, "")
+	if reject, msg := rejectReadMarker(ctx, marker, reader); reject {
+		t.Fatalf("marker rejected: %s", msg)
+	}
+	if reject, _ := rejectReadMarker(ctx, signedEvent(t, readerSK, KindReadMarker, now, nostr.Tags{{"d", "butchers"}, {"read_until", "0"}}, ""), reader); !reject {
+		t.Fatal("marker for a group the author is not in accepted")
+	}
+	if err := persistEvent(ctx, marker); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := unreadCounts(ctx, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 || counts["bakers"] != 1 || counts["brewers"] != 1 {
+		t.Fatalf("counts %v, want bakers 1 (after the marker, not own) and brewers 1 (no marker)", counts)
+	}
+
+	prev := unread.ttl
+	unread.ttl = time.Hour
+	t.Cleanup(func() { unread.ttl = prev })
+	if _, err := unread.get(ctx, reader); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM read_markers"); err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := unread.get(ctx, reader); cached["bakers"] != 1 {
+		t.Fatalf("cache not used: %v", cached)
+	}
+	unread.forget(defaultCommunityID, reader)
+	if fresh, _ := unread.get(ctx, reader); fresh["bakers"] != 3 {
+		t.Fatalf("after forget: %v", fresh)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// RECIPE ENGAGEMENT (NIP-25, NIP-22)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Recipes are public, and so are the reactions (kind 7) and comments (kind
+// 1111) on them: one whose target is a recipe stored here needs neither auth
+// nor membership, only the proof of work non-members owe for recipes (see
+// rejectRecipePow). A reaction names its target in an a tag or its last e
+// tag, a comment its root in an A or E tag. Reads of those kinds are public
+// when a tag filter ties them to recipes. Group chat reactions carry an h
+// tag and stay member-only, as do recipes shared in a group (see
+// GROUP-SCOPED EVENTS).
+
+const KindComment = 1111
+
+// isRecipeEngagement reports a reaction or comment on a recipe stored in
+// ctx's community.
+func isRecipeEngagement(ctx context.Context, event *nostr.Event) bool {
+	if getHTag(event) != "" {
+		return false
+	}
+	addressTag, idTag := "a", "e"
+	switch event.Kind {
+	case KindReaction:
+	case KindComment:
+		addressTag, idTag = "A", "E"
+	default:
+		return false
+	}
+	if tag := event.Tags.GetFirst([]string{addressTag, ""}); tag != nil {
+		return recipesStored(ctx, []string{(*tag)[1]}, nil)
+	}
+	var id string
+	if event.Kind == KindReaction {
+		id = reactionTarget(event)
+	} else if tag := event.Tags.GetFirst([]string{idTag, ""}); tag != nil {
+		id = (*tag)[1]
+	}
+	return id != "" && recipesStored(ctx, nil, []string{id})
+}
+
+// isPublicEngagementFilter reports a filter for reactions, comments and zap
+// receipts (see RECIPE ZAPS) that can only match engagement with recipes:
+// one of its a/A tag filters names only recipe addresses, or one of its e/E
+// tag filters only recipes stored here.
+func isPublicEngagementFilter(ctx context.Context, filter nostr.Filter) bool {
+	if len(filter.Kinds) == 0 {
+		return false
+	}
+	for _, k := range filter.Kinds {
+		if k != KindReaction && k != KindComment && k != nostr.KindZap {
+			return false
+		}
+	}
+	recipePrefix := fmt.Sprintf("%d:", KindRecipe)
+	for name, values := range filter.Tags {
+		if len(values) == 0 {
+			continue
+		}
+		switch strings.TrimPrefix(name, "&") {
+		case "a", "A":
+			recipes := true
+			for _, v := range values {
+				recipes = recipes && strings.HasPrefix(v, recipePrefix)
+			}
+			if recipes {
+				return true
+			}
+		case "e", "E":
+			if recipesStored(ctx, nil, values) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recipesStored reports whether every address and id names a recipe stored
+// in ctx's community.
+func recipesStored(ctx context.Context, addresses, ids []string) bool {
+	community := communityOf(ctx).id()
+	for _, address := range addresses {
+		parts := strings.SplitN(address, ":", 3)
+		if len(parts) != 3 || parts[0] != fmt.Sprint(KindRecipe) || !nostr.IsValid32ByteHex(parts[1]) {
+			return false
+		}
+		var exists bool
+		if err := db.QueryRowContext(ctx, `
+			SELECT EXISTS (SELECT 1 FROM events WHERE kind = $1 AND pubkey = $2 AND d_tag = $3 AND community = $4
+				AND `+ungroupedCondition("events")+`)
+		`, KindRecipe, parts[1], parts[2], community).Scan(&exists); err != nil || !exists {
+			return false
+		}
+	}
+	if len(ids) == 0 {
+		return true
+	}
+	var found int
+	if err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM events WHERE id = ANY($1) AND kind = $2 AND community = $3
+			AND `+ungroupedCondition("events")+`
+	`, pq.Array(ids), KindRecipe, community).Scan(&found); err != nil {
+		log.Printf("[engagement] Error looking up recipes: %v", err)
+		return false
+	}
+	distinct := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		distinct[id] = true
+	}
+	return found == len(distinct)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPublicEngagementFilterByAddress(t *testing.T) {
+	ctx := context.Background()
+	recipe := fmt.Sprintf("%d:%s:pancakes", KindRecipe, pubkeys(1)[0])
+	for _, tc := range []struct {
+		filter nostr.Filter
+		public bool
+	}{
+		{nostr.Filter{Kinds: []int{KindReaction}, Tags: nostr.TagMap{"a": {recipe}}}, true},
+		{nostr.Filter{Kinds: []int{KindComment}, Tags: nostr.TagMap{"A": {recipe}, "p": {pubkeys(1)[0]}}}, true},
+		{nostr.Filter{Kinds: []int{KindReaction, KindComment}, Tags: nostr.TagMap{"a": {recipe}}}, true},
+		{nostr.Filter{Kinds: []int{KindReaction, 1}, Tags: nostr.TagMap{"a": {recipe}}}, false},
+		{nostr.Filter{Tags: nostr.TagMap{"a": {recipe}}}, false},
+		{nostr.Filter{Kinds: []int{KindReaction}, Tags: nostr.TagMap{"a": {recipe, "30311:" + pubkeys(1)[0] + ":live"}}}, false},
+		{nostr.Filter{Kinds: []int{KindReaction}}, false},
+	} {
+		if got := isPublicEngagementFilter(ctx, tc.filter); got != tc.public {
+			t.Errorf("%v: public %v, want %v", tc.filter, got, tc.public)
+		}
+	}
+}
+
+func TestRecipeEngagementWithoutMembership(t *testing.T) {
+	openTestDB(t)
+	saved := limits
+	defer func() { limits = saved }()
+	ctx := context.Background()
+	chefSK, strangerSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	chef, _ := nostr.GetPublicKey(chefSK)
+	addTestMember(t, chef)
+
+	recipe := signedEvent(t, chefSK, KindRecipe, nostr.Now(), nostr.Tags{{"d", "pancakes"}}, "")
+	note := signedEvent(t, chefSK, 1, nostr.Now(), nil, "members only")
+	for _, evt := range []*nostr.Event{recipe, note} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	address := fmt.Sprintf("%d:%s:pancakes", KindRecipe, chef)
+
+	for _, tc := range []struct {
+		name   string
+		kind   int
+		tags   nostr.Tags
+		public bool
+	}{
+		{"like by address", KindReaction, nostr.Tags{{"a", address}, {"p", chef}}, true},
+		{"like by id", KindReaction, nostr.Tags{{"e", recipe.ID}, {"p", chef}}, true},
+		{"comment", KindComment, nostr.Tags{{"A", address}, {"K", "30023"}, {"a", address}, {"k", "30023"}}, true},
+		{"comment by root id", KindComment, nostr.Tags{{"E", recipe.ID}, {"K", "30023"}}, true},
+		{"like on a note", KindReaction, nostr.Tags{{"e", note.ID}}, false},
+		{"comment on an unknown recipe", KindComment, nostr.Tags{{"A", address + "-v2"}}, false},
+		{"group reaction", KindReaction, nostr.Tags{{"e", recipe.ID}, {"h", "bakers"}}, false},
+	} {
+		evt := signedEvent(t, strangerSK, tc.kind, nostr.Now(), tc.tags, "+")
+		reject, msg := rejectEventPolicy(ctx, evt)
+		if tc.public && reject {
+			t.Errorf("%s: refused: %s", tc.name, msg)
+		}
+		if !tc.public && (!reject || !strings.HasPrefix(msg, "auth-required:")) {
+			t.Errorf("%s: %v %q, want auth required", tc.name, reject, msg)
+		}
+	}
+
+	limits.MinPowDifficulty = 8
+	like := signedEvent(t, strangerSK, KindReaction, nostr.Now(), nostr.Tags{{"a", address}}, "+")
+	if reject, msg := rejectEventPolicy(ctx, like); !reject || msg != "pow: difficulty 8 required" {
+		t.Errorf("like without proof of work: %v %q", reject, msg)
+	}
+
+	if !isPublicEngagementFilter(ctx, nostr.Filter{Kinds: []int{KindReaction, KindComment}, Tags: nostr.TagMap{"e": {recipe.ID}}}) {
+		t.Error("engagement with a recipe id is not public")
+	}
+	if isPublicEngagementFilter(ctx, nostr.Filter{Kinds: []int{KindReaction}, Tags: nostr.TagMap{"e": {recipe.ID, note.ID}}}) {
+		t.Error("reactions to a members-only note are public")
+	}
+}
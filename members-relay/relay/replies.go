@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// CHAT REPLIES (NIP-29)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// A chat reply (kind 10) names the message it answers, and the thread's
+// root, with NIP-10 e tags. Clients render a reply whose e tags point at a
+// message from another relay, another group or one since deleted as an
+// orphaned thread, so RELAY_CHAT_REPLIES sets how replies are checked:
+//
+//   - "strict" (the default): every root and reply e tag must name an event
+//     stored here for the same group.
+//   - "loose": e tags naming events stored here must be the same group's;
+//     ids the relay does not hold are let through, for clients that thread
+//     across relays.
+//   - "off": no check.
+//
+// Replies that fail are refused with "invalid: reply references unknown
+// event in this group". Mention e tags are not checked.
+
+const (
+	replyCheckStrict = "strict"
+	replyCheckLoose  = "loose"
+	replyCheckOff    = "off"
+)
+
+var replyCheck string
+
+func loadReplyConfig() {
+	replyCheck = envOr("RELAY_CHAT_REPLIES", replyCheckStrict)
+	switch replyCheck {
+	case replyCheckStrict, replyCheckLoose, replyCheckOff:
+	default:
+		log.Fatalf("Invalid RELAY_CHAT_REPLIES %q (strict, loose or off)", replyCheck)
+	}
+}
+
+// replyReferences returns the ids of a reply's root and reply e tags:
+// those marked root or reply, and unmarked (positional) ones.
+func replyReferences(event *nostr.Event) []string {
+	var ids []string
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "e" || tag[1] == "" {
+			continue
+		}
+		if len(tag) >= 4 && tag[3] != "" && tag[3] != "root" && tag[3] != "reply" {
+			continue
+		}
+		ids = append(ids, tag[1])
+	}
+	return ids
+}
+
+// rejectChatReply checks a kind 10's references to the group it is sent to.
+func rejectChatReply(ctx context.Context, event *nostr.Event, groupId string) (bool, string) {
+	if event.Kind != KindGroupChatReply || replyCheck == replyCheckOff {
+		return false, ""
+	}
+	for _, id := range replyReferences(event) {
+		target, err := storedEvent(ctx, id)
+		if err != nil {
+			log.Printf("[NIP-29] Error looking up reply target %s: %v", id, err)
+			return true, say(ctx, msgEventLookupFailed)
+		}
+		if target == nil && replyCheck == replyCheckLoose {
+			continue
+		}
+		if target == nil || !inGroup(target, groupId) {
+			return true, say(ctx, msgReplyUnknown)
+		}
+	}
+	return false, ""
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestReplyReferences(t *testing.T) {
+	root, parent, mention := strings.Repeat("a", 64), strings.Repeat("b", 64), strings.Repeat("c", 64)
+	event := &nostr.Event{Tags: nostr.Tags{
+		{"h", "club"},
+		{"e", root, "", "root"},
+		{"e", parent, "wss://members.zap.cooking", "reply"},
+		{"e", mention, "", "mention"},
+	}}
+	if got := replyReferences(event); !reflect.DeepEqual(got, []string{root, parent}) {
+		t.Errorf("marked tags: %v", got)
+	}
+	if got := replyReferences(&nostr.Event{Tags: nostr.Tags{{"e", root}, {"e", parent, ""}}}); len(got) != 2 {
+		t.Errorf("positional tags: %v", got)
+	}
+}
+
+func TestChatReplyThreading(t *testing.T) {
+	openTestDB(t)
+	withRelayKey(t)
+	ctx := context.Background()
+	adminSK, memberSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	for _, g := range []string{"club", "other"} {
+		applyGroupEvent(t, signedEvent(t, adminSK, KindCreateGroup, now, nostr.Tags{{"h", g}}, ""))
+	}
+	own := signedEvent(t, memberSK, KindGroupChat, now, nostr.Tags{{"h", "club"}}, "proofing overnight?")
+	foreign := signedEvent(t, memberSK, KindGroupChat, now, nostr.Tags{{"h", "other"}}, "proofing overnight?")
+	for _, evt := range []*nostr.Event{own, foreign} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replyTo := func(id string) *nostr.Event {
+		return signedEvent(t, memberSK, KindGroupChatReply, now+1, nostr.Tags{{"h", "club"}, {"e", id, "", "root"}}, "yes")
+	}
+	unknown := strings.Repeat("0", 64)
+	prev := replyCheck
+	t.Cleanup(func() { replyCheck = prev })
+
+	for _, tc := range []struct {
+		mode   string
+		target string
+		reject bool
+	}{
+		{replyCheckStrict, own.ID, false},
+		{replyCheckStrict, foreign.ID, true},
+		{replyCheckStrict, unknown, true},
+		{replyCheckLoose, foreign.ID, true},
+		{replyCheckLoose, unknown, false},
+		{replyCheckOff, foreign.ID, false},
+	} {
+		replyCheck = tc.mode
+		reject, msg := rejectChatReply(ctx, replyTo(tc.target), "club")
+		if reject != tc.reject || (reject && msg != "invalid: reply references unknown event in this group") {
+			t.Errorf("%s, reply to %s: %v %q", tc.mode, tc.target, reject, msg)
+		}
+	}
+}
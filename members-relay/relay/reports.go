@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// REPORTS (NIP-56)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Members report spam and abuse with kind 1984: a p tag naming the reported
+// pubkey and, for a message, e tags naming it, the report type in the third
+// element of either. Reports are stored like other member events but only
+// their author and the relay admin read them back, stored or live; reports
+// indexes them by target. Once RELAY_REPORT_HIDE_THRESHOLD distinct members have reported
+// an event (0 switches this off), it is hidden: left out of everyone's
+// query results but the admin's, not deleted. The admin reviews hidden
+// events with NIP-86 listeventsneedingmoderation, then deletes one with
+// banevent or clears the hide with allowevent; a cleared event is not hidden
+// again.
+
+// reportTypes are the report types of NIP-56.
+var reportTypes = map[string]bool{
+	"nudity": true, "malware": true, "profanity": true, "illegal": true,
+	"spam": true, "impersonation": true, "other": true,
+}
+
+// reportHideThreshold is how many members must report an event to hide it.
+var reportHideThreshold = 3
+
+func loadReportConfig() {
+	reportHideThreshold = envInt("RELAY_REPORT_HIDE_THRESHOLD", 3)
+}
+
+// reportTarget is one thing a report names: an event ("" when it reports a
+// pubkey alone) and its author.
+type reportTarget struct {
+	Event  string
+	Pubkey string
+	Type   string
+}
+
+// reportTargets returns what a kind 1984 reports, nil without a p tag. An
+// e tag without a type takes the p tag's.
+func reportTargets(event *nostr.Event) []reportTarget {
+	p := event.Tags.GetFirst([]string{"p", ""})
+	if p == nil || !nostr.IsValid32ByteHex((*p)[1]) {
+		return nil
+	}
+	pubkeyType := ""
+	if len(*p) >= 3 {
+		pubkeyType = (*p)[2]
+	}
+	var targets []reportTarget
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "e" || !nostr.IsValid32ByteHex(tag[1]) {
+			continue
+		}
+		t := reportTarget{Event: tag[1], Pubkey: (*p)[1], Type: pubkeyType}
+		if len(tag) >= 3 && tag[2] != "" {
+			t.Type = tag[2]
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 {
+		targets = append(targets, reportTarget{Pubkey: (*p)[1], Type: pubkeyType})
+	}
+	return targets
+}
+
+// rejectReport is the write policy for kind 1984.
+func rejectReport(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	if !isActiveMember(ctx, pubkey) {
+		return true, say(ctx, msgMembershipRequired)
+	}
+	targets := reportTargets(event)
+	if len(targets) == 0 {
+		return true, say(ctx, msgReportTarget)
+	}
+	for _, t := range targets {
+		if !reportTypes[t.Type] {
+			return true, say(ctx, msgReportType, t.Type)
+		}
+	}
+	return false, ""
+}
+
+// insertReport records a report's targets and hides each reported event
+// that has now reached reportHideThreshold.
+func insertReport(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	if event.Kind != nostr.KindReporting {
+		return nil
+	}
+	community := communityOf(ctx).id()
+	for _, t := range reportTargets(event) {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO reports (event_id, reporter, target_event, target_pubkey, report_type, community)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT DO NOTHING
+		`, event.ID, event.PubKey, t.Event, t.Pubkey, t.Type, community); err != nil {
+			return err
+		}
+		if t.Event == "" || reportHideThreshold <= 0 {
+			continue
+		}
+		if err := hideReported(ctx, tx, t.Event, community); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hideReported hides id once enough distinct members reported it. Only a
+// stored event is hidden, and only once: a hide the admin cleared stays
+// cleared.
+func hideReported(ctx context.Context, tx *sql.Tx, id, community string) error {
+	var reporters int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(DISTINCT reporter) FROM reports WHERE target_event = $1 AND community = $2
+	`, id, community).Scan(&reporters); err != nil {
+		return err
+	}
+	if reporters < reportHideThreshold {
+		return nil
+	}
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO hidden_events (community, id)
+		SELECT community, id FROM events WHERE id = $1 AND community = $2
+		ON CONFLICT DO NOTHING
+	`, id, community)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("[reports] Hid %s in %s after %d reports, pending admin review", id, community, reporters)
+	}
+	return nil
+}
+
+// clearHidden lifts the hide of id, which stays visible from then on.
+func clearHidden(ctx context.Context, community, id string) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE hidden_events SET cleared_at = NOW() WHERE community = $1 AND id = $2 AND cleared_at IS NULL
+	`, community, id)
+	return err
+}
+
+// hiddenEventsQuery lists the events awaiting review for listBanned, each
+// with its reporter count and report types as the reason.
+const hiddenEventsQuery = `
+	SELECT h.id, COUNT(DISTINCT r.reporter) || ' reports: ' || string_agg(DISTINCT r.report_type, ', ')
+	FROM hidden_events h
+	JOIN reports r ON r.target_event = h.id AND r.community = h.community
+	WHERE h.community = $1 AND h.cleared_at IS NULL
+	GROUP BY h.id, h.hidden_at
+	ORDER BY h.hidden_at`
+
+// ─── Reads ─────────────────────────────────────────────────────────────────────
+
+// reportPrivacyCondition limits reports to the viewer's own; callers skip
+// it for the admin.
+func reportPrivacyCondition(viewer string, argIndex int) (string, []interface{}) {
+	return fmt.Sprintf("(kind <> %d OR pubkey = $%d)", nostr.KindReporting, argIndex), []interface{}{viewer}
+}
+
+// unhiddenCondition leaves hidden events out; callers skip it for the admin.
+func unhiddenCondition() string {
+	return `NOT EXISTS (SELECT 1 FROM hidden_events h
+		WHERE h.id = events.id AND h.community = events.community AND h.cleared_at IS NULL)`
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestReportTargets(t *testing.T) {
+	pk, id := pubkeys(1)[0], pubkeys(2)[1]
+	for _, tc := range []struct {
+		tags nostr.Tags
+		want []reportTarget
+	}{
+		{nostr.Tags{{"p", pk, "impersonation"}}, []reportTarget{{Pubkey: pk, Type: "impersonation"}}},
+		{nostr.Tags{{"e", id, "spam"}, {"p", pk}}, []reportTarget{{Event: id, Pubkey: pk, Type: "spam"}}},
+		{nostr.Tags{{"e", id}, {"p", pk, "profanity"}}, []reportTarget{{Event: id, Pubkey: pk, Type: "profanity"}}},
+		{nostr.Tags{{"e", id, "spam"}}, nil},
+		{nostr.Tags{{"p", "npub1chef"}}, nil},
+	} {
+		got := reportTargets(&nostr.Event{Kind: nostr.KindReporting, Tags: tc.tags})
+		if len(got) != len(tc.want) || (len(got) > 0 && got[0] != tc.want[0]) {
+			t.Errorf("%v: got %+v, want %+v", tc.tags, got, tc.want)
+		}
+	}
+}
+
+func TestReportsHideAfterThreshold(t *testing.T) {
+	openTestDB(t)
+	adminSK := withTestAdmin(t)
+	admin, _ := nostr.GetPublicKey(adminSK)
+	saved := reportHideThreshold
+	reportHideThreshold = 2
+	t.Cleanup(func() { reportHideThreshold = saved })
+	ctx := context.Background()
+
+	var sks, members []string
+	for range 3 {
+		sk := nostr.GeneratePrivateKey()
+		pk, _ := nostr.GetPublicKey(sk)
+		addTestMember(t, pk)
+		sks, members = append(sks, sk), append(members, pk)
+	}
+	spam := signedEvent(t, sks[0], 9, nostr.Now(), nostr.Tags{{"h", "kitchen"}}, "cheap pans!!!")
+	if err := persistEvent(ctx, spam); err != nil {
+		t.Fatal(err)
+	}
+	report := func(i int, kind string) *nostr.Event {
+		t.Helper()
+		evt := signedEvent(t, sks[i], nostr.KindReporting, nostr.Now(), nostr.Tags{{"e", spam.ID, kind}, {"p", members[0]}}, "")
+		if reject, msg := rejectReport(ctx, evt, members[i]); reject {
+			t.Fatalf("report refused: %s", msg)
+		}
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+		return evt
+	}
+	visible := func(viewer string) bool {
+		t.Helper()
+		query, args := buildViewerQuery(nostr.Filter{IDs: []string{spam.ID}}, nil, viewer, false)
+		found, err := fetchEvents(ctx, query, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(found) == 1
+	}
+
+	if reject, msg := rejectReport(ctx, signedEvent(t, sks[1], nostr.KindReporting, nostr.Now(),
+		nostr.Tags{{"e", spam.ID, "annoying"}, {"p", members[0]}}, ""), members[1]); !reject || msg != `invalid: unknown report type "annoying"` {
+		t.Fatalf("unknown type: %v %q", reject, msg)
+	}
+	outsider := signedEvent(t, nostr.GeneratePrivateKey(), nostr.KindReporting, nostr.Now(), nostr.Tags{{"p", members[0], "spam"}}, "")
+	if reject, _ := rejectReport(ctx, outsider, outsider.PubKey); !reject {
+		t.Fatal("report from a non-member accepted")
+	}
+
+	first := report(1, "spam")
+	report(1, "profanity")
+	if !visible(members[2]) {
+		t.Fatal("hidden after one member reported twice")
+	}
+	report(2, "spam")
+	if visible(members[2]) || visible(members[0]) || visible("") {
+		t.Fatal("reported event still visible")
+	}
+	if !visible(admin) {
+		t.Fatal("hidden from the admin")
+	}
+
+	query, args := buildViewerQuery(nostr.Filter{Kinds: []int{nostr.KindReporting}}, nil, members[1], false)
+	if reports, err := fetchEvents(ctx, query, args); err != nil || len(reports) != 2 {
+		t.Fatalf("reporter's own reports: %d, %v", len(reports), err)
+	}
+	query, args = buildViewerQuery(nostr.Filter{IDs: []string{first.ID}}, nil, members[2], false)
+	if reports, _ := fetchEvents(ctx, query, args); len(reports) != 0 {
+		t.Fatal("another member read a report")
+	}
+
+	_, resp := managementCall(t, adminSK, "listeventsneedingmoderation", nil, "")
+	raw, _ := json.Marshal(resp.Result)
+	if !strings.Contains(string(raw), spam.ID) || !strings.Contains(string(raw), "2 reports: profanity, spam") {
+		t.Fatalf("hidden event not listed: %s", raw)
+	}
+	if _, resp := managementCall(t, adminSK, "allowevent", []any{spam.ID}, ""); resp.Error != "" {
+		t.Fatal(resp.Error)
+	}
+	report(0, "other")
+	if !visible(members[2]) {
+		t.Fatal("cleared event hidden again")
+	}
+	_, resp = managementCall(t, adminSK, "listeventsneedingmoderation", nil, "")
+	if raw, _ := json.Marshal(resp.Result); string(raw) != "[]" {
+		t.Fatalf("cleared event still listed: %s", raw)
+	}
+}
+
+// A new report reaches its author's and the admin's live subscriptions, and
+// no one else's.
+func TestReportsLiveDelivery(t *testing.T) {
+	adminSK, authorSK, strangerSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	prev := adminPubkey
+	adminPubkey, _ = nostr.GetPublicKey(adminSK)
+	t.Cleanup(func() { adminPubkey = prev })
+
+	tracker := &connTracker{conns: make(map[*khatru.WebSocket]*trackedConn)}
+	rl := khatru.NewRelay()
+	rl.RejectFilter = append(rl.RejectFilter, tracker.limitFilter)
+	rl.PreventBroadcast = append(rl.PreventBroadcast, hideRestricted)
+	rl.OnConnect = append(rl.OnConnect, tracker.onConnect)
+	rl.OnDisconnect = append(rl.OnDisconnect, tracker.onDisconnect)
+	url := startTestRelay(t, rl, testServerConfig(true))
+	subscribe := func(sk string) *wsTestClient {
+		t.Helper()
+		c := dialTestRelay(t, url)
+		if !c.auth(url, c.challenge(), sk) {
+			t.Fatal("AUTH refused")
+		}
+		if got := c.req("feed", `{"kinds":[1984,30023]}`); got != "EOSE" {
+			t.Fatalf("REQ: %s", got)
+		}
+		return c
+	}
+	admin, author, stranger := subscribe(adminSK), subscribe(authorSK), subscribe(strangerSK)
+
+	report := signedEvent(t, authorSK, nostr.KindReporting, nostr.Now(), nostr.Tags{{"p", pubkeys(1)[0], "spam"}}, "")
+	recipe := signedEvent(t, strangerSK, KindRecipe, nostr.Now(), nostr.Tags{{"d", "soup"}}, "")
+	rl.BroadcastEvent(report)
+	tracker.deliverRestricted(context.Background(), report)
+	rl.BroadcastEvent(recipe)
+	for name, tc := range map[string]struct {
+		c    *wsTestClient
+		want string
+	}{"admin": {admin, report.ID}, "author": {author, report.ID}, "stranger": {stranger, recipe.ID}} {
+		env := tc.c.next(func(env nostr.Envelope) bool { _, ok := env.(*nostr.EventEnvelope); return ok })
+		if got := env.(*nostr.EventEnvelope).ID; got != tc.want {
+			t.Errorf("%s got %s first, want %s", name, got, tc.want)
+		}
+	}
+}
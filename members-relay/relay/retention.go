@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// CHAT RETENTION
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Some groups want chat to fade, others want history forever. A group's
+// message_ttl (seconds, 0 for none) is set with a ["message_ttl", "<secs>"]
+// tag on a kind 9002 or through POST /admin/groups/message-ttl, and shows in
+// its 39000. The purger removes chat (kinds 9 and 10) older than the tighter
+// of the group's TTL and the relay-wide chat retention
+// (RELAY_CHAT_RETENTION, advertised in NIP-11), so a group can shorten the
+// relay's retention but not extend it. Purged messages are tombstoned so
+// clients cannot publish them again. Kind 11 and the moderation kinds are
+// never purged, and neither are announcements (see GROUP ANNOUNCEMENTS) or
+// messages a group admin or moderator pinned in their NIP-51 pin list (kind
+// 10001). Reactions go with their message.
+//
+// A TTL change that would expire messages the current setting keeps is only
+// accepted with a confirmation: "confirm" as the tag's third element, or
+// "confirm": true in the API request.
+
+// chatPurgeBatch bounds one purge statement.
+const chatPurgeBatch = 1000
+
+var purgedChatKinds = []int{KindGroupChat, KindGroupChatReply}
+
+// chatRetention returns the relay-wide retention of kind, 0 for none: the
+// shortest time rule in limits.Retention covering it.
+func chatRetention(kind int) time.Duration {
+	var shortest time.Duration
+	for _, rule := range limits.Retention {
+		if rule.Time <= 0 || (len(rule.Kinds) > 0 && !mayMatchKind(rule.Kinds, kind)) {
+			continue
+		}
+		if d := time.Duration(rule.Time) * time.Second; shortest == 0 || d < shortest {
+			shortest = d
+		}
+	}
+	return shortest
+}
+
+// effectiveTTL is the tighter of a group's TTL and the relay-wide retention,
+// 0 for none.
+func effectiveTTL(groupTTL, relayRetention time.Duration) time.Duration {
+	if groupTTL <= 0 || (relayRetention > 0 && relayRetention < groupTTL) {
+		return relayRetention
+	}
+	return groupTTL
+}
+
+// messageTTLTag parses the message_ttl tag of a kind 9002. ok is false when
+// there is none.
+func messageTTLTag(tags nostr.Tags) (ttl time.Duration, confirm, ok bool, err error) {
+	for _, tag := range tags {
+		if len(tag) < 2 || tag[0] != "message_ttl" {
+			continue
+		}
+		secs, err := strconv.ParseInt(tag[1], 10, 64)
+		if err != nil || secs < 0 {
+			return 0, false, true, fmt.Errorf("malformed message_ttl %q", tag[1])
+		}
+		return time.Duration(secs) * time.Second, len(tag) >= 3 && tag[2] == "confirm", true, nil
+	}
+	return 0, false, false, nil
+}
+
+// notPinnedCondition exempts chat e of group g pinned (kind 10001) by one of
+// its admins or moderators.
+const notPinnedCondition = `NOT EXISTS (
+	SELECT 1 FROM event_tags pt
+	JOIN events p ON p.id = pt.event_id AND p.kind = 10001
+	JOIN group_members gm ON gm.pubkey = p.pubkey AND gm.group_id = g.id AND gm.role IN ('admin', 'moderator')
+	WHERE pt.tag_name = 'e' AND pt.tag_value = e.id)`
+
+// newlyExpiredChat counts the messages of groupId that a TTL of ttl would
+// expire and the group's current TTL keeps.
+func newlyExpiredChat(ctx context.Context, groupId string, ttl time.Duration) (int64, error) {
+	var n int64
+	for _, kind := range purgedChatKinds {
+		retention := chatRetention(kind)
+		next := effectiveTTL(ttl, retention)
+		if next <= 0 {
+			continue
+		}
+		var count int64
+		err := db.QueryRowContext(ctx, `
+			SELECT COUNT(*) FROM events e
+			JOIN event_tags h ON h.event_id = e.id AND h.tag_name = 'h'
+			JOIN groups g ON g.id = h.tag_value AND g.community = e.community
+			WHERE g.id = $1 AND g.community = $2 AND e.kind = $3
+			AND e.created_at < EXTRACT(EPOCH FROM NOW())::bigint - $4
+			AND (LEAST(NULLIF(g.message_ttl, 0), NULLIF($5, 0)) IS NULL
+				OR e.created_at >= EXTRACT(EPOCH FROM NOW())::bigint - LEAST(NULLIF(g.message_ttl, 0), NULLIF($5, 0)))
+			AND `+notPinnedCondition+`
+			AND `+notAnnouncementCondition,
+			groupId, communityOf(ctx).id(), kind, int64(next.Seconds()), int64(retention.Seconds())).Scan(&count)
+		if err != nil {
+			return 0, err
+		}
+		n += count
+	}
+	return n, nil
+}
+
+// rejectMessageTTL checks the message_ttl tag of a kind 9002, if any.
+func rejectMessageTTL(ctx context.Context, event *nostr.Event) (bool, string) {
+	ttl, confirm, ok, err := messageTTLTag(event.Tags)
+	if !ok {
+		return false, ""
+	}
+	if err != nil {
+		return true, say(ctx, msgTTLMalformed)
+	}
+	if confirm {
+		return false, ""
+	}
+	n, err := newlyExpiredChat(ctx, getHTag(event), ttl)
+	if err != nil {
+		log.Printf("[retention] Error checking TTL change for %s: %v", getHTag(event), err)
+		return true, say(ctx, msgTTLCheckFailed)
+	}
+	if n > 0 {
+		return true, say(ctx, msgTTLConfirm, n)
+	}
+	return false, ""
+}
+
+// setMessageTTL stores groupId's TTL as part of tx, which must hold the
+// group's lock.
+func setMessageTTL(ctx context.Context, tx *sql.Tx, groupId string, ttl time.Duration) error {
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE groups SET message_ttl = $1, updated_at = NOW() WHERE id = $2",
+		int64(ttl.Seconds()), groupId); err != nil {
+		return err
+	}
+	log.Printf("[retention] Group %s message TTL set to %s", groupId, ttl)
+	return markGroupDirty(ctx, tx, groupId)
+}
+
+// purgeExpiredChat tombstones and deletes one batch of expired chat of kind.
+func purgeExpiredChat(ctx context.Context, kind int) (int64, error) {
+	res, err := db.ExecContext(ctx, `
+		WITH expired AS (
+			SELECT e.id FROM events e
+			JOIN event_tags h ON h.event_id = e.id AND h.tag_name = 'h'
+			JOIN groups g ON g.id = h.tag_value AND g.community = e.community
+			WHERE e.kind = $1
+			AND e.created_at < EXTRACT(EPOCH FROM NOW())::bigint - LEAST(NULLIF(g.message_ttl, 0), NULLIF($2, 0))
+			AND `+notPinnedCondition+`
+			AND `+notAnnouncementCondition+`
+			LIMIT $3
+		), tombstoned AS (
+			INSERT INTO tombstones (target) SELECT id FROM expired ON CONFLICT (target) DO NOTHING
+		), reactions AS (
+			DELETE FROM events WHERE id IN (
+				SELECT r.event_id FROM group_reactions r JOIN expired x ON r.target = x.id)
+		)
+		DELETE FROM events WHERE id IN (SELECT id FROM expired)
+	`, kind, int64(chatRetention(kind).Seconds()), chatPurgeBatch)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// purgeAllExpiredChat purges batches until none is full.
+func purgeAllExpiredChat(ctx context.Context) (int64, error) {
+	var total int64
+	for _, kind := range purgedChatKinds {
+		for {
+			n, err := purgeExpiredChat(ctx, kind)
+			total += n
+			if err != nil {
+				return total, err
+			}
+			if n < chatPurgeBatch {
+				break
+			}
+		}
+	}
+	return total, nil
+}
+
+// runChatRetentionPurger applies chat retention hourly.
+func runChatRetentionPurger(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if n, err := purgeAllExpiredChat(ctx); err != nil {
+			log.Printf("[retention] Error purging expired chat: %v", err)
+		} else if n > 0 {
+			log.Printf("[retention] Purged %d expired chat messages", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ─── HTTP ──────────────────────────────────────────────────────────────────────
+
+type messageTTLRequest struct {
+	Group      string `json:"group"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+	Confirm    bool   `json:"confirm"`
+}
+
+// registerRetentionAPI mounts POST /admin/groups/message-ttl (the
+// community's relay admin, JSON body) on the admin mux.
+func registerRetentionAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/groups/message-ttl", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		pubkey := nip98Admin(r)
+		var req messageTTLRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil || req.TTLSeconds < 0 {
+			httpError(w, r, pubkey, http.StatusBadRequest, msgMalformedJSON)
+			return
+		}
+		if !groupExists(ctx, req.Group) {
+			httpError(w, r, pubkey, http.StatusNotFound, msgGroupNotFound)
+			return
+		}
+		ttl := time.Duration(req.TTLSeconds) * time.Second
+		if !req.Confirm {
+			n, err := newlyExpiredChat(ctx, req.Group, ttl)
+			if err != nil {
+				writeAPIResult(w, nil, err)
+				return
+			}
+			if n > 0 {
+				httpError(w, r, pubkey, http.StatusConflict, msgTTLConfirm, n)
+				return
+			}
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			writeAPIResult(w, nil, err)
+			return
+		}
+		defer tx.Rollback()
+		if err = lockGroup(ctx, tx, req.Group); err == nil {
+			if err = setMessageTTL(ctx, tx, req.Group, ttl); err == nil {
+				err = tx.Commit()
+			}
+		}
+		if err == nil {
+			groupSync.kick()
+		}
+		writeAPIResult(w, map[string]interface{}{"group": req.Group, "ttl_seconds": req.TTLSeconds}, err)
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMessageTTLTag(t *testing.T) {
+	cases := []struct {
+		tags    nostr.Tags
+		ttl     time.Duration
+		confirm bool
+		ok      bool
+		err     bool
+	}{
+		{nostr.Tags{{"name", "Bakers"}}, 0, false, false, false},
+		{nostr.Tags{{"message_ttl", "86400"}}, 24 * time.Hour, false, true, false},
+		{nostr.Tags{{"message_ttl", "3600", "confirm"}}, time.Hour, true, true, false},
+		{nostr.Tags{{"message_ttl", "0"}}, 0, false, true, false},
+		{nostr.Tags{{"message_ttl", "-5"}}, 0, false, true, true},
+		{nostr.Tags{{"message_ttl", "1d"}}, 0, false, true, true},
+	}
+	for i, tc := range cases {
+		ttl, confirm, ok, err := messageTTLTag(tc.tags)
+		if ttl != tc.ttl || confirm != tc.confirm || ok != tc.ok || (err != nil) != tc.err {
+			t.Errorf("case %d: got %v %v %v %v", i, ttl, confirm, ok, err)
+		}
+	}
+}
+
+func TestEffectiveTTL(t *testing.T) {
+	day := 24 * time.Hour
+	for _, tc := range []struct{ group, relay, want time.Duration }{
+		{0, 0, 0},
+		{day, 0, day},
+		{0, 30 * day, 30 * day},
+		{day, 30 * day, day},
+		{60 * day, 30 * day, 30 * day}, // a group cannot extend the relay's retention
+	} {
+		if got := effectiveTTL(tc.group, tc.relay); got != tc.want {
+			t.Errorf("group %v, relay %v: got %v, want %v", tc.group, tc.relay, got, tc.want)
+		}
+	}
+}
+
+func TestChatRetention(t *testing.T) {
+	prev := limits.Retention
+	t.Cleanup(func() { limits.Retention = prev })
+	limits.Retention = []retentionRule{
+		{Kinds: []int{KindGroupChat, KindGroupChatReply}, Time: 7 * 86400},
+		{Kinds: []int{KindGroupChat}, Time: 86400},
+		{Count: 1000},
+	}
+	if got := chatRetention(KindGroupChat); got != 24*time.Hour {
+		t.Fatalf("kind 9: %v", got)
+	}
+	if got := chatRetention(KindGroupChatReply); got != 7*24*time.Hour {
+		t.Fatalf("kind 10: %v", got)
+	}
+	if got := chatRetention(KindGroupChatDelete); got != 0 {
+		t.Fatalf("kind 11: %v", got)
+	}
+}
+
+func TestPurgeExpiredChat(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	prev := limits.Retention
+	limits.Retention = nil
+	t.Cleanup(func() { limits.Retention = prev })
+	modSK, chatSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	mod, _ := nostr.GetPublicKey(modSK)
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO groups (id, name, message_ttl) VALUES ('bakers', 'Bakers', 3600), ('archivists', 'Archivists', 0)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO group_members (group_id, pubkey, role) VALUES ('bakers', $1, 'moderator')", mod); err != nil {
+		t.Fatal(err)
+	}
+
+	old := nostr.Now() - 2*3600
+	post := func(kind int, group string, createdAt nostr.Timestamp) *nostr.Event {
+		evt := signedEvent(t, chatSK, kind, createdAt, nostr.Tags{{"h", group}}, "crumb shot")
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+		return evt
+	}
+	expired := post(KindGroupChat, "bakers", old)
+	pinned := post(KindGroupChat, "bakers", old)
+	fresh := post(KindGroupChatReply, "bakers", nostr.Now())
+	forever := post(KindGroupChat, "archivists", old)
+	pins := signedEvent(t, modSK, 10001, nostr.Now(), nostr.Tags{{"e", pinned.ID}}, "")
+	if err := persistEvent(ctx, pins); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := purgeAllExpiredChat(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("purged %d (%v), want 1", n, err)
+	}
+	for _, evt := range []*nostr.Event{pinned, fresh, forever} {
+		var exists bool
+		if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM events WHERE id = $1)", evt.ID).Scan(&exists); err != nil || !exists {
+			t.Fatalf("event %s purged (%v)", evt.ID, err)
+		}
+	}
+	var tombstoned bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM tombstones WHERE target = $1)", expired.ID).Scan(&tombstoned); err != nil || !tombstoned {
+		t.Fatalf("purged message not tombstoned (%v)", err)
+	}
+
+	// The relay-wide retention applies where it is tighter.
+	limits.Retention = []retentionRule{{Kinds: []int{KindGroupChat}, Time: 3600}}
+	if n, err := purgeAllExpiredChat(ctx); err != nil || n != 1 {
+		t.Fatalf("relay retention purged %d (%v), want 1", n, err)
+	}
+}
+
+func TestMessageTTLNeedsConfirmation(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	prev := limits.Retention
+	limits.Retention = nil
+	t.Cleanup(func() { limits.Retention = prev })
+	chatSK := nostr.GeneratePrivateKey()
+	if _, err := db.ExecContext(ctx, "INSERT INTO groups (id, name, message_ttl) VALUES ('bakers', 'Bakers', 7200)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, age := range []nostr.Timestamp{1800, 5400} {
+		if err := persistEvent(ctx, signedEvent(t, chatSK, KindGroupChat, nostr.Now()-age, nostr.Tags{{"h", "bakers"}}, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	edit := func(tag ...string) *nostr.Event {
+		return &nostr.Event{Kind: KindEditMetadata, Tags: nostr.Tags{{"h", "bakers"}, append(nostr.Tag{"message_ttl"}, tag...)}}
+	}
+	if reject, msg := rejectMessageTTL(ctx, edit("3600")); !reject || !strings.Contains(msg, "1 existing") {
+		t.Fatalf("tighter TTL accepted without confirmation: %v %q", reject, msg)
+	}
+	if reject, msg := rejectMessageTTL(ctx, edit("3600", "confirm")); reject {
+		t.Fatalf("confirmed TTL rejected: %q", msg)
+	}
+	if reject, msg := rejectMessageTTL(ctx, edit("86400")); reject {
+		t.Fatalf("looser TTL rejected: %q", msg)
+	}
+	if reject, msg := rejectMessageTTL(ctx, edit("0")); reject {
+		t.Fatalf("removing the TTL rejected: %q", msg)
+	}
+	if reject, msg := rejectMessageTTL(ctx, edit("soon")); !reject || !strings.HasPrefix(msg, "invalid:") {
+		t.Fatalf("malformed TTL: %v %q", reject, msg)
+	}
+}
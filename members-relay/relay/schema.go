@@ -0,0 +1,667 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// TABLE MIGRATIONS
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// schemaMigrations are idempotent DDL statements applied in order at startup.
+// The first block mirrors the tables db/init.sql creates for a fresh install so
+// the relay (and its test database) can bootstrap itself; later entries are
+// additive changes. Never edit an entry once shipped — append a new one.
+var schemaMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS events (
+		id         TEXT PRIMARY KEY,
+		pubkey     TEXT NOT NULL,
+		kind       INTEGER NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		content    TEXT NOT NULL DEFAULT '',
+		tags       JSONB NOT NULL DEFAULT '[]',
+		sig        TEXT NOT NULL,
+		d_tag      TEXT,
+		raw        JSONB NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS members (
+		pubkey             TEXT PRIMARY KEY,
+		status             TEXT NOT NULL DEFAULT 'active',
+		tier               TEXT NOT NULL DEFAULT 'standard',
+		subscription_start TIMESTAMPTZ,
+		subscription_end   TIMESTAMPTZ,
+		payment_id         TEXT,
+		payment_method     TEXT,
+		created_at         TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at         TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS groups (
+		id          TEXT PRIMARY KEY,
+		name        TEXT NOT NULL,
+		description TEXT,
+		picture_url TEXT,
+		is_public   BOOLEAN NOT NULL DEFAULT false,
+		is_open     BOOLEAN NOT NULL DEFAULT false,
+		created_by  TEXT,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS group_members (
+		group_id  TEXT NOT NULL,
+		pubkey    TEXT NOT NULL,
+		role      TEXT NOT NULL DEFAULT 'member',
+		joined_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (group_id, pubkey)
+	)`,
+	`CREATE TABLE IF NOT EXISTS group_bans (
+		group_id  TEXT NOT NULL,
+		pubkey    TEXT NOT NULL,
+		reason    TEXT,
+		banned_by TEXT,
+		banned_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (group_id, pubkey)
+	)`,
+	`CREATE TABLE IF NOT EXISTS relay_state (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`,
+
+	// Single-letter tags, one row per (event, name, value), for index-backed
+	// tag filters. Rows disappear with their event via the cascade.
+	`CREATE TABLE IF NOT EXISTS event_tags (
+		event_id  TEXT NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+		tag_name  TEXT NOT NULL,
+		tag_value TEXT NOT NULL,
+		PRIMARY KEY (event_id, tag_name, tag_value)
+	)`,
+
+	// Last outbound profile fetch per pubkey, found or not.
+	`CREATE TABLE IF NOT EXISTS profile_fetches (
+		pubkey     TEXT PRIMARY KEY,
+		fetched_at TIMESTAMPTZ NOT NULL
+	)`,
+
+	// Follow edges mirrored from each author's current kind 3.
+	`CREATE TABLE IF NOT EXISTS follows (
+		follower TEXT NOT NULL,
+		followee TEXT NOT NULL,
+		PRIMARY KEY (follower, followee)
+	)`,
+
+	// Span of each stored NIP-52 calendar event, for upcoming-event queries.
+	`CREATE TABLE IF NOT EXISTS calendar_events (
+		event_id  TEXT PRIMARY KEY REFERENCES events(id) ON DELETE CASCADE,
+		group_id  TEXT,
+		starts_at TIMESTAMPTZ NOT NULL,
+		ends_at   TIMESTAMPTZ NOT NULL
+	)`,
+
+	// One row per badge and recipient; revoked awards keep their row.
+	`CREATE TABLE IF NOT EXISTS badge_awards (
+		badge      TEXT NOT NULL,
+		recipient  TEXT NOT NULL,
+		event_id   TEXT,
+		awarded_at TIMESTAMPTZ NOT NULL,
+		revoked_at TIMESTAMPTZ,
+		PRIMARY KEY (badge, recipient)
+	)`,
+
+	// NIP-09 tombstones: deleted event ids, and addresses deleted by
+	// coordinate up to deleted_until, so deleted events are not accepted again.
+	`CREATE TABLE IF NOT EXISTS tombstones (
+		target        TEXT PRIMARY KEY,
+		deleted_until BIGINT,
+		deleted_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+
+	// Who deleted which event, on what authority.
+	`CREATE TABLE IF NOT EXISTS deletion_audit (
+		id          BIGSERIAL PRIMARY KEY,
+		event_id    TEXT NOT NULL,
+		address     TEXT,
+		kind        INTEGER NOT NULL,
+		author      TEXT NOT NULL,
+		deleted_by  TEXT NOT NULL,
+		relayed_by  TEXT,
+		authority   TEXT NOT NULL,
+		request_id  TEXT NOT NULL,
+		deleted_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+
+	// NIP-29 group sync: a group whose relay-signed metadata lags its
+	// tables is dirty until the sync worker regenerates it.
+	`ALTER TABLE groups ADD COLUMN IF NOT EXISTS metadata_dirty_since TIMESTAMPTZ`,
+	`ALTER TABLE groups ADD COLUMN IF NOT EXISTS metadata_version BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE groups ADD COLUMN IF NOT EXISTS metadata_sync_error TEXT`,
+
+	// Relay-signed group events (join/leave confirmations) awaiting signing.
+	`CREATE TABLE IF NOT EXISTS group_outbox (
+		id           BIGSERIAL PRIMARY KEY,
+		group_id     TEXT NOT NULL,
+		event        JSONB NOT NULL,
+		attempts     INTEGER NOT NULL DEFAULT 0,
+		next_attempt TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		last_error   TEXT,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+
+	// Communities (see COMMUNITIES). Existing rows belong to the default
+	// community, and a pubkey can be a member of several communities.
+	`ALTER TABLE members ADD COLUMN IF NOT EXISTS community TEXT NOT NULL DEFAULT 'default'`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS members_community_pubkey ON members (community, pubkey)`,
+	`ALTER TABLE members DROP CONSTRAINT IF EXISTS members_pkey`,
+	`ALTER TABLE groups ADD COLUMN IF NOT EXISTS community TEXT NOT NULL DEFAULT 'default'`,
+	`ALTER TABLE events ADD COLUMN IF NOT EXISTS community TEXT NOT NULL DEFAULT 'default'`,
+
+	// Content labels (see CONTENT LABELS), one row per label event, target
+	// and label; rows disappear with their label event via the cascade.
+	`CREATE TABLE IF NOT EXISTS content_labels (
+		event_id  TEXT NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+		target    TEXT NOT NULL,
+		label     TEXT NOT NULL,
+		reason    TEXT,
+		labeler   TEXT NOT NULL,
+		community TEXT NOT NULL,
+		PRIMARY KEY (event_id, target, label)
+	)`,
+	`ALTER TABLE groups ADD COLUMN IF NOT EXISTS require_media_labels BOOLEAN NOT NULL DEFAULT false`,
+	// Per-group chat TTL in seconds, 0 for none (see CHAT RETENTION).
+	`ALTER TABLE groups ADD COLUMN IF NOT EXISTS message_ttl BIGINT NOT NULL DEFAULT 0`,
+
+	// Full-text search over the title tag and content (see SEARCH).
+	`ALTER TABLE events ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+		setweight(to_tsvector('simple', COALESCE(jsonb_path_query_first(tags, '$[*] ? (@[0] == "title")') ->> 1, '')), 'A') ||
+		setweight(to_tsvector('simple', content), 'B')
+	) STORED`,
+
+	// Each stored group chat reaction (see GROUP CHAT REACTIONS).
+	`CREATE TABLE IF NOT EXISTS group_reactions (
+		event_id  TEXT PRIMARY KEY REFERENCES events(id) ON DELETE CASCADE,
+		target    TEXT NOT NULL,
+		group_id  TEXT NOT NULL,
+		pubkey    TEXT NOT NULL,
+		emoji     TEXT NOT NULL,
+		community TEXT NOT NULL
+	)`,
+
+	// Recipes considered for each week's featured list (see FEATURED
+	// RECIPES), kept after publication as a record of the review.
+	`CREATE TABLE IF NOT EXISTS featured_picks (
+		week     TEXT NOT NULL,
+		address  TEXT NOT NULL,
+		score    INTEGER NOT NULL DEFAULT 0,
+		status   TEXT NOT NULL,
+		added_by TEXT NOT NULL,
+		PRIMARY KEY (week, address)
+	)`,
+
+	// Each stored read marker's position (see READ MARKERS).
+	`CREATE TABLE IF NOT EXISTS read_markers (
+		event_id   TEXT PRIMARY KEY REFERENCES events(id) ON DELETE CASCADE,
+		pubkey     TEXT NOT NULL,
+		group_id   TEXT NOT NULL,
+		community  TEXT NOT NULL,
+		read_until TIMESTAMPTZ NOT NULL
+	)`,
+
+	// The sats of each zap receipt for a stored recipe (see RECIPE ZAPS).
+	`CREATE TABLE IF NOT EXISTS zap_receipts (
+		event_id  TEXT PRIMARY KEY REFERENCES events(id) ON DELETE CASCADE,
+		recipe    TEXT NOT NULL,
+		msats     BIGINT NOT NULL,
+		community TEXT NOT NULL
+	)`,
+
+	// Each stored report's targets, and the events hidden once enough
+	// members reported them (see REPORTS). target_event is '' for a report
+	// of a pubkey alone.
+	`CREATE TABLE IF NOT EXISTS reports (
+		event_id      TEXT NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+		reporter      TEXT NOT NULL,
+		target_event  TEXT NOT NULL,
+		target_pubkey TEXT NOT NULL,
+		report_type   TEXT NOT NULL,
+		community     TEXT NOT NULL,
+		PRIMARY KEY (event_id, target_event, target_pubkey)
+	)`,
+	`CREATE TABLE IF NOT EXISTS hidden_events (
+		community  TEXT NOT NULL,
+		id         TEXT NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+		hidden_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		cleared_at TIMESTAMPTZ,
+		PRIMARY KEY (community, id)
+	)`,
+
+	// Pubkeys and events the relay admin banned over NIP-86 (see RELAY
+	// MANAGEMENT), per community.
+	`CREATE TABLE IF NOT EXISTS banned_pubkeys (
+		community TEXT NOT NULL,
+		pubkey    TEXT NOT NULL,
+		reason    TEXT NOT NULL DEFAULT '',
+		banned_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (community, pubkey)
+	)`,
+	`CREATE TABLE IF NOT EXISTS banned_events (
+		community TEXT NOT NULL,
+		id        TEXT NOT NULL,
+		reason    TEXT NOT NULL DEFAULT '',
+		banned_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (community, id)
+	)`,
+
+	// events.created_at holds the event's own Unix timestamp, compared and
+	// returned exactly as clients send it. Existing rows are converted once.
+	`DO $$ BEGIN
+		IF (SELECT data_type FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'events' AND column_name = 'created_at') <> 'bigint' THEN
+			ALTER TABLE events ALTER COLUMN created_at TYPE BIGINT USING EXTRACT(EPOCH FROM created_at)::bigint;
+		END IF;
+	END $$`,
+
+	// Hashtags in event_tags are lowercase (see tagIndexValue). Rows indexed
+	// before that are rewritten once.
+	`DO $$ BEGIN
+		IF NOT EXISTS (SELECT 1 FROM relay_state WHERE key = 'event_tags_hashtags_lowercased') THEN
+			INSERT INTO event_tags (event_id, tag_name, tag_value)
+			SELECT event_id, tag_name, lower(tag_value) FROM event_tags
+			WHERE tag_name = 't' AND tag_value <> lower(tag_value)
+			ON CONFLICT DO NOTHING;
+			DELETE FROM event_tags WHERE tag_name = 't' AND tag_value <> lower(tag_value);
+			INSERT INTO relay_state (key, value) VALUES ('event_tags_hashtags_lowercased', NOW()::text);
+		END IF;
+	END $$`,
+
+	// NIP-40 expiration, copied from the first expiration tag (see EXPIRING
+	// EVENTS). Events stored before the column are filled in once.
+	`ALTER TABLE events ADD COLUMN IF NOT EXISTS expires_at BIGINT`,
+	`DO $$ BEGIN
+		IF NOT EXISTS (SELECT 1 FROM relay_state WHERE key = 'events_expires_at_backfilled') THEN
+			UPDATE events SET expires_at = (
+				SELECT CASE WHEN x->>1 ~ '^[0-9]{1,12}$' THEN (x->>1)::bigint END
+				FROM jsonb_array_elements(events.tags) WITH ORDINALITY AS t(x, n)
+				WHERE x->>0 = 'expiration' ORDER BY n LIMIT 1)
+			WHERE tags @> '[["expiration"]]';
+			INSERT INTO relay_state (key, value) VALUES ('events_expires_at_backfilled', NOW()::text);
+		END IF;
+	END $$`,
+
+	// One stored version per address (see idx_events_address). Versions
+	// left behind by concurrent replacements are dropped once, keeping the
+	// newest, the lowest id winning a tie.
+	`DO $$ BEGIN
+		IF NOT EXISTS (SELECT 1 FROM relay_state WHERE key = 'events_addresses_deduplicated') THEN
+			DELETE FROM events e USING events n
+			WHERE e.d_tag IS NOT NULL AND n.d_tag = e.d_tag
+			AND n.kind = e.kind AND n.pubkey = e.pubkey AND n.community = e.community
+			AND (n.created_at > e.created_at OR (n.created_at = e.created_at AND n.id < e.id));
+			INSERT INTO relay_state (key, value) VALUES ('events_addresses_deduplicated', NOW()::text);
+		END IF;
+	END $$`,
+	// The uniqueness itself is part of the schema, not of the optional
+	// index manifest. Versions stored since the step above are dropped the
+	// same way, under a lock that holds writers off until the index exists.
+	`DO $$ BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_indexes
+			WHERE schemaname = current_schema() AND indexname = 'idx_events_address') THEN
+			LOCK TABLE events IN SHARE ROW EXCLUSIVE MODE;
+			DELETE FROM events e USING events n
+			WHERE e.d_tag IS NOT NULL AND n.d_tag = e.d_tag
+			AND n.kind = e.kind AND n.pubkey = e.pubkey AND n.community = e.community
+			AND (n.created_at > e.created_at OR (n.created_at = e.created_at AND n.id < e.id));
+			CREATE UNIQUE INDEX idx_events_address ON events (kind, pubkey, d_tag, community);
+		END IF;
+	END $$`,
+
+	// Join requests to closed groups awaiting an admin (see JOIN REQUESTS AND
+	// INVITES).
+	`CREATE TABLE IF NOT EXISTS pending_joins (
+		group_id     TEXT NOT NULL,
+		pubkey       TEXT NOT NULL,
+		event_id     TEXT NOT NULL,
+		requested_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (group_id, pubkey)
+	)`,
+	// Invite codes issued by create-invite events; deleting the event
+	// revokes its code. expires_at is a Unix timestamp, like events'.
+	`CREATE TABLE IF NOT EXISTS invites (
+		group_id   TEXT NOT NULL,
+		code       TEXT NOT NULL,
+		event_id   TEXT NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+		creator    TEXT NOT NULL,
+		max_uses   INTEGER NOT NULL,
+		uses_left  INTEGER NOT NULL,
+		expires_at BIGINT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (group_id, code)
+	)`,
+	// Timed mutes from mute-user events (see GROUP MUTES); muted_until is a
+	// Unix timestamp. Expired rows are ignored, not swept.
+	`CREATE TABLE IF NOT EXISTS group_mutes (
+		group_id    TEXT NOT NULL,
+		pubkey      TEXT NOT NULL,
+		muted_until BIGINT NOT NULL,
+		muted_by    TEXT NOT NULL,
+		PRIMARY KEY (group_id, pubkey)
+	)`,
+	// Events pinned by pin-event (see PINNED MESSAGES).
+	`CREATE TABLE IF NOT EXISTS group_pins (
+		group_id  TEXT NOT NULL,
+		event_id  TEXT NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+		pinned_by TEXT NOT NULL,
+		pinned_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (group_id, event_id)
+	)`,
+	// The community of queued relay events, for groups deleted meanwhile.
+	`ALTER TABLE group_outbox ADD COLUMN IF NOT EXISTS community TEXT`,
+	// Per-group member cap, 0 for none (see GROUP CAPACITY).
+	`ALTER TABLE groups ADD COLUMN IF NOT EXISTS max_members INTEGER NOT NULL DEFAULT 0`,
+	// Group memberships ended by a lapsed subscription (see LAPSED MEMBERS).
+	`CREATE TABLE IF NOT EXISTS group_member_lapses (
+		id        BIGSERIAL PRIMARY KEY,
+		group_id  TEXT NOT NULL,
+		pubkey    TEXT NOT NULL,
+		role      TEXT NOT NULL,
+		joined_at TIMESTAMPTZ NOT NULL,
+		lapsed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+
+	// One join request (kind 9021) per try (see JOIN REQUESTS AND INVITES).
+	// Requests repeated with no leave (9022) or removal (9001) in between
+	// are dropped once, keeping the newest, the lowest id winning a tie.
+	// Tags are matched in the tags column: migrateSchema runs before
+	// backfillEventTags fills event_tags on an upgraded database.
+	`DO $$ BEGIN
+		IF NOT EXISTS (SELECT 1 FROM relay_state WHERE key = 'join_requests_deduplicated') THEN
+			DELETE FROM events e USING (
+				SELECT DISTINCT r.id, t->>1 AS group_id
+				FROM events r, jsonb_array_elements(r.tags) t
+				WHERE r.kind = 9021 AND t->>0 = 'h'
+			) h
+			WHERE e.id = h.id
+			AND NOT EXISTS (SELECT 1 FROM pending_joins p WHERE p.event_id = e.id)
+			AND EXISTS (
+				SELECT 1 FROM events n
+				WHERE n.kind = 9021 AND n.pubkey = e.pubkey AND n.community = e.community
+				AND n.tags @> jsonb_build_array(jsonb_build_array('h', h.group_id))
+				AND (n.created_at > e.created_at OR (n.created_at = e.created_at AND n.id < e.id))
+				AND NOT EXISTS (
+					SELECT 1 FROM events x
+					WHERE x.community = e.community AND x.created_at BETWEEN e.created_at AND n.created_at
+					AND x.tags @> jsonb_build_array(jsonb_build_array('h', h.group_id))
+					AND ((x.kind = 9022 AND x.pubkey = e.pubkey)
+						OR (x.kind = 9001 AND x.tags @> jsonb_build_array(jsonb_build_array('p', e.pubkey))))));
+			INSERT INTO relay_state (key, value) VALUES ('join_requests_deduplicated', NOW()::text);
+		END IF;
+	END $$`,
+
+	// One stored version per replaceable kind and author (kinds 0, 3 and
+	// 10000-19999). Older versions stored before persistEvent enforced this,
+	// or by bulk imports, are dropped once, keeping the newest, the lowest
+	// id winning a tie.
+	`DO $$ BEGIN
+		IF NOT EXISTS (SELECT 1 FROM relay_state WHERE key = 'events_replaceables_deduplicated') THEN
+			DELETE FROM events e USING events n
+			WHERE (e.kind IN (0, 3) OR e.kind BETWEEN 10000 AND 19999)
+			AND n.kind = e.kind AND n.pubkey = e.pubkey AND n.community = e.community
+			AND (n.created_at > e.created_at OR (n.created_at = e.created_at AND n.id < e.id));
+			INSERT INTO relay_state (key, value) VALUES ('events_replaceables_deduplicated', NOW()::text);
+		END IF;
+	END $$`,
+}
+
+// schemaAdvisoryLockKey serializes migrations across instances.
+const schemaAdvisoryLockKey = 7_290_460
+
+// migrateSchema applies schemaMigrations under a session advisory lock.
+func migrateSchema(ctx context.Context) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", schemaAdvisoryLockKey); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", schemaAdvisoryLockKey)
+
+	for i, stmt := range schemaMigrations {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("migration %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// INDEX MANIFEST
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// indexSpec describes an index the relay's queries depend on. The manifest
+// below is the single source of truth: startup verification, automatic
+// creation and the `schema` subcommand used by migrations all read from it.
+type indexSpec struct {
+	Name    string
+	Table   string
+	Method  string // btree, gin, ...
+	Columns string // column list exactly as Postgres renders it in pg_indexes
+}
+
+var indexManifest = []indexSpec{
+	{Name: "idx_events_kind_created_at", Table: "events", Method: "btree", Columns: "kind, created_at DESC"},
+	{Name: "idx_events_pubkey_created_at", Table: "events", Method: "btree", Columns: "pubkey, created_at DESC"},
+	{Name: "idx_events_d_tag", Table: "events", Method: "btree", Columns: "d_tag"},
+	{Name: "idx_events_expires_at", Table: "events", Method: "btree", Columns: "expires_at"},
+	{Name: "idx_events_kind_pubkey_d_tag", Table: "events", Method: "btree", Columns: "kind, pubkey, d_tag"},
+	{Name: "idx_events_tags", Table: "events", Method: "gin", Columns: "tags"},
+	{Name: "idx_group_members_pubkey", Table: "group_members", Method: "btree", Columns: "pubkey"},
+	{Name: "idx_event_tags_name_value", Table: "event_tags", Method: "btree", Columns: "tag_name, tag_value, event_id"},
+	{Name: "idx_calendar_events_group_ends_at", Table: "calendar_events", Method: "btree", Columns: "group_id, ends_at"},
+	{Name: "idx_follows_followee", Table: "follows", Method: "btree", Columns: "followee, follower"},
+	{Name: "idx_events_search_vector", Table: "events", Method: "gin", Columns: "search_vector"},
+	{Name: "idx_content_labels_target", Table: "content_labels", Method: "btree", Columns: "target, community"},
+	{Name: "idx_group_reactions_target", Table: "group_reactions", Method: "btree", Columns: "target, pubkey, emoji"},
+	{Name: "idx_read_markers_pubkey_group", Table: "read_markers", Method: "btree", Columns: "pubkey, group_id"},
+	{Name: "idx_zap_receipts_recipe", Table: "zap_receipts", Method: "btree", Columns: "recipe, community"},
+	{Name: "idx_reports_target", Table: "reports", Method: "btree", Columns: "target_event, community"},
+	{Name: "idx_group_member_lapses_member", Table: "group_member_lapses", Method: "btree", Columns: "group_id, pubkey, lapsed_at DESC"},
+}
+
+// indexAdvisoryLockKey guards concurrent index creation when several relay
+// instances start against the same database.
+const indexAdvisoryLockKey = 7_290_456
+
+var (
+	statsIndexesMissing = expvar.NewInt("schema_indexes_missing")
+	statsSchemaDegraded = expvar.NewInt("schema_degraded")
+)
+
+// definition renders the index body the way pg_indexes.indexdef does, minus
+// the schema qualifier, so it can be compared against what is installed.
+func (s indexSpec) definition() string {
+	return fmt.Sprintf("CREATE INDEX %s ON %s USING %s (%s)", s.Name, s.Table, s.Method, s.Columns)
+}
+
+// createStatement is the DDL migrations and the auto-creator run.
+func (s indexSpec) createStatement() string {
+	return fmt.Sprintf("CREATE INDEX CONCURRENTLY IF NOT EXISTS %s ON %s USING %s (%s)",
+		s.Name, s.Table, s.Method, s.Columns)
+}
+
+// indexBody strips the "CREATE [UNIQUE] INDEX name ON [public.]table" prefix so
+// an index installed under a different name still counts as present.
+func indexBody(def string) string {
+	def = normalizeIndexDef(def)
+	if i := strings.Index(def, " on "); i >= 0 {
+		def = def[i+len(" on "):]
+	}
+	return def
+}
+
+func normalizeIndexDef(def string) string {
+	def = strings.ToLower(strings.Join(strings.Fields(def), " "))
+	return strings.ReplaceAll(def, " public.", " ")
+}
+
+type installedIndex struct {
+	name  string
+	def   string
+	valid bool
+}
+
+type indexProblem struct {
+	spec   indexSpec
+	reason string
+}
+
+// diffIndexes compares the manifest against installed indexes and reports
+// which entries are missing, invalid, or installed with a different definition.
+func diffIndexes(manifest []indexSpec, installed []installedIndex) []indexProblem {
+	var problems []indexProblem
+	for _, spec := range manifest {
+		want := normalizeIndexDef(spec.definition())
+		var byName *installedIndex
+		equivalent := false
+		for i := range installed {
+			idx := &installed[i]
+			if idx.name == spec.Name {
+				byName = idx
+			}
+			if idx.valid && indexBody(idx.def) == indexBody(want) {
+				equivalent = true
+			}
+		}
+		switch {
+		case byName != nil && !byName.valid:
+			problems = append(problems, indexProblem{spec, "invalid (interrupted concurrent build)"})
+		case byName != nil && normalizeIndexDef(byName.def) != want && !equivalent:
+			problems = append(problems, indexProblem{spec, "definition mismatch: " + byName.def})
+		case byName == nil && !equivalent:
+			problems = append(problems, indexProblem{spec, "missing"})
+		}
+	}
+	return problems
+}
+
+func loadInstalledIndexes(ctx context.Context) ([]installedIndex, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT i.indexname, i.indexdef, x.indisvalid
+		FROM pg_indexes i
+		JOIN pg_class c ON c.relname = i.indexname
+		JOIN pg_namespace n ON n.oid = c.relnamespace AND n.nspname = i.schemaname
+		JOIN pg_index x ON x.indexrelid = c.oid
+		WHERE i.schemaname = current_schema()
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var installed []installedIndex
+	for rows.Next() {
+		var idx installedIndex
+		if err := rows.Scan(&idx.name, &idx.def, &idx.valid); err != nil {
+			return nil, err
+		}
+		installed = append(installed, idx)
+	}
+	return installed, rows.Err()
+}
+
+// verifyIndexes runs at startup. Missing indexes are created when
+// RELAY_CREATE_INDEXES is set; otherwise the relay keeps running but logs a
+// loud warning and flips the schema_degraded metric. RELAY_REQUIRE_INDEXES
+// turns the warning into a fatal error.
+func verifyIndexes(ctx context.Context) {
+	installed, err := loadInstalledIndexes(ctx)
+	if err != nil {
+		log.Printf("[schema] Could not inspect indexes: %v", err)
+		statsSchemaDegraded.Set(1)
+		return
+	}
+
+	problems := diffIndexes(indexManifest, installed)
+	if len(problems) > 0 && autoCreateIndexes {
+		if err := createIndexes(ctx, problems); err != nil {
+			log.Printf("[schema] Index creation failed: %v", err)
+		}
+		if installed, err = loadInstalledIndexes(ctx); err == nil {
+			problems = diffIndexes(indexManifest, installed)
+		}
+	}
+
+	statsIndexesMissing.Set(int64(len(problems)))
+	if len(problems) == 0 {
+		statsSchemaDegraded.Set(0)
+		log.Printf("[schema] All %d manifest indexes present", len(indexManifest))
+		return
+	}
+
+	statsSchemaDegraded.Set(1)
+	log.Println("[schema] ════════════════════════════════════════════════════════════")
+	log.Printf("[schema] WARNING: %d required index(es) missing or wrong — queries WILL be slow", len(problems))
+	for _, p := range problems {
+		log.Printf("[schema]   %s on %s: %s", p.spec.Name, p.spec.Table, p.reason)
+		log.Printf("[schema]     fix: %s;", p.spec.createStatement())
+	}
+	log.Println("[schema] Set RELAY_CREATE_INDEXES=true to create them automatically")
+	log.Println("[schema] ════════════════════════════════════════════════════════════")
+	if requireIndexes {
+		log.Fatal("[schema] RELAY_REQUIRE_INDEXES is set; refusing to start in a degraded configuration")
+	}
+}
+
+// createIndexes builds the given indexes CONCURRENTLY on a dedicated
+// connection holding a session advisory lock, so only one instance builds.
+func createIndexes(ctx context.Context, problems []indexProblem) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", indexAdvisoryLockKey).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		log.Println("[schema] Another instance is creating indexes; skipping")
+		return nil
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", indexAdvisoryLockKey)
+
+	for _, p := range problems {
+		if p.reason != "missing" {
+			// Invalid or mismatched indexes under our name are rebuilt from scratch.
+			log.Printf("[schema] Dropping %s (%s)", p.spec.Name, p.reason)
+			if _, err := conn.ExecContext(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+p.spec.Name); err != nil {
+				return fmt.Errorf("drop %s: %w", p.spec.Name, err)
+			}
+		}
+		log.Printf("[schema] Creating %s", p.spec.Name)
+		if _, err := conn.ExecContext(ctx, p.spec.createStatement()); err != nil {
+			return fmt.Errorf("create %s: %w", p.spec.Name, err)
+		}
+	}
+	return nil
+}
+
+// schemaSQL renders the migrations and index manifest as a migration script.
+func schemaSQL() string {
+	var b strings.Builder
+	b.WriteString("-- Generated by `relay schema` from schema.go.\n")
+	for _, stmt := range schemaMigrations {
+		b.WriteString(stmt)
+		b.WriteString(";\n\n")
+	}
+	b.WriteString("-- CREATE INDEX CONCURRENTLY cannot run inside a transaction block.\n")
+	for _, spec := range indexManifest {
+		b.WriteString(spec.createStatement())
+		b.WriteString(";\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestDiffIndexes(t *testing.T) {
+	manifest := []indexSpec{
+		{Name: "idx_events_kind_created_at", Table: "events", Method: "btree", Columns: "kind, created_at DESC"},
+		{Name: "idx_events_tags", Table: "events", Method: "gin", Columns: "tags"},
+		{Name: "idx_events_d_tag", Table: "events", Method: "btree", Columns: "d_tag"},
+	}
+
+	installed := []installedIndex{
+		{name: "idx_events_kind_created_at", def: "CREATE INDEX idx_events_kind_created_at ON public.events USING btree (kind, created_at DESC)", valid: true},
+		// Operator-created under another name: still satisfies the manifest.
+		{name: "events_tags_gin", def: "CREATE INDEX events_tags_gin ON public.events USING gin (tags)", valid: true},
+	}
+	problems := diffIndexes(manifest, installed)
+	if len(problems) != 1 || problems[0].spec.Name != "idx_events_d_tag" || problems[0].reason != "missing" {
+		t.Fatalf("expected only d_tag missing, got %+v", problems)
+	}
+
+	invalid := []installedIndex{
+		{name: "idx_events_kind_created_at", def: "CREATE INDEX idx_events_kind_created_at ON public.events USING btree (kind, created_at DESC)", valid: false},
+	}
+	problems = diffIndexes(manifest[:1], invalid)
+	if len(problems) != 1 || !strings.HasPrefix(problems[0].reason, "invalid") {
+		t.Fatalf("expected invalid index to be reported, got %+v", problems)
+	}
+
+	mismatched := []installedIndex{
+		{name: "idx_events_kind_created_at", def: "CREATE INDEX idx_events_kind_created_at ON public.events USING btree (kind)", valid: true},
+	}
+	problems = diffIndexes(manifest[:1], mismatched)
+	if len(problems) != 1 || !strings.HasPrefix(problems[0].reason, "definition mismatch") {
+		t.Fatalf("expected mismatch to be reported, got %+v", problems)
+	}
+}
+
+func TestSchemaSQLCoversManifest(t *testing.T) {
+	sql := schemaSQL()
+	for _, spec := range indexManifest {
+		if !strings.Contains(sql, spec.createStatement()+";") {
+			t.Fatalf("schema output missing %s", spec.Name)
+		}
+	}
+}
+
+// The address index comes with the schema, without RELAY_CREATE_INDEXES.
+func TestAddressIndexIsMigrated(t *testing.T) {
+	openTestDB(t)
+	var def string
+	if err := db.QueryRow("SELECT indexdef FROM pg_indexes WHERE indexname = 'idx_events_address'").Scan(&def); err != nil {
+		t.Fatalf("idx_events_address: %v", err)
+	}
+	if !strings.HasPrefix(def, "CREATE UNIQUE INDEX") {
+		t.Fatalf("idx_events_address is not unique: %s", def)
+	}
+	for _, spec := range indexManifest {
+		if spec.Name == "idx_events_address" {
+			t.Fatal("idx_events_address is still left to the index manifest")
+		}
+	}
+}
+
+// Replaceable versions stored before the single-version rule collapse to the
+// newest once the schema migrates.
+func TestReplaceablesAreDeduplicated(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	current := signedEvent(t, sk, nostr.KindProfileMetadata, now, nil, `{"name":"current"}`)
+	stale := signedEvent(t, sk, nostr.KindProfileMetadata, now-60, nil, `{"name":"stale"}`)
+	if err := persistEvent(ctx, current); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := stale.MarshalJSON()
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO events (id, pubkey, created_at, kind, tags, content, sig, raw) VALUES ($1, $2, $3, $4, '[]', '', $5, $6)",
+		stale.ID, stale.PubKey, stale.CreatedAt, stale.Kind, stale.Sig, raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM relay_state WHERE key = 'events_replaceables_deduplicated'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	if err := db.QueryRowContext(ctx,
+		"SELECT array_agg(id) FROM events WHERE kind = $1 AND pubkey = $2",
+		stale.Kind, stale.PubKey).Scan(pq.Array(&ids)); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != current.ID {
+		t.Fatalf("stored profiles %v, want only %s", ids, current.ID)
+	}
+}
+
+// events.created_at holds Unix seconds, which the admin UI would show as a
+// 1970 date: the API must convert it wherever it selects it.
+func TestAPISelectsEventTimesAsTimestamps(t *testing.T) {
+	src, err := os.ReadFile("../api/index.ts")
+	if err != nil {
+		t.Skipf("API source not found: %v", err)
+	}
+	checked := 0
+	for i, line := range strings.Split(string(src), "\n") {
+		if !strings.Contains(line, "SELECT") || !strings.Contains(line, "FROM events") || !strings.Contains(line, "created_at") {
+			continue
+		}
+		checked++
+		if !strings.Contains(line, "to_timestamp(created_at) AS created_at") {
+			t.Errorf("index.ts:%d selects raw events.created_at: %s", i+1, strings.TrimSpace(line))
+		}
+	}
+	if checked == 0 {
+		t.Fatal("no event query in the API selects created_at")
+	}
+}
+
+// apiQuery returns the SQL the admin API keeps in the constant name.
+func apiQuery(t *testing.T, name string) string {
+	t.Helper()
+	src, err := os.ReadFile("../api/index.ts")
+	if err != nil {
+		t.Skipf("API source not found: %v", err)
+	}
+	m := regexp.MustCompile("(?s)const " + name + " = `([^`]*)`").FindSubmatch(src)
+	if m == nil {
+		t.Fatalf("index.ts has no %s", name)
+	}
+	return string(m[1])
+}
+
+// The admin API of one community must not see another's events, profiles
+// or badges.
+func TestAPIQueriesStayInCommunity(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	fr := &community{ID: "fr", AdminPubkey: pubkeys(1)[0]}
+	withCommunities(t, fr)
+	frCtx := withCommunity(ctx, fr)
+
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	now := nostr.Now()
+	seeded := map[string]*nostr.Event{}
+	for _, c := range []struct {
+		id  string
+		ctx context.Context
+	}{{defaultCommunityID, ctx}, {"fr", frCtx}} {
+		profile := signedEvent(t, sk, 0, now, nil, `{"name":"`+c.id+`"}`)
+		award := signedEvent(t, sk, 8, now, nostr.Tags{{"a", "30009:" + pk + ":" + c.id}, {"p", pk}}, "")
+		for _, evt := range []*nostr.Event{profile, award} {
+			if err := persistEvent(c.ctx, evt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.ExecContext(ctx,
+			"INSERT INTO badge_awards (badge, recipient, event_id, awarded_at) VALUES ($1, $2, $3, NOW())",
+			c.id, pk, award.ID); err != nil {
+			t.Fatal(err)
+		}
+		seeded[c.id] = profile
+	}
+
+	for _, id := range []string{defaultCommunityID, "fr"} {
+		var total int
+		if err := db.QueryRowContext(ctx, "SELECT total_events FROM ("+apiQuery(t, "EVENT_STATS_SQL")+") s", id).Scan(&total); err != nil {
+			t.Fatal(err)
+		}
+		if total != 2 {
+			t.Errorf("%s: stats count %d events, want 2", id, total)
+		}
+
+		var content string
+		if err := db.QueryRowContext(ctx, apiQuery(t, "PROFILES_SQL"), id, pq.Array([]string{pk})).Scan(new(string), &content); err != nil {
+			t.Fatal(err)
+		}
+		if content != seeded[id].Content {
+			t.Errorf("%s: profile %s, want %s", id, content, seeded[id].Content)
+		}
+
+		var badges []string
+		rows, err := db.QueryContext(ctx, apiQuery(t, "MEMBER_BADGES_SQL"), id, pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var badge string
+			if err := rows.Scan(&badge, new(string), new(any)); err != nil {
+				t.Fatal(err)
+			}
+			badges = append(badges, badge)
+		}
+		rows.Close()
+		if len(badges) != 1 || badges[0] != id {
+			t.Errorf("%s: badges %v, want only its own", id, badges)
+		}
+
+		var events int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM ("+apiQuery(t, "EVENTS_SQL")+") e", id).Scan(&events); err != nil {
+			t.Fatal(err)
+		}
+		if events != 2 {
+			t.Errorf("%s: event browser lists %d events, want 2", id, events)
+		}
+	}
+}
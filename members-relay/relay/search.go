@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// SEARCH (NIP-50)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// events.search_vector is a generated column over an event's title tag
+// (weighted higher) and content, so every write path keeps it current and
+// a GIN index serves filters with "search". The 'simple' configuration
+// neither stems nor drops stop words: recipes are written in many
+// languages, and any word a member typed should match. plainto_tsquery
+// treats the terms as plain words, so quotes and operators in a search
+// cannot break the query. Results come back by relevance, then newest
+// first; kinds, authors, tags and limit apply as for any filter.
+
+// searchExtensions are the NIP-50 key:value options the relay ignores
+// rather than searching for.
+var searchExtensions = []string{"include:", "domain:", "language:", "sentiment:", "nsfw:"}
+
+// searchTerms returns the words of a NIP-50 search string to look for.
+func searchTerms(search string) string {
+	search = strings.ReplaceAll(search, "\x00", "")
+	var words []string
+	for _, word := range strings.Fields(search) {
+		extension := false
+		for _, prefix := range searchExtensions {
+			if strings.HasPrefix(strings.ToLower(word), prefix) {
+				extension = true
+				break
+			}
+		}
+		if !extension {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// searchCondition matches the search terms at argIndex; searchRank orders
+// by how well they match.
+func searchCondition(argIndex int) string {
+	return fmt.Sprintf("search_vector @@ plainto_tsquery('simple', $%d)", argIndex)
+}
+
+func searchRank(argIndex int) string {
+	return fmt.Sprintf("ts_rank(search_vector, plainto_tsquery('simple', $%d)) DESC", argIndex)
+}
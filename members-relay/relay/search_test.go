@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestSearchTerms(t *testing.T) {
+	for search, want := range map[string]string{
+		"sourdough":                      "sourdough",
+		`  "crème brûlée"  `:             `"crème brûlée"`,
+		"ramen language:ja include:spam": "ramen",
+		"Nsfw:true pho":                  "pho",
+		"tom yum | !kha & (gai)":         "tom yum | !kha & (gai)",
+		"domain:zap.cooking":             "",
+		"bread\x00 flour":                "bread flour",
+		"ready in 12:30":                 "ready in 12:30",
+	} {
+		if got := searchTerms(search); got != want {
+			t.Errorf("%q: got %q, want %q", search, got, want)
+		}
+	}
+}
+
+func TestBuildQuerySearch(t *testing.T) {
+	query, args := buildQuery(nostr.Filter{Kinds: []int{KindRecipe}, Authors: pubkeys(1), Search: "sourdough language:en", Limit: 20})
+	if !strings.Contains(query, "search_vector @@ plainto_tsquery('simple', $3)") {
+		t.Fatalf("no search condition: %s", query)
+	}
+	if !strings.Contains(query, "ORDER BY ts_rank(search_vector, plainto_tsquery('simple', $3)) DESC, created_at DESC, id LIMIT 20") {
+		t.Fatalf("not ordered by relevance: %s", query)
+	}
+	if args[2] != "sourdough" {
+		t.Fatalf("search argument %v", args[2])
+	}
+	if query, _ := buildQuery(nostr.Filter{Kinds: []int{KindRecipe}, Search: "include:spam"}); strings.Contains(query, "search_vector") {
+		t.Fatalf("extension-only search should not filter: %s", query)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	chefSK, memberSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	member, _ := nostr.GetPublicKey(memberSK)
+	addTestMember(t, member)
+	if _, err := db.ExecContext(ctx, "INSERT INTO groups (id, name) VALUES ('bakers', 'Bakers')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO group_members (group_id, pubkey, role) VALUES ('bakers', $1, 'member')", member); err != nil {
+		t.Fatal(err)
+	}
+
+	now := nostr.Now()
+	loaf := signedEvent(t, chefSK, KindRecipe, now-10, nostr.Tags{{"d", "loaf"}, {"title", "Country Sourdough"}}, "Flour, water, salt.")
+	mention := signedEvent(t, chefSK, KindRecipe, now, nostr.Tags{{"d", "toast"}, {"title", "Toast"}}, "Slice yesterday's sourdough.")
+	brulee := signedEvent(t, chefSK, KindRecipe, now, nostr.Tags{{"d", "brulee"}, {"title", "Crème brûlée"}}, `The "crack" is the point.`)
+	chat := signedEvent(t, chefSK, KindGroupChat, now, nostr.Tags{{"h", "bakers"}}, "Who has a sourdough starter to share?")
+	for _, evt := range []*nostr.Event{loaf, mention, brulee, chat} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func(filter nostr.Filter, viewer string) []string {
+		t.Helper()
+		query, args := buildViewerQuery(filter, nil, viewer, false)
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var ids []string
+		for rows.Next() {
+			var raw []byte
+			rows.Scan(&raw)
+			var evt nostr.Event
+			evt.UnmarshalJSON(raw)
+			ids = append(ids, evt.ID)
+		}
+		return ids
+	}
+
+	if got := search(nostr.Filter{Kinds: []int{KindRecipe}, Search: "sourdough"}, ""); len(got) != 2 || got[0] != loaf.ID {
+		t.Fatalf("recipes %v, want the titled loaf ranked before the newer mention", got)
+	}
+	if got := search(nostr.Filter{Kinds: []int{KindRecipe}, Search: `"crème brûlée" 'crack`}, ""); len(got) != 1 || got[0] != brulee.ID {
+		t.Fatalf("quoted unicode search %v", got)
+	}
+	if got := search(nostr.Filter{Kinds: []int{KindRecipe}, Search: "sourdough", Limit: 1}, ""); len(got) != 1 {
+		t.Fatalf("limit ignored: %v", got)
+	}
+
+	if got := search(nostr.Filter{Kinds: []int{KindGroupChat}, Search: "starter"}, member); len(got) != 1 || got[0] != chat.ID {
+		t.Fatalf("member chat search %v", got)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// HTTP SERVER & CONNECTION LIFECYCLE
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// serverConfig holds the HTTP and websocket timeouts. Dead peers are detected
+// by khatru's ping/pong (no pong within PongWait closes the socket); the idle
+// timeouts are a separate policy for peers that answer pings but never send
+// anything. Authenticated clients legitimately hold DM subscriptions open for
+// days, so their idle timeout is independent and disabled by default.
+type serverConfig struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	PingPeriod        time.Duration
+	PongWait          time.Duration
+	WriteWait         time.Duration
+	AnonIdleTimeout   time.Duration // 0 disables
+	AuthedIdleTimeout time.Duration // 0 disables
+
+	AuthOnConnect bool // send the NIP-42 challenge as soon as the socket opens
+}
+
+var serverCfg serverConfig
+
+func loadServerConfig() {
+	serverCfg = serverConfig{
+		ReadHeaderTimeout: envDuration("RELAY_HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       envDuration("RELAY_HTTP_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      envDuration("RELAY_HTTP_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       envDuration("RELAY_HTTP_IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes:    envInt("RELAY_HTTP_MAX_HEADER_BYTES", 16<<10),
+
+		PingPeriod:        envDuration("RELAY_WS_PING_PERIOD", 30*time.Second),
+		PongWait:          envDuration("RELAY_WS_PONG_WAIT", 75*time.Second),
+		WriteWait:         envDuration("RELAY_WS_WRITE_WAIT", 10*time.Second),
+		AnonIdleTimeout:   envDuration("RELAY_WS_IDLE_TIMEOUT", 30*time.Minute),
+		AuthedIdleTimeout: envDuration("RELAY_WS_AUTHED_IDLE_TIMEOUT", 0),
+
+		AuthOnConnect: envBool("RELAY_AUTH_ON_CONNECT", true),
+	}
+	if serverCfg.PingPeriod >= serverCfg.PongWait {
+		log.Fatalf("RELAY_WS_PING_PERIOD (%s) must be shorter than RELAY_WS_PONG_WAIT (%s)",
+			serverCfg.PingPeriod, serverCfg.PongWait)
+	}
+}
+
+type netConnKey struct{}
+
+// newHTTPServer builds the hardened server. The raw net.Conn is stashed in
+// every request context so the idle reaper can close upgraded websockets.
+func newHTTPServer(addr string, handler http.Handler, cfg serverConfig) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, netConnKey{}, c)
+		},
+	}
+}
+
+// listenAndServe is server.ListenAndServe with every accepted connection
+// wrapped in a sniffConn.
+func listenAndServe(server *http.Server) error {
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	return server.Serve(sniffListener{ln})
+}
+
+type sniffListener struct{ net.Listener }
+
+func (l sniffListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &sniffConn{Conn: c}, nil
+}
+
+// sniffConn decodes client→server websocket frames on an upgraded connection
+// so we can see what khatru parses away or handles without a hook: CLOSE
+// messages, the NIP-119 "&" filter keys that go-nostr's filter decoder
+// drops, and AUTH events (see AUTHENTICATION). Only unfragmented text frames
+// that start as a REQ, CLOSE or AUTH (and fit in maxSniffedFrame) are unmasked and kept; everything else is skipped by
+// length. khatru's upgrader does not negotiate compression, so payloads are
+// plain JSON.
+type sniffConn struct {
+	net.Conn
+	onMessage func(msg []byte) // set once the websocket is established
+
+	hdr       []byte
+	inPayload bool
+	remaining uint64
+	mask      [4]byte
+	maskPos   int
+	capture   bool
+	decided   bool
+	payload   []byte
+}
+
+const (
+	maxSniffedFrame = 64 << 10
+	sniffPrefixLen  = 16
+)
+
+func (c *sniffConn) watch(onMessage func(msg []byte)) {
+	c.onMessage = onMessage
+}
+
+// Read is only ever called from khatru's single read goroutine (and, before
+// the upgrade, net/http's), so the parser state needs no locking.
+func (c *sniffConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.onMessage != nil && n > 0 {
+		c.feed(p[:n])
+	}
+	return n, err
+}
+
+func (c *sniffConn) feed(b []byte) {
+	for len(b) > 0 {
+		if !c.inPayload {
+			c.hdr = append(c.hdr, b[0])
+			b = b[1:]
+			if need := frameHeaderLen(c.hdr); need > 0 && len(c.hdr) == need {
+				c.startFrame()
+			}
+			continue
+		}
+
+		k := uint64(len(b))
+		if k > c.remaining {
+			k = c.remaining
+		}
+		if c.capture {
+			for _, x := range b[:k] {
+				c.payload = append(c.payload, x^c.mask[c.maskPos&3])
+				c.maskPos++
+			}
+			// Stop copying as soon as the message is clearly not one we want.
+			if !c.decided && len(c.payload) >= sniffPrefixLen {
+				c.decided = true
+				c.capture = isSniffedCommand(c.payload)
+			}
+		}
+		c.remaining -= k
+		b = b[k:]
+		if c.remaining == 0 {
+			c.endFrame()
+		}
+	}
+}
+
+// isSniffedCommand reports whether a message prefix is a REQ, CLOSE or AUTH.
+func isSniffedCommand(prefix []byte) bool {
+	prefix = bytes.TrimLeft(prefix, " \t\r\n")
+	if len(prefix) == 0 || prefix[0] != '[' {
+		return false
+	}
+	prefix = bytes.TrimLeft(prefix[1:], " \t\r\n")
+	return bytes.HasPrefix(prefix, []byte(`"REQ"`)) || bytes.HasPrefix(prefix, []byte(`"CLOSE"`)) ||
+		bytes.HasPrefix(prefix, []byte(`"AUTH"`))
+}
+
+// frameHeaderLen returns the total header length once enough bytes are
+// known, or 0 if more are needed.
+func frameHeaderLen(hdr []byte) int {
+	if len(hdr) < 2 {
+		return 0
+	}
+	n := 2
+	switch hdr[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if hdr[1]&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+func (c *sniffConn) startFrame() {
+	h := c.hdr
+	fin, opcode, masked := h[0]&0x80 != 0, h[0]&0x0f, h[1]&0x80 != 0
+	length := uint64(h[1] & 0x7f)
+	off := 2
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(h[2:4]))
+		off = 4
+	case 127:
+		length = binary.BigEndian.Uint64(h[2:10])
+		off = 10
+	}
+	if masked {
+		copy(c.mask[:], h[off:off+4])
+	} else {
+		c.mask = [4]byte{}
+	}
+	c.hdr = c.hdr[:0]
+	c.inPayload = true
+	c.maskPos = 0
+	c.payload = c.payload[:0]
+	c.remaining = length
+	c.capture = fin && opcode == 0x1 && length <= maxSniffedFrame
+	c.decided = false
+	if length == 0 {
+		c.endFrame()
+	}
+}
+
+func (c *sniffConn) endFrame() {
+	if c.capture && (c.decided || isSniffedCommand(c.payload)) {
+		c.onMessage(c.payload)
+	}
+	c.inPayload = false
+	c.capture = false
+	if cap(c.payload) > 4<<10 {
+		c.payload = nil // don't pin a large buffer to an idle connection
+	} else {
+		c.payload = c.payload[:0]
+	}
+}
+
+// applyWebsocketConfig sets khatru's keepalive options and the NIP-42
+// challenge behavior.
+func applyWebsocketConfig(rl *khatru.Relay, cfg serverConfig) {
+	rl.PingPeriod = cfg.PingPeriod
+	rl.PongWait = cfg.PongWait
+	rl.WriteWait = cfg.WriteWait
+	if cfg.AuthOnConnect {
+		rl.OnConnect = append(rl.OnConnect, sendAuthChallenge)
+	}
+}
+
+// sendAuthChallenge sends AUTH before the client says anything, so clients
+// can authenticate up front instead of learning it from an auth-required
+// CLOSED/OK. khatru re-sends the same challenge with every auth-required
+// rejection; it changes only when an AUTH is refused, and expires after
+// RELAY_AUTH_CHALLENGE_TTL (see AUTHENTICATION). A client may AUTH again at
+// any time, e.g. after a key change, and the connection switches to the
+// newly authenticated pubkey.
+func sendAuthChallenge(ctx context.Context) {
+	khatru.RequestAuth(ctx)
+}
+
+type trackedConn struct {
+	netConn    net.Conn
+	lastActive time.Time
+	subs       map[string]*openSub
+	andTags    map[string]*pendingAndTags
+	community  string // see COMMUNITIES
+
+	challengedAt time.Time // when ws.Challenge was issued
+	authed       string    // the pubkey of the last AUTH checkAuth passed
+	member       bool      // authed was a member then (see AUTHENTICATION)
+
+	reqs    reqBucket
+	metered map[context.Context]bool // open REQ → over the REQ rate
+}
+
+// connTracker records the last client-initiated activity (REQ/EVENT) per
+// websocket so idle connections can be reaped.
+type connTracker struct {
+	mu         sync.Mutex
+	conns      map[*khatru.WebSocket]*trackedConn
+	checksAuth bool // AUTH events go through checkAuth
+}
+
+var connections = &connTracker{conns: make(map[*khatru.WebSocket]*trackedConn), checksAuth: true}
+
+func (t *connTracker) onConnect(ctx context.Context) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return
+	}
+	c, _ := ws.Request.Context().Value(netConnKey{}).(net.Conn)
+	t.mu.Lock()
+	t.conns[ws] = &trackedConn{netConn: c, lastActive: time.Now(), subs: make(map[string]*openSub),
+		andTags: make(map[string]*pendingAndTags), community: communityOf(ctx).id(),
+		metered: make(map[context.Context]bool), challengedAt: time.Now()}
+	t.mu.Unlock()
+
+	if sc, ok := c.(*sniffConn); ok {
+		sc.watch(func(msg []byte) { t.onClientMessage(ws, msg) })
+	}
+}
+
+// onClientMessage receives the REQ, CLOSE and AUTH messages sniffed off a
+// connection, in order, before khatru's handler goroutine for them starts.
+func (t *connTracker) onClientMessage(ws *khatru.WebSocket, msg []byte) {
+	if !bytes.Contains(msg, []byte(`"CLOSE"`)) && !bytes.Contains(msg, []byte(`"&`)) && !bytes.Contains(msg, []byte(`"AUTH"`)) {
+		return
+	}
+	switch env := nostr.ParseMessage(msg).(type) {
+	case *nostr.AuthEnvelope:
+		if t.checksAuth {
+			if challenge := t.checkAuth(ws, &env.Event, time.Now()); challenge != "" {
+				ws.WriteJSON(nostr.AuthEnvelope{Challenge: &challenge})
+			}
+		}
+	case *nostr.CloseEnvelope:
+		t.closeSubscription(ws, string(*env))
+	case *nostr.ReqEnvelope:
+		t.stashAndTags(ws, env.SubscriptionID, msg)
+	}
+}
+
+func (t *connTracker) onDisconnect(ctx context.Context) {
+	ws := khatru.GetConnection(ctx)
+	t.mu.Lock()
+	delete(t.conns, ws)
+	t.mu.Unlock()
+}
+
+func (t *connTracker) touch(ctx context.Context) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return
+	}
+	t.mu.Lock()
+	if c, ok := t.conns[ws]; ok {
+		c.lastActive = time.Now()
+	}
+	t.mu.Unlock()
+}
+
+func (t *connTracker) touchEvent(ctx context.Context, _ *nostr.Event) (bool, string) {
+	t.touch(ctx)
+	return false, ""
+}
+
+func (t *connTracker) touchFilter(ctx context.Context, _ nostr.Filter) (bool, string) {
+	t.touch(ctx)
+	return false, ""
+}
+
+func (t *connTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// idleLimit picks the idle timeout that applies to a connection.
+func idleLimit(cfg serverConfig, authed bool) time.Duration {
+	if authed {
+		return cfg.AuthedIdleTimeout
+	}
+	return cfg.AnonIdleTimeout
+}
+
+// reapIdle closes connections idle beyond their limit and returns how many.
+func (t *connTracker) reapIdle(cfg serverConfig, now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	reaped := 0
+	for ws, c := range t.conns {
+		limit := idleLimit(cfg, ws.AuthedPublicKey != "")
+		if limit <= 0 || c.netConn == nil || now.Sub(c.lastActive) < limit {
+			continue
+		}
+		// Closing the socket makes khatru's read loop fail and run its own cleanup.
+		c.netConn.Close()
+		delete(t.conns, ws)
+		reaped++
+	}
+	return reaped
+}
+
+func (t *connTracker) runIdleReaper(ctx context.Context, cfg serverConfig) {
+	interval := time.Minute
+	for _, limit := range []time.Duration{cfg.AnonIdleTimeout, cfg.AuthedIdleTimeout} {
+		if limit > 0 && limit/2 < interval {
+			interval = limit / 2
+		}
+	}
+	if cfg.AnonIdleTimeout <= 0 && cfg.AuthedIdleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n := t.reapIdle(cfg, now); n > 0 {
+				log.Printf("[conn] Reaped %d idle websocket connection(s)", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestDeadPeerIsDisconnected(t *testing.T) {
+	cfg := serverConfig{
+		ReadHeaderTimeout: time.Second,
+		MaxHeaderBytes:    16 << 10,
+		PingPeriod:        50 * time.Millisecond,
+		PongWait:          200 * time.Millisecond,
+		WriteWait:         time.Second,
+	}
+	tracker := &connTracker{conns: make(map[*khatru.WebSocket]*trackedConn)}
+	rl := khatru.NewRelay()
+	rl.OnConnect = append(rl.OnConnect, tracker.onConnect)
+	rl.OnDisconnect = append(rl.OnDisconnect, tracker.onDisconnect)
+	url := startTestRelay(t, rl, cfg)
+
+	// This client never reads, so it never answers pings.
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for tracker.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tracker.count() != 1 {
+		t.Fatal("connection was never registered")
+	}
+	for tracker.count() != 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if tracker.count() != 0 {
+		t.Fatal("unresponsive client was not disconnected after PongWait")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+}
+
+func TestIdleReaperPolicy(t *testing.T) {
+	cfg := serverConfig{AnonIdleTimeout: time.Minute, AuthedIdleTimeout: 0}
+	tracker := &connTracker{conns: make(map[*khatru.WebSocket]*trackedConn)}
+	now := time.Now()
+
+	anon, anonPeer := net.Pipe()
+	defer anonPeer.Close()
+	authed, authedPeer := net.Pipe()
+	defer authed.Close()
+	defer authedPeer.Close()
+	fresh, freshPeer := net.Pipe()
+	defer fresh.Close()
+	defer freshPeer.Close()
+
+	tracker.conns[&khatru.WebSocket{}] = &trackedConn{netConn: anon, lastActive: now.Add(-2 * time.Minute)}
+	tracker.conns[&khatru.WebSocket{AuthedPublicKey: "abc"}] = &trackedConn{netConn: authed, lastActive: now.Add(-72 * time.Hour)}
+	tracker.conns[&khatru.WebSocket{}] = &trackedConn{netConn: fresh, lastActive: now.Add(-10 * time.Second)}
+
+	if n := tracker.reapIdle(cfg, now); n != 1 {
+		t.Fatalf("expected 1 reaped connection, got %d", n)
+	}
+	if tracker.count() != 2 {
+		t.Fatalf("expected authed and fresh connections to survive, have %d", tracker.count())
+	}
+	if _, err := anonPeer.Read(make([]byte, 1)); err == nil {
+		t.Fatal("idle anonymous connection was not closed")
+	}
+
+	cfg.AuthedIdleTimeout = 24 * time.Hour
+	if n := tracker.reapIdle(cfg, now); n != 1 {
+		t.Fatalf("expected authed connection to be reaped once its limit is set, got %d", n)
+	}
+}
+
+// testServerConfig is the server configuration websocket tests run with.
+func testServerConfig(authOnConnect bool) serverConfig {
+	return serverConfig{ReadHeaderTimeout: time.Second, MaxHeaderBytes: 16 << 10,
+		PingPeriod: time.Second, PongWait: 2 * time.Second, WriteWait: time.Second, AuthOnConnect: authOnConnect}
+}
+
+// startTestRelay applies cfg's websocket settings to rl and serves it like
+// startTestServer.
+func startTestRelay(t testing.TB, rl *khatru.Relay, cfg serverConfig) string {
+	t.Helper()
+	applyWebsocketConfig(rl, cfg)
+	return startTestServer(t, rl, cfg)
+}
+
+// startTestServer serves handler as the relay does, behind the sniffing
+// listener, until the test ends, and returns its ws:// URL.
+func startTestServer(t testing.TB, handler http.Handler, cfg serverConfig) string {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config = newHTTPServer("", handler, cfg)
+	srv.Listener = sniffListener{srv.Listener}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// dialTestRelay connects to a test relay; the connection closes when the
+// test ends.
+func dialTestRelay(t *testing.T, url string) *wsTestClient {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &wsTestClient{t: t, conn: conn}
+}
+
+// wsTestClient speaks raw NIP-01 to a test relay.
+type wsTestClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+
+	challenges []string // AUTH challenges seen while waiting for something else
+}
+
+func (c *wsTestClient) send(msg string) {
+	c.t.Helper()
+	if err := c.conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+// next returns the next envelope accepted by match, skipping others.
+func (c *wsTestClient) next(match func(nostr.Envelope) bool) nostr.Envelope {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			c.t.Fatalf("read: %v", err)
+		}
+		env := nostr.ParseMessage(msg)
+		if env == nil {
+			continue
+		}
+		if match(env) {
+			return env
+		}
+		if auth, ok := env.(*nostr.AuthEnvelope); ok {
+			c.challenges = append(c.challenges, *auth.Challenge)
+		}
+	}
+}
+
+// req sends a REQ and returns "EOSE" or the CLOSED reason.
+func (c *wsTestClient) req(subID, filter string) string {
+	c.t.Helper()
+	c.send(`["REQ","` + subID + `",` + filter + `]`)
+	env := c.next(func(env nostr.Envelope) bool {
+		switch env := env.(type) {
+		case *nostr.EOSEEnvelope:
+			return string(*env) == subID
+		case *nostr.ClosedEnvelope:
+			return env.SubscriptionID == subID
+		}
+		return false
+	})
+	if closed, ok := env.(*nostr.ClosedEnvelope); ok {
+		return closed.Reason
+	}
+	return "EOSE"
+}
+
+func (c *wsTestClient) challenge() string {
+	c.t.Helper()
+	env := c.next(func(env nostr.Envelope) bool { _, ok := env.(*nostr.AuthEnvelope); return ok })
+	return *env.(*nostr.AuthEnvelope).Challenge
+}
+
+// auth answers challenge as sk and reports whether the relay accepted it.
+func (c *wsTestClient) auth(relayURL, challenge, sk string) bool {
+	c.t.Helper()
+	evt := signedEvent(c.t, sk, nostr.KindClientAuthentication, nostr.Now(),
+		nostr.Tags{{"relay", relayURL}, {"challenge", challenge}}, "")
+	raw, _ := nostr.AuthEnvelope{Event: *evt}.MarshalJSON()
+	c.send(string(raw))
+	env := c.next(func(env nostr.Envelope) bool {
+		ok, isOK := env.(*nostr.OKEnvelope)
+		return isOK && ok.EventID == evt.ID
+	})
+	return env.(*nostr.OKEnvelope).OK
+}
+
+func TestAuthChallengeOnConnect(t *testing.T) {
+	rl := khatru.NewRelay()
+	rl.RejectFilter = append(rl.RejectFilter, rejectFilterPolicy)
+	url := startTestRelay(t, rl, testServerConfig(true))
+
+	t.Run("authenticates before sending anything", func(t *testing.T) {
+		c := dialTestRelay(t, url)
+		challenge := c.challenge()
+		skA, skB := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+		pkA, _ := nostr.GetPublicKey(skA)
+		pkB, _ := nostr.GetPublicKey(skB)
+
+		if !c.auth(url, challenge, skA) {
+			t.Fatal("AUTH with the connect-time challenge was refused")
+		}
+		if got := c.req("own", `{"authors":["`+pkA+`"]}`); got != "EOSE" {
+			t.Fatalf("own-author read after AUTH: %s", got)
+		}
+
+		// Key change: the same challenge authenticates the new key.
+		if !c.auth(url, challenge, skB) {
+			t.Fatal("re-AUTH after key change was refused")
+		}
+		if got := c.req("own2", `{"authors":["`+pkB+`"]}`); got != "EOSE" {
+			t.Fatalf("own-author read after re-AUTH: %s", got)
+		}
+
+		if c.auth(url, "not-the-challenge", skA) {
+			t.Fatal("AUTH with a wrong challenge was accepted")
+		}
+	})
+
+	t.Run("ignores the challenge", func(t *testing.T) {
+		c := dialTestRelay(t, url)
+		challenge := c.challenge()
+
+		if got := c.req("recipes", `{"kinds":[30023]}`); got != "EOSE" {
+			t.Fatalf("public read without AUTH: %s", got)
+		}
+		if got := c.req("chat", `{"kinds":[9],"#h":["g"]}`); !strings.HasPrefix(got, "auth-required:") {
+			t.Fatalf("group read without AUTH: %s", got)
+		}
+		// The rejection re-sends the same challenge, which still works.
+		if len(c.challenges) != 1 || c.challenges[0] != challenge {
+			t.Fatalf("expected the challenge %q to be re-sent, got %v", challenge, c.challenges)
+		}
+		sk := nostr.GeneratePrivateKey()
+		if !c.auth(url, challenge, sk) {
+			t.Fatal("late AUTH was refused")
+		}
+	})
+}
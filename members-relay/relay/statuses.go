@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// USER STATUSES (NIP-38)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Kind 30315 statuses are addressable: one current status per author and d
+// tag ("general", "music", ...). A status carrying an h tag is group-scoped
+// (see GROUP-SCOPED EVENTS). Statuses expire like any event (see EXPIRING
+// EVENTS); a status with a malformed expiration tag is refused.
+
+// rejectUserStatus is the write policy for kind 30315.
+func rejectUserStatus(ctx context.Context, event *nostr.Event, pubkey string) (bool, string) {
+	if !isActiveMember(ctx, pubkey) {
+		return true, say(ctx, msgMembershipRequired)
+	}
+	if addressableDTag(event) == nil {
+		return true, say(ctx, msgStatusDTag)
+	}
+	if _, err := eventExpiration(event); err != nil {
+		return true, say(ctx, msgMalformedExpiration)
+	}
+	return rejectGroupScope(ctx, event, pubkey)
+}
+
+// eventExpiration returns the NIP-40 expiration of event, or 0 if it has none.
+func eventExpiration(event *nostr.Event) (nostr.Timestamp, error) {
+	tag := event.Tags.GetFirst([]string{"expiration", ""})
+	if tag == nil {
+		return 0, nil
+	}
+	ts, err := strconv.ParseInt((*tag)[1], 10, 64)
+	if err != nil || ts <= 0 {
+		return 0, errors.New("malformed expiration tag")
+	}
+	return nostr.Timestamp(ts), nil
+}
+
+// mayMatchKind reports whether a filter with these kinds can return kind.
+func mayMatchKind(kinds []int, kind int) bool {
+	if len(kinds) == 0 {
+		return true
+	}
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
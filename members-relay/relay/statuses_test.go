@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestEventExpiration(t *testing.T) {
+	for _, tc := range []struct {
+		tags nostr.Tags
+		want nostr.Timestamp
+		err  bool
+	}{
+		{nil, 0, false},
+		{nostr.Tags{{"expiration", "1700000000"}}, 1700000000, false},
+		{nostr.Tags{{"expiration", "soon"}}, 0, true},
+		{nostr.Tags{{"expiration", "-5"}}, 0, true},
+	} {
+		got, err := eventExpiration(&nostr.Event{Tags: tc.tags})
+		if got != tc.want || (err != nil) != tc.err {
+			t.Errorf("%v: got %d, %v", tc.tags, got, err)
+		}
+	}
+}
+
+func TestStatusConditionOnlyForStatusKinds(t *testing.T) {
+	if q, _ := buildViewerQuery(nostr.Filter{Kinds: []int{nostr.KindProfileMetadata}}, nil, pubkeys(1)[0], false); strings.Contains(q, "jsonb_array_elements") {
+		t.Fatalf("status visibility applied to profiles: %s", q)
+	}
+	q, args := buildViewerQuery(nostr.Filter{Kinds: []int{KindUserStatus}, Authors: pubkeys(3)}, nil, pubkeys(1)[0], false)
+	if !strings.Contains(q, "group_members") || len(args) != 4 {
+		t.Fatalf("expected group-scoped check with viewer arg: %s %v", q, args)
+	}
+}
+
+func TestAdmitFilterRecordsLiveFilters(t *testing.T) {
+	c := &trackedConn{subs: make(map[string]*openSub)}
+	req1, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req2 := context.Background()
+	c.admitFilter(req1, "s", nostr.Filter{Kinds: []int{1}}, relayLimits{})
+	c.admitFilter(req1, "s", nostr.Filter{Kinds: []int{2}}, relayLimits{})
+	if n := len(c.subs["s"].live); n != 2 {
+		t.Fatalf("expected 2 live filters, got %d", n)
+	}
+	c.admitFilter(req2, "s", nostr.Filter{Kinds: []int{KindUserStatus}}, relayLimits{})
+	if live := c.subs["s"].live; len(live) != 1 || live[0].Kinds[0] != KindUserStatus {
+		t.Fatalf("replacing REQ kept old filters: %v", live)
+	}
+}
+
+func TestUserStatusVisibility(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	authorSK := nostr.GeneratePrivateKey()
+	author, _ := nostr.GetPublicKey(authorSK)
+	outsider := pubkeys(1)[0]
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO group_members (group_id, pubkey, role) VALUES ('sourdough', $1, 'member')", author); err != nil {
+		t.Fatal(err)
+	}
+
+	now := nostr.Now()
+	statuses := map[string]*nostr.Event{
+		"general": signedEvent(t, authorSK, KindUserStatus, now, nostr.Tags{{"d", "general"}}, "cooking"),
+		"group":   signedEvent(t, authorSK, KindUserStatus, now, nostr.Tags{{"d", "sourdough"}, {"h", "sourdough"}}, "week 3 loaf"),
+		"expired": signedEvent(t, authorSK, KindUserStatus, now-100, nostr.Tags{{"d", "music"}, {"expiration", "1"}}, "old"),
+	}
+	names := make(map[string]string)
+	for name, evt := range statuses {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+		names[evt.ID] = name
+	}
+	// An older version never replaces the current one.
+	if err := persistEvent(ctx, signedEvent(t, authorSK, KindUserStatus, now-10, nostr.Tags{{"d", "general"}}, "stale")); err != nil {
+		t.Fatal(err)
+	}
+
+	visible := func(viewer string) string {
+		query, args := buildViewerQuery(nostr.Filter{Kinds: []int{KindUserStatus}, Authors: []string{author}}, nil, viewer, false)
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var got []string
+		for rows.Next() {
+			var raw []byte
+			rows.Scan(&raw)
+			var evt nostr.Event
+			evt.UnmarshalJSON(raw)
+			got = append(got, names[evt.ID])
+		}
+		sort.Strings(got)
+		return strings.Join(got, ",")
+	}
+
+	if got := visible(author); got != "general,group" {
+		t.Fatalf("group member sees %q", got)
+	}
+	if got := visible(outsider); got != "general" {
+		t.Fatalf("non-member sees %q", got)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// openTestDB points the package-level db at RELAY_TEST_DATABASE_URL, skipping
+// the test when it is unset. The database is migrated, indexed and WIPED, so
+// it must be dedicated to tests.
+func openTestDB(tb testing.TB) {
+	tb.Helper()
+	url := os.Getenv("RELAY_TEST_DATABASE_URL")
+	if url == "" {
+		tb.Skip("RELAY_TEST_DATABASE_URL not set")
+	}
+	conn, err := sql.Open("postgres", url)
+	if err != nil {
+		tb.Fatalf("open test db: %v", err)
+	}
+	if err := conn.Ping(); err != nil {
+		tb.Fatalf("ping test db: %v", err)
+	}
+	prev := db
+	db = conn
+	tb.Cleanup(func() {
+		conn.Close()
+		db = prev
+	})
+
+	ctx := context.Background()
+	if err := migrateSchema(ctx); err != nil {
+		tb.Fatalf("migrate test db: %v", err)
+	}
+	installed, err := loadInstalledIndexes(ctx)
+	if err != nil {
+		tb.Fatalf("inspect indexes: %v", err)
+	}
+	if err := createIndexes(ctx, diffIndexes(indexManifest, installed)); err != nil {
+		tb.Fatalf("create indexes: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, "TRUNCATE events, event_tags, members, groups, group_members, group_bans, profile_fetches, follows, calendar_events, badge_awards, tombstones, deletion_audit, group_outbox, content_labels, read_markers, group_reactions, featured_picks, banned_pubkeys, banned_events, zap_receipts, reports, hidden_events, pending_joins, invites, group_mutes, group_pins, group_member_lapses"); err != nil {
+		tb.Fatalf("truncate test db: %v", err)
+	}
+}
+
+// signedEvent builds and signs an event with sk.
+func signedEvent(tb testing.TB, sk string, kind int, createdAt nostr.Timestamp, tags nostr.Tags, content string) *nostr.Event {
+	tb.Helper()
+	event := &nostr.Event{
+		Kind:      kind,
+		CreatedAt: createdAt,
+		Tags:      tags,
+		Content:   content,
+	}
+	if err := event.Sign(sk); err != nil {
+		tb.Fatalf("sign: %v", err)
+	}
+	return event
+}
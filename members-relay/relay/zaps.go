@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════════
+// RECIPE ZAPS (NIP-57)
+// ═══════════════════════════════════════════════════════════════════════════════
+
+// Zap receipts (kind 9735) are published by the recipient's lightning
+// provider, which neither authenticates nor is a member. A receipt whose a
+// or e tag names a recipe stored here is accepted from anyone once it
+// checks out: the zap request in its description is a signed kind 9734,
+// its bolt11 carries an amount (the request's amount tag, if any, agrees),
+// and when the recipe author's stored profile has a lud16, the receipt is
+// signed by that address's nostrPubkey. zap_receipts keeps the sats per
+// recipe for recipeZapTotals.
+
+const lnurlCacheTTL = time.Hour
+
+var lnurlClient = &http.Client{Timeout: 5 * time.Second}
+
+// lnurlNostrPubkey returns the nostrPubkey that signs zap receipts for a
+// lightning address, "" when it does not support zaps. Tests replace it.
+var lnurlNostrPubkey = fetchLNURLNostrPubkey
+
+var lnurlCache = struct {
+	sync.Mutex
+	entries map[string]lnurlEntry
+}{entries: make(map[string]lnurlEntry)}
+
+type lnurlEntry struct {
+	pubkey  string
+	fetched time.Time
+}
+
+// rowQueryer is a *sql.DB or a *sql.Tx.
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// zappedRecipe returns the address of the recipe stored in ctx's community
+// that a zap receipt names, or "".
+func zappedRecipe(ctx context.Context, q rowQueryer, event *nostr.Event) string {
+	community := communityOf(ctx).id()
+	if tag := event.Tags.GetFirst([]string{"a", fmt.Sprintf("%d:", KindRecipe)}); tag != nil {
+		parts := strings.SplitN((*tag)[1], ":", 3)
+		if len(parts) != 3 || !nostr.IsValid32ByteHex(parts[1]) {
+			return ""
+		}
+		var exists bool
+		q.QueryRowContext(ctx, `
+			SELECT EXISTS (SELECT 1 FROM events WHERE kind = $1 AND pubkey = $2 AND d_tag = $3 AND community = $4)
+		`, KindRecipe, parts[1], parts[2], community).Scan(&exists)
+		if exists {
+			return (*tag)[1]
+		}
+		return ""
+	}
+	if tag := event.Tags.GetFirst([]string{"e", ""}); tag != nil {
+		var pubkey, d string
+		if err := q.QueryRowContext(ctx, `
+			SELECT pubkey, d_tag FROM events WHERE id = $1 AND kind = $2 AND community = $3
+		`, (*tag)[1], KindRecipe, community).Scan(&pubkey, &d); err == nil {
+			return fmt.Sprintf("%d:%s:%s", KindRecipe, pubkey, d)
+		}
+	}
+	return ""
+}
+
+// rejectZapReceipt is the write policy for a kind 9735 naming recipe, the
+// address zappedRecipe found.
+func rejectZapReceipt(ctx context.Context, event *nostr.Event, recipe string) (bool, string) {
+	request, err := zapRequest(event)
+	if err != nil {
+		return true, say(ctx, msgZapRequestInvalid, err)
+	}
+	bolt11 := event.Tags.GetFirst([]string{"bolt11", ""})
+	if bolt11 == nil {
+		return true, say(ctx, msgZapBolt11)
+	}
+	msats, err := bolt11Msats((*bolt11)[1])
+	if err != nil {
+		return true, say(ctx, msgZapBolt11)
+	}
+	if tag := request.Tags.GetFirst([]string{"amount", ""}); tag != nil && (*tag)[1] != strconv.FormatInt(msats, 10) {
+		return true, say(ctx, msgZapAmountMismatch)
+	}
+
+	author := strings.SplitN(recipe, ":", 3)[1]
+	lud16 := storedLightningAddress(ctx, author)
+	if lud16 == "" {
+		return false, ""
+	}
+	provider, err := lnurlNostrPubkey(ctx, lud16)
+	if err != nil {
+		log.Printf("[zaps] Error resolving %s: %v", lud16, err)
+		return true, say(ctx, msgZapProviderUnreachable)
+	}
+	if provider != event.PubKey {
+		return true, say(ctx, msgZapProvider)
+	}
+	return false, ""
+}
+
+// zapRequest returns the signed kind 9734 in a receipt's description tag.
+func zapRequest(receipt *nostr.Event) (*nostr.Event, error) {
+	tag := receipt.Tags.GetFirst([]string{"description", ""})
+	if tag == nil {
+		return nil, errors.New("missing description")
+	}
+	var request nostr.Event
+	if err := json.Unmarshal([]byte((*tag)[1]), &request); err != nil {
+		return nil, errors.New("description is not an event")
+	}
+	if request.Kind != nostr.KindZapRequest {
+		return nil, errors.New("description is not a kind 9734")
+	}
+	if !request.CheckID() {
+		return nil, errors.New("bad id")
+	}
+	if ok, err := request.CheckSignature(); err != nil || !ok {
+		return nil, errors.New("bad signature")
+	}
+	return &request, nil
+}
+
+// bolt11Multipliers are the BOLT-11 amount multipliers in millisatoshis per
+// unit, tenths for p (pico-bitcoin).
+var bolt11Multipliers = map[byte]int64{'m': 100_000_000, 'u': 100_000, 'n': 100, 'p': 1}
+
+// bolt11Msats reads the amount of a BOLT-11 invoice from its human-readable
+// part, e.g. lnbc2500u1... is 250000000 msats.
+func bolt11Msats(invoice string) (int64, error) {
+	invoice = strings.TrimPrefix(strings.ToLower(invoice), "lightning:")
+	sep := strings.LastIndexByte(invoice, '1')
+	if !strings.HasPrefix(invoice, "ln") || sep < 0 {
+		return 0, errors.New("not a bolt11 invoice")
+	}
+	hrp := invoice[2:sep]
+	start := strings.IndexAny(hrp, "0123456789")
+	if start < 0 {
+		return 0, errors.New("invoice has no amount")
+	}
+	amount := hrp[start:]
+	multiplier := int64(100_000_000_000) // msats per bitcoin
+	if unit := amount[len(amount)-1]; unit < '0' || unit > '9' {
+		m, ok := bolt11Multipliers[unit]
+		if !ok {
+			return 0, fmt.Errorf("unknown multiplier %q", unit)
+		}
+		multiplier, amount = m, amount[:len(amount)-1]
+	}
+	if len(amount) == 0 || len(amount) > 15 {
+		return 0, errors.New("unreadable amount")
+	}
+	n, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("unreadable amount")
+	}
+	if multiplier == 1 {
+		if n%10 != 0 {
+			return 0, errors.New("sub-millisatoshi amount")
+		}
+		return n / 10, nil
+	}
+	return n * multiplier, nil
+}
+
+// storedLightningAddress returns the lud16 of pubkey's stored profile, or "".
+func storedLightningAddress(ctx context.Context, pubkey string) string {
+	var content string
+	if err := db.QueryRowContext(ctx, `
+		SELECT content FROM events WHERE kind = $1 AND pubkey = $2 AND community = $3
+		ORDER BY created_at DESC LIMIT 1
+	`, nostr.KindProfileMetadata, pubkey, communityOf(ctx).id()).Scan(&content); err != nil {
+		return ""
+	}
+	var profile struct {
+		Lud16 string `json:"lud16"`
+	}
+	json.Unmarshal([]byte(content), &profile)
+	return strings.TrimSpace(profile.Lud16)
+}
+
+// fetchLNURLNostrPubkey asks the lightning address's LNURL-pay endpoint for
+// its nostrPubkey, cached for lnurlCacheTTL.
+func fetchLNURLNostrPubkey(ctx context.Context, lud16 string) (string, error) {
+	lnurlCache.Lock()
+	entry, ok := lnurlCache.entries[lud16]
+	lnurlCache.Unlock()
+	if ok && time.Since(entry.fetched) < lnurlCacheTTL {
+		return entry.pubkey, nil
+	}
+
+	name, domain, ok := strings.Cut(lud16, "@")
+	if !ok || name == "" || domain == "" || strings.ContainsAny(domain, "/?#@") {
+		return "", fmt.Errorf("malformed lightning address %q", lud16)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+domain+"/.well-known/lnurlp/"+name, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := lnurlClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("LNURL endpoint returned %s", resp.Status)
+	}
+	var params struct {
+		AllowsNostr bool   `json:"allowsNostr"`
+		NostrPubkey string `json:"nostrPubkey"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&params); err != nil {
+		return "", err
+	}
+	pubkey := ""
+	if params.AllowsNostr {
+		pubkey = params.NostrPubkey
+	}
+	lnurlCache.Lock()
+	lnurlCache.entries[lud16] = lnurlEntry{pubkey: pubkey, fetched: time.Now()}
+	lnurlCache.Unlock()
+	return pubkey, nil
+}
+
+// insertZapReceipt records the sats of a receipt for a stored recipe.
+func insertZapReceipt(ctx context.Context, tx *sql.Tx, event *nostr.Event) error {
+	if event.Kind != nostr.KindZap {
+		return nil
+	}
+	bolt11 := event.Tags.GetFirst([]string{"bolt11", ""})
+	if bolt11 == nil {
+		return nil
+	}
+	msats, err := bolt11Msats((*bolt11)[1])
+	if err != nil {
+		return nil
+	}
+	recipe := zappedRecipe(ctx, tx, event)
+	if recipe == "" {
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO zap_receipts (event_id, recipe, msats, community) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (event_id) DO NOTHING
+	`, event.ID, recipe, msats, communityOf(ctx).id())
+	return err
+}
+
+// zapTotal is the zapping of one recipe.
+type zapTotal struct {
+	Zaps int   `json:"zaps"`
+	Sats int64 `json:"sats"`
+}
+
+// recipeZapTotals sums the stored receipts of each recipe address in ctx's
+// community. Recipes without zaps are left out.
+func recipeZapTotals(ctx context.Context, recipes []string) (map[string]zapTotal, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT recipe, COUNT(*), SUM(msats) / 1000
+		FROM zap_receipts
+		WHERE recipe = ANY($1) AND community = $2
+		GROUP BY recipe
+	`, pq.Array(recipes), communityOf(ctx).id())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	totals := make(map[string]zapTotal)
+	for rows.Next() {
+		var recipe string
+		var t zapTotal
+		if err := rows.Scan(&recipe, &t.Zaps, &t.Sats); err != nil {
+			return nil, err
+		}
+		totals[recipe] = t
+	}
+	return totals, rows.Err()
+}
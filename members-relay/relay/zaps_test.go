@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestBolt11Msats(t *testing.T) {
+	for _, tc := range []struct {
+		invoice string
+		msats   int64
+		ok      bool
+	}{
+		{"lnbc2500u1pvjluezpp5qqqsyqcyq5rqwzqf", 250_000_000, true},
+		{"lnbc20m1pvjluezpp5qqqsyqcyq5rqwzqf", 2_000_000_000, true},
+		{"lnbc10n1pvjluezpp5qqqsyqcyq5rqwzqf", 1_000, true},
+		{"lnbc250p1pvjluezpp5qqqsyqcyq5rqwzqf", 25, true},
+		{"LIGHTNING:LNTB1500N1PVJLUEZPP5QQQSYQCYQ5RQWZQF", 150_000, true},
+		{"lnbcrt5u1pvjluezpp5qqqsyqcyq5rqwzqf", 500_000, true},
+		{"lnbc1pvjluezpp5qqqsyqcyq5rqwzqf", 0, false},
+		{"lnbc25p1pvjluezpp5qqqsyqcyq5rqwzqf", 0, false},
+		{"lnbc5x1pvjluezpp5qqqsyqcyq5rqwzqf", 0, false},
+		{"bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq", 0, false},
+	} {
+		msats, err := bolt11Msats(tc.invoice)
+		if tc.ok && (err != nil || msats != tc.msats) {
+			t.Errorf("%s: %d, %v; want %d", tc.invoice, msats, err, tc.msats)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: read %d msats", tc.invoice, msats)
+		}
+	}
+}
+
+// zapReceipt builds a receipt signed by providerSK for a zap of msats to
+// target (an a or e tag), its request signed by a fresh key.
+func zapReceipt(t *testing.T, providerSK string, target nostr.Tag, invoice string, msats int64) *nostr.Event {
+	t.Helper()
+	request := signedEvent(t, nostr.GeneratePrivateKey(), nostr.KindZapRequest, nostr.Now(),
+		nostr.Tags{target, {"amount", fmt.Sprint(msats)}, {"relays", "wss://members.zap.cooking"}}, "")
+	raw, _ := json.Marshal(request)
+	return signedEvent(t, providerSK, nostr.KindZap, nostr.Now(),
+		nostr.Tags{target, {"bolt11", invoice}, {"description", string(raw)}}, "")
+}
+
+func TestZapRequest(t *testing.T) {
+	valid := zapReceipt(t, nostr.GeneratePrivateKey(), nostr.Tag{"e", pubkeys(1)[0]}, "lnbc10n1x", 1000)
+	if _, err := zapRequest(valid); err != nil {
+		t.Fatalf("valid request refused: %v", err)
+	}
+	forged := *valid
+	forged.Tags = nostr.Tags{{"description", strings.Replace(valid.Tags.GetFirst([]string{"description", ""}).Value(), `"amount","1000"`, `"amount","9000"`, 1)}}
+	note, _ := json.Marshal(signedEvent(t, nostr.GeneratePrivateKey(), 1, nostr.Now(), nil, ""))
+	for name, receipt := range map[string]*nostr.Event{
+		"forged":      &forged,
+		"not 9734":    {Tags: nostr.Tags{{"description", string(note)}}},
+		"not json":    {Tags: nostr.Tags{{"description", "thanks!"}}},
+		"missing tag": {},
+	} {
+		if _, err := zapRequest(receipt); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestZapReceiptsForRecipes(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	chefSK, providerSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	chef, _ := nostr.GetPublicKey(chefSK)
+	provider, _ := nostr.GetPublicKey(providerSK)
+	savedFetch := lnurlNostrPubkey
+	defer func() { lnurlNostrPubkey = savedFetch }()
+	lnurlNostrPubkey = func(_ context.Context, lud16 string) (string, error) {
+		if lud16 != "chef@pay.example" {
+			return "", errors.New("unreachable")
+		}
+		return provider, nil
+	}
+
+	recipe := signedEvent(t, chefSK, KindRecipe, nostr.Now(), nostr.Tags{{"d", "pancakes"}}, "")
+	note := signedEvent(t, chefSK, 1, nostr.Now(), nil, "")
+	for _, evt := range []*nostr.Event{recipe, note} {
+		if err := persistEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	address := fmt.Sprintf("%d:%s:pancakes", KindRecipe, chef)
+	byAddress, byID := nostr.Tag{"a", address}, nostr.Tag{"e", recipe.ID}
+
+	// Without a stored profile there is no provider to check against.
+	if reject, msg := rejectEventPolicy(ctx, zapReceipt(t, nostr.GeneratePrivateKey(), byAddress, "lnbc10u1x", 1_000_000)); reject {
+		t.Fatalf("receipt refused before the profile is known: %s", msg)
+	}
+	profile := signedEvent(t, chefSK, nostr.KindProfileMetadata, nostr.Now(), nil, `{"name":"chef","lud16":"chef@pay.example"}`)
+	if err := persistEvent(ctx, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	good := []*nostr.Event{
+		zapReceipt(t, providerSK, byAddress, "lnbc10u1x", 1_000_000),
+		zapReceipt(t, providerSK, byID, "lnbc2500n1x", 250_000),
+	}
+	for _, receipt := range good {
+		if reject, msg := rejectEventPolicy(ctx, receipt); reject {
+			t.Fatalf("valid receipt refused: %s", msg)
+		}
+		if err := persistEvent(ctx, receipt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mismatched := zapReceipt(t, providerSK, byAddress, "lnbc10u1x", 5_000)
+	noAmount := zapReceipt(t, providerSK, byAddress, "lnbc1x", 1_000)
+	for _, tc := range []struct {
+		name    string
+		receipt *nostr.Event
+		prefix  string
+	}{
+		{"someone else's signature", zapReceipt(t, nostr.GeneratePrivateKey(), byAddress, "lnbc10u1x", 1_000_000), "invalid: the receipt is not signed"},
+		{"amount mismatch", mismatched, "invalid: the invoice amount"},
+		{"no amount", noAmount, "invalid: the bolt11 tag"},
+		{"no request", signedEvent(t, providerSK, nostr.KindZap, nostr.Now(), nostr.Tags{byAddress, {"bolt11", "lnbc10u1x"}}, ""), "invalid: the zap request"},
+		{"not a recipe", zapReceipt(t, providerSK, nostr.Tag{"e", note.ID}, "lnbc10u1x", 1_000_000), "auth-required:"},
+	} {
+		if reject, msg := rejectEventPolicy(ctx, tc.receipt); !reject || !strings.HasPrefix(msg, tc.prefix) {
+			t.Errorf("%s: %v %q", tc.name, reject, msg)
+		}
+	}
+
+	lnurlNostrPubkey = func(context.Context, string) (string, error) { return "", errors.New("timeout") }
+	if reject, msg := rejectEventPolicy(ctx, zapReceipt(t, providerSK, byAddress, "lnbc10u1x", 1_000_000)); !reject || !strings.HasPrefix(msg, "error:") {
+		t.Errorf("unreachable provider: %v %q", reject, msg)
+	}
+
+	totals, err := recipeZapTotals(ctx, []string{address, fmt.Sprintf("%d:%s:waffles", KindRecipe, chef)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(totals) != 1 || totals[address] != (zapTotal{Zaps: 2, Sats: 1_250}) {
+		t.Fatalf("totals %+v", totals)
+	}
+}